@@ -1,33 +1,64 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"syscall"
+	"time"
 
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/datafile"
+	"github.com/mriaz/vpn-core/internal/desktopnotify"
+	"github.com/mriaz/vpn-core/internal/instance"
 	"github.com/mriaz/vpn-core/internal/ipc"
+	"github.com/mriaz/vpn-core/internal/lastrun"
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/paths"
+	"github.com/mriaz/vpn-core/internal/perfreport"
+	"github.com/mriaz/vpn-core/internal/profiles"
 	"github.com/mriaz/vpn-core/internal/service"
+	"github.com/mriaz/vpn-core/internal/settings"
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+	"github.com/mriaz/vpn-core/internal/usage"
 	"github.com/mriaz/vpn-core/internal/vpn"
+	"github.com/mriaz/vpn-core/internal/winevent"
 )
 
 func main() {
 	installFlag := flag.Bool("install", false, "Install as Windows service")
 	uninstallFlag := flag.Bool("uninstall", false, "Uninstall Windows service")
+	purgeFlag := flag.Bool("purge", false, "With -uninstall: also remove the TUN adapter, firewall rules and all data in %ProgramData%\\MRVPN")
+	instanceFlag := flag.String("instance", "", "Run as a separate named instance with its own pipe, service, data directory, adapter and ports, alongside the default install")
 	interactiveFlag := flag.Bool("interactive", false, "Run in interactive (non-service) mode")
+	slowRPCFlag := flag.Duration("slow-rpc", 2*time.Second, "Log RPC calls slower than this (0 disables)")
+	iconWorkersFlag := flag.Int("icon-workers", splittunnel.DefaultIconWorkers, "Icons apps.list extracts in parallel (1-32)")
 	flag.Parse()
+	splittunnel.SetIconWorkers(*iconWorkersFlag)
+	inst, err := instance.New(*instanceFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths.SetInstance(inst)
 
 	switch {
 	case *installFlag:
-		if err := service.Install(); err != nil {
+		if err := service.Install(inst); err != nil {
 			log.Fatalf("Failed to install service: %v", err)
 		}
-		log.Println("Service installed successfully. Start it with: net start MRVPN")
+		log.Printf("Service installed successfully. Start it with: net start %s", inst.ServiceName())
 		return
 
 	case *uninstallFlag:
-		if err := service.Uninstall(); err != nil {
+		report, err := service.Uninstall(inst, *purgeFlag)
+		if report != nil {
+			log.Printf("Cleanup summary:\n%s", report)
+		}
+		if err != nil {
 			log.Fatalf("Failed to uninstall service: %v", err)
 		}
 		log.Println("Service uninstalled successfully.")
@@ -35,14 +66,14 @@ func main() {
 
 	case *interactiveFlag:
 		log.Println("Running in interactive mode...")
-		runCore(nil)
+		runCore(inst, nil, nil, nil, *slowRPCFlag)
 		return
 	}
 
 	// Default: try to run as Windows service
 	if service.IsRunningAsService() {
-		if err := service.RunAsService(func(stop <-chan struct{}) {
-			runCore(stop)
+		if err := service.RunAsService(inst, func(stop, resume <-chan struct{}, logons <-chan service.Logon) {
+			runCore(inst, stop, resume, logons, *slowRPCFlag)
 		}); err != nil {
 			log.Fatalf("Failed to run as service: %v", err)
 		}
@@ -50,57 +81,321 @@ func main() {
 		// Not a service, run interactively
 		log.Println("Not running as service, starting in interactive mode...")
 		log.Println("Use -install to install as a Windows service")
-		runCore(nil)
+		runCore(inst, nil, nil, nil, *slowRPCFlag)
 	}
 }
 
-func runCore(stop <-chan struct{}) {
+// runCore runs the service as inst until stopped. resume signals a wake
+// from sleep and logons user logons; both are nil outside service mode.
+func runCore(inst instance.Instance, stop, resume <-chan struct{}, logons <-chan service.Logon, slowRPC time.Duration) {
+	// Summary of this run, marked running until it ends, for
+	// diagnostics.lastRun after the next start. A panic here is the run's
+	// last words: the deferred cleanup below still disconnects, then it is
+	// logged and recorded and the process exits with its own code.
+	lastRun, err := lastrun.Start(paths.File(lastrun.FileName))
+	if err != nil {
+		log.Printf("warning: last run summary: %v", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			reportPanic(inst, lastRun, p)
+			os.Exit(lastrun.ExitCodePanic)
+		}
+		if err := lastRun.End(lastrun.EndStopped, nil, nil); err != nil {
+			log.Printf("warning: failed to record the end of the run: %v", err)
+		}
+	}()
+
 	// Initialize state machine
 	sm := vpn.NewStateMachine()
 
 	// Initialize VPN engine
 	engine := vpn.NewEngine(sm)
+	engine.SetInstance(inst)
+
+	// Load persisted settings and saved profiles. Whatever is wrong with
+	// the files is set aside or reset rather than stopping the service,
+	// and reported by diagnostics.lastRun.
+	guard, loadIssues := datafile.OpenGuard(paths.File(datafile.GuardFileName),
+		settings.FileName, profiles.FileName, profiles.SubscriptionsFileName)
+	settingsStore := settings.Open(paths.File(settings.FileName), guard)
+	profileStore := profiles.Open(paths.File(profiles.FileName), guard)
+	loadIssues = append(loadIssues, settingsStore.LoadIssues()...)
+	loadIssues = append(loadIssues, profileStore.LoadIssues()...)
+	for _, issue := range loadIssues {
+		log.Printf("warning: data file %s", issue)
+	}
+	engine.SetPowerMode(settingsStore.Get().PowerMode)
+	engine.SetHealthThresholds(ipc.HealthThresholds(settingsStore.Get()))
+	engine.SetDNSQueryLog(settingsStore.Get().DNSQueryLog)
+	// Health probes run outside any request; the dial timeout bounds them.
+	probe := func(server *parser.ServerConfig) (time.Duration, error) {
+		return ipc.ProbeLatency(context.Background(), server)
+	}
+	health := profiles.NewHealthMonitor(profileStore, paths.File(profiles.HealthFileName), probe)
+	performance := profiles.OpenPerformance(paths.File(profiles.PerformanceFileName))
+	iconDenylist := splittunnel.OpenIconDenylist(paths.File(splittunnel.IconDenylistFileName))
+	defer iconDenylist.Close()
+	splittunnel.SetIconDenylist(iconDenylist)
+
+	// Record connect stage timings per server for servers.performance
+	sm.OnConnectTiming(func(t vpn.ConnectTiming) {
+		performance.Record(t.Server, profiles.ConnectSample{
+			At:             t.At,
+			BuildMs:        t.BuildMs,
+			StartMs:        t.StartMs,
+			TotalMs:        t.TotalMs,
+			FirstTrafficMs: t.FirstTrafficMs,
+		})
+	})
+	sm.OnReconnect(func(r vpn.Reconnect) {
+		if r.Server != nil {
+			performance.RecordReconnect(r.Server, r.SessionStarted, r.At)
+		}
+	})
+	sm.OnSessionEnd(func(end vpn.SessionEnd) {
+		if end.Server != nil {
+			performance.RecordEnd(end.Server, end.StartedAt, end.EndedAt, end.Reason)
+		}
+	})
+
+	// Traffic per local calendar day for stats.getHistory
+	usageHistory, err := usage.Open(paths.File(usage.FileName))
+	if err != nil {
+		log.Printf("warning: %v, starting a new usage history", err)
+	}
+	sm.OnStats(func(stats vpn.Stats) {
+		if err := usageHistory.Record(stats.Traffic); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	})
+	sm.OnSessionEnd(func(vpn.SessionEnd) {
+		if err := usageHistory.EndSession(); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	})
+
+	// Tunnel speeds over the last minute for diagnostics.performanceReport
+	throughput := perfreport.NewMeter(time.Minute)
+	sm.OnStats(func(stats vpn.Stats) {
+		throughput.Record(time.Now(), stats.UpSpeed, stats.DownSpeed)
+	})
+	sm.OnSessionEnd(func(vpn.SessionEnd) { throughput.Reset() })
 
 	// Initialize IPC handler and server
-	handler := ipc.NewHandler(engine, sm)
-	server := ipc.NewServer(handler)
+	handler := ipc.NewHandler(engine, sm, settingsStore, profileStore, health, performance)
+	handler.SetSlowCallThreshold(slowRPC)
+	handler.SetLastRun(lastRun.Previous())
+	handler.SetLoadIssues(loadIssues)
+	handler.SetUsageHistory(usageHistory)
+	handler.SetThroughputMeter(throughput)
+	handler.SetServiceStatus(func() (ipc.ServiceStatus, error) {
+		info, err := service.Status(inst)
+		return ipc.ServiceStatus{Installed: info.Installed, Running: info.Running, AutoStart: info.AutoStart}, err
+	})
+	server := ipc.NewServer(handler, inst)
 
 	// Set up state change notifications
-	sm.OnStateChange(func(state vpn.State, err error) {
-		errMsg := ""
-		if err != nil {
-			errMsg = err.Error()
-		}
-		server.Broadcast(&ipc.Notification{
+	sm.OnTransition(func(t vpn.Transition) {
+		server.Broadcast(ipc.TopicState, &ipc.Notification{
 			Method: "vpn.stateChanged",
-			Params: ipc.StateChangedParams{
-				State: string(state),
-				Error: errMsg,
-			},
+			Params: ipc.NewStateChangedParams(t),
 		})
 	})
 
+	// Keep the last run summary's VPN state current
+	sm.OnTransition(func(t vpn.Transition) {
+		server := ""
+		if t.Server != nil && t.State != vpn.StateDisconnected {
+			server = t.Server.Name
+		}
+		if err := lastRun.SetState(string(t.State), server); err != nil {
+			log.Printf("warning: failed to update the last run summary: %v", err)
+		}
+	})
+
 	// Set up stats notifications
-	sm.OnStats(func(upload, download, upSpeed, downSpeed int64) {
-		server.Broadcast(&ipc.Notification{
+	sm.OnStats(func(stats vpn.Stats) {
+		server.Broadcast(ipc.TopicStats, &ipc.Notification{
 			Method: "vpn.statsUpdate",
 			Params: ipc.StatsUpdateParams{
-				Upload:    upload,
-				Download:  download,
-				UpSpeed:   upSpeed,
-				DownSpeed: downSpeed,
+				Upload:         stats.Upload,
+				Download:       stats.Download,
+				UpSpeed:        stats.UpSpeed,
+				DownSpeed:      stats.DownSpeed,
+				DirectUpload:   stats.DirectUpload,
+				DirectDownload: stats.DirectDownload,
+				RTTMs:          stats.RTTMs,
+				TunUpload:      stats.TunUpload,
+				TunDownload:    stats.TunDownload,
 			},
 		})
 	})
 
+	// Set up connection tracing notifications (debug.traceConnections)
+	sm.OnConnMatched(func(match vpn.ConnMatch) {
+		server.Broadcast(ipc.TopicLogs, &ipc.Notification{
+			Method: "debug.connMatched",
+			Params: match,
+		})
+	})
+
+	// Tell the user the first time the kill switch holds traffic in a session
+	sm.OnKillSwitchEngaged(func(stats vpn.KillSwitchStats) {
+		server.Broadcast(ipc.TopicAlerts, &ipc.Notification{
+			Method: "vpn.killSwitchEngaged",
+			Params: ipc.NewKillSwitchStatus(stats),
+		})
+	})
+
+	// Tell the user the first time a session leaks connections past the
+	// tunnel while its routes are set up
+	sm.OnEarlyLeak(func(leak vpn.EarlyLeak) {
+		server.Broadcast(ipc.TopicAlerts, &ipc.Notification{
+			Method: "vpn.earlyLeakDetected",
+			Params: leak,
+		})
+	})
+
+	// Tell the user when a connected session stops answering in time, and
+	// when it recovers
+	sm.OnHealthChanged(func(health vpn.SessionHealth) {
+		server.Broadcast(ipc.TopicState, &ipc.Notification{
+			Method: "vpn.healthChanged",
+			Params: health,
+		})
+	})
+
+	// Tell the user when traffic stats freeze because the Clash API stopped
+	// answering
+	sm.OnStatsStalled(func(stall vpn.StatsStall) {
+		server.Broadcast(ipc.TopicAlerts, &ipc.Notification{
+			Method: "diagnostics.statsStalled",
+			Params: stall,
+		})
+	})
+
+	// Tell the user, once per session, when the Clash API cannot be reached
+	// even on a new port, so the session runs without stats
+	sm.OnStatsUnavailable(func(u vpn.StatsUnavailable) {
+		server.Broadcast(ipc.TopicAlerts, &ipc.Notification{
+			Method: "diagnostics.statsUnavailable",
+			Params: u,
+		})
+	})
+
+	// Tell the user when packets below the configured MTU stall through the
+	// tunnel, with the MTU to use instead
+	sm.OnMTUWarning(func(probe vpn.MTUProbe) {
+		server.Broadcast(ipc.TopicAlerts, &ipc.Notification{
+			Method: "vpn.mtuWarning",
+			Params: probe,
+		})
+	})
+
+	// Desktop toasts for session events while no UI is connected to show
+	// them (settings.desktopNotifications)
+	toasts := desktopnotify.NewDispatcher(desktopnotify.Toast{}, func() desktopnotify.Settings {
+		return settingsStore.Get().DesktopNotifications
+	}, func() bool {
+		return server.ClientCount() > 0
+	})
+	sm.OnTransition(toasts.Transition)
+	sm.OnKillSwitchEngaged(toasts.KillSwitchEngaged)
+
+	// Session events in the Windows Event Log for enterprise log collection
+	// (settings.eventLogEnabled, on by default as a service)
+	if elog, err := winevent.Open(inst.ServiceName()); err != nil {
+		log.Printf("event log unavailable, session events are not written to it: %v", err)
+	} else {
+		defer elog.Close()
+		events := winevent.NewEmitter(elog, func() bool {
+			if enabled := settingsStore.Get().EventLogEnabled; enabled != nil {
+				return *enabled
+			}
+			return stop != nil
+		})
+		sm.OnTransition(events.Transition)
+		sm.OnKillSwitchEngaged(events.KillSwitchEngaged)
+		sm.OnReconnect(events.Reconnect)
+	}
+
+	// Append-only log of state-changing calls, with the client behind each
+	// (audit.query)
+	handler.SetAuditLog(audit.Open(paths.File(audit.FileName), func() audit.Retention {
+		return settingsStore.Get().AuditRetention()
+	}))
+
+	// Notifications the handler raises itself, such as split tunnel app
+	// entries whose app was uninstalled or replaced
+	handler.SetNotifier(server)
+
 	// Start IPC server
 	if err := server.Start(); err != nil {
 		log.Fatalf("Failed to start IPC server: %v", err)
 	}
-	defer server.Stop()
-	defer engine.Disconnect()
+	// Stop taking clients and calls and let those in flight finish before
+	// the engine goes, then close the clients
+	defer server.Shutdown(ipc.ShutdownDrain, func() {
+		if err := engine.Disconnect(); err != nil {
+			log.Printf("warning: disconnect on shutdown failed: %v", err)
+		}
+	})
+
+	// Background profile health checks (opt-in via settings)
+	healthStop := make(chan struct{})
+	defer close(healthStop)
+	go health.Run(healthStop, func() (bool, time.Duration) {
+		cfg := settingsStore.Get()
+		return cfg.HealthMonitor, time.Duration(cfg.HealthIntervalMinutes) * time.Minute
+	}, func() bool {
+		state := sm.State()
+		return state != vpn.StateDisconnected && state != vpn.StateError
+	})
+
+	// Daily split tunnel app reconciliation (also runs on apps.list)
+	staleStop := make(chan struct{})
+	defer close(staleStop)
+	go handler.RunStaleAppsCheck(staleStop, 24*time.Hour)
+
+	// Expiry of apps.exportIcons directories, all removed on shutdown
+	iconExportStop := make(chan struct{})
+	defer close(iconExportStop)
+	go handler.RunIconExportSweeper(iconExportStop)
+
+	// Subscription auto-updates (subscriptions.save autoUpdateHours)
+	subscriptionStop := make(chan struct{})
+	defer close(subscriptionStop)
+	go handler.RunSubscriptionUpdates(subscriptionStop)
 
-	log.Println("MRVPN core service started")
+	// Time-of-day schedules (settings.schedules), caught up on resume
+	scheduleStop := make(chan struct{})
+	defer close(scheduleStop)
+	go handler.RunScheduler(scheduleStop, resume)
+
+	// Starting the UI at logon (settings.launchUiOnLogon); only the
+	// service sees logons and can start programs in a user's session
+	if logons != nil {
+		handler.SetUILauncher(service.LaunchInSession)
+		logonStop := make(chan struct{})
+		defer close(logonStop)
+		go func() {
+			for {
+				select {
+				case l := <-logons:
+					handler.OnLogon(l.SessionID, l.Console)
+				case <-logonStop:
+					return
+				}
+			}
+		}()
+	}
+
+	if inst.IsDefault() {
+		log.Println("MRVPN core service started")
+	} else {
+		log.Printf("MRVPN core service started as instance %s", inst.Name())
+	}
 
 	// Wait for stop signal from any source
 	sigChan := make(chan os.Signal, 1)
@@ -127,3 +422,17 @@ func runCore(stop <-chan struct{}) {
 
 	log.Println("MRVPN core service stopping...")
 }
+
+// reportPanic logs a panic that ended runCore, with its stack, to the log
+// and the Event Log, and records it as the end of the run.
+func reportPanic(inst instance.Instance, lastRun *lastrun.Recorder, p interface{}) {
+	stack := debug.Stack()
+	log.Printf("panic: %v\n%s", p, stack)
+	if elog, err := winevent.Open(inst.ServiceName()); err == nil {
+		elog.Error(winevent.IDServicePanic, fmt.Sprintf("The VPN service stopped after an internal error: %v\n\n%s", p, stack))
+		elog.Close()
+	}
+	if err := lastRun.End(lastrun.EndPanic, p, stack); err != nil {
+		log.Printf("failed to record the panic in the last run summary: %v", err)
+	}
+}
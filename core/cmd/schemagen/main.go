@@ -0,0 +1,25 @@
+// Command schemagen writes the JSON Schema of every IPC method's params and
+// result. It is run by go generate in internal/ipc, which embeds the output
+// and serves it through meta.schema.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/mriaz/vpn-core/internal/ipc"
+)
+
+func main() {
+	out := flag.String("o", "schemas.json", "Output file")
+	flag.Parse()
+
+	data, err := ipc.GenerateSchemas()
+	if err != nil {
+		log.Fatalf("Failed to generate schemas: %v", err)
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+}
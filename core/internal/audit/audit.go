@@ -0,0 +1,209 @@
+// Package audit keeps an append-only log of the calls that change the
+// service's state, for shared machines and enterprise deployments: who
+// called what, when, with which parameters and how it ended. It is kept
+// apart from the debug log as JSON lines, one Entry per line, and rotated
+// by size.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileName is the audit log inside the data directory. Rotated files are
+// named audit.1.jsonl, audit.2.jsonl and so on, oldest last.
+const FileName = "audit.jsonl"
+
+// Outcomes of an audited call.
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+// Actor is who made a call. Calls the service makes itself, such as a
+// scheduled connect, have no process and name their Origin instead.
+type Actor struct {
+	PID    uint32 `json:"pid,omitempty"`
+	Image  string `json:"image,omitempty"`  // full path of the client's executable
+	User   string `json:"user,omitempty"`   // SID of the client process's user
+	Origin string `json:"origin,omitempty"` // e.g. "schedule"
+}
+
+// Entry is one audited call.
+type Entry struct {
+	Time       time.Time       `json:"time"`
+	Method     string          `json:"method"`
+	RequestID  string          `json:"requestId,omitempty"`
+	Actor      Actor           `json:"actor"`
+	Params     json.RawMessage `json:"params,omitempty"` // see Redact
+	Outcome    string          `json:"outcome"`
+	ErrorKey   string          `json:"errorKey,omitempty"`
+	DurationMs int64           `json:"durationMs"`
+}
+
+// Retention bounds the disk the log takes: the current file is rotated
+// once it reaches MaxSizeMB, and Keep rotated files are kept.
+type Retention struct {
+	MaxSizeMB int
+	Keep      int
+}
+
+// DefaultRetention keeps up to 25MB of history.
+var DefaultRetention = Retention{MaxSizeMB: 5, Keep: 4}
+
+// Validate checks the retention is within range.
+func (r Retention) Validate() error {
+	if r.MaxSizeMB < 1 || r.MaxSizeMB > 100 {
+		return fmt.Errorf("auditMaxSizeMb must be between 1 and 100")
+	}
+	if r.Keep < 1 || r.Keep > 20 {
+		return fmt.Errorf("auditKeepFiles must be between 1 and 20")
+	}
+	return nil
+}
+
+// Log is the audit log at a path. It is safe for concurrent use.
+type Log struct {
+	mu        sync.Mutex
+	path      string
+	retention func() Retention
+}
+
+// Open returns the log at path, created on the first Append. retention is
+// read on every append, so a settings change applies at once.
+func Open(path string, retention func() Retention) *Log {
+	return &Log{path: path, retention: retention}
+}
+
+// Append writes e to the log, rotating it first if e would take it past
+// its maximum size.
+func (l *Log) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.retention()
+	if info, err := os.Stat(l.path); err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > int64(r.MaxSizeMB)<<20 {
+		if err := l.rotate(r.Keep); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rotate shifts the rotated files up by one, dropping those beyond keep,
+// and moves the current file to the first; mu must be held.
+func (l *Log) rotate(keep int) error {
+	for i := keep; ; i++ {
+		if err := os.Remove(l.rotated(i)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(l.path, l.rotated(1))
+}
+
+// rotated returns the path of the nth most recent rotated file.
+func (l *Log) rotated(n int) string {
+	ext := filepath.Ext(l.path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(l.path, ext), n, ext)
+}
+
+// Query selects entries. Zero From or To leaves that end open; an empty
+// Method matches every method.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Method string
+	Limit  int // most recent entries returned; 0 for all
+}
+
+func (q Query) matches(e *Entry) bool {
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && e.Time.After(q.To) {
+		return false
+	}
+	return q.Method == "" || e.Method == q.Method
+}
+
+// Query returns the matching entries of the current and rotated files,
+// oldest first. With a limit it returns the most recent ones, and
+// truncated reports that older matches were left out. Lines that do not
+// parse, as one cut short by a crash, are skipped.
+func (l *Log) Query(q Query) (entries []Entry, truncated bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Oldest first: the highest-numbered rotated file down to the current.
+	files := []string{l.path}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(l.rotated(i)); err != nil {
+			break
+		}
+		files = append([]string{l.rotated(i)}, files...)
+	}
+
+	entries = []Entry{}
+	for _, path := range files {
+		if err := readEntries(path, q, &entries); err != nil {
+			return nil, false, err
+		}
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+		truncated = true
+	}
+	return entries, truncated, nil
+}
+
+// readEntries appends the entries of the file at path that match q.
+func readEntries(path string, q Query, entries *[]Entry) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var e Entry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if q.matches(&e) {
+			*entries = append(*entries, e)
+		}
+	}
+	return scanner.Err()
+}
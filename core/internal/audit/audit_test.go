@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendAndQuery(t *testing.T) {
+	l := Open(filepath.Join(t.TempDir(), FileName), func() Retention { return DefaultRetention })
+	base := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	for i, method := range []string{"vpn.connect", "settings.set", "vpn.disconnect", "vpn.connect"} {
+		if err := l.Append(Entry{Time: base.Add(time.Duration(i) * time.Minute), Method: method, Outcome: OutcomeOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"all", Query{}, []string{"vpn.connect", "settings.set", "vpn.disconnect", "vpn.connect"}},
+		{"method", Query{Method: "vpn.connect"}, []string{"vpn.connect", "vpn.connect"}},
+		{"range", Query{From: base.Add(time.Minute), To: base.Add(2 * time.Minute)}, []string{"settings.set", "vpn.disconnect"}},
+		{"limit keeps the newest", Query{Limit: 2}, []string{"vpn.disconnect", "vpn.connect"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, truncated, err := l.Query(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Method)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if truncated != (tt.q.Limit > 0) {
+				t.Errorf("truncated = %v", truncated)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, FileName)
+	retention := Retention{MaxSizeMB: 1, Keep: 2}
+	l := Open(path, func() Retention { return retention })
+
+	// Each entry takes about 100KB, so a file holds 10 of them.
+	params, _ := json.Marshal(strings.Repeat("x", 100<<10))
+	base := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 45; i++ {
+		e := Entry{Time: base.Add(time.Duration(i) * time.Second), Method: fmt.Sprintf("m%d", i), Params: params, Outcome: OutcomeOK}
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{FileName, "audit.1.jsonl", "audit.2.jsonl"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1<<20 {
+			t.Errorf("%s is %d bytes, over the 1MB limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.3.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("audit.3.jsonl kept beyond Keep: %v", err)
+	}
+
+	// What is left is the newest history, in order.
+	entries, _, err := l.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 20 || entries[len(entries)-1].Method != "m44" {
+		t.Fatalf("got %d entries ending %+v", len(entries), entries[len(entries)-1].Method)
+	}
+	for i := 1; i < len(entries); i++ {
+		if !entries[i].Time.After(entries[i-1].Time) {
+			t.Fatalf("entries out of order at %d", i)
+		}
+	}
+
+	// Lowering Keep drops the surplus on the next rotation.
+	retention.Keep = 1
+	for i := 45; i < 56; i++ {
+		l.Append(Entry{Time: base.Add(time.Duration(i) * time.Second), Method: "late", Params: params})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.2.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("audit.2.jsonl kept after lowering Keep: %v", err)
+	}
+}
+
+func TestQuerySkipsTornLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	l := Open(path, func() Retention { return DefaultRetention })
+	l.Append(Entry{Time: time.Now(), Method: "vpn.connect"})
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"time":"2026-10-16T09:00:00Z","meth`)
+	f.Close()
+
+	entries, _, err := l.Query(Query{})
+	if err != nil || len(entries) != 1 {
+		t.Errorf("got %+v, %v; want the one whole entry", entries, err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		want   string
+	}{
+		{"link", `{"link":"vless://11111111-2222@example.com:443?pbk=k&sid=ab#Home","policy":"replace"}`,
+			`{"link":"vless://example.com:443","policy":"replace"}`},
+		{"links", `{"links":["hysteria2://secret@[2001:db8::1]:8443#A","garbage"]}`,
+			`{"links":["hysteria2://[2001:db8::1]:8443","[redacted]"]}`},
+		{"subscription url", `{"name":"Provider","url":"https://sub.example.com/api/v1/client/subscribe?token=abc123"}`,
+			`{"name":"Provider","url":"https://sub.example.com"}`},
+		{"admin token", `{"token":"hunter2"}`, `{"token":"[redacted]"}`},
+		{"raw outbound", `{"outbound":{"type":"trojan","server":"example.com","password":"p","tls":{"reality":{"public_key":"pk","short_id":"ab"}}}}`,
+			`{"outbound":{"password":"[redacted]","server":"example.com","tls":{"reality":{"public_key":"pk","short_id":"[redacted]"}},"type":"trojan"}}`},
+		{"parsed server", `{"server":{"protocol":"vless","params":{"uuid":"u","obfs-password":"o","sni":"a.com"}}}`,
+			`{"server":{"params":{"obfs-password":"[redacted]","sni":"a.com","uuid":"[redacted]"},"protocol":"vless"}}`},
+		{"not json", `{"link":`, `"[redacted]"`},
+		{"too large", `{"apps":["` + strings.Repeat("a", maxParamsBytes) + `"]}`, `"[4109 bytes omitted]"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(Redact(json.RawMessage(tt.params))); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+	if got := Redact(nil); got != nil {
+		t.Errorf("Redact(nil) = %s", got)
+	}
+}
@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// maxParamsBytes caps the params kept per entry; a larger summary, such as
+// a long app list, is replaced by its size.
+const maxParamsBytes = 4 << 10
+
+const redacted = "[redacted]"
+
+// secretKeys are the param names, at any depth, whose values are replaced
+// by redacted. Names containing "password", "token" or "secret" are too.
+var secretKeys = map[string]bool{
+	"uuid":           true,
+	"auth":           true,
+	"psk":            true,
+	"sid":            true, // REALITY short ID
+	"short_id":       true,
+	"private_key":    true,
+	"pre_shared_key": true,
+}
+
+// linkKeys are the param names holding share links, which carry the
+// credentials in their user part. They are reduced to protocol, host and
+// port.
+var linkKeys = map[string]bool{
+	"link":  true,
+	"links": true,
+}
+
+// urlKeys are the param names holding URLs, such as a subscription's, which
+// often carry an access token in their path or query. They are reduced to
+// scheme and host.
+var urlKeys = map[string]bool{
+	"url": true,
+}
+
+// Redact returns a copy of params, a JSON value, with credentials removed:
+// secret fields are replaced and links reduced to where they point. Params
+// that are not valid JSON are dropped entirely.
+func Redact(params json.RawMessage) json.RawMessage {
+	if len(params) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(params, &v); err != nil {
+		return json.RawMessage(`"` + redacted + `"`)
+	}
+	out, err := json.Marshal(redactValue(v, false))
+	if err != nil {
+		return nil
+	}
+	if len(out) > maxParamsBytes {
+		out, _ = json.Marshal(fmt.Sprintf("[%d bytes omitted]", len(out)))
+	}
+	return out
+}
+
+func redactValue(v interface{}, link bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			switch {
+			case isSecret(k):
+				v[k] = redacted
+			case urlKeys[k]:
+				v[k] = urlSummary(field)
+			default:
+				v[k] = redactValue(field, linkKeys[k])
+			}
+		}
+		return v
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = redactValue(elem, link)
+		}
+		return v
+	case string:
+		if link {
+			return linkSummary(v)
+		}
+	}
+	return v
+}
+
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	return secretKeys[key] || strings.Contains(key, "password") || strings.Contains(key, "token") || strings.Contains(key, "secret")
+}
+
+// urlSummary reduces a URL to scheme://host.
+func urlSummary(v interface{}) interface{} {
+	s, _ := v.(string)
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// linkSummary reduces a share link to protocol://host:port.
+func linkSummary(link string) string {
+	server, err := parser.ParseLink(link)
+	if err != nil {
+		return redacted
+	}
+	return server.Protocol + "://" + net.JoinHostPort(server.Address, strconv.Itoa(int(server.Port)))
+}
@@ -0,0 +1,121 @@
+// Package datafile loads the service's JSON data files, such as the
+// settings and profiles, defensively. The service runs as SYSTEM and reads
+// them from ProgramData, where an administrator or a compromised updater
+// could change them, and a file it cannot use must not keep it from
+// starting. Load quarantines a file that cannot be read instead of
+// failing, a Guard detects a file the service did not save itself, and
+// each store resets or drops what is out of its bounds. What was found is
+// reported as Issues, which diagnostics.lastRun lists.
+package datafile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Issue kinds.
+const (
+	IssueUnreadable   = "unreadable"    // not JSON, truncated or too large; quarantined
+	IssueTampered     = "tampered"      // changed outside the service; quarantined
+	IssueReplayed     = "replayed"      // an older version the service saved was put back; quarantined
+	IssueDeleted      = "deleted"       // deleted outside the service
+	IssueInvalidField = "invalid_field" // a field or entry out of bounds; reset to its default or dropped
+	IssueGuardReset   = "guard_reset"   // the Guard's state could not be read or is missing; files are trusted as found
+)
+
+// QuarantineSuffix is appended to a quarantined file. Only the last one
+// of each file is kept, for support.
+const QuarantineSuffix = ".quarantined"
+
+// Issue is a problem found loading a data file.
+type Issue struct {
+	File string `json:"file"` // name in the data directory, e.g. "settings.json"
+	Kind string `json:"kind" jsonschema:"enum=unreadable|tampered|replayed|deleted|invalid_field|guard_reset"`
+	// For IssueInvalidField, the field, such as "healthIntervalMinutes",
+	// or the entry of a list, such as "[3]".
+	Field  string `json:"field,omitempty"`
+	Detail string `json:"detail"` // English description for logs and support
+}
+
+func (i Issue) String() string {
+	if i.Field != "" {
+		return fmt.Sprintf("%s: %s %s: %s", i.File, i.Kind, i.Field, i.Detail)
+	}
+	return fmt.Sprintf("%s: %s: %s", i.File, i.Kind, i.Detail)
+}
+
+// InvalidField returns the issue of a field of file reset or dropped for
+// cause.
+func InvalidField(file, field string, cause error) Issue {
+	return Issue{File: filepath.Base(file), Kind: IssueInvalidField, Field: field, Detail: cause.Error()}
+}
+
+// Load reads the data file at path, checks it with guard, which may be
+// nil, and passes it to decode. found is false when the file is missing or
+// was quarantined, and the store keeps its defaults; decode must leave
+// them alone when it fails. A file over limit bytes is not read.
+func Load(path string, limit int64, guard *Guard, decode func(data []byte) error) (found bool, issues []Issue) {
+	name := filepath.Base(path)
+	data, err := readLimited(path, limit)
+	if errors.Is(err, os.ErrNotExist) {
+		if guard.forget(name) {
+			issues = append(issues, Issue{File: name, Kind: IssueDeleted, Detail: "deleted outside the service; using defaults"})
+		}
+		return false, issues
+	}
+	if err == nil {
+		if err = guard.Check(name, data); err != nil {
+			kind := IssueTampered
+			if errors.Is(err, ErrReplayed) {
+				kind = IssueReplayed
+			}
+			guard.forget(name)
+			return false, []Issue{quarantine(path, kind, err)}
+		}
+		err = decode(data)
+	}
+	if err != nil {
+		guard.forget(name)
+		return false, []Issue{quarantine(path, IssueUnreadable, err)}
+	}
+	return true, nil
+}
+
+// readLimited reads the file at path unless it is over limit bytes.
+func readLimited(path string, limit int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+// quarantine moves the file at path aside, so the service starts with
+// defaults and the next save writes a new file, and returns the issue.
+func quarantine(path, kind string, cause error) Issue {
+	issue := Issue{File: filepath.Base(path), Kind: kind}
+	if err := Quarantine(path); err != nil {
+		issue.Detail = fmt.Sprintf("%v; using defaults, but the file could not be moved aside: %v", cause, err)
+	} else {
+		issue.Detail = fmt.Sprintf("%v; using defaults, the file was moved to %s", cause, issue.File+QuarantineSuffix)
+	}
+	return issue
+}
+
+// Quarantine moves the file at path to path+QuarantineSuffix, replacing
+// an earlier one.
+func Quarantine(path string) error {
+	os.Remove(path + QuarantineSuffix)
+	return os.Rename(path, path+QuarantineSuffix)
+}
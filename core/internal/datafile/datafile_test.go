@@ -0,0 +1,193 @@
+package datafile
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func decodeInto(v interface{}) func([]byte) error {
+	return func(data []byte) error { return json.Unmarshal(data, v) }
+}
+
+func kinds(issues []Issue) []string {
+	var out []string
+	for _, i := range issues {
+		out = append(out, i.Kind)
+	}
+	return out
+}
+
+func TestLoadQuarantinesUnreadable(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"corrupted", "{\x00\x01garbage"},
+		{"truncated", `{"healthMonitor": true, "schedu`},
+		{"too large", `{"pad": "` + strings.Repeat("x", 100) + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "settings.json")
+			os.WriteFile(path, []byte(tt.data), 0o644)
+			var v map[string]interface{}
+			found, issues := Load(path, 64, nil, decodeInto(&v))
+			if found || len(issues) != 1 || issues[0].Kind != IssueUnreadable || issues[0].File != "settings.json" {
+				t.Fatalf("Load = %v, %+v", found, issues)
+			}
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("file left in place: %v", err)
+			}
+			if data, _ := os.ReadFile(path + QuarantineSuffix); string(data) != tt.data {
+				t.Errorf("quarantined = %q", data)
+			}
+		})
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	found, issues := Load(filepath.Join(t.TempDir(), "settings.json"), 64, nil, decodeInto(new(interface{})))
+	if found || len(issues) != 0 {
+		t.Errorf("Load = %v, %+v", found, issues)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	dir := t.TempDir()
+	guardPath := filepath.Join(dir, GuardFileName)
+	path := filepath.Join(dir, "profiles.json")
+	g, issues := OpenGuard(guardPath)
+	if len(issues) != 0 {
+		t.Fatalf("new guard: %+v", issues)
+	}
+
+	// A file from before the guard is trusted as found.
+	os.WriteFile(path, []byte(`["v0"]`), 0o644)
+	var v []string
+	if found, issues := Load(path, 1<<10, g, decodeInto(&v)); !found || len(issues) != 0 {
+		t.Fatalf("unrecorded file: %v, %+v", found, issues)
+	}
+	for _, version := range []string{`["v1"]`, `["v2"]`} {
+		if err := g.WriteFile(path, []byte(version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The record survives a restart.
+	g, issues = OpenGuard(guardPath)
+	if len(issues) != 0 {
+		t.Fatalf("reopened guard: %+v", issues)
+	}
+	if err := g.Check("profiles.json", []byte(`["v2"]`)); err != nil {
+		t.Errorf("saved version: %v", err)
+	}
+	if err := g.Check("profiles.json", []byte(`["v1"]`)); !errors.Is(err, ErrReplayed) {
+		t.Errorf("earlier version: %v, want ErrReplayed", err)
+	}
+	if err := g.Check("profiles.json", []byte(`["evil"]`)); !errors.Is(err, ErrTampered) {
+		t.Errorf("edited file: %v, want ErrTampered", err)
+	}
+	if err := g.Check("settings.json", []byte(`{}`)); err != nil {
+		t.Errorf("another file: %v", err)
+	}
+
+	// A tampered file is quarantined and its record dropped, so the next
+	// start does not report it again.
+	os.WriteFile(path, []byte(`["evil"]`), 0o644)
+	found, issues := Load(path, 1<<10, g, decodeInto(&v))
+	if found || len(issues) != 1 || issues[0].Kind != IssueTampered {
+		t.Fatalf("tampered file: %v, %+v", found, issues)
+	}
+	if found, issues := Load(path, 1<<10, g, decodeInto(&v)); found || len(issues) != 0 {
+		t.Errorf("after quarantine: %v, %+v", found, issues)
+	}
+}
+
+func TestGuardReplayAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.json")
+	g, _ := OpenGuard(filepath.Join(dir, GuardFileName))
+	g.WriteFile(path, []byte(`{"v":1}`))
+	g.WriteFile(path, []byte(`{"v":2}`))
+
+	os.WriteFile(path, []byte(`{"v":1}`), 0o644)
+	var v map[string]int
+	if _, issues := Load(path, 1<<10, g, decodeInto(&v)); len(issues) != 1 || issues[0].Kind != IssueReplayed {
+		t.Errorf("replayed file: %+v", issues)
+	}
+
+	g.WriteFile(path, []byte(`{"v":3}`))
+	os.Remove(path)
+	if found, issues := Load(path, 1<<10, g, decodeInto(&v)); found || len(issues) != 1 || issues[0].Kind != IssueDeleted {
+		t.Errorf("deleted file: %v, %+v", found, issues)
+	}
+}
+
+func TestGuardSaveInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	guardPath := filepath.Join(dir, GuardFileName)
+	path := filepath.Join(dir, "settings.json")
+	g, _ := OpenGuard(guardPath)
+	g.WriteFile(path, []byte(`{"v":1}`))
+
+	// The service stopped after writing the file, before recording it.
+	f := g.state.Files["settings.json"]
+	f.Pending = g.sum("settings.json", []byte(`{"v":2}`))
+	if err := g.save(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, []byte(`{"v":2}`), 0o644)
+
+	g, _ = OpenGuard(guardPath)
+	var v map[string]int
+	if found, issues := Load(path, 1<<10, g, decodeInto(&v)); !found || len(issues) != 0 || v["v"] != 2 {
+		t.Errorf("Load = %v, %+v, %v", found, issues, v)
+	}
+	if err := g.Check("settings.json", []byte(`{"v":1}`)); !errors.Is(err, ErrReplayed) {
+		t.Errorf("version before the interrupted save: %v", err)
+	}
+}
+
+func TestGuardStateUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	guardPath := filepath.Join(dir, GuardFileName)
+	os.WriteFile(guardPath, []byte("not sealed"), 0o644)
+	g, issues := OpenGuard(guardPath)
+	if got := kinds(issues); len(got) != 1 || got[0] != IssueGuardReset {
+		t.Fatalf("issues = %+v", issues)
+	}
+	// Files are trusted as found, and guarded again from then on.
+	if err := g.Check("settings.json", []byte(`{}`)); err != nil {
+		t.Errorf("Check = %v", err)
+	}
+	if _, issues := OpenGuard(guardPath); len(issues) != 0 {
+		t.Errorf("replaced state: %+v", issues)
+	}
+}
+
+func TestGuardStateMissing(t *testing.T) {
+	dir := t.TempDir()
+	guardPath := filepath.Join(dir, GuardFileName)
+	// Without data files, a missing state is the first run.
+	if _, issues := OpenGuard(guardPath, "settings.json", "profiles.json"); len(issues) != 0 {
+		t.Fatalf("first run: %+v", issues)
+	}
+
+	// The state is deleted, or predates the guard, while data files exist.
+	os.Remove(guardPath)
+	os.WriteFile(filepath.Join(dir, "profiles.json"), []byte(`[]`), 0o644)
+	_, issues := OpenGuard(guardPath, "settings.json", "profiles.json")
+	if got := kinds(issues); len(got) != 1 || got[0] != IssueGuardReset {
+		t.Fatalf("issues = %+v", issues)
+	}
+	if !strings.Contains(issues[0].Detail, "profiles.json") {
+		t.Errorf("detail = %q", issues[0].Detail)
+	}
+	if _, issues := OpenGuard(guardPath, "settings.json", "profiles.json"); len(issues) != 0 {
+		t.Errorf("new state: %+v", issues)
+	}
+}
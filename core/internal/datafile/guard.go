@@ -0,0 +1,235 @@
+package datafile
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mriaz/vpn-core/internal/paths"
+)
+
+// GuardFileName is the Guard's state inside the data directory.
+const GuardFileName = "integrity.dat"
+
+// Errors of Guard.Check.
+var (
+	ErrTampered = errors.New("the file does not match what the service last saved")
+	ErrReplayed = errors.New("the file is an older version the service saved before")
+)
+
+// maxPrevious is how many earlier versions of a file a Guard remembers,
+// to tell a replayed file from other tampering.
+const maxPrevious = 8
+
+// Guard detects data files changed outside the service. It keeps an HMAC
+// of the version of each file the service last saved, keyed by a random
+// secret, in a state file sealed with MachineSealer; a file that does not
+// match is tampered with, or replayed if it matches an earlier version.
+//
+// A file the Guard has no record of, as on the first run, is trusted as
+// found. A save records the new version as pending before it writes the
+// file, so a crash in between leaves a file the Guard still accepts.
+//
+// A nil *Guard accepts every file and writes them unguarded.
+type Guard struct {
+	path   string
+	sealer Sealer
+
+	mu    sync.Mutex
+	state guardState
+}
+
+type guardState struct {
+	Key   []byte                `json:"key"`
+	Files map[string]*fileState `json:"files"`
+}
+
+// fileState holds the HMACs of the versions of a file, in hex.
+type fileState struct {
+	Current  string   `json:"current,omitempty"`  // the version last saved
+	Pending  string   `json:"pending,omitempty"`  // the version being saved
+	Previous []string `json:"previous,omitempty"` // earlier versions, newest first
+}
+
+// promote makes the pending version current.
+func (f *fileState) promote() {
+	if f.Current != "" {
+		f.Previous = append([]string{f.Current}, f.Previous...)
+		if len(f.Previous) > maxPrevious {
+			f.Previous = f.Previous[:maxPrevious]
+		}
+	}
+	f.Current, f.Pending = f.Pending, ""
+}
+
+// OpenGuard loads a Guard's state from path. guarded names the data files
+// it guards, in the same directory. A missing state starts a new one, as
+// on the first run. A state that cannot be read, as after a move to
+// another machine, starts a new one too and is reported, since the files
+// are then trusted as found; so is a missing state while guarded files
+// exist, as when it was deleted, or once on the upgrade that adds it.
+func OpenGuard(path string, guarded ...string) (*Guard, []Issue) {
+	g := &Guard{path: path, sealer: MachineSealer}
+	var issues []Issue
+	err := g.load()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if found := existing(filepath.Dir(path), guarded); len(found) > 0 {
+			issues = append(issues, Issue{File: filepath.Base(path), Kind: IssueGuardReset,
+				Detail: fmt.Sprintf("the integrity state is missing but %s exist; data files are trusted as found", strings.Join(found, ", "))})
+		}
+	case err != nil:
+		issues = append(issues, Issue{File: filepath.Base(path), Kind: IssueGuardReset,
+			Detail: fmt.Sprintf("%v; data files are trusted as found", err)})
+	}
+	if err != nil {
+		g.state = guardState{Key: make([]byte, 32), Files: make(map[string]*fileState)}
+		if _, err := rand.Read(g.state.Key); err != nil {
+			panic(err)
+		}
+		if err := g.save(); err != nil {
+			log.Printf("warning: failed to save the data file integrity state: %v", err)
+		}
+	}
+	return g, issues
+}
+
+// existing returns the names of the files in dir that exist.
+func existing(dir string, names []string) []string {
+	var found []string
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+func (g *Guard) load() error {
+	sealed, err := os.ReadFile(g.path)
+	if err != nil {
+		return err
+	}
+	data, err := g.sealer.Unseal(sealed)
+	if err != nil {
+		return fmt.Errorf("failed to unseal the integrity state: %w", err)
+	}
+	var state guardState
+	if err := json.Unmarshal(data, &state); err != nil || len(state.Key) < 16 {
+		return errors.New("the integrity state is corrupt")
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*fileState)
+	}
+	g.state = state
+	return nil
+}
+
+// save writes the state. Caller holds g.mu, or owns g.
+func (g *Guard) save() error {
+	data, err := json.Marshal(g.state)
+	if err != nil {
+		return err
+	}
+	sealed, err := g.sealer.Seal(data)
+	if err != nil {
+		return fmt.Errorf("failed to seal the integrity state: %w", err)
+	}
+	return paths.WriteFileAtomic(g.path, sealed)
+}
+
+// sum returns the HMAC of the contents of the named file, in hex.
+func (g *Guard) sum(name string, data []byte) string {
+	mac := hmac.New(sha256.New, g.state.Key)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check verifies the contents of the named data file against the version
+// the service last saved, failing with ErrTampered or ErrReplayed. A file
+// without a record is recorded as found.
+func (g *Guard) Check(name string, data []byte) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sum := g.sum(name, data)
+	f := g.state.Files[name]
+	switch {
+	case f == nil:
+		g.state.Files[name] = &fileState{Current: sum}
+	case hmac.Equal([]byte(sum), []byte(f.Current)):
+		return nil
+	case f.Pending != "" && hmac.Equal([]byte(sum), []byte(f.Pending)):
+		// Saved, but the service stopped before it recorded so.
+		f.promote()
+	case slices.Contains(f.Previous, sum):
+		return ErrReplayed
+	default:
+		return ErrTampered
+	}
+	if err := g.save(); err != nil {
+		log.Printf("warning: failed to save the data file integrity state: %v", err)
+	}
+	return nil
+}
+
+// WriteFile saves data to the data file at path, recording the new
+// version.
+func (g *Guard) WriteFile(path string, data []byte) error {
+	if g == nil {
+		return paths.WriteFileAtomic(path, data)
+	}
+	name := filepath.Base(path)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f := g.state.Files[name]
+	if f == nil {
+		f = &fileState{}
+		g.state.Files[name] = f
+	}
+	f.Pending = g.sum(name, data)
+	if err := g.save(); err != nil {
+		return err
+	}
+	if err := paths.WriteFileAtomic(path, data); err != nil {
+		return err
+	}
+	f.promote()
+	if err := g.save(); err != nil {
+		// The pending version still vouches for the file.
+		log.Printf("warning: failed to save the data file integrity state: %v", err)
+	}
+	return nil
+}
+
+// forget drops the record of the named file, as when it was deleted or
+// quarantined, reporting whether there was one.
+func (g *Guard) forget(name string) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.state.Files[name]; !ok {
+		return false
+	}
+	delete(g.state.Files, name)
+	if err := g.save(); err != nil {
+		log.Printf("warning: failed to save the data file integrity state: %v", err)
+	}
+	return true
+}
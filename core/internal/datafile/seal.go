@@ -0,0 +1,16 @@
+package datafile
+
+// Sealer encrypts data at rest so that only this machine, or the account
+// that sealed it, reads it back, and a forged copy fails to unseal.
+type Sealer interface {
+	Seal(data []byte) ([]byte, error)
+	Unseal(data []byte) ([]byte, error)
+}
+
+// The sealers of this platform: MachineSealer seals the Guard's state for
+// the machine, AccountSealer seals secrets in data files for the account
+// the service runs as.
+var (
+	MachineSealer Sealer = newSealer(true)
+	AccountSealer Sealer = newSealer(false)
+)
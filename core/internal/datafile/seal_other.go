@@ -0,0 +1,15 @@
+//go:build !windows
+
+package datafile
+
+// plainSealer stands in for DPAPI where there is none. The service only
+// ships for Windows; builds elsewhere are for development and tests, so
+// sealed data is kept as is.
+type plainSealer struct{}
+
+func newSealer(bool) Sealer {
+	return plainSealer{}
+}
+
+func (plainSealer) Seal(data []byte) ([]byte, error)   { return append([]byte(nil), data...), nil }
+func (plainSealer) Unseal(data []byte) ([]byte, error) { return append([]byte(nil), data...), nil }
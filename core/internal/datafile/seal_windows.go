@@ -0,0 +1,52 @@
+package datafile
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// dpapi seals with DPAPI, for the machine or the calling account.
+type dpapi struct {
+	machine bool
+}
+
+func newSealer(machine bool) Sealer {
+	return dpapi{machine: machine}
+}
+
+func (d dpapi) Seal(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	flags := uint32(windows.CRYPTPROTECT_UI_FORBIDDEN)
+	if d.machine {
+		flags |= windows.CRYPTPROTECT_LOCAL_MACHINE
+	}
+	if err := windows.CryptProtectData(newBlob(data), nil, nil, 0, nil, flags, &out); err != nil {
+		return nil, err
+	}
+	return takeBlob(&out), nil
+}
+
+func (dpapi) Unseal(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(newBlob(data), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	return takeBlob(&out), nil
+}
+
+func newBlob(data []byte) *windows.DataBlob {
+	if len(data) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+}
+
+// takeBlob copies out a blob DPAPI allocated and frees it.
+func takeBlob(blob *windows.DataBlob) []byte {
+	if blob.Data == nil {
+		return nil
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(blob.Data)))
+	return append([]byte(nil), unsafe.Slice(blob.Data, blob.Size)...)
+}
@@ -0,0 +1,270 @@
+// Package desktopnotify tells the user about session events that happen
+// while no UI is connected to report them, such as a dropped tunnel or a
+// data cap ending the session, with a Windows toast notification.
+package desktopnotify
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// Events a desktop notification can be shown for.
+const (
+	EventUnexpectedDisconnect = "unexpectedDisconnect" // a connected session failed
+	EventReconnectSucceeded   = "reconnectSucceeded"   // a connect after a drop came up
+	EventReconnectFailed      = "reconnectFailed"      // a connect after a drop failed
+	EventDataCapReached       = "dataCapReached"       // a data cap ended the session
+	EventKillSwitchEngaged    = "killSwitchEngaged"    // the kill switch held traffic
+	EventCrashRecovery        = "crashRecovery"        // state left by a crash was cleaned up
+)
+
+// ReconnectWindow is how soon after an unexpected disconnect a connect
+// counts as a reconnect.
+const ReconnectWindow = 5 * time.Minute
+
+// Settings configures desktop notifications. They are off unless Enabled,
+// and each event can be turned off on its own.
+type Settings struct {
+	Enabled    bool         `json:"enabled"`
+	Events     EventToggles `json:"events"`
+	QuietHours QuietHours   `json:"quietHours"`
+}
+
+// EventToggles turns notifications on per event.
+type EventToggles struct {
+	UnexpectedDisconnect bool `json:"unexpectedDisconnect"`
+	ReconnectSucceeded   bool `json:"reconnectSucceeded"`
+	ReconnectFailed      bool `json:"reconnectFailed"`
+	DataCapReached       bool `json:"dataCapReached"`
+	KillSwitchEngaged    bool `json:"killSwitchEngaged"`
+	CrashRecovery        bool `json:"crashRecovery"`
+}
+
+// QuietHours is a daily window, in local wall-clock time, during which no
+// notification is shown. A window whose End is before its Start runs past
+// midnight; leaving both empty disables quiet hours.
+type QuietHours struct {
+	Start string `json:"start"` // "HH:MM"
+	End   string `json:"end"`   // "HH:MM"
+}
+
+// DefaultSettings returns notifications off, with every event on once
+// they are enabled.
+func DefaultSettings() Settings {
+	return Settings{
+		Events: EventToggles{
+			UnexpectedDisconnect: true,
+			ReconnectSucceeded:   true,
+			ReconnectFailed:      true,
+			DataCapReached:       true,
+			KillSwitchEngaged:    true,
+			CrashRecovery:        true,
+		},
+	}
+}
+
+// Validate checks the quiet hours.
+func Validate(s Settings) error {
+	q := s.QuietHours
+	if q.Start == "" && q.End == "" {
+		return nil
+	}
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return fmt.Errorf("invalid quietHours.start %q", q.Start)
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return fmt.Errorf("invalid quietHours.end %q", q.End)
+	}
+	if start == end {
+		return fmt.Errorf("quietHours.start and quietHours.end must differ")
+	}
+	return nil
+}
+
+// enabled reports whether notifications for event are on.
+func (t EventToggles) enabled(event string) bool {
+	switch event {
+	case EventUnexpectedDisconnect:
+		return t.UnexpectedDisconnect
+	case EventReconnectSucceeded:
+		return t.ReconnectSucceeded
+	case EventReconnectFailed:
+		return t.ReconnectFailed
+	case EventDataCapReached:
+		return t.DataCapReached
+	case EventKillSwitchEngaged:
+		return t.KillSwitchEngaged
+	case EventCrashRecovery:
+		return t.CrashRecovery
+	}
+	return false
+}
+
+// contains reports whether at falls within the quiet hours.
+func (q QuietHours) contains(at time.Time) bool {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return false
+	}
+	m := at.Hour()*60 + at.Minute()
+	if start < end {
+		return m >= start && m < end
+	}
+	return m >= start || m < end
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok || len(h) != 2 || len(m) != 2 {
+		return 0, fmt.Errorf("not HH:MM")
+	}
+	hour, err := strconv.Atoi(h)
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, fmt.Errorf("invalid hour")
+	}
+	minute, err := strconv.Atoi(m)
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("invalid minute")
+	}
+	return hour*60 + minute, nil
+}
+
+// Notification is one desktop notification.
+type Notification struct {
+	Event string
+	Title string
+	Body  string
+}
+
+// Notifier shows notifications on the user's desktop.
+type Notifier interface {
+	Show(n Notification) error
+}
+
+// Dispatcher turns session events into desktop notifications. It shows
+// nothing while a UI is connected, since the UI reports the same events
+// itself, nor during quiet hours.
+type Dispatcher struct {
+	notifier    Notifier
+	settings    func() Settings
+	uiConnected func() bool
+	now         func() time.Time // replaced in tests
+
+	mu           sync.Mutex
+	droppedAt    time.Time // when the last session failed unexpectedly; zero once handled
+	reconnecting bool      // the connect in progress follows a drop
+}
+
+// NewDispatcher returns a dispatcher that shows notifications with
+// notifier, as configured by settings, while uiConnected is false.
+func NewDispatcher(notifier Notifier, settings func() Settings, uiConnected func() bool) *Dispatcher {
+	return &Dispatcher{
+		notifier:    notifier,
+		settings:    settings,
+		uiConnected: uiConnected,
+		now:         time.Now,
+	}
+}
+
+// Transition follows the session through a state change. A connected
+// session going to the error state is an unexpected disconnect, and the
+// next connect within ReconnectWindow a reconnect.
+func (d *Dispatcher) Transition(t vpn.Transition) {
+	d.mu.Lock()
+	var event, detail string
+	switch t.State {
+	case vpn.StateConnecting:
+		// The engine re-establishing a session's link counts as well.
+		d.reconnecting = t.Reason == vpn.ReasonReconnect ||
+			!d.droppedAt.IsZero() && t.At.Sub(d.droppedAt) <= ReconnectWindow
+		d.droppedAt = time.Time{}
+	case vpn.StateConnected:
+		if d.reconnecting {
+			event = EventReconnectSucceeded
+		}
+		d.reconnecting = false
+	case vpn.StateError:
+		switch {
+		case t.Previous == vpn.StateConnected:
+			event = EventUnexpectedDisconnect
+			d.droppedAt = t.At
+		case d.reconnecting:
+			event = EventReconnectFailed
+		}
+		d.reconnecting = false
+		if t.Err != nil {
+			detail = t.Err.Error()
+		}
+	case vpn.StateDisconnected:
+		if t.Reason == vpn.ReasonCap {
+			event = EventDataCapReached
+		}
+		d.reconnecting = false
+	}
+	d.mu.Unlock()
+
+	if event != "" {
+		d.Notify(event, detail)
+	}
+}
+
+// KillSwitchEngaged reports the first kill switch engagement of a session.
+func (d *Dispatcher) KillSwitchEngaged(stats vpn.KillSwitchStats) {
+	d.Notify(EventKillSwitchEngaged, "")
+}
+
+// Notify shows the notification for event, with detail appended to its
+// text, unless the settings, quiet hours or a connected UI rule it out.
+// Showing it runs in the background, since state listeners run while the
+// engine holds its lock.
+func (d *Dispatcher) Notify(event, detail string) {
+	s := d.settings()
+	if !s.Enabled || !s.Events.enabled(event) || s.QuietHours.contains(d.now()) {
+		return
+	}
+	if d.uiConnected() {
+		return
+	}
+	n := notificationFor(event, detail)
+	go func() {
+		if err := d.notifier.Show(n); err != nil {
+			log.Printf("warning: failed to show %s desktop notification: %v", event, err)
+		}
+	}()
+}
+
+// notificationFor returns the notification text for event.
+func notificationFor(event, detail string) Notification {
+	n := Notification{Event: event}
+	switch event {
+	case EventUnexpectedDisconnect:
+		n.Title, n.Body = "VPN disconnected", "The VPN connection dropped unexpectedly."
+	case EventReconnectSucceeded:
+		n.Title, n.Body = "VPN reconnected", "The VPN connection is back up."
+	case EventReconnectFailed:
+		n.Title, n.Body = "VPN reconnect failed", "The VPN could not reconnect."
+	case EventDataCapReached:
+		n.Title, n.Body = "Data cap reached", "The VPN disconnected because the data cap was reached."
+	case EventKillSwitchEngaged:
+		n.Title, n.Body = "Kill switch engaged", "The server stopped answering; traffic is held in the tunnel until it does."
+	case EventCrashRecovery:
+		n.Title, n.Body = "VPN recovered", "The VPN cleaned up after an unexpected shutdown."
+	}
+	if detail != "" {
+		n.Body += " " + detail
+	}
+	return n
+}
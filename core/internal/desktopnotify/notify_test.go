@@ -0,0 +1,188 @@
+package desktopnotify
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// fakeNotifier records the notifications shown.
+type fakeNotifier struct {
+	shown chan Notification
+}
+
+func newFakeNotifier() *fakeNotifier {
+	return &fakeNotifier{shown: make(chan Notification, 16)}
+}
+
+func (f *fakeNotifier) Show(n Notification) error {
+	f.shown <- n
+	return nil
+}
+
+// next returns the next notification shown, or "" for none.
+func (f *fakeNotifier) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case n := <-f.shown:
+		return n.Event
+	case <-time.After(time.Second):
+		return ""
+	}
+}
+
+// none fails if a notification was shown.
+func (f *fakeNotifier) none(t *testing.T) {
+	t.Helper()
+	select {
+	case n := <-f.shown:
+		t.Errorf("unexpected notification %+v", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func newTestDispatcher(s Settings, ui *bool) (*Dispatcher, *fakeNotifier) {
+	f := newFakeNotifier()
+	d := NewDispatcher(f, func() Settings { return s }, func() bool { return *ui })
+	d.now = func() time.Time { return time.Date(2026, 3, 2, 12, 0, 0, 0, time.Local) }
+	return d, f
+}
+
+func enabledSettings() Settings {
+	s := DefaultSettings()
+	s.Enabled = true
+	return s
+}
+
+func TestDispatcherMapsTransitions(t *testing.T) {
+	ui := false
+	d, f := newTestDispatcher(enabledSettings(), &ui)
+	at := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	step := func(state, previous vpn.State, offset time.Duration) {
+		d.Transition(vpn.Transition{State: state, Previous: previous, At: at.Add(offset), Err: errors.New("sing-box exited")})
+	}
+
+	// A user connect is not a reconnect.
+	step(vpn.StateConnecting, vpn.StateDisconnected, 0)
+	step(vpn.StateConnected, vpn.StateConnecting, time.Second)
+	f.none(t)
+
+	step(vpn.StateError, vpn.StateConnected, time.Minute)
+	if got := f.next(t); got != EventUnexpectedDisconnect {
+		t.Fatalf("drop: got %q", got)
+	}
+	step(vpn.StateConnecting, vpn.StateError, 2*time.Minute)
+	step(vpn.StateConnected, vpn.StateConnecting, 2*time.Minute)
+	if got := f.next(t); got != EventReconnectSucceeded {
+		t.Fatalf("reconnect: got %q", got)
+	}
+
+	step(vpn.StateError, vpn.StateConnected, 10*time.Minute)
+	f.next(t)
+	step(vpn.StateConnecting, vpn.StateError, 11*time.Minute)
+	step(vpn.StateError, vpn.StateConnecting, 11*time.Minute)
+	if got := f.next(t); got != EventReconnectFailed {
+		t.Fatalf("failed reconnect: got %q", got)
+	}
+
+	// Connecting long after a drop is a fresh connect.
+	step(vpn.StateError, vpn.StateConnected, 20*time.Minute)
+	f.next(t)
+	step(vpn.StateConnecting, vpn.StateError, 20*time.Minute+ReconnectWindow+time.Second)
+	step(vpn.StateConnected, vpn.StateConnecting, time.Hour)
+	f.none(t)
+
+	// The engine re-establishing the link of a session.
+	d.Transition(vpn.Transition{State: vpn.StateConnecting, Previous: vpn.StateConnected, Reason: vpn.ReasonReconnect})
+	step(vpn.StateError, vpn.StateConnecting, 2*time.Hour)
+	if got := f.next(t); got != EventReconnectFailed {
+		t.Fatalf("failed engine reconnect: got %q", got)
+	}
+
+	d.Transition(vpn.Transition{State: vpn.StateDisconnected, Previous: vpn.StateDisconnecting, Reason: vpn.ReasonCap})
+	if got := f.next(t); got != EventDataCapReached {
+		t.Fatalf("cap: got %q", got)
+	}
+	d.Transition(vpn.Transition{State: vpn.StateDisconnected, Previous: vpn.StateDisconnecting, Reason: vpn.ReasonUser})
+	f.none(t)
+
+	d.KillSwitchEngaged(vpn.KillSwitchStats{Activations: 1})
+	if got := f.next(t); got != EventKillSwitchEngaged {
+		t.Fatalf("kill switch: got %q", got)
+	}
+}
+
+func TestDispatcherGating(t *testing.T) {
+	noon := time.Date(2026, 3, 2, 12, 0, 0, 0, time.Local)
+	late := time.Date(2026, 3, 2, 23, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name string
+		edit func(s *Settings)
+		ui   bool
+		at   time.Time
+		want bool
+	}{
+		{"enabled", func(s *Settings) {}, false, noon, true},
+		{"disabled", func(s *Settings) { s.Enabled = false }, false, noon, false},
+		{"event off", func(s *Settings) { s.Events.UnexpectedDisconnect = false }, false, noon, false},
+		{"UI connected", func(s *Settings) {}, true, noon, false},
+		{"quiet hours", func(s *Settings) { s.QuietHours = QuietHours{Start: "11:00", End: "13:00"} }, false, noon, false},
+		{"outside quiet hours", func(s *Settings) { s.QuietHours = QuietHours{Start: "22:00", End: "07:00"} }, false, noon, true},
+		{"quiet hours past midnight", func(s *Settings) { s.QuietHours = QuietHours{Start: "22:00", End: "07:00"} }, false, late, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := enabledSettings()
+			tt.edit(&s)
+			ui := tt.ui
+			d, f := newTestDispatcher(s, &ui)
+			d.now = func() time.Time { return tt.at }
+			d.Notify(EventUnexpectedDisconnect, "")
+			if tt.want {
+				if got := f.next(t); got != EventUnexpectedDisconnect {
+					t.Errorf("got %q, want a notification", got)
+				}
+			} else {
+				f.none(t)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, q := range []QuietHours{{}, {Start: "22:00", End: "07:00"}, {Start: "00:00", End: "23:59"}} {
+		if err := Validate(Settings{QuietHours: q}); err != nil {
+			t.Errorf("%+v: %v", q, err)
+		}
+	}
+	for _, q := range []QuietHours{{Start: "22:00"}, {Start: "24:00", End: "07:00"}, {Start: "7:00", End: "08:00"}, {Start: "08:00", End: "08:00"}} {
+		if err := Validate(Settings{QuietHours: q}); err == nil {
+			t.Errorf("%+v accepted", q)
+		}
+	}
+}
+
+func TestToastScript(t *testing.T) {
+	script := toastScript(Notification{Title: "It’s <down>", Body: "a & b"})
+	if !strings.Contains(script, "<text>It’’s &lt;down&gt;</text><text>a &amp; b</text>") {
+		t.Errorf("script does not escape the text:\n%s", script)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encodeCommand("ü€"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = uint16(raw[2*i]) | uint16(raw[2*i+1])<<8
+	}
+	if got := string(utf16.Decode(units)); got != "ü€" {
+		t.Errorf("encoded command decodes to %q", got)
+	}
+}
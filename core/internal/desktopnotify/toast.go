@@ -0,0 +1,63 @@
+package desktopnotify
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+// ErrNoUserSession is returned when no user is signed in at the console
+// to show a notification to.
+var ErrNoUserSession = errors.New("no user is signed in at the console")
+
+// Toast shows notifications as Windows toasts. A service runs in session
+// 0, which has no desktop, so there the toast is raised by a hidden
+// PowerShell started as the console user in their session.
+type Toast struct{}
+
+// ToastAppID is the AppUserModelID toasts are shown under. Windows only
+// shows toasts for registered app IDs, and the service has no Start menu
+// shortcut of its own, so it borrows PowerShell's.
+const ToastAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+// toastScript returns a PowerShell script that shows n through the WinRT
+// ToastNotificationManager.
+func toastScript(n Notification) string {
+	doc := "<toast><visual><binding template=\"ToastGeneric\"><text>" + xmlEscape(n.Title) +
+		"</text><text>" + xmlEscape(n.Body) + "</text></binding></visual></toast>"
+	return strings.Join([]string{
+		"[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null",
+		"[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] > $null",
+		"$xml = New-Object Windows.Data.Xml.Dom.XmlDocument",
+		"$xml.LoadXml(" + psQuote(doc) + ")",
+		"[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier(" + psQuote(ToastAppID) +
+			").Show([Windows.UI.Notifications.ToastNotification]::new($xml))",
+	}, "\n")
+}
+
+// encodeCommand encodes script for powershell -EncodedCommand, which takes
+// base64 of UTF-16LE and sidesteps command-line quoting.
+func encodeCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	b := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// psQuote quotes s as a PowerShell single-quoted string, in which only
+// quote characters are special; PowerShell also treats the typographic
+// single quotes as quotes.
+func psQuote(s string) string {
+	r := strings.NewReplacer("'", "''", "‘", "‘‘", "’", "’’", "‚", "‚‚", "‛", "‛‛")
+	return "'" + r.Replace(s) + "'"
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package desktopnotify
+
+import "errors"
+
+// Show fails: toasts are a Windows feature, and the service only ships
+// for Windows.
+func (Toast) Show(Notification) error {
+	return errors.New("toasts are only shown on Windows")
+}
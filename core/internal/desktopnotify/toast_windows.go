@@ -0,0 +1,46 @@
+package desktopnotify
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// Show shows n and waits for PowerShell to hand it to Windows.
+func (Toast) Show(n Notification) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-WindowStyle", "Hidden",
+		"-EncodedCommand", encodeCommand(toastScript(n)))
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true, CreationFlags: windows.CREATE_NO_WINDOW}
+	if inServiceSession() {
+		var token windows.Token
+		if err := windows.WTSQueryUserToken(windows.WTSGetActiveConsoleSessionId(), &token); err != nil {
+			return fmt.Errorf("%w: %v", ErrNoUserSession, err)
+		}
+		defer token.Close()
+		cmd.SysProcAttr.Token = syscall.Token(token)
+		if env, err := token.Environ(false); err == nil {
+			cmd.Env = env
+		}
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to show toast: %w (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// inServiceSession reports whether the process runs in session 0.
+func inServiceSession() bool {
+	var session uint32
+	if err := windows.ProcessIdToSessionId(windows.GetCurrentProcessId(), &session); err != nil {
+		return true
+	}
+	return session == 0
+}
@@ -0,0 +1,321 @@
+// Package dnsenv detects local DNS setups that change what names resolve
+// to, which users then see as the tunnel's doing: hosts file overrides,
+// a system resolver on another LAN device such as a Pi-hole, and a DNS
+// proxy such as Acrylic on this machine.
+package dnsenv
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"strings"
+)
+
+// Severities of a finding.
+const (
+	SeverityWarning = "warning" // likely to break or change resolution
+	SeverityInfo    = "info"    // worth knowing when resolution looks odd
+)
+
+// Explanation keys, which the UI translates.
+const (
+	KeyHostsOverride    = "dns.hosts_override"    // the hosts file blocks or redirects a watched name
+	KeyHostsBlocklist   = "dns.hosts_blocklist"   // the hosts file is an ad-block list
+	KeyLANResolver      = "dns.lan_resolver"      // the system resolver is a LAN device other than the gateway
+	KeyLoopbackResolver = "dns.loopback_resolver" // the system resolver is this machine
+	KeyLocalDNSProxy    = "dns.local_dns_proxy"   // a process listens for DNS on this machine
+)
+
+// Finding is one detected setup.
+type Finding struct {
+	Key      string `json:"key"`
+	Severity string `json:"severity" jsonschema:"enum=warning|info"`
+	Host     string `json:"host,omitempty"`    // the overridden name
+	Address  string `json:"address,omitempty"` // where it points, or the resolver or listener address
+	Adapter  string `json:"adapter,omitempty"` // whose resolver it is
+	Process  string `json:"process,omitempty"` // the listening executable
+	Product  string `json:"product,omitempty"` // recognized DNS software
+	Detail   string `json:"detail"`            // English description for logs and support
+	Count    int    `json:"count,omitempty"`   // entries in a blocklist
+}
+
+// Report is the result of a check. Provider failures are listed in
+// Errors; the remaining checks still run.
+type Report struct {
+	Findings []Finding `json:"findings"`
+	Errors   []string  `json:"errors,omitempty"`
+}
+
+// Resolver is a DNS server an adapter is configured with.
+type Resolver struct {
+	Adapter  string
+	Addr     netip.Addr
+	Gateways []netip.Addr // the adapter's default gateways
+}
+
+// Listener is a socket bound to the DNS port on this machine.
+type Listener struct {
+	Addr    netip.Addr
+	PID     uint32
+	Process string // full path of the executable, if known
+}
+
+// Provider reads the system state a check inspects. The Windows
+// implementation is WindowsProvider; tests use fakes.
+type Provider interface {
+	HostsFile() ([]byte, error)
+	Resolvers() ([]Resolver, error)
+	DNSListeners() ([]Listener, error)
+}
+
+// watchedDomains are names whose override is almost never intended and
+// always confusing: popular sites and the DNS-over-HTTPS hosts the tunnel
+// resolves through (see vpn's DNS config). Their www. names are watched
+// too; other subdomains are not, as privacy tools block telemetry hosts.
+var watchedDomains = []string{
+	"dns.google",
+	"cloudflare-dns.com",
+	"google.com",
+	"youtube.com",
+	"gstatic.com",
+	"googleapis.com",
+	"microsoft.com",
+	"windowsupdate.com",
+	"live.com",
+	"office.com",
+	"apple.com",
+	"facebook.com",
+	"instagram.com",
+	"whatsapp.com",
+	"telegram.org",
+	"twitter.com",
+	"x.com",
+	"wikipedia.org",
+	"amazon.com",
+	"netflix.com",
+	"github.com",
+	"cloudflare.com",
+}
+
+// blocklistThreshold is how many blocking entries make a hosts file an
+// ad-block list rather than a few hand-made overrides.
+const blocklistThreshold = 100
+
+// knownDNSProxies maps lowercase executable names to the product.
+var knownDNSProxies = map[string]string{
+	"acrylicservice.exe": "Acrylic DNS Proxy",
+	"dnscrypt-proxy.exe": "dnscrypt-proxy",
+	"simplednscrypt.exe": "Simple DNSCrypt",
+	"adguardhome.exe":    "AdGuard Home",
+	"adguardsvc.exe":     "AdGuard",
+	"dnsproxy.exe":       "AdGuard dnsproxy",
+	"technitium.dns.exe": "Technitium DNS Server",
+	"yogadnsservice.exe": "YogaDNS",
+	"nextdns.exe":        "NextDNS",
+	"ctrld.exe":          "Control D",
+	"unbound.exe":        "Unbound",
+	"dns.exe":            "Windows DNS Server",
+}
+
+// Check inspects the system through p. extraHosts are further names to
+// watch in the hosts file, such as the server being connected to.
+func Check(p Provider, extraHosts ...string) Report {
+	report := Report{Findings: []Finding{}}
+
+	hosts, err := p.HostsFile()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("read hosts file: %v", err))
+	}
+	report.Findings = append(report.Findings, checkHosts(ParseHosts(hosts), extraHosts)...)
+
+	resolvers, err := p.Resolvers()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("list resolvers: %v", err))
+	}
+	report.Findings = append(report.Findings, checkResolvers(resolvers)...)
+
+	listeners, err := p.DNSListeners()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("list DNS listeners: %v", err))
+	}
+	report.Findings = append(report.Findings, checkListeners(listeners)...)
+	return report
+}
+
+// maxCompactFindings caps the findings a connect reports.
+const maxCompactFindings = 5
+
+// Compact returns the warnings of r, at most maxCompactFindings, as a
+// connect reports them.
+func (r Report) Compact() []Finding {
+	var warnings []Finding
+	for _, f := range r.Findings {
+		if f.Severity == SeverityWarning && len(warnings) < maxCompactFindings {
+			warnings = append(warnings, f)
+		}
+	}
+	return warnings
+}
+
+// HostsEntry is one line of a hosts file.
+type HostsEntry struct {
+	Addr  netip.Addr
+	Names []string // lowercase, without a trailing dot
+	Line  int      // 1-based
+}
+
+// ParseHosts parses a hosts file. Comments, blank lines and lines whose
+// address does not parse are skipped.
+func ParseHosts(data []byte) []HostsEntry {
+	var entries []HostsEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		if hash := strings.IndexByte(line, '#'); hash >= 0 {
+			line = line[:hash]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		entry := HostsEntry{Addr: addr.Unmap(), Line: i + 1}
+		for _, name := range fields[1:] {
+			entry.Names = append(entry.Names, strings.TrimSuffix(strings.ToLower(name), "."))
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// blocking reports whether a hosts entry to addr blocks its names.
+func blocking(addr netip.Addr) bool {
+	return addr.IsUnspecified() || addr.IsLoopback()
+}
+
+func checkHosts(entries []HostsEntry, extraHosts []string) []Finding {
+	watched := make(map[string]bool)
+	for _, d := range watchedDomains {
+		watched[d] = true
+		watched["www."+d] = true
+	}
+	for _, h := range extraHosts {
+		if h = strings.TrimSuffix(strings.ToLower(h), "."); h != "" {
+			watched[h] = true
+		}
+	}
+
+	var findings []Finding
+	blocked := 0
+	for _, e := range entries {
+		for _, name := range e.Names {
+			if name == "localhost" || strings.HasSuffix(name, ".localhost") || name == "localhost.localdomain" {
+				continue
+			}
+			if blocking(e.Addr) {
+				blocked++
+			}
+			if !watched[name] {
+				continue
+			}
+			f := Finding{Key: KeyHostsOverride, Severity: SeverityWarning, Host: name, Address: e.Addr.String()}
+			if blocking(e.Addr) {
+				f.Detail = fmt.Sprintf("hosts file line %d blocks %s (%s)", e.Line, name, e.Addr)
+			} else {
+				f.Detail = fmt.Sprintf("hosts file line %d points %s at %s", e.Line, name, e.Addr)
+			}
+			findings = append(findings, f)
+		}
+	}
+	if blocked >= blocklistThreshold {
+		findings = append(findings, Finding{
+			Key:      KeyHostsBlocklist,
+			Severity: SeverityInfo,
+			Count:    blocked,
+			Detail:   fmt.Sprintf("hosts file blocks %d names, as an ad-block list does", blocked),
+		})
+	}
+	return findings
+}
+
+// siteLocal is the deprecated IPv6 site-local range; Windows lists
+// fec0:0:0:ffff::1-3 as placeholder resolvers on adapters without IPv6 DNS.
+var siteLocal = netip.MustParsePrefix("fec0::/10")
+
+func checkResolvers(resolvers []Resolver) []Finding {
+	var findings []Finding
+	seen := make(map[netip.Addr]bool)
+	for _, r := range resolvers {
+		addr := r.Addr.Unmap()
+		if seen[addr] {
+			continue
+		}
+		switch {
+		case addr.IsLoopback():
+			seen[addr] = true
+			findings = append(findings, Finding{
+				Key:      KeyLoopbackResolver,
+				Severity: SeverityWarning,
+				Address:  addr.String(),
+				Adapter:  r.Adapter,
+				Detail:   fmt.Sprintf("adapter %q resolves through %s, a DNS proxy on this machine", r.Adapter, addr),
+			})
+		case addr.IsPrivate() && !siteLocal.Contains(addr) && !isGateway(addr, r.Gateways):
+			// A home router forwards DNS as the gateway; another LAN
+			// device answering DNS is a filter such as Pi-hole, whose
+			// answers the tunnel's local resolver also gets.
+			seen[addr] = true
+			findings = append(findings, Finding{
+				Key:      KeyLANResolver,
+				Severity: SeverityWarning,
+				Address:  addr.String(),
+				Adapter:  r.Adapter,
+				Detail:   fmt.Sprintf("adapter %q resolves through %s, a LAN device other than its gateway (such as Pi-hole or AdGuard Home)", r.Adapter, addr),
+			})
+		}
+	}
+	return findings
+}
+
+func isGateway(addr netip.Addr, gateways []netip.Addr) bool {
+	for _, g := range gateways {
+		if g.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func checkListeners(listeners []Listener) []Finding {
+	var findings []Finding
+	seen := make(map[uint32]bool)
+	for _, l := range listeners {
+		if !l.Addr.IsLoopback() && !l.Addr.IsUnspecified() {
+			continue
+		}
+		if l.PID != 0 && seen[l.PID] {
+			continue
+		}
+		seen[l.PID] = true
+		f := Finding{
+			Key:      KeyLocalDNSProxy,
+			Severity: SeverityWarning,
+			Address:  l.Addr.String(),
+			Process:  l.Process,
+			Product:  knownDNSProxies[strings.ToLower(filepath.Base(strings.ReplaceAll(l.Process, `\`, "/")))],
+		}
+		who := "a process"
+		switch {
+		case f.Product != "":
+			who = f.Product
+		case l.Process != "":
+			who = l.Process
+		case l.PID != 0:
+			who = fmt.Sprintf("process %d", l.PID)
+		}
+		f.Detail = fmt.Sprintf("%s listens for DNS on %s", who, netip.AddrPortFrom(l.Addr, 53))
+		findings = append(findings, f)
+	}
+	return findings
+}
@@ -0,0 +1,157 @@
+package dnsenv
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fakeProvider struct {
+	hosts     string
+	resolvers []Resolver
+	listeners []Listener
+	err       error
+}
+
+func (f fakeProvider) HostsFile() ([]byte, error)        { return []byte(f.hosts), f.err }
+func (f fakeProvider) Resolvers() ([]Resolver, error)    { return f.resolvers, f.err }
+func (f fakeProvider) DNSListeners() ([]Listener, error) { return f.listeners, f.err }
+
+func TestParseHosts(t *testing.T) {
+	data := "# Copyright (c) 1993-2009 Microsoft Corp.\r\n" +
+		"\r\n" +
+		"127.0.0.1       localhost\r\n" +
+		"::1             localhost # IPv6\r\n" +
+		"0.0.0.0 ads.example.com tracker.example.com.\r\n" +
+		"not-an-ip example.com\r\n" +
+		"10.0.0.5\r\n" +
+		"\t192.168.1.20\tNAS.Home.lan\n"
+	want := []HostsEntry{
+		{Addr: netip.MustParseAddr("127.0.0.1"), Names: []string{"localhost"}, Line: 3},
+		{Addr: netip.MustParseAddr("::1"), Names: []string{"localhost"}, Line: 4},
+		{Addr: netip.MustParseAddr("0.0.0.0"), Names: []string{"ads.example.com", "tracker.example.com"}, Line: 5},
+		{Addr: netip.MustParseAddr("192.168.1.20"), Names: []string{"nas.home.lan"}, Line: 8},
+	}
+	if got := ParseHosts([]byte(data)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestCheckHosts(t *testing.T) {
+	var blocklist strings.Builder
+	for i := 0; i < blocklistThreshold; i++ {
+		fmt.Fprintf(&blocklist, "0.0.0.0 ad%d.example.net\n", i)
+	}
+
+	tests := []struct {
+		name  string
+		hosts string
+		extra []string
+		want  []string // key host address, in order
+	}{
+		{"default file", "127.0.0.1 localhost\n::1 localhost\n", nil, nil},
+		{"blocked popular site", "0.0.0.0 www.youtube.com youtube.com\n", nil,
+			[]string{"dns.hosts_override www.youtube.com 0.0.0.0", "dns.hosts_override youtube.com 0.0.0.0"}},
+		{"redirected DoH host", "203.0.113.9 cloudflare-dns.com\n", nil,
+			[]string{"dns.hosts_override cloudflare-dns.com 203.0.113.9"}},
+		{"telemetry subdomain is not watched", "0.0.0.0 vortex.data.microsoft.com\n", nil, nil},
+		{"connect server", "198.51.100.7 vpn.example.org\n", []string{"VPN.example.org."},
+			[]string{"dns.hosts_override vpn.example.org 198.51.100.7"}},
+		{"ad-block list", blocklist.String(), nil, []string{"dns.hosts_blocklist  "}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range checkHosts(ParseHosts([]byte(tt.hosts)), tt.extra) {
+				got = append(got, f.Key+" "+f.Host+" "+f.Address)
+				if f.Detail == "" {
+					t.Errorf("%s has no detail", f.Key)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckResolvers(t *testing.T) {
+	gw := []netip.Addr{netip.MustParseAddr("192.168.1.1")}
+	tests := []struct {
+		name      string
+		resolvers []Resolver
+		want      []string // key address
+	}{
+		{"router", []Resolver{{Adapter: "Wi-Fi", Addr: netip.MustParseAddr("192.168.1.1"), Gateways: gw}}, nil},
+		{"public", []Resolver{{Adapter: "Wi-Fi", Addr: netip.MustParseAddr("1.1.1.1"), Gateways: gw}}, nil},
+		{"pi-hole", []Resolver{
+			{Adapter: "Ethernet", Addr: netip.MustParseAddr("192.168.1.53"), Gateways: gw},
+			{Adapter: "Wi-Fi", Addr: netip.MustParseAddr("192.168.1.53"), Gateways: gw},
+		}, []string{"dns.lan_resolver 192.168.1.53"}},
+		{"ipv6 placeholders and router", []Resolver{
+			{Adapter: "Wi-Fi", Addr: netip.MustParseAddr("fec0:0:0:ffff::1")},
+			{Adapter: "Wi-Fi", Addr: netip.MustParseAddr("fe80::1")},
+		}, nil},
+		{"local proxy", []Resolver{{Adapter: "Wi-Fi", Addr: netip.MustParseAddr("127.0.0.1")}},
+			[]string{"dns.loopback_resolver 127.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range checkResolvers(tt.resolvers) {
+				got = append(got, f.Key+" "+f.Address)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckListeners(t *testing.T) {
+	findings := checkListeners([]Listener{
+		{Addr: netip.MustParseAddr("127.0.0.1"), PID: 700, Process: `C:\Program Files\Acrylic DNS Proxy\AcrylicService.exe`},
+		{Addr: netip.MustParseAddr("::1"), PID: 700, Process: `C:\Program Files\Acrylic DNS Proxy\AcrylicService.exe`},
+		{Addr: netip.MustParseAddr("192.168.137.1"), PID: 900}, // Internet Connection Sharing on its own network
+		{Addr: netip.MustParseAddr("0.0.0.0"), PID: 1234},
+	})
+	if len(findings) != 2 {
+		t.Fatalf("got %+v, want 2 findings", findings)
+	}
+	if f := findings[0]; f.Key != KeyLocalDNSProxy || f.Product != "Acrylic DNS Proxy" || !strings.Contains(f.Detail, "127.0.0.1:53") {
+		t.Errorf("acrylic = %+v", f)
+	}
+	if f := findings[1]; f.Product != "" || !strings.Contains(f.Detail, "process 1234") {
+		t.Errorf("unknown = %+v", f)
+	}
+}
+
+func TestCheckAndCompact(t *testing.T) {
+	p := fakeProvider{
+		hosts:     "0.0.0.0 google.com\n",
+		resolvers: []Resolver{{Adapter: "Wi-Fi", Addr: netip.MustParseAddr("10.0.0.2")}},
+		listeners: []Listener{{Addr: netip.MustParseAddr("127.0.0.1"), PID: 1}},
+	}
+	report := Check(p)
+	if len(report.Findings) != 3 || len(report.Errors) != 0 {
+		t.Fatalf("got %+v", report)
+	}
+
+	p.err = errors.New("access denied")
+	if report := Check(p); len(report.Errors) != 3 {
+		t.Errorf("errors = %v, want one per source", report.Errors)
+	}
+
+	var many Report
+	for i := 0; i < maxCompactFindings+2; i++ {
+		many.Findings = append(many.Findings, Finding{Key: KeyHostsOverride, Severity: SeverityWarning})
+	}
+	many.Findings = append([]Finding{{Key: KeyHostsBlocklist, Severity: SeverityInfo}}, many.Findings...)
+	compact := many.Compact()
+	if len(compact) != maxCompactFindings || compact[0].Severity != SeverityWarning {
+		t.Errorf("compact = %+v, want %d warnings", compact, maxCompactFindings)
+	}
+}
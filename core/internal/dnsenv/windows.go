@@ -0,0 +1,155 @@
+package dnsenv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modiphlpapi             = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetExtendedUdpTable = modiphlpapi.NewProc("GetExtendedUdpTable")
+)
+
+// udpTableOwnerPID is UDP_TABLE_OWNER_PID, the table class listing each
+// socket with its owning process.
+const udpTableOwnerPID = 1
+
+// WindowsProvider reads the hosts file, each adapter's resolvers from the
+// IP Helper API and the UDP sockets bound to port 53. OwnAdapter, the TUN
+// adapter, is skipped: its resolver is the tunnel's.
+type WindowsProvider struct {
+	OwnAdapter string
+}
+
+func (WindowsProvider) HostsFile() ([]byte, error) {
+	root := os.Getenv("SystemRoot")
+	if root == "" {
+		root = `C:\Windows`
+	}
+	data, err := os.ReadFile(filepath.Join(root, `System32\drivers\etc\hosts`))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (p WindowsProvider) Resolvers() ([]Resolver, error) {
+	size := uint32(15 * 1024)
+	var buf []byte
+	for {
+		buf = make([]byte, size)
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, windows.GAA_FLAG_INCLUDE_GATEWAYS, 0,
+			(*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])), &size)
+		if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GetAdaptersAddresses: %w", err)
+		}
+		break
+	}
+
+	var resolvers []Resolver
+	for a := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])); a != nil; a = a.Next {
+		name := windows.UTF16PtrToString(a.FriendlyName)
+		if a.OperStatus != windows.IfOperStatusUp || strings.EqualFold(name, p.OwnAdapter) {
+			continue
+		}
+		var gateways []netip.Addr
+		for g := a.FirstGatewayAddress; g != nil; g = g.Next {
+			if addr, ok := netip.AddrFromSlice(g.Address.IP()); ok {
+				gateways = append(gateways, addr.Unmap())
+			}
+		}
+		for d := a.FirstDnsServerAddress; d != nil; d = d.Next {
+			if addr, ok := netip.AddrFromSlice(d.Address.IP()); ok {
+				resolvers = append(resolvers, Resolver{Adapter: name, Addr: addr.Unmap(), Gateways: gateways})
+			}
+		}
+	}
+	return resolvers, nil
+}
+
+func (WindowsProvider) DNSListeners() ([]Listener, error) {
+	var listeners []Listener
+	for _, family := range []uint32{windows.AF_INET, windows.AF_INET6} {
+		table, err := udpTable(family)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, dnsRows(table, family)...)
+	}
+	for i := range listeners {
+		listeners[i].Process = processImage(listeners[i].PID)
+	}
+	return listeners, nil
+}
+
+// udpTable returns the raw UDP socket table of family with owning PIDs.
+func udpTable(family uint32) ([]byte, error) {
+	size := uint32(16 * 1024)
+	for {
+		buf := make([]byte, size)
+		r, _, _ := procGetExtendedUdpTable.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)),
+			0, uintptr(family), udpTableOwnerPID, 0)
+		if windows.Errno(r) == windows.ERROR_INSUFFICIENT_BUFFER {
+			continue
+		}
+		if r != 0 {
+			return nil, fmt.Errorf("GetExtendedUdpTable: %w", windows.Errno(r))
+		}
+		return buf[:size], nil
+	}
+}
+
+// dnsRows returns the sockets of a MIB_UDPTABLE_OWNER_PID or
+// MIB_UDP6TABLE_OWNER_PID bound to port 53.
+func dnsRows(table []byte, family uint32) []Listener {
+	if len(table) < 4 {
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint32(table))
+	rowSize, addrSize := 12, 4 // addr, port, pid
+	if family == windows.AF_INET6 {
+		rowSize, addrSize = 28, 16 // addr, scope ID, port, pid
+	}
+	var listeners []Listener
+	for i := 0; i < n && 4+(i+1)*rowSize <= len(table); i++ {
+		row := table[4+i*rowSize : 4+(i+1)*rowSize]
+		portOffset := addrSize
+		if family == windows.AF_INET6 {
+			portOffset += 4
+		}
+		// The port is in network byte order in the low bytes.
+		if binary.BigEndian.Uint16(row[portOffset:]) != 53 {
+			continue
+		}
+		addr, _ := netip.AddrFromSlice(row[:addrSize])
+		listeners = append(listeners, Listener{Addr: addr, PID: binary.LittleEndian.Uint32(row[portOffset+4:])})
+	}
+	return listeners
+}
+
+// processImage returns the executable path of pid, or "" if it cannot be
+// read.
+func processImage(pid uint32) string {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(process)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(process, 0, &buf[0], &size); err != nil {
+		return ""
+	}
+	return windows.UTF16ToString(buf[:size])
+}
@@ -0,0 +1,249 @@
+// Package envscan detects other VPNs and proxies that conflict with the
+// tunnel: third-party VPN adapters, default routes captured by a virtual
+// adapter, a system proxy, and running proxy tools with their own TUN
+// stack.
+package envscan
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Finding kinds.
+const (
+	KindVPNAdapter   = "vpn_adapter"   // another VPN's adapter is up
+	KindDefaultRoute = "default_route" // a default or half-default route points at a virtual adapter
+	KindSystemProxy  = "system_proxy"  // a user has a system proxy configured
+	KindProxyTool    = "proxy_tool"    // a proxy tool with its own TUN stack is running
+)
+
+// Adapter is a network adapter as reported by the provider.
+type Adapter struct {
+	Index       uint32
+	Name        string // friendly name, e.g. "Ethernet"
+	Description string // driver description, e.g. "WireGuard Tunnel"
+	Up          bool
+	Virtual     bool // not backed by hardware
+}
+
+// Route is an entry of the IPv4 or IPv6 routing table.
+type Route struct {
+	Prefix         netip.Prefix
+	InterfaceIndex uint32
+}
+
+// ProxySetting is the system proxy configuration of one user.
+type ProxySetting struct {
+	User          string // account SID
+	Enabled       bool
+	Server        string
+	AutoConfigURL string
+}
+
+// Process is a running process.
+type Process struct {
+	PID  uint32
+	Name string // executable name, e.g. "v2rayN.exe"
+}
+
+// Provider reads the system state a scan inspects. The Windows
+// implementation is WindowsProvider; tests use fakes.
+type Provider interface {
+	Adapters() ([]Adapter, error)
+	Routes() ([]Route, error)
+	Proxies() ([]ProxySetting, error)
+	// Processes lists the running processes, except this one and those
+	// started from its installation directory.
+	Processes() ([]Process, error)
+}
+
+// Finding is one detected conflict.
+type Finding struct {
+	Kind    string `json:"kind"`
+	Adapter string `json:"adapter,omitempty"`
+	Product string `json:"product,omitempty"` // recognized VPN product or proxy tool
+	Process string `json:"process,omitempty"` // executable of a proxy tool
+	PID     uint32 `json:"pid,omitempty"`
+	// TunStack marks a TUN adapter or proxy tool that competes with the
+	// tunnel for auto_route.
+	TunStack bool   `json:"tunStack,omitempty"`
+	Detail   string `json:"detail"` // English description for logs and support
+}
+
+// Report is the result of a scan. Provider failures are listed in Errors;
+// the remaining checks still run.
+type Report struct {
+	Findings []Finding `json:"findings"`
+	Errors   []string  `json:"errors,omitempty"`
+}
+
+// knownVPNAdapters maps lowercase fragments of adapter names or
+// descriptions to the product they belong to. More specific fragments come
+// first.
+var knownVPNAdapters = []struct {
+	fragment string
+	product  string
+}{
+	{"anyconnect", "Cisco AnyConnect"},
+	{"cisco secure client", "Cisco Secure Client"},
+	{"cloudflare warp", "Cloudflare WARP"},
+	{"cloudflarewarp", "Cloudflare WARP"},
+	{"pangp", "GlobalProtect"},
+	{"fortinet", "FortiClient"},
+	{"juniper", "Juniper / Pulse Secure"},
+	{"pulse secure", "Juniper / Pulse Secure"},
+	{"nordlynx", "NordVPN"},
+	{"expressvpn", "ExpressVPN"},
+	{"tailscale", "Tailscale"},
+	{"zerotier", "ZeroTier"},
+	{"openvpn", "OpenVPN"},
+	{"wireguard", "WireGuard"},
+	{"tap-windows", "TAP (OpenVPN and others)"},
+	{"wintun", "Wintun (WireGuard-based VPN)"},
+}
+
+// Scan inspects the system through p. ownAdapter is the name of our own
+// TUN adapter, which is never reported.
+func Scan(p Provider, ownAdapter string) Report {
+	report := Report{Findings: []Finding{}}
+
+	adapters, err := p.Adapters()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("list adapters: %v", err))
+	}
+	byIndex := make(map[uint32]Adapter, len(adapters))
+	for _, a := range adapters {
+		byIndex[a.Index] = a
+		if !a.Up || strings.EqualFold(a.Name, ownAdapter) {
+			continue
+		}
+		if product := vpnProduct(a); product != "" {
+			report.Findings = append(report.Findings, Finding{
+				Kind:     KindVPNAdapter,
+				Adapter:  a.Name,
+				Product:  product,
+				TunStack: tunAdapter(a),
+				Detail:   fmt.Sprintf("%s adapter %q (%s) is up", product, a.Name, a.Description),
+			})
+		}
+	}
+
+	routes, err := p.Routes()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("read routes: %v", err))
+	}
+	for _, r := range routes {
+		// /0 is the default route; /1 pairs are how VPNs override it
+		// without deleting the original.
+		if r.Prefix.Bits() > 1 {
+			continue
+		}
+		a, known := byIndex[r.InterfaceIndex]
+		// TAP adapters present themselves as Ethernet, so a recognized VPN
+		// counts as virtual regardless of what the provider says.
+		if known && (strings.EqualFold(a.Name, ownAdapter) || !a.Virtual && vpnProduct(a) == "") {
+			continue
+		}
+		name := a.Name
+		if !known {
+			name = fmt.Sprintf("interface %d", r.InterfaceIndex)
+		}
+		report.Findings = append(report.Findings, Finding{
+			Kind:     KindDefaultRoute,
+			Adapter:  name,
+			Product:  vpnProduct(a),
+			TunStack: known && tunAdapter(a),
+			Detail:   fmt.Sprintf("route %s points at virtual adapter %q", r.Prefix, name),
+		})
+	}
+
+	proxies, err := p.Proxies()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("read proxy settings: %v", err))
+	}
+	for _, ps := range proxies {
+		switch {
+		case ps.Enabled && ps.Server != "":
+			report.Findings = append(report.Findings, Finding{
+				Kind:   KindSystemProxy,
+				Detail: fmt.Sprintf("system proxy %s is set for user %s", ps.Server, ps.User),
+			})
+		case ps.AutoConfigURL != "":
+			report.Findings = append(report.Findings, Finding{
+				Kind:   KindSystemProxy,
+				Detail: fmt.Sprintf("proxy auto-config %s is set for user %s", ps.AutoConfigURL, ps.User),
+			})
+		}
+	}
+
+	processes, err := p.Processes()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("list processes: %v", err))
+	}
+	for _, proc := range processes {
+		if t := processTool(proc.Name); t != nil {
+			report.Findings = append(report.Findings, Finding{
+				Kind:     KindProxyTool,
+				Product:  t.Product,
+				Process:  proc.Name,
+				PID:      proc.PID,
+				TunStack: true,
+				Detail:   fmt.Sprintf("%s is running (%s, PID %d) and may bring up its own TUN adapter", t.Product, proc.Name, proc.PID),
+			})
+		}
+	}
+	return report
+}
+
+// vpnProduct returns the VPN product or proxy tool an adapter belongs to,
+// or "".
+func vpnProduct(a Adapter) string {
+	if t := adapterTool(a); t != nil {
+		return t.Product
+	}
+	text := strings.ToLower(a.Name + " " + a.Description)
+	for _, k := range knownVPNAdapters {
+		if strings.Contains(text, k.fragment) {
+			return k.product
+		}
+	}
+	return ""
+}
+
+// tunAdapter reports whether a is the TUN adapter of a proxy tool or
+// another Wintun adapter.
+func tunAdapter(a Adapter) bool {
+	return adapterTool(a) != nil || strings.Contains(strings.ToLower(a.Name+" "+a.Description), "wintun")
+}
+
+// DefaultRouteFamilies reports which address families the routing table
+// has a default route for, outside our own TUN adapter ownAdapter: an
+// IPv6-only network, as on mobile tethering, has v6 but not v4. /1 halves
+// count, as another VPN may override the default route with them.
+func DefaultRouteFamilies(p Provider, ownAdapter string) (v4, v6 bool, err error) {
+	routes, err := p.Routes()
+	if err != nil {
+		return false, false, fmt.Errorf("read routes: %w", err)
+	}
+	// Without the adapters our own adapter's routes cannot be told apart;
+	// they are counted then.
+	adapters, _ := p.Adapters()
+	own := map[uint32]bool{}
+	for _, a := range adapters {
+		if strings.EqualFold(a.Name, ownAdapter) {
+			own[a.Index] = true
+		}
+	}
+	for _, r := range routes {
+		if r.Prefix.Bits() > 1 || own[r.InterfaceIndex] {
+			continue
+		}
+		if r.Prefix.Addr().Is4() {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return v4, v6, nil
+}
@@ -0,0 +1,195 @@
+package envscan
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+type fakeProvider struct {
+	adapters  []Adapter
+	routes    []Route
+	proxies   []ProxySetting
+	processes []Process
+	err       error // returned by Adapters
+}
+
+func (f fakeProvider) Adapters() ([]Adapter, error)     { return f.adapters, f.err }
+func (f fakeProvider) Routes() ([]Route, error)         { return f.routes, nil }
+func (f fakeProvider) Proxies() ([]ProxySetting, error) { return f.proxies, nil }
+func (f fakeProvider) Processes() ([]Process, error)    { return f.processes, nil }
+
+var (
+	ethernet = Adapter{Index: 1, Name: "Ethernet", Description: "Intel(R) Ethernet Connection", Up: true}
+	ownTun   = Adapter{Index: 2, Name: "MRVPN", Description: "sing-tun Tunnel", Up: true, Virtual: true}
+)
+
+func route(prefix string, index uint32) Route {
+	return Route{Prefix: netip.MustParsePrefix(prefix), InterfaceIndex: index}
+}
+
+func kinds(r Report) []string {
+	var out []string
+	for _, f := range r.Findings {
+		out = append(out, f.Kind+":"+f.Product)
+	}
+	return out
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name string
+		p    fakeProvider
+		want []string
+	}{
+		{
+			name: "clean system",
+			p: fakeProvider{
+				adapters: []Adapter{ethernet, ownTun},
+				routes:   []Route{route("0.0.0.0/0", 1), route("0.0.0.0/1", 2), route("128.0.0.0/1", 2)},
+				proxies:  []ProxySetting{{User: "S-1-5-21-1", Server: "proxy:8080"}},
+			},
+		},
+		{
+			name: "anyconnect up with half-default routes",
+			p: fakeProvider{
+				adapters: []Adapter{ethernet, {Index: 7, Name: "Ethernet 3", Description: "Cisco AnyConnect Secure Mobility Client Virtual Miniport Adapter", Up: true, Virtual: true}},
+				routes:   []Route{route("0.0.0.0/0", 1), route("0.0.0.0/1", 7), route("10.0.0.0/8", 7)},
+			},
+			want: []string{"vpn_adapter:Cisco AnyConnect", "default_route:Cisco AnyConnect"},
+		},
+		{
+			name: "tap adapter reported as ethernet",
+			p: fakeProvider{
+				adapters: []Adapter{ethernet, {Index: 9, Name: "Local Area Connection", Description: "TAP-Windows Adapter V9", Up: true}},
+				routes:   []Route{route("::/0", 9)},
+			},
+			want: []string{"vpn_adapter:TAP (OpenVPN and others)", "default_route:TAP (OpenVPN and others)"},
+		},
+		{
+			name: "disconnected wireguard adapter",
+			p: fakeProvider{
+				adapters: []Adapter{ethernet, {Index: 4, Name: "wg0", Description: "WireGuard Tunnel", Virtual: true}},
+			},
+		},
+		{
+			name: "default route on unknown interface",
+			p: fakeProvider{
+				adapters: []Adapter{ethernet},
+				routes:   []Route{route("0.0.0.0/0", 42)},
+			},
+			want: []string{"default_route:"},
+		},
+		{
+			name: "system proxy and pac",
+			p: fakeProvider{
+				proxies: []ProxySetting{
+					{User: "S-1-5-21-1", Enabled: true, Server: "127.0.0.1:7890"},
+					{User: "S-1-5-21-2", AutoConfigURL: "http://wpad/proxy.pac"},
+				},
+			},
+			want: []string{"system_proxy:", "system_proxy:"},
+		},
+		{
+			name: "clash verge in tun mode",
+			p: fakeProvider{
+				adapters:  []Adapter{ethernet, ownTun, {Index: 12, Name: "Mihomo", Description: "Wintun Userspace Tunnel", Up: true, Virtual: true}},
+				routes:    []Route{route("0.0.0.0/0", 1), route("0.0.0.0/1", 12)},
+				processes: []Process{{PID: 40, Name: "explorer.exe"}, {PID: 41, Name: "Clash-Verge.exe"}, {PID: 42, Name: "verge-mihomo.exe"}},
+			},
+			want: []string{"vpn_adapter:Clash Verge", "default_route:Clash Verge", "proxy_tool:Clash Verge", "proxy_tool:Clash Verge"},
+		},
+		{
+			name: "other sing-box and an unknown wintun adapter",
+			p: fakeProvider{
+				adapters:  []Adapter{ethernet, ownTun, {Index: 13, Name: "tun0", Description: "Wintun Userspace Tunnel", Up: true, Virtual: true}},
+				processes: []Process{{PID: 50, Name: "sing-box.exe"}},
+			},
+			want: []string{"vpn_adapter:Wintun (WireGuard-based VPN)", "proxy_tool:sing-box"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := kinds(Scan(tt.p, "MRVPN"))
+			if len(got) != len(tt.want) {
+				t.Fatalf("findings = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("finding %d = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestScanContinuesAfterProviderError(t *testing.T) {
+	r := Scan(fakeProvider{
+		err:     errors.New("access denied"),
+		proxies: []ProxySetting{{User: "S-1-5-21-1", Enabled: true, Server: "proxy:3128"}},
+	}, "MRVPN")
+	if len(r.Errors) != 1 || len(r.Findings) != 1 {
+		t.Errorf("report = %+v", r)
+	}
+}
+
+func TestDefaultRouteFamilies(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []Route
+		v4, v6 bool
+	}{
+		{"dual-stack", []Route{route("0.0.0.0/0", 1), route("::/0", 1), route("192.168.1.0/24", 1)}, true, true},
+		{"IPv6-only", []Route{route("::/0", 1), route("192.168.1.0/24", 1)}, false, true},
+		{"IPv6-only under our tunnel", []Route{route("::/0", 1), route("0.0.0.0/1", 2), route("128.0.0.0/1", 2)}, false, true},
+		{"IPv4 through another VPN", []Route{route("::/0", 1), route("0.0.0.0/1", 3)}, true, true},
+		{"offline", []Route{route("127.0.0.0/8", 1)}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := fakeProvider{adapters: []Adapter{ethernet, ownTun}, routes: tt.routes}
+			v4, v6, err := DefaultRouteFamilies(p, "MRVPN")
+			if err != nil || v4 != tt.v4 || v6 != tt.v6 {
+				t.Errorf("v4 %v, v6 %v, err %v; want %v, %v", v4, v6, err, tt.v4, tt.v6)
+			}
+		})
+	}
+}
+
+func TestTunConflicts(t *testing.T) {
+	r := Scan(fakeProvider{
+		adapters: []Adapter{
+			ethernet, ownTun,
+			{Index: 7, Name: "Ethernet 3", Description: "Cisco AnyConnect Virtual Miniport Adapter", Up: true, Virtual: true},
+			{Index: 13, Name: "singbox_tun", Description: "sing-tun Tunnel", Up: true, Virtual: true},
+		},
+		proxies:   []ProxySetting{{User: "S-1-5-21-1", Enabled: true, Server: "127.0.0.1:10808"}},
+		processes: []Process{{PID: 60, Name: "v2rayN.exe"}},
+	}, "MRVPN")
+	if len(r.Findings) != 4 {
+		t.Fatalf("findings = %v", kinds(r))
+	}
+	conflicts := r.TunConflicts()
+	got := kinds(conflicts)
+	if len(got) != 2 || got[0] != "vpn_adapter:v2rayN" || got[1] != "proxy_tool:v2rayN" {
+		t.Fatalf("conflicts = %v", got)
+	}
+	if f := conflicts.Findings[1]; f.Process != "v2rayN.exe" || f.PID != 60 {
+		t.Errorf("tool finding = %+v", f)
+	}
+}
+
+func TestLoadTools(t *testing.T) {
+	tools, err := loadTools([]byte(`[{"product": "Example", "processes": ["Example.EXE"], "adapters": ["Example TUN"]}]`))
+	if err != nil || tools[0].Processes[0] != "example.exe" || tools[0].Adapters[0] != "example tun" {
+		t.Errorf("tools = %+v, %v", tools, err)
+	}
+	for _, bad := range []string{`{}`, `[{"product": "No processes"}]`, `[{"processes": ["x.exe"]}]`, `[{"product": "X", "processes": ["x.exe"], "adapters": [""]}]`} {
+		if _, err := loadTools([]byte(bad)); err == nil {
+			t.Errorf("loadTools(%s) succeeded", bad)
+		}
+	}
+	if len(knownTools) == 0 {
+		t.Error("no known tools")
+	}
+}
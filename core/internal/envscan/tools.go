@@ -0,0 +1,101 @@
+package envscan
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Proxy tools with a TUN mode, such as Clash Verge, v2rayN or another
+// sing-box, bring up their own TUN adapter and auto_route. With ours up as
+// well, the two fight over the routes and neither works. Scan reports
+// their running processes and their adapters as TunStack findings.
+//
+// The tools are listed in tools.json, so support can add one without
+// touching the code.
+
+//go:embed tools.json
+var toolsJSON []byte
+
+// Tool is a proxy tool that runs its own TUN stack.
+type Tool struct {
+	Product   string   `json:"product"`
+	Processes []string `json:"processes"`          // executable names, e.g. "v2rayn.exe"
+	Adapters  []string `json:"adapters,omitempty"` // fragments of its TUN adapter's name or description
+}
+
+// knownTools are matched in order, so more specific adapter fragments come
+// first.
+var knownTools = mustLoadTools(toolsJSON)
+
+func mustLoadTools(data []byte) []Tool {
+	tools, err := loadTools(data)
+	if err != nil {
+		panic(err)
+	}
+	return tools
+}
+
+// loadTools parses a tools list, lowercasing the names and fragments it
+// matches with.
+func loadTools(data []byte) ([]Tool, error) {
+	var tools []Tool
+	if err := json.Unmarshal(data, &tools); err != nil {
+		return nil, fmt.Errorf("tools: %w", err)
+	}
+	for i := range tools {
+		t := &tools[i]
+		if t.Product == "" || len(t.Processes) == 0 {
+			return nil, fmt.Errorf("tools: entry %d needs a product and its processes", i+1)
+		}
+		for j, name := range t.Processes {
+			t.Processes[j] = strings.ToLower(name)
+		}
+		for j, fragment := range t.Adapters {
+			if fragment == "" {
+				return nil, fmt.Errorf("tools: %s has an empty adapter fragment", t.Product)
+			}
+			t.Adapters[j] = strings.ToLower(fragment)
+		}
+	}
+	return tools, nil
+}
+
+// processTool returns the tool an executable belongs to, or nil.
+func processTool(name string) *Tool {
+	name = strings.ToLower(name)
+	for i, t := range knownTools {
+		for _, p := range t.Processes {
+			if name == p {
+				return &knownTools[i]
+			}
+		}
+	}
+	return nil
+}
+
+// adapterTool returns the tool whose TUN adapter a is, or nil.
+func adapterTool(a Adapter) *Tool {
+	text := strings.ToLower(a.Name + " " + a.Description)
+	for i, t := range knownTools {
+		for _, fragment := range t.Adapters {
+			if strings.Contains(text, fragment) {
+				return &knownTools[i]
+			}
+		}
+	}
+	return nil
+}
+
+// TunConflicts returns r with only its TunStack findings: the tools and
+// adapters that compete with the tunnel for auto_route.
+func (r Report) TunConflicts() Report {
+	conflicts := Report{Findings: []Finding{}, Errors: r.Errors}
+	for _, f := range r.Findings {
+		if f.TunStack {
+			conflicts.Findings = append(conflicts.Findings, f)
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,164 @@
+package envscan
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// Interface types backed by hardware. Everything else (tunnels, PPP,
+// loopback, "other") is treated as virtual.
+var physicalIfTypes = map[uint32]bool{
+	windows.IF_TYPE_ETHERNET_CSMACD: true,
+	windows.IF_TYPE_IEEE80211:       true,
+	243:                             true, // IF_TYPE_WWANPP
+	244:                             true, // IF_TYPE_WWANPP2
+}
+
+const internetSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// WindowsProvider reads adapters and routes from the IP Helper API and
+// proxy settings from each loaded user hive. The core runs as a service,
+// so HKEY_CURRENT_USER would be the service account's hive, not the user's.
+type WindowsProvider struct{}
+
+func (WindowsProvider) Adapters() ([]Adapter, error) {
+	size := uint32(15 * 1024)
+	for {
+		buf := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, windows.GAA_FLAG_INCLUDE_ALL_INTERFACES, 0, first, &size)
+		if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GetAdaptersAddresses: %w", err)
+		}
+
+		var adapters []Adapter
+		for a := first; a != nil; a = a.Next {
+			adapters = append(adapters, Adapter{
+				Index:       a.IfIndex,
+				Name:        windows.UTF16PtrToString(a.FriendlyName),
+				Description: windows.UTF16PtrToString(a.Description),
+				Up:          a.OperStatus == windows.IfOperStatusUp,
+				Virtual:     !physicalIfTypes[a.IfType],
+			})
+		}
+		return adapters, nil
+	}
+}
+
+func (WindowsProvider) Routes() ([]Route, error) {
+	var table *windows.MibIpForwardTable2
+	if err := windows.GetIpForwardTable2(windows.AF_UNSPEC, &table); err != nil {
+		return nil, fmt.Errorf("GetIpForwardTable2: %w", err)
+	}
+	defer windows.FreeMibTable(unsafe.Pointer(table))
+
+	var routes []Route
+	for _, row := range table.Rows() {
+		addr, ok := sockaddrAddr(&row.DestinationPrefix.Prefix)
+		if !ok {
+			continue
+		}
+		routes = append(routes, Route{
+			Prefix:         netip.PrefixFrom(addr, int(row.DestinationPrefix.PrefixLength)),
+			InterfaceIndex: row.InterfaceIndex,
+		})
+	}
+	return routes, nil
+}
+
+func sockaddrAddr(sa *windows.RawSockaddrInet) (netip.Addr, bool) {
+	switch sa.Family {
+	case windows.AF_INET:
+		return netip.AddrFrom4((*windows.RawSockaddrInet4)(unsafe.Pointer(sa)).Addr), true
+	case windows.AF_INET6:
+		return netip.AddrFrom16((*windows.RawSockaddrInet6)(unsafe.Pointer(sa)).Addr), true
+	}
+	return netip.Addr{}, false
+}
+
+func (WindowsProvider) Proxies() ([]ProxySetting, error) {
+	users, err := registry.USERS.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("enumerate user hives: %w", err)
+	}
+
+	var settings []ProxySetting
+	for _, sid := range users {
+		// Interactive accounts only; skips the service and *_Classes hives.
+		if !strings.HasPrefix(sid, "S-1-5-21-") || strings.HasSuffix(sid, "_Classes") {
+			continue
+		}
+		key, err := registry.OpenKey(registry.USERS, sid+`\`+internetSettingsKey, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		enabled, _, _ := key.GetIntegerValue("ProxyEnable")
+		server, _, _ := key.GetStringValue("ProxyServer")
+		pac, _, _ := key.GetStringValue("AutoConfigURL")
+		key.Close()
+
+		settings = append(settings, ProxySetting{
+			User:          sid,
+			Enabled:       enabled != 0,
+			Server:        server,
+			AutoConfigURL: pac,
+		})
+	}
+	return settings, nil
+}
+
+func (WindowsProvider) Processes() ([]Process, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("CreateToolhelp32Snapshot: %w", err)
+	}
+	defer windows.CloseHandle(snapshot)
+
+	self := uint32(os.Getpid())
+	var ownDir string
+	if exe, err := os.Executable(); err == nil {
+		ownDir = filepath.Dir(exe)
+	}
+	var processes []Process
+	entry := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+		if entry.ProcessID == self || ownDir != "" && strings.EqualFold(filepath.Dir(processImage(entry.ProcessID)), ownDir) {
+			continue
+		}
+		processes = append(processes, Process{
+			PID:  entry.ProcessID,
+			Name: windows.UTF16ToString(entry.ExeFile[:]),
+		})
+	}
+	if !errors.Is(err, windows.ERROR_NO_MORE_FILES) {
+		return processes, fmt.Errorf("Process32Next: %w", err)
+	}
+	return processes, nil
+}
+
+// processImage returns the full path of a process's executable, or "" when
+// the process cannot be opened.
+func processImage(pid uint32) string {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return ""
+	}
+	return windows.UTF16ToString(buf[:size])
+}
@@ -0,0 +1,150 @@
+// Package instance derives the names of the machine-wide resources an
+// installation of the service owns: its named pipe, Windows service, data
+// directory, TUN adapter, firewall rules and Clash API port. A developer
+// build started with -instance gets its own set, so it can run alongside
+// the production install; the default instance keeps the original names.
+package instance
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+)
+
+// baseName is the name of the default instance's resources; other
+// instances append "-<name>".
+const baseName = "MRVPN"
+
+// The default instance serves the Clash API on defaultClashPort. Named
+// instances use a port in the clashPortRange ports above it, picked by a
+// hash of the name: two named instances collide one time in
+// clashPortRange, and never with the default one.
+const (
+	defaultClashPort = 9090
+	clashPortRange   = 1000
+)
+
+// validName restricts instance names to what every derived name accepts:
+// pipe, service and adapter names, and a directory name. Lowercase only,
+// since Windows compares all of them case-insensitively.
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,15}$`)
+
+// Instance identifies one installation of the service. The zero value is
+// the default instance.
+type Instance struct {
+	name string
+}
+
+// Default is the instance of a normal install.
+var Default = Instance{}
+
+// New returns the instance called name; an empty name is the default
+// instance.
+func New(name string) (Instance, error) {
+	if name == "" {
+		return Default, nil
+	}
+	if !validName.MatchString(name) {
+		return Instance{}, fmt.Errorf("invalid instance name %q: use up to 16 lowercase letters, digits and hyphens", name)
+	}
+	return Instance{name: name}, nil
+}
+
+// Name returns the instance name, empty for the default instance.
+func (i Instance) Name() string {
+	return i.name
+}
+
+// IsDefault reports whether i is the default instance.
+func (i Instance) IsDefault() bool {
+	return i.name == ""
+}
+
+// qualified returns baseName with the instance suffix.
+func (i Instance) qualified() string {
+	if i.IsDefault() {
+		return baseName
+	}
+	return baseName + "-" + i.name
+}
+
+// PipeName returns the named pipe the IPC server listens on.
+func (i Instance) PipeName() string {
+	return `\\.\pipe\` + i.qualified()
+}
+
+// ServiceName returns the Windows service name, also used as the event
+// log source.
+func (i Instance) ServiceName() string {
+	return i.qualified()
+}
+
+// ServiceDisplayName returns the service name shown in the Services
+// console.
+func (i Instance) ServiceDisplayName() string {
+	if i.IsDefault() {
+		return baseName + " Service"
+	}
+	return baseName + " Service (" + i.name + ")"
+}
+
+// DataDirName returns the directory name used under %ProgramData%.
+func (i Instance) DataDirName() string {
+	return i.qualified()
+}
+
+// InterfaceName returns the name of the TUN adapter sing-box creates.
+func (i Instance) InterfaceName() string {
+	return i.qualified()
+}
+
+// FirewallRuleName returns the display name of every Windows Firewall rule
+// the service creates; FirewallProvider identifies them.
+func (i Instance) FirewallRuleName() string {
+	return i.qualified()
+}
+
+// firewallProvider is the GUID the default instance tags its Windows
+// Firewall rules with. Named instances derive theirs from it and the name.
+const firewallProvider = "{4D1C2A57-8B0E-4F3A-9C61-2E7F5B3D9A18}"
+
+// FirewallProvider returns the GUID every Windows Firewall rule the
+// service creates is grouped under, so cleanup finds them by it rather
+// than by a display name anyone could reuse.
+func (i Instance) FirewallProvider() string {
+	if i.IsDefault() {
+		return firewallProvider
+	}
+	// A name-based (version 5 style) UUID: stable across runs.
+	h := sha1.Sum([]byte(firewallProvider + i.name))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("{%X-%X-%X-%X-%X}", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// ClashPort returns the loopback port the generated config serves the
+// Clash API on.
+func (i Instance) ClashPort() int {
+	if i.IsDefault() {
+		return defaultClashPort
+	}
+	h := fnv.New32a()
+	h.Write([]byte(i.name))
+	return defaultClashPort + 1 + int(h.Sum32()%clashPortRange)
+}
+
+// ClashAddr returns the Clash API listen address.
+func (i Instance) ClashAddr() string {
+	return "127.0.0.1:" + strconv.Itoa(i.ClashPort())
+}
+
+// Args returns the command line flags that select the instance, to pass to
+// the service when it is installed.
+func (i Instance) Args() []string {
+	if i.IsDefault() {
+		return nil
+	}
+	return []string{"-instance", i.name}
+}
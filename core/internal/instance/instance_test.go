@@ -0,0 +1,63 @@
+package instance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultKeepsOriginalNames(t *testing.T) {
+	inst, err := New("")
+	if err != nil || !inst.IsDefault() {
+		t.Fatalf("New(\"\") = %+v, %v", inst, err)
+	}
+	got := []string{inst.PipeName(), inst.ServiceName(), inst.ServiceDisplayName(), inst.DataDirName(),
+		inst.InterfaceName(), inst.FirewallRuleName(), inst.ClashAddr()}
+	want := []string{`\\.\pipe\MRVPN`, "MRVPN", "MRVPN Service", "MRVPN", "MRVPN", "MRVPN", "127.0.0.1:9090"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("default names = %q, want %q", got, want)
+	}
+	if inst.Args() != nil {
+		t.Errorf("Args() = %q, want none", inst.Args())
+	}
+}
+
+func TestNamedInstance(t *testing.T) {
+	inst, err := New("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{inst.Name(), inst.PipeName(), inst.ServiceName(), inst.ServiceDisplayName(), inst.DataDirName(),
+		inst.InterfaceName(), inst.FirewallRuleName()}
+	want := []string{"dev", `\\.\pipe\MRVPN-dev`, "MRVPN-dev", "MRVPN Service (dev)", "MRVPN-dev", "MRVPN-dev", "MRVPN-dev"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+	port := inst.ClashPort()
+	if port <= defaultClashPort || port > defaultClashPort+clashPortRange {
+		t.Errorf("ClashPort() = %d, outside the named instance range", port)
+	}
+	if again, _ := New("dev"); again.ClashPort() != port {
+		t.Error("ClashPort() differs between runs")
+	}
+	if other, _ := New("staging"); other.ClashPort() == port {
+		t.Error("dev and staging share a Clash API port")
+	}
+	provider := inst.FirewallProvider()
+	if provider == Default.FirewallProvider() || len(provider) != 38 {
+		t.Errorf("FirewallProvider() = %s", provider)
+	}
+	if again, _ := New("dev"); again.FirewallProvider() != provider {
+		t.Error("FirewallProvider() differs between runs")
+	}
+	if got := inst.Args(); !reflect.DeepEqual(got, []string{"-instance", "dev"}) {
+		t.Errorf("Args() = %q", got)
+	}
+}
+
+func TestNewRejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"Dev", "-dev", "dev build", `dev\x`, "a-name-that-is-too-long"} {
+		if _, err := New(name); err == nil {
+			t.Errorf("New(%q) accepted", name)
+		}
+	}
+}
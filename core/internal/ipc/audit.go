@@ -0,0 +1,129 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/audit"
+)
+
+// auditedMethods are the methods that change the service's state, which
+// auditCalls records whether they succeed or not.
+var auditedMethods = map[string]bool{
+	"vpn.connect":            true,
+	"vpn.connectRaw":         true,
+	"vpn.disconnect":         true,
+	"vpn.reconnect":          true,
+	"vpn.setRateLimit":       true,
+	"split.setConfig":        true,
+	"split.pruneStale":       true,
+	"settings.set":           true,
+	"settings.adminLock":     true,
+	"settings.adminUnlock":   true,
+	"profiles.save":          true,
+	"profiles.delete":        true,
+	"profiles.exportLink":    true, // hands out credentials
+	"subscriptions.save":     true,
+	"subscriptions.delete":   true,
+	"subscriptions.refresh":  true,
+	"debug.traceConnections": true,
+	"maintenance.clearCache": true,
+	"service.shutdown":       true,
+}
+
+// maxAuditQueryEntries caps the entries audit.query returns, the most
+// recent ones.
+const maxAuditQueryEntries = 1000
+
+// SetAuditLog sets the log auditCalls records state changes in.
+func (h *Handler) SetAuditLog(l *audit.Log) {
+	h.mu.Lock()
+	h.audit = l
+	h.mu.Unlock()
+}
+
+// auditCalls records every call of an audited method in the audit log,
+// with who made it, its params with credentials redacted and its outcome.
+// Calls the service makes itself, such as scheduled connects, name their
+// origin instead of a client.
+func (h *Handler) auditCalls(next methodFunc) methodFunc {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, *RPCError) {
+		h.mu.RLock()
+		l := h.audit
+		h.mu.RUnlock()
+		method := methodName(ctx)
+		if l == nil || !auditedMethods[method] {
+			return next(ctx, params)
+		}
+
+		start := time.Now()
+		result, rpcErr := next(ctx, params)
+		entry := audit.Entry{
+			Time:       start,
+			Method:     method,
+			RequestID:  requestID(ctx),
+			Actor:      auditActor(ctx),
+			Params:     audit.Redact(params),
+			Outcome:    audit.OutcomeOK,
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if rpcErr != nil {
+			entry.Outcome = audit.OutcomeError
+			entry.ErrorKey = rpcErr.Key
+		}
+		if err := l.Append(entry); err != nil {
+			log.Printf("failed to write audit log: %v", err)
+		}
+		return result, rpcErr
+	}
+}
+
+// auditActor returns who made the call served by ctx.
+func auditActor(ctx context.Context) audit.Actor {
+	if id := requestIdentity(ctx); id != nil {
+		return audit.Actor{PID: id.PID, Image: id.Image, User: id.SID}
+	}
+	if requestClient(ctx) != nil {
+		return audit.Actor{Origin: "client"} // connected, but not resolved
+	}
+	return audit.Actor{Origin: attemptOrigin(ctx)}
+}
+
+// handleAuditQuery returns audit log entries to administrators: clients
+// running elevated.
+func (h *Handler) handleAuditQuery(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	if id := requestIdentity(ctx); id == nil || !id.Elevated {
+		return nil, rpcError(ErrCodeInvalidRequest, ErrKeyAdminRequired, "audit.query requires an elevated client")
+	}
+	var params AuditQueryParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	if params.From < 0 || params.To < 0 || (params.To > 0 && params.To < params.From) {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid time range")
+	}
+	h.mu.RLock()
+	l := h.audit
+	h.mu.RUnlock()
+	if l == nil {
+		return AuditQueryResult{Entries: []audit.Entry{}}, nil
+	}
+
+	q := audit.Query{Method: params.Method, Limit: maxAuditQueryEntries}
+	if params.From > 0 {
+		q.From = time.Unix(params.From, 0)
+	}
+	if params.To > 0 {
+		q.To = time.Unix(params.To, 0)
+	}
+	entries, truncated, err := l.Query(q)
+	if err != nil {
+		log.Printf("audit.query failed: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyStorageFailed, "failed to read the audit log")
+	}
+	return AuditQueryResult{Entries: entries, Truncated: truncated}, nil
+}
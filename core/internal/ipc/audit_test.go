@@ -0,0 +1,199 @@
+package ipc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/profiles"
+	"github.com/mriaz/vpn-core/internal/settings"
+)
+
+// pipeClient is a client connection served by a test handler.
+type pipeClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// connectAs serves a new connection whose client resolves to id.
+func connectAs(t *testing.T, h *Handler, id *ClientIdentity) *pipeClient {
+	server, conn := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	h.identify = func(net.Conn) *ClientIdentity { return id }
+	go func() {
+		c := newClient(&h.notify)
+		var ok bool
+		if c.identity, ok = h.admitConn(server); !ok {
+			server.Close()
+			return
+		}
+		h.serve(server, c)
+	}()
+	return &pipeClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+}
+
+func (p *pipeClient) call(id, method string, params interface{}) *Response {
+	raw, _ := json.Marshal(params)
+	line, _ := json.Marshal(Request{ID: id, Method: method, Params: raw})
+	go p.conn.Write(append(line, '\n'))
+	if !p.scanner.Scan() {
+		p.t.Fatalf("%s: no response: %v", method, p.scanner.Err())
+	}
+	var resp Response
+	if err := json.Unmarshal(p.scanner.Bytes(), &resp); err != nil {
+		p.t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestAuditLog(t *testing.T) {
+	h := newTestHandler(t)
+	path := filepath.Join(t.TempDir(), audit.FileName)
+	h.SetAuditLog(audit.Open(path, func() audit.Retention { return audit.DefaultRetention }))
+
+	user := &ClientIdentity{PID: 4242, Image: `C:\Program Files\MRVPN\mrvpn.exe`, SID: "S-1-5-21-1-2-3-1001"}
+	c := connectAs(t, h, user)
+	const token = "correct-horse-battery-staple"
+	c.call("1", "settings.set", map[string]int{"healthIntervalMinutes": 30})
+	c.call("2", "vpn.status", nil) // reads are not audited
+	c.call("3", "vpn.connect", map[string]string{"link": "vless://11111111-secret@router.lan:443#Home"})
+	c.call("4", "settings.adminLock", AdminLockParams{Token: token})
+
+	// Calls the service makes itself name their origin.
+	ctx := context.WithValue(context.Background(), attemptOriginKey{}, "schedule")
+	h.registry.dispatch(ctx, "vpn.disconnect", json.RawMessage(`{"force":true}`))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) || strings.Contains(string(data), "11111111-secret") {
+		t.Fatalf("audit log holds a credential:\n%s", data)
+	}
+	var entries []audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e audit.Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want 4:\n%s", len(entries), data)
+	}
+
+	want := []struct {
+		method, requestID, outcome, errorKey, params string
+		actor                                        audit.Actor
+	}{
+		{"settings.set", "1", audit.OutcomeOK, "", `{"healthIntervalMinutes":30}`, audit.Actor{PID: 4242, Image: user.Image, User: user.SID}},
+		{"vpn.connect", "3", audit.OutcomeError, ErrKeyServerPrivate, `{"link":"vless://router.lan:443"}`, audit.Actor{PID: 4242, Image: user.Image, User: user.SID}},
+		{"settings.adminLock", "4", audit.OutcomeOK, "", `{"token":"[redacted]"}`, audit.Actor{PID: 4242, Image: user.Image, User: user.SID}},
+		{"vpn.disconnect", "", audit.OutcomeOK, "", `{"force":true}`, audit.Actor{Origin: "schedule"}},
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Method != w.method || e.RequestID != w.requestID || e.Outcome != w.outcome || e.ErrorKey != w.errorKey ||
+			string(e.Params) != w.params || e.Actor != w.actor || e.Time.IsZero() {
+			t.Errorf("entry %d = %+v (params %s), want %+v", i, e, e.Params, w)
+		}
+	}
+}
+
+func TestExportLinkAudited(t *testing.T) {
+	h := newTestHandler(t)
+	path := filepath.Join(t.TempDir(), audit.FileName)
+	h.SetAuditLog(audit.Open(path, func() audit.Retention { return audit.DefaultRetention }))
+	saved, err := h.profiles.Save(profiles.Profile{Name: "Home & Away", Link: "hy2://s3cret@home.example.com?obfs=salamander&obfs-password=x#Old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectAs(t, h, &ClientIdentity{PID: 7})
+	if resp := c.call("1", "profiles.exportLink", ExportLinkParams{ID: saved.ID}); resp.Error == nil || resp.Error.Code != ErrCodeConfirmationRequired {
+		t.Fatalf("unconfirmed export = %+v", resp)
+	}
+	resp := c.call("2", "profiles.exportLink", ExportLinkParams{ID: saved.ID, Confirm: true})
+	if resp.Error != nil {
+		t.Fatalf("export = %+v", resp.Error)
+	}
+	var result ExportLinkResult
+	raw, _ := json.Marshal(resp.Result)
+	if err := json.Unmarshal(raw, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Link != "hysteria2://s3cret@home.example.com:443?obfs=salamander&obfs-password=x#Home%20&%20Away" || result.Name != "Home & Away" {
+		t.Errorf("export = %+v", result)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Fatalf("audit log holds the credential:\n%s", data)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var last audit.Entry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || last.Method != "profiles.exportLink" || last.Outcome != audit.OutcomeOK || last.Actor.PID != 7 {
+		t.Errorf("audit log:\n%s", data)
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetAuditLog(audit.Open(filepath.Join(t.TempDir(), audit.FileName), func() audit.Retention { return audit.DefaultRetention }))
+
+	user := connectAs(t, h, &ClientIdentity{PID: 1, SID: "S-1-5-21-1-2-3-1001"})
+	user.call("1", "settings.set", map[string]int{"healthIntervalMinutes": 30})
+	user.call("2", "vpn.disconnect", DestructiveParams{Force: true})
+	if resp := user.call("3", "audit.query", nil); resp.Error == nil || resp.Error.Key != ErrKeyAdminRequired {
+		t.Fatalf("audit.query by a standard user = %+v, want %s", resp.Error, ErrKeyAdminRequired)
+	}
+	// Outside a client connection there is no one to check.
+	if resp := call(h, "audit.query", nil); resp.Error == nil || resp.Error.Key != ErrKeyAdminRequired {
+		t.Fatalf("audit.query without a client = %+v, want %s", resp.Error, ErrKeyAdminRequired)
+	}
+
+	admin := connectAs(t, h, &ClientIdentity{PID: 2, SID: "S-1-5-21-1-2-3-500", Elevated: true})
+	resp := admin.call("1", "audit.query", AuditQueryParams{Method: "settings.set"})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	var result AuditQueryResult
+	raw, _ := json.Marshal(resp.Result)
+	json.Unmarshal(raw, &result)
+	if len(result.Entries) != 1 || result.Entries[0].Method != "settings.set" || result.Entries[0].Actor.PID != 1 {
+		t.Errorf("got %+v, want the one settings.set", result.Entries)
+	}
+
+	if resp := admin.call("2", "audit.query", AuditQueryParams{From: 2000, To: 1000}); resp.Error == nil || resp.Error.Key != ErrKeyInvalidParams {
+		t.Errorf("inverted range = %+v, want %s", resp.Error, ErrKeyInvalidParams)
+	}
+}
+
+func TestAuditRetentionSettings(t *testing.T) {
+	h := newTestHandler(t)
+	if resp := call(h, "settings.set", map[string]int{"auditMaxSizeMb": 0}); resp.Error == nil || resp.Error.Key != ErrKeySettingsInvalid {
+		t.Errorf("auditMaxSizeMb 0 = %+v, want %s", resp.Error, ErrKeySettingsInvalid)
+	}
+	if resp := call(h, "settings.set", map[string]int{"auditMaxSizeMb": 20, "auditKeepFiles": 2}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if got := h.settings.Get().AuditRetention(); got != (audit.Retention{MaxSizeMB: 20, Keep: 2}) {
+		t.Errorf("retention = %+v", got)
+	}
+	if got := settings.Defaults().AuditRetention(); got != audit.DefaultRetention {
+		t.Errorf("default retention = %+v", got)
+	}
+}
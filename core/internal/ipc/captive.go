@@ -0,0 +1,143 @@
+package ipc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// A connect that fails on a network that does not answer may be stuck
+// behind a captive portal. The handler then checks for one and, if found,
+// gives the user settings.captivePortalGraceMinutes to sign in: scheduled
+// connects are held off meanwhile, and the connect that ran into the
+// portal is tried once more when the grace window ends.
+
+// captiveRetryTimeout bounds the connect retried after the grace window,
+// as methodTimeouts bounds vpn.connect.
+const captiveRetryTimeout = 2 * time.Minute
+
+// captiveRetryKey marks the context of a retried connect, whose failure
+// does not start another grace window.
+type captiveRetryKey struct{}
+
+// captiveGrace is the grace window of a detected captive portal.
+type captiveGrace struct {
+	mu    sync.Mutex
+	until time.Time                                          // zero when no window is open
+	stop  func() bool                                        // cancels the retry timer
+	retry func()                                             // runs when the window ends; nil for none
+	after func(d time.Duration, f func()) (stop func() bool) // replaced in tests
+	now   func() time.Time                                   // replaced in tests
+}
+
+func newCaptiveGrace() *captiveGrace {
+	return &captiveGrace{
+		after: func(d time.Duration, f func()) func() bool { return time.AfterFunc(d, f).Stop },
+		now:   time.Now,
+	}
+}
+
+// active reports whether a grace window is open.
+func (g *captiveGrace) active() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !g.until.IsZero()
+}
+
+// pending reports whether a connect waits for the grace window to end.
+func (g *captiveGrace) pending() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.retry != nil
+}
+
+// begin opens a grace window of d that runs retry when it ends, replacing
+// any open one, and returns when it ends.
+func (g *captiveGrace) begin(d time.Duration, retry func()) time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stop != nil {
+		g.stop()
+	}
+	g.until = g.now().Add(d)
+	g.retry = retry
+	g.stop = g.after(d, g.expire)
+	return g.until
+}
+
+// deferRetry replaces the retry of the open window with retry.
+func (g *captiveGrace) deferRetry(retry func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.until.IsZero() {
+		g.retry = retry
+	}
+}
+
+// cancel closes the grace window without a retry, as when a connect
+// succeeded meanwhile.
+func (g *captiveGrace) cancel() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stop != nil {
+		g.stop()
+	}
+	g.until, g.stop, g.retry = time.Time{}, nil, nil
+}
+
+// expire closes the window and runs its retry.
+func (g *captiveGrace) expire() {
+	g.mu.Lock()
+	retry := g.retry
+	g.until, g.stop, g.retry = time.Time{}, nil, nil
+	g.mu.Unlock()
+	if retry != nil {
+		retry()
+	}
+}
+
+// checkCaptivePortal runs after a connect failed with err. If the failure
+// looks like a blocked network and a captive portal is found, it opens a
+// grace window, announces the portal with vpn.captivePortalDetected, and
+// returns the error for the connect.
+func (h *Handler) checkCaptivePortal(ctx context.Context, err error, params *ConnectParams, cfg *vpn.Config) *RPCError {
+	if !vpn.IsNetworkError(err) || ctx.Value(captiveRetryKey{}) != nil {
+		return nil
+	}
+	portal := h.detectPortal(ctx)
+	if !portal.Detected {
+		return nil
+	}
+	log.Printf("vpn.connect: captive portal detected at %s", portal.URL)
+
+	grace := time.Duration(h.settings.Get().CaptivePortalGraceMinutes) * time.Minute
+	retryAt := h.captive.begin(grace, func() { h.retryAfterPortal(params, cfg) })
+
+	h.mu.RLock()
+	notifier := h.notifier
+	h.mu.RUnlock()
+	if notifier != nil {
+		notifier.Broadcast(TopicAlerts, &Notification{
+			Method: "vpn.captivePortalDetected",
+			Params: CaptivePortalParams{PortalURL: portal.URL, GraceSeconds: int(grace.Seconds()), RetryAt: retryAt.Unix()},
+		})
+	}
+	return rpcErrorData(ErrCodeInternal, ErrKeyCaptivePortal, "a captive portal is blocking the network",
+		map[string]interface{}{"portalUrl": portal.URL, "retryAt": retryAt.Unix()})
+}
+
+// retryAfterPortal tries a connect held off by a captive portal again,
+// unless a session was started meanwhile.
+func (h *Handler) retryAfterPortal(params *ConnectParams, cfg *vpn.Config) {
+	if state := h.stateMachine.State(); state != vpn.StateDisconnected && state != vpn.StateError {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), captiveRetryKey{}, true), captiveRetryTimeout)
+	defer cancel()
+	if _, rpcErr := h.connect(ctx, params, cfg); rpcErr != nil {
+		log.Printf("vpn.connect: retry after captive portal failed: %s", rpcErr.Message)
+	}
+}
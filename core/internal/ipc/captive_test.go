@@ -0,0 +1,96 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/profiles"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// fakeTimer stands in for time.AfterFunc, firing only when told.
+type fakeTimer struct {
+	d       time.Duration
+	fire    func()
+	stopped bool
+}
+
+func (f *fakeTimer) after(d time.Duration, fn func()) func() bool {
+	f.d, f.fire, f.stopped = d, fn, false
+	return func() bool { f.stopped = true; return true }
+}
+
+func TestCaptivePortalGrace(t *testing.T) {
+	h := newTestHandler(t)
+	notifier := &recordingNotifier{}
+	h.SetNotifier(notifier)
+	timer := &fakeTimer{}
+	h.captive.after = timer.after
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	h.captive.now = func() time.Time { return now }
+	probes := 0
+	h.detectPortal = func(context.Context) vpn.CaptivePortal {
+		probes++
+		return vpn.CaptivePortal{Detected: true, URL: "http://portal.example/login"}
+	}
+	cfg := vpn.DefaultConfig()
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}
+
+	// Failures unrelated to the network are not probed.
+	if rpcErr := h.checkCaptivePortal(context.Background(), errors.New("bad config"), &ConnectParams{}, cfg); rpcErr != nil || probes != 0 {
+		t.Fatalf("config error: %+v, %d probes", rpcErr, probes)
+	}
+
+	rpcErr := h.checkCaptivePortal(context.Background(), dialErr, &ConnectParams{}, cfg)
+	if rpcErr == nil || rpcErr.Key != ErrKeyCaptivePortal || rpcErr.Data["portalUrl"] != "http://portal.example/login" {
+		t.Fatalf("error = %+v", rpcErr)
+	}
+	if !h.captive.active() || timer.d != 5*time.Minute {
+		t.Errorf("grace active %v for %s, want 5m", h.captive.active(), timer.d)
+	}
+	if len(notifier.sent) != 1 || notifier.topics[0] != TopicAlerts || notifier.sent[0].Method != "vpn.captivePortalDetected" {
+		t.Fatalf("notifications = %+v", notifier.sent)
+	}
+	if p := notifier.sent[0].Params.(CaptivePortalParams); p.RetryAt != now.Add(5*time.Minute).Unix() || p.GraceSeconds != 300 {
+		t.Errorf("params = %+v", p)
+	}
+
+	// A scheduled connect waits for the window to end and then replaces
+	// the retry of the failed connect.
+	p, err := h.profiles.Save(profiles.Profile{Link: "vless://u@example.com:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rpcErr := h.scheduledConnect(context.Background(), p.ID); rpcErr == nil || rpcErr.Key != ErrKeyCaptivePortal {
+		t.Fatalf("scheduled connect during grace = %+v", rpcErr)
+	}
+
+	// The retry is skipped once a session was started meanwhile.
+	h.stateMachine.SetState(vpn.StateConnected, nil)
+	timer.fire()
+	if h.captive.active() {
+		t.Error("grace still active after it ended")
+	}
+	if h.stateMachine.State() != vpn.StateConnected {
+		t.Errorf("state = %s, want the session left alone", h.stateMachine.State())
+	}
+	h.stateMachine.SetState(vpn.StateDisconnected, nil)
+
+	// A retried connect that fails again does not open another window.
+	retry := context.WithValue(context.Background(), captiveRetryKey{}, true)
+	if rpcErr := h.checkCaptivePortal(retry, dialErr, &ConnectParams{}, cfg); rpcErr != nil {
+		t.Errorf("retry failure = %+v", rpcErr)
+	}
+
+	// Disconnecting calls off a pending retry.
+	h.checkCaptivePortal(context.Background(), dialErr, &ConnectParams{}, cfg)
+	if resp := call(h, "vpn.disconnect", DestructiveParams{Force: true}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if h.captive.active() || !timer.stopped {
+		t.Error("disconnect left the grace window open")
+	}
+}
@@ -0,0 +1,75 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/settings"
+)
+
+// auditClientRejected is the audit log method of a connection the client
+// allow-list refused.
+const auditClientRejected = "ipc.connect"
+
+// admitClient checks the client id against the client allow-list of the
+// settings (AllowedClientPaths and AllowedClientSigners) and returns why
+// it is refused, nil if it may use the service. It runs as the client
+// connects, before any of its requests.
+func (h *Handler) admitClient(id *ClientIdentity) error {
+	s := h.settings.Get()
+	if !s.ClientAllowListed() {
+		return nil
+	}
+	if id == nil || id.Image == "" {
+		return errors.New("the client's executable could not be resolved")
+	}
+	return h.admitImage(&s, id.Image)
+}
+
+// admitImage checks the executable at image against the client allow-list
+// of s, which restricts the clients.
+func (h *Handler) admitImage(s *settings.Settings, image string) error {
+	if s.ClientPathAllowed(image) {
+		return nil
+	}
+	if len(s.AllowedClientSigners) == 0 {
+		return fmt.Errorf("%s is not an allowed client", image)
+	}
+	thumbprint, err := h.verifySigner(image)
+	if err != nil {
+		return fmt.Errorf("%s has no valid signature: %w", image, err)
+	}
+	if !s.ClientSignerAllowed(thumbprint) {
+		return fmt.Errorf("%s is signed by %s, which is not an allowed signer", image, thumbprint)
+	}
+	return nil
+}
+
+// rejectClient logs and audits a connection admitClient refused.
+func (h *Handler) rejectClient(id *ClientIdentity, reason error) {
+	log.Printf("rejecting IPC client: %v", reason)
+	h.mu.RLock()
+	l := h.audit
+	h.mu.RUnlock()
+	if l == nil {
+		return
+	}
+	entry := audit.Entry{
+		Time:     time.Now(),
+		Method:   auditClientRejected,
+		Actor:    audit.Actor{Origin: "client"},
+		Outcome:  audit.OutcomeError,
+		ErrorKey: ErrKeyClientNotAllowed,
+	}
+	if id != nil {
+		entry.Actor = audit.Actor{PID: id.PID, Image: id.Image, User: id.SID}
+	}
+	entry.Params, _ = json.Marshal(map[string]string{"reason": reason.Error()})
+	if err := l.Append(entry); err != nil {
+		log.Printf("failed to write audit log: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/settings"
+)
+
+const (
+	appImage      = `C:\Program Files\MRVPN\mrvpn.exe`
+	appThumbprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+)
+
+// admitted reports whether a client resolving to id is served: it answers
+// vpn.status rather than being disconnected.
+func admitted(t *testing.T, h *Handler, id *ClientIdentity) bool {
+	c := connectAs(t, h, id)
+	line, _ := json.Marshal(Request{ID: "1", Method: "vpn.status"})
+	go c.conn.Write(append(line, '\n'))
+	return c.scanner.Scan()
+}
+
+func TestClientAllowList(t *testing.T) {
+	h := newTestHandler(t)
+	st := settings.Open(filepath.Join(t.TempDir(), settings.FileName), nil)
+	h.settings = st
+	auditPath := filepath.Join(t.TempDir(), audit.FileName)
+	h.SetAuditLog(audit.Open(auditPath, func() audit.Retention { return audit.DefaultRetention }))
+	signers := map[string]string{
+		`C:\Program Files\MRVPN\helper.exe`: appThumbprint,
+		`C:\Users\bob\Downloads\tool.exe`:   "ffffffffffffffffffffffffffffffffffffffff",
+	}
+	h.verifySigner = func(image string) (string, error) {
+		if thumbprint, ok := signers[image]; ok {
+			return thumbprint, nil
+		}
+		return "", errors.New("TRUST_E_NOSIGNATURE")
+	}
+	other := &ClientIdentity{PID: 7, Image: `C:\Users\bob\Downloads\tool.exe`, SID: "S-1-5-21-1-2-3-1001"}
+
+	// Off by default: every client is served.
+	if !admitted(t, h, other) {
+		t.Fatal("client refused without an allow-list")
+	}
+
+	// Enabling takes an admin lock and its token.
+	allowList := map[string]interface{}{
+		"allowedClientPaths":   []string{strings.ToLower(appImage)},
+		"allowedClientSigners": []string{strings.ToLower(appThumbprint)},
+	}
+	if resp := call(h, "settings.set", allowList); resp.Error == nil || resp.Error.Key != ErrKeySettingsLocked {
+		t.Fatalf("settings.set without an admin lock = %+v, want %s", resp.Error, ErrKeySettingsLocked)
+	}
+	const token = "correct-horse-battery"
+	if resp := call(h, "settings.adminLock", AdminLockParams{Token: token}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if resp := call(h, "settings.set", allowList); resp.Error == nil || resp.Error.Key != ErrKeySettingsLocked {
+		t.Fatalf("settings.set without token = %+v, want %s", resp.Error, ErrKeySettingsLocked)
+	}
+	allowList["adminToken"] = token
+	if resp := call(h, "settings.set", allowList); resp.Error != nil {
+		t.Fatalf("settings.set with token: %+v", resp.Error)
+	}
+	if resp := call(h, "settings.set", map[string]interface{}{"allowedClientSigners": []string{"abc"}, "adminToken": token}); resp.Error == nil || resp.Error.Key != ErrKeySettingsInvalid {
+		t.Errorf("settings.set of a bad thumbprint = %+v, want %s", resp.Error, ErrKeySettingsInvalid)
+	}
+
+	tests := []struct {
+		name string
+		id   *ClientIdentity
+		ok   bool
+	}{
+		{"listed path", &ClientIdentity{PID: 1, Image: appImage}, true},
+		{"allowed signer", &ClientIdentity{PID: 2, Image: `C:\Program Files\MRVPN\helper.exe`}, true},
+		{"other signer", other, false},
+		{"unsigned", &ClientIdentity{PID: 3, Image: `C:\Windows\System32\cmd.exe`}, false},
+		{"unresolved", nil, false},
+	}
+	for _, tt := range tests {
+		if got := admitted(t, h, tt.id); got != tt.ok {
+			t.Errorf("%s: admitted = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejected []audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e audit.Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if e.Method == auditClientRejected {
+			rejected = append(rejected, e)
+		}
+	}
+	if len(rejected) != 3 {
+		t.Fatalf("got %d rejections, want 3:\n%s", len(rejected), data)
+	}
+	if e := rejected[0]; e.Outcome != audit.OutcomeError || e.ErrorKey != ErrKeyClientNotAllowed ||
+		e.Actor != (audit.Actor{PID: other.PID, Image: other.Image, User: other.SID}) || !strings.Contains(string(e.Params), "not an allowed signer") {
+		t.Errorf("rejection = %+v", e)
+	}
+	if e := rejected[2]; e.Actor != (audit.Actor{Origin: "client"}) {
+		t.Errorf("unresolved rejection actor = %+v", e.Actor)
+	}
+
+	// Unlocked, the list can only be cleared.
+	if resp := call(h, "settings.adminUnlock", AdminLockParams{Token: token}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if resp := call(h, "settings.set", map[string][]string{"allowedClientPaths": {appImage}}); resp.Error == nil {
+		t.Error("allow-list changed without an admin lock")
+	}
+	if resp := call(h, "settings.set", map[string][]string{"allowedClientPaths": {}, "allowedClientSigners": {}}); resp.Error != nil {
+		t.Fatalf("clearing the allow-list: %+v", resp.Error)
+	}
+	if !admitted(t, h, other) {
+		t.Error("client refused after clearing the allow-list")
+	}
+}
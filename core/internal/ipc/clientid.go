@@ -0,0 +1,48 @@
+package ipc
+
+import (
+	"log"
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// identifyPipeClient resolves the process at the client end of a named
+// pipe connection. A process that exits or cannot be opened leaves the
+// rest of the identity empty; nil means conn is not a pipe.
+func identifyPipeClient(conn net.Conn) *ClientIdentity {
+	pipe, ok := conn.(interface{ Fd() uintptr })
+	if !ok {
+		return nil
+	}
+	id := &ClientIdentity{}
+	if err := windows.GetNamedPipeClientProcessId(windows.Handle(pipe.Fd()), &id.PID); err != nil {
+		log.Printf("failed to identify IPC client: %v", err)
+		return nil
+	}
+
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, id.PID)
+	if err != nil {
+		log.Printf("failed to open IPC client process %d: %v", id.PID, err)
+		return id
+	}
+	defer windows.CloseHandle(process)
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(process, 0, &buf[0], &size); err == nil {
+		id.Image = windows.UTF16ToString(buf[:size])
+	}
+
+	var token windows.Token
+	if err := windows.OpenProcessToken(process, windows.TOKEN_QUERY, &token); err != nil {
+		log.Printf("failed to open the token of IPC client process %d: %v", id.PID, err)
+		return id
+	}
+	defer token.Close()
+	if user, err := token.GetTokenUser(); err == nil {
+		id.SID = user.User.Sid.String()
+	}
+	id.Elevated = token.IsElevated()
+	return id
+}
@@ -0,0 +1,78 @@
+package ipc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// EncodingGzip is the only message compression clients can negotiate.
+const EncodingGzip = "gzip"
+
+// compressThreshold is the size above which messages to a client that
+// negotiated compression are compressed. Smaller ones gain little and cost
+// the client an extra decode.
+const compressThreshold = 8 << 10
+
+// Envelope carries a compressed message on the wire, on its own line like
+// any other message. Data is the message's JSON compressed with Encoding,
+// base64 encoded. Clients that list an encoding in core.hello's compression
+// receive large responses and notifications this way, and may send
+// requests this way whether they negotiated or not.
+type Envelope struct {
+	Compressed bool   `json:"compressed"`
+	Encoding   string `json:"encoding"`
+	Data       []byte `json:"data"`
+}
+
+// negotiateCompression returns the encoding to use with a client offering
+// offered, or "" for plain JSON.
+func negotiateCompression(offered []string) string {
+	if slices.Contains(offered, EncodingGzip) {
+		return EncodingGzip
+	}
+	return ""
+}
+
+// compressMessage wraps a newline-terminated message in a gzip Envelope.
+// It returns data unchanged when the envelope would not be smaller.
+func compressMessage(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bytes.TrimSuffix(data, []byte{'\n'}))
+	if err := zw.Close(); err != nil {
+		return data
+	}
+	out, err := json.Marshal(Envelope{Compressed: true, Encoding: EncodingGzip, Data: buf.Bytes()})
+	if err != nil || len(out)+1 >= len(data) {
+		return data
+	}
+	return append(out, '\n')
+}
+
+// decodeMessage returns the message a line carries: the line itself, or
+// the inflated contents of an Envelope, limited to maxMessageSize.
+func decodeMessage(line []byte) ([]byte, error) {
+	var env Envelope
+	if err := json.Unmarshal(line, &env); err != nil || !env.Compressed {
+		return line, nil
+	}
+	if env.Encoding != EncodingGzip {
+		return nil, fmt.Errorf("unsupported encoding %q", env.Encoding)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(env.Data))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(zr, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMessageSize {
+		return nil, fmt.Errorf("message exceeds %d bytes", maxMessageSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,190 @@
+package ipc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+)
+
+func TestCompressMessage(t *testing.T) {
+	large := notification(t, "apps.list", strings.Repeat(`{"name":"App","exeName":"app.exe"},`, 1000))
+	out := compressMessage(large)
+	if len(out) >= len(large) || out[len(out)-1] != '\n' {
+		t.Fatalf("compressed %d bytes to %d", len(large), len(out))
+	}
+	var env Envelope
+	if err := json.Unmarshal(out, &env); err != nil || !env.Compressed || env.Encoding != EncodingGzip {
+		t.Fatalf("envelope = %+v, %v", env, err)
+	}
+	got, err := decodeMessage(bytes.TrimSuffix(out, []byte{'\n'}))
+	if err != nil || !bytes.Equal(got, bytes.TrimSuffix(large, []byte{'\n'})) {
+		t.Errorf("round trip = %.60q, %v", got, err)
+	}
+
+	// Random-looking data does not shrink, so it goes out as is.
+	const alphabet = "!#$%'()*+,-./0123456789:;=?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[]^_`abcdefghijklmnopqrstuvwxyz{|}~"
+	rng := rand.New(rand.NewPCG(1, 2))
+	var noise strings.Builder
+	for noise.Len() < 2*compressThreshold {
+		noise.WriteByte(alphabet[rng.IntN(len(alphabet))])
+	}
+	incompressible := notification(t, "x", noise.String())
+	if out := compressMessage(incompressible); !bytes.Equal(out, incompressible) {
+		t.Errorf("incompressible message enveloped: %d to %d bytes", len(incompressible), len(out))
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	plain := []byte(`{"id":"1","method":"core.hello","params":{"data":"x"}}`)
+	if got, err := decodeMessage(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("plain request = %q, %v", got, err)
+	}
+	for _, line := range []string{
+		`{"compressed":true,"encoding":"br","data":""}`,
+		`{"compressed":true,"encoding":"gzip","data":"bm90IGd6aXA="}`,
+	} {
+		if _, err := decodeMessage([]byte(line)); err == nil {
+			t.Errorf("decodeMessage(%s) succeeded", line)
+		}
+	}
+	huge := compressMessage(append(bytes.Repeat([]byte(" "), maxMessageSize+1), '\n'))
+	if _, err := decodeMessage(huge); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("oversized message: %v", err)
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	h := newTestHandler(t)
+	c := newClient(&h.notify)
+	var id int
+	hello := func(offered ...string) HelloResult {
+		t.Helper()
+		raw, _ := json.Marshal(HelloParams{Compression: offered})
+		id++
+		resp := h.handleFor(context.Background(), c, &Request{ID: strconv.Itoa(id), Method: "core.hello", Params: raw})
+		r, ok := resp.Result.(HelloResult)
+		if !ok {
+			t.Fatalf("core.hello = %+v", resp)
+		}
+		return r
+	}
+	if r := hello("br", "gzip"); r.Compression != EncodingGzip || !c.gzip.Load() {
+		t.Errorf("compression = %q, negotiated %v", r.Compression, c.gzip.Load())
+	}
+	if r := hello(); r.Compression != "" || c.gzip.Load() {
+		t.Errorf("hello without compression kept %q, negotiated %v", r.Compression, c.gzip.Load())
+	}
+	// Without a client connection there is nothing to negotiate.
+	if resp := call(h, "core.hello", HelloParams{Compression: []string{EncodingGzip}}); resp.Result.(HelloResult).Compression != "" {
+		t.Errorf("compression negotiated without a client")
+	}
+}
+
+// readLine reads one message from r, inflating it if enveloped, and
+// reports whether it was.
+func readLine(t *testing.T, r *bufio.Reader) ([]byte, bool) {
+	t.Helper()
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := decodeMessage(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, !bytes.Equal(data, line)
+}
+
+// TestMixedClientBroadcast delivers the same notifications to a client that
+// negotiated compression and one that did not.
+func TestMixedClientBroadcast(t *testing.T) {
+	var counters notifyCounters
+	plainClient, gzipClient := newClient(&counters), newClient(&counters)
+	gzipClient.gzip.Store(true)
+
+	readers := map[*client]*bufio.Reader{}
+	for _, c := range []*client{plainClient, gzipClient} {
+		r, w := io.Pipe()
+		defer r.Close()
+		readers[c] = bufio.NewReaderSize(r, 1<<20)
+		go c.queue.run(func(data []byte) error { return c.write(w, data) })
+	}
+
+	small := notification(t, "vpn.healthChanged", map[string]bool{"healthy": true})
+	large := notification(t, "split.staleEntries", strings.Repeat("stale entry ", 2000))
+	for _, data := range [][]byte{small, large} {
+		plainClient.deliver(TopicState, "m", data)
+		gzipClient.deliver(TopicState, "m", data)
+	}
+
+	for _, tt := range []struct {
+		c          *client
+		compressed [2]bool
+	}{
+		{plainClient, [2]bool{false, false}},
+		{gzipClient, [2]bool{false, true}},
+	} {
+		for i, want := range [][]byte{small, large} {
+			got, compressed := readLine(t, readers[tt.c])
+			if compressed != tt.compressed[i] {
+				t.Errorf("message %d: compressed = %v, want %v", i, compressed, tt.compressed[i])
+			}
+			if !bytes.Equal(bytes.TrimSuffix(got, []byte{'\n'}), bytes.TrimSuffix(want, []byte{'\n'})) {
+				t.Errorf("message %d differs after decoding", i)
+			}
+		}
+	}
+	plainClient.queue.close()
+	gzipClient.queue.close()
+}
+
+// TestServeCompressed negotiates compression on a connection, then sends a
+// compressed request and gets a large response compressed.
+func TestServeCompressed(t *testing.T) {
+	h := newTestHandler(t)
+	h.installedApps = func(ctx context.Context, iconSize int) ([]splittunnel.AppInfo, error) {
+		apps := make([]splittunnel.AppInfo, 500)
+		for i := range apps {
+			apps[i] = splittunnel.AppInfo{Name: fmt.Sprintf("App %d", i), ExeName: fmt.Sprintf("app%d.exe", i)}
+		}
+		return apps, nil
+	}
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go h.serve(server, newClient(&h.notify))
+	r := bufio.NewReaderSize(conn, 1<<20)
+
+	go conn.Write([]byte(`{"id":"1","method":"core.hello","params":{"compression":["gzip"]}}` + "\n"))
+	var hello Response
+	if data, _ := readLine(t, r); json.Unmarshal(data, &hello) != nil || hello.Error != nil {
+		t.Fatalf("core.hello = %s", data)
+	}
+
+	req := compressMessage(append([]byte(`{"id":"2","method":"apps.list","params":{"pad":"`+strings.Repeat(" ", compressThreshold)+`"}}`), '\n'))
+	go conn.Write(req)
+	data, compressed := readLine(t, r)
+	var resp struct {
+		ID     string                `json:"id"`
+		Result []splittunnel.AppInfo `json:"result"`
+		Error  *RPCError             `json:"error"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil || resp.ID != "2" || len(resp.Result) != 500 || !compressed {
+		t.Errorf("apps.list: id %q, %d apps, compressed %v, error %+v", resp.ID, len(resp.Result), compressed, resp.Error)
+	}
+
+	go conn.Write([]byte(`{"compressed":true,"encoding":"gzip","data":"AAAA"}` + "\n"))
+	var bad Response
+	if data, _ := readLine(t, r); json.Unmarshal(data, &bad) != nil || bad.Error == nil || bad.Error.Key != ErrKeyInvalidJSON {
+		t.Errorf("bad envelope = %s", data)
+	}
+}
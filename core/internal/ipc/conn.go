@@ -0,0 +1,137 @@
+package ipc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+const maxMessageSize = 8 * 1024 * 1024 // fits a 5MB servers.decodeQr image in base64
+
+// clientIdleTimeout closes a connection that sends nothing for this long.
+const clientIdleTimeout = 5 * time.Minute
+
+// admitConn identifies the client on conn and checks it against the client
+// allow-list, logging and auditing a refusal. It runs before the client is
+// registered with the server, so a refused one never sees a notification.
+func (h *Handler) admitConn(conn net.Conn) (*ClientIdentity, bool) {
+	id := h.identify(conn)
+	if err := h.admitClient(id); err != nil {
+		h.rejectClient(id, err)
+		return id, false
+	}
+	return id, true
+}
+
+// serve answers the requests an admitted client sends on conn, one at a
+// time and in order, until the client disconnects. Requests run under a
+// context that is cancelled as soon as the client goes away, so a long
+// call such as apps.list with icons stops instead of finishing for nobody,
+// and are cancelled too when a shutdown runs out of time waiting for them.
+func (h *Handler) serve(conn net.Conn, c *client) {
+	ctx, cancel := context.WithCancel(h.gate.ctx)
+	defer cancel()
+
+	// Reading continues while a request runs, which is how a disconnect
+	// mid-call is noticed.
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		defer cancel()
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
+		for scanner.Scan() {
+			// Reset read deadline after each successful message
+			conn.SetReadDeadline(time.Now().Add(clientIdleTimeout))
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			line := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			if err != io.EOF {
+				log.Printf("client read error: %v", err)
+			}
+		}
+	}()
+
+	for line := range lines {
+		var req Request
+		line, err := decodeMessage(line)
+		if err != nil {
+			c.send(conn, &Response{Error: &RPCError{
+				Code:    ErrCodeParseError,
+				Key:     ErrKeyInvalidJSON,
+				Message: "invalid compressed message: " + err.Error(),
+			}})
+			continue
+		}
+		if err := json.Unmarshal(line, &req); err != nil {
+			resp := Response{
+				Error: &RPCError{
+					Code:    ErrCodeParseError,
+					Key:     ErrKeyInvalidJSON,
+					Message: "invalid JSON",
+				},
+			}
+			c.send(conn, &resp)
+			continue
+		}
+
+		// Once shutdown has begun, calls are refused; one admitted counts
+		// as in flight until its response is written.
+		if !h.gate.enter() {
+			c.send(conn, &Response{ID: req.ID, Error: shuttingDownError()})
+			continue
+		}
+		c.send(conn, h.handleClientRequest(ctx, c, &req))
+		h.gate.leave()
+	}
+}
+
+// handleClientRequest runs a request through the handler. Method panics
+// are already recovered by the registry; this catches anything outside it
+// so a bad request cannot kill the client goroutine.
+func (h *Handler) handleClientRequest(ctx context.Context, c *client, req *Request) (resp *Response) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic handling %s: %v\n%s", req.Method, p, debug.Stack())
+			resp = &Response{ID: req.ID, Error: rpcError(ErrCodeInternal, ErrKeyInternal, "internal error")}
+		}
+	}()
+	return h.handleFor(ctx, c, req)
+}
+
+// send writes a response to the client.
+func (c *client) send(w io.Writer, resp *Response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("failed to marshal response: %v", err)
+		return
+	}
+	if err := c.write(w, append(data, '\n')); err != nil {
+		log.Printf("failed to send response: %v", err)
+	}
+}
+
+// write sends a newline-terminated message to the client, compressed if
+// the client negotiated compression and the message is large.
+func (c *client) write(w io.Writer, data []byte) error {
+	if c.gzip.Load() && len(data) > compressThreshold {
+		data = compressMessage(data)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := w.Write(data)
+	return err
+}
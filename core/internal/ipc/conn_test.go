@@ -0,0 +1,85 @@
+package ipc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+)
+
+// TestServeCancelsOnDisconnect hangs up mid apps.list and checks the
+// listing sees its context cancelled instead of running to completion.
+func TestServeCancelsOnDisconnect(t *testing.T) {
+	h := newTestHandler(t)
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	h.installedApps = func(ctx context.Context, iconSize int) ([]splittunnel.AppInfo, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			stopped <- ctx.Err()
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Second): // icon extraction for a very long list
+			stopped <- nil
+			return nil, nil
+		}
+	}
+
+	server, conn := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		h.serve(server, newClient(&h.notify))
+		close(served)
+	}()
+
+	if _, err := conn.Write([]byte(`{"id":"1","method":"apps.list","params":{"icons":true}}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	conn.Close()
+
+	select {
+	case err := <-stopped:
+		if err != context.Canceled {
+			t.Errorf("apps.list ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("apps.list kept running after the client disconnected")
+	}
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve did not return after the client disconnected")
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+	h := newTestHandler(t)
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go h.serve(server, newClient(&h.notify))
+
+	go conn.Write([]byte("not json\n" + `{"id":"7","method":"core.hello"}` + "\n"))
+	scanner := bufio.NewScanner(conn)
+	var got []Response
+	for len(got) < 2 && scanner.Scan() {
+		var resp Response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resp)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d responses: %v", len(got), scanner.Err())
+	}
+	if got[0].Error == nil || got[0].Error.Key != ErrKeyInvalidJSON {
+		t.Errorf("first response = %+v, want invalid JSON", got[0])
+	}
+	if got[1].ID != "7" || got[1].Error != nil {
+		t.Errorf("second response = %+v", got[1])
+	}
+}
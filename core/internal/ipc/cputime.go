@@ -0,0 +1,24 @@
+package ipc
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// processCPUTime reads the CPU time used by the service process.
+func processCPUTime() (ProcessStats, error) {
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(windows.CurrentProcess(), &creation, &exit, &kernel, &user); err != nil {
+		return ProcessStats{}, err
+	}
+	// Filetime durations count 100ns intervals.
+	ms := func(ft windows.Filetime) int64 {
+		return (int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)) / 10000
+	}
+	return ProcessStats{
+		UserMs:    ms(user),
+		KernelMs:  ms(kernel),
+		UptimeSec: int64(time.Since(time.Unix(0, creation.Nanoseconds())).Seconds()),
+	}, nil
+}
@@ -0,0 +1,130 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// The app retries a request when it thinks the pipe stalled, reusing the
+// request's ID. Each client remembers its recent request IDs with their
+// responses, so a retry gets the first attempt's response instead of
+// running the method again: a second vpn.connect must not bounce the
+// tunnel. A retry of a call still running waits for it.
+const (
+	dedupTTL        = 30 * time.Second
+	dedupMaxEntries = 64 // per client; the oldest is forgotten first
+)
+
+// dedupEntry is one remembered request.
+type dedupEntry struct {
+	id     string
+	method string
+	done   chan struct{} // closed once result and err are set
+	result interface{}
+	err    *RPCError
+	at     time.Time // when the call finished
+}
+
+// requestCache holds a client's recent requests by ID.
+type requestCache struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	order   []*dedupEntry // oldest first
+	now     func() time.Time
+}
+
+func newRequestCache() *requestCache {
+	return &requestCache{entries: make(map[string]*dedupEntry), now: time.Now}
+}
+
+// begin returns the entry of a request seen within dedupTTL, with dup set,
+// or records a new one for the caller to finish.
+func (c *requestCache) begin(id, method string) (entry *dedupEntry, dup bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if e, ok := c.entries[id]; ok {
+		select {
+		case <-e.done:
+			if now.Sub(e.at) < dedupTTL {
+				return e, true
+			}
+		default:
+			return e, true
+		}
+	}
+
+	// Forget expired entries and, past the bound, the oldest ones.
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if len(c.order) < dedupMaxEntries && !c.expired(oldest, now) {
+			break
+		}
+		c.order = c.order[1:]
+		if c.entries[oldest.id] == oldest {
+			delete(c.entries, oldest.id)
+		}
+	}
+
+	entry = &dedupEntry{id: id, method: method, done: make(chan struct{})}
+	c.entries[id] = entry
+	c.order = append(c.order, entry)
+	return entry, false
+}
+
+// expired reports whether a finished entry is older than dedupTTL.
+func (c *requestCache) expired(e *dedupEntry, now time.Time) bool {
+	select {
+	case <-e.done:
+		return now.Sub(e.at) >= dedupTTL
+	default:
+		return false
+	}
+}
+
+// finish records the response of a request begun with begin and releases
+// the retries waiting for it.
+func (c *requestCache) finish(e *dedupEntry, result interface{}, err *RPCError) {
+	c.mu.Lock()
+	e.result, e.err, e.at = result, err, c.now()
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// size returns the number of remembered requests.
+func (c *requestCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// suppressDuplicates answers a repeated request ID from the client's
+// request cache. Reusing an ID for another method is an invalid request.
+// Calls outside a client connection, or without an ID, always run.
+func suppressDuplicates(next methodFunc) methodFunc {
+	return func(ctx context.Context, params json.RawMessage) (result interface{}, rpcErr *RPCError) {
+		c, id := requestClient(ctx), requestID(ctx)
+		if c == nil || id == "" {
+			return next(ctx, params)
+		}
+		method := methodName(ctx)
+		entry, dup := c.requests.begin(id, method)
+		if dup {
+			if entry.method != method {
+				return nil, rpcErrorData(ErrCodeInvalidRequest, ErrKeyRequestIDReused, "request ID already used for another method",
+					map[string]interface{}{"id": id, "method": entry.method})
+			}
+			select {
+			case <-entry.done:
+				return entry.result, entry.err
+			case <-ctx.Done():
+				return nil, cancelledError(ctx)
+			}
+		}
+		// Deferred so a panic escaping the chain cannot leave retries waiting.
+		defer func() { c.requests.finish(entry, result, rpcErr) }()
+		return next(ctx, params)
+	}
+}
@@ -0,0 +1,136 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dedupRegistry returns a registry with duplicate suppression and a
+// method counting its executions.
+func dedupRegistry(runs *atomic.Int32, release <-chan struct{}) *registry {
+	r := newRegistry()
+	r.use(suppressDuplicates)
+	r.register("vpn.connect", func(context.Context, json.RawMessage) (interface{}, *RPCError) {
+		n := runs.Add(1)
+		if release != nil {
+			<-release
+		}
+		return fmt.Sprintf("run %d", n), nil
+	})
+	r.register("vpn.disconnect", func(context.Context, json.RawMessage) (interface{}, *RPCError) {
+		return "ok", nil
+	})
+	return r
+}
+
+func clientCall(r *registry, c *client, id, method string) (interface{}, *RPCError) {
+	ctx := context.WithValue(context.Background(), requestIDKey, id)
+	ctx = context.WithValue(ctx, clientKey, c)
+	return r.dispatch(ctx, method, nil)
+}
+
+func TestRetryAfterSuccess(t *testing.T) {
+	var runs atomic.Int32
+	r := dedupRegistry(&runs, nil)
+	c := newClient(&notifyCounters{})
+
+	first, _ := clientCall(r, c, "7", "vpn.connect")
+	retry, rpcErr := clientCall(r, c, "7", "vpn.connect")
+	if rpcErr != nil || retry != first || runs.Load() != 1 {
+		t.Errorf("retry = %v, %+v after %d runs; want the first response", retry, rpcErr, runs.Load())
+	}
+
+	// A new ID runs again.
+	if result, _ := clientCall(r, c, "8", "vpn.connect"); result != "run 2" {
+		t.Errorf("new ID = %v", result)
+	}
+
+	// The same ID for another method is refused.
+	if _, rpcErr := clientCall(r, c, "7", "vpn.disconnect"); rpcErr == nil || rpcErr.Code != ErrCodeInvalidRequest || rpcErr.Key != ErrKeyRequestIDReused {
+		t.Errorf("reused ID = %+v, want invalid request", rpcErr)
+	}
+
+	// After the TTL the ID is forgotten.
+	c.requests.now = func() time.Time { return time.Now().Add(dedupTTL) }
+	if result, _ := clientCall(r, c, "7", "vpn.connect"); result != "run 3" {
+		t.Errorf("after TTL = %v, want a new run", result)
+	}
+}
+
+func TestRetryInFlight(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+	r := dedupRegistry(&runs, release)
+	c := newClient(&notifyCounters{})
+
+	results := make([]interface{}, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		if i == 1 {
+			// The retry arrives while the first attempt runs.
+			for runs.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = clientCall(r, c, "1", "vpn.connect")
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if runs.Load() != 1 || results[0] != "run 1" || results[1] != "run 1" {
+		t.Errorf("results = %v after %d runs", results, runs.Load())
+	}
+}
+
+func TestRequestIDsPerClient(t *testing.T) {
+	var runs atomic.Int32
+	r := dedupRegistry(&runs, nil)
+	a, b := newClient(&notifyCounters{}), newClient(&notifyCounters{})
+
+	ra, _ := clientCall(r, a, "1", "vpn.connect")
+	rb, _ := clientCall(r, b, "1", "vpn.connect")
+	if ra == rb || runs.Load() != 2 {
+		t.Errorf("clients share request IDs: %v, %v", ra, rb)
+	}
+	// Another client may use the ID for another method.
+	if _, rpcErr := clientCall(r, b, "2", "vpn.disconnect"); rpcErr != nil {
+		t.Error(rpcErr)
+	}
+
+	// Calls outside a client connection are never suppressed.
+	call := func() interface{} {
+		result, _ := r.dispatch(context.WithValue(context.Background(), requestIDKey, "1"), "vpn.connect", nil)
+		return result
+	}
+	if call() == call() {
+		t.Error("in-process call suppressed")
+	}
+}
+
+func TestRequestCacheBounded(t *testing.T) {
+	var runs atomic.Int32
+	r := dedupRegistry(&runs, nil)
+	c := newClient(&notifyCounters{})
+	for i := 0; i < 3*dedupMaxEntries; i++ {
+		clientCall(r, c, fmt.Sprint(i), "vpn.connect")
+	}
+	if n := c.requests.size(); n > dedupMaxEntries {
+		t.Errorf("%d requests remembered, want at most %d", n, dedupMaxEntries)
+	}
+	// The newest are the ones kept.
+	before := runs.Load()
+	clientCall(r, c, fmt.Sprint(3*dedupMaxEntries-1), "vpn.connect")
+	if runs.Load() != before {
+		t.Error("newest request forgotten")
+	}
+}
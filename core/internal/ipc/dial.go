@@ -0,0 +1,109 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// attemptDelay is how long a dial waits on one address before racing the
+// next (RFC 8305 recommends 250ms).
+const attemptDelay = 250 * time.Millisecond
+
+// interleaveFamilies orders addrs for dialing: alternating address
+// families, starting with the family of the resolver's first answer, so a
+// family that does not work costs one attempt delay, not a timeout per
+// address.
+func interleaveFamilies(addrs []netip.Addr) []netip.Addr {
+	if len(addrs) == 0 {
+		return nil
+	}
+	var first, second []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() == addrs[0].Is4() {
+			first = append(first, a)
+		} else {
+			second = append(second, a)
+		}
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// dialFirst connects to port on the first of addrs that answers, Happy
+// Eyeballs style: each attempt gets attemptDelay, or until it fails, before
+// the next one starts alongside it. It returns the connection and how long
+// its own attempt took, or the first error when every attempt fails.
+func dialFirst(ctx context.Context, d *net.Dialer, addrs []netip.Addr, port uint16) (net.Conn, time.Duration, error) {
+	if len(addrs) == 0 {
+		return nil, 0, errors.New("no addresses to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		took time.Duration
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := netip.AddrPortFrom(addrs[next], port).String()
+		next++
+		pending++
+		go func() {
+			begin := time.Now()
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- result{conn, time.Since(begin), err}
+		}()
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		var delay <-chan time.Time
+		var timer *time.Timer
+		if next < len(addrs) {
+			timer = time.NewTimer(attemptDelay)
+			delay = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Attempts still running lose the race; close what they
+				// connect.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.took, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, 0, firstErr
+}
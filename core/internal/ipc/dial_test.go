@@ -0,0 +1,78 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), netip.MustParseAddr("2001:db8::3"),
+		netip.MustParseAddr("203.0.113.1"),
+	}
+	got := fmt.Sprint(interleaveFamilies(addrs))
+	if want := "[2001:db8::1 203.0.113.1 2001:db8::2 2001:db8::3]"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+}
+
+func TestDialFirst(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	live := netip.MustParseAddr("127.0.0.1")
+
+	tests := []struct {
+		name  string
+		addrs []netip.Addr
+	}{
+		{"single", []netip.Addr{live}},
+		// Refused at once on a host without IPv6, or with nothing on the
+		// port; either way the next address is tried.
+		{"failing first", []netip.Addr{netip.MustParseAddr("::1"), live}},
+		// A documentation address never answers; the next one races it
+		// after attemptDelay.
+		{"stalled first", []netip.Addr{netip.MustParseAddr("192.0.2.1"), live}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := net.Dialer{Timeout: 5 * time.Second}
+			start := time.Now()
+			conn, took, err := dialFirst(context.Background(), &d, tt.addrs, port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if conn.RemoteAddr().(*net.TCPAddr).IP.String() != "127.0.0.1" || took > time.Second || time.Since(start) > 2*time.Second {
+				t.Errorf("connected to %v in %v (%v in all)", conn.RemoteAddr(), took, time.Since(start))
+			}
+		})
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := uint16(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+	d := net.Dialer{Timeout: time.Second}
+	if _, _, err := dialFirst(context.Background(), &d, []netip.Addr{live, live}, closedPort); err == nil {
+		t.Error("dial to a closed port succeeded")
+	}
+}
@@ -0,0 +1,9 @@
+package ipc
+
+import "golang.org/x/sys/windows"
+
+// processElevated reports whether the service process runs with an
+// elevated token, which creating the TUN adapter and its routes requires.
+func processElevated() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
@@ -1,274 +1,1670 @@
 package ipc
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net"
+	"net/netip"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/datafile"
+	"github.com/mriaz/vpn-core/internal/dnsenv"
+	"github.com/mriaz/vpn-core/internal/envscan"
+	"github.com/mriaz/vpn-core/internal/instance"
+	"github.com/mriaz/vpn-core/internal/lastrun"
+	"github.com/mriaz/vpn-core/internal/netinfo"
+	"github.com/mriaz/vpn-core/internal/netready"
 	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/paths"
+	"github.com/mriaz/vpn-core/internal/perfreport"
+	"github.com/mriaz/vpn-core/internal/profiles"
+	"github.com/mriaz/vpn-core/internal/qrscan"
+	"github.com/mriaz/vpn-core/internal/scheduler"
+	"github.com/mriaz/vpn-core/internal/settings"
 	"github.com/mriaz/vpn-core/internal/splittunnel"
+	"github.com/mriaz/vpn-core/internal/usage"
 	"github.com/mriaz/vpn-core/internal/vpn"
 )
 
+// maxLinkLength caps server links accepted over IPC. Real REALITY links
+// with long pbk/spx values already exceed 2KB.
+const maxLinkLength = 4096
+
+// maxDeduplicateLinks caps the links servers.deduplicate accepts per call.
+const maxDeduplicateLinks = 2000
+
+// maxParseTextBytes caps the text servers.parseText scans.
+const maxParseTextBytes = 64 << 10
+
+// confirmSpeedThreshold is the proxied speed, in bytes per second, above
+// which ending the session asks for confirmation. Below it, open but idle
+// connections (keep-alives, push channels) don't get in the way.
+const confirmSpeedThreshold = 32 << 10
+
+// networkWaitMax bounds how long a connect made with waitForNetwork, or a
+// reconnect, waits for the network to become available.
+const networkWaitMax = time.Minute
+
 // Handler dispatches RPC method calls.
 type Handler struct {
-	engine       *vpn.Engine
-	stateMachine *vpn.StateMachine
-	mu           sync.RWMutex
-	splitConfig  *SplitTunnelConfig
-	ShutdownCh   chan struct{}
+	engine        *vpn.Engine
+	stateMachine  *vpn.StateMachine
+	settings      *settings.Store
+	profiles      *profiles.Store
+	health        *profiles.HealthMonitor
+	performance   *profiles.PerformanceStore
+	subscriptions *profiles.SubscriptionUpdater
+	envScan       func() envscan.Report                                               // replaced in tests
+	dnsCheck      func(hosts ...string) dnsenv.Report                                 // replaced in tests
+	routeTable    func() netinfo.Snapshot                                             // replaced in tests
+	probeProxy    func(ctx context.Context, p vpn.UpstreamProxy, target string) error // replaced in tests
+	lastRun       *lastrun.Summary                                                    // of the previous run; see SetLastRun
+	loadIssues    []datafile.Issue                                                    // see SetLoadIssues
+	usage         *usage.History                                                      // see SetUsageHistory
+	throughput    *perfreport.Meter                                                   // see SetThroughputMeter
+	cpuUsage      func(ctx context.Context) (float64, error)                          // replaced in tests
+	activity      func() vpn.Activity                                                 // replaced in tests
+	lookupIP      func(ctx context.Context, host string) ([]net.IP, error)            // replaced in tests
+	routeFamily   func() (v4, v6 bool, err error)                                     // replaced in tests
+	registry      *registry
+	metrics       *rpcMetrics
+	notify        notifyCounters // updated by the server's client queues
+	gate          *requestGate   // requests in flight, drained by Server.Shutdown
+	mu            sync.RWMutex
+	splitConfig   *SplitTunnelConfig
+	stale         []splittunnel.StaleEntry // from the last reconciliation, for split.pruneStale
+	appCatalog    *splittunnel.AppCatalog  // versions of the app list, for apps.listDiff
+	scheduler     *scheduler.Scheduler
+	preSchedule   *SplitTunnelConfig // split config to restore when the schedule ends
+	notifier      Notifier
+	setup         setupProbes
+	cacheFile     string // sing-box cache file; replaced in tests
+	iconExport    *splittunnel.IconExporter
+	captive       *captiveGrace
+	detectPortal  func(ctx context.Context) vpn.CaptivePortal // replaced in tests
+	network       *netready.Gate                              // replaced in tests
+	identify      func(conn net.Conn) *ClientIdentity         // replaced in tests
+	verifySigner  func(image string) (string, error)          // replaced in tests
+	audit         *audit.Log                                  // nil until SetAuditLog
+	ShutdownCh    chan struct{}
+
+	// Starts the UI in a user's session; nil until SetUILauncher.
+	launchUI    func(sessionID uint32, path string) (uint32, error)
+	installedUI string // the UI beside the service; replaced in tests
+
+	// App inventories; replaced in tests.
+	installedApps func(ctx context.Context, iconSize int) ([]splittunnel.AppInfo, error)
+	lanAddress    func() (string, error)
+	runningApps   func() ([]splittunnel.RunningApp, error)
+}
+
+// defaultMethodTimeout bounds calls to methods not in methodTimeouts.
+const defaultMethodTimeout = 30 * time.Second
+
+// methodTimeouts are the methods that legitimately take longer, or should
+// give up sooner, than defaultMethodTimeout.
+var methodTimeouts = map[string]time.Duration{
+	"vpn.connect":           2 * time.Minute,
+	"vpn.connectRaw":        2 * time.Minute,
+	"vpn.reconnect":         2 * time.Minute,
+	"vpn.setRateLimit":      2 * time.Minute, // may reconnect
+	"apps.list":             2 * time.Minute, // icon extraction reads every executable
+	"apps.listDiff":         2 * time.Minute,
+	"apps.exportIcons":      2 * time.Minute,
+	"servers.ping":          10 * time.Second,
+	"subscriptions.refresh": time.Minute, // a fetch alone may take 30s
+	"diagnostics.mtuProbe":  time.Minute, // a stall takes two probe timeouts
 }
 
 // NewHandler creates a new RPC handler.
-func NewHandler(engine *vpn.Engine, sm *vpn.StateMachine) *Handler {
-	return &Handler{
-		engine:       engine,
-		stateMachine: sm,
+func NewHandler(engine *vpn.Engine, sm *vpn.StateMachine, st *settings.Store, ps *profiles.Store, hm *profiles.HealthMonitor, perf *profiles.PerformanceStore) *Handler {
+	h := &Handler{
+		engine:        engine,
+		stateMachine:  sm,
+		settings:      st,
+		profiles:      ps,
+		health:        hm,
+		performance:   perf,
+		subscriptions: profiles.NewSubscriptionUpdater(ps, subscriptionProxy(st)),
+		envScan:       func() envscan.Report { return scanEnvironment(engine.Instance()) },
+		probeProxy:    vpn.ProbeUpstreamProxy,
+		dnsCheck: func(hosts ...string) dnsenv.Report {
+			return dnsenv.Check(dnsenv.WindowsProvider{OwnAdapter: engine.Instance().InterfaceName()}, hosts...)
+		},
+		routeTable: func() netinfo.Snapshot {
+			return netinfo.Take(netinfo.WindowsProvider{}, engine.Instance().InterfaceName())
+		},
+		cpuUsage: func(ctx context.Context) (float64, error) {
+			return sampleCPU(ctx, cpuSampleWindow)
+		},
+		network:      netready.NewGate(netready.WindowsProvider{}),
+		identify:     identifyPipeClient,
+		verifySigner: verifyImageSigner,
+		activity:     engine.Activity,
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		routeFamily: func() (bool, bool, error) {
+			return envscan.DefaultRouteFamilies(envscan.WindowsProvider{}, engine.Instance().InterfaceName())
+		},
+		registry: newRegistry(),
+		metrics:  newRPCMetrics(),
+		gate:     newRequestGate(),
 		splitConfig: &SplitTunnelConfig{
 			Mode: "off",
 		},
+		installedApps: splittunnel.ListInstalledApps,
+		appCatalog:    splittunnel.NewAppCatalog(),
+		runningApps:   splittunnel.ListRunningApps,
+		lanAddress:    func() (string, error) { return vpn.LANAddress(engine.Instance()) },
+		cacheFile:     paths.File(vpn.CacheFileName),
+		iconExport:    splittunnel.NewIconExporter(paths.File(splittunnel.IconExportDirName)),
+		captive:       newCaptiveGrace(),
+		installedUI:   installedUIPath(),
+		detectPortal:  vpn.DetectCaptivePortal,
+		setup: setupProbes{
+			driver:      func() vpn.DriverStatus { return vpn.CheckDriver(engine.Instance()) },
+			clockOffset: vpn.ClockOffset,
+			powerShell:  splittunnel.PowerShellAvailable,
+			elevated:    processElevated,
+		},
 		ShutdownCh: make(chan struct{}),
 	}
+	h.scheduler = scheduler.New(func() []scheduler.Entry { return h.settings.Get().Schedules }, h.applySchedule)
+
+	// Outermost first: retried requests are answered before anything else
+	// runs; panics and cancellations count as errors in metrics and are
+	// logged.
+	h.registry.use(suppressDuplicates, logErrors, h.auditCalls, h.metrics.middleware, withTimeouts(methodTimeouts, defaultMethodTimeout), recoverPanics)
+
+	h.registry.register("core.hello", h.handleHello)
+	h.registry.register("core.subscribe", h.handleSubscribe)
+	h.registry.register("core.unsubscribe", h.handleUnsubscribe)
+	h.registry.register("vpn.connect", h.handleConnect)
+	h.registry.register("vpn.connectRaw", h.handleConnectRaw)
+	h.registry.register("vpn.disconnect", h.handleDisconnect)
+	h.registry.register("vpn.reconnect", h.handleReconnect)
+	h.registry.register("vpn.setRateLimit", h.handleSetRateLimit)
+	h.registry.register("vpn.status", h.handleStatus)
+	h.registry.register("vpn.explain", h.handleExplain)
+	h.registry.register("vpn.lanClients", h.handleLANClients)
+	h.registry.register("stats.transport", h.handleTransportStats)
+	h.registry.register("stats.getHistory", h.handleStatsHistory)
+	h.registry.register("apps.list", h.handleAppsList)
+	h.registry.register("apps.listDiff", h.handleAppsListDiff)
+	h.registry.register("apps.exportIcons", h.handleAppsExportIcons)
+	h.registry.register("apps.domainActivity", h.handleAppsDomainActivity)
+	h.registry.register("split.setConfig", h.handleSplitSetConfig)
+	h.registry.register("split.getConfig", h.handleSplitGetConfig)
+	h.registry.register("split.pruneStale", h.handleSplitPruneStale)
+	h.registry.register("split.capabilities", h.handleSplitCapabilities)
+	h.registry.register("servers.ping", h.handlePing)
+	h.registry.register("servers.deduplicate", h.handleDeduplicate)
+	h.registry.register("servers.performance", h.handlePerformance)
+	h.registry.register("servers.parseText", h.handleParseText)
+	h.registry.register("servers.decodeQr", h.handleDecodeQR)
+	h.registry.register("diagnostics.checkCompat", h.handleCheckCompat)
+	h.registry.register("diagnostics.checkDrivers", h.handleCheckDrivers)
+	h.registry.register("setup.verify", h.handleSetupVerify)
+	h.registry.register("diagnostics.environment", h.handleEnvironment)
+	h.registry.register("diagnostics.conflicts", h.handleConflicts)
+	h.registry.register("diagnostics.dnsEnvironment", h.handleDNSEnvironment)
+	h.registry.register("diagnostics.routes", h.handleRoutes)
+	h.registry.register("diagnostics.performanceReport", h.handlePerformanceReport)
+	h.registry.register("diagnostics.mtuProbe", h.handleMTUProbe)
+	h.registry.register("diagnostics.lastRun", h.handleLastRun)
+	h.registry.register("debug.rpcStats", h.handleRPCStats)
+	h.registry.register("debug.getConfig", h.handleDebugGetConfig)
+	h.registry.register("debug.traceConnections", h.handleTraceConnections)
+	h.registry.register("settings.get", h.handleSettingsGet)
+	h.registry.register("settings.set", h.handleSettingsSet)
+	h.registry.register("settings.adminLock", h.handleAdminLock)
+	h.registry.register("settings.adminUnlock", h.handleAdminUnlock)
+	h.registry.register("profiles.list", h.handleProfilesList)
+	h.registry.register("profiles.save", h.handleProfilesSave)
+	h.registry.register("profiles.exportLink", h.handleProfilesExportLink)
+	h.registry.register("profiles.delete", h.handleProfilesDelete)
+	h.registry.register("profiles.health", h.handleProfilesHealth)
+	h.registry.register("profiles.suggestBest", h.handleProfilesSuggestBest)
+	h.registry.register("subscriptions.list", h.handleSubscriptionsList)
+	h.registry.register("subscriptions.save", h.handleSubscriptionsSave)
+	h.registry.register("subscriptions.delete", h.handleSubscriptionsDelete)
+	h.registry.register("subscriptions.refresh", h.handleSubscriptionsRefresh)
+	h.registry.register("subscriptions.info", h.handleSubscriptionsInfo)
+	h.registry.register("service.shutdown", h.handleShutdown)
+	h.registry.register("maintenance.clearCache", h.handleClearCache)
+	h.registry.register("meta.schema", h.handleMetaSchema)
+	h.registry.register("audit.query", h.handleAuditQuery)
+	return h
+}
+
+// SetSlowCallThreshold sets how long a call may take before it is logged
+// as slow. Zero disables slow-call logging.
+func (h *Handler) SetSlowCallThreshold(d time.Duration) {
+	h.metrics.mu.Lock()
+	h.metrics.slowThreshold = d
+	h.metrics.mu.Unlock()
+}
+
+// RPCStats returns per-method call statistics since the service started.
+func (h *Handler) RPCStats() []MethodStats {
+	return h.metrics.snapshot()
 }
 
 // Handle processes a single RPC request and returns a response.
 func (h *Handler) Handle(req *Request) *Response {
-	switch req.Method {
-	case "vpn.connect":
-		return h.handleConnect(req)
-	case "vpn.disconnect":
-		return h.handleDisconnect(req)
-	case "vpn.status":
-		return h.handleStatus(req)
-	case "apps.list":
-		return h.handleAppsList(req)
-	case "split.setConfig":
-		return h.handleSplitSetConfig(req)
-	case "split.getConfig":
-		return h.handleSplitGetConfig(req)
-	case "servers.ping":
-		return h.handlePing(req)
-	case "service.shutdown":
-		return h.handleShutdown(req)
-	default:
-		return &Response{
-			ID: req.ID,
-			Error: &RPCError{
-				Code:    ErrCodeMethodNotFound,
-				Message: fmt.Sprintf("method not found: %s", req.Method),
-			},
+	return h.handleFor(context.Background(), nil, req)
+}
+
+// handleFor handles a request from client c, which is nil outside a client
+// connection. The call is cancelled when ctx is, typically because the
+// client disconnected.
+func (h *Handler) handleFor(ctx context.Context, c *client, req *Request) *Response {
+	ctx = context.WithValue(ctx, requestIDKey, req.ID)
+	if c != nil {
+		ctx = context.WithValue(ctx, clientKey, c)
+	}
+	result, rpcErr := h.registry.dispatch(ctx, req.Method, req.Params)
+	if rpcErr != nil {
+		return &Response{ID: req.ID, Error: rpcErr}
+	}
+	return &Response{ID: req.ID, Result: result}
+}
+
+func (h *Handler) handleHello(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params HelloParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
 		}
 	}
+	result := HelloResult{
+		CoreVersion:  vpn.CoreVersion(),
+		Capabilities: h.registry.names(),
+		Instance:     h.engine.Instance().Name(),
+	}
+	// Only a connected client can negotiate; this response is already
+	// subject to what it asked for.
+	if c := requestClient(ctx); c != nil {
+		result.Compression = negotiateCompression(params.Compression)
+		c.gzip.Store(result.Compression == EncodingGzip)
+	}
+	return result, nil
 }
 
-func (h *Handler) handleConnect(req *Request) *Response {
-	var params ConnectParams
-	if err := json.Unmarshal(req.Params, &params); err != nil {
-		return errorResponse(req.ID, ErrCodeInvalidParams, "invalid parameters")
+// SetNotifier sets where the handler sends notifications it raises itself.
+func (h *Handler) SetNotifier(n Notifier) {
+	h.mu.Lock()
+	h.notifier = n
+	h.mu.Unlock()
+}
+
+func (h *Handler) handleSubscribe(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.updateSubscription(ctx, raw, true)
+}
+
+func (h *Handler) handleUnsubscribe(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.updateSubscription(ctx, raw, false)
+}
+
+func (h *Handler) updateSubscription(ctx context.Context, raw json.RawMessage, subscribe bool) (interface{}, *RPCError) {
+	var params SubscribeParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	for _, topic := range params.Topics {
+		if !validTopic(topic) {
+			return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "unknown topic",
+				map[string]interface{}{"topic": topic})
+		}
+	}
+	sub := clientSubscription(ctx)
+	if sub == nil {
+		return nil, rpcError(ErrCodeInvalidRequest, ErrKeyInvalidParams, "subscriptions need a client connection")
 	}
+	return SubscribeResult{Topics: sub.update(params.Topics, subscribe)}, nil
+}
 
-	// Validate link length
-	if len(params.Link) > 2048 {
-		return errorResponse(req.ID, ErrCodeInvalidParams, "server link is too long")
+func (h *Handler) handleCheckDrivers(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return vpn.CheckDriver(h.engine.Instance()), nil
+}
+
+func (h *Handler) handleRPCStats(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	result := RPCStatsResult{
+		Methods:       h.RPCStats(),
+		PowerMode:     h.engine.PowerMode(),
+		Notifications: h.notify.snapshot(),
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	poller := h.engine.PollerStats()
+	result.StatsPoller = StatsPollerStats{Active: poller.Active, Sessions: poller.Sessions, Violations: poller.Violations}
+	if cpu, err := processCPUTime(); err == nil {
+		result.Process = &cpu
+	} else {
+		log.Printf("warning: failed to read process CPU time: %v", err)
 	}
+	return result, nil
+}
 
-	// Parse the server link
-	serverCfg, err := parser.ParseLink(params.Link)
-	if err != nil {
-		log.Printf("vpn.connect: failed to parse link: %v", err)
-		return errorResponse(req.ID, ErrCodeInvalidParams, "failed to parse server link")
+func (h *Handler) handleTransportStats(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	stats, ok := h.engine.TransportStats()
+	if !ok {
+		return TransportStatsResult{}, nil
 	}
+	result := TransportStatsResult{
+		Available:        true,
+		Protocol:         stats.Protocol,
+		Source:           stats.Source,
+		RTTMs:            stats.RTTMs,
+		LossPercent:      stats.LossPercent,
+		CongestionWindow: stats.CongestionWindow,
+	}
+	if !stats.MeasuredAt.IsZero() {
+		result.MeasuredAt = stats.MeasuredAt.Unix()
+	}
+	return result, nil
+}
+
+func (h *Handler) handleLANClients(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	result := LANClientsResult{Clients: []LANClient{}}
+	if h.engine.LAN() == nil {
+		return result, nil
+	}
+	result.Enabled = true
+	for _, c := range h.engine.LANClients() {
+		result.Clients = append(result.Clients, LANClient{IP: c.IP, Connections: c.Connections})
+	}
+	return result, nil
+}
 
+// lanShare builds the LAN sharing settings from connect params.
+func (h *Handler) lanShare(params *ConnectParams) (*vpn.LANShare, *RPCError) {
+	lan := &vpn.LANShare{
+		Listen:   params.LANAddress,
+		Port:     params.LANPort,
+		Username: params.LANUsername,
+		Password: params.LANPassword,
+	}
+	// Credentials are checked first so a missing password is reported as
+	// such even on a machine without a LAN address.
+	if lan.Username == "" || lan.Password == "" {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyLANCredentials, "LAN sharing requires a username and password")
+	}
+	if lan.Listen == "" {
+		addr, err := h.lanAddress()
+		if err != nil {
+			log.Printf("vpn.connect: LAN address: %v", err)
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyLANNoAddress, "no LAN address found for sharing")
+		}
+		lan.Listen = addr
+	}
+	if err := lan.Validate(); err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyLANInvalid, "invalid LAN sharing settings",
+			map[string]interface{}{"reason": err.Error()})
+	}
+	return lan, nil
+}
+
+// buildConfig turns connect params into a validated engine config, filling
+// split tunnel settings from the stored config when the params omit them.
+func (h *Handler) buildConfig(params *ConnectParams) (*vpn.Config, *RPCError) {
+	serverCfg, rpcErr := resolveServer(params)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	return h.configFor(params, serverCfg)
+}
+
+// resolveServer returns the server of params' link or pre-parsed server.
+func resolveServer(params *ConnectParams) (*parser.ServerConfig, *RPCError) {
+	var serverCfg *parser.ServerConfig
+	switch {
+	case params.Link != "" && params.Server != nil:
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyLinkAndServer, "provide either link or server, not both")
+
+	case params.Server != nil:
+		if err := parser.Validate(params.Server); err != nil {
+			log.Printf("invalid server config: %v", err)
+			return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyServerInvalid, "invalid server configuration",
+				map[string]interface{}{"reason": err.Error()})
+		}
+		serverCfg = params.Server
+
+	default:
+		// Validate link length
+		if len(params.Link) > maxLinkLength {
+			return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyLinkTooLong, "server link is too long",
+				map[string]interface{}{"length": len(params.Link), "max": maxLinkLength})
+		}
+
+		// Parse the server link
+		var err error
+		serverCfg, err = parser.ParseLink(params.Link)
+		if err != nil {
+			log.Printf("failed to parse link: %v", err)
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyLinkParseFailed, "failed to parse server link")
+		}
+	}
+	return serverCfg, nil
+}
+
+// configFor builds the session config for serverCfg from the options of
+// params and the stored split tunnel config and settings.
+func (h *Handler) configFor(params *ConnectParams, serverCfg *parser.ServerConfig) (*vpn.Config, *RPCError) {
 	// Build VPN config
 	cfg := vpn.DefaultConfig()
 	cfg.Server = serverCfg
-	cfg.SplitTunnelMode = params.SplitTunnelMode
-	cfg.SplitTunnelApps = params.SplitTunnelApps
-	cfg.SplitTunnelDomains = params.SplitTunnelDomains
-	cfg.SplitTunnelInvert = params.SplitTunnelInvert
-
-	// Use stored split tunnel config if not provided in connect params
-	if cfg.SplitTunnelMode == "" {
-		h.mu.RLock()
-		cfg.SplitTunnelMode = h.splitConfig.Mode
-		cfg.SplitTunnelApps = h.splitConfig.Apps
-		cfg.SplitTunnelDomains = h.splitConfig.Domains
-		cfg.SplitTunnelInvert = h.splitConfig.Invert
-		h.mu.RUnlock()
-	}
-
-	if err := h.engine.Connect(cfg); err != nil {
+	if h.settings.Get().Simulation {
+		sim, err := vpn.SimulationFor(serverCfg)
+		if err != nil {
+			return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyServerInvalid, "invalid simulation params",
+				map[string]interface{}{"reason": err.Error()})
+		}
+		cfg.Simulation = sim
+	}
+
+	// validateSplitConfig also checks the DNS hijack exceptions and servers.
+	h.mu.RLock()
+	split, rpcErr := mergeSplitConfig(params, h.splitConfig)
+	h.mu.RUnlock()
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	cfg.SplitTunnelMode = split.Mode
+	cfg.SplitTunnelApps = split.Apps
+	cfg.SplitTunnelDomains = split.Domains
+	cfg.SplitTunnelInvert = split.Invert
+	cfg.DNSHijackExceptions = split.DNSHijackExceptions
+	cfg.DNSServers = split.DNSServers
+
+	cfg.TCPKeepAliveSeconds = params.TCPKeepAliveSeconds
+	cfg.IdleTimeoutSeconds = params.IdleTimeoutSeconds
+	cfg.WSMaxEarlyData = params.WSMaxEarlyData
+	cfg.WSEarlyDataHeader = params.WSEarlyDataHeader
+	cfg.SniffMode = params.SniffMode
+	cfg.PowerMode = h.settings.Get().PowerMode
+	cfg.BuiltinBypasses = h.settings.Get().BuiltinBypasses
+	cfg.DNSQueryLog = h.settings.Get().DNSQueryLog
+	if h.settings.Get().PersistCache {
+		cfg.CacheFile = h.cacheFile
+	}
+	if h.settings.Get().AutoTuneMTU {
+		if mtu := h.engine.SuggestedMTU(serverCfg.Address); mtu > 0 {
+			cfg.MTU = mtu
+		}
+	}
+	cfg.TransportPolicy = params.TransportPolicy
+	cfg.RateLimit = h.settings.Get().RateLimit()
+	cfg.Limits = h.settings.Get().ConfigLimits()
+	if params.MaxDownMbps != nil {
+		cfg.RateLimit.MaxDownMbps = *params.MaxDownMbps
+	}
+	if params.MaxUpMbps != nil {
+		cfg.RateLimit.MaxUpMbps = *params.MaxUpMbps
+	}
+	if err := cfg.ValidateTuning(); err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyTuningInvalid, "invalid advanced options",
+			map[string]interface{}{"reason": err.Error()})
+	}
+	if err := cfg.CheckTransport(); err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyTransportConflict, "the server protocol needs UDP and cannot be used in TCP-only mode",
+			map[string]interface{}{"protocol": serverCfg.Protocol, "transportPolicy": cfg.TransportPolicy})
+	}
+	if cfg.Simulation == nil {
+		cfg.UpstreamProxy = h.settings.UpstreamProxy()
+	}
+	if err := cfg.CheckUpstreamProxy(); err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyUpstreamConflict, "the server protocol runs over UDP and cannot go through the upstream proxy",
+			map[string]interface{}{"protocol": serverCfg.Protocol, "upstreamProxy": cfg.UpstreamProxy.Type})
+	}
+	if params.HardenInterface != nil {
+		cfg.HardenInterface = *params.HardenInterface
+	}
+	cfg.PinTunDNS = params.PinTunDNS
+	cfg.DelayConnectedUntilRouteVerified = params.DelayConnectedUntilRouteVerified
+
+	if params.AllowLAN {
+		lan, rpcErr := h.lanShare(params)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		cfg.LAN = lan
+	}
+
+	return cfg, nil
+}
+
+func (h *Handler) handleConnect(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ConnectParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	cfg, rpcErr := h.buildConfig(&params)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	return h.connect(ctx, &params, cfg)
+}
+
+// handleConnectRaw connects with a sing-box outbound the user wrote in
+// place of a link. Every other option works as for vpn.connect.
+func (h *Handler) handleConnectRaw(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ConnectRawParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	if params.Link != "" || params.Server != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "vpn.connectRaw takes an outbound, not a link or server")
+	}
+	if len(params.Outbound) == 0 {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "outbound is required")
+	}
+	outbound, serverCfg, err := vpn.ParseRawOutbound(params.Outbound, params.Name)
+	if err != nil {
+		log.Printf("vpn.connectRaw: %v", err)
+		data := map[string]interface{}{"reason": err.Error()}
+		var rawErr *vpn.RawOutboundError
+		if errors.As(err, &rawErr) {
+			data["field"] = rawErr.Field
+		}
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyOutboundInvalid, "outbound not allowed", data)
+	}
+	cfg, rpcErr := h.configFor(&params.ConnectParams, serverCfg)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	cfg.RawOutbound = outbound
+	return h.connect(ctx, &params.ConnectParams, cfg)
+}
+
+// attemptOriginKey carries who started a connect made without a client,
+// such as "schedule"; client calls count as the user's.
+type attemptOriginKey struct{}
+
+// attemptOrigin returns the origin of an attempt started under ctx.
+func attemptOrigin(ctx context.Context) string {
+	if origin, ok := ctx.Value(attemptOriginKey{}).(string); ok {
+		return origin
+	}
+	if ctx.Value(captiveRetryKey{}) != nil {
+		return "captive-retry"
+	}
+	return "user"
+}
+
+// attemptError returns the error for a connect or reconnect refused or
+// preempted in favour of another attempt, or nil if err is not one.
+func attemptError(err error) *RPCError {
+	var attemptErr *vpn.AttemptError
+	if !errors.As(err, &attemptErr) {
+		return nil
+	}
+	data := map[string]interface{}{"attempt": attemptErr.Attempt, "winner": attemptErr.Winner}
+	if attemptErr.Outcome == vpn.OutcomeRejected {
+		return rpcErrorData(ErrCodeInvalidRequest, ErrKeyAttemptRejected, attemptErr.Error(), data)
+	}
+	return rpcErrorData(ErrCodeCancelled, ErrKeyAttemptPreempted, attemptErr.Error(), data)
+}
+
+// awaitNetwork waits, up to networkWaitMax, for the network to become
+// available before method goes ahead, which it does either way.
+func (h *Handler) awaitNetwork(ctx context.Context, method string) {
+	res := h.network.Wait(ctx, networkWaitMax)
+	switch {
+	case !res.Ready && ctx.Err() == nil:
+		log.Printf("%s: network still unavailable (%s) after %v, going ahead", method, res.Level, res.Waited.Round(time.Second))
+	case res.Ready && res.Waited > 0:
+		log.Printf("%s: waited %v for the network", method, res.Waited.Round(time.Millisecond))
+	}
+}
+
+// connect starts a session with cfg, built from params.
+func (h *Handler) connect(ctx context.Context, params *ConnectParams, cfg *vpn.Config) (interface{}, *RPCError) {
+	if !vpn.ValidAttemptPolicy(params.Policy) {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid attempt policy",
+			map[string]interface{}{"policy": params.Policy})
+	}
+	serverCfg := cfg.Server
+	if rpcErr := h.checkServerPolicy(ctx, serverCfg, vpn.RawServerPorts(cfg.RawOutbound)); rpcErr != nil {
+		return nil, rpcErr
+	}
+	// A simulated connect needs no network.
+	if params.WaitForNetwork && cfg.Simulation == nil {
+		h.awaitNetwork(ctx, "vpn.connect")
+	}
+	if cfg.Simulation == nil {
+		cfg.OuterNetwork = h.outerNetwork(ctx)
+		if cfg.OuterNetwork.IPv6Only {
+			log.Printf("vpn.connect: IPv6-only network, NAT64 prefix %v", cfg.OuterNetwork.NAT64)
+		}
+	}
+	if rpcErr := h.checkUpstreamProxy(ctx, cfg); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	// Another VPN or a system proxy usually wins over our routes, leaving
+	// the tunnel up but unused. Warn by default; refuse in strict mode.
+	env := h.envScan()
+	for _, f := range env.Findings {
+		log.Printf("vpn.connect: environment: %s", f.Detail)
+	}
+	if params.StrictEnvironment && len(env.Findings) > 0 {
+		msg := "another VPN or proxy is active"
+		if tools := env.TunConflicts().Findings; len(tools) > 0 && tools[0].Product != "" {
+			msg = tools[0].Product + " is running its own TUN stack"
+		}
+		return nil, rpcErrorData(ErrCodeInternal, ErrKeyEnvironmentConflict, msg,
+			map[string]interface{}{"findings": env.Findings})
+	}
+
+	// Local DNS filters and hosts overrides change what resolves through
+	// the tunnel too. Only ever a warning.
+	var dnsWarnings []dnsenv.Finding
+	if serverCfg != nil {
+		dnsWarnings = h.dnsCheck(serverCfg.Address).Compact()
+	} else {
+		dnsWarnings = h.dnsCheck().Compact()
+	}
+	for _, f := range dnsWarnings {
+		log.Printf("vpn.connect: DNS environment: %s", f.Detail)
+	}
+
+	if raised := cfg.Limits.Raised(); len(raised) > 0 {
+		log.Printf("vpn.connect: warning: config limits raised above the defaults: %s", strings.Join(raised, ", "))
+	}
+
+	if err := h.engine.ConnectWith(ctx, cfg, vpn.AttemptOptions{Policy: params.Policy, Origin: attemptOrigin(ctx)}); err != nil {
 		log.Printf("vpn.connect: connection failed: %v", err)
-		return errorResponse(req.ID, ErrCodeInternal, "connection failed")
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx)
+		}
+		if rpcErr := attemptError(err); rpcErr != nil {
+			return nil, rpcErr
+		}
+		if errors.Is(err, vpn.ErrTunDriverMissing) {
+			return nil, rpcErrorData(ErrCodeInternal, ErrKeyTunDriverMissing, "TUN driver is missing or blocked",
+				map[string]interface{}{"remediation": vpn.TunDriverRemediation})
+		}
+		var limitErr *vpn.ConfigLimitError
+		if errors.As(err, &limitErr) {
+			return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyConfigTooComplex, limitErr.Error(),
+				map[string]interface{}{"limit": limitErr.Limit, "max": limitErr.Max, "actual": limitErr.Actual, "over": limitErr.Over()})
+		}
+		var unsupported *vpn.UnsupportedFeatureError
+		if errors.As(err, &unsupported) {
+			return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyCoreUnsupported, unsupported.Error(),
+				map[string]interface{}{"feature": unsupported.Feature, "coreVersion": unsupported.CoreVersion, "minVersion": unsupported.MinVersion})
+		}
+		if cfg.Simulation != nil {
+			return nil, rpcError(ErrCodeInternal, ErrKeyConnectFailed, "connection failed")
+		}
+		if rpcErr := h.checkCaptivePortal(ctx, err, params, cfg); rpcErr != nil {
+			return nil, rpcErr
+		}
+		return nil, rpcError(ErrCodeInternal, ErrKeyConnectFailed, "connection failed")
 	}
+	h.captive.cancel()
 
-	return &Response{
-		ID:     req.ID,
-		Result: map[string]interface{}{"ok": true},
+	result := ConnectResult{OK: true, Warnings: env.Findings, DNSWarnings: dnsWarnings, BuildDurationMs: h.engine.LastConnectTiming().BuildMs}
+	if s := vpn.SplitSupportFor(vpn.ConnectionTUN, cfg.SniffMode, cfg.SplitTunnelMode); !s.Supported || s.Limited {
+		log.Printf("vpn.connect: split tunnel mode %s: %s", s.Mode, s.Reason)
+		result.SplitWarnings = []vpn.SplitSupport{s}
 	}
+	return result, nil
 }
 
-func (h *Handler) handleDisconnect(req *Request) *Response {
-	if err := h.engine.Disconnect(); err != nil {
+func (h *Handler) handleExplain(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ConnectParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	cfg, rpcErr := h.buildConfig(&params)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	explanation, err := vpn.Explain(cfg)
+	if err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyServerInvalid, "invalid configuration",
+			map[string]interface{}{"reason": err.Error()})
+	}
+	return explanation, nil
+}
+
+// checkDestructive parses the params of a call that ends the session and
+// returns the disconnect reason. Without force, it refuses while proxied
+// transfers are running so the UI can confirm with the user first.
+func (h *Handler) checkDestructive(raw json.RawMessage) (string, *RPCError) {
+	var params DestructiveParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return "", rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	if params.Reason == "" {
+		params.Reason = vpn.ReasonUser
+	}
+	if !vpn.ValidReason(params.Reason) {
+		return "", rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid disconnect reason",
+			map[string]interface{}{"reason": params.Reason})
+	}
+	if params.Force || h.stateMachine.State() != vpn.StateConnected {
+		return params.Reason, nil
+	}
+	a := h.activity()
+	if a.ProxyConnections > 0 && a.UpSpeed+a.DownSpeed >= confirmSpeedThreshold {
+		return "", rpcErrorData(ErrCodeConfirmationRequired, ErrKeyConfirmRequired, "transfers in progress; repeat with force to proceed",
+			map[string]interface{}{
+				"activeConnections": a.ProxyConnections,
+				"upSpeed":           a.UpSpeed,
+				"downSpeed":         a.DownSpeed,
+			})
+	}
+	return params.Reason, nil
+}
+
+func (h *Handler) handleDisconnect(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	reason, rpcErr := h.checkDestructive(raw)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	// Disconnecting also calls off a connect waiting out a captive portal.
+	h.captive.cancel()
+	if err := h.engine.DisconnectWithReason(reason); err != nil {
 		log.Printf("vpn.disconnect failed: %v", err)
-		return errorResponse(req.ID, ErrCodeInternal, "disconnect failed")
+		return nil, rpcError(ErrCodeInternal, ErrKeyDisconnectFailed, "disconnect failed")
+	}
+	return OKResult{OK: true}, nil
+}
+
+// handleReconnect re-establishes the tunnel within the current session,
+// keeping its uptime and traffic totals.
+func (h *Handler) handleReconnect(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	if h.stateMachine.State() == vpn.StateDisconnected {
+		return nil, rpcError(ErrCodeInvalidRequest, ErrKeyNotConnected, "not connected")
 	}
-	return &Response{
-		ID:     req.ID,
-		Result: map[string]interface{}{"ok": true},
+	// Tearing down the link while the adapter is still coming back, as
+	// right after a wake, would only end the session.
+	h.awaitNetwork(ctx, "vpn.reconnect")
+	if err := h.engine.ReconnectWith(ctx, vpn.AttemptOptions{Origin: attemptOrigin(ctx)}); err != nil {
+		if errors.Is(err, vpn.ErrNotConnected) {
+			return nil, rpcError(ErrCodeInvalidRequest, ErrKeyNotConnected, "not connected")
+		}
+		log.Printf("vpn.reconnect failed: %v", err)
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx)
+		}
+		if rpcErr := attemptError(err); rpcErr != nil {
+			return nil, rpcErr
+		}
+		return nil, rpcError(ErrCodeInternal, ErrKeyConnectFailed, "reconnect failed")
 	}
+	return OKResult{OK: true}, nil
 }
 
-func (h *Handler) handleStatus(req *Request) *Response {
+// handleSetRateLimit changes the connected session's rate limit, in place
+// or by reconnecting, depending on how the session enforces it.
+func (h *Handler) handleSetRateLimit(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params SetRateLimitParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	if err := params.RateLimit.Validate(); err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyTuningInvalid, "invalid rate limit",
+			map[string]interface{}{"reason": err.Error()})
+	}
+	if !vpn.ValidAttemptPolicy(params.Policy) {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid attempt policy",
+			map[string]interface{}{"policy": params.Policy})
+	}
+	reconnected, err := h.engine.SetRateLimit(ctx, params.RateLimit, vpn.AttemptOptions{Policy: params.Policy, Origin: attemptOrigin(ctx)})
+	if err != nil {
+		if errors.Is(err, vpn.ErrNotConnected) {
+			return nil, rpcError(ErrCodeInvalidRequest, ErrKeyNotConnected, "not connected")
+		}
+		log.Printf("vpn.setRateLimit: reconnect failed: %v", err)
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx)
+		}
+		if rpcErr := attemptError(err); rpcErr != nil {
+			return nil, rpcErr
+		}
+		return nil, rpcError(ErrCodeInternal, ErrKeyConnectFailed, "reconnect failed")
+	}
+	return SetRateLimitResult{RateLimit: h.rateLimitStatus(), Reconnected: reconnected}, nil
+}
+
+// rateLimitStatus returns the session's rate limit, or nil if it has none.
+func (h *Handler) rateLimitStatus() *RateLimitStatus {
+	limit, mode := h.engine.RateLimit()
+	if mode == "" {
+		return nil
+	}
+	return &RateLimitStatus{RateLimit: limit, Mode: mode}
+}
+
+func (h *Handler) handleStatus(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
 	state := h.stateMachine.State()
 	result := StatusResult{
-		State: string(state),
+		State:       string(state),
+		CoreVersion: vpn.CoreVersion(),
 	}
 
 	if state == vpn.StateConnected {
-		result.ConnectedAt = h.engine.ConnectedAt().Unix()
+		sessionStarted := h.engine.SessionStartedAt().Unix()
+		result.ConnectedAt = sessionStarted
+		result.SessionStartedAt = sessionStarted
+		result.CurrentLinkEstablishedAt = h.engine.ConnectedAt().Unix()
+		result.Reconnects = h.engine.Reconnects()
+		traffic := h.engine.Traffic()
+		result.Upload = traffic.Upload
+		result.Download = traffic.Download
+		result.DirectUpload = traffic.DirectUpload
+		result.DirectDownload = traffic.DirectDownload
+		result.Hardening = h.engine.Hardening()
+		if lan := h.engine.LAN(); lan != nil {
+			result.LAN = &LANEndpoint{Address: lan.Listen, Port: lan.Port, Username: lan.Username, Password: lan.Password}
+		}
+		if ks := h.engine.KillSwitch(); ks != nil {
+			status := NewKillSwitchStatus(*ks)
+			result.KillSwitch = &status
+		}
+		result.EarlyLeakCount = h.engine.EarlyLeakCount()
+		result.StatsUnavailable = h.engine.StatsUnavailable()
+		if health, ok := h.engine.Health(); ok && !health.Healthy {
+			result.Degraded = true
+			result.DegradedReason = health.Reason
+		}
 		cfg := h.engine.Config()
 		if cfg != nil && cfg.Server != nil {
 			result.ServerName = cfg.Server.Name
 			result.Protocol = cfg.Server.Protocol
 		}
+		if cfg != nil {
+			result.TransportPolicy = cfg.TransportPolicy
+			if result.TransportPolicy == "" {
+				result.TransportPolicy = vpn.TransportAuto
+			}
+		}
+		result.RateLimit = h.rateLimitStatus()
+		result.PendingChanges = h.engine.PendingChanges()
 	}
 
+	result.LastConnectDurationMs = h.engine.LastConnectTiming().TotalMs
+
 	if state == vpn.StateError {
 		if err := h.stateMachine.LastError(); err != nil {
 			result.State = string(vpn.StateError)
 		}
 	}
 
-	return &Response{
-		ID:     req.ID,
-		Result: result,
+	return result, nil
+}
+
+// NewStateChangedParams converts a state machine transition for the
+// client.
+func NewStateChangedParams(t vpn.Transition) StateChangedParams {
+	p := StateChangedParams{
+		State:         string(t.State),
+		Reason:        t.Reason,
+		TransitionID:  t.ID,
+		PreviousState: string(t.Previous),
+		Timestamp:     t.At.UnixMilli(),
+	}
+	if t.Err != nil {
+		p.Error = t.Err.Error()
+	}
+	switch t.State {
+	case vpn.StateConnected:
+		p.ConnectedAt = t.ConnectedAt.UnixMilli()
+		p.SessionStartedAt = t.SessionStartedAt.UnixMilli()
+	case vpn.StateDisconnected:
+		ms := t.Duration.Milliseconds()
+		p.DurationMs = &ms
+	}
+	return p
+}
+
+// NewKillSwitchStatus converts engine kill switch stats for the client.
+func NewKillSwitchStatus(s vpn.KillSwitchStats) KillSwitchStatus {
+	status := KillSwitchStatus{
+		Activations:        s.Activations,
+		Engaged:            s.Engaged,
+		ProtectedSeconds:   s.ProtectedSeconds,
+		BlockedConnections: s.BlockedConnections,
+	}
+	if !s.LastActivation.IsZero() {
+		status.LastActivationTime = s.LastActivation.Unix()
+	}
+	return status
+}
+
+func (h *Handler) handleAppsList(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params AppsListParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	return h.listApps(ctx, params)
+}
+
+// handleAppsListDiff lists apps like apps.list, but returns only the
+// changes since the version the client has; see splittunnel.AppCatalog.
+func (h *Handler) handleAppsListDiff(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params AppsListDiffParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	apps, rpcErr := h.listApps(ctx, params.AppsListParams)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	return h.appCatalog.Diff(h.iconSize(params.AppsListParams), apps, params.SinceVersion), nil
+}
+
+// iconSize returns the icon size apps are listed with for params, 0 for
+// none.
+func (h *Handler) iconSize(params AppsListParams) int {
+	icons := h.settings.Get().PowerMode != vpn.PowerLow
+	if params.Icons != nil {
+		icons = *params.Icons
+	}
+	if !icons {
+		return 0
+	}
+	if params.IconSize != 0 {
+		return params.IconSize
 	}
+	return splittunnel.IconSizeSmall
 }
 
-func (h *Handler) handleAppsList(req *Request) *Response {
-	apps, err := splittunnel.ListInstalledApps()
+// listApps lists the installed apps for apps.list and apps.listDiff, and
+// reconciles the split tunnel app list against them.
+func (h *Handler) listApps(ctx context.Context, params AppsListParams) ([]AppInfo, *RPCError) {
+	if rpcErr := checkIconSize(params.IconSize); rpcErr != nil {
+		return nil, rpcErr
+	}
+	apps, err := h.installedApps(ctx, h.iconSize(params))
 	if err != nil {
 		log.Printf("apps.list failed: %v", err)
-		return errorResponse(req.ID, ErrCodeInternal, "failed to list apps")
+		return nil, rpcError(ErrCodeInternal, ErrKeyAppsListFailed, "failed to list apps")
+	}
+
+	if h.hasSplitApps() {
+		h.reconcileApps(apps)
+	}
+	return apps, nil
+}
+
+// checkIconSize rejects an icon size other than 0 (the default) and the
+// sizes splittunnel extracts.
+func checkIconSize(size int) *RPCError {
+	if size != 0 && !splittunnel.ValidIconSize(size) {
+		return rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid icon size",
+			map[string]interface{}{"iconSize": size, "allowed": []int{splittunnel.IconSizeSmall, splittunnel.IconSizeLarge}})
+	}
+	return nil
+}
+
+// handleAppsExportIcons writes the icons of the installed apps as PNG
+// files the UI reads from disk, instead of sending them over the pipe.
+func (h *Handler) handleAppsExportIcons(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params AppsExportIconsParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	if rpcErr := checkIconSize(params.IconSize); rpcErr != nil {
+		return nil, rpcErr
+	}
+	iconSize := splittunnel.IconSizeSmall
+	if params.IconSize != 0 {
+		iconSize = params.IconSize
 	}
-	return &Response{
-		ID:     req.ID,
-		Result: apps,
+
+	apps, err := h.installedApps(ctx, iconSize)
+	if err != nil {
+		log.Printf("apps.exportIcons failed to list apps: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyAppsListFailed, "failed to list apps")
+	}
+	export, err := h.iconExport.Export(apps)
+	if err != nil {
+		log.Printf("apps.exportIcons failed: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyIconExportFailed, "failed to export icons")
 	}
+	return AppsExportIconsResult{Dir: export.Dir, Icons: export.Icons, ExpiresAt: export.ExpiresAt.Unix()}, nil
+}
+
+// Bounds of AppsDomainActivityParams.SinceMinutes.
+const (
+	defaultDomainActivityMinutes = 15
+	maxDomainActivityMinutes     = 60
+)
+
+// handleAppsDomainActivity lists the domains an app reached in the session
+// and how each was routed, to check a split tunnel rule that seems to let
+// an app leak. It needs the dnsQueryLog setting.
+func (h *Handler) handleAppsDomainActivity(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params AppsDomainActivityParams
+	if err := json.Unmarshal(raw, &params); err != nil || strings.TrimSpace(params.ExeName) == "" {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "exeName is required")
+	}
+	if params.SinceMinutes < 0 || params.SinceMinutes > maxDomainActivityMinutes {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "sinceMinutes is out of range",
+			map[string]interface{}{"min": 1, "max": maxDomainActivityMinutes})
+	}
+	minutes := params.SinceMinutes
+	if minutes == 0 {
+		minutes = defaultDomainActivityMinutes
+	}
+	since := time.Now().Add(-time.Duration(minutes) * time.Minute)
+	return AppsDomainActivityResult{
+		QueryLog: h.engine.DNSQueryLog(),
+		Domains:  h.engine.DomainActivity(strings.TrimSpace(params.ExeName), since),
+	}, nil
+}
+
+// RunIconExportSweeper removes icon exports once they expire, and all of
+// them when stop is closed.
+func (h *Handler) RunIconExportSweeper(stop <-chan struct{}) {
+	h.iconExport.Run(stop, 10*time.Minute)
 }
 
-func (h *Handler) handleSplitSetConfig(req *Request) *Response {
+func (h *Handler) handleSplitSetConfig(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
 	var config SplitTunnelConfig
-	if err := json.Unmarshal(req.Params, &config); err != nil {
-		return errorResponse(req.ID, ErrCodeInvalidParams, "invalid parameters")
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
 	}
+	if rpcErr := validateSplitConfig(&config); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	h.mu.Lock()
+	changed := !reflect.DeepEqual(h.splitConfig, &config)
+	h.splitConfig = &config
+	h.mu.Unlock()
+	// The session routes by the config it connected with; vpn.status lists
+	// the change as pending until the next connect.
+	if changed {
+		h.engine.ApplyHot(ctx, vpn.HotOp{Kind: vpn.HotReconnect, Change: vpn.ChangeSplitTunnel})
+	}
+	return OKResult{OK: true}, nil
+}
+
+// pendingOf lists the changes of results that wait for the next connect.
+func pendingOf(results []vpn.HotResult) []string {
+	var pending []string
+	for _, r := range results {
+		if r.Pending {
+			pending = append(pending, r.Change)
+		}
+	}
+	return pending
+}
 
-	// Validate mode
+// validateSplitConfig checks a config for split.setConfig.
+func validateSplitConfig(config *SplitTunnelConfig) *RPCError {
 	switch config.Mode {
 	case "off", "app", "domain":
 		// valid
 	default:
-		return errorResponse(req.ID, ErrCodeInvalidParams, "invalid mode: must be off, app, or domain")
+		return rpcErrorData(ErrCodeInvalidParams, ErrKeySplitInvalidMode, "invalid mode: must be off, app, or domain",
+			map[string]interface{}{"mode": config.Mode, "allowed": []string{"off", "app", "domain"}})
 	}
 
-	h.mu.Lock()
-	h.splitConfig = &config
-	h.mu.Unlock()
-	return &Response{
-		ID:     req.ID,
-		Result: map[string]interface{}{"ok": true},
+	if _, err := splittunnel.ParseDomains(config.Domains); err != nil {
+		data := map[string]interface{}{"reason": err.Error()}
+		var entryErr *splittunnel.DomainEntryError
+		if errors.As(err, &entryErr) {
+			data["index"] = entryErr.Index
+			data["entry"] = entryErr.Entry
+		}
+		return rpcErrorData(ErrCodeInvalidParams, ErrKeySplitInvalidDomain, "invalid split tunnel domain", data)
+	}
+	if _, _, err := splittunnel.ParseDNSExceptions(config.DNSHijackExceptions); err != nil {
+		return rpcErrorData(ErrCodeInvalidParams, ErrKeyDNSExceptionInvalid, "invalid DNS hijack exception",
+			map[string]interface{}{"reason": err.Error()})
 	}
+	if err := splittunnel.ValidateDNSServers(config.DNSServers); err != nil {
+		return rpcErrorData(ErrCodeInvalidParams, ErrKeyDNSServerInvalid, "invalid DNS server",
+			map[string]interface{}{"reason": err.Error()})
+	}
+	return nil
 }
 
-func (h *Handler) handleSplitGetConfig(req *Request) *Response {
+func (h *Handler) handleSplitGetConfig(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
 	h.mu.RLock()
 	cfg := h.splitConfig
 	h.mu.RUnlock()
-	return &Response{
-		ID:     req.ID,
-		Result: cfg,
+	return cfg, nil
+}
+
+func (h *Handler) handleDebugGetConfig(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	h.mu.RLock()
+	result := DebugConfigResult{SplitTunnel: h.splitConfig}
+	h.mu.RUnlock()
+
+	if h.stateMachine.State() == vpn.StateConnected {
+		if cfg := h.engine.Config(); cfg != nil && cfg.Server != nil {
+			result.Active = &ActiveConfig{
+				Protocol:            cfg.Server.Protocol,
+				SplitTunnelMode:     cfg.SplitTunnelMode,
+				DNSHijackExceptions: cfg.DNSHijackExceptions,
+				KillSwitch:          cfg.KillSwitch,
+				MTU:                 cfg.MTU,
+				StatsStrategy:       h.engine.StatsStrategy(),
+			}
+		}
 	}
+	return result, nil
 }
 
-// isPrivateAddress checks if a host resolves to a private/loopback/link-local IP.
-func isPrivateAddress(host string) bool {
-	ip := net.ParseIP(host)
-	if ip == nil {
-		// Hostname — resolve it first
-		addrs, err := net.LookupIP(host)
-		if err != nil || len(addrs) == 0 {
-			return true // block if unresolvable
+func (h *Handler) handleTraceConnections(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params TraceConnectionsParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	result := TraceConnectionsResult{Enabled: params.Enabled}
+	if until := h.engine.TraceConnections(params.Enabled); !until.IsZero() {
+		result.ExpiresAt = until.Unix()
+	}
+	return result, nil
+}
+
+// publicAddrs returns the addresses host resolves to with lookup, or
+// errPrivateAddress if any of them is private, loopback or link-local: a
+// public first answer does not keep a dial from reaching a private one. A
+// host that does not resolve is refused too.
+func publicAddrs(ctx context.Context, host string, lookup func(ctx context.Context, host string) ([]net.IP, error)) ([]netip.Addr, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookup(ctx, host); err != nil || len(ips) == 0 {
+			return nil, errPrivateAddress
+		}
+	}
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || isPrivateIP(ip) {
+			return nil, errPrivateAddress
 		}
-		ip = addrs[0]
+		addrs = append(addrs, addr.Unmap())
 	}
+	return addrs, nil
+}
+
+func isPrivateIP(ip net.IP) bool {
 	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
 }
 
-func (h *Handler) handlePing(req *Request) *Response {
+// checkUpstreamProxy runs the preflight of cfg's upstream proxy, if any,
+// so that a proxy that is unreachable or refuses the credentials is
+// reported as such rather than as a failed connect.
+func (h *Handler) checkUpstreamProxy(ctx context.Context, cfg *vpn.Config) *RPCError {
+	if cfg.UpstreamProxy == nil || cfg.Server == nil {
+		return nil
+	}
+	target := net.JoinHostPort(cfg.Server.Address, strconv.Itoa(int(cfg.Server.Port)))
+	err := h.probeProxy(ctx, *cfg.UpstreamProxy, target)
+	if err == nil {
+		return nil
+	}
+	log.Printf("vpn.connect: upstream proxy preflight failed: %v", err)
+	if ctx.Err() != nil {
+		return cancelledError(ctx)
+	}
+	data := map[string]interface{}{"proxy": cfg.UpstreamProxy.Addr(), "reason": err.Error()}
+	var proxyErr *vpn.UpstreamProxyError
+	if errors.As(err, &proxyErr) {
+		data["stage"] = proxyErr.Stage
+	}
+	return rpcErrorData(ErrCodeInternal, ErrKeyUpstreamFailed, "the upstream proxy cannot reach the server", data)
+}
+
+// checkServerPolicy refuses servers on ports settings do not allow, and
+// servers on private, loopback or link-local addresses, so a shared link
+// cannot turn a device on the user's LAN into the VPN server. A host name
+// that does not resolve is let through: it cannot reach the LAN either,
+// and the connect reports the failure. hops are the port hopping ranges
+// of a raw outbound; every port in them must be allowed too.
+func (h *Handler) checkServerPolicy(ctx context.Context, serverCfg *parser.ServerConfig, hops []vpn.PortRange) *RPCError {
+	s := h.settings.Get()
+	if !s.ServerPortAllowed(serverCfg.Port) {
+		return rpcErrorData(ErrCodeInvalidParams, ErrKeyServerPortBlocked, "server port not allowed",
+			map[string]interface{}{"port": serverCfg.Port, "allowedPorts": s.AllowedServerPorts})
+	}
+	for _, r := range hops {
+		for port := uint32(r.Lo); port <= uint32(r.Hi); port++ {
+			if !s.ServerPortAllowed(uint16(port)) {
+				return rpcErrorData(ErrCodeInvalidParams, ErrKeyServerPortBlocked, "server port not allowed",
+					map[string]interface{}{"port": port, "serverPorts": r.String(), "allowedPorts": s.AllowedServerPorts})
+			}
+		}
+	}
+	ips := []net.IP{net.ParseIP(serverCfg.Address)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = h.lookupIP(ctx, serverCfg.Address); err != nil {
+			log.Printf("vpn.connect: failed to resolve %s: %v", serverCfg.Address, err)
+			return nil
+		}
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return rpcErrorData(ErrCodeInvalidParams, ErrKeyServerPrivate, "server address is private",
+				map[string]interface{}{"address": serverCfg.Address})
+		}
+	}
+	return nil
+}
+
+func (h *Handler) handleDeduplicate(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params DeduplicateParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	if len(params.Links) > maxDeduplicateLinks {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "too many links",
+			map[string]interface{}{"count": len(params.Links), "max": maxDeduplicateLinks})
+	}
+
+	result := DeduplicateResult{Groups: []DuplicateGroup{}, Invalid: []InvalidLink{}}
+	cfgs := make([]*parser.ServerConfig, len(params.Links))
+	for i, link := range params.Links {
+		if len(link) > maxLinkLength {
+			result.Invalid = append(result.Invalid, InvalidLink{Index: i, ErrorKey: ErrKeyLinkTooLong})
+			continue
+		}
+		cfg, err := parser.ParseLink(link)
+		if err != nil {
+			result.Invalid = append(result.Invalid, InvalidLink{Index: i, ErrorKey: ErrKeyLinkParseFailed})
+			continue
+		}
+		cfgs[i] = cfg
+	}
+
+	for _, g := range parser.FindDuplicates(cfgs) {
+		result.Groups = append(result.Groups, DuplicateGroup{
+			Key:           g.Key,
+			Members:       g.Members,
+			Canonical:     g.Canonical,
+			CanonicalLink: strings.TrimSpace(params.Links[g.Canonical]),
+		})
+	}
+	return result, nil
+}
+
+func (h *Handler) handleParseText(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ParseTextParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	if len(params.Text) > maxParseTextBytes {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "text is too long",
+			map[string]interface{}{"length": len(params.Text), "max": maxParseTextBytes})
+	}
+
+	return h.parseTexts([]string{params.Text}), nil
+}
+
+// parseTexts extracts and parses the links in each text, as
+// servers.parseText does for one.
+func (h *Handler) parseTexts(texts []string) ParseTextResult {
+	// Stored rules were validated when saved.
+	groups, _ := parser.CompileGroupRules(h.settings.Get().ServerGroupRules)
+	seen := make(map[string]int)
+	result := ParseTextResult{Servers: []ParsedLink{}, Failures: []LinkFailure{}}
+	for _, text := range texts {
+		for _, c := range parser.ExtractLinks(text) {
+			switch {
+			case len(c.Link) > maxLinkLength:
+				result.Failures = append(result.Failures, LinkFailure{Link: c.Link[:maxLinkLength], ErrorKey: ErrKeyLinkTooLong, Reason: "link is too long"})
+			case c.Err != nil:
+				result.Failures = append(result.Failures, LinkFailure{Link: c.Link, ErrorKey: ErrKeyLinkParseFailed, Reason: c.Err.Error()})
+			default:
+				id := parser.CanonicalKey(c.Server)
+				if seen[id]++; seen[id] > 1 {
+					id += "-" + strconv.Itoa(seen[id])
+				}
+				result.Servers = append(result.Servers, ParsedLink{
+					ID:       id,
+					Link:     c.Link,
+					Server:   c.Server,
+					NameInfo: parser.DescribeName(c.Server.Name, groups),
+				})
+			}
+		}
+	}
+	result.Unparseable = len(result.Failures)
+	return result
+}
+
+func (h *Handler) handleDecodeQR(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params DecodeQRParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	codes, err := qrscan.Decode(params.Image)
+	switch {
+	case errors.Is(err, qrscan.ErrImageTooLarge):
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyImageTooLarge, err.Error(),
+			map[string]interface{}{"maxBytes": qrscan.MaxImageBytes})
+	case err != nil:
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyImageInvalid, err.Error())
+	}
+	return DecodeQRResult{Codes: len(codes), ParseTextResult: h.parseTexts(codes)}, nil
+}
+
+func (h *Handler) handlePerformance(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params PerformanceParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	if params.Links == nil {
+		return PerformanceResult{Servers: h.performance.All()}, nil
+	}
+
+	result := PerformanceResult{Servers: []profiles.ServerPerformance{}}
+	for _, link := range params.Links {
+		if len(link) > maxLinkLength {
+			continue
+		}
+		server, err := parser.ParseLink(link)
+		if err != nil {
+			continue
+		}
+		if perf, ok := h.performance.Get(server); ok {
+			perf.Link = link
+			result.Servers = append(result.Servers, perf)
+		}
+	}
+	return result, nil
+}
+
+func (h *Handler) handlePing(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
 	var params PingParams
-	if err := json.Unmarshal(req.Params, &params); err != nil {
-		return errorResponse(req.ID, ErrCodeInvalidParams, "invalid parameters")
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
 	}
 
 	serverCfg, err := parser.ParseLink(params.Link)
 	if err != nil {
-		return &Response{
-			ID:     req.ID,
-			Result: PingResult{Error: "failed to parse link"},
-		}
+		return PingResult{Error: "failed to parse link", ErrorKey: ErrKeyLinkParseFailed}, nil
+	}
+	if s := h.settings.Get(); !s.ServerPortAllowed(serverCfg.Port) {
+		return PingResult{Error: "server port not allowed", ErrorKey: ErrKeyServerPortBlocked}, nil
 	}
 
-	// SSRF protection: block private/loopback addresses
-	if isPrivateAddress(serverCfg.Address) {
-		return &Response{
-			ID:     req.ID,
-			Result: PingResult{Error: "cannot ping private addresses"},
-		}
+	var outer vpn.OuterNetwork
+	if ip, err := netip.ParseAddr(serverCfg.Address); err == nil && ip.Is4() {
+		outer = h.outerNetwork(ctx)
+	}
+	latency, err := probeLatency(ctx, serverCfg, h.lookupIP, outer)
+	if ctx.Err() != nil {
+		return nil, cancelledError(ctx)
+	}
+	if errors.Is(err, errPrivateAddress) {
+		return PingResult{Error: "cannot ping private addresses", ErrorKey: ErrKeyPingPrivateAddress}, nil
+	}
+	if err != nil {
+		return PingResult{Error: "connection failed", ErrorKey: ErrKeyPingUnreachable}, nil
 	}
 
-	// Simple TCP connect to measure latency
-	start := time.Now()
-	addr := fmt.Sprintf("%s:%d", serverCfg.Address, serverCfg.Port)
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	return PingResult{Latency: int(latency.Milliseconds())}, nil
+}
+
+// errPrivateAddress is returned by ProbeLatency for non-public servers.
+var errPrivateAddress = errors.New("cannot probe private addresses")
+
+// ProbeLatency measures TCP connect latency to a server, giving up when ctx
+// is done. Private, loopback and link-local addresses are refused (SSRF
+// protection).
+func ProbeLatency(ctx context.Context, serverCfg *parser.ServerConfig) (time.Duration, error) {
+	return probeLatency(ctx, serverCfg, func(ctx context.Context, host string) ([]net.IP, error) {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}, vpn.OuterNetwork{})
+}
+
+// probeLatency is ProbeLatency resolving with lookup. The server's
+// addresses of both families race (see dialFirst), translated for outer,
+// so the latency is that of the address a connect would use.
+func probeLatency(ctx context.Context, serverCfg *parser.ServerConfig, lookup func(ctx context.Context, host string) ([]net.IP, error), outer vpn.OuterNetwork) (time.Duration, error) {
+	addrs, err := publicAddrs(ctx, serverCfg.Address, lookup)
 	if err != nil {
-		return &Response{
-			ID:     req.ID,
-			Result: PingResult{Error: "connection failed"},
-		}
+		return 0, err
+	}
+	for i, addr := range addrs {
+		addrs[i] = outer.Translate(addr)
+	}
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, took, err := dialFirst(ctx, &dialer, interleaveFamilies(addrs), serverCfg.Port)
+	if err != nil {
+		return 0, err
 	}
 	conn.Close()
-	latency := time.Since(start).Milliseconds()
+	return took, nil
+}
 
-	return &Response{
-		ID:     req.ID,
-		Result: PingResult{Latency: int(latency)},
+// outerNetwork reads how the machine reaches servers from the routing
+// table, looking for the network's NAT64 prefix when it is IPv6-only. A
+// routing table that cannot be read counts as one with an IPv4 route.
+func (h *Handler) outerNetwork(ctx context.Context) vpn.OuterNetwork {
+	v4, v6, err := h.routeFamily()
+	if err != nil {
+		log.Printf("outer network: %v", err)
+		return vpn.OuterNetwork{}
+	}
+	if v4 || !v6 {
+		return vpn.OuterNetwork{}
 	}
+	return vpn.OuterNetwork{IPv6Only: true, NAT64: vpn.DiscoverNAT64(ctx, h.lookupIP)}
 }
 
-func (h *Handler) handleShutdown(req *Request) *Response {
-	log.Printf("Shutdown requested via IPC")
+// scanEnvironment checks the system for other VPNs and proxies, besides
+// the TUN adapter of inst.
+func scanEnvironment(inst instance.Instance) envscan.Report {
+	return envscan.Scan(envscan.WindowsProvider{}, inst.InterfaceName())
+}
+
+func (h *Handler) handleEnvironment(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.envScan(), nil
+}
+
+// handleConflicts lists the proxy tools and TUN adapters that would fight
+// the tunnel over auto_route.
+func (h *Handler) handleConflicts(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.envScan().TunConflicts(), nil
+}
+
+// handleDNSEnvironment checks for hosts file overrides, LAN and loopback
+// resolvers and local DNS proxies, watching the session's server name in
+// the hosts file too.
+func (h *Handler) handleDNSEnvironment(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	if cfg := h.engine.Config(); cfg != nil && cfg.Server != nil {
+		return h.dnsCheck(cfg.Server.Address), nil
+	}
+	return h.dnsCheck(), nil
+}
+
+// handleRoutes returns the IPv4 and IPv6 routing tables and the adapters,
+// annotated with which routes the tunnel added and which defaults it
+// overrides.
+func (h *Handler) handleRoutes(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.routeTable(), nil
+}
+
+// SetLastRun sets the summary of the service's previous run that
+// diagnostics.lastRun reports; nil when there is none.
+func (h *Handler) SetLastRun(prev *lastrun.Summary) {
+	h.mu.Lock()
+	h.lastRun = prev
+	h.mu.Unlock()
+}
+
+// SetLoadIssues sets what was wrong with the data files at startup, which
+// diagnostics.lastRun reports.
+func (h *Handler) SetLoadIssues(issues []datafile.Issue) {
+	h.mu.Lock()
+	h.loadIssues = issues
+	h.mu.Unlock()
+}
+
+// handleLastRun reports how the service's previous run ended, so the UI
+// can explain a restart after a crash, and what was wrong with the data
+// files this run loaded.
+func (h *Handler) handleLastRun(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	h.mu.RLock()
+	prev, issues := h.lastRun, h.loadIssues
+	h.mu.RUnlock()
+	if prev == nil {
+		return LastRunResult{LoadIssues: issues}, nil
+	}
+	return LastRunResult{LoadIssues: issues, Previous: &LastRun{
+		StartedAt: prev.StartedAt.Unix(),
+		EndedAt:   prev.EndedAt.Unix(),
+		EndReason: prev.EndReason,
+		State:     prev.State,
+		Server:    prev.Server,
+		Panic:     prev.Panic,
+		Stack:     prev.Stack,
+	}}, nil
+}
+
+// SetUsageHistory sets the per-day traffic history stats.getHistory
+// reports.
+func (h *Handler) SetUsageHistory(history *usage.History) {
+	h.mu.Lock()
+	h.usage = history
+	h.mu.Unlock()
+}
+
+// handleStatsHistory returns traffic per local calendar day, with each
+// day's boundaries so the UI can lay out 23 and 25 hour days.
+func (h *Handler) handleStatsHistory(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params StatsHistoryParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil || params.Days < 0 {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	h.mu.RLock()
+	history := h.usage
+	h.mu.RUnlock()
+	result := StatsHistoryResult{Days: []HistoryDay{}}
+	if history == nil {
+		return result, nil
+	}
+	for _, d := range history.Days(params.Days) {
+		result.Days = append(result.Days, HistoryDay{
+			Date:           d.Date,
+			Start:          d.Start.Unix(),
+			End:            d.End.Unix(),
+			UTCOffset:      d.Offset,
+			Upload:         d.Upload,
+			Download:       d.Download,
+			DirectUpload:   d.DirectUpload,
+			DirectDownload: d.DirectDownload,
+		})
+	}
+	return result, nil
+}
+
+func (h *Handler) handleMTUProbe(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	probe, err := h.engine.ProbeMTU(ctx)
+	if err != nil {
+		return nil, rpcError(ErrCodeInternal, ErrKeyNotConnected, "not connected")
+	}
+	return probe, nil
+}
+
+func (h *Handler) handleCheckCompat(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params CheckCompatParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+
+	serverCfg, err := parser.ParseLink(params.Link)
+	if err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyLinkParseFailed, "failed to parse server link")
+	}
+
+	version := vpn.CoreVersion()
+	return CheckCompatResult{
+		CoreVersion: version,
+		Features:    vpn.RequiredFeatures(serverCfg),
+		Warnings:    vpn.CheckCompat(serverCfg, version),
+	}, nil
+}
+
+func (h *Handler) handleShutdown(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	reason, rpcErr := h.checkDestructive(raw)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	log.Printf("Shutdown requested via IPC (reason: %s)", reason)
+	// Disconnect here so the session ends with the caller's reason rather
+	// than the default one of the deferred cleanup.
+	if err := h.engine.DisconnectWithReason(reason); err != nil {
+		log.Printf("warning: disconnect before shutdown failed: %v", err)
+	}
 	// Signal main goroutine for graceful shutdown (runs deferred cleanup)
 	go func() {
 		time.Sleep(100 * time.Millisecond)
 		close(h.ShutdownCh)
 	}()
-	return &Response{
-		ID:     req.ID,
-		Result: map[string]interface{}{"ok": true},
-	}
+	return OKResult{OK: true}, nil
 }
 
-func errorResponse(id string, code int, message string) *Response {
-	log.Printf("RPC error [%s]: %s", id, message)
-	return &Response{
-		ID: id,
-		Error: &RPCError{
-			Code:    code,
-			Message: message,
-		},
+func (h *Handler) handleClearCache(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ClearCacheParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+
+	var result ClearCacheResult
+	switch state := h.stateMachine.State(); state {
+	case vpn.StateDisconnected, vpn.StateError:
+	case vpn.StateConnected:
+		if !params.Disconnect {
+			return nil, rpcErrorData(ErrCodeConfirmationRequired, ErrKeyCacheInUse, "the cache file is in use; repeat with disconnect to end the session first",
+				map[string]interface{}{"state": string(state)})
+		}
+		reason, rpcErr := h.checkDestructive(raw)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		if err := h.engine.DisconnectWithReason(reason); err != nil {
+			log.Printf("maintenance.clearCache: disconnect failed: %v", err)
+			return nil, rpcError(ErrCodeInternal, ErrKeyDisconnectFailed, "disconnect failed")
+		}
+		result.Disconnected = true
+	default:
+		// A session is starting or stopping; sing-box may hold the file.
+		return nil, rpcErrorData(ErrCodeInternal, ErrKeyCacheInUse, "the cache file is in use; retry once the session has settled",
+			map[string]interface{}{"state": string(state)})
+	}
+
+	removed, err := vpn.ClearCacheFile(h.cacheFile)
+	if err != nil {
+		log.Printf("maintenance.clearCache: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyStorageFailed, "failed to delete the cache file")
 	}
+	result.Removed = removed
+	return result, nil
 }
@@ -0,0 +1,1583 @@
+package ipc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/mriaz/vpn-core/internal/datafile"
+	"github.com/mriaz/vpn-core/internal/dnsenv"
+	"github.com/mriaz/vpn-core/internal/envscan"
+	"github.com/mriaz/vpn-core/internal/instance"
+	"github.com/mriaz/vpn-core/internal/lastrun"
+	"github.com/mriaz/vpn-core/internal/netready"
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/perfreport"
+	"github.com/mriaz/vpn-core/internal/profiles"
+	"github.com/mriaz/vpn-core/internal/qrscan"
+	"github.com/mriaz/vpn-core/internal/settings"
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+	"github.com/mriaz/vpn-core/internal/usage"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	dir := t.TempDir()
+	st := settings.Open(filepath.Join(dir, settings.FileName), nil)
+	ps := profiles.Open(filepath.Join(dir, profiles.FileName), nil)
+	hm := profiles.NewHealthMonitor(ps, filepath.Join(dir, profiles.HealthFileName), func(*parser.ServerConfig) (time.Duration, error) { return 0, nil })
+	perf := profiles.OpenPerformance(filepath.Join(dir, profiles.PerformanceFileName))
+
+	sm := vpn.NewStateMachine()
+	h := NewHandler(vpn.NewEngine(sm), sm, st, ps, hm, perf)
+	h.cacheFile = filepath.Join(dir, vpn.CacheFileName)
+	h.iconExport = splittunnel.NewIconExporter(filepath.Join(dir, splittunnel.IconExportDirName))
+	// Names under .lan resolve to a private address, others to a public one.
+	h.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		if strings.HasSuffix(host, ".lan") {
+			return []net.IP{net.ParseIP("192.168.1.1")}, nil
+		}
+		return []net.IP{net.ParseIP("203.0.113.10")}, nil
+	}
+	h.network = netready.NewGate(&fakeNetwork{level: netready.LevelInternetAccess})
+	h.routeFamily = func() (bool, bool, error) { return true, true, nil }
+	return h
+}
+
+// fakeNetwork reports a fixed connectivity level and counts the reads.
+type fakeNetwork struct {
+	level netready.Level
+	reads atomic.Int32
+}
+
+func (f *fakeNetwork) Level() (netready.Level, error) {
+	f.reads.Add(1)
+	return f.level, nil
+}
+
+// recordingNotifier records the notifications a handler raises.
+type recordingNotifier struct {
+	topics []string
+	sent   []*Notification
+}
+
+func (n *recordingNotifier) Broadcast(topic string, notification *Notification) {
+	n.topics = append(n.topics, topic)
+	n.sent = append(n.sent, notification)
+}
+
+func call(h *Handler, method string, params interface{}) *Response {
+	var raw json.RawMessage
+	if params != nil {
+		raw, _ = json.Marshal(params)
+	}
+	return h.Handle(&Request{ID: "1", Method: method, Params: raw})
+}
+
+// TestErrorKeys documents the error key returned by each handler failure
+// path. The UI translates these keys, so a change here is a contract change.
+func TestErrorKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		params  interface{}
+		wantKey string
+	}{
+		{"unknown method", "vpn.bogus", nil, ErrKeyMethodNotFound},
+		{"hello bad params", "core.hello", "not an object", ErrKeyInvalidParams},
+		{"connect bad params", "vpn.connect", "not an object", ErrKeyInvalidParams},
+		{"connect link too long", "vpn.connect", map[string]string{"link": "vless://" + strings.Repeat("a", maxLinkLength)}, ErrKeyLinkTooLong},
+		{"connect unparseable link", "vpn.connect", map[string]string{"link": "ftp://example.com"}, ErrKeyLinkParseFailed},
+		{"connect unknown attempt policy", "vpn.connect", map[string]string{"link": "vless://u@example.com:443", "policy": "later"}, ErrKeyInvalidParams},
+		{"connect link and server", "vpn.connect", map[string]interface{}{
+			"link":   "vless://u@example.com:443",
+			"server": map[string]interface{}{"protocol": "vless"},
+		}, ErrKeyLinkAndServer},
+		{"connect invalid server", "vpn.connect", map[string]interface{}{
+			"server": map[string]interface{}{"protocol": "vless", "address": "example.com", "port": 443},
+		}, ErrKeyServerInvalid},
+		{"connect keep-alive out of range", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443", "tcpKeepAliveSeconds": 1,
+		}, ErrKeyTuningInvalid},
+		{"connect invalid sniff mode", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443", "sniffMode": "partial",
+		}, ErrKeyTuningInvalid},
+		{"connect invalid transport policy", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443", "transportPolicy": "udp-only",
+		}, ErrKeyTuningInvalid},
+		{"connect hysteria2 in tcp-only mode", "vpn.connect", map[string]interface{}{
+			"link": "hy2://p@example.com:443", "transportPolicy": "tcp-only",
+		}, ErrKeyTransportConflict},
+		{"mtuProbe not connected", "diagnostics.mtuProbe", nil, ErrKeyNotConnected},
+		{"performance report not connected", "diagnostics.performanceReport", nil, ErrKeyNotConnected},
+		{"reconnect not connected", "vpn.reconnect", nil, ErrKeyNotConnected},
+		{"setRateLimit not connected", "vpn.setRateLimit", map[string]int{"maxDownMbps": 5}, ErrKeyNotConnected},
+		{"setRateLimit out of range", "vpn.setRateLimit", map[string]int{"maxUpMbps": -1}, ErrKeyTuningInvalid},
+		{"connect rate limit out of range", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443", "maxDownMbps": vpn.MaxRateLimitMbps + 1,
+		}, ErrKeyTuningInvalid},
+		{"settings rate limit out of range", "settings.set", map[string]int{"maxUpMbps": -5}, ErrKeySettingsInvalid},
+		{"settings audit log size out of range", "settings.set", map[string]int{"auditMaxSizeMb": 500}, ErrKeySettingsInvalid},
+		{"audit query without an elevated client", "audit.query", nil, ErrKeyAdminRequired},
+		{"connect private address", "vpn.connect", map[string]string{"link": "vless://u@192.168.1.1:443"}, ErrKeyServerPrivate},
+		{"connect loopback address", "vpn.connect", map[string]string{"link": "vless://u@[::1]:443"}, ErrKeyServerPrivate},
+		{"connect name of a private address", "vpn.connect", map[string]string{"link": "vless://u@router.lan:443"}, ErrKeyServerPrivate},
+		{"connectRaw private address", "vpn.connectRaw", map[string]interface{}{
+			"outbound": map[string]interface{}{"type": "trojan", "server": "10.0.0.5", "server_port": 443, "password": "p"},
+		}, ErrKeyServerPrivate},
+		{"settings invalid allowed port", "settings.set", map[string][]string{"allowedServerPorts": {"9000-80"}}, ErrKeySettingsInvalid},
+		{"admin lock short token", "settings.adminLock", map[string]string{"token": "short"}, ErrKeyInvalidParams},
+		{"admin unlock while unlocked", "settings.adminUnlock", map[string]string{}, ErrKeyInvalidParams},
+		{"connectRaw bad params", "vpn.connectRaw", "not an object", ErrKeyInvalidParams},
+		{"connectRaw without outbound", "vpn.connectRaw", map[string]interface{}{}, ErrKeyInvalidParams},
+		{"connectRaw with link", "vpn.connectRaw", map[string]interface{}{
+			"link": "vless://u@example.com:443", "outbound": map[string]interface{}{"type": "vless"},
+		}, ErrKeyInvalidParams},
+		{"connectRaw detour", "vpn.connectRaw", map[string]interface{}{
+			"outbound": map[string]interface{}{"type": "vless", "server": "example.com", "server_port": 443, "uuid": "u", "detour": "direct"},
+		}, ErrKeyOutboundInvalid},
+		{"connectRaw tuic in tcp-only mode", "vpn.connectRaw", map[string]interface{}{
+			"outbound":        map[string]interface{}{"type": "tuic", "server": "example.com", "server_port": 443, "uuid": "u"},
+			"transportPolicy": "tcp-only",
+		}, ErrKeyTransportConflict},
+		{"connect idle timeout out of range", "vpn.connect", map[string]interface{}{
+			"link": "hy2://p@example.com:443", "idleTimeoutSeconds": 99999,
+		}, ErrKeyTuningInvalid},
+		{"connect early data too large", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443?type=ws", "wsMaxEarlyData": 1 << 20,
+		}, ErrKeyTuningInvalid},
+		{"connect bad early data header", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443?type=ws", "wsMaxEarlyData": 2048, "wsEarlyDataHeader": "Bad Header:",
+		}, ErrKeyTuningInvalid},
+		{"connect lan without credentials", "vpn.connect", map[string]interface{}{
+			"link": "hy2://p@example.com:443", "allowLan": true, "lanUsername": "u",
+		}, ErrKeyLANCredentials},
+		{"connect lan public address", "vpn.connect", map[string]interface{}{
+			"link": "hy2://p@example.com:443", "allowLan": true, "lanAddress": "8.8.8.8",
+			"lanUsername": "u", "lanPassword": "p",
+		}, ErrKeyLANInvalid},
+		{"connect lan privileged port", "vpn.connect", map[string]interface{}{
+			"link": "hy2://p@example.com:443", "allowLan": true, "lanAddress": "192.168.1.10", "lanPort": 80,
+			"lanUsername": "u", "lanPassword": "p",
+		}, ErrKeyLANInvalid},
+		{"split invalid dns exception", "split.setConfig", map[string]interface{}{
+			"mode": "off", "dnsHijackExceptions": []string{"bad|app"},
+		}, ErrKeyDNSExceptionInvalid},
+		{"connect invalid dns exception", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443", "dnsHijackExceptions": []string{"a?b"},
+		}, ErrKeyDNSExceptionInvalid},
+		{"split dns server suffix twice", "split.setConfig", map[string]interface{}{
+			"mode": "off", "dnsServers": []map[string]interface{}{
+				{"domainSuffixes": []string{"corp.example"}, "address": "10.0.0.53", "detour": "proxy"},
+				{"domainSuffixes": []string{"corp.example"}, "address": "10.0.0.54", "detour": "proxy"},
+			},
+		}, ErrKeyDNSServerInvalid},
+		{"split dns server bad detour", "split.setConfig", map[string]interface{}{
+			"mode": "off", "dnsServers": []map[string]interface{}{
+				{"domainSuffixes": []string{"corp.example"}, "address": "10.0.0.53", "detour": "block"},
+			},
+		}, ErrKeyDNSServerInvalid},
+		{"split invalid domain regex", "split.setConfig", map[string]interface{}{
+			"mode": "domain", "domains": []string{"example.com", "regex:(cdn"},
+		}, ErrKeySplitInvalidDomain},
+		{"connect empty domain keyword", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443", "splitTunnelMode": "domain", "splitTunnelDomains": []string{"keyword:"},
+		}, ErrKeySplitInvalidDomain},
+		{"split invalid mode", "split.setConfig", map[string]string{"mode": "everything"}, ErrKeySplitInvalidMode},
+		{"connect app split without apps", "vpn.connect", map[string]interface{}{
+			"link": "vless://u@example.com:443", "splitTunnelMode": "app", "splitTunnelApps": []string{},
+		}, ErrKeySplitEmptyList},
+		{"split capabilities unknown connection mode", "split.capabilities", map[string]string{"connectionMode": "socks"}, ErrKeyInvalidParams},
+		{"split capabilities invalid sniff mode", "split.capabilities", map[string]string{"sniffMode": "sometimes"}, ErrKeyTuningInvalid},
+		{"schema without method", "meta.schema", nil, ErrKeyInvalidParams},
+		{"schema of unknown method", "meta.schema", MetaSchemaParams{Method: "vpn.bogus"}, ErrKeyMethodNotFound},
+		{"ping bad params", "servers.ping", "x", ErrKeyInvalidParams},
+		{"deduplicate bad params", "servers.deduplicate", "x", ErrKeyInvalidParams},
+		{"parse text bad params", "servers.parseText", 42, ErrKeyInvalidParams},
+		{"decode qr not an image", "servers.decodeQr", DecodeQRParams{Image: []byte("vless://u@example.com:443")}, ErrKeyImageInvalid},
+		{"decode qr oversized image", "servers.decodeQr", DecodeQRParams{Image: make([]byte, qrscan.MaxImageBytes+1)}, ErrKeyImageTooLarge},
+		{"compat unparseable link", "diagnostics.checkCompat", map[string]string{"link": "nope"}, ErrKeyLinkParseFailed},
+		{"settings out of range", "settings.set", map[string]int{"healthIntervalMinutes": 1}, ErrKeySettingsInvalid},
+		{"settings unknown power mode", "settings.set", map[string]string{"powerMode": "turbo"}, ErrKeySettingsInvalid},
+		{"settings invalid proxy bypass", "settings.set", map[string][]string{"systemProxyBypass": {"fd00::/8"}}, ErrKeySettingsInvalid},
+		{"settings invalid quiet hours", "settings.set", map[string]interface{}{"desktopNotifications": map[string]interface{}{"quietHours": map[string]string{"start": "22:00"}}}, ErrKeySettingsInvalid},
+		{"settings invalid captive portal grace", "settings.set", map[string]int{"captivePortalGraceMinutes": 0}, ErrKeySettingsInvalid},
+		{"profile bad link", "profiles.save", map[string]string{"link": "nope"}, ErrKeyLinkParseFailed},
+		{"profile unknown id", "profiles.delete", map[string]string{"id": "missing"}, ErrKeyProfileNotFound},
+		{"export unconfirmed", "profiles.exportLink", map[string]string{"id": "missing"}, ErrKeyConfirmRequired},
+		{"export unknown id", "profiles.exportLink", ExportLinkParams{ID: "missing", Confirm: true}, ErrKeyProfileNotFound},
+		{"export while disconnected", "profiles.exportLink", ExportLinkParams{Confirm: true}, ErrKeyNotConnected},
+	}
+
+	h := newTestHandler(t)
+	for _, tt := range tests {
+		resp := call(h, tt.method, tt.params)
+		if resp.Error == nil {
+			t.Errorf("%s: expected error, got result %v", tt.name, resp.Result)
+			continue
+		}
+		if resp.Error.Key != tt.wantKey {
+			t.Errorf("%s: key = %q, want %q", tt.name, resp.Error.Key, tt.wantKey)
+		}
+		if resp.Error.Message == "" {
+			t.Errorf("%s: empty English message", tt.name)
+		}
+	}
+}
+
+func TestErrorData(t *testing.T) {
+	h := newTestHandler(t)
+
+	resp := call(h, "vpn.connect", map[string]string{"link": "vless://" + strings.Repeat("a", maxLinkLength)})
+	if resp.Error == nil || resp.Error.Data["max"] != maxLinkLength {
+		t.Errorf("link.too_long data = %v, want max %d", resp.Error, maxLinkLength)
+	}
+
+	resp = call(h, "split.setConfig", map[string]string{"mode": "everything"})
+	if resp.Error == nil || resp.Error.Data["mode"] != "everything" {
+		t.Errorf("split.invalid_mode data = %v, want offending mode", resp.Error)
+	}
+}
+
+func TestPingErrorKeys(t *testing.T) {
+	h := newTestHandler(t)
+
+	resp := call(h, "servers.ping", map[string]string{"link": "nope"})
+	if r, ok := resp.Result.(PingResult); !ok || r.ErrorKey != ErrKeyLinkParseFailed {
+		t.Errorf("ping unparseable link: result = %#v", resp.Result)
+	}
+
+	resp = call(h, "servers.ping", map[string]string{"link": "vless://u@127.0.0.1:443"})
+	if r, ok := resp.Result.(PingResult); !ok || r.ErrorKey != ErrKeyPingPrivateAddress {
+		t.Errorf("ping private address: result = %#v", resp.Result)
+	}
+}
+
+// resolverTable answers lookups from a table; other names do not resolve.
+type resolverTable map[string][]string
+
+func (r resolverTable) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	answers, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	ips := make([]net.IP, len(answers))
+	for i, a := range answers {
+		ips[i] = net.ParseIP(a)
+	}
+	return ips, nil
+}
+
+func TestPublicAddrs(t *testing.T) {
+	resolver := resolverTable{
+		"v6only.example":    {"2001:db8::10"},
+		"dualstack.example": {"2001:db8::10", "203.0.113.10"},
+		// A public IPv6 first answer used to hide the private IPv4 one.
+		"masked.example": {"2001:db8::10", "192.168.1.1"},
+		"ula.example":    {"203.0.113.10", "fd00::1"},
+	}
+	tests := []struct {
+		host string
+		want []string // nil if refused
+	}{
+		{"v6only.example", []string{"2001:db8::10"}},
+		{"dualstack.example", []string{"2001:db8::10", "203.0.113.10"}},
+		{"masked.example", nil},
+		{"ula.example", nil},
+		{"unknown.example", nil},
+		{"2001:db8::10", []string{"2001:db8::10"}},
+		{"fe80::1", nil},
+	}
+	for _, tt := range tests {
+		addrs, err := publicAddrs(context.Background(), tt.host, resolver.lookup)
+		if tt.want == nil {
+			if !errors.Is(err, errPrivateAddress) {
+				t.Errorf("%s: addrs %v, err %v; want errPrivateAddress", tt.host, addrs, err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(addrs) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: addrs %v, err %v; want %v", tt.host, addrs, err, tt.want)
+		}
+	}
+
+	// servers.ping refuses the masked name.
+	h := newTestHandler(t)
+	h.lookupIP = resolver.lookup
+	resp := call(h, "servers.ping", map[string]string{"link": "vless://u@masked.example:443"})
+	if r, ok := resp.Result.(PingResult); !ok || r.ErrorKey != ErrKeyPingPrivateAddress {
+		t.Errorf("ping masked private address: result = %#v", resp.Result)
+	}
+}
+
+func TestOuterNetwork(t *testing.T) {
+	h := newTestHandler(t)
+	if n := h.outerNetwork(context.Background()); n != (vpn.OuterNetwork{}) {
+		t.Errorf("dual-stack: %+v", n)
+	}
+
+	h.routeFamily = func() (bool, bool, error) { return false, true, nil }
+	h.lookupIP = resolverTable{"ipv4only.arpa": {"64:ff9b::c000:aa"}}.lookup
+	n := h.outerNetwork(context.Background())
+	if !n.IPv6Only || n.NAT64.String() != "64:ff9b::/96" {
+		t.Errorf("IPv6-only with NAT64: %+v", n)
+	}
+	h.lookupIP = resolverTable{}.lookup
+	if n := h.outerNetwork(context.Background()); !n.IPv6Only || n.NAT64.IsValid() {
+		t.Errorf("IPv6-only without NAT64: %+v", n)
+	}
+
+	h.routeFamily = func() (bool, bool, error) { return false, false, errors.New("access denied") }
+	if n := h.outerNetwork(context.Background()); n.IPv6Only {
+		t.Errorf("unreadable routes: %+v", n)
+	}
+}
+
+func TestAllowedServerPorts(t *testing.T) {
+	h := newTestHandler(t)
+	if resp := call(h, "settings.set", map[string][]string{"allowedServerPorts": {"443", "8000-8999"}}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+
+	resp := call(h, "vpn.connect", map[string]string{"link": "vless://u@example.com:22"})
+	if resp.Error == nil || resp.Error.Key != ErrKeyServerPortBlocked {
+		t.Fatalf("vpn.connect to port 22 = %+v, want %s", resp.Error, ErrKeyServerPortBlocked)
+	}
+	if resp.Error.Data["port"] != uint16(22) {
+		t.Errorf("error data = %v", resp.Error.Data)
+	}
+	resp = call(h, "servers.ping", map[string]string{"link": "vless://u@example.com:9000"})
+	if r, ok := resp.Result.(PingResult); !ok || r.ErrorKey != ErrKeyServerPortBlocked {
+		t.Errorf("ping port 9000: result = %#v", resp.Result)
+	}
+	// Port hopping dials every port of server_ports, not just server_port.
+	hysteria2 := func(serverPorts ...string) map[string]interface{} {
+		return map[string]interface{}{
+			"outbound":          map[string]interface{}{"type": "hysteria2", "server": "example.com", "server_port": 443, "password": "p", "server_ports": serverPorts},
+			"strictEnvironment": true,
+		}
+	}
+	for _, ports := range [][]string{{"1-65535"}, {"1:65535"}, {"8000:8999", "9000"}} {
+		resp := call(h, "vpn.connectRaw", hysteria2(ports...))
+		if resp.Error == nil || resp.Error.Key != ErrKeyServerPortBlocked {
+			t.Errorf("vpn.connectRaw hopping over %v = %+v, want %s", ports, resp.Error, ErrKeyServerPortBlocked)
+		}
+	}
+
+	// Allowed ports get past the policy; the connect then fails on the
+	// environment check instead.
+	h.envScan = func() envscan.Report {
+		return envscan.Report{Findings: []envscan.Finding{{Kind: envscan.KindVPNAdapter, Product: "WireGuard", Detail: "up"}}}
+	}
+	for _, port := range []string{"443", "8000", "8999"} {
+		resp := call(h, "vpn.connect", map[string]interface{}{"link": "vless://u@example.com:" + port, "strictEnvironment": true})
+		if resp.Error == nil || resp.Error.Key != ErrKeyEnvironmentConflict {
+			t.Errorf("vpn.connect to port %s = %+v, want %s", port, resp.Error, ErrKeyEnvironmentConflict)
+		}
+	}
+	resp = call(h, "vpn.connectRaw", hysteria2("8000:8999", "443"))
+	if resp.Error == nil || resp.Error.Key != ErrKeyEnvironmentConflict {
+		t.Errorf("vpn.connectRaw hopping over allowed ports = %+v, want %s", resp.Error, ErrKeyEnvironmentConflict)
+	}
+}
+
+func TestAdminLock(t *testing.T) {
+	h := newTestHandler(t)
+	path := filepath.Join(t.TempDir(), settings.FileName)
+	st := settings.Open(path, nil)
+	h.settings = st
+	const token = "correct-horse-battery"
+
+	resp := call(h, "settings.adminLock", AdminLockParams{Token: token})
+	if r, ok := resp.Result.(settings.Settings); !ok || !r.AdminLocked {
+		t.Fatalf("settings.adminLock = %+v, %+v", resp.Result, resp.Error)
+	}
+
+	// The server policy needs the token; other settings do not.
+	resp = call(h, "settings.set", map[string][]string{"allowedServerPorts": {"1-65535"}})
+	if resp.Error == nil || resp.Error.Key != ErrKeySettingsLocked {
+		t.Errorf("settings.set without token = %+v, want %s", resp.Error, ErrKeySettingsLocked)
+	}
+	resp = call(h, "settings.set", map[string]interface{}{"allowedServerPorts": []string{"1-65535"}, "adminToken": "guess-guess-guess"})
+	if resp.Error == nil || resp.Error.Key != ErrKeySettingsLocked {
+		t.Errorf("settings.set with wrong token = %+v, want %s", resp.Error, ErrKeySettingsLocked)
+	}
+	if resp := call(h, "settings.set", map[string]interface{}{"powerMode": "low", "adminLocked": false}); resp.Error != nil {
+		t.Errorf("settings.set of another setting: %+v", resp.Error)
+	}
+	if !h.settings.Get().AdminLocked {
+		t.Error("a patch unlocked the settings")
+	}
+	resp = call(h, "settings.set", map[string]interface{}{"allowedServerPorts": []string{"443"}, "adminToken": token})
+	if resp.Error != nil {
+		t.Fatalf("settings.set with token: %+v", resp.Error)
+	}
+
+	// Relocking with another token and unlocking need the current token.
+	for _, method := range []string{"settings.adminLock", "settings.adminUnlock"} {
+		resp = call(h, method, AdminLockParams{Token: "another-long-token"})
+		if resp.Error == nil || resp.Error.Key != ErrKeySettingsLocked {
+			t.Errorf("%s with wrong token = %+v, want %s", method, resp.Error, ErrKeySettingsLocked)
+		}
+	}
+
+	// The lock survives a restart, without reaching settings.get.
+	reopened := settings.Open(path, nil)
+	if s := reopened.Get(); !s.AdminLocked || len(s.AllowedServerPorts) != 1 {
+		t.Errorf("reopened settings = %+v", s)
+	}
+	data, _ := json.Marshal(call(h, "settings.get", nil).Result)
+	if strings.Contains(string(data), "adminLockHash") {
+		t.Errorf("settings.get exposes the lock hash: %s", data)
+	}
+
+	resp = call(h, "settings.adminUnlock", AdminLockParams{Token: token})
+	if r, ok := resp.Result.(settings.Settings); !ok || r.AdminLocked {
+		t.Fatalf("settings.adminUnlock = %+v, %+v", resp.Result, resp.Error)
+	}
+	if resp := call(h, "settings.set", map[string][]string{"allowedServerPorts": {}}); resp.Error != nil {
+		t.Errorf("settings.set after unlock: %+v", resp.Error)
+	}
+}
+
+func TestStatusConnectedWithoutServer(t *testing.T) {
+	h := newTestHandler(t)
+	// State can reach connected before the engine has a server config.
+	h.stateMachine.SetState(vpn.StateConnected, nil)
+
+	resp := call(h, "vpn.status", nil)
+	if resp.Error != nil {
+		t.Fatalf("vpn.status error = %+v", resp.Error)
+	}
+	if r := resp.Result.(StatusResult); r.State != string(vpn.StateConnected) || r.ServerName != "" {
+		t.Errorf("vpn.status = %+v", r)
+	}
+}
+
+func TestHelloReportsInstance(t *testing.T) {
+	h := newTestHandler(t)
+	if r := call(h, "core.hello", nil).Result.(HelloResult); r.Instance != "" {
+		t.Errorf("default instance reported as %q", r.Instance)
+	}
+	dev, _ := instance.New("dev")
+	h.engine.SetInstance(dev)
+	if r := call(h, "core.hello", nil).Result.(HelloResult); r.Instance != "dev" {
+		t.Errorf("instance = %q, want dev", r.Instance)
+	}
+}
+
+func TestAttemptErrors(t *testing.T) {
+	running := vpn.Attempt{ID: 1, Kind: vpn.AttemptConnect, Origin: "user"}
+	refused := vpn.Attempt{ID: 2, Kind: vpn.AttemptConnect, Origin: "schedule"}
+	tests := []struct {
+		err     error
+		wantKey string
+	}{
+		{&vpn.AttemptError{Attempt: refused, Outcome: vpn.OutcomeRejected, Winner: running}, ErrKeyAttemptRejected},
+		{fmt.Errorf("connect: %w", &vpn.AttemptError{Attempt: running, Outcome: vpn.OutcomePreempted, Winner: refused}), ErrKeyAttemptPreempted},
+	}
+	for _, tt := range tests {
+		rpcErr := attemptError(tt.err)
+		if rpcErr == nil || rpcErr.Key != tt.wantKey {
+			t.Fatalf("%v: %+v, want %s", tt.err, rpcErr, tt.wantKey)
+		}
+		if _, ok := rpcErr.Data["winner"].(vpn.Attempt); !ok {
+			t.Errorf("%v: data %+v names no winner", tt.err, rpcErr.Data)
+		}
+	}
+	if rpcErr := attemptError(errors.New("server unreachable")); rpcErr != nil {
+		t.Errorf("plain failure = %+v", rpcErr)
+	}
+}
+
+func TestLANSharing(t *testing.T) {
+	h := newTestHandler(t)
+	h.lanAddress = func() (string, error) { return "", vpn.ErrNoLANAddress }
+	resp := call(h, "vpn.connect", map[string]interface{}{
+		"link": "hy2://p@example.com:443", "allowLan": true, "lanUsername": "u", "lanPassword": "p",
+	})
+	if resp.Error == nil || resp.Error.Key != ErrKeyLANNoAddress {
+		t.Errorf("connect without LAN address: error = %+v", resp.Error)
+	}
+
+	resp = call(h, "vpn.lanClients", nil)
+	if r, ok := resp.Result.(LANClientsResult); !ok || r.Enabled || r.Clients == nil {
+		t.Errorf("vpn.lanClients while disconnected = %#v", resp.Result)
+	}
+	if r := call(h, "vpn.status", nil).Result.(StatusResult); r.LAN != nil {
+		t.Errorf("vpn.status LAN = %+v while disconnected", r.LAN)
+	}
+}
+
+func TestDebugGetConfigShowsExceptions(t *testing.T) {
+	h := newTestHandler(t)
+	exceptions := []string{"vpnagent.exe", "10.0.0.53"}
+	if resp := call(h, "split.setConfig", map[string]interface{}{
+		"mode": "off", "dnsHijackExceptions": exceptions,
+	}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+
+	resp := call(h, "debug.getConfig", nil)
+	r, ok := resp.Result.(DebugConfigResult)
+	if !ok || len(r.SplitTunnel.DNSHijackExceptions) != 2 || r.Active != nil {
+		t.Errorf("debug.getConfig = %#v", resp.Result)
+	}
+}
+
+func TestExplainUsesStoredSplitConfig(t *testing.T) {
+	h := newTestHandler(t)
+	call(h, "split.setConfig", map[string]interface{}{"mode": "app", "apps": []string{"chrome.exe"}})
+
+	resp := call(h, "vpn.explain", map[string]string{"link": "vless://u@example.com:443"})
+	e, ok := resp.Result.(*vpn.Explanation)
+	if !ok {
+		t.Fatalf("vpn.explain = %#v, %+v", resp.Result, resp.Error)
+	}
+	if e.DefaultRoute != vpn.RouteDirect || len(e.Rules) != 2 {
+		t.Errorf("explanation = %+v, want stored app split applied", e)
+	}
+	if h.stateMachine.State() != vpn.StateDisconnected {
+		t.Errorf("vpn.explain changed state to %s", h.stateMachine.State())
+	}
+}
+
+// TestMergeSplitConfig covers how connect params override the stored split
+// tunnel config. Params are JSON so omitted and empty lists differ as they
+// do on the wire.
+func TestMergeSplitConfig(t *testing.T) {
+	appSplit := &SplitTunnelConfig{Mode: "app", Apps: []string{"chrome.exe"}, Domains: []string{"example.org"}, Invert: true,
+		DNSHijackExceptions: []string{"game.exe"}}
+	off := &SplitTunnelConfig{Mode: "off"}
+	editing := &SplitTunnelConfig{Mode: "app", Apps: []string{}}
+
+	tests := []struct {
+		name    string
+		stored  *SplitTunnelConfig
+		params  string
+		want    SplitTunnelConfig
+		wantKey string
+	}{
+		{"nothing given keeps stored", appSplit, `{}`, *appSplit, ""},
+		{"mode only keeps stored lists", appSplit, `{"splitTunnelMode":"domain"}`,
+			SplitTunnelConfig{Mode: "domain", Apps: []string{"chrome.exe"}, Domains: []string{"example.org"}, Invert: true, DNSHijackExceptions: []string{"game.exe"}}, ""},
+		{"apps only keep stored mode", appSplit, `{"splitTunnelApps":["code.exe"]}`,
+			SplitTunnelConfig{Mode: "app", Apps: []string{"code.exe"}, Domains: []string{"example.org"}, Invert: true, DNSHijackExceptions: []string{"game.exe"}}, ""},
+		{"invert false overrides", appSplit, `{"splitTunnelInvert":false}`,
+			SplitTunnelConfig{Mode: "app", Apps: []string{"chrome.exe"}, Domains: []string{"example.org"}, DNSHijackExceptions: []string{"game.exe"}}, ""},
+		{"dns exceptions override", appSplit, `{"dnsHijackExceptions":[]}`,
+			SplitTunnelConfig{Mode: "app", Apps: []string{"chrome.exe"}, Domains: []string{"example.org"}, Invert: true, DNSHijackExceptions: []string{}}, ""},
+		{"everything given", off, `{"splitTunnelMode":"app","splitTunnelApps":["a.exe"],"splitTunnelInvert":true}`,
+			SplitTunnelConfig{Mode: "app", Apps: []string{"a.exe"}, Invert: true}, ""},
+		{"off needs no list", appSplit, `{"splitTunnelMode":"off","splitTunnelApps":[]}`,
+			SplitTunnelConfig{Mode: "off", Apps: []string{}, Domains: []string{"example.org"}, Invert: true, DNSHijackExceptions: []string{"game.exe"}}, ""},
+		{"app mode with empty apps", appSplit, `{"splitTunnelMode":"app","splitTunnelApps":[]}`, SplitTunnelConfig{}, ErrKeySplitEmptyList},
+		{"empty apps under stored app mode", appSplit, `{"splitTunnelApps":[]}`, SplitTunnelConfig{}, ErrKeySplitEmptyList},
+		{"app mode with none stored", off, `{"splitTunnelMode":"app"}`, SplitTunnelConfig{}, ErrKeySplitEmptyList},
+		{"domain mode with empty domains", appSplit, `{"splitTunnelMode":"domain","splitTunnelDomains":[]}`, SplitTunnelConfig{}, ErrKeySplitEmptyList},
+		{"empty apps do not matter for domain mode", appSplit, `{"splitTunnelMode":"domain","splitTunnelApps":[]}`,
+			SplitTunnelConfig{Mode: "domain", Apps: []string{}, Domains: []string{"example.org"}, Invert: true, DNSHijackExceptions: []string{"game.exe"}}, ""},
+		{"stored config mid-edit untouched", editing, `{}`, *editing, ""},
+		{"invalid mode", appSplit, `{"splitTunnelMode":"everything"}`, SplitTunnelConfig{}, ErrKeySplitInvalidMode},
+		{"invalid dns exception", appSplit, `{"dnsHijackExceptions":["a?b"]}`, SplitTunnelConfig{}, ErrKeyDNSExceptionInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params ConnectParams
+			if err := json.Unmarshal([]byte(tt.params), &params); err != nil {
+				t.Fatal(err)
+			}
+			got, rpcErr := mergeSplitConfig(&params, tt.stored)
+			if tt.wantKey != "" {
+				if rpcErr == nil || rpcErr.Key != tt.wantKey || rpcErr.Code != ErrCodeInvalidParams {
+					t.Fatalf("error = %+v, want %s", rpcErr, tt.wantKey)
+				}
+				return
+			}
+			if rpcErr != nil {
+				t.Fatal(rpcErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	_, rpcErr := mergeSplitConfig(&ConnectParams{SplitTunnelMode: "app", SplitTunnelApps: []string{}}, off)
+	if rpcErr.Message != "mode 'app' requires at least one app or use the saved configuration" {
+		t.Errorf("message = %q", rpcErr.Message)
+	}
+}
+
+func TestBuiltinBypassesSetting(t *testing.T) {
+	h := newTestHandler(t)
+	resp := call(h, "settings.set", map[string]interface{}{"builtinBypasses": []string{"windowsUpdate", "printers"}})
+	if resp.Error == nil || resp.Error.Key != ErrKeySettingsInvalid {
+		t.Fatalf("unknown bypass: error = %+v", resp.Error)
+	}
+
+	resp = call(h, "settings.set", map[string]interface{}{"builtinBypasses": []string{"windowsUpdate"}})
+	if r, ok := resp.Result.(SettingsSetResult); !ok || len(r.BuiltinBypasses) != 1 || len(r.PendingReconnect) != 0 {
+		t.Fatalf("settings.set = %#v, %+v", resp.Result, resp.Error)
+	}
+	resp = call(h, "vpn.explain", map[string]string{"link": "vless://u@example.com:443"})
+	e := resp.Result.(*vpn.Explanation)
+	if last := e.Rules[len(e.Rules)-1]; last.Match != "Windows Update traffic (built-in bypass)" || last.Route != vpn.RouteDirect {
+		t.Errorf("last rule = %+v", last)
+	}
+
+	call(h, "settings.set", map[string]interface{}{"builtinBypasses": []string{}})
+	resp = call(h, "vpn.explain", map[string]string{"link": "vless://u@example.com:443"})
+	if e := resp.Result.(*vpn.Explanation); len(e.Rules) != 1 {
+		t.Errorf("rules after disabling = %+v", e.Rules)
+	}
+}
+
+func TestSplitCapabilities(t *testing.T) {
+	h := newTestHandler(t)
+	resp := call(h, "split.capabilities", nil)
+	r, ok := resp.Result.(SplitCapabilitiesResult)
+	if !ok || r.ConnectionMode != vpn.ConnectionTUN || r.SniffMode != vpn.SniffFull || len(r.Modes) != 3 {
+		t.Fatalf("split.capabilities = %#v, %+v", resp.Result, resp.Error)
+	}
+	for _, m := range r.Modes {
+		if !m.Supported || m.Limited {
+			t.Errorf("default session: %+v", m)
+		}
+	}
+
+	resp = call(h, "split.capabilities", SplitCapabilitiesParams{ConnectionMode: vpn.ConnectionProxy})
+	for _, m := range resp.Result.(SplitCapabilitiesResult).Modes {
+		if m.Mode == "app" && (m.Supported || m.Reason == "") {
+			t.Errorf("proxy mode: %+v", m)
+		}
+	}
+	resp = call(h, "split.capabilities", SplitCapabilitiesParams{SniffMode: vpn.SniffOff})
+	if d := resp.Result.(SplitCapabilitiesResult).Modes[2]; d.Mode != "domain" || !d.Limited {
+		t.Errorf("sniff off: %+v", d)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	h := newTestHandler(t)
+	links := []string{
+		"vless://u@example.com:443?security=tls#Main",
+		"nope",
+		"vless://u@example.com:443?fp=chrome&security=tls#Copy",
+		"hy2://p@example.com:443",
+	}
+	resp := call(h, "servers.deduplicate", DeduplicateParams{Links: links})
+	r, ok := resp.Result.(DeduplicateResult)
+	if !ok {
+		t.Fatalf("servers.deduplicate = %#v, %+v", resp.Result, resp.Error)
+	}
+	if len(r.Groups) != 1 || len(r.Groups[0].Members) != 2 || r.Groups[0].CanonicalLink != links[2] {
+		t.Errorf("groups = %+v", r.Groups)
+	}
+	if len(r.Invalid) != 1 || r.Invalid[0].Index != 1 || r.Invalid[0].ErrorKey != ErrKeyLinkParseFailed {
+		t.Errorf("invalid = %+v", r.Invalid)
+	}
+}
+
+func TestPerformanceByLink(t *testing.T) {
+	h := newTestHandler(t)
+	server, err := parser.ParseLink("vless://u@example.com:443#A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.performance.Record(server, profiles.ConnectSample{At: time.Now(), TotalMs: 250})
+
+	link := "vless://u@example.com:443?fp=chrome#B"
+	resp := call(h, "servers.performance", PerformanceParams{Links: []string{link, "hy2://p@other.com:443", "nope"}})
+	r, ok := resp.Result.(PerformanceResult)
+	if !ok {
+		t.Fatalf("servers.performance = %#v, %+v", resp.Result, resp.Error)
+	}
+	if len(r.Servers) != 1 || r.Servers[0].Link != link || r.Servers[0].AvgTotalMs != 250 {
+		t.Errorf("servers = %+v", r.Servers)
+	}
+
+	resp = call(h, "servers.performance", nil)
+	if r := resp.Result.(PerformanceResult); len(r.Servers) != 1 || r.Servers[0].Link != "" {
+		t.Errorf("all servers = %+v", r.Servers)
+	}
+}
+
+func TestConnectStrictEnvironment(t *testing.T) {
+	h := newTestHandler(t)
+	h.envScan = func() envscan.Report {
+		return envscan.Report{Findings: []envscan.Finding{{Kind: envscan.KindVPNAdapter, Product: "WireGuard", Detail: "up"}}}
+	}
+
+	resp := call(h, "vpn.connect", map[string]interface{}{"link": "vless://u@example.com:443", "strictEnvironment": true})
+	if resp.Error == nil || resp.Error.Key != ErrKeyEnvironmentConflict {
+		t.Fatalf("vpn.connect = %+v, want %s", resp.Error, ErrKeyEnvironmentConflict)
+	}
+	if findings, _ := resp.Error.Data["findings"].([]envscan.Finding); len(findings) != 1 {
+		t.Errorf("error data = %v", resp.Error.Data)
+	}
+	if h.stateMachine.State() != vpn.StateDisconnected {
+		t.Errorf("state = %s after refused connect", h.stateMachine.State())
+	}
+
+	resp = call(h, "diagnostics.environment", nil)
+	if r, ok := resp.Result.(envscan.Report); !ok || len(r.Findings) != 1 {
+		t.Errorf("diagnostics.environment = %#v", resp.Result)
+	}
+}
+
+func TestConnectTunConflicts(t *testing.T) {
+	h := newTestHandler(t)
+	clash := envscan.Finding{Kind: envscan.KindProxyTool, Product: "Clash Verge", Process: "clash-verge.exe", PID: 41, TunStack: true, Detail: "running"}
+	h.envScan = func() envscan.Report {
+		return envscan.Report{Findings: []envscan.Finding{{Kind: envscan.KindSystemProxy, Detail: "proxy"}, clash}}
+	}
+
+	resp := call(h, "diagnostics.conflicts", nil)
+	if r, ok := resp.Result.(envscan.Report); !ok || len(r.Findings) != 1 || r.Findings[0] != clash {
+		t.Errorf("diagnostics.conflicts = %#v", resp.Result)
+	}
+
+	link := "vless://" + vpn.SimulationUUID + "@sim.example:443?security=none&sim_delay=10ms"
+	resp = call(h, "vpn.connect", map[string]interface{}{"link": link, "strictEnvironment": true})
+	if resp.Error == nil || resp.Error.Key != ErrKeyEnvironmentConflict || !strings.Contains(resp.Error.Message, "Clash Verge") {
+		t.Fatalf("strict vpn.connect = %+v, want %s naming the tool", resp.Error, ErrKeyEnvironmentConflict)
+	}
+
+	// Without strict mode the conflict is a warning only.
+	resp = call(h, "vpn.connect", map[string]interface{}{"link": link})
+	r, ok := resp.Result.(ConnectResult)
+	if !ok {
+		t.Fatalf("vpn.connect = %+v", resp.Error)
+	}
+	if len(r.Warnings) != 2 || r.Warnings[1] != clash {
+		t.Errorf("warnings = %+v", r.Warnings)
+	}
+}
+
+func TestDNSEnvironment(t *testing.T) {
+	h := newTestHandler(t)
+	var checked [][]string
+	h.envScan = func() envscan.Report { return envscan.Report{Findings: []envscan.Finding{}} }
+	h.dnsCheck = func(hosts ...string) dnsenv.Report {
+		checked = append(checked, hosts)
+		return dnsenv.Report{Findings: []dnsenv.Finding{
+			{Key: dnsenv.KeyHostsBlocklist, Severity: dnsenv.SeverityInfo, Detail: "blocklist"},
+			{Key: dnsenv.KeyLANResolver, Severity: dnsenv.SeverityWarning, Address: "192.168.1.53", Detail: "pi-hole"},
+		}}
+	}
+
+	resp := call(h, "diagnostics.dnsEnvironment", nil)
+	if r, ok := resp.Result.(dnsenv.Report); !ok || len(r.Findings) != 2 {
+		t.Errorf("diagnostics.dnsEnvironment = %#v", resp.Result)
+	}
+
+	// The connect preflight watches the server's name and never refuses,
+	// even in strict mode.
+	resp = call(h, "vpn.connect", map[string]interface{}{"link": "vless://u@vpn.example.com:443", "strictEnvironment": true})
+	if resp.Error != nil && resp.Error.Key == ErrKeyEnvironmentConflict {
+		t.Fatalf("vpn.connect refused over DNS findings: %+v", resp.Error)
+	}
+	if len(checked) != 2 || !reflect.DeepEqual(checked[1], []string{"vpn.example.com"}) {
+		t.Errorf("checked hosts %q", checked)
+	}
+	if r, ok := resp.Result.(ConnectResult); ok {
+		if len(r.DNSWarnings) != 1 || r.DNSWarnings[0].Key != dnsenv.KeyLANResolver {
+			t.Errorf("dnsWarnings = %+v, want the warning only", r.DNSWarnings)
+		}
+	}
+}
+
+func TestParseText(t *testing.T) {
+	h := newTestHandler(t)
+	text := "Today's servers:\n🇩🇪 vless://u@de.example.com:443#DE\n🇫🇮 [fast](hy2://p@fi.example.com:443#FI).\nold one: vmess://abc"
+	resp := call(h, "servers.parseText", ParseTextParams{Text: text})
+	r, ok := resp.Result.(ParseTextResult)
+	if !ok {
+		t.Fatalf("servers.parseText = %#v, %+v", resp.Result, resp.Error)
+	}
+	if len(r.Servers) != 2 || r.Servers[0].Server.Name != "DE" || r.Servers[1].Link != "hy2://p@fi.example.com:443#FI" {
+		t.Errorf("servers = %+v", r.Servers)
+	}
+	if r.Unparseable != 1 || r.Failures[0].Link != "vmess://abc" || r.Failures[0].ErrorKey != ErrKeyLinkParseFailed {
+		t.Errorf("failures = %d %+v", r.Unparseable, r.Failures)
+	}
+
+	resp = call(h, "servers.parseText", ParseTextParams{Text: strings.Repeat("x", maxParseTextBytes+1)})
+	if resp.Error == nil || resp.Error.Data["max"] != maxParseTextBytes {
+		t.Errorf("oversized text: %+v", resp.Error)
+	}
+}
+
+func TestParseTextNameMetadata(t *testing.T) {
+	h := newTestHandler(t)
+	text := "vless://u@us.example.com:443#%5BUS%5D%20New%20York%201%20x2\n" +
+		"vless://u@us.example.com:443?fp=chrome#%F0%9F%87%BA%F0%9F%87%B8%20backup\n" +
+		"hy2://p@jp.example.com:443#%E6%97%A5%E6%9C%AC%20%E4%B8%9C%E4%BA%AC"
+	parse := func() []ParsedLink {
+		t.Helper()
+		resp := call(h, "servers.parseText", ParseTextParams{Text: text})
+		r, ok := resp.Result.(ParseTextResult)
+		if !ok || len(r.Servers) != 3 {
+			t.Fatalf("servers.parseText = %#v, %+v", resp.Result, resp.Error)
+		}
+		return r.Servers
+	}
+
+	servers := parse()
+	us := servers[0]
+	if us.Server.Name != "[US] New York 1 x2" || us.Country != "US" || us.Group != "US" || us.Multiplier != 2 {
+		t.Errorf("first = %+v %+v", us.Server, us.NameInfo)
+	}
+	// Same server, other fingerprint: same key, told apart by a suffix.
+	if key := parser.CanonicalKey(us.Server); us.ID != key || servers[1].ID != key+"-2" {
+		t.Errorf("ids = %q, %q; key %q", us.ID, servers[1].ID, key)
+	}
+	if jp := servers[2]; jp.Country != "JP" || jp.Group != "" {
+		t.Errorf("third = %+v", jp.NameInfo)
+	}
+	if again := parse(); again[0].ID != us.ID || again[2].ID != servers[2].ID {
+		t.Error("ids changed between imports")
+	}
+
+	// Group rules come from the settings.
+	if resp := call(h, "settings.set", map[string]interface{}{
+		"serverGroupRules": []parser.GroupRule{{Regex: "東京|东京", Label: "Tokyo"}},
+	}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if servers := parse(); servers[0].Group != "" || servers[2].Group != "Tokyo" {
+		t.Errorf("groups = %q, %q", servers[0].Group, servers[2].Group)
+	}
+	if resp := call(h, "settings.set", map[string]interface{}{
+		"serverGroupRules": []parser.GroupRule{{Regex: "("}},
+	}); resp.Error == nil || resp.Error.Key != ErrKeySettingsInvalid {
+		t.Errorf("invalid rule = %+v", resp.Error)
+	}
+}
+
+// qrPNG renders each text as a QR code, side by side in one PNG.
+func qrPNG(t *testing.T, texts ...string) []byte {
+	t.Helper()
+	const size = 300
+	img := image.NewGray(image.Rect(0, 0, size*len(texts), size))
+	for i, text := range texts {
+		m, err := qrcode.NewQRCodeWriter().Encode(text, gozxing.BarcodeFormat_QR_CODE, size, size, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		draw.Draw(img, image.Rect(i*size, 0, (i+1)*size, size), m, image.Point{}, draw.Src)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeQR(t *testing.T) {
+	h := newTestHandler(t)
+	params := DecodeQRParams{Image: qrPNG(t, "vless://u@de.example.com:443#DE", "ss://YWVzLTI1Ni1nY206cGFzcw@ss.example.com:8388#FR")}
+	resp := call(h, "servers.decodeQr", params)
+	r, ok := resp.Result.(DecodeQRResult)
+	if !ok {
+		t.Fatalf("servers.decodeQr = %#v, %+v", resp.Result, resp.Error)
+	}
+	if r.Codes != 2 || len(r.Servers) != 1 || r.Servers[0].Server.Name != "DE" || r.Servers[0].Country != "DE" {
+		t.Errorf("codes %d, servers %+v", r.Codes, r.Servers)
+	}
+	// ss:// is recognized but not supported.
+	if r.Unparseable != 1 || !strings.HasPrefix(r.Failures[0].Link, "ss://") || r.Failures[0].ErrorKey != ErrKeyLinkParseFailed {
+		t.Errorf("failures = %d %+v", r.Unparseable, r.Failures)
+	}
+
+	// A QR code without a link is counted but yields nothing.
+	resp = call(h, "servers.decodeQr", DecodeQRParams{Image: qrPNG(t, "WIFI:S:Cafe;T:WPA;P:secret;;")})
+	if r, ok := resp.Result.(DecodeQRResult); !ok || r.Codes != 1 || len(r.Servers) != 0 || len(r.Failures) != 0 {
+		t.Errorf("non-link code = %#v, %+v", resp.Result, resp.Error)
+	}
+
+	// The largest image fits in a request once base64-encoded.
+	raw, _ := json.Marshal(DecodeQRParams{Image: make([]byte, qrscan.MaxImageBytes)})
+	data, _ := json.Marshal(Request{ID: "1", Method: "servers.decodeQr", Params: raw})
+	if len(data) > maxMessageSize {
+		t.Errorf("a %d byte image needs a %d byte request, over %d", qrscan.MaxImageBytes, len(data), maxMessageSize)
+	}
+}
+
+func TestSplitStaleEntries(t *testing.T) {
+	h := newTestHandler(t)
+	h.installedApps = func(context.Context, int) ([]splittunnel.AppInfo, error) {
+		return []splittunnel.AppInfo{{ExeName: "chrome.exe", InstallPath: `C:\Chrome`}, {ExeName: "game.exe", InstallPath: `D:\New`}}, nil
+	}
+	h.runningApps = func() ([]splittunnel.RunningApp, error) { return nil, nil }
+	notifier := &recordingNotifier{}
+	h.SetNotifier(notifier)
+
+	call(h, "split.setConfig", map[string]interface{}{
+		"mode": "app", "apps": []string{"chrome.exe", "game.exe", "gone.exe"},
+		"appPaths": map[string]string{"game.exe": `D:\Old\game.exe`},
+	})
+	if resp := call(h, "apps.list", nil); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if len(notifier.sent) != 1 || notifier.topics[0] != TopicApps ||
+		len(notifier.sent[0].Params.(StaleEntriesParams).Entries) != 2 {
+		t.Fatalf("notifications = %+v", notifier.sent)
+	}
+
+	// Only flagged entries can be pruned.
+	resp := call(h, "split.pruneStale", PruneStaleParams{ExeNames: []string{"gone.exe", "chrome.exe"}})
+	r, ok := resp.Result.(PruneStaleResult)
+	if !ok || !reflect.DeepEqual(r.Removed, []string{"gone.exe"}) {
+		t.Fatalf("split.pruneStale = %#v, %+v", resp.Result, resp.Error)
+	}
+	if !reflect.DeepEqual(r.Config.Apps, []string{"chrome.exe", "game.exe"}) || r.Config.AppPaths["game.exe"] == "" {
+		t.Errorf("config = %+v", r.Config)
+	}
+
+	resp = call(h, "split.pruneStale", nil)
+	if r := resp.Result.(PruneStaleResult); !reflect.DeepEqual(r.Removed, []string{"game.exe"}) || len(r.Config.Apps) != 1 {
+		t.Errorf("prune all = %+v", r)
+	}
+}
+
+func TestAppsExportIcons(t *testing.T) {
+	h := newTestHandler(t)
+	var sizes []int
+	h.installedApps = func(_ context.Context, iconSize int) ([]splittunnel.AppInfo, error) {
+		sizes = append(sizes, iconSize)
+		return []splittunnel.AppInfo{
+			{ExeName: "chrome.exe", Icon: base64.StdEncoding.EncodeToString([]byte("png"))},
+			{ExeName: "plain.exe"},
+		}, nil
+	}
+
+	resp := call(h, "apps.exportIcons", AppsExportIconsParams{IconSize: 64})
+	r, ok := resp.Result.(AppsExportIconsResult)
+	if !ok || len(r.Icons) != 1 || r.Icons[0].ExeName != "chrome.exe" || r.ExpiresAt == 0 {
+		t.Fatalf("apps.exportIcons = %#v, %+v", resp.Result, resp.Error)
+	}
+	if data, err := os.ReadFile(filepath.Join(r.Dir, r.Icons[0].File)); err != nil || string(data) != "png" {
+		t.Errorf("icon file = %q, %v", data, err)
+	}
+	if !reflect.DeepEqual(sizes, []int{64}) {
+		t.Errorf("icon sizes = %v", sizes)
+	}
+	if resp := call(h, "apps.exportIcons", AppsExportIconsParams{IconSize: 48}); resp.Error == nil || resp.Error.Key != ErrKeyInvalidParams {
+		t.Errorf("48 px icons: error = %+v", resp.Error)
+	}
+}
+
+func TestAppsDomainActivity(t *testing.T) {
+	h := newTestHandler(t)
+	resp := call(h, "apps.domainActivity", AppsDomainActivityParams{ExeName: "chrome.exe"})
+	if r, ok := resp.Result.(AppsDomainActivityResult); !ok || r.QueryLog || r.Domains == nil || len(r.Domains) != 0 {
+		t.Fatalf("query log off: %#v, %+v", resp.Result, resp.Error)
+	}
+
+	if resp := call(h, "settings.set", map[string]bool{"dnsQueryLog": true}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if !h.engine.DNSQueryLog() {
+		t.Error("settings.set did not turn the query log on")
+	}
+	resp = call(h, "apps.domainActivity", AppsDomainActivityParams{ExeName: "chrome.exe", SinceMinutes: 60})
+	if r, ok := resp.Result.(AppsDomainActivityResult); !ok || !r.QueryLog {
+		t.Errorf("query log on: %#v, %+v", resp.Result, resp.Error)
+	}
+
+	for _, params := range []AppsDomainActivityParams{{}, {ExeName: " "}, {ExeName: "chrome.exe", SinceMinutes: 61}, {ExeName: "chrome.exe", SinceMinutes: -1}} {
+		if resp := call(h, "apps.domainActivity", params); resp.Error == nil || resp.Error.Key != ErrKeyInvalidParams {
+			t.Errorf("%+v: error = %+v", params, resp.Error)
+		}
+	}
+}
+
+func TestAppsListDiff(t *testing.T) {
+	h := newTestHandler(t)
+	apps := make([]splittunnel.AppInfo, 300)
+	for i := range apps {
+		apps[i] = splittunnel.AppInfo{
+			Name:    fmt.Sprintf("App %d", i),
+			ExeName: fmt.Sprintf("app%d.exe", i),
+			Icon:    base64.StdEncoding.EncodeToString(make([]byte, 1500)),
+		}
+	}
+	var sizes []int
+	h.installedApps = func(_ context.Context, iconSize int) ([]splittunnel.AppInfo, error) {
+		sizes = append(sizes, iconSize)
+		return apps, nil
+	}
+
+	resp := call(h, "apps.listDiff", nil)
+	first, ok := resp.Result.(AppListDiff)
+	if !ok || !first.Full || len(first.Apps) != len(apps) {
+		t.Fatalf("first apps.listDiff = %+v", resp.Error)
+	}
+
+	// Reopening the picker with nothing installed or removed transfers
+	// the version and empty lists.
+	resp = call(h, "apps.listDiff", map[string]uint64{"sinceVersion": first.Version})
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := resp.Result.(AppListDiff); r.Full || r.Version != first.Version || len(data) >= 1024 {
+		t.Errorf("unchanged reopen: %s (%d bytes)", data, len(data))
+	}
+
+	apps = append(apps[:0:0], apps[1:]...)
+	resp = call(h, "apps.listDiff", map[string]uint64{"sinceVersion": first.Version})
+	if r, _ := resp.Result.(AppListDiff); r.Full || len(r.Removed) != 1 || r.Version == first.Version {
+		t.Errorf("after an uninstall: %+v", r)
+	}
+
+	// Icon options work as for apps.list; the list without icons has its
+	// own versions.
+	resp = call(h, "apps.listDiff", map[string]interface{}{"sinceVersion": first.Version, "icons": false})
+	if r, _ := resp.Result.(AppListDiff); !r.Full {
+		t.Errorf("list without icons diffed against one with: %+v", r.Version)
+	}
+	if !reflect.DeepEqual(sizes, []int{32, 32, 32, 0}) {
+		t.Errorf("icon sizes = %v", sizes)
+	}
+	if resp := call(h, "apps.listDiff", map[string]int{"iconSize": 48}); resp.Error == nil || resp.Error.Key != ErrKeyInvalidParams {
+		t.Errorf("48 px icons: error = %+v", resp.Error)
+	}
+}
+
+func TestPowerMode(t *testing.T) {
+	h := newTestHandler(t)
+	var icons []int
+	h.installedApps = func(_ context.Context, iconSize int) ([]splittunnel.AppInfo, error) {
+		icons = append(icons, iconSize)
+		return nil, nil
+	}
+
+	resp := call(h, "settings.set", map[string]string{"powerMode": "low"})
+	r, ok := resp.Result.(SettingsSetResult)
+	if !ok || r.PowerMode != "low" || len(r.PendingReconnect) != 0 {
+		t.Fatalf("settings.set = %#v, %+v", resp.Result, resp.Error)
+	}
+	if h.engine.PowerMode() != vpn.PowerLow {
+		t.Errorf("engine power mode = %q", h.engine.PowerMode())
+	}
+
+	call(h, "apps.list", nil)
+	call(h, "apps.list", AppsListParams{Icons: &[]bool{true}[0]})
+	call(h, "apps.list", AppsListParams{Icons: &[]bool{true}[0], IconSize: 64})
+	if !reflect.DeepEqual(icons, []int{0, 32, 64}) {
+		t.Errorf("icon sizes = %v, want off by default in low power mode", icons)
+	}
+	if resp := call(h, "apps.list", AppsListParams{IconSize: 256}); resp.Error == nil || resp.Error.Key != ErrKeyInvalidParams {
+		t.Errorf("apps.list with 256 px icons: error = %+v", resp.Error)
+	}
+
+	resp = call(h, "debug.rpcStats", nil)
+	if s := resp.Result.(RPCStatsResult); s.PowerMode != vpn.PowerLow || s.Process == nil || s.Goroutines == 0 || s.StatsPoller.Active != 0 {
+		t.Errorf("debug.rpcStats = %+v", s)
+	}
+}
+
+func TestDestructiveConfirmation(t *testing.T) {
+	h := newTestHandler(t)
+	h.stateMachine.SetState(vpn.StateConnected, nil)
+	h.activity = func() vpn.Activity {
+		return vpn.Activity{ProxyConnections: 3, DownSpeed: 2 << 20, UpSpeed: 1 << 10}
+	}
+
+	for _, method := range []string{"vpn.disconnect", "service.shutdown"} {
+		resp := call(h, method, nil)
+		if resp.Error == nil || resp.Error.Code != ErrCodeConfirmationRequired || resp.Error.Key != ErrKeyConfirmRequired {
+			t.Fatalf("%s = %+v, want confirmation required", method, resp.Error)
+		}
+		if d := resp.Error.Data; d["activeConnections"] != 3 || d["downSpeed"] != int64(2<<20) || d["upSpeed"] != int64(1<<10) {
+			t.Errorf("%s error data = %v", method, d)
+		}
+	}
+
+	resp := call(h, "vpn.disconnect", DestructiveParams{Force: true, Reason: "bedtime"})
+	if resp.Error == nil || resp.Error.Key != ErrKeyInvalidParams {
+		t.Errorf("unknown reason = %+v, want %s", resp.Error, ErrKeyInvalidParams)
+	}
+
+	resp = call(h, "vpn.disconnect", DestructiveParams{Force: true, Reason: vpn.ReasonSchedule})
+	if resp.Error != nil {
+		t.Errorf("forced vpn.disconnect = %+v", resp.Error)
+	}
+
+	// Idle connections and slow transfers don't need confirmation.
+	h.activity = func() vpn.Activity { return vpn.Activity{ProxyConnections: 5, DownSpeed: 100} }
+	if resp := call(h, "vpn.disconnect", nil); resp.Error != nil {
+		t.Errorf("vpn.disconnect while idle = %+v", resp.Error)
+	}
+}
+
+func TestCacheFileSetting(t *testing.T) {
+	h := newTestHandler(t)
+	server := &parser.ServerConfig{Protocol: "vless", Address: "example.com", Port: 443, Params: map[string]string{"uuid": "u"}}
+
+	cfg, rpcErr := h.configFor(&ConnectParams{}, server)
+	if rpcErr != nil || cfg.CacheFile != h.cacheFile {
+		t.Errorf("default: cache file = %q, %+v", cfg.CacheFile, rpcErr)
+	}
+
+	if resp := call(h, "settings.set", map[string]bool{"persistCache": false}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if cfg, _ := h.configFor(&ConnectParams{}, server); cfg.CacheFile != "" {
+		t.Errorf("persistCache off: cache file = %q", cfg.CacheFile)
+	}
+}
+
+func TestConnectRateLimit(t *testing.T) {
+	h := newTestHandler(t)
+	server := &parser.ServerConfig{Protocol: "vless", Address: "example.com", Port: 443, Params: map[string]string{"uuid": "u"}}
+
+	if cfg, _ := h.configFor(&ConnectParams{}, server); !cfg.RateLimit.IsZero() {
+		t.Errorf("default: %+v, want unlimited", cfg.RateLimit)
+	}
+	if resp := call(h, "settings.set", map[string]int{"maxDownMbps": 10, "maxUpMbps": 2}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if cfg, _ := h.configFor(&ConnectParams{}, server); cfg.RateLimit != (vpn.RateLimit{MaxDownMbps: 10, MaxUpMbps: 2}) {
+		t.Errorf("from settings: %+v", cfg.RateLimit)
+	}
+	// A connect's own limit wins per direction, zero lifting it.
+	zero, five := 0, 5
+	cfg, rpcErr := h.configFor(&ConnectParams{MaxDownMbps: &zero, MaxUpMbps: &five}, server)
+	if rpcErr != nil || cfg.RateLimit != (vpn.RateLimit{MaxUpMbps: 5}) {
+		t.Errorf("from params: %+v, %+v", cfg.RateLimit, rpcErr)
+	}
+}
+
+func TestConnectWaitForNetwork(t *testing.T) {
+	h := newTestHandler(t)
+	network := &fakeNetwork{level: netready.LevelInternetAccess}
+	h.network = netready.NewGate(network)
+	link := "vless://u@example.com:443?security=tls#A"
+
+	call(h, "vpn.connect", ConnectParams{Link: link})
+	if n := network.reads.Load(); n != 0 {
+		t.Errorf("plain connect read the network %d times, want it not to wait", n)
+	}
+	call(h, "vpn.disconnect", DestructiveParams{Force: true})
+
+	call(h, "vpn.connect", ConnectParams{Link: link, WaitForNetwork: true})
+	if n := network.reads.Load(); n != 1 {
+		t.Errorf("waitForNetwork read the network %d times, want 1", n)
+	}
+	call(h, "vpn.disconnect", DestructiveParams{Force: true})
+
+	// Not connected: nothing to reconnect, so nothing to wait for.
+	if resp := call(h, "vpn.reconnect", nil); resp.Error == nil || resp.Error.Key != ErrKeyNotConnected {
+		t.Fatalf("reconnect = %+v, want %s", resp.Error, ErrKeyNotConnected)
+	}
+	if n := network.reads.Load(); n != 1 {
+		t.Errorf("reconnect while disconnected read the network, %d reads", n)
+	}
+	// A reconnect always waits for the network before dropping the link.
+	h.stateMachine.SetState(vpn.StateConnected, nil)
+	call(h, "vpn.reconnect", nil)
+	if n := network.reads.Load(); n != 2 {
+		t.Errorf("reconnect read the network %d times in all, want 2", n)
+	}
+}
+
+func TestClearCache(t *testing.T) {
+	h := newTestHandler(t)
+	os.WriteFile(h.cacheFile, []byte("db"), 0o644)
+
+	h.stateMachine.SetState(vpn.StateConnected, nil)
+	resp := call(h, "maintenance.clearCache", nil)
+	if resp.Error == nil || resp.Error.Code != ErrCodeConfirmationRequired || resp.Error.Key != ErrKeyCacheInUse {
+		t.Fatalf("connected = %+v, want confirmation required", resp.Error)
+	}
+	if _, err := os.Stat(h.cacheFile); err != nil {
+		t.Fatal("cache file deleted while connected")
+	}
+
+	// Disconnecting first still asks before interrupting transfers.
+	h.activity = func() vpn.Activity { return vpn.Activity{ProxyConnections: 2, DownSpeed: 1 << 20} }
+	resp = call(h, "maintenance.clearCache", ClearCacheParams{Disconnect: true})
+	if resp.Error == nil || resp.Error.Key != ErrKeyConfirmRequired {
+		t.Fatalf("busy = %+v, want %s", resp.Error, ErrKeyConfirmRequired)
+	}
+
+	resp = call(h, "maintenance.clearCache", ClearCacheParams{DestructiveParams: DestructiveParams{Force: true}, Disconnect: true})
+	if r, ok := resp.Result.(ClearCacheResult); !ok || !r.Removed || !r.Disconnected {
+		t.Fatalf("forced = %#v, %+v", resp.Result, resp.Error)
+	}
+	if _, err := os.Stat(h.cacheFile); !os.IsNotExist(err) {
+		t.Error("cache file not deleted")
+	}
+
+	h.stateMachine.SetState(vpn.StateConnecting, nil)
+	if resp := call(h, "maintenance.clearCache", ClearCacheParams{Disconnect: true}); resp.Error == nil || resp.Error.Key != ErrKeyCacheInUse {
+		t.Errorf("connecting = %+v, want %s", resp.Error, ErrKeyCacheInUse)
+	}
+}
+
+func TestTransportStatsDisconnected(t *testing.T) {
+	h := newTestHandler(t)
+	resp := call(h, "stats.transport", nil)
+	if r, ok := resp.Result.(TransportStatsResult); !ok || r.Available {
+		t.Errorf("stats.transport = %#v, %+v", resp.Result, resp.Error)
+	}
+}
+
+func TestNewStateChangedParams(t *testing.T) {
+	at := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	p := NewStateChangedParams(vpn.Transition{ID: 4, State: vpn.StateConnected, Previous: vpn.StateConnecting, At: at, ConnectedAt: at})
+	if p.TransitionID != 4 || p.PreviousState != "connecting" || p.Timestamp != at.UnixMilli() || p.ConnectedAt != at.UnixMilli() || p.DurationMs != nil {
+		t.Errorf("connected params = %+v", p)
+	}
+
+	p = NewStateChangedParams(vpn.Transition{ID: 5, State: vpn.StateDisconnected, Previous: vpn.StateDisconnecting,
+		At: at, Duration: 90 * time.Second, Reason: vpn.ReasonIdle})
+	if p.DurationMs == nil || *p.DurationMs != 90000 || p.ConnectedAt != 0 || p.Reason != vpn.ReasonIdle {
+		t.Errorf("disconnected params = %+v", p)
+	}
+}
+
+func TestPendingChanges(t *testing.T) {
+	h := newTestHandler(t)
+	split := SplitTunnelConfig{Mode: "domain", Domains: []string{"example.org"}}
+
+	// Disconnected, changes are for the next connect anyway.
+	call(h, "split.setConfig", split)
+	if resp := call(h, "settings.set", map[string]interface{}{"builtinBypasses": []string{"windowsUpdate"}}); len(resp.Result.(SettingsSetResult).PendingReconnect) != 0 {
+		t.Errorf("disconnected settings.set = %+v", resp.Result)
+	}
+
+	if resp := call(h, "vpn.connect", ConnectParams{Link: "vless://u@example.com:443?security=tls#A"}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	defer call(h, "vpn.disconnect", DestructiveParams{Force: true})
+	if r := call(h, "vpn.status", nil).Result.(StatusResult); r.PendingChanges != nil {
+		t.Errorf("fresh session pending %v", r.PendingChanges)
+	}
+
+	// Storing the same split config changes nothing.
+	call(h, "split.setConfig", split)
+	split.Domains = append(split.Domains, "example.net")
+	call(h, "split.setConfig", split)
+	resp := call(h, "settings.set", map[string]interface{}{"builtinBypasses": []string{}})
+	if r := resp.Result.(SettingsSetResult); !reflect.DeepEqual(r.PendingReconnect, []string{vpn.ChangeBuiltinBypasses}) {
+		t.Errorf("settings.set pending %v", r.PendingReconnect)
+	}
+	// The query log needs process lookup, which this session lacks.
+	resp = call(h, "settings.set", map[string]interface{}{"dnsQueryLog": true})
+	if r := resp.Result.(SettingsSetResult); !reflect.DeepEqual(r.PendingReconnect, []string{vpn.ChangeBuiltinBypasses, vpn.ChangeDNSQueryLog}) {
+		t.Errorf("settings.set dnsQueryLog pending %v", r.PendingReconnect)
+	}
+	want := []string{vpn.ChangeSplitTunnel, vpn.ChangeBuiltinBypasses, vpn.ChangeDNSQueryLog}
+	if r := call(h, "vpn.status", nil).Result.(StatusResult); !reflect.DeepEqual(r.PendingChanges, want) {
+		t.Errorf("status pending %v, want %v", r.PendingChanges, want)
+	}
+}
+
+func TestLastRun(t *testing.T) {
+	h := newTestHandler(t)
+	if r := call(h, "diagnostics.lastRun", nil).Result.(LastRunResult); r.Previous != nil {
+		t.Errorf("no previous run: %+v", r.Previous)
+	}
+
+	crashed := time.Date(2026, 3, 1, 14, 32, 0, 0, time.UTC)
+	h.SetLastRun(&lastrun.Summary{
+		StartedAt: crashed.Add(-time.Hour),
+		EndedAt:   crashed,
+		EndReason: lastrun.EndAbrupt,
+		State:     string(vpn.StateConnected),
+		Server:    "DE Frankfurt",
+	})
+	r := call(h, "diagnostics.lastRun", nil).Result.(LastRunResult)
+	want := LastRun{StartedAt: crashed.Add(-time.Hour).Unix(), EndedAt: crashed.Unix(), EndReason: "abrupt", State: "connected", Server: "DE Frankfurt"}
+	if r.Previous == nil || *r.Previous != want {
+		t.Errorf("previous = %+v, want %+v", r.Previous, want)
+	}
+}
+
+func TestStartWithDamagedDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	guardPath := filepath.Join(dir, datafile.GuardFileName)
+	guard, _ := datafile.OpenGuard(guardPath)
+	// The service saved subscriptions, which were then edited by hand.
+	subsPath := filepath.Join(dir, profiles.SubscriptionsFileName)
+	if err := guard.WriteFile(subsPath, []byte(`[{"id": "s1", "url": "https://sub.example.com/a"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(subsPath, []byte(`[{"id": "s1", "url": "https://evil.example.com/a"}]`), 0o644)
+	// Files from before the guard, with values out of bounds.
+	hugeList := make([]string, 5000)
+	for i := range hugeList {
+		hugeList[i] = "*.example.com"
+	}
+	settingsFile, _ := json.Marshal(map[string]interface{}{
+		"powerMode":             "low",
+		"healthIntervalMinutes": -5,
+		"degradedRttMs":         "fast",
+		"systemProxyBypass":     hugeList,
+	})
+	os.WriteFile(filepath.Join(dir, settings.FileName), settingsFile, 0o644)
+	os.WriteFile(filepath.Join(dir, profiles.FileName), []byte(`[
+		{"id": "p1", "name": "DE", "link": "vless://u@de.example.com:443"},
+		{"id": "p2", "name": "Broken", "link": "vless://"},
+		{"id": "p1", "name": "Twice", "link": "vless://u@fi.example.com:443"}
+	]`), 0o644)
+
+	guard, issues := datafile.OpenGuard(guardPath)
+	st := settings.Open(filepath.Join(dir, settings.FileName), guard)
+	ps := profiles.Open(filepath.Join(dir, profiles.FileName), guard)
+	issues = append(append(issues, st.LoadIssues()...), ps.LoadIssues()...)
+	h := newTestHandler(t)
+	h.settings, h.profiles = st, ps
+	h.SetLoadIssues(issues)
+
+	r := call(h, "diagnostics.lastRun", nil).Result.(LastRunResult)
+	var got []string
+	for _, issue := range r.LoadIssues {
+		got = append(got, issue.File+":"+issue.Kind+":"+issue.Field)
+	}
+	want := []string{
+		"settings.json:invalid_field:degradedRttMs",
+		"settings.json:invalid_field:healthIntervalMinutes",
+		"settings.json:invalid_field:systemProxyBypass",
+		"subscriptions.json:tampered:",
+		"profiles.json:invalid_field:[2]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("load issues = %q, want %q", got, want)
+	}
+
+	// The service works with what was kept and the defaults.
+	s := call(h, "settings.get", nil).Result.(settings.Settings)
+	if s.PowerMode != "low" || s.HealthIntervalMinutes != settings.Defaults().HealthIntervalMinutes || len(s.SystemProxyBypass) != 0 {
+		t.Errorf("settings = %+v", s)
+	}
+	// A link that no longer parses keeps its profile, marked invalid.
+	if list := call(h, "profiles.list", nil).Result.([]profiles.Profile); len(list) != 2 || list[0].Name != "DE" || list[0].Invalid != "" || list[1].Name != "Broken" || list[1].Invalid == "" {
+		t.Errorf("profiles = %+v", list)
+	}
+	if subs := ps.Subscriptions(); len(subs) != 0 {
+		t.Errorf("subscriptions = %+v", subs)
+	}
+	if _, err := os.Stat(subsPath + datafile.QuarantineSuffix); err != nil {
+		t.Errorf("tampered subscriptions not quarantined: %v", err)
+	}
+
+	// Saves are guarded, and the next start finds nothing wrong.
+	if resp := call(h, "settings.set", map[string]int{"healthIntervalMinutes": 30}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if resp := call(h, "profiles.save", map[string]string{"link": "hy2://p@fi.example.com:443#FI"}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if resp := call(h, "profiles.save", map[string]string{"id": "p2", "link": "vless://u@nl.example.com:443"}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if p, _ := h.profiles.Get("p2"); p.Invalid != "" {
+		t.Errorf("fixed profile = %+v", p)
+	}
+	guard, issues = datafile.OpenGuard(guardPath)
+	issues = append(append(issues, settings.Open(filepath.Join(dir, settings.FileName), guard).LoadIssues()...),
+		profiles.Open(filepath.Join(dir, profiles.FileName), guard).LoadIssues()...)
+	if len(issues) != 0 {
+		t.Errorf("issues after saving = %+v", issues)
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	h := newTestHandler(t)
+	path := filepath.Join(t.TempDir(), settings.FileName)
+	st := settings.Open(path, nil)
+	h.settings = st
+	var probed []string
+	h.probeProxy = func(ctx context.Context, p vpn.UpstreamProxy, target string) error {
+		probed = append(probed, p.Username+":"+p.Password+"@"+p.Addr()+" -> "+target)
+		if p.Password != "s3cret" {
+			return &vpn.UpstreamProxyError{Stage: vpn.UpstreamStageAuth, Err: errors.New("proxy answered 407")}
+		}
+		return nil
+	}
+
+	resp := call(h, "settings.set", map[string]interface{}{"upstreamProxy": map[string]interface{}{
+		"type": "http", "host": "proxy.corp.example", "port": 3128, "username": "alice", "password": "s3cret",
+	}})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	// The password is write-only and kept encrypted.
+	data, _ := json.Marshal(call(h, "settings.get", nil).Result)
+	file, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "s3cret") || !strings.Contains(string(data), `"passwordSet":true`) {
+		t.Errorf("settings.get = %s", data)
+	}
+	if strings.Contains(string(file), "s3cret") {
+		t.Errorf("settings file holds the password in the clear: %s", file)
+	}
+	// Another change keeps the password; it survives a restart.
+	if resp := call(h, "settings.set", map[string]interface{}{"upstreamProxy": map[string]interface{}{"port": 8080}}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	reopened := settings.Open(path, nil)
+	if p := reopened.UpstreamProxy(); p == nil || p.Password != "s3cret" || p.Port != 8080 {
+		t.Errorf("reopened upstream proxy = %+v", p)
+	}
+
+	resp = call(h, "vpn.connect", ConnectParams{Link: "vless://u@example.com:443?security=tls#A"})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	call(h, "vpn.disconnect", DestructiveParams{Force: true})
+	if want := []string{"alice:s3cret@proxy.corp.example:8080 -> example.com:443"}; !reflect.DeepEqual(probed, want) {
+		t.Errorf("probed %v, want %v", probed, want)
+	}
+
+	// Hysteria2 cannot go through the proxy.
+	resp = call(h, "vpn.connect", ConnectParams{Link: "hy2://p@example.com:443"})
+	if resp.Error == nil || resp.Error.Key != ErrKeyUpstreamConflict {
+		t.Errorf("hysteria2 connect = %+v, want %s", resp.Error, ErrKeyUpstreamConflict)
+	}
+
+	call(h, "settings.set", map[string]interface{}{"upstreamProxy": map[string]interface{}{"password": "wrong"}})
+	resp = call(h, "vpn.connect", ConnectParams{Link: "vless://u@example.com:443?security=tls#A"})
+	if resp.Error == nil || resp.Error.Key != ErrKeyUpstreamFailed || resp.Error.Data["stage"] != vpn.UpstreamStageAuth {
+		t.Errorf("connect with a wrong password = %+v, want %s", resp.Error, ErrKeyUpstreamFailed)
+	}
+
+	// A password without a username is refused; null removes the proxy.
+	resp = call(h, "settings.set", map[string]interface{}{"upstreamProxy": map[string]interface{}{"username": "", "password": "s3cret"}})
+	if resp.Error == nil || resp.Error.Key != ErrKeySettingsInvalid {
+		t.Errorf("password without username = %+v", resp.Error)
+	}
+	call(h, "settings.set", map[string]interface{}{"upstreamProxy": nil})
+	if h.settings.UpstreamProxy() != nil {
+		t.Error("upstream proxy not removed")
+	}
+}
+
+func TestStatsHistory(t *testing.T) {
+	h := newTestHandler(t)
+	if r := call(h, "stats.getHistory", nil).Result.(StatsHistoryResult); len(r.Days) != 0 {
+		t.Errorf("without a history: %+v", r.Days)
+	}
+
+	history, err := usage.Open(filepath.Join(t.TempDir(), usage.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history.Record(vpn.Traffic{Upload: 5, Download: 100, DirectDownload: 7})
+	h.SetUsageHistory(history)
+	now := time.Now()
+	r := call(h, "stats.getHistory", StatsHistoryParams{Days: 7}).Result.(StatsHistoryResult)
+	if len(r.Days) != 1 {
+		t.Fatalf("days %+v", r.Days)
+	}
+	d := r.Days[0]
+	_, offset := now.Zone()
+	if d.Date != now.Format(usage.DateLayout) || d.Start > now.Unix() || d.End <= now.Unix() || d.UTCOffset != offset {
+		t.Errorf("day %+v at %v", d, now)
+	}
+	if d.Upload != 5 || d.Download != 100 || d.DirectDownload != 7 {
+		t.Errorf("traffic %+v", d)
+	}
+
+	if resp := call(h, "stats.getHistory", StatsHistoryParams{Days: -1}); resp.Error == nil || resp.Error.Key != ErrKeyInvalidParams {
+		t.Errorf("negative days = %+v", resp.Error)
+	}
+}
+
+func TestSimulatedConnect(t *testing.T) {
+	h := newTestHandler(t)
+	inst, err := instance.New("simipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.engine.SetInstance(inst)
+	t.Cleanup(func() { h.engine.Disconnect() })
+	const link = "vless://" + vpn.SimulationUUID + "@sim.example:443?security=none&sim_delay=10ms"
+
+	if resp := call(h, "settings.set", map[string]bool{"simulation": true}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	resp := call(h, "vpn.connect", map[string]string{"link": link + "&sim_fail=driver"})
+	if resp.Error == nil || resp.Error.Key != ErrKeyTunDriverMissing {
+		t.Errorf("scripted driver failure = %+v, want %s", resp.Error, ErrKeyTunDriverMissing)
+	}
+	resp = call(h, "vpn.connect", map[string]string{"link": link + "&sim_fail=soon"})
+	if resp.Error == nil || resp.Error.Key != ErrKeyServerInvalid {
+		t.Errorf("bad simulation params = %+v, want %s", resp.Error, ErrKeyServerInvalid)
+	}
+	// A transport the core lacks fails the connect instead of bringing up
+	// a tunnel that passes no traffic.
+	resp = call(h, "vpn.connect", map[string]string{"link": link + "&type=xhttp&path=%2Fxh&mode=packet-up"})
+	if resp.Error == nil || resp.Error.Key != ErrKeyCoreUnsupported || resp.Error.Data["feature"] != "xhttp" {
+		t.Errorf("xhttp connect = %+v, want %s", resp.Error, ErrKeyCoreUnsupported)
+	}
+
+	// A config over a lowered limit is refused naming the limit; a raised
+	// one is allowed with a warning.
+	if resp := call(h, "settings.set", map[string]int{"maxConfigOutbounds": 1}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	resp = call(h, "vpn.connect", map[string]string{"link": link})
+	if resp.Error == nil || resp.Error.Key != ErrKeyConfigTooComplex || resp.Error.Data["limit"] != vpn.LimitOutbounds || resp.Error.Data["over"] == nil {
+		t.Errorf("connect over the outbound limit = %+v, want %s", resp.Error, ErrKeyConfigTooComplex)
+	}
+	resp = call(h, "settings.set", map[string]int{"maxConfigOutbounds": 0, "maxConfigRules": 5000})
+	if set, _ := resp.Result.(SettingsSetResult); resp.Error != nil || len(set.Warnings) != 1 {
+		t.Errorf("raising a limit = %+v, want a warning", resp)
+	}
+	if resp := call(h, "settings.set", map[string]int{"maxConfigKb": 1 << 20}); resp.Error == nil || resp.Error.Key != ErrKeySettingsInvalid {
+		t.Errorf("limit over its ceiling = %+v", resp.Error)
+	}
+
+	if resp := call(h, "vpn.connect", map[string]string{"link": link}); resp.Error != nil {
+		t.Fatalf("simulated connect: %+v", resp.Error)
+	}
+	if state := h.stateMachine.State(); state != vpn.StateConnected {
+		t.Errorf("state %s, want connected", state)
+	}
+	resp = call(h, "profiles.exportLink", ExportLinkParams{Confirm: true})
+	if exported, _ := resp.Result.(ExportLinkResult); resp.Error != nil || exported.Link != "vless://"+vpn.SimulationUUID+"@sim.example:443?sim_delay=10ms" {
+		t.Errorf("export of the session = %+v", resp)
+	}
+
+	// The performance report reads the session's figures.
+	h.cpuUsage = func(context.Context) (float64, error) { return 97, nil }
+	meter := perfreport.NewMeter(time.Minute)
+	meter.Record(time.Now(), 1000, 8000)
+	h.SetThroughputMeter(meter)
+	resp = call(h, "diagnostics.performanceReport", nil)
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	report, _ := resp.Result.(perfreport.Report)
+	if report.Transport.Protocol != "vless" || report.Transport.Security != "none" || report.Transport.TransportPolicy != vpn.TransportAuto ||
+		report.Throughput.DownBps != 8000 || report.CPUPercent == nil || report.Findings[0].Key != perfreport.KeyCPUSaturated {
+		t.Errorf("report = %+v", report)
+	}
+
+	if resp := call(h, "vpn.disconnect", nil); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+}
@@ -0,0 +1,22 @@
+package ipc
+
+import "context"
+
+// ClientIdentity is the process on the other end of a client connection,
+// resolved when it connects. Fields that could not be resolved are empty.
+type ClientIdentity struct {
+	PID      uint32
+	Image    string // full path of the executable
+	SID      string // the process's user
+	Elevated bool   // runs with an administrator's full token
+}
+
+// requestIdentity returns the identity of the client that sent the request
+// served by ctx, or nil outside a client connection or if it could not be
+// resolved.
+func requestIdentity(ctx context.Context) *ClientIdentity {
+	if c := requestClient(ctx); c != nil {
+		return c.identity
+	}
+	return nil
+}
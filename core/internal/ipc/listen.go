@@ -0,0 +1,41 @@
+package ipc
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// listenBackoff are the delays between attempts to create the pipe. Right
+// after boot creating it has been seen to fail for a few seconds on some
+// machines, so a failure is retried for about half a minute before the
+// service gives up.
+var listenBackoff = []time.Duration{
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	4 * time.Second,
+	8 * time.Second,
+	16 * time.Second,
+}
+
+// listenWithRetry calls listen until it succeeds, sleeping the delays of
+// backoff in turn between attempts, and returns the last error once they
+// run out.
+func listenWithRetry(listen func() (net.Listener, error), backoff []time.Duration, sleep func(time.Duration)) (net.Listener, error) {
+	for attempt := 0; ; attempt++ {
+		l, err := listen()
+		if err == nil {
+			if attempt > 0 {
+				log.Printf("IPC pipe created after %d retries", attempt)
+			}
+			return l, nil
+		}
+		if attempt == len(backoff) {
+			return nil, err
+		}
+		log.Printf("failed to create IPC pipe, retrying in %v: %v", backoff[attempt], err)
+		sleep(backoff[attempt])
+	}
+}
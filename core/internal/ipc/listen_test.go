@@ -0,0 +1,48 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListenWithRetry(t *testing.T) {
+	backoff := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}
+	errPipe := errors.New("pipe busy")
+
+	t.Run("succeeds after failures", func(t *testing.T) {
+		var slept []time.Duration
+		calls := 0
+		want := &net.TCPListener{}
+		l, err := listenWithRetry(func() (net.Listener, error) {
+			calls++
+			if calls < 3 {
+				return nil, errPipe
+			}
+			return want, nil
+		}, backoff, func(d time.Duration) { slept = append(slept, d) })
+		if err != nil || l != want {
+			t.Fatalf("got %v, %v", l, err)
+		}
+		if !reflect.DeepEqual(slept, backoff[:2]) {
+			t.Errorf("slept %v, want %v", slept, backoff[:2])
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		var slept []time.Duration
+		calls := 0
+		_, err := listenWithRetry(func() (net.Listener, error) {
+			calls++
+			return nil, errPipe
+		}, backoff, func(d time.Duration) { slept = append(slept, d) })
+		if !errors.Is(err, errPipe) {
+			t.Errorf("err = %v, want %v", err, errPipe)
+		}
+		if calls != len(backoff)+1 || !reflect.DeepEqual(slept, backoff) {
+			t.Errorf("%d calls, slept %v; want %d calls, slept %v", calls, slept, len(backoff)+1, backoff)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSlowCallThreshold is how long a single call may take before it
+	// is logged as slow.
+	defaultSlowCallThreshold = 2 * time.Second
+	// latencySamples is how many recent latencies are kept per method for
+	// percentile estimates.
+	latencySamples = 128
+)
+
+// MethodStats summarizes calls to one RPC method since the service started.
+type MethodStats struct {
+	Method string  `json:"method"`
+	Count  int64   `json:"count"`
+	Errors int64   `json:"errors"`
+	P50Ms  float64 `json:"p50Ms"` // over the most recent calls
+	P95Ms  float64 `json:"p95Ms"`
+	MaxMs  float64 `json:"maxMs"` // all-time
+}
+
+// methodMetrics holds the raw counters behind MethodStats.
+type methodMetrics struct {
+	count   int64
+	errors  int64
+	max     time.Duration
+	recent  [latencySamples]time.Duration // ring buffer
+	next    int
+	samples int
+}
+
+// rpcMetrics records per-method call counts and latencies in memory.
+type rpcMetrics struct {
+	mu            sync.Mutex
+	methods       map[string]*methodMetrics
+	slowThreshold time.Duration
+
+	now func() time.Time
+}
+
+func newRPCMetrics() *rpcMetrics {
+	return &rpcMetrics{
+		methods:       make(map[string]*methodMetrics),
+		slowThreshold: defaultSlowCallThreshold,
+		now:           time.Now,
+	}
+}
+
+// middleware records the duration and outcome of every call. Params are
+// never logged: they may carry server credentials.
+func (m *rpcMetrics) middleware(next methodFunc) methodFunc {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, *RPCError) {
+		start := m.now()
+		result, rpcErr := next(ctx, params)
+		m.record(methodName(ctx), m.now().Sub(start), rpcErr != nil)
+		return result, rpcErr
+	}
+}
+
+func (m *rpcMetrics) record(method string, elapsed time.Duration, failed bool) {
+	m.mu.Lock()
+	mm, ok := m.methods[method]
+	if !ok {
+		mm = &methodMetrics{}
+		m.methods[method] = mm
+	}
+	mm.count++
+	if failed {
+		mm.errors++
+	}
+	if elapsed > mm.max {
+		mm.max = elapsed
+	}
+	mm.recent[mm.next] = elapsed
+	mm.next = (mm.next + 1) % latencySamples
+	if mm.samples < latencySamples {
+		mm.samples++
+	}
+	threshold := m.slowThreshold
+	m.mu.Unlock()
+
+	if threshold > 0 && elapsed > threshold {
+		log.Printf("warning: slow RPC %s took %s", method, elapsed.Round(time.Millisecond))
+	}
+}
+
+// snapshot returns stats for every method called so far, sorted by name.
+func (m *rpcMetrics) snapshot() []MethodStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]MethodStats, 0, len(m.methods))
+	for method, mm := range m.methods {
+		recent := append([]time.Duration(nil), mm.recent[:mm.samples]...)
+		sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+		out = append(out, MethodStats{
+			Method: method,
+			Count:  mm.count,
+			Errors: mm.errors,
+			P50Ms:  durationMs(percentile(recent, 50)),
+			P95Ms:  durationMs(percentile(recent, 95)),
+			MaxMs:  durationMs(mm.max),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Method < out[j].Method })
+	return out
+}
+
+// percentile returns the nearest-rank percentile p of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,86 @@
+package ipc
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// steppingClock advances by the next queued step on every reading.
+type steppingClock struct {
+	t     time.Time
+	steps []time.Duration
+}
+
+func (c *steppingClock) now() time.Time {
+	if len(c.steps) > 0 {
+		c.t = c.t.Add(c.steps[0])
+		c.steps = c.steps[1:]
+	}
+	return c.t
+}
+
+func TestRPCMetricsCounters(t *testing.T) {
+	h := newTestHandler(t)
+	clock := &steppingClock{t: time.Unix(0, 0)}
+	h.metrics.now = clock.now
+
+	// Each call reads the clock twice: start (no step) and end (duration).
+	for _, d := range []time.Duration{10, 20, 30, 40} {
+		clock.steps = append(clock.steps, 0, d*time.Millisecond)
+		call(h, "settings.get", nil)
+	}
+	clock.steps = append(clock.steps, 0, 5*time.Millisecond)
+	call(h, "profiles.delete", map[string]string{"id": "missing"})
+	call(h, "vpn.bogus", nil)
+
+	stats := h.RPCStats()
+	if len(stats) != 2 {
+		t.Fatalf("stats = %+v, want settings.get and profiles.delete only", stats)
+	}
+	del, get := stats[0], stats[1]
+	if get.Method != "settings.get" || get.Count != 4 || get.Errors != 0 {
+		t.Errorf("settings.get = %+v", get)
+	}
+	if get.P50Ms != 20 || get.P95Ms != 40 || get.MaxMs != 40 {
+		t.Errorf("settings.get latencies = %+v, want p50 20 p95 40 max 40", get)
+	}
+	if del.Method != "profiles.delete" || del.Count != 1 || del.Errors != 1 {
+		t.Errorf("profiles.delete = %+v", del)
+	}
+
+	resp := call(h, "debug.rpcStats", nil)
+	if r, ok := resp.Result.(RPCStatsResult); !ok || len(r.Methods) != 2 {
+		t.Errorf("debug.rpcStats = %#v", resp.Result)
+	}
+}
+
+func TestRPCMetricsSlowCallLogged(t *testing.T) {
+	var buf bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(orig)
+
+	h := newTestHandler(t)
+	clock := &steppingClock{t: time.Unix(0, 0)}
+	h.metrics.now = clock.now
+	h.SetSlowCallThreshold(time.Second)
+
+	clock.steps = []time.Duration{0, 500 * time.Millisecond}
+	call(h, "settings.set", map[string]bool{"healthMonitor": true})
+	if buf.Len() != 0 {
+		t.Fatalf("fast call logged: %q", buf.String())
+	}
+
+	clock.steps = []time.Duration{0, 3 * time.Second}
+	call(h, "settings.set", map[string]bool{"healthMonitor": true})
+	out := buf.String()
+	if !strings.Contains(out, "slow RPC settings.set took 3s") {
+		t.Errorf("slow call log = %q", out)
+	}
+	if strings.Contains(out, "healthMonitor") {
+		t.Errorf("slow call log leaked params: %q", out)
+	}
+}
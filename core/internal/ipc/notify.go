@@ -0,0 +1,255 @@
+package ipc
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Notification topics clients subscribe to with core.subscribe.
+const (
+	TopicState    = "state"    // vpn.stateChanged, vpn.healthChanged
+	TopicStats    = "stats"    // vpn.statsUpdate
+	TopicLogs     = "logs"     // debug.connMatched
+	TopicApps     = "apps"     // split.staleEntries
+	TopicAlerts   = "alerts"   // warnings that need the user's attention
+	TopicSchedule = "schedule" // scheduler.fired
+	TopicProfiles = "profiles" // subscriptions.updated, subscriptions.quotaWarning
+)
+
+// defaultTopics are what a client receives until it subscribes otherwise,
+// matching what clients that predate subscriptions rely on.
+var defaultTopics = []string{TopicState, TopicStats}
+
+func validTopic(topic string) bool {
+	switch topic {
+	case TopicState, TopicStats, TopicLogs, TopicApps, TopicAlerts, TopicSchedule, TopicProfiles:
+		return true
+	}
+	return false
+}
+
+// Notifier delivers notifications to the clients subscribed to a topic.
+type Notifier interface {
+	Broadcast(topic string, notification *Notification)
+}
+
+// subscription is the set of topics one client receives.
+type subscription struct {
+	mu     sync.Mutex
+	topics map[string]bool
+}
+
+func newSubscription() *subscription {
+	s := &subscription{topics: make(map[string]bool)}
+	for _, topic := range defaultTopics {
+		s.topics[topic] = true
+	}
+	return s
+}
+
+func (s *subscription) has(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.topics[topic]
+}
+
+// update adds or removes topics and returns the resulting set, sorted.
+func (s *subscription) update(topics []string, subscribe bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, topic := range topics {
+		if subscribe {
+			s.topics[topic] = true
+		} else {
+			delete(s.topics, topic)
+		}
+	}
+	out := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		out = append(out, topic)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// maxQueuedNotifications bounds the notifications waiting for one client.
+// When a slow client falls this far behind, its oldest ones are dropped.
+const maxQueuedNotifications = 64
+
+// Notifications the queue coalesces instead of queueing every one.
+const (
+	methodStatsUpdate  = "vpn.statsUpdate"
+	methodStateChanged = "vpn.stateChanged"
+)
+
+// NotificationStats counts notifications a client never received because
+// it fell behind.
+type NotificationStats struct {
+	Coalesced int64 `json:"coalesced"` // replaced by a newer stats update or equal to the previous state
+	Dropped   int64 `json:"dropped"`   // pushed out of a full queue
+}
+
+// notifyCounters are the service-wide totals behind NotificationStats.
+type notifyCounters struct {
+	coalesced atomic.Int64
+	dropped   atomic.Int64
+}
+
+func (c *notifyCounters) snapshot() NotificationStats {
+	return NotificationStats{Coalesced: c.coalesced.Load(), Dropped: c.dropped.Load()}
+}
+
+// client is a connected client. Responses and queued notifications are
+// written under writeMu so they never interleave.
+type client struct {
+	queue    *notifyQueue
+	sub      *subscription
+	requests *requestCache   // recent requests; see suppressDuplicates
+	gzip     atomic.Bool     // negotiated in core.hello; see Envelope
+	identity *ClientIdentity // set by serve; nil if unresolved
+	writeMu  sync.Mutex
+}
+
+func newClient(counters *notifyCounters) *client {
+	return &client{queue: newNotifyQueue(counters), sub: newSubscription(), requests: newRequestCache()}
+}
+
+// deliver queues a marshaled notification if the client subscribes to
+// topic.
+func (c *client) deliver(topic, method string, data []byte) {
+	if c.sub.has(topic) {
+		c.queue.push(method, data)
+	}
+}
+
+type queuedNotification struct {
+	method string
+	data   []byte // marshaled, newline terminated
+}
+
+// notifyQueue holds the notifications pending for one client, so a slow
+// reader never blocks Broadcast or the other clients. Only the newest stats
+// update is kept, in the position of the first one still pending, and a
+// state change equal to the previous one apart from its transition
+// metadata is dropped; everything else queues in order up to
+// maxQueuedNotifications.
+type notifyQueue struct {
+	mu        sync.Mutex
+	pending   []queuedNotification
+	lastState string // stateKey of the most recent state change accepted
+	closed    bool
+	ready     chan struct{} // signaled when pending becomes non-empty
+	counters  *notifyCounters
+}
+
+func newNotifyQueue(counters *notifyCounters) *notifyQueue {
+	return &notifyQueue{ready: make(chan struct{}, 1), counters: counters}
+}
+
+// push queues a marshaled notification.
+func (q *notifyQueue) push(method string, data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+
+	switch method {
+	case methodStatsUpdate:
+		for i := range q.pending {
+			if q.pending[i].method == methodStatsUpdate {
+				q.pending[i].data = data
+				q.counters.coalesced.Add(1)
+				return
+			}
+		}
+	case methodStateChanged:
+		if stateKey(data) == q.lastState {
+			q.counters.coalesced.Add(1)
+			return
+		}
+	}
+
+	if len(q.pending) >= maxQueuedNotifications {
+		// A dropped state change the client never saw must not suppress
+		// an equal one later.
+		if oldest := q.pending[0]; oldest.method == methodStateChanged && stateKey(oldest.data) == q.lastState {
+			q.lastState = ""
+		}
+		q.pending = append(q.pending[:0], q.pending[1:]...)
+		q.counters.dropped.Add(1)
+	}
+	if method == methodStateChanged {
+		q.lastState = stateKey(data)
+	}
+	q.pending = append(q.pending, queuedNotification{method: method, data: data})
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// stateKey identifies what a marshaled vpn.stateChanged reports, leaving
+// out the transition metadata that makes every notification unique. It is
+// never empty.
+func stateKey(data []byte) string {
+	var n struct {
+		Params StateChangedParams `json:"params"`
+	}
+	if err := json.Unmarshal(data, &n); err != nil {
+		return "\x00" + string(data)
+	}
+	p := n.Params
+	return strings.Join([]string{p.State, p.Error, p.ServerName, p.Reason}, "\x00")
+}
+
+// take removes and returns the pending notifications, blocking until there
+// are some. It returns nil once the queue is closed.
+func (q *notifyQueue) take() []queuedNotification {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil
+		}
+		if len(q.pending) > 0 {
+			batch := q.pending
+			q.pending = nil
+			q.mu.Unlock()
+			return batch
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// close stops the queue and wakes a blocked take.
+func (q *notifyQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.pending = nil
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run sends queued notifications with write until the queue is closed or
+// a write fails.
+func (q *notifyQueue) run(write func(data []byte) error) error {
+	for {
+		batch := q.take()
+		if batch == nil {
+			return nil
+		}
+		for _, n := range batch {
+			if err := write(n.data); err != nil {
+				return err
+			}
+		}
+	}
+}
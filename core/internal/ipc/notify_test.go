@@ -0,0 +1,214 @@
+package ipc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func notification(t *testing.T, method string, params interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(&Notification{Method: method, Params: params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, '\n')
+}
+
+func pendingMethods(q *notifyQueue) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var methods []string
+	for _, n := range q.pending {
+		methods = append(methods, n.method)
+	}
+	return strings.Join(methods, ",")
+}
+
+func TestNotifyQueueCoalescing(t *testing.T) {
+	var counters notifyCounters
+	q := newNotifyQueue(&counters)
+
+	q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: "connecting"}))
+	q.push(methodStatsUpdate, notification(t, methodStatsUpdate, StatsUpdateParams{Upload: 1}))
+	q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: "connecting"}))
+	q.push("split.staleEntries", notification(t, "split.staleEntries", nil))
+	q.push(methodStatsUpdate, notification(t, methodStatsUpdate, StatsUpdateParams{Upload: 2}))
+	q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: "connected"}))
+
+	// The newest stats update takes the place of the first; the repeated
+	// state is dropped.
+	if got, want := pendingMethods(q), "vpn.stateChanged,vpn.statsUpdate,split.staleEntries,vpn.stateChanged"; got != want {
+		t.Fatalf("pending = %s, want %s", got, want)
+	}
+	batch := q.take()
+	if !strings.Contains(string(batch[1].data), `"upload":2`) {
+		t.Errorf("stats update = %s, want the newest", batch[1].data)
+	}
+	if got := counters.snapshot(); got.Coalesced != 2 || got.Dropped != 0 {
+		t.Errorf("counters = %+v", got)
+	}
+
+	// Equal states are collapsed across takes too, whatever their
+	// transition metadata; different ones are not.
+	q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: "connected", TransitionID: 7, PreviousState: "connected"}))
+	q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: "disconnecting", Reason: "user"}))
+	if got := pendingMethods(q); got != "vpn.stateChanged" {
+		t.Errorf("pending = %s, want one state change", got)
+	}
+}
+
+func TestNotifyQueueBounded(t *testing.T) {
+	var counters notifyCounters
+	q := newNotifyQueue(&counters)
+
+	for i := 0; i < maxQueuedNotifications+10; i++ {
+		q.push("profiles.healthUpdate", notification(t, "profiles.healthUpdate", map[string]int{"i": i}))
+	}
+	batch := q.take()
+	if len(batch) != maxQueuedNotifications {
+		t.Fatalf("queued %d, want %d", len(batch), maxQueuedNotifications)
+	}
+	// The oldest are dropped so the client keeps the latest.
+	if !strings.Contains(string(batch[0].data), `"i":10}`) {
+		t.Errorf("oldest kept = %s", batch[0].data)
+	}
+	if got := counters.snapshot().Dropped; got != 10 {
+		t.Errorf("dropped = %d, want 10", got)
+	}
+
+	// A state change pushed out of the queue may be sent again.
+	q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: "error"}))
+	for i := 0; i < maxQueuedNotifications; i++ {
+		q.push("profiles.healthUpdate", notification(t, "profiles.healthUpdate", nil))
+	}
+	q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: "error"}))
+	if batch := q.take(); batch[len(batch)-1].method != methodStateChanged {
+		t.Errorf("state change lost after being dropped")
+	}
+}
+
+// TestNotifyQueueSlowReader flaps the state and streams stats at a client
+// that reads slowly, and checks it ends up with the latest of both while
+// the queue stays bounded.
+func TestNotifyQueueSlowReader(t *testing.T) {
+	var counters notifyCounters
+	q := newNotifyQueue(&counters)
+	r, w := io.Pipe()
+	go q.run(func(data []byte) error {
+		_, err := w.Write(data)
+		return err
+	})
+
+	var lastState, lastStats string
+	gotFinal := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var n struct {
+				Method string          `json:"method"`
+				Params json.RawMessage `json:"params"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+				t.Errorf("bad line %q: %v", scanner.Text(), err)
+				return
+			}
+			switch n.Method {
+			case methodStateChanged:
+				lastState = string(n.Params)
+				if strings.Contains(lastState, "final") {
+					close(gotFinal)
+					return
+				}
+			case methodStatsUpdate:
+				lastStats = string(n.Params)
+			}
+			time.Sleep(time.Millisecond) // a slow UI thread
+		}
+	}()
+
+	const flaps = 5000
+	states := []string{"connecting", "connected", "disconnecting", "disconnected"}
+	for i := 0; i < flaps; i++ {
+		q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: states[i%len(states)]}))
+		q.push(methodStatsUpdate, notification(t, methodStatsUpdate, StatsUpdateParams{Upload: int64(i)}))
+		q.mu.Lock()
+		n := len(q.pending)
+		q.mu.Unlock()
+		if n > maxQueuedNotifications {
+			t.Fatalf("queue grew to %d notifications", n)
+		}
+	}
+	q.push(methodStateChanged, notification(t, methodStateChanged, StateChangedParams{State: "connected", ServerName: "final"}))
+
+	select {
+	case <-gotFinal:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client never received the final state")
+	}
+	q.close()
+	r.Close()
+
+	if want := `{"state":"connected","serverName":"final"}`; lastState != want {
+		t.Errorf("last state = %s, want %s", lastState, want)
+	}
+	if want := fmt.Sprintf(`"upload":%d`, flaps-1); !strings.Contains(lastStats, want) {
+		t.Errorf("last stats = %s, want %s", lastStats, want)
+	}
+	if c := counters.snapshot(); c.Coalesced == 0 || c.Dropped == 0 {
+		t.Errorf("counters = %+v, want coalescing and drops for a slow reader", c)
+	}
+}
+
+func TestSubscriptionTopics(t *testing.T) {
+	h := newTestHandler(t)
+	var counters notifyCounters
+	tray, ui := newClient(&counters), newClient(&counters)
+
+	var id int
+	subscribe := func(c *client, method string, topics ...string) *Response {
+		raw, _ := json.Marshal(SubscribeParams{Topics: topics})
+		id++
+		return h.handleFor(context.Background(), c, &Request{ID: strconv.Itoa(id), Method: method, Params: raw})
+	}
+	if resp := subscribe(tray, "core.unsubscribe", TopicStats); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	resp := subscribe(tray, "core.subscribe", TopicAlerts)
+	if r, ok := resp.Result.(SubscribeResult); !ok || strings.Join(r.Topics, ",") != "alerts,state" {
+		t.Errorf("core.subscribe = %#v, %+v", resp.Result, resp.Error)
+	}
+	if resp := subscribe(tray, "core.subscribe", "weather"); resp.Error == nil || resp.Error.Data["topic"] != "weather" {
+		t.Errorf("unknown topic = %+v", resp.Error)
+	}
+	// Requests outside a client connection have nothing to subscribe.
+	if resp := call(h, "core.subscribe", SubscribeParams{Topics: []string{TopicLogs}}); resp.Error == nil {
+		t.Error("core.subscribe without a client succeeded")
+	}
+
+	for _, n := range []struct{ topic, method string }{
+		{TopicState, methodStateChanged},
+		{TopicStats, methodStatsUpdate},
+		{TopicLogs, "debug.connMatched"},
+		{TopicApps, "split.staleEntries"},
+		{TopicAlerts, "alerts.raised"},
+	} {
+		data := notification(t, n.method, nil)
+		tray.deliver(n.topic, n.method, data)
+		ui.deliver(n.topic, n.method, data)
+	}
+
+	// The UI never subscribed and gets the default topics.
+	if got := pendingMethods(ui.queue); got != "vpn.stateChanged,vpn.statsUpdate" {
+		t.Errorf("default client received %s", got)
+	}
+	if got := pendingMethods(tray.queue); got != "vpn.stateChanged,alerts.raised" {
+		t.Errorf("tray client received %s", got)
+	}
+}
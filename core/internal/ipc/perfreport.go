@@ -0,0 +1,97 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/perfreport"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// cpuSampleWindow is how long diagnostics.performanceReport measures the
+// service's CPU use for.
+const cpuSampleWindow = time.Second
+
+// sampleCPU returns the CPU the service process used over window, as a
+// percentage of one core.
+func sampleCPU(ctx context.Context, window time.Duration) (float64, error) {
+	before, err := processCPUTime()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(window):
+	}
+	after, err := processCPUTime()
+	if err != nil {
+		return 0, err
+	}
+	used := (after.UserMs + after.KernelMs) - (before.UserMs + before.KernelMs)
+	return float64(used) * 100 / float64(time.Since(start).Milliseconds()), nil
+}
+
+// SetThroughputMeter sets the meter fed by the stats poller whose last
+// minute diagnostics.performanceReport reports.
+func (h *Handler) SetThroughputMeter(m *perfreport.Meter) {
+	h.mu.Lock()
+	h.throughput = m
+	h.mu.Unlock()
+}
+
+func (h *Handler) handlePerformanceReport(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	cfg := h.engine.Config()
+	if cfg == nil || cfg.Server == nil || h.stateMachine.State() != vpn.StateConnected {
+		return nil, rpcError(ErrCodeInvalidRequest, ErrKeyNotConnected, "not connected")
+	}
+	transport, err := vpn.DescribeTransport(cfg)
+	if err != nil {
+		return nil, rpcError(ErrCodeInternal, ErrKeyInternal, "failed to read the session's transport")
+	}
+
+	in := perfreport.Inputs{
+		Transport: perfreport.Transport{
+			Protocol:        transport.Protocol,
+			Transport:       transport.Transport,
+			Security:        transport.Security,
+			Mux:             transport.Mux,
+			MuxProtocol:     transport.MuxProtocol,
+			TransportPolicy: cfg.TransportPolicy,
+		},
+		CPUCores:      runtime.NumCPU(),
+		SplitMode:     cfg.SplitTunnelMode,
+		MTU:           cfg.MTU,
+		SuggestedMTU:  h.engine.SuggestedMTU(cfg.Server.Address),
+		UpstreamProxy: cfg.UpstreamProxy != nil,
+	}
+	if in.Transport.TransportPolicy == "" {
+		in.Transport.TransportPolicy = vpn.TransportAuto
+	}
+	if health, ok := h.engine.Health(); ok {
+		in.RTTMs = health.Metrics.RTTMs
+		in.Degraded = !health.Healthy
+		in.HealthReason = health.Reason
+	}
+	if stats, ok := h.engine.TransportStats(); ok {
+		if in.RTTMs == 0 {
+			in.RTTMs = stats.RTTMs
+		}
+		in.LossPercent = stats.LossPercent
+	}
+	if cpu, err := h.cpuUsage(ctx); err == nil {
+		in.CPUPercent = &cpu
+	} else {
+		log.Printf("warning: failed to sample process CPU use: %v", err)
+	}
+
+	h.mu.RLock()
+	meter := h.throughput
+	h.mu.RUnlock()
+	in.Throughput = meter.Throughput(time.Now())
+	return perfreport.Build(in, time.Now()), nil
+}
@@ -0,0 +1,17 @@
+package ipc
+
+import (
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// listenPipe creates the named pipe clients connect to.
+func listenPipe(name string) (net.Listener, error) {
+	return winio.ListenPipe(name, &winio.PipeConfig{
+		SecurityDescriptor: "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;IU)", // SYSTEM + Admins + Interactive Users only
+		MessageMode:        false,
+		InputBufferSize:    65536,
+		OutputBufferSize:   1048576, // 1MB — app list with icons can be large
+	})
+}
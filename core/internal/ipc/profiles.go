@@ -0,0 +1,218 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/profiles"
+	"github.com/mriaz/vpn-core/internal/settings"
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+func (h *Handler) handleSettingsGet(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.settings.Get(), nil
+}
+
+func (h *Handler) handleSettingsSet(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	if len(raw) == 0 {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	var params SettingsSetParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeySettingsInvalid, "invalid settings",
+			map[string]interface{}{"reason": err.Error()})
+	}
+	previous := h.settings.Get()
+	err := checkScheduleSplitConfigs(raw)
+	var updated settings.Settings
+	if err == nil {
+		updated, err = h.settings.Set(raw, params.AdminToken)
+	}
+	if errors.Is(err, settings.ErrAdminLocked) {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeySettingsLocked, "the server policy is locked by an administrator")
+	}
+	if errors.Is(err, settings.ErrAdminLockRequired) {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeySettingsLocked, "the client allow-list and UI launch require an admin lock; set one with settings.adminLock first")
+	}
+	if err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeySettingsInvalid, "invalid settings",
+			map[string]interface{}{"reason": err.Error()})
+	}
+
+	if !reflect.DeepEqual(updated.Schedules, previous.Schedules) {
+		h.scheduler.Poke()
+	}
+
+	result := SettingsSetResult{Settings: updated}
+	if raised := updated.ConfigLimits().Raised(); len(raised) > 0 {
+		result.Warnings = append(result.Warnings, "config limits raised above the defaults ("+strings.Join(raised, ", ")+"); configs this large can make connecting slow")
+	}
+	h.engine.SetHealthThresholds(HealthThresholds(updated))
+	h.engine.SetDNSQueryLog(updated.DNSQueryLog)
+	var ops []vpn.HotOp
+	if updated.PowerMode != previous.PowerMode {
+		h.engine.SetPowerMode(updated.PowerMode)
+		for _, change := range vpn.PowerModeReconnectChanges(h.engine.Config(), updated.PowerMode) {
+			ops = append(ops, vpn.HotOp{Kind: vpn.HotReconnect, Change: change})
+		}
+	}
+	// Route rules are fixed for the session; the bypasses apply from the
+	// next connect. Rules come out in bundle order, so comparing them
+	// ignores reordered or repeated names.
+	if cfg := h.engine.Config(); cfg != nil &&
+		!reflect.DeepEqual(splittunnel.BuildBypassRules(cfg.BuiltinBypasses), splittunnel.BuildBypassRules(updated.BuiltinBypasses)) {
+		ops = append(ops, vpn.HotOp{Kind: vpn.HotReconnect, Change: vpn.ChangeBuiltinBypasses})
+	}
+	if cfg := h.engine.Config(); cfg != nil && !reflect.DeepEqual(cfg.UpstreamProxy, h.settings.UpstreamProxy()) {
+		ops = append(ops, vpn.HotOp{Kind: vpn.HotReconnect, Change: vpn.ChangeUpstreamProxy})
+	}
+	if vpn.DNSQueryLogReconnect(h.engine.Config(), updated.DNSQueryLog) {
+		ops = append(ops, vpn.HotOp{Kind: vpn.HotReconnect, Change: vpn.ChangeDNSQueryLog})
+	}
+	if len(ops) > 0 {
+		result.PendingReconnect = pendingOf(h.engine.ApplyHot(ctx, ops...))
+	}
+	return result, nil
+}
+
+func (h *Handler) handleAdminLock(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.setAdminLock(raw, true)
+}
+
+func (h *Handler) handleAdminUnlock(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.setAdminLock(raw, false)
+}
+
+func (h *Handler) setAdminLock(raw json.RawMessage, locked bool) (interface{}, *RPCError) {
+	var params AdminLockParams
+	if err := json.Unmarshal(raw, &params); err != nil || params.Token == "" {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	updated, err := h.settings.SetAdminLock(params.Token, locked)
+	switch {
+	case errors.Is(err, settings.ErrAdminToken):
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeySettingsLocked, "wrong admin token")
+	case errors.Is(err, settings.ErrTokenTooWeak):
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "admin token too short",
+			map[string]interface{}{"reason": err.Error()})
+	case err != nil:
+		log.Printf("settings: failed to save admin lock: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyStorageFailed, "failed to save settings")
+	}
+	return updated, nil
+}
+
+// HealthThresholds returns the session health thresholds of s.
+func HealthThresholds(s settings.Settings) vpn.HealthThresholds {
+	return vpn.HealthThresholds{
+		FailedProbes:   s.DegradedAfterProbes,
+		RTTMs:          int64(s.DegradedRTTMs),
+		RecoveryProbes: s.RecoverAfterProbes,
+	}
+}
+
+func (h *Handler) handleProfilesList(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.profiles.List(), nil
+}
+
+func (h *Handler) handleProfilesSave(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var p profiles.Profile
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	if len(p.Link) > maxLinkLength {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyLinkTooLong, "server link is too long",
+			map[string]interface{}{"length": len(p.Link), "max": maxLinkLength})
+	}
+	if _, err := parser.ParseLink(p.Link); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyLinkParseFailed, "failed to parse server link")
+	}
+
+	saved, err := h.profiles.Save(p)
+	if errors.Is(err, profiles.ErrNotFound) {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyProfileNotFound, "profile not found")
+	}
+	if err != nil {
+		log.Printf("profiles.save failed: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyStorageFailed, "failed to save profile")
+	}
+	return saved, nil
+}
+
+func (h *Handler) handleProfilesDelete(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ProfileIDParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+
+	err := h.profiles.Delete(params.ID)
+	if errors.Is(err, profiles.ErrNotFound) {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyProfileNotFound, "profile not found")
+	}
+	if err != nil {
+		log.Printf("profiles.delete failed: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyStorageFailed, "failed to delete profile")
+	}
+	h.health.Forget(params.ID)
+	return OKResult{OK: true}, nil
+}
+
+func (h *Handler) handleProfilesExportLink(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ExportLinkParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	if !params.Confirm {
+		return nil, rpcError(ErrCodeConfirmationRequired, ErrKeyConfirmRequired, "the link contains the server's credentials; repeat with confirm to export it")
+	}
+
+	var server *parser.ServerConfig
+	if params.ID != "" {
+		p, ok := h.profiles.Get(params.ID)
+		if !ok {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyProfileNotFound, "profile not found")
+		}
+		parsed, err := parser.ParseLink(p.Link)
+		if err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyLinkParseFailed, "failed to parse server link")
+		}
+		parsed.Name = p.Name
+		server = parsed
+	} else {
+		cfg := h.engine.Config()
+		if h.stateMachine.State() != vpn.StateConnected || cfg == nil || cfg.Server == nil {
+			return nil, rpcError(ErrCodeInvalidRequest, ErrKeyNotConnected, "not connected")
+		}
+		if cfg.RawOutbound != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyLinkExportFailed, "a session connected with a raw outbound has no share link")
+		}
+		server = cfg.Server
+	}
+
+	link, err := parser.BuildLink(server)
+	if err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyLinkExportFailed, "failed to build a share link",
+			map[string]interface{}{"reason": err.Error()})
+	}
+	return ExportLinkResult{Link: link, Name: server.Name}, nil
+}
+
+func (h *Handler) handleProfilesHealth(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.health.Health(), nil
+}
+
+func (h *Handler) handleProfilesSuggestBest(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var result SuggestBestResult
+	if best, ok := h.health.SuggestBest(); ok {
+		result.Best = &best
+	}
+	return result, nil
+}
@@ -1,6 +1,18 @@
 package ipc
 
-import "encoding/json"
+import (
+	"encoding/json"
+
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/datafile"
+	"github.com/mriaz/vpn-core/internal/dnsenv"
+	"github.com/mriaz/vpn-core/internal/envscan"
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/profiles"
+	"github.com/mriaz/vpn-core/internal/settings"
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
 
 // Request represents a JSON-RPC request from the Flutter UI.
 type Request struct {
@@ -22,10 +34,14 @@ type Notification struct {
 	Params interface{} `json:"params,omitempty"`
 }
 
-// RPCError represents an error in a JSON-RPC response.
+// RPCError represents an error in a JSON-RPC response. Key is a stable
+// machine-readable identifier the UI localizes; Message is English text for
+// logs and older clients.
 type RPCError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int                    `json:"code"`
+	Key     string                 `json:"key,omitempty"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"` // offending values, limits
 }
 
 // Standard error codes.
@@ -37,34 +53,351 @@ const (
 	ErrCodeInternal       = -32603
 )
 
+// Application error codes, in the JSON-RPC server error range.
+const (
+	// ErrCodeConfirmationRequired means a destructive call would interrupt
+	// active transfers. The UI asks the user and repeats it with force.
+	ErrCodeConfirmationRequired = -32001
+	// ErrCodeCancelled means a call was abandoned before it finished: its
+	// client disconnected or the method's timeout passed.
+	ErrCodeCancelled = -32002
+)
+
+// Error keys carried in RPCError.Key and PingResult.ErrorKey. These are a
+// contract with the UI translations; never change an existing value.
+const (
+	ErrKeyInvalidJSON          = "request.invalid_json"
+	ErrKeyMethodNotFound       = "request.method_not_found"
+	ErrKeyInvalidParams        = "request.invalid_params"
+	ErrKeyInternal             = "request.internal_error"
+	ErrKeyLinkTooLong          = "link.too_long"
+	ErrKeyLinkParseFailed      = "link.parse_failed"
+	ErrKeyLinkExportFailed     = "link.export_failed"
+	ErrKeyImageInvalid         = "qr.image_invalid"
+	ErrKeyImageTooLarge        = "qr.image_too_large"
+	ErrKeyLinkAndServer        = "connect.link_and_server"
+	ErrKeyServerInvalid        = "connect.server_invalid"
+	ErrKeyServerPortBlocked    = "connect.port_not_allowed"
+	ErrKeyServerPrivate        = "connect.private_address"
+	ErrKeyConnectFailed        = "connect.failed"
+	ErrKeyConfigTooComplex     = "connect.config_too_complex"
+	ErrKeyCoreUnsupported      = "connect.core_unsupported"
+	ErrKeyAttemptRejected      = "connect.attempt_rejected"
+	ErrKeyAttemptPreempted     = "connect.attempt_preempted"
+	ErrKeyDisconnectFailed     = "disconnect.failed"
+	ErrKeyNotConnected         = "vpn.not_connected"
+	ErrKeyAppsListFailed       = "apps.list_failed"
+	ErrKeyIconExportFailed     = "apps.export_icons_failed"
+	ErrKeySplitInvalidMode     = "split.invalid_mode"
+	ErrKeySplitInvalidDomain   = "split.invalid_domain"
+	ErrKeyDNSExceptionInvalid  = "split.invalid_dns_exception"
+	ErrKeyDNSServerInvalid     = "split.invalid_dns_server"
+	ErrKeySplitEmptyList       = "split.empty_list"
+	ErrKeyPingPrivateAddress   = "ping.private_address"
+	ErrKeyPingUnreachable      = "ping.unreachable"
+	ErrKeySettingsInvalid      = "settings.invalid"
+	ErrKeySettingsLocked       = "settings.locked"
+	ErrKeyProfileNotFound      = "profile.not_found"
+	ErrKeyStorageFailed        = "storage.failed"
+	ErrKeySubscriptionNotFound = "subscription.not_found"
+	ErrKeySubscriptionInvalid  = "subscription.invalid"
+	ErrKeySubscriptionFailed   = "subscription.refresh_failed"
+	ErrKeyTunDriverMissing     = "connect.tun_driver_missing"
+	ErrKeyTuningInvalid        = "connect.tuning_invalid"
+	ErrKeyCaptivePortal        = "connect.captive_portal"
+	ErrKeyEnvironmentConflict  = "connect.environment_conflict"
+	ErrKeyTransportConflict    = "connect.transport_conflict"
+	ErrKeyUpstreamConflict     = "connect.upstream_proxy_conflict"
+	ErrKeyUpstreamFailed       = "connect.upstream_proxy_failed"
+	ErrKeyOutboundInvalid      = "connect.outbound_invalid"
+	ErrKeyConfirmRequired      = "confirm.required"
+	ErrKeyCacheInUse           = "maintenance.cache_in_use"
+	ErrKeyLANCredentials       = "connect.lan_credentials"
+	ErrKeyLANNoAddress         = "connect.lan_no_address"
+	ErrKeyLANInvalid           = "connect.lan_invalid"
+	ErrKeyCancelled            = "request.cancelled"
+	ErrKeyRequestIDReused      = "request.id_reused"
+	ErrKeyTimeout              = "request.timeout"
+	ErrKeyShuttingDown         = "request.shutting_down"
+	ErrKeyAdminRequired        = "auth.admin_required"
+	ErrKeyClientNotAllowed     = "auth.client_not_allowed"
+)
+
 // VPN state constants.
 const (
-	StateDisconnected = "disconnected"
-	StateConnecting   = "connecting"
-	StateConnected    = "connected"
+	StateDisconnected  = "disconnected"
+	StateConnecting    = "connecting"
+	StateConnected     = "connected"
 	StateDisconnecting = "disconnecting"
-	StateError        = "error"
+	StateError         = "error"
 )
 
 // ConnectParams are parameters for the vpn.connect method.
+// Exactly one of Link or Server must be provided.
 type ConnectParams struct {
-	Link            string   `json:"link"`
-	SplitTunnelMode string   `json:"splitTunnelMode,omitempty"` // "off", "app", "domain"
-	SplitTunnelApps []string `json:"splitTunnelApps,omitempty"`
-	SplitTunnelDomains []string `json:"splitTunnelDomains,omitempty"`
-	SplitTunnelInvert  bool   `json:"splitTunnelInvert,omitempty"` // true = "all except selected"
+	Link   string               `json:"link,omitempty"`
+	Server *parser.ServerConfig `json:"server,omitempty"` // pre-parsed server, validated like a link
+
+	// Split tunnel options override the stored split.setConfig config
+	// field by field: an omitted field keeps the stored value, an empty
+	// mode included. A mode of app or domain, given here or kept, needs
+	// at least one app or domain; an empty list given here, or a mode
+	// given here with no list anywhere, is refused with
+	// split.empty_list rather than connecting with nothing split.
+	SplitTunnelMode     string   `json:"splitTunnelMode,omitempty" jsonschema:"enum=off|app|domain"`
+	SplitTunnelApps     []string `json:"splitTunnelApps,omitempty"`
+	SplitTunnelDomains  []string `json:"splitTunnelDomains,omitempty"`
+	SplitTunnelInvert   *bool    `json:"splitTunnelInvert,omitempty"`   // true = "all except selected"
+	DNSHijackExceptions []string `json:"dnsHijackExceptions,omitempty"` // apps or IPs whose DNS goes direct
+
+	// Advanced tuning; omitted or zero uses the defaults.
+	TCPKeepAliveSeconds int    `json:"tcpKeepAliveSeconds,omitempty"` // 10-600, default 30
+	IdleTimeoutSeconds  int    `json:"idleTimeoutSeconds,omitempty"`  // 10-3600, UDP sessions of Hysteria2 servers
+	WSMaxEarlyData      int    `json:"wsMaxEarlyData,omitempty"`      // 0-8192 bytes
+	WSEarlyDataHeader   string `json:"wsEarlyDataHeader,omitempty"`
+	SniffMode           string `json:"sniffMode,omitempty" jsonschema:"enum=full|proxy-only|off"`            // default "full"
+	TransportPolicy     string `json:"transportPolicy,omitempty" jsonschema:"enum=auto|tcp-only|block-quic"` // default "auto"
+
+	// TUN adapter hardening; hardenInterface defaults to on when omitted.
+	HardenInterface *bool `json:"hardenInterface,omitempty"`
+	PinTunDNS       bool  `json:"pinTunDns,omitempty"` // point the adapter's DNS at the tunnel
+
+	// Hold the connected state until the default route is verified to
+	// go through the tunnel, by up to 5 seconds.
+	DelayConnectedUntilRouteVerified bool `json:"delayConnectedUntilRouteVerified,omitempty"`
+
+	// Refuse to connect while another VPN or a system proxy is active
+	// instead of returning warnings.
+	StrictEnvironment bool `json:"strictEnvironment,omitempty"`
+
+	// Cap the tunnel's throughput, in Mbps; zero is unlimited. Omitted
+	// uses settings.maxDownMbps and maxUpMbps. vpn.setRateLimit changes
+	// the limit of a connected session.
+	MaxDownMbps *int `json:"maxDownMbps,omitempty"`
+	MaxUpMbps   *int `json:"maxUpMbps,omitempty"`
+
+	// Wait, by up to a minute, for Windows to report network access
+	// before connecting, as an auto-connect at startup should: at boot
+	// the service often runs before the network is up.
+	WaitForNetwork bool `json:"waitForNetwork,omitempty"`
+
+	// What to do while another connect or reconnect is in progress:
+	// refuse (the default), cancel it and take over, which also replaces
+	// a connected session, or wait for it to finish. Refused or cancelled
+	// connects fail with connect.attempt_rejected or
+	// connect.attempt_preempted naming the attempt that won.
+	Policy string `json:"policy,omitempty" jsonschema:"enum=reject|replace|queue"`
+
+	// Share the tunnel with LAN devices through an authenticated
+	// SOCKS5/HTTP proxy. Username and password are required; the address
+	// defaults to this machine's LAN address and the port to 7890.
+	AllowLAN    bool   `json:"allowLan,omitempty"`
+	LANAddress  string `json:"lanAddress,omitempty"`
+	LANPort     int    `json:"lanPort,omitempty"` // 1024-65535
+	LANUsername string `json:"lanUsername,omitempty"`
+	LANPassword string `json:"lanPassword,omitempty"`
+}
+
+// ConnectRawParams are the params of vpn.connectRaw: a sing-box outbound
+// object in place of link or server, which must be empty, with the other
+// options of vpn.connect. The outbound's type and fields are limited to a
+// whitelist (see vpn.ParseRawOutbound) and its tag is replaced.
+type ConnectRawParams struct {
+	ConnectParams
+	Outbound json.RawMessage `json:"outbound" jsonschema:"required"`
+	Name     string          `json:"name,omitempty"` // shown as the server name; defaults to server:port
+}
+
+// ConnectResult is the result of vpn.connect.
+type ConnectResult struct {
+	OK       bool              `json:"ok"`
+	Warnings []envscan.Finding `json:"warnings"` // other VPNs or proxies that may take traffic from the tunnel
+
+	// DNSWarnings are up to five diagnostics.dnsEnvironment warnings,
+	// such as a Pi-hole resolver or a hosts file override.
+	DNSWarnings []dnsenv.Finding `json:"dnsWarnings,omitempty"`
+
+	// SplitWarnings is set when the session cannot fully honor the
+	// requested split tunnel mode.
+	SplitWarnings []vpn.SplitSupport `json:"splitWarnings,omitempty"`
+
+	// BuildDurationMs is how long generating the sing-box config took.
+	BuildDurationMs int64 `json:"buildDurationMs,omitempty"`
+}
+
+// HelloParams are the optional params of core.hello.
+type HelloParams struct {
+	// Compression lists the message encodings the client can inflate, such
+	// as "gzip"; see Envelope.
+	Compression []string `json:"compression,omitempty"`
+}
+
+// HelloResult is the result of core.hello.
+type HelloResult struct {
+	CoreVersion  string   `json:"coreVersion"`
+	Capabilities []string `json:"capabilities"` // supported RPC methods
+	// Instance is the -instance name the service runs as; empty for the
+	// default install.
+	Instance string `json:"instance,omitempty"`
+	// Compression is the encoding large messages to this client use from
+	// now on, including this response; empty for plain JSON throughout.
+	Compression string `json:"compression,omitempty" jsonschema:"enum=gzip"`
 }
 
 // StatusResult is the result of vpn.status.
 type StatusResult struct {
-	State       string `json:"state"`
+	State       string `json:"state" jsonschema:"enum=disconnected|connecting|connected|disconnecting|error"`
 	ServerName  string `json:"serverName,omitempty"`
 	Protocol    string `json:"protocol,omitempty"`
-	ConnectedAt int64  `json:"connectedAt,omitempty"`
-	Upload      int64  `json:"upload,omitempty"`
-	Download    int64  `json:"download,omitempty"`
-	UpSpeed     int64  `json:"upSpeed,omitempty"`
-	DownSpeed   int64  `json:"downSpeed,omitempty"`
+	ConnectedAt int64  `json:"connectedAt,omitempty"` // same as sessionStartedAt
+	// A session spans the links the service re-establishes within it (see
+	// vpn.reconnect); uptime counts from the session start.
+	SessionStartedAt         int64 `json:"sessionStartedAt,omitempty"`
+	CurrentLinkEstablishedAt int64 `json:"currentLinkEstablishedAt,omitempty"`
+	Reconnects               int   `json:"reconnects,omitempty"`
+	Upload                   int64 `json:"upload,omitempty"` // session totals, across reconnects
+	Download                 int64 `json:"download,omitempty"`
+	// Traffic bypassing the tunnel via split tunneling.
+	DirectUpload   int64  `json:"directUpload,omitempty"`
+	DirectDownload int64  `json:"directDownload,omitempty"`
+	UpSpeed        int64  `json:"upSpeed,omitempty"`
+	DownSpeed      int64  `json:"downSpeed,omitempty"`
+	CoreVersion    string `json:"coreVersion,omitempty"` // embedded sing-box version
+
+	Hardening       *vpn.HardeningReport `json:"hardening,omitempty"`       // TUN adapter hardening applied
+	TransportPolicy string               `json:"transportPolicy,omitempty"` // active UDP policy
+	RateLimit       *RateLimitStatus     `json:"rateLimit,omitempty"`       // set while the session's throughput is capped
+	// Time from connect request to connected for the most recent session.
+	LastConnectDurationMs int64 `json:"lastConnectDurationMs,omitempty"`
+
+	LAN *LANEndpoint `json:"lan,omitempty"` // set while the tunnel is shared with the LAN
+
+	KillSwitch *KillSwitchStatus `json:"killSwitch,omitempty"` // set while connected with the kill switch on
+
+	// Connections that went direct while the session's routes were being
+	// set up; the first one raises vpn.earlyLeakDetected with a vpn.EarlyLeak.
+	EarlyLeakCount int `json:"earlyLeakCount,omitempty"`
+
+	// Set while connected but the server stops answering health probes in
+	// time; vpn.healthChanged reports each change with a vpn.SessionHealth.
+	Degraded       bool   `json:"degraded,omitempty"`
+	DegradedReason string `json:"degradedReason,omitempty" jsonschema:"enum=probe_failed|high_rtt"`
+
+	// Set while connected but the Clash API cannot be reached, even after
+	// moving it to a new port, so traffic and speeds stay at zero;
+	// diagnostics.statsUnavailable reports it once per session with a
+	// vpn.StatsUnavailable.
+	StatsUnavailable bool `json:"statsUnavailable,omitempty"`
+
+	// Changes made while connected that sing-box cannot apply to the
+	// running session, e.g. "builtinBypasses" or "splitTunnel"; they take
+	// effect on the next vpn.connect.
+	PendingChanges []string `json:"pendingChanges,omitempty"`
+}
+
+// RateLimitStatus is a session's throughput cap and how it is enforced:
+// by the Hysteria2 bandwidth hints, which a change reconnects to apply, or
+// by shaping the connections to the server, which a change updates in
+// place (see vpn.RateLimitHints).
+type RateLimitStatus struct {
+	vpn.RateLimit
+	Mode string `json:"mode" jsonschema:"enum=hints|shaped"`
+}
+
+// SetRateLimitParams are the params of vpn.setRateLimit: the new limit of
+// the connected session, in Mbps, where zero is unlimited. It lasts for
+// the session; settings.maxDownMbps and maxUpMbps are the default of the
+// next connect.
+type SetRateLimitParams struct {
+	vpn.RateLimit
+	// What to do if applying the limit takes a reconnect while another
+	// connect or reconnect is in progress, as for vpn.connect.
+	Policy string `json:"policy,omitempty" jsonschema:"enum=reject|replace|queue"`
+}
+
+// SetRateLimitResult reports the limit in effect and whether the session
+// was reconnected to apply it.
+type SetRateLimitResult struct {
+	RateLimit   *RateLimitStatus `json:"rateLimit,omitempty"` // omitted once unlimited
+	Reconnected bool             `json:"reconnected"`
+}
+
+// KillSwitchStatus reports how often the kill switch held traffic in the
+// tunnel this session because the proxy stopped answering (see
+// vpn.KillSwitchStats). It is also the params of the vpn.killSwitchEngaged
+// notification, sent the first time that happens in a session.
+type KillSwitchStatus struct {
+	Activations        int   `json:"activations"`
+	LastActivationTime int64 `json:"lastActivationTime,omitempty"` // Unix seconds
+	Engaged            bool  `json:"engaged"`
+	ProtectedSeconds   int64 `json:"protectedSeconds"`
+	BlockedConnections int   `json:"blockedConnections"`
+}
+
+// LANEndpoint is the proxy LAN devices configure to use the tunnel.
+type LANEndpoint struct {
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LANClientsResult is the result of vpn.lanClients.
+type LANClientsResult struct {
+	Enabled bool        `json:"enabled"` // false when disconnected or not sharing
+	Clients []LANClient `json:"clients"`
+}
+
+// LANClient is a LAN device with open connections through the tunnel.
+type LANClient struct {
+	IP          string `json:"ip"`
+	Connections int    `json:"connections"`
+}
+
+// SubscribeParams are parameters for core.subscribe and core.unsubscribe.
+type SubscribeParams struct {
+	Topics []string `json:"topics" jsonschema:"required"` // Topic* values
+}
+
+// SubscribeResult is the result of core.subscribe and core.unsubscribe:
+// the topics the client now receives.
+type SubscribeResult struct {
+	Topics []string `json:"topics"`
+}
+
+// ShuttingDownParams are the params of the core.shuttingDown notification,
+// which every client receives when the service begins to stop.
+type ShuttingDownParams struct {
+	DrainMs int64 `json:"drainMs"` // how long calls in flight have to finish before they are cancelled
+}
+
+// DestructiveParams are parameters for calls that end the session,
+// vpn.disconnect, service.shutdown and maintenance.clearCache. Without Force, a call made while
+// transfers are running fails with ErrCodeConfirmationRequired.
+type DestructiveParams struct {
+	Force  bool   `json:"force,omitempty"`
+	Reason string `json:"reason,omitempty"` // a vpn.Reason* value; defaults to "user"
+}
+
+// ClearCacheParams are parameters for the maintenance.clearCache method.
+// sing-box holds the cache file while connected: without Disconnect the
+// call then fails with ErrCodeConfirmationRequired, and with it the
+// session ends first, subject to Force like vpn.disconnect.
+type ClearCacheParams struct {
+	DestructiveParams
+	Disconnect bool `json:"disconnect,omitempty"`
+}
+
+// ClearCacheResult is the result of maintenance.clearCache.
+type ClearCacheResult struct {
+	Removed      bool `json:"removed"` // a cache file existed
+	Disconnected bool `json:"disconnected,omitempty"`
+}
+
+// OKResult is the result of methods that only report success, such as
+// vpn.disconnect and split.setConfig.
+type OKResult struct {
+	OK bool `json:"ok"`
 }
 
 // StateChangedParams are params pushed via vpn.stateChanged notification.
@@ -72,39 +405,508 @@ type StateChangedParams struct {
 	State      string `json:"state"`
 	Error      string `json:"error,omitempty"`
 	ServerName string `json:"serverName,omitempty"`
+	Reason     string `json:"reason,omitempty"` // why the session ended, on disconnecting and disconnected
+
+	// Transition metadata. IDs increase by one per transition for the life
+	// of the service; a gap means notifications were dropped. A repeat of
+	// the current state carries none.
+	TransitionID  uint64 `json:"transitionId,omitempty"`
+	PreviousState string `json:"previousState,omitempty"`
+	Timestamp     int64  `json:"timestamp,omitempty"`   // unix ms the state was entered
+	ConnectedAt   int64  `json:"connectedAt,omitempty"` // unix ms the link was established, on connected
+	// Unix ms the session first connected, on connected; earlier than
+	// connectedAt after a reconnect (reason "reconnect").
+	SessionStartedAt int64  `json:"sessionStartedAt,omitempty"`
+	DurationMs       *int64 `json:"durationMs,omitempty"` // time the session was connected, on disconnected; 0 if it never connected
 }
 
 // StatsUpdateParams are params pushed via vpn.statsUpdate notification.
+//
+// Two sources count the session's bytes. Upload, Download and the direct
+// pair come from the proxy's per-connection counters and split traffic by
+// route, but miss UDP flows outside connection tracking and connections
+// that close between polls. TunUpload and TunDownload come from the TUN
+// adapter's interface counters, as Task Manager shows them: every packet
+// through the tunnel, whatever its route, including DNS and protocol
+// overhead, and no split by route.
 type StatsUpdateParams struct {
-	Upload    int64 `json:"upload"`
-	Download  int64 `json:"download"`
-	UpSpeed   int64 `json:"upSpeed"`
-	DownSpeed int64 `json:"downSpeed"`
+	Upload    int64 `json:"upload" jsonschema:"description=bytes sent through the proxy this session, from its connection counters"`
+	Download  int64 `json:"download" jsonschema:"description=bytes received through the proxy this session, from its connection counters"`
+	UpSpeed   int64 `json:"upSpeed" jsonschema:"description=proxy upload in bytes per second"`
+	DownSpeed int64 `json:"downSpeed" jsonschema:"description=proxy download in bytes per second"`
+	// Traffic bypassing the tunnel via split tunneling.
+	DirectUpload   int64 `json:"directUpload" jsonschema:"description=bytes sent by connections split tunneling routes direct"`
+	DirectDownload int64 `json:"directDownload" jsonschema:"description=bytes received by connections split tunneling routes direct"`
+	RTTMs          int64 `json:"rttMs,omitempty"` // hysteria2 sessions only, once measured
+	// Adapter counters; 0 when they cannot be read.
+	TunUpload   int64 `json:"tunUpload" jsonschema:"description=bytes apps sent into the TUN adapter this session, from its interface counters; all routes, 0 if unreadable"`
+	TunDownload int64 `json:"tunDownload" jsonschema:"description=bytes the TUN adapter delivered to apps this session, from its interface counters; all routes, 0 if unreadable"`
 }
 
-// AppInfo describes an installed Windows application.
-type AppInfo struct {
-	Name        string `json:"name"`
-	ExeName     string `json:"exeName"`
-	InstallPath string `json:"installPath,omitempty"`
-	IsUWP       bool   `json:"isUwp"`
+// TransportStatsResult is the result of stats.transport. Available is false
+// when disconnected or the protocol reports no link quality; only
+// hysteria2 does. LossPercent and CongestionWindow are omitted when the
+// QUIC layer doesn't expose them, which with the embedded core is always.
+type TransportStatsResult struct {
+	Available        bool     `json:"available"`
+	Protocol         string   `json:"protocol,omitempty"`
+	Source           string   `json:"source,omitempty"` // "quic" or "probe"
+	RTTMs            int64    `json:"rttMs,omitempty"`
+	MeasuredAt       int64    `json:"measuredAt,omitempty"` // unix seconds
+	LossPercent      *float64 `json:"lossPercent,omitempty"`
+	CongestionWindow *int64   `json:"congestionWindow,omitempty"`
+}
+
+// RPCStatsResult is the result of debug.rpcStats.
+type RPCStatsResult struct {
+	Methods   []MethodStats `json:"methods"`
+	PowerMode string        `json:"powerMode"`
+	Process   *ProcessStats `json:"process,omitempty"` // nil if unavailable
+
+	Notifications NotificationStats `json:"notifications"`
+
+	Goroutines  int              `json:"goroutines"`
+	StatsPoller StatsPollerStats `json:"statsPoller"`
+}
+
+// StatsPollerStats describes the engine's stats poller. Active above 1 or
+// any violations mean stats polling leaked across a reconnect.
+type StatsPollerStats struct {
+	Active     int   `json:"active"`
+	Sessions   int64 `json:"sessions"`
+	Violations int64 `json:"violations"`
+}
+
+// ProcessStats is the CPU time the service process has used, for comparing
+// power modes over the same interval.
+type ProcessStats struct {
+	UserMs    int64 `json:"userMs"`
+	KernelMs  int64 `json:"kernelMs"`
+	UptimeSec int64 `json:"uptimeSec"`
+}
+
+// SettingsSetParams are the params of settings.set: the settings to
+// change, plus the admin token when changing the server policy while it is
+// locked (see settings.Store.SetAdminLock).
+type SettingsSetParams struct {
+	settings.Settings
+	AdminToken string `json:"adminToken,omitempty"`
+}
+
+// AdminLockParams are the params of settings.adminLock and
+// settings.adminUnlock.
+type AdminLockParams struct {
+	Token string `json:"token" jsonschema:"required"`
+}
+
+// SettingsSetResult is the result of settings.set: the updated settings
+// plus the changes the running session only picks up after a reconnect.
+type SettingsSetResult struct {
+	settings.Settings
+	PendingReconnect []string `json:"pendingReconnect,omitempty"` // e.g. "logLevel", "builtinBypasses"
+	Warnings         []string `json:"warnings,omitempty"`         // settings that are valid but risky
+}
+
+// AppsListParams are the optional params of apps.list.
+type AppsListParams struct {
+	Icons    *bool `json:"icons,omitempty"`    // defaults to off in low power mode
+	IconSize int   `json:"iconSize,omitempty"` // 32 (default) or 64 pixels
+}
+
+// AppsListDiffParams are the params of apps.listDiff: those of apps.list,
+// plus the version of the list the client has, 0 for none.
+type AppsListDiffParams struct {
+	AppsListParams
+	SinceVersion uint64 `json:"sinceVersion,omitempty"`
+}
+
+// AppsExportIconsParams are the optional params of apps.exportIcons.
+type AppsExportIconsParams struct {
+	IconSize int `json:"iconSize,omitempty"` // 32 (default) or 64 pixels
+}
+
+// AppsExportIconsResult is the result of apps.exportIcons: a directory of
+// PNG files, readable by interactive users, and which app each is for.
+// File names are bare names inside Dir; the directory is removed after
+// ExpiresAt or when the service stops.
+type AppsExportIconsResult struct {
+	Dir       string                     `json:"dir" jsonschema:"required"`
+	Icons     []splittunnel.ExportedIcon `json:"icons" jsonschema:"required"`
+	ExpiresAt int64                      `json:"expiresAt" jsonschema:"required"` // Unix seconds
+}
+
+// AppsDomainActivityParams are the params of apps.domainActivity.
+type AppsDomainActivityParams struct {
+	ExeName      string `json:"exeName" jsonschema:"required"` // e.g. "chrome.exe", matched case-insensitively
+	SinceMinutes int    `json:"sinceMinutes,omitempty"`        // 1-60, default 15
+}
+
+// AppsDomainActivityResult is the result of apps.domainActivity. With the
+// dnsQueryLog setting off, QueryLog is false and Domains is empty.
+type AppsDomainActivityResult struct {
+	QueryLog bool                 `json:"queryLog" jsonschema:"required"`
+	Domains  []vpn.DomainActivity `json:"domains" jsonschema:"required"` // most recently seen first
+}
+
+// TraceConnectionsParams are the params of debug.traceConnections.
+type TraceConnectionsParams struct {
+	Enabled bool `json:"enabled"`
 }
 
+// TraceConnectionsResult is the result of debug.traceConnections. While
+// enabled, each new connection is pushed as a debug.connMatched
+// notification carrying a vpn.ConnMatch.
+type TraceConnectionsResult struct {
+	Enabled   bool  `json:"enabled"`
+	ExpiresAt int64 `json:"expiresAt,omitempty"` // unix seconds; tracing turns itself off then
+}
+
+// DebugConfigResult is the result of debug.getConfig. It never contains
+// server credentials.
+type DebugConfigResult struct {
+	SplitTunnel *SplitTunnelConfig `json:"splitTunnel"`      // stored, applied on the next connect
+	Active      *ActiveConfig      `json:"active,omitempty"` // in use by the current session
+}
+
+// ActiveConfig describes the options of the running session.
+type ActiveConfig struct {
+	Protocol            string   `json:"protocol"`
+	SplitTunnelMode     string   `json:"splitTunnelMode"`
+	DNSHijackExceptions []string `json:"dnsHijackExceptions"`
+	KillSwitch          bool     `json:"killSwitch"`
+	MTU                 int      `json:"mtu"`
+	// StatsStrategy is how the session counts traffic: from the Clash
+	// API's totals without split tunneling, else per connection.
+	StatsStrategy string `json:"statsStrategy" jsonschema:"enum=global-totals|per-connection"`
+}
+
+// AppInfo is an entry of the apps.list result.
+type AppInfo = splittunnel.AppInfo
+
+// AppListDiff is the result of apps.listDiff.
+type AppListDiff = splittunnel.AppListDiff
+
 // SplitTunnelConfig represents the current split tunnel configuration.
 type SplitTunnelConfig struct {
-	Mode    string   `json:"mode"`    // "off", "app", "domain"
+	Mode    string   `json:"mode" jsonschema:"enum=off|app|domain"`
 	Apps    []string `json:"apps"`    // exe names
-	Domains []string `json:"domains"` // domain suffixes
+	Domains []string `json:"domains"` // domain suffixes, "keyword:text" or "regex:expr"
 	Invert  bool     `json:"invert"`  // true = "all except selected"
+
+	// AppPaths maps exe names in Apps to the path they were selected at,
+	// so a same-named app elsewhere is flagged as changed.
+	AppPaths map[string]string `json:"appPaths,omitempty"`
+
+	// DNSHijackExceptions are apps or IPs whose DNS bypasses the hijack.
+	DNSHijackExceptions []string `json:"dnsHijackExceptions,omitempty"`
+
+	// DNSServers resolve their domain suffixes with servers of their own,
+	// such as a corporate resolver through the tunnel.
+	DNSServers []splittunnel.DNSServer `json:"dnsServers,omitempty"`
 }
 
 // PingParams are parameters for the servers.ping method.
 type PingParams struct {
-	Link string `json:"link"`
+	Link string `json:"link" jsonschema:"required"`
+}
+
+// DeduplicateParams are parameters for the servers.deduplicate method.
+type DeduplicateParams struct {
+	Links []string `json:"links" jsonschema:"required"`
+}
+
+// DeduplicateResult is the result of servers.deduplicate. Indices refer to
+// the links in the params.
+type DeduplicateResult struct {
+	Groups  []DuplicateGroup `json:"groups"`  // only sets of two or more
+	Invalid []InvalidLink    `json:"invalid"` // links that could not be parsed
+}
+
+// DuplicateGroup is a set of links that reach the same server.
+type DuplicateGroup struct {
+	Key           string `json:"key"` // stable identity; contains no credential
+	Members       []int  `json:"members"`
+	Canonical     int    `json:"canonical"` // suggested entry to keep
+	CanonicalLink string `json:"canonicalLink"`
+}
+
+// InvalidLink reports a link servers.deduplicate skipped.
+type InvalidLink struct {
+	Index    int    `json:"index"`
+	ErrorKey string `json:"errorKey"`
+}
+
+// StaleEntriesParams are params pushed via the split.staleEntries
+// notification.
+type StaleEntriesParams struct {
+	Entries []splittunnel.StaleEntry `json:"entries"`
+}
+
+// CaptivePortalParams are params pushed via the vpn.captivePortalDetected
+// notification when a connect ran into a captive portal. Scheduled
+// connects wait until RetryAt, when the failed connect is tried again.
+type CaptivePortalParams struct {
+	PortalURL    string `json:"portalUrl"` // page to open for signing in
+	GraceSeconds int    `json:"graceSeconds"`
+	RetryAt      int64  `json:"retryAt"` // Unix seconds
+}
+
+// SchedulerFiredParams are params pushed via the scheduler.fired
+// notification when a schedule window opens or the last open one closes.
+type SchedulerFiredParams struct {
+	Index   int       `json:"index"` // entry in settings.schedules
+	Action  string    `json:"action"`
+	Phase   string    `json:"phase"`             // "start" or "end"
+	CatchUp bool      `json:"catchUp,omitempty"` // the window opened while asleep or stopped
+	Error   *RPCError `json:"error,omitempty"`   // the action failed
+}
+
+// PruneStaleParams are parameters for the split.pruneStale method. Without
+// exe names, every flagged entry is removed.
+type PruneStaleParams struct {
+	ExeNames []string `json:"exeNames,omitempty"`
+}
+
+// SplitCapabilitiesParams are the optional params of split.capabilities.
+// Omitted fields describe the current session, or the defaults when
+// disconnected.
+type SplitCapabilitiesParams struct {
+	ConnectionMode string `json:"connectionMode,omitempty" jsonschema:"enum=tun|proxy"`
+	SniffMode      string `json:"sniffMode,omitempty" jsonschema:"enum=full|proxy-only|off"`
+}
+
+// SplitCapabilitiesResult is the result of split.capabilities.
+type SplitCapabilitiesResult struct {
+	ConnectionMode string             `json:"connectionMode"`
+	SniffMode      string             `json:"sniffMode"`
+	Modes          []vpn.SplitSupport `json:"modes"`
+}
+
+// PruneStaleResult is the result of split.pruneStale.
+type PruneStaleResult struct {
+	Removed []string           `json:"removed"`
+	Config  *SplitTunnelConfig `json:"config"`
+}
+
+// ParseTextParams are parameters for the servers.parseText method.
+type ParseTextParams struct {
+	Text string `json:"text" jsonschema:"required"` // free-form text, up to 64KB
+}
+
+// ParseTextResult is the result of servers.parseText. Links are listed in
+// order of appearance; repeated links are listed once.
+type ParseTextResult struct {
+	Servers     []ParsedLink  `json:"servers"`
+	Unparseable int           `json:"unparseable"`
+	Failures    []LinkFailure `json:"failures"`
+}
+
+// ParsedLink is a link servers.parseText found and parsed. The metadata
+// is derived from Server.Name, which is left as the link has it.
+type ParsedLink struct {
+	// ID is the server's canonical key (see servers.deduplicate), so it
+	// stays the same across imports. Further links to the same server in
+	// one text get "-2", "-3" appended.
+	ID     string               `json:"id"`
+	Link   string               `json:"link"`
+	Server *parser.ServerConfig `json:"server"`
+	parser.NameInfo
+}
+
+// DecodeQRParams are parameters for the servers.decodeQr method.
+type DecodeQRParams struct {
+	Image []byte `json:"image" jsonschema:"required"` // base64 PNG or JPEG, up to 5MB
+}
+
+// DecodeQRResult is the result of servers.decodeQr: the links in the QR
+// codes found in the image, as servers.parseText reports them.
+type DecodeQRResult struct {
+	Codes int `json:"codes"` // distinct QR codes found
+	ParseTextResult
+}
+
+// LinkFailure is a link-like candidate that did not parse.
+type LinkFailure struct {
+	Link     string `json:"link"`
+	ErrorKey string `json:"errorKey"`
+	Reason   string `json:"reason"` // English parser error
+}
+
+// PerformanceParams are parameters for the servers.performance method.
+// Without links, every tracked server is returned.
+type PerformanceParams struct {
+	Links []string `json:"links,omitempty"`
+}
+
+// PerformanceResult is the result of servers.performance. Duplicate links
+// share one history (see servers.deduplicate).
+type PerformanceResult struct {
+	Servers []profiles.ServerPerformance `json:"servers"`
 }
 
 // PingResult is the result of servers.ping.
 type PingResult struct {
-	Latency int    `json:"latency"` // milliseconds
-	Error   string `json:"error,omitempty"`
+	Latency  int    `json:"latency"` // milliseconds
+	Error    string `json:"error,omitempty"`
+	ErrorKey string `json:"errorKey,omitempty"`
+}
+
+// CheckCompatParams are parameters for the diagnostics.checkCompat method.
+type CheckCompatParams struct {
+	Link string `json:"link" jsonschema:"required"`
+}
+
+// CheckCompatResult is the result of diagnostics.checkCompat.
+type CheckCompatResult struct {
+	CoreVersion string   `json:"coreVersion"`
+	Features    []string `json:"features"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+// ProfileIDParams identify a saved profile.
+type ProfileIDParams struct {
+	ID string `json:"id" jsonschema:"required"`
+}
+
+// ExportLinkParams are parameters for the profiles.exportLink method: the
+// profile to export, or the connected server when ID is empty. The link
+// carries the server's credentials, so without Confirm the call fails with
+// ErrCodeConfirmationRequired; the export is recorded in the audit log.
+type ExportLinkParams struct {
+	ID      string `json:"id,omitempty"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+// ExportLinkResult is the result of profiles.exportLink: the server as a
+// canonical share link (see parser.BuildLink), named as the profile is.
+type ExportLinkResult struct {
+	Link string `json:"link"`
+	Name string `json:"name"`
+}
+
+// SuggestBestResult is the result of profiles.suggestBest. Best is nil when
+// no profile has answered a health probe yet.
+type SuggestBestResult struct {
+	Best *profiles.ProfileHealth `json:"best"`
+}
+
+// SubscriptionRefreshResult is the result of subscriptions.refresh.
+type SubscriptionRefreshResult struct {
+	Subscription profiles.Subscription     `json:"subscription"`
+	Diff         profiles.SubscriptionDiff `json:"diff"`
+}
+
+// SubscriptionInfoResult is the result of subscriptions.info. Quota is
+// nil when the subscription's server reports none; the
+// subscriptions.quotaWarning notification carries a profiles.QuotaWarning
+// when usage crosses 80% or 95% of it or expiry is 3 days away.
+type SubscriptionInfoResult struct {
+	Subscription profiles.Subscription `json:"subscription"`
+	Quota        *profiles.QuotaStatus `json:"quota,omitempty"`
+}
+
+// SubscriptionUpdatedParams are params pushed via the
+// subscriptions.updated notification after a subscription was refreshed,
+// on a schedule or by subscriptions.refresh.
+type SubscriptionUpdatedParams struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Added       int    `json:"added"`
+	Removed     int    `json:"removed"`
+	Changed     int    `json:"changed"`
+	LastUpdated int64  `json:"lastUpdated"` // Unix seconds
+}
+
+// MetaSchemaParams are parameters for the meta.schema method.
+type MetaSchemaParams struct {
+	Method string `json:"method" jsonschema:"required"`
+}
+
+// MetaSchemaResult is the JSON Schema of a method's params and result.
+// Params is absent for methods that take none.
+type MetaSchemaResult struct {
+	Method  string          `json:"method"`
+	Dialect string          `json:"$schema"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// SetupCheck is one item of the setup.verify report. Remediation is a key
+// the UI localizes into advice; it is absent when there is nothing to do.
+type SetupCheck struct {
+	ID          string `json:"id"` // service, pipe, driver, conflicts, clock, powershell, elevation
+	Result      string `json:"result" jsonschema:"enum=pass|warn|fail"`
+	Detail      string `json:"detail,omitempty"` // English, for logs and support
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// SetupVerifyResult is the result of setup.verify. Ready is set when no
+// check failed; warnings do not block a connect.
+type SetupVerifyResult struct {
+	Ready  bool         `json:"ready"`
+	Checks []SetupCheck `json:"checks"`
+}
+
+// LastRunResult is the result of diagnostics.lastRun. Previous is nil when
+// there is no record of a previous run. LoadIssues lists what was wrong
+// with the data files this run started with: files quarantined or found
+// tampered with, and fields reset to their defaults.
+type LastRunResult struct {
+	Previous   *LastRun         `json:"previous"`
+	LoadIssues []datafile.Issue `json:"loadIssues,omitempty"`
+}
+
+// LastRun summarizes a run of the service. An abrupt end (the process was
+// killed, crashed outside the service's panic handler, or the machine lost
+// power) is dated to the run's last recorded state change or start.
+type LastRun struct {
+	StartedAt int64  `json:"startedAt"` // unix seconds
+	EndedAt   int64  `json:"endedAt"`
+	EndReason string `json:"endReason" jsonschema:"enum=stopped|panic|abrupt"`
+	State     string `json:"state,omitempty"`  // the last VPN state
+	Server    string `json:"server,omitempty"` // the server of the last connect or session, if under way
+	Panic     string `json:"panic,omitempty"`  // for a panic, its value and stack
+	Stack     string `json:"stack,omitempty"`
+}
+
+// StatsHistoryParams are the params of stats.getHistory. Zero days
+// returns the whole history.
+type StatsHistoryParams struct {
+	Days int `json:"days,omitempty"`
+}
+
+// StatsHistoryResult is the result of stats.getHistory: traffic per local
+// calendar day, oldest first. Days without traffic are absent.
+type StatsHistoryResult struct {
+	Days []HistoryDay `json:"days"`
+}
+
+// HistoryDay is the traffic of one day. Start and End are its boundaries
+// in unix seconds: 23 or 25 hours apart when the clocks change, and
+// shorter or longer after a time zone change.
+type HistoryDay struct {
+	Date           string `json:"date"`      // local date, YYYY-MM-DD
+	Start          int64  `json:"start"`     // unix seconds
+	End            int64  `json:"end"`       // unix seconds
+	UTCOffset      int    `json:"utcOffset"` // seconds east of UTC at start
+	Upload         int64  `json:"upload"`    // through the proxy
+	Download       int64  `json:"download"`
+	DirectUpload   int64  `json:"directUpload"` // bypassed by split tunneling
+	DirectDownload int64  `json:"directDownload"`
+}
+
+// AuditQueryParams are the params of audit.query. Zero from or to leaves
+// that end open.
+type AuditQueryParams struct {
+	From   int64  `json:"from,omitempty"`   // unix seconds
+	To     int64  `json:"to,omitempty"`     // unix seconds
+	Method string `json:"method,omitempty"` // only calls of this method
+}
+
+// AuditQueryResult is the result of audit.query: the matching entries,
+// oldest first. At most 1000 are returned, the most recent; truncated
+// reports that older ones were left out.
+type AuditQueryResult struct {
+	Entries   []audit.Entry `json:"entries"`
+	Truncated bool          `json:"truncated,omitempty"`
 }
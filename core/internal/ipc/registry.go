@@ -0,0 +1,180 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// methodFunc implements one RPC method. It returns either a result to
+// marshal or an error for the client.
+type methodFunc func(ctx context.Context, params json.RawMessage) (interface{}, *RPCError)
+
+// middleware wraps a methodFunc with cross-cutting behaviour such as
+// logging, timing or access control.
+type middleware func(next methodFunc) methodFunc
+
+type contextKey int
+
+const (
+	methodKey contextKey = iota
+	requestIDKey
+	clientKey
+)
+
+// methodName returns the RPC method being served by ctx.
+func methodName(ctx context.Context) string {
+	name, _ := ctx.Value(methodKey).(string)
+	return name
+}
+
+// requestID returns the client-supplied request ID being served by ctx.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestClient returns the client that sent the request served by ctx,
+// or nil outside a client connection.
+func requestClient(ctx context.Context) *client {
+	c, _ := ctx.Value(clientKey).(*client)
+	return c
+}
+
+// clientSubscription returns the topics of the client that sent the
+// request served by ctx, or nil outside a client connection.
+func clientSubscription(ctx context.Context) *subscription {
+	if c := requestClient(ctx); c != nil {
+		return c.sub
+	}
+	return nil
+}
+
+// registry maps method names to implementations and runs every call
+// through a shared middleware chain.
+type registry struct {
+	methods    map[string]methodFunc
+	middleware []middleware
+}
+
+func newRegistry() *registry {
+	return &registry{methods: make(map[string]methodFunc)}
+}
+
+// register adds a method. Registering the same name twice is a programming
+// error.
+func (r *registry) register(name string, fn methodFunc) {
+	if _, dup := r.methods[name]; dup {
+		panic("ipc: method registered twice: " + name)
+	}
+	r.methods[name] = fn
+}
+
+// use appends middleware. The first middleware added is the outermost.
+func (r *registry) use(mw ...middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+// names returns the registered method names, sorted.
+func (r *registry) names() []string {
+	names := make([]string, 0, len(r.methods))
+	for name := range r.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dispatch calls a method through the middleware chain. Unknown methods are
+// rejected before any middleware runs.
+func (r *registry) dispatch(ctx context.Context, method string, params json.RawMessage) (interface{}, *RPCError) {
+	fn, ok := r.methods[method]
+	if !ok {
+		return nil, rpcErrorData(ErrCodeMethodNotFound, ErrKeyMethodNotFound, fmt.Sprintf("method not found: %s", method),
+			map[string]interface{}{"method": method})
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		fn = r.middleware[i](fn)
+	}
+	return fn(context.WithValue(ctx, methodKey, method), params)
+}
+
+// recoverPanics turns a panicking method into an internal error so one bad
+// call cannot take down the client connection or the service.
+func recoverPanics(next methodFunc) methodFunc {
+	return func(ctx context.Context, params json.RawMessage) (result interface{}, rpcErr *RPCError) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("panic in %s: %v\n%s", methodName(ctx), p, debug.Stack())
+				result = nil
+				rpcErr = rpcError(ErrCodeInternal, ErrKeyInternal, "internal error")
+			}
+		}()
+		return next(ctx, params)
+	}
+}
+
+// logErrors logs every failed call with its request ID and error key.
+func logErrors(next methodFunc) methodFunc {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, *RPCError) {
+		result, rpcErr := next(ctx, params)
+		if rpcErr != nil {
+			log.Printf("RPC error [%s] %s: %s (%s)", requestID(ctx), methodName(ctx), rpcErr.Message, rpcErr.Key)
+		}
+		return result, rpcErr
+	}
+}
+
+// withTimeouts bounds every call by its method's entry in timeouts, or by
+// def. A call whose context ended before it started is not run, and one
+// that fails after its context ended reports ErrCodeCancelled instead of
+// the error the interruption caused.
+func withTimeouts(timeouts map[string]time.Duration, def time.Duration) middleware {
+	return func(next methodFunc) methodFunc {
+		return func(ctx context.Context, params json.RawMessage) (interface{}, *RPCError) {
+			timeout, ok := timeouts[methodName(ctx)]
+			if !ok {
+				timeout = def
+			}
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			if ctx.Err() != nil {
+				return nil, cancelledError(ctx)
+			}
+			result, rpcErr := next(ctx, params)
+			if rpcErr != nil && ctx.Err() != nil {
+				return nil, cancelledError(ctx)
+			}
+			return result, rpcErr
+		}
+	}
+}
+
+// cancelledError reports why ctx ended.
+func cancelledError(ctx context.Context) *RPCError {
+	if errors.Is(context.Cause(ctx), errShuttingDown) {
+		return shuttingDownError()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return rpcError(ErrCodeCancelled, ErrKeyTimeout, "request timed out")
+	}
+	return rpcError(ErrCodeCancelled, ErrKeyCancelled, "request cancelled")
+}
+
+func rpcError(code int, key, message string) *RPCError {
+	return rpcErrorData(code, key, message, nil)
+}
+
+func rpcErrorData(code int, key, message string, data map[string]interface{}) *RPCError {
+	return &RPCError{
+		Code:    code,
+		Key:     key,
+		Message: message,
+		Data:    data,
+	}
+}
@@ -0,0 +1,130 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPanicRecovered(t *testing.T) {
+	h := newTestHandler(t)
+	h.registry.register("test.panic", func(context.Context, json.RawMessage) (interface{}, *RPCError) {
+		var m map[string]int
+		m["boom"]++ // nil map write
+		return nil, nil
+	})
+
+	resp := call(h, "test.panic", nil)
+	if resp.Error == nil || resp.Error.Code != ErrCodeInternal || resp.Error.Key != ErrKeyInternal {
+		t.Fatalf("panic response = %+v, want internal error", resp.Error)
+	}
+	if resp.ID != "1" {
+		t.Errorf("response ID = %q, want request ID", resp.ID)
+	}
+
+	// The handler keeps serving after a panic, and metrics saw the failure.
+	if resp := call(h, "settings.get", nil); resp.Error != nil {
+		t.Fatalf("call after panic failed: %+v", resp.Error)
+	}
+	for _, s := range h.RPCStats() {
+		if s.Method == "test.panic" && s.Errors != 1 {
+			t.Errorf("test.panic stats = %+v, want 1 error", s)
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var order []string
+	trace := func(name string) middleware {
+		return func(next methodFunc) methodFunc {
+			return func(ctx context.Context, params json.RawMessage) (interface{}, *RPCError) {
+				order = append(order, name+":"+methodName(ctx))
+				return next(ctx, params)
+			}
+		}
+	}
+
+	r := newRegistry()
+	r.use(trace("outer"), trace("inner"))
+	r.register("a.b", func(context.Context, json.RawMessage) (interface{}, *RPCError) {
+		order = append(order, "method")
+		return "ok", nil
+	})
+
+	result, rpcErr := r.dispatch(context.Background(), "a.b", nil)
+	if rpcErr != nil || result != "ok" {
+		t.Fatalf("dispatch = %v, %+v", result, rpcErr)
+	}
+	want := []string{"outer:a.b", "inner:a.b", "method"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+
+	// Unknown methods never reach middleware.
+	order = nil
+	if _, rpcErr := r.dispatch(context.Background(), "a.missing", nil); rpcErr == nil || rpcErr.Key != ErrKeyMethodNotFound {
+		t.Errorf("unknown method error = %+v", rpcErr)
+	}
+	if len(order) != 0 {
+		t.Errorf("middleware ran for unknown method: %v", order)
+	}
+}
+
+func TestHelloCapabilities(t *testing.T) {
+	h := newTestHandler(t)
+	resp := call(h, "core.hello", nil)
+	hello, ok := resp.Result.(HelloResult)
+	if !ok {
+		t.Fatalf("core.hello result = %#v", resp.Result)
+	}
+	if !reflect.DeepEqual(hello.Capabilities, h.registry.names()) {
+		t.Errorf("capabilities = %v, want registry names", hello.Capabilities)
+	}
+	for _, want := range []string{"core.hello", "vpn.connect", "profiles.save"} {
+		found := false
+		for _, c := range hello.Capabilities {
+			found = found || c == want
+		}
+		if !found {
+			t.Errorf("capabilities missing %s", want)
+		}
+	}
+}
+
+func TestMethodTimeouts(t *testing.T) {
+	r := newRegistry()
+	r.use(withTimeouts(map[string]time.Duration{"a.slow": 10 * time.Millisecond}, time.Minute))
+	var ran []string
+	wait := func(ctx context.Context, _ json.RawMessage) (interface{}, *RPCError) {
+		ran = append(ran, methodName(ctx))
+		select {
+		case <-ctx.Done():
+			return nil, rpcError(ErrCodeInternal, ErrKeyInternal, "interrupted")
+		case <-time.After(50 * time.Millisecond):
+			return "done", nil
+		}
+	}
+	r.register("a.slow", wait)
+	r.register("a.fast", wait)
+
+	if _, rpcErr := r.dispatch(context.Background(), "a.slow", nil); rpcErr == nil ||
+		rpcErr.Code != ErrCodeCancelled || rpcErr.Key != ErrKeyTimeout {
+		t.Errorf("a.slow = %+v, want a timeout", rpcErr)
+	}
+	if result, rpcErr := r.dispatch(context.Background(), "a.fast", nil); rpcErr != nil || result != "done" {
+		t.Errorf("a.fast = %v, %+v under the default timeout", result, rpcErr)
+	}
+
+	// A request whose client already left is not run at all.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ran = nil
+	if _, rpcErr := r.dispatch(ctx, "a.fast", nil); rpcErr == nil || rpcErr.Key != ErrKeyCancelled {
+		t.Errorf("cancelled call = %+v", rpcErr)
+	}
+	if len(ran) != 0 {
+		t.Errorf("cancelled call ran %v", ran)
+	}
+}
@@ -0,0 +1,174 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/scheduler"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// Schedule phases reported by scheduler.fired.
+const (
+	schedulePhaseStart = "start"
+	schedulePhaseEnd   = "end"
+)
+
+// RunScheduler applies settings.schedules until stop is closed. resume
+// signals a wake from sleep, so windows that opened meanwhile fire at once;
+// it may be nil.
+func (h *Handler) RunScheduler(stop, resume <-chan struct{}) {
+	h.scheduler.Run(stop, resume)
+}
+
+// checkScheduleSplitConfigs validates the split configs embedded in the
+// schedules of a settings.set patch, which the settings store only checks
+// to be objects.
+func checkScheduleSplitConfigs(patch json.RawMessage) error {
+	var p struct {
+		Schedules []scheduler.Entry `json:"schedules"`
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil // reported by the store
+	}
+	for i, e := range p.Schedules {
+		if e.Action != scheduler.ActionSetSplitConfig || len(e.SplitConfig) == 0 {
+			continue
+		}
+		var config SplitTunnelConfig
+		if err := json.Unmarshal(e.SplitConfig, &config); err != nil {
+			return fmt.Errorf("schedules: entry %d: invalid splitConfig", i)
+		}
+		if rpcErr := validateSplitConfig(&config); rpcErr != nil {
+			return fmt.Errorf("schedules: entry %d: %s", i, rpcErr.Message)
+		}
+	}
+	return nil
+}
+
+// applySchedule carries out a change of the schedule window in force
+// through the same methods a client would call, and reports it with
+// scheduler.fired.
+//
+// A window that opens applies its action. When the last one closes, a
+// connectProfile session is disconnected and the split config in effect
+// before the schedule first changed it is restored.
+func (h *Handler) applySchedule(t scheduler.Transition) {
+	ctx := context.WithValue(context.Background(), attemptOriginKey{}, "schedule")
+	if t.To == nil {
+		f := t.From
+		var rpcErr *RPCError
+		if f.Entry.Action == scheduler.ActionConnectProfile {
+			rpcErr = h.scheduledDisconnect(ctx)
+		}
+		if err := h.restorePreScheduleSplit(ctx); err != nil && rpcErr == nil {
+			rpcErr = err
+		}
+		h.notifyScheduleFired(f, schedulePhaseEnd, false, rpcErr)
+		return
+	}
+
+	f := t.To
+	var rpcErr *RPCError
+	switch f.Entry.Action {
+	case scheduler.ActionConnectProfile:
+		rpcErr = h.scheduledConnect(ctx, f.Entry.ProfileID)
+	case scheduler.ActionDisconnect:
+		rpcErr = h.scheduledDisconnect(ctx)
+	case scheduler.ActionSetSplitConfig:
+		h.mu.Lock()
+		if h.preSchedule == nil {
+			h.preSchedule = h.splitConfig
+		}
+		h.mu.Unlock()
+		_, rpcErr = h.registry.dispatch(ctx, "split.setConfig", f.Entry.SplitConfig)
+	}
+	h.notifyScheduleFired(f, schedulePhaseStart, t.CatchUp, rpcErr)
+}
+
+// scheduledConnect connects to a saved profile, replacing any session with
+// another server.
+func (h *Handler) scheduledConnect(ctx context.Context, profileID string) *RPCError {
+	p, ok := h.profiles.Get(profileID)
+	if !ok {
+		return rpcError(ErrCodeInvalidParams, ErrKeyProfileNotFound, "profile not found")
+	}
+	if h.captive.active() {
+		// Connecting now would only fail again; connect once the user had
+		// time to sign in to the portal.
+		h.captive.deferRetry(func() {
+			ctx := context.WithValue(context.Background(), captiveRetryKey{}, true)
+			if rpcErr := h.scheduledConnect(ctx, profileID); rpcErr != nil {
+				log.Printf("scheduler: connect held off by a captive portal failed: %s", rpcErr.Message)
+			}
+		})
+		return rpcError(ErrCodeInternal, ErrKeyCaptivePortal, "connect held off while a captive portal is signed in to")
+	}
+	if h.stateMachine.State() != vpn.StateDisconnected {
+		if cfg := h.engine.Config(); cfg != nil && cfg.Server != nil {
+			if target, err := parser.ParseLink(p.Link); err == nil && parser.CanonicalKey(target) == parser.CanonicalKey(cfg.Server) {
+				return nil // already there
+			}
+		}
+		if rpcErr := h.scheduledDisconnect(ctx); rpcErr != nil {
+			return rpcErr
+		}
+	}
+	// A window open at boot fires as soon as the service starts, which
+	// may be before the network is up.
+	params, _ := json.Marshal(ConnectParams{Link: p.Link, WaitForNetwork: true})
+	_, rpcErr := h.registry.dispatch(ctx, "vpn.connect", params)
+	return rpcErr
+}
+
+// scheduledDisconnect ends the session without asking for confirmation.
+func (h *Handler) scheduledDisconnect(ctx context.Context) *RPCError {
+	if h.stateMachine.State() == vpn.StateDisconnected {
+		return nil
+	}
+	params, _ := json.Marshal(DestructiveParams{Force: true, Reason: vpn.ReasonSchedule})
+	_, rpcErr := h.registry.dispatch(ctx, "vpn.disconnect", params)
+	return rpcErr
+}
+
+// restorePreScheduleSplit puts back the split config a schedule replaced.
+func (h *Handler) restorePreScheduleSplit(ctx context.Context) *RPCError {
+	h.mu.Lock()
+	saved := h.preSchedule
+	h.preSchedule = nil
+	h.mu.Unlock()
+	if saved == nil {
+		return nil
+	}
+	params, _ := json.Marshal(saved)
+	_, rpcErr := h.registry.dispatch(ctx, "split.setConfig", params)
+	return rpcErr
+}
+
+func (h *Handler) notifyScheduleFired(f *scheduler.Firing, phase string, catchUp bool, rpcErr *RPCError) {
+	if rpcErr != nil {
+		log.Printf("scheduler: entry %d (%s) %s failed: %s", f.Index, f.Entry.Action, phase, rpcErr.Message)
+	} else {
+		log.Printf("scheduler: entry %d (%s) %s", f.Index, f.Entry.Action, phase)
+	}
+
+	h.mu.RLock()
+	notifier := h.notifier
+	h.mu.RUnlock()
+	if notifier == nil {
+		return
+	}
+	notifier.Broadcast(TopicSchedule, &Notification{
+		Method: "scheduler.fired",
+		Params: SchedulerFiredParams{
+			Index:   f.Index,
+			Action:  f.Entry.Action,
+			Phase:   phase,
+			CatchUp: catchUp,
+			Error:   rpcErr,
+		},
+	})
+}
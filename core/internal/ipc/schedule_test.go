@@ -0,0 +1,97 @@
+package ipc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/scheduler"
+)
+
+func firing(index int, e scheduler.Entry) *scheduler.Firing {
+	return &scheduler.Firing{Index: index, Entry: e, Start: time.Now()}
+}
+
+func TestScheduledSplitConfigIsRestored(t *testing.T) {
+	h := newTestHandler(t)
+	n := &recordingNotifier{}
+	h.SetNotifier(n)
+	if resp := call(h, "split.setConfig", map[string]interface{}{"mode": "domain", "domains": []string{"example.org"}}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+
+	games := scheduler.Entry{Days: scheduler.AllDays, StartTime: "09:00", EndTime: "17:00", Action: scheduler.ActionSetSplitConfig,
+		SplitConfig: json.RawMessage(`{"mode":"app","apps":["game.exe"],"invert":true}`)}
+	breakTime := scheduler.Entry{Days: scheduler.AllDays, StartTime: "12:00", EndTime: "13:00", Action: scheduler.ActionSetSplitConfig,
+		SplitConfig: json.RawMessage(`{"mode":"off"}`)}
+
+	h.applySchedule(scheduler.Transition{To: firing(0, games), CatchUp: true})
+	if got := h.splitConfig; got.Mode != "app" || !got.Invert {
+		t.Fatalf("split config after start = %+v", got)
+	}
+	h.applySchedule(scheduler.Transition{From: firing(0, games), To: firing(1, breakTime)})
+	h.applySchedule(scheduler.Transition{From: firing(1, breakTime), To: firing(0, games)})
+	h.applySchedule(scheduler.Transition{From: firing(0, games)})
+	if got := h.splitConfig; got.Mode != "domain" || len(got.Domains) != 1 {
+		t.Errorf("split config after end = %+v, want the config from before the schedule", got)
+	}
+
+	if len(n.sent) != 4 {
+		t.Fatalf("got %d notifications, want 4", len(n.sent))
+	}
+	first := n.sent[0].Params.(SchedulerFiredParams)
+	last := n.sent[3].Params.(SchedulerFiredParams)
+	if n.topics[0] != TopicSchedule || n.sent[0].Method != "scheduler.fired" ||
+		first.Phase != schedulePhaseStart || !first.CatchUp || first.Error != nil {
+		t.Errorf("first notification = %s %+v", n.topics[0], first)
+	}
+	if last.Phase != schedulePhaseEnd || last.Index != 0 || last.Action != scheduler.ActionSetSplitConfig {
+		t.Errorf("last notification = %+v", last)
+	}
+}
+
+func TestScheduledConnectUnknownProfile(t *testing.T) {
+	h := newTestHandler(t)
+	n := &recordingNotifier{}
+	h.SetNotifier(n)
+
+	e := scheduler.Entry{Days: scheduler.AllDays, StartTime: "09:00", EndTime: "17:00",
+		Action: scheduler.ActionConnectProfile, ProfileID: "gone"}
+	h.applySchedule(scheduler.Transition{To: firing(2, e)})
+	if len(n.sent) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(n.sent))
+	}
+	if p := n.sent[0].Params.(SchedulerFiredParams); p.Index != 2 || p.Error == nil || p.Error.Key != ErrKeyProfileNotFound {
+		t.Errorf("notification = %+v", p)
+	}
+}
+
+func TestSettingsSetValidatesSchedules(t *testing.T) {
+	h := newTestHandler(t)
+	for name, schedules := range map[string]interface{}{
+		"end before start": []map[string]interface{}{
+			{"days": 1, "startTime": "17:00", "endTime": "09:00", "action": "disconnect"},
+		},
+		"bad split mode": []map[string]interface{}{
+			{"days": 1, "startTime": "09:00", "endTime": "17:00", "action": "setSplitConfig", "splitConfig": map[string]string{"mode": "games"}},
+		},
+	} {
+		resp := call(h, "settings.set", map[string]interface{}{"schedules": schedules})
+		if resp.Error == nil || resp.Error.Key != ErrKeySettingsInvalid {
+			t.Errorf("%s: error = %+v", name, resp.Error)
+		}
+	}
+	if got := h.settings.Get().Schedules; len(got) != 0 {
+		t.Errorf("invalid schedules were saved: %+v", got)
+	}
+
+	resp := call(h, "settings.set", map[string]interface{}{"schedules": []map[string]interface{}{
+		{"days": 62, "startTime": "09:00", "endTime": "17:00", "action": "setSplitConfig", "splitConfig": map[string]string{"mode": "off"}},
+	}})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if got := h.settings.Get().Schedules; len(got) != 1 || got[0].Days != 62 {
+		t.Errorf("schedules = %+v", got)
+	}
+}
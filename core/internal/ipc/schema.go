@@ -0,0 +1,200 @@
+package ipc
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/mriaz/vpn-core/internal/dnsenv"
+	"github.com/mriaz/vpn-core/internal/envscan"
+	"github.com/mriaz/vpn-core/internal/jsonschema"
+	"github.com/mriaz/vpn-core/internal/netinfo"
+	"github.com/mriaz/vpn-core/internal/perfreport"
+	"github.com/mriaz/vpn-core/internal/profiles"
+	"github.com/mriaz/vpn-core/internal/settings"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+//go:generate go run ../../cmd/schemagen -o schemas.json
+
+// methodTypes are the Go types of a method's params and result. Params is
+// nil for methods that take none.
+type methodTypes struct {
+	Params reflect.Type
+	Result reflect.Type
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// methodSchemaTypes lists the payload types of every registered method.
+// Run go generate after changing them or any type they contain.
+var methodSchemaTypes = map[string]methodTypes{
+	"core.hello":                    {typeOf[HelloParams](), typeOf[HelloResult]()},
+	"core.subscribe":                {typeOf[SubscribeParams](), typeOf[SubscribeResult]()},
+	"core.unsubscribe":              {typeOf[SubscribeParams](), typeOf[SubscribeResult]()},
+	"vpn.connect":                   {typeOf[ConnectParams](), typeOf[ConnectResult]()},
+	"vpn.connectRaw":                {typeOf[ConnectRawParams](), typeOf[ConnectResult]()},
+	"vpn.disconnect":                {typeOf[DestructiveParams](), typeOf[OKResult]()},
+	"vpn.reconnect":                 {nil, typeOf[OKResult]()},
+	"vpn.setRateLimit":              {typeOf[SetRateLimitParams](), typeOf[SetRateLimitResult]()},
+	"vpn.status":                    {nil, typeOf[StatusResult]()},
+	"vpn.explain":                   {typeOf[ConnectParams](), typeOf[vpn.Explanation]()},
+	"vpn.lanClients":                {nil, typeOf[LANClientsResult]()},
+	"stats.transport":               {nil, typeOf[TransportStatsResult]()},
+	"stats.getHistory":              {typeOf[StatsHistoryParams](), typeOf[StatsHistoryResult]()},
+	"apps.list":                     {typeOf[AppsListParams](), typeOf[[]AppInfo]()},
+	"apps.listDiff":                 {typeOf[AppsListDiffParams](), typeOf[AppListDiff]()},
+	"apps.exportIcons":              {typeOf[AppsExportIconsParams](), typeOf[AppsExportIconsResult]()},
+	"apps.domainActivity":           {typeOf[AppsDomainActivityParams](), typeOf[AppsDomainActivityResult]()},
+	"split.setConfig":               {typeOf[SplitTunnelConfig](), typeOf[OKResult]()},
+	"split.getConfig":               {nil, typeOf[SplitTunnelConfig]()},
+	"split.pruneStale":              {typeOf[PruneStaleParams](), typeOf[PruneStaleResult]()},
+	"split.capabilities":            {typeOf[SplitCapabilitiesParams](), typeOf[SplitCapabilitiesResult]()},
+	"servers.ping":                  {typeOf[PingParams](), typeOf[PingResult]()},
+	"servers.deduplicate":           {typeOf[DeduplicateParams](), typeOf[DeduplicateResult]()},
+	"servers.performance":           {typeOf[PerformanceParams](), typeOf[PerformanceResult]()},
+	"servers.parseText":             {typeOf[ParseTextParams](), typeOf[ParseTextResult]()},
+	"servers.decodeQr":              {typeOf[DecodeQRParams](), typeOf[DecodeQRResult]()},
+	"diagnostics.checkCompat":       {typeOf[CheckCompatParams](), typeOf[CheckCompatResult]()},
+	"diagnostics.checkDrivers":      {nil, typeOf[vpn.DriverStatus]()},
+	"diagnostics.environment":       {nil, typeOf[envscan.Report]()},
+	"diagnostics.conflicts":         {nil, typeOf[envscan.Report]()},
+	"diagnostics.dnsEnvironment":    {nil, typeOf[dnsenv.Report]()},
+	"diagnostics.routes":            {nil, typeOf[netinfo.Snapshot]()},
+	"diagnostics.performanceReport": {nil, typeOf[perfreport.Report]()},
+	"diagnostics.lastRun":           {nil, typeOf[LastRunResult]()},
+	"diagnostics.mtuProbe":          {nil, typeOf[vpn.MTUProbe]()},
+	"setup.verify":                  {nil, typeOf[SetupVerifyResult]()},
+	"debug.rpcStats":                {nil, typeOf[RPCStatsResult]()},
+	"debug.getConfig":               {nil, typeOf[DebugConfigResult]()},
+	"debug.traceConnections":        {typeOf[TraceConnectionsParams](), typeOf[TraceConnectionsResult]()},
+	"settings.get":                  {nil, typeOf[settings.Settings]()},
+	"settings.set":                  {typeOf[SettingsSetParams](), typeOf[SettingsSetResult]()},
+	"audit.query":                   {typeOf[AuditQueryParams](), typeOf[AuditQueryResult]()},
+	"settings.adminLock":            {typeOf[AdminLockParams](), typeOf[settings.Settings]()},
+	"settings.adminUnlock":          {typeOf[AdminLockParams](), typeOf[settings.Settings]()},
+	"profiles.list":                 {nil, typeOf[[]profiles.Profile]()},
+	"profiles.save":                 {typeOf[profiles.Profile](), typeOf[profiles.Profile]()},
+	"profiles.delete":               {typeOf[ProfileIDParams](), typeOf[OKResult]()},
+	"profiles.exportLink":           {typeOf[ExportLinkParams](), typeOf[ExportLinkResult]()},
+	"profiles.health":               {nil, typeOf[[]profiles.ProfileHealth]()},
+	"profiles.suggestBest":          {nil, typeOf[SuggestBestResult]()},
+	"subscriptions.list":            {nil, typeOf[[]profiles.Subscription]()},
+	"subscriptions.save":            {typeOf[profiles.Subscription](), typeOf[profiles.Subscription]()},
+	"subscriptions.delete":          {typeOf[ProfileIDParams](), typeOf[OKResult]()},
+	"subscriptions.refresh":         {typeOf[ProfileIDParams](), typeOf[SubscriptionRefreshResult]()},
+	"subscriptions.info":            {typeOf[ProfileIDParams](), typeOf[SubscriptionInfoResult]()},
+	"service.shutdown":              {typeOf[DestructiveParams](), typeOf[OKResult]()},
+	"maintenance.clearCache":        {typeOf[ClearCacheParams](), typeOf[ClearCacheResult]()},
+	"meta.schema":                   {typeOf[MetaSchemaParams](), typeOf[MetaSchemaResult]()},
+}
+
+// notificationSchemaTypes lists the params types of notifications whose
+// payload is defined here.
+var notificationSchemaTypes = map[string]reflect.Type{
+	methodStatsUpdate:  typeOf[StatsUpdateParams](),
+	methodShuttingDown: typeOf[ShuttingDownParams](),
+}
+
+// methodSchema is the schema document of one method.
+type methodSchema struct {
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result"`
+}
+
+// schemaDocument is the layout of schemas.json.
+type schemaDocument struct {
+	Dialect       string                     `json:"$schema"`
+	Methods       map[string]methodSchema    `json:"methods"`
+	Notifications map[string]json.RawMessage `json:"notifications"` // params of each notification
+}
+
+// GenerateSchemas derives the JSON Schema of every method's params and
+// result from methodSchemaTypes, and of notification params from
+// notificationSchemaTypes. go generate writes it to schemas.json,
+// which is embedded and served by meta.schema.
+func GenerateSchemas() ([]byte, error) {
+	doc := schemaDocument{Dialect: jsonschema.Dialect, Methods: make(map[string]methodSchema, len(methodSchemaTypes))}
+	names := make([]string, 0, len(methodSchemaTypes))
+	for name := range methodSchemaTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		types := methodSchemaTypes[name]
+		var ms methodSchema
+		if types.Params != nil {
+			s, err := jsonschema.For(types.Params, jsonschema.Input)
+			if err != nil {
+				return nil, fmt.Errorf("%s params: %w", name, err)
+			}
+			if ms.Params, err = json.Marshal(s); err != nil {
+				return nil, err
+			}
+		}
+		s, err := jsonschema.For(types.Result, jsonschema.Output)
+		if err != nil {
+			return nil, fmt.Errorf("%s result: %w", name, err)
+		}
+		if ms.Result, err = json.Marshal(s); err != nil {
+			return nil, err
+		}
+		doc.Methods[name] = ms
+	}
+	doc.Notifications = make(map[string]json.RawMessage, len(notificationSchemaTypes))
+	for name, t := range notificationSchemaTypes {
+		s, err := jsonschema.For(t, jsonschema.Output)
+		if err != nil {
+			return nil, fmt.Errorf("%s params: %w", name, err)
+		}
+		if doc.Notifications[name], err = json.Marshal(s); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+//go:embed schemas.json
+var schemasJSON []byte
+
+var embeddedSchemas = sync.OnceValue(func() schemaDocument {
+	var doc schemaDocument
+	if err := json.Unmarshal(schemasJSON, &doc); err != nil {
+		panic("ipc: invalid schemas.json: " + err.Error())
+	}
+	return doc
+})
+
+func (h *Handler) handleMetaSchema(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params MetaSchemaParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+	if params.Method == "" {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "method is required")
+	}
+	doc := embeddedSchemas()
+	ms, ok := doc.Methods[params.Method]
+	if !ok {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyMethodNotFound, fmt.Sprintf("no schema for method: %s", params.Method),
+			map[string]interface{}{"method": params.Method})
+	}
+	return MetaSchemaResult{
+		Method:  params.Method,
+		Dialect: doc.Dialect,
+		Params:  ms.Params,
+		Result:  ms.Result,
+	}, nil
+}
@@ -0,0 +1,190 @@
+package ipc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestSchemasCoverMethods(t *testing.T) {
+	h := newTestHandler(t)
+	var typed []string
+	for name := range methodSchemaTypes {
+		typed = append(typed, name)
+	}
+	sort.Strings(typed)
+	if names := h.registry.names(); !slices.Equal(names, typed) {
+		t.Errorf("methods with schema types = %v, registered methods = %v", typed, names)
+	}
+	for _, name := range h.registry.names() {
+		if _, ok := embeddedSchemas().Methods[name]; !ok {
+			t.Errorf("schemas.json has no schema for %s", name)
+		}
+	}
+}
+
+func TestSchemasUpToDate(t *testing.T) {
+	data, err := GenerateSchemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, schemasJSON) {
+		t.Error("schemas.json is stale; run go generate ./internal/ipc")
+	}
+}
+
+func TestMetaSchema(t *testing.T) {
+	h := newTestHandler(t)
+	resp := call(h, "meta.schema", MetaSchemaParams{Method: "vpn.connect"})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	result := resp.Result.(MetaSchemaResult)
+	var params, res map[string]interface{}
+	if err := json.Unmarshal(result.Params, &params); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(result.Result, &res); err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "ConnectParams" || params["properties"].(map[string]interface{})["link"] == nil {
+		t.Errorf("vpn.connect params schema = %v", params)
+	}
+	if res["title"] != "ConnectResult" || !reflect.DeepEqual(res["required"], []interface{}{"ok", "warnings"}) {
+		t.Errorf("vpn.connect result schema = %v", res)
+	}
+
+	resp = call(h, "meta.schema", MetaSchemaParams{Method: "vpn.status"})
+	if result := resp.Result.(MetaSchemaResult); result.Params != nil || result.Result == nil {
+		t.Errorf("vpn.status schema = %+v", result)
+	}
+}
+
+// TestResultsMatchSchemas checks that what handlers return validates
+// against their result schema, so the type table stays honest.
+func TestResultsMatchSchemas(t *testing.T) {
+	h := newTestHandler(t)
+	for _, tt := range []struct {
+		method string
+		params interface{}
+	}{
+		{"core.hello", nil},
+		{"vpn.status", nil},
+		{"vpn.lanClients", nil},
+		{"vpn.explain", ConnectParams{Link: "vless://u@example.com:443", SplitTunnelMode: "domain", SplitTunnelDomains: []string{"example.org"}}},
+		{"stats.transport", nil},
+		{"split.setConfig", SplitTunnelConfig{Mode: "app", Apps: []string{"chrome.exe"}}},
+		{"split.getConfig", nil},
+		{"split.capabilities", nil},
+		{"servers.deduplicate", DeduplicateParams{Links: []string{"vless://u@example.com:443", "bogus"}}},
+		{"servers.parseText", ParseTextParams{Text: "vless://u@example.com:443 ss://bad"}},
+		{"servers.decodeQr", DecodeQRParams{Image: qrPNG(t, "vless://u@example.com:443 ss://bad")}},
+		{"servers.performance", nil},
+		{"diagnostics.checkCompat", CheckCompatParams{Link: "vless://u@example.com:443"}},
+		{"debug.rpcStats", nil},
+		{"debug.getConfig", nil},
+		{"settings.get", nil},
+		{"settings.set", map[string]interface{}{"powerMode": "low"}},
+		{"profiles.list", nil},
+		{"profiles.health", nil},
+		{"profiles.suggestBest", nil},
+		{"meta.schema", MetaSchemaParams{Method: "meta.schema"}},
+	} {
+		resp := call(h, tt.method, tt.params)
+		if resp.Error != nil {
+			t.Errorf("%s: %+v", tt.method, resp.Error)
+			continue
+		}
+		data, err := json.Marshal(resp.Result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value, schema interface{}
+		json.Unmarshal(data, &value)
+		json.Unmarshal(embeddedSchemas().Methods[tt.method].Result, &schema)
+		if err := validate(schema.(map[string]interface{}), value, "result"); err != nil {
+			t.Errorf("%s: %v\n%s", tt.method, err, data)
+		}
+	}
+}
+
+// validate checks value against the subset of JSON Schema the generator
+// emits. Unlike JSON Schema, it rejects properties the schema does not
+// list, which catches a method returning a different type than its entry
+// in methodSchemaTypes.
+func validate(schema map[string]interface{}, value interface{}, path string) error {
+	if len(schema) == 0 {
+		return nil // any value
+	}
+	if types, ok := schema["type"]; ok {
+		var allowed []string
+		switch types := types.(type) {
+		case string:
+			allowed = []string{types}
+		case []interface{}:
+			for _, typ := range types {
+				allowed = append(allowed, typ.(string))
+			}
+		}
+		if !slices.Contains(allowed, jsonType(value)) && !(jsonType(value) == "integer" && slices.Contains(allowed, "number")) {
+			return fmt.Errorf("%s: %s, want %v", path, jsonType(value), types)
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && !slices.Contains(enum, value) {
+		return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := value[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", path, name)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		extra, _ := schema["additionalProperties"].(map[string]interface{})
+		for name, v := range value {
+			sub, ok := props[name].(map[string]interface{})
+			if !ok {
+				sub = extra
+			}
+			if sub == nil {
+				return fmt.Errorf("%s: unexpected property %s", path, name)
+			}
+			if err := validate(sub, v, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items, _ := schema["items"].(map[string]interface{})
+		for i, v := range value {
+			if err := validate(items, v, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == float64(int64(value)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
@@ -1,76 +1,127 @@
 package ipc
 
 import (
-	"bufio"
 	"encoding/json"
-	"io"
 	"log"
 	"net"
+	"runtime/debug"
 	"sync"
 	"time"
 
-	"github.com/Microsoft/go-winio"
+	"github.com/mriaz/vpn-core/internal/instance"
 )
 
 const maxClients = 10
-const maxMessageSize = 1 * 1024 * 1024 // 1MB max message size
-
-const pipeName = `\\.\pipe\MRVPN`
 
 // Server is the named pipe IPC server.
 type Server struct {
 	handler        *Handler
+	pipeName       string
 	listener       net.Listener
-	clients        map[net.Conn]bool
+	clients        map[net.Conn]*client
 	mu             sync.Mutex
 	done           chan struct{}
 	hadClient      bool
 	clientsDrained chan struct{}
+	closed         bool // clients closed; Broadcast and accept leave them alone
+	stopAccepting  sync.Once
+	shutdown       sync.Once
 }
 
-// NewServer creates a new IPC server with the given handler.
-func NewServer(handler *Handler) *Server {
+// NewServer creates a new IPC server with the given handler, listening on
+// the pipe of inst.
+func NewServer(handler *Handler, inst instance.Instance) *Server {
 	return &Server{
 		handler:        handler,
-		clients:        make(map[net.Conn]bool),
+		pipeName:       inst.PipeName(),
+		clients:        make(map[net.Conn]*client),
 		done:           make(chan struct{}),
 		clientsDrained: make(chan struct{}),
 	}
 }
 
-// Start begins listening on the named pipe.
+// Start begins listening on the named pipe, retrying a failure to create
+// it with listenBackoff.
 func (s *Server) Start() error {
-	listener, err := winio.ListenPipe(pipeName, &winio.PipeConfig{
-		SecurityDescriptor: "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;IU)", // SYSTEM + Admins + Interactive Users only
-		MessageMode:        false,
-		InputBufferSize:    65536,
-		OutputBufferSize:   1048576, // 1MB — app list with icons can be large
-	})
+	listener, err := listenWithRetry(func() (net.Listener, error) {
+		return listenPipe(s.pipeName)
+	}, listenBackoff, time.Sleep)
 	if err != nil {
 		return err
 	}
-	s.listener = listener
+	s.serve(listener)
+	log.Printf("IPC server listening on %s", s.pipeName)
+	return nil
+}
 
+// serve accepts clients on listener until the server stops.
+func (s *Server) serve(listener net.Listener) {
+	s.listener = listener
 	go s.acceptLoop()
-	log.Printf("IPC server listening on %s", pipeName)
-	return nil
 }
 
-// Stop shuts down the IPC server.
+// Stop closes the listener and every client at once, abandoning calls in
+// flight. It is safe to call more than once, and alongside Broadcast.
 func (s *Server) Stop() {
-	close(s.done)
-	if s.listener != nil {
-		s.listener.Close()
-	}
+	s.closeListener()
+	s.closeClients()
+}
+
+// Shutdown stops the server in order, so no call runs against a torn down
+// engine and no client is cut off mid-response:
+//
+//  1. the listener closes, so no client connects any more;
+//  2. every client is sent core.shuttingDown;
+//  3. new requests are refused with ErrKeyShuttingDown while those in
+//     flight get drain to finish, after which they are cancelled and get
+//     ErrKeyShuttingDown too;
+//  4. teardown runs, typically disconnecting the engine;
+//  5. the clients are closed.
+//
+// Only the first call of Shutdown does anything; Stop afterwards is a
+// no-op.
+func (s *Server) Shutdown(drain time.Duration, teardown func()) {
+	s.shutdown.Do(func() {
+		s.closeListener()
+		s.notifyAll(&Notification{Method: methodShuttingDown, Params: ShuttingDownParams{DrainMs: drain.Milliseconds()}})
+		if !s.handler.gate.drain(drain, shutdownCancelGrace) {
+			log.Printf("IPC calls still running %v after shutdown began, closing their clients anyway", drain+shutdownCancelGrace)
+		}
+		if teardown != nil {
+			teardown()
+		}
+		s.closeClients()
+	})
+}
+
+// closeListener stops accepting clients.
+func (s *Server) closeListener() {
+	s.stopAccepting.Do(func() {
+		close(s.done)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+}
+
+// closeClients closes every client connection and keeps new ones from
+// being added.
+func (s *Server) closeClients() {
 	s.mu.Lock()
-	for conn := range s.clients {
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for conn, c := range s.clients {
+		c.queue.close()
 		conn.Close()
 	}
-	s.mu.Unlock()
 }
 
-// Broadcast sends a notification to all connected clients.
-func (s *Server) Broadcast(notification *Notification) {
+// notifyAll queues a notification for every client, whatever it
+// subscribes to.
+func (s *Server) notifyAll(notification *Notification) {
 	data, err := json.Marshal(notification)
 	if err != nil {
 		log.Printf("failed to marshal notification: %v", err)
@@ -80,17 +131,38 @@ func (s *Server) Broadcast(notification *Notification) {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, c := range s.clients {
+		c.queue.push(notification.Method, data)
+	}
+}
 
-	var failed []net.Conn
-	for conn := range s.clients {
-		if _, err := conn.Write(data); err != nil {
-			log.Printf("failed to send notification to client: %v", err)
-			failed = append(failed, conn)
+// Broadcast queues a notification for the clients subscribed to topic. It
+// never waits for a client to read; see notifyQueue for what a client that
+// falls behind misses.
+func (s *Server) Broadcast(topic string, notification *Notification) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic broadcasting %s: %v\n%s", notification.Method, p, debug.Stack())
 		}
+	}()
+
+	data, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("failed to marshal notification: %v", err)
+		return
 	}
-	for _, conn := range failed {
-		delete(s.clients, conn)
-		conn.Close()
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, c := range s.clients {
+		c.deliver(topic, notification.Method, data)
 	}
 }
 
@@ -107,23 +179,64 @@ func (s *Server) acceptLoop() {
 			}
 		}
 
-		s.mu.Lock()
-		if len(s.clients) >= maxClients {
-			s.mu.Unlock()
-			log.Printf("rejecting connection: max clients (%d) reached", maxClients)
-			conn.Close()
+		if !s.hasRoom(conn) {
 			continue
 		}
-		s.clients[conn] = true
-		s.hadClient = true
-		s.mu.Unlock()
+		go s.admit(conn)
+	}
+}
 
-		go s.handleClient(conn)
+// hasRoom reports whether the server takes another client, closing conn if
+// not.
+func (s *Server) hasRoom(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	if len(s.clients) >= maxClients {
+		log.Printf("rejecting connection: max clients (%d) reached", maxClients)
+		conn.Close()
+		return false
 	}
+	return true
+}
+
+// admit identifies the client on conn and, if the allow-list admits it,
+// registers and serves it. A refused client is closed unregistered: it
+// gets no notifications and does not count toward ClientsDrained.
+func (s *Server) admit(conn net.Conn) {
+	id, ok := s.handler.admitConn(conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	c := newClient(&s.handler.notify)
+	c.identity = id
+
+	s.mu.Lock()
+	if s.closed || len(s.clients) >= maxClients {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.clients[conn] = c
+	s.hadClient = true
+	s.mu.Unlock()
+
+	go s.handleClient(conn, c)
+	go func() {
+		if err := c.queue.run(func(data []byte) error { return c.write(conn, data) }); err != nil {
+			log.Printf("failed to send notification to client: %v", err)
+			conn.Close() // ends handleClient, which cleans up
+		}
+	}()
 }
 
-func (s *Server) handleClient(conn net.Conn) {
+func (s *Server) handleClient(conn net.Conn, c *client) {
 	defer func() {
+		c.queue.close()
 		s.mu.Lock()
 		delete(s.clients, conn)
 		drained := len(s.clients) == 0 && s.hadClient
@@ -138,36 +251,7 @@ func (s *Server) handleClient(conn net.Conn) {
 		}
 	}()
 
-	scanner := bufio.NewScanner(conn)
-	scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
-	for scanner.Scan() {
-		// Reset read deadline after each successful message
-		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
-		}
-
-		var req Request
-		if err := json.Unmarshal(line, &req); err != nil {
-			resp := Response{
-				Error: &RPCError{
-					Code:    ErrCodeParseError,
-					Message: "invalid JSON",
-				},
-			}
-			s.sendResponse(conn, &resp)
-			continue
-		}
-
-		resp := s.handler.Handle(&req)
-		s.sendResponse(conn, resp)
-	}
-	if err := scanner.Err(); err != nil {
-		if err != io.EOF {
-			log.Printf("client read error: %v", err)
-		}
-	}
+	s.handler.serve(conn, c)
 }
 
 // ClientsDrained returns a channel that receives a signal when all clients
@@ -176,14 +260,9 @@ func (s *Server) ClientsDrained() <-chan struct{} {
 	return s.clientsDrained
 }
 
-func (s *Server) sendResponse(conn net.Conn, resp *Response) {
-	data, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("failed to marshal response: %v", err)
-		return
-	}
-	data = append(data, '\n')
-	if _, err := conn.Write(data); err != nil {
-		log.Printf("failed to send response: %v", err)
-	}
+// ClientCount returns the number of connected clients.
+func (s *Server) ClientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
 }
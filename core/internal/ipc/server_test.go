@@ -0,0 +1,220 @@
+package ipc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/settings"
+)
+
+// TestShutdownUnderLoad stops a server while clients keep sending calls,
+// some quick and some that only end when cancelled, and notifications are
+// broadcast. Every call that started must get its result or a shutting
+// down error, and none may still run when the engine is torn down.
+func TestShutdownUnderLoad(t *testing.T) {
+	h := newTestHandler(t)
+	var running atomic.Int32
+	started := make(map[string]bool)
+	var startedMu sync.Mutex
+	h.registry.register("test.work", func(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+		running.Add(1)
+		defer running.Add(-1)
+		var params struct {
+			ID    string `json:"id"`
+			Block bool   `json:"block"`
+		}
+		json.Unmarshal(raw, &params)
+		startedMu.Lock()
+		started[params.ID] = true
+		startedMu.Unlock()
+		if params.Block {
+			<-ctx.Done()
+			return nil, rpcError(ErrCodeInternal, ErrKeyInternal, "interrupted")
+		}
+		time.Sleep(5 * time.Millisecond)
+		return OKResult{OK: true}, nil
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{handler: h, clients: make(map[net.Conn]*client), done: make(chan struct{}), clientsDrained: make(chan struct{}, 1)}
+	s.serve(listener)
+
+	const clients = 6
+	type outcome struct {
+		responses map[string]*Response
+		notified  bool
+	}
+	outcomes := make([]outcome, clients)
+	var wg sync.WaitGroup
+	ready := make(chan struct{}, clients)
+	for i := 0; i < clients; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		outcomes[i].responses = make(map[string]*Response)
+		wg.Add(2)
+		go func(i int) { // sends until the connection closes
+			defer wg.Done()
+			ready <- struct{}{}
+			for n := 0; ; n++ {
+				id := fmt.Sprintf("%d-%d", i, n)
+				req := fmt.Sprintf(`{"id":%q,"method":"test.work","params":{"id":%q,"block":%v}}`+"\n", id, id, i == 0 && n == 3)
+				if _, err := conn.Write([]byte(req)); err != nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+		go func(i int) { // reads until the connection closes
+			defer wg.Done()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				var msg struct {
+					Response
+					Method string `json:"method"`
+				}
+				if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+					t.Errorf("client %d: %v", i, err)
+					continue
+				}
+				if msg.Method == methodShuttingDown {
+					outcomes[i].notified = true
+					continue
+				}
+				if msg.Method == "" {
+					resp := msg.Response
+					outcomes[i].responses[resp.ID] = &resp
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < clients; i++ {
+		<-ready
+	}
+	broadcastStop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-broadcastStop:
+				return
+			default:
+				s.Broadcast(TopicState, &Notification{Method: "vpn.stateChanged", Params: StateChangedParams{State: "connected"}})
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	var tornDown bool
+	s.Shutdown(200*time.Millisecond, func() {
+		tornDown = true
+		if n := running.Load(); n != 0 {
+			t.Errorf("%d calls still running at teardown", n)
+		}
+	})
+	s.Shutdown(time.Second, func() { t.Error("second shutdown ran its teardown") })
+	s.Stop()
+	close(broadcastStop)
+	s.Broadcast(TopicState, &Notification{Method: "vpn.stateChanged"}) // after close
+	wg.Wait()
+
+	if !tornDown {
+		t.Fatal("teardown did not run")
+	}
+	shuttingDown := 0
+	startedMu.Lock()
+	defer startedMu.Unlock()
+	for i, o := range outcomes {
+		if !o.notified {
+			t.Errorf("client %d was not sent %s", i, methodShuttingDown)
+		}
+		for id, resp := range o.responses {
+			switch {
+			case resp.Error == nil:
+			case resp.Error.Key == ErrKeyShuttingDown:
+				shuttingDown++
+			default:
+				t.Errorf("call %s: %+v", id, resp.Error)
+			}
+		}
+	}
+	for id := range started {
+		var i, n int
+		fmt.Sscanf(id, "%d-%d", &i, &n)
+		if outcomes[i].responses[id] == nil {
+			t.Errorf("call %s started but got no response", id)
+		}
+	}
+	if blocked := outcomes[0].responses["0-3"]; blocked == nil || blocked.Error == nil || blocked.Error.Key != ErrKeyShuttingDown {
+		t.Errorf("blocked call = %+v, want cancelled as shutting down", blocked)
+	}
+	if shuttingDown < clients {
+		t.Errorf("%d calls refused as shutting down, want at least one per client", shuttingDown)
+	}
+}
+
+// TestRefusedClientUnregistered checks that a client the allow-list
+// refuses is never registered: broadcasts sent while it is identified do
+// not reach it, and its disconnect does not signal ClientsDrained, which
+// would stop the service.
+func TestRefusedClientUnregistered(t *testing.T) {
+	h := newTestHandler(t)
+	h.settings = settings.Open(filepath.Join(t.TempDir(), settings.FileName), nil)
+	const token = "correct-horse-battery"
+	if resp := call(h, "settings.adminLock", AdminLockParams{Token: token}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if resp := call(h, "settings.set", map[string]interface{}{"allowedClientPaths": []string{appImage}, "adminToken": token}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	identifying := make(chan struct{})
+	release := make(chan struct{})
+	h.identify = func(net.Conn) *ClientIdentity {
+		close(identifying)
+		<-release
+		return &ClientIdentity{PID: 7, Image: `C:\Users\bob\Downloads\tool.exe`}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{handler: h, clients: make(map[net.Conn]*client), done: make(chan struct{}), clientsDrained: make(chan struct{}, 1)}
+	s.serve(listener)
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-identifying
+	s.Broadcast(TopicState, &Notification{Method: "vpn.stateChanged", Params: StateChangedParams{State: "connected"}})
+	if n := s.ClientCount(); n != 0 {
+		t.Errorf("%d clients registered while identifying", n)
+	}
+	close(release)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if data, err := io.ReadAll(conn); len(data) != 0 || err != nil {
+		t.Errorf("refused client read %q, %v; want nothing before the close", data, err)
+	}
+	select {
+	case <-s.ClientsDrained():
+		t.Error("a refused client signaled ClientsDrained")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,180 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/envscan"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// setup.verify lets the first-run screen show, before the user picks a
+// server, everything on this machine that would stop a connect or degrade
+// it. A failed check blocks connecting; a warning does not.
+
+// Setup check results.
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// Remediation keys of setup checks.
+const (
+	RemedyInstallService  = "setup.install_service"
+	RemedyStartService    = "setup.start_service"
+	RemedyAutoStart       = "setup.enable_autostart"
+	RemedyReinstallDriver = "setup.reinstall_driver"
+	RemedyConflictingVPN  = "setup.disable_conflicting_vpn"
+	RemedySyncClock       = "setup.sync_clock"
+	RemedyPowerShell      = "setup.enable_powershell"
+	RemedyRunElevated     = "setup.run_elevated"
+)
+
+// setupClockTimeout bounds the clock check, which needs the network.
+const setupClockTimeout = 5 * time.Second
+
+// ServiceStatus is the Windows service's registration as the service
+// manager reports it.
+type ServiceStatus struct {
+	Installed bool
+	Running   bool
+	AutoStart bool
+}
+
+// setupProbes are the system checks of setup.verify; replaced in tests.
+type setupProbes struct {
+	serviceStatus func() (ServiceStatus, error) // nil until SetServiceStatus
+	driver        func() vpn.DriverStatus
+	clockOffset   func(ctx context.Context) (time.Duration, error)
+	powerShell    func() bool
+	elevated      func() bool
+}
+
+// SetServiceStatus sets how setup.verify queries the service manager. The
+// service package cannot be imported here, as it imports this one.
+func (h *Handler) SetServiceStatus(status func() (ServiceStatus, error)) {
+	h.mu.Lock()
+	h.setup.serviceStatus = status
+	h.mu.Unlock()
+}
+
+func (h *Handler) handleSetupVerify(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	h.mu.RLock()
+	probes := h.setup
+	h.mu.RUnlock()
+
+	checks := []SetupCheck{
+		checkServiceSetup(probes.serviceStatus),
+		checkPipeSetup(ctx, h.engine.Instance().PipeName()),
+		checkDriverSetup(probes.driver()),
+		checkConflictsSetup(h.envScan()),
+		checkClockSetup(ctx, probes.clockOffset),
+		checkPowerShellSetup(probes.powerShell()),
+		checkElevationSetup(probes.elevated()),
+	}
+	result := SetupVerifyResult{Ready: true, Checks: checks}
+	for _, c := range checks {
+		if c.Result == CheckFail {
+			result.Ready = false
+		}
+	}
+	return result, nil
+}
+
+func checkServiceSetup(status func() (ServiceStatus, error)) SetupCheck {
+	c := SetupCheck{ID: "service"}
+	if status == nil {
+		c.Result, c.Detail = CheckWarn, "service status unavailable"
+		return c
+	}
+	s, err := status()
+	switch {
+	case err != nil && !s.Installed:
+		c.Result, c.Detail = CheckWarn, err.Error()
+	case !s.Installed:
+		c.Result, c.Detail, c.Remediation = CheckFail, "the MRVPN service is not installed", RemedyInstallService
+	case !s.Running:
+		// Something answered this call, so it runs from a console.
+		c.Result, c.Detail, c.Remediation = CheckWarn, "the MRVPN service is installed but stopped", RemedyStartService
+	case err != nil:
+		c.Result, c.Detail = CheckWarn, err.Error()
+	case !s.AutoStart:
+		c.Result, c.Detail, c.Remediation = CheckWarn, "the MRVPN service does not start with Windows", RemedyAutoStart
+	default:
+		c.Result = CheckPass
+	}
+	return c
+}
+
+// checkPipeSetup passes when the call came over the pipe, which shows the
+// app can reach the service.
+func checkPipeSetup(ctx context.Context, pipeName string) SetupCheck {
+	if requestClient(ctx) == nil {
+		return SetupCheck{ID: "pipe", Result: CheckWarn, Detail: "not called over " + pipeName}
+	}
+	return SetupCheck{ID: "pipe", Result: CheckPass}
+}
+
+func checkDriverSetup(status vpn.DriverStatus) SetupCheck {
+	c := SetupCheck{ID: "driver", Result: CheckPass, Detail: "wintun " + status.Version}
+	switch {
+	case !status.Loaded:
+		c.Result, c.Detail, c.Remediation = CheckFail, status.Error, RemedyReinstallDriver
+	case status.GhostAdapter:
+		c.Detail += "; a leftover adapter will be removed at connect"
+	}
+	return c
+}
+
+func checkConflictsSetup(env envscan.Report) SetupCheck {
+	c := SetupCheck{ID: "conflicts", Result: CheckPass}
+	if len(env.Findings) > 0 {
+		details := make([]string, len(env.Findings))
+		for i, f := range env.Findings {
+			details[i] = f.Detail
+		}
+		c.Result, c.Detail, c.Remediation = CheckWarn, strings.Join(details, "; "), RemedyConflictingVPN
+	} else if len(env.Errors) > 0 {
+		c.Result, c.Detail = CheckWarn, "scan incomplete: "+strings.Join(env.Errors, "; ")
+	}
+	return c
+}
+
+// checkClockSetup fails on a clock off by enough to break REALITY and TLS
+// handshakes. The check needs the network; when it cannot run, that is
+// only a warning.
+func checkClockSetup(ctx context.Context, offsetOf func(ctx context.Context) (time.Duration, error)) SetupCheck {
+	ctx, cancel := context.WithTimeout(ctx, setupClockTimeout)
+	defer cancel()
+	offset, err := offsetOf(ctx)
+	switch {
+	case err != nil:
+		return SetupCheck{ID: "clock", Result: CheckWarn, Detail: "clock could not be checked: " + err.Error()}
+	case vpn.ClockSkewed(offset):
+		return SetupCheck{ID: "clock", Result: CheckFail, Remediation: RemedySyncClock,
+			Detail: fmt.Sprintf("system clock is off by %s", offset.Round(time.Second))}
+	}
+	return SetupCheck{ID: "clock", Result: CheckPass}
+}
+
+// checkPowerShellSetup warns when PowerShell is blocked or constrained:
+// Store apps are then listed from the package repository only.
+func checkPowerShellSetup(ok bool) SetupCheck {
+	if !ok {
+		return SetupCheck{ID: "powershell", Result: CheckWarn, Remediation: RemedyPowerShell,
+			Detail: "PowerShell is blocked or runs in constrained language mode"}
+	}
+	return SetupCheck{ID: "powershell", Result: CheckPass}
+}
+
+func checkElevationSetup(elevated bool) SetupCheck {
+	if !elevated {
+		return SetupCheck{ID: "elevation", Result: CheckFail, Remediation: RemedyRunElevated,
+			Detail: "the service runs without administrator rights and cannot create the TUN adapter"}
+	}
+	return SetupCheck{ID: "elevation", Result: CheckPass}
+}
@@ -0,0 +1,116 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/envscan"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// healthySetup replaces the setup probes with those of a ready machine.
+func healthySetup(h *Handler) {
+	h.SetServiceStatus(func() (ServiceStatus, error) {
+		return ServiceStatus{Installed: true, Running: true, AutoStart: true}, nil
+	})
+	h.setup.driver = func() vpn.DriverStatus { return vpn.DriverStatus{Loaded: true, Version: "0.14"} }
+	h.setup.clockOffset = func(context.Context) (time.Duration, error) { return 2 * time.Second, nil }
+	h.setup.powerShell = func() bool { return true }
+	h.setup.elevated = func() bool { return true }
+	h.envScan = func() envscan.Report { return envscan.Report{} }
+}
+
+func verifySetup(t *testing.T, h *Handler) (SetupVerifyResult, map[string]SetupCheck) {
+	t.Helper()
+	resp := call(h, "setup.verify", nil)
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	result := resp.Result.(SetupVerifyResult)
+	checks := make(map[string]SetupCheck)
+	for _, c := range result.Checks {
+		checks[c.ID] = c
+	}
+	return result, checks
+}
+
+func TestSetupVerifyReady(t *testing.T) {
+	h := newTestHandler(t)
+	healthySetup(h)
+
+	result, checks := verifySetup(t, h)
+	if !result.Ready || len(result.Checks) != 7 {
+		t.Fatalf("result = %+v", result)
+	}
+	for id, c := range checks {
+		// Called in-process, not over the pipe.
+		if id == "pipe" {
+			continue
+		}
+		if c.Result != CheckPass || c.Remediation != "" {
+			t.Errorf("%s = %+v, want a pass", id, c)
+		}
+	}
+	if checks["pipe"].Result != CheckWarn {
+		t.Errorf("pipe = %+v, want a warning outside a client connection", checks["pipe"])
+	}
+}
+
+func TestSetupVerifyRemediation(t *testing.T) {
+	tests := []struct {
+		name   string
+		breaks func(h *Handler)
+		id     string
+		result string
+		remedy string
+	}{
+		{"service missing", func(h *Handler) {
+			h.SetServiceStatus(func() (ServiceStatus, error) { return ServiceStatus{}, nil })
+		}, "service", CheckFail, RemedyInstallService},
+		{"service stopped", func(h *Handler) {
+			h.SetServiceStatus(func() (ServiceStatus, error) { return ServiceStatus{Installed: true, AutoStart: true}, nil })
+		}, "service", CheckWarn, RemedyStartService},
+		{"manual start", func(h *Handler) {
+			h.SetServiceStatus(func() (ServiceStatus, error) { return ServiceStatus{Installed: true, Running: true}, nil })
+		}, "service", CheckWarn, RemedyAutoStart},
+		{"service manager unreachable", func(h *Handler) {
+			h.SetServiceStatus(func() (ServiceStatus, error) { return ServiceStatus{}, errors.New("access denied") })
+		}, "service", CheckWarn, ""},
+		{"driver blocked", func(h *Handler) {
+			h.setup.driver = func() vpn.DriverStatus { return vpn.DriverStatus{Error: "wintun.dll not found"} }
+		}, "driver", CheckFail, RemedyReinstallDriver},
+		{"other vpn", func(h *Handler) {
+			h.envScan = func() envscan.Report {
+				return envscan.Report{Findings: []envscan.Finding{{Kind: "adapter", Product: "OpenVPN", Detail: "OpenVPN adapter is up"}}}
+			}
+		}, "conflicts", CheckWarn, RemedyConflictingVPN},
+		{"clock skew", func(h *Handler) {
+			h.setup.clockOffset = func(context.Context) (time.Duration, error) { return -5 * time.Minute, nil }
+		}, "clock", CheckFail, RemedySyncClock},
+		{"clock unchecked", func(h *Handler) {
+			h.setup.clockOffset = func(context.Context) (time.Duration, error) { return 0, errors.New("offline") }
+		}, "clock", CheckWarn, ""},
+		{"constrained powershell", func(h *Handler) { h.setup.powerShell = func() bool { return false } },
+			"powershell", CheckWarn, RemedyPowerShell},
+		{"not elevated", func(h *Handler) { h.setup.elevated = func() bool { return false } },
+			"elevation", CheckFail, RemedyRunElevated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			healthySetup(h)
+			tt.breaks(h)
+
+			result, checks := verifySetup(t, h)
+			c := checks[tt.id]
+			if c.Result != tt.result || c.Remediation != tt.remedy || c.Detail == "" {
+				t.Errorf("%s = %+v, want %s with remediation %q", tt.id, c, tt.result, tt.remedy)
+			}
+			if result.Ready != (tt.result != CheckFail) {
+				t.Errorf("ready = %v with %s %s", result.Ready, tt.id, tt.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// methodShuttingDown tells every client, whatever it subscribes to, that
+// the service is stopping: calls it sends from now on are refused with
+// ErrKeyShuttingDown and its connection closes once the calls in flight
+// are done.
+const methodShuttingDown = "core.shuttingDown"
+
+// ShutdownDrain is how long Server.Shutdown lets calls in flight finish,
+// well inside the time the service control manager allows a stop.
+const ShutdownDrain = 5 * time.Second
+
+// shutdownCancelGrace is how long calls cancelled at the end of the drain
+// have to return their error before their clients are closed regardless.
+const shutdownCancelGrace = 2 * time.Second
+
+// errShuttingDown is the cause of the cancellation of calls still running
+// when the drain ends; cancelledError reports it as ErrKeyShuttingDown.
+var errShuttingDown = errors.New("shutting down")
+
+// shuttingDownError is the error of a call refused or cancelled by
+// shutdown.
+func shuttingDownError() *RPCError {
+	return rpcError(ErrCodeCancelled, ErrKeyShuttingDown, "service is shutting down")
+}
+
+// requestGate admits the requests of every client until shutdown and
+// tracks the ones in flight, so shutdown can wait for them.
+type requestGate struct {
+	mu     sync.Mutex
+	closed bool
+	active int
+	idle   chan struct{} // closed once the gate is closed and nothing runs
+
+	// ctx is the parent of every connection's context; it is cancelled
+	// with errShuttingDown when the drain runs out.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+func newRequestGate() *requestGate {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &requestGate{idle: make(chan struct{}), ctx: ctx, cancel: cancel}
+}
+
+// enter admits a request, which must then call leave, or reports false
+// once shutdown has begun.
+func (g *requestGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.active++
+	return true
+}
+
+// leave ends a request enter admitted.
+func (g *requestGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	if g.closed && g.active == 0 {
+		close(g.idle)
+	}
+}
+
+// drain refuses new requests and waits up to timeout for those in flight,
+// then cancels the rest and waits up to grace for them to return. It
+// reports whether every request finished.
+func (g *requestGate) drain(timeout, grace time.Duration) bool {
+	g.mu.Lock()
+	if !g.closed {
+		g.closed = true
+		if g.active == 0 {
+			close(g.idle)
+		}
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-g.idle:
+		return true
+	case <-time.After(timeout):
+	}
+	g.cancel(errShuttingDown)
+	select {
+	case <-g.idle:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
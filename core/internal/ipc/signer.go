@@ -0,0 +1,81 @@
+package ipc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modWintrust                        = windows.NewLazySystemDLL("wintrust.dll")
+	procWTHelperProvDataFromStateData  = modWintrust.NewProc("WTHelperProvDataFromStateData")
+	procWTHelperGetProvSignerFromChain = modWintrust.NewProc("WTHelperGetProvSignerFromChain")
+)
+
+// cryptProviderSgnr is the head of CRYPT_PROVIDER_SGNR, up to the
+// signer's certificate chain.
+type cryptProviderSgnr struct {
+	size       uint32
+	verifyAsOf windows.Filetime
+	chainLen   uint32
+	chain      *cryptProviderCert
+}
+
+// cryptProviderCert is the head of CRYPT_PROVIDER_CERT.
+type cryptProviderCert struct {
+	size uint32
+	cert *windows.CertContext
+}
+
+// verifyImageSigner checks the Authenticode signature of the executable
+// at image with WinVerifyTrust and returns the SHA-1 thumbprint of its
+// signing certificate, in hex. Revocation is not checked, so the check
+// never waits on the network.
+func verifyImageSigner(image string) (string, error) {
+	path, err := windows.UTF16PtrFromString(image)
+	if err != nil {
+		return "", err
+	}
+	file := &windows.WinTrustFileInfo{
+		Size:     uint32(unsafe.Sizeof(windows.WinTrustFileInfo{})),
+		FilePath: path,
+	}
+	data := &windows.WinTrustData{
+		Size:                            uint32(unsafe.Sizeof(windows.WinTrustData{})),
+		UIChoice:                        windows.WTD_UI_NONE,
+		RevocationChecks:                windows.WTD_REVOKE_NONE,
+		UnionChoice:                     windows.WTD_CHOICE_FILE,
+		StateAction:                     windows.WTD_STATEACTION_VERIFY,
+		FileOrCatalogOrBlobOrSgnrOrCert: unsafe.Pointer(file),
+		ProvFlags:                       windows.WTD_CACHE_ONLY_URL_RETRIEVAL,
+	}
+	verifyErr := windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, data)
+	defer func() {
+		data.StateAction = windows.WTD_STATEACTION_CLOSE
+		windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, data)
+	}()
+	if verifyErr != nil {
+		return "", verifyErr
+	}
+
+	provData, _, _ := procWTHelperProvDataFromStateData.Call(uintptr(data.StateData))
+	if provData == 0 {
+		return "", errors.New("no signature state")
+	}
+	signerPtr, _, _ := procWTHelperGetProvSignerFromChain.Call(provData, 0, 0, 0)
+	if signerPtr == 0 {
+		return "", errors.New("no signer")
+	}
+	// The signer lives in the state data, which WinVerifyTrust owns until
+	// the deferred close.
+	signer := *(**cryptProviderSgnr)(unsafe.Pointer(&signerPtr))
+	if signer.chainLen == 0 || signer.chain == nil || signer.chain.cert == nil {
+		return "", errors.New("signer has no certificate")
+	}
+	cert := signer.chain.cert
+	sum := sha1.Sum(unsafe.Slice(cert.EncodedCert, cert.Length))
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,203 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// mergeSplitConfig applies the split tunnel options of connect params to
+// the stored config; see ConnectParams for the rules.
+func mergeSplitConfig(params *ConnectParams, stored *SplitTunnelConfig) (SplitTunnelConfig, *RPCError) {
+	merged := SplitTunnelConfig{
+		Mode:                stored.Mode,
+		Apps:                stored.Apps,
+		Domains:             stored.Domains,
+		Invert:              stored.Invert,
+		DNSHijackExceptions: stored.DNSHijackExceptions,
+		DNSServers:          stored.DNSServers,
+	}
+	if params.SplitTunnelMode != "" {
+		merged.Mode = params.SplitTunnelMode
+	}
+	if params.SplitTunnelApps != nil {
+		merged.Apps = params.SplitTunnelApps
+	}
+	if params.SplitTunnelDomains != nil {
+		merged.Domains = params.SplitTunnelDomains
+	}
+	if params.SplitTunnelInvert != nil {
+		merged.Invert = *params.SplitTunnelInvert
+	}
+	if params.DNSHijackExceptions != nil {
+		merged.DNSHijackExceptions = params.DNSHijackExceptions
+	}
+	if rpcErr := validateSplitConfig(&merged); rpcErr != nil {
+		return SplitTunnelConfig{}, rpcErr
+	}
+
+	// A stored config may be mid-edit with an empty list; it is only
+	// refused once the params touch the mode or the list.
+	list, given, noun := merged.Apps, params.SplitTunnelApps != nil, "app"
+	if merged.Mode == "domain" {
+		list, given, noun = merged.Domains, params.SplitTunnelDomains != nil, "domain"
+	}
+	if merged.Mode != "off" && len(list) == 0 && (given || params.SplitTunnelMode != "") {
+		return SplitTunnelConfig{}, rpcErrorData(ErrCodeInvalidParams, ErrKeySplitEmptyList,
+			fmt.Sprintf("mode '%s' requires at least one %s or use the saved configuration", merged.Mode, noun),
+			map[string]interface{}{"mode": merged.Mode})
+	}
+	return merged, nil
+}
+
+// RunStaleAppsCheck reconciles the split tunnel app list against the
+// installed apps every interval until stop is closed.
+func (h *Handler) RunStaleAppsCheck(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !h.hasSplitApps() {
+				continue
+			}
+			installed, err := h.installedApps(context.Background(), 0)
+			if err != nil {
+				log.Printf("stale app check: %v", err)
+				continue
+			}
+			h.reconcileApps(installed)
+		}
+	}
+}
+
+func (h *Handler) hasSplitApps() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.splitConfig.Apps) > 0
+}
+
+// reconcileApps flags split tunnel app entries missing from installed and
+// running apps, remembers them for split.pruneStale and notifies the UI.
+func (h *Handler) reconcileApps(installed []splittunnel.AppInfo) []splittunnel.StaleEntry {
+	running, err := h.runningApps()
+	if err != nil {
+		log.Printf("warning: failed to list running apps: %v", err)
+	}
+
+	h.mu.Lock()
+	cfg := h.splitConfig
+	stale := splittunnel.FindStaleApps(cfg.Apps, cfg.AppPaths, installed, running)
+	h.stale = stale
+	notifier := h.notifier
+	h.mu.Unlock()
+
+	if len(stale) > 0 {
+		log.Printf("split tunnel: %d app entries no longer match an installed app", len(stale))
+		if notifier != nil {
+			notifier.Broadcast(TopicApps, &Notification{
+				Method: "split.staleEntries",
+				Params: StaleEntriesParams{Entries: stale},
+			})
+		}
+	}
+	return stale
+}
+
+func (h *Handler) handleSplitPruneStale(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params PruneStaleParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Only entries the last reconciliation flagged are removed, so a
+	// confirmation for an outdated list cannot drop a valid app.
+	flagged := make(map[string]bool, len(h.stale))
+	for _, e := range h.stale {
+		flagged[strings.ToLower(e.ExeName)] = true
+	}
+	remove := flagged
+	if len(params.ExeNames) > 0 {
+		remove = make(map[string]bool, len(params.ExeNames))
+		for _, exe := range params.ExeNames {
+			if key := strings.ToLower(exe); flagged[key] {
+				remove[key] = true
+			}
+		}
+	}
+
+	updated := *h.splitConfig
+	updated.Apps = []string{}
+	updated.AppPaths = nil
+	result := PruneStaleResult{Removed: []string{}}
+	for _, exe := range h.splitConfig.Apps {
+		if remove[strings.ToLower(exe)] {
+			result.Removed = append(result.Removed, exe)
+			continue
+		}
+		updated.Apps = append(updated.Apps, exe)
+		if path, ok := h.splitConfig.AppPaths[exe]; ok {
+			if updated.AppPaths == nil {
+				updated.AppPaths = make(map[string]string)
+			}
+			updated.AppPaths[exe] = path
+		}
+	}
+
+	remaining := h.stale[:0:0]
+	for _, e := range h.stale {
+		if !remove[strings.ToLower(e.ExeName)] {
+			remaining = append(remaining, e)
+		}
+	}
+	h.stale = remaining
+	h.splitConfig = &updated
+	result.Config = &updated
+	return result, nil
+}
+
+func (h *Handler) handleSplitCapabilities(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params SplitCapabilitiesParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+		}
+	}
+
+	result := SplitCapabilitiesResult{ConnectionMode: params.ConnectionMode, SniffMode: params.SniffMode}
+	if result.ConnectionMode == "" {
+		result.ConnectionMode = vpn.ConnectionTUN // the only mode sessions run in
+	}
+	if result.SniffMode == "" {
+		if cfg := h.engine.Config(); cfg != nil && h.stateMachine.State() != vpn.StateDisconnected {
+			result.SniffMode = cfg.SniffMode
+		}
+	}
+	if result.SniffMode == "" {
+		result.SniffMode = vpn.SniffFull
+	}
+
+	if result.ConnectionMode != vpn.ConnectionTUN && result.ConnectionMode != vpn.ConnectionProxy {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid connection mode",
+			map[string]interface{}{"connectionMode": result.ConnectionMode})
+	}
+	if err := (&vpn.Config{SniffMode: result.SniffMode}).ValidateTuning(); err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeyTuningInvalid, "invalid advanced options",
+			map[string]interface{}{"reason": err.Error()})
+	}
+	result.Modes = vpn.SplitCapabilities(result.ConnectionMode, result.SniffMode)
+	return result, nil
+}
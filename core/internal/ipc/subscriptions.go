@@ -0,0 +1,189 @@
+package ipc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/profiles"
+	"github.com/mriaz/vpn-core/internal/settings"
+)
+
+// subscriptionCheckInterval is how often RunSubscriptionUpdates looks for
+// subscriptions due for a refresh.
+const subscriptionCheckInterval = time.Minute
+
+// subscriptionProxy returns the upstream proxy of st, read at every fetch,
+// as the proxy subscriptions are fetched through.
+func subscriptionProxy(st *settings.Store) func() *url.URL {
+	return func() *url.URL {
+		if p := st.UpstreamProxy(); p != nil {
+			return p.URL()
+		}
+		return nil
+	}
+}
+
+// RunSubscriptionUpdates refreshes subscriptions as their auto-update
+// intervals come due, until stop is closed. Refreshes run one at a time on
+// this goroutine; a failed one backs its subscription off and the rest go
+// ahead.
+func (h *Handler) RunSubscriptionUpdates(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(subscriptionCheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, sub := range h.subscriptions.Due() {
+			if ctx.Err() != nil {
+				return
+			}
+			if _, _, err := h.refreshSubscription(ctx, sub.ID); err != nil {
+				log.Printf("subscriptions: refresh of %s failed: %v", sub.ID, err)
+			}
+		}
+		// Expiry draws near without a refresh.
+		h.checkQuotas()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshSubscription refreshes a subscription, forgets the health of the
+// profiles it removed and announces the result with subscriptions.updated.
+func (h *Handler) refreshSubscription(ctx context.Context, id string) (profiles.Subscription, profiles.SubscriptionDiff, error) {
+	sub, diff, err := h.subscriptions.Refresh(ctx, id)
+	if err != nil {
+		return sub, diff, err
+	}
+	for _, removed := range diff.RemovedIDs {
+		h.health.Forget(removed)
+	}
+	if diff.Added+diff.Removed+diff.Changed > 0 {
+		log.Printf("subscriptions: %s refreshed: %d added, %d removed, %d changed", id, diff.Added, diff.Removed, diff.Changed)
+	}
+
+	h.mu.RLock()
+	notifier := h.notifier
+	h.mu.RUnlock()
+	if notifier != nil {
+		notifier.Broadcast(TopicProfiles, &Notification{
+			Method: "subscriptions.updated",
+			Params: SubscriptionUpdatedParams{
+				ID:          sub.ID,
+				Name:        sub.Name,
+				Added:       diff.Added,
+				Removed:     diff.Removed,
+				Changed:     diff.Changed,
+				LastUpdated: sub.LastUpdated,
+			},
+		})
+	}
+	h.checkQuotas()
+	return sub, diff, nil
+}
+
+// checkQuotas broadcasts the subscription quota warnings that came due
+// with subscriptions.quotaWarning. Without a notifier they stay due.
+func (h *Handler) checkQuotas() {
+	h.mu.RLock()
+	notifier := h.notifier
+	h.mu.RUnlock()
+	if notifier == nil {
+		return
+	}
+	warnings, err := h.subscriptions.CheckQuotas()
+	if err != nil {
+		log.Printf("subscriptions: failed to record quota warnings: %v", err)
+	}
+	for _, w := range warnings {
+		log.Printf("subscriptions: %s quota warning %s", w.ID, w.Kind)
+		notifier.Broadcast(TopicProfiles, &Notification{Method: "subscriptions.quotaWarning", Params: w})
+	}
+}
+
+func (h *Handler) handleSubscriptionsList(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	return h.profiles.Subscriptions(), nil
+}
+
+func (h *Handler) handleSubscriptionsSave(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var sub profiles.Subscription
+	if err := json.Unmarshal(raw, &sub); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+	if err := sub.Validate(); err != nil {
+		return nil, rpcErrorData(ErrCodeInvalidParams, ErrKeySubscriptionInvalid, "invalid subscription",
+			map[string]interface{}{"reason": err.Error()})
+	}
+
+	saved, err := h.profiles.SaveSubscription(sub)
+	if errors.Is(err, profiles.ErrSubscriptionNotFound) {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeySubscriptionNotFound, "subscription not found")
+	}
+	if err != nil {
+		log.Printf("subscriptions.save failed: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyStorageFailed, "failed to save subscription")
+	}
+	return saved, nil
+}
+
+func (h *Handler) handleSubscriptionsDelete(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ProfileIDParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+
+	removed, err := h.profiles.DeleteSubscription(params.ID)
+	if errors.Is(err, profiles.ErrSubscriptionNotFound) {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeySubscriptionNotFound, "subscription not found")
+	}
+	for _, id := range removed {
+		h.health.Forget(id)
+	}
+	if err != nil {
+		log.Printf("subscriptions.delete failed: %v", err)
+		return nil, rpcError(ErrCodeInternal, ErrKeyStorageFailed, "failed to delete subscription")
+	}
+	return OKResult{OK: true}, nil
+}
+
+func (h *Handler) handleSubscriptionsRefresh(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ProfileIDParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+
+	sub, diff, err := h.refreshSubscription(ctx, params.ID)
+	if errors.Is(err, profiles.ErrSubscriptionNotFound) {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeySubscriptionNotFound, "subscription not found")
+	}
+	if err != nil {
+		return nil, rpcErrorData(ErrCodeInternal, ErrKeySubscriptionFailed, "failed to refresh subscription",
+			map[string]interface{}{"reason": err.Error(), "retryAt": sub.RetryAt})
+	}
+	return SubscriptionRefreshResult{Subscription: sub, Diff: diff}, nil
+}
+
+func (h *Handler) handleSubscriptionsInfo(ctx context.Context, raw json.RawMessage) (interface{}, *RPCError) {
+	var params ProfileIDParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeyInvalidParams, "invalid parameters")
+	}
+
+	sub, quota, ok := h.subscriptions.Info(params.ID)
+	if !ok {
+		return nil, rpcError(ErrCodeInvalidParams, ErrKeySubscriptionNotFound, "subscription not found")
+	}
+	return SubscriptionInfoResult{Subscription: sub, Quota: quota}, nil
+}
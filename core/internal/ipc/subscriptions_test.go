@@ -0,0 +1,98 @@
+package ipc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/profiles"
+)
+
+func TestSubscriptionMethods(t *testing.T) {
+	h := newTestHandler(t)
+	notifier := &recordingNotifier{}
+	h.SetNotifier(notifier)
+	payload, status := "vless://u@a.example.com:443#A\nhy2://p@b.example.com:443#B\n", http.StatusOK
+	userinfo := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userinfo != "" {
+			w.Header().Set("Subscription-Userinfo", userinfo)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+	// Fetches refuse loopback addresses other than a proxy's, so the test
+	// server serves the subscription as a forward proxy.
+	proxy, _ := url.Parse(srv.URL)
+	h.subscriptions = profiles.NewSubscriptionUpdater(h.profiles, func() *url.URL { return proxy })
+
+	if resp := call(h, "subscriptions.save", map[string]interface{}{"url": "ftp://sub.example.com/"}); resp.Error == nil || resp.Error.Key != ErrKeySubscriptionInvalid {
+		t.Errorf("save of an ftp URL: %+v", resp.Error)
+	}
+	resp := call(h, "subscriptions.save", map[string]interface{}{"name": "Provider", "url": "http://sub.example.com/list", "autoUpdateHours": 24})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	sub := resp.Result.(profiles.Subscription)
+
+	resp = call(h, "subscriptions.refresh", ProfileIDParams{ID: sub.ID})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if result := resp.Result.(SubscriptionRefreshResult); result.Diff.Added != 2 || result.Subscription.LastUpdated == 0 {
+		t.Errorf("refresh = %+v", result)
+	}
+	if len(notifier.sent) != 1 || notifier.topics[0] != TopicProfiles || notifier.sent[0].Method != "subscriptions.updated" {
+		t.Fatalf("notifications = %+v", notifier.sent)
+	}
+	if params := notifier.sent[0].Params.(SubscriptionUpdatedParams); params.ID != sub.ID || params.Added != 2 {
+		t.Errorf("subscriptions.updated = %+v", params)
+	}
+	if list := call(h, "profiles.list", nil).Result.([]profiles.Profile); len(list) != 2 {
+		t.Errorf("profiles = %+v", list)
+	}
+	if info := call(h, "subscriptions.info", ProfileIDParams{ID: sub.ID}).Result.(SubscriptionInfoResult); info.Subscription.ID != sub.ID || info.Quota != nil {
+		t.Errorf("info without a quota = %+v", info)
+	}
+
+	// A quota past 80% is reported by subscriptions.info and warned of.
+	userinfo = "upload=1GB; download=7.5GB; total=10GB"
+	if resp := call(h, "subscriptions.refresh", ProfileIDParams{ID: sub.ID}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if len(notifier.sent) != 3 || notifier.topics[2] != TopicProfiles || notifier.sent[2].Method != "subscriptions.quotaWarning" {
+		t.Fatalf("notifications = %+v", notifier.sent)
+	}
+	if w := notifier.sent[2].Params.(profiles.QuotaWarning); w.ID != sub.ID || w.Kind != profiles.QuotaWarnUsed80 || w.Status.PercentUsed != 85 {
+		t.Errorf("subscriptions.quotaWarning = %+v", w)
+	}
+	info := call(h, "subscriptions.info", ProfileIDParams{ID: sub.ID}).Result.(SubscriptionInfoResult)
+	if info.Quota == nil || info.Quota.Total != 10<<30 || info.Quota.PercentUsed != 85 || info.Quota.DaysUntilExpiry != nil {
+		t.Errorf("info = %+v", info.Quota)
+	}
+	notifier.sent, notifier.topics = notifier.sent[:1], notifier.topics[:1]
+
+	// A failed refresh reports when it is retried and leaves the profiles.
+	status = http.StatusBadGateway
+	resp = call(h, "subscriptions.refresh", ProfileIDParams{ID: sub.ID})
+	if resp.Error == nil || resp.Error.Key != ErrKeySubscriptionFailed || resp.Error.Data["retryAt"] == int64(0) {
+		t.Errorf("failed refresh: %+v", resp.Error)
+	}
+	if len(notifier.sent) != 1 || len(h.profiles.List()) != 2 {
+		t.Errorf("after a failure: %d notifications, %d profiles", len(notifier.sent), len(h.profiles.List()))
+	}
+
+	if resp := call(h, "subscriptions.delete", ProfileIDParams{ID: sub.ID}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if len(h.profiles.List()) != 0 || len(h.profiles.Subscriptions()) != 0 {
+		t.Errorf("after delete: %+v, %+v", h.profiles.List(), h.profiles.Subscriptions())
+	}
+	for _, method := range []string{"subscriptions.refresh", "subscriptions.delete", "subscriptions.info"} {
+		if resp := call(h, method, ProfileIDParams{ID: sub.ID}); resp.Error == nil || resp.Error.Key != ErrKeySubscriptionNotFound {
+			t.Errorf("%s of a deleted subscription: %+v", method, resp.Error)
+		}
+	}
+}
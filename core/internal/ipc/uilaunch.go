@@ -0,0 +1,127 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/settings"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// auditUILaunch is the audit log method of a UI started at logon.
+const auditUILaunch = "service.launchUi"
+
+// uiExeName is the UI executable the installer puts beside the service.
+const uiExeName = "MRVPN.exe"
+
+// installedUIPath returns the UI installed beside the service executable,
+// or "" if the service cannot tell where it runs from.
+func installedUIPath() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(exe), uiExeName)
+}
+
+// SetUILauncher sets how OnLogon starts the UI in a user's session,
+// returning its process ID. The service package cannot be imported here,
+// as it imports this one.
+func (h *Handler) SetUILauncher(launch func(sessionID uint32, path string) (uint32, error)) {
+	h.mu.Lock()
+	h.launchUI = launch
+	h.mu.Unlock()
+}
+
+// decideUILaunch reports whether a logon starts the UI, and if not, why.
+// It does with launchUiOnLogon on and a uiPath set, for a logon at the
+// console while the session is connected or a connect is pending: in
+// progress, as at boot while waiting for the network, or held off by a
+// captive portal.
+func decideUILaunch(s *settings.Settings, console bool, state vpn.State, connectPending bool) (bool, string) {
+	switch {
+	case !s.LaunchUIOnLogon:
+		return false, "launchUiOnLogon is off"
+	case !console:
+		return false, "not a console logon"
+	case s.UIPath == "":
+		return false, "no uiPath is set"
+	case state == vpn.StateConnected, state == vpn.StateConnecting, connectPending:
+		return true, ""
+	}
+	return false, "not connected and no connect is pending"
+}
+
+// OnLogon handles a user logging on to Windows session sessionID, at the
+// console or not, starting the UI there as decideUILaunch decides. The UI
+// must be the one installed beside the service, or pass a configured
+// client allow-list as it would to connect; with neither, nothing starts.
+// A launch is audited; its failure is logged and otherwise ignored.
+func (h *Handler) OnLogon(sessionID uint32, console bool) {
+	s := h.settings.Get()
+	launch, reason := decideUILaunch(&s, console, h.stateMachine.State(), h.captive.pending())
+	if !launch {
+		if s.LaunchUIOnLogon {
+			log.Printf("not starting the UI at the logon to session %d: %s", sessionID, reason)
+		}
+		return
+	}
+
+	h.mu.RLock()
+	launcher := h.launchUI
+	h.mu.RUnlock()
+	var pid uint32
+	var err error
+	switch {
+	case launcher == nil:
+		err = errors.New("the UI can only be started by the service")
+	case h.installedUI != "" && strings.EqualFold(filepath.Clean(s.UIPath), h.installedUI):
+	case s.ClientAllowListed():
+		err = h.admitImage(&s, s.UIPath)
+	default:
+		err = fmt.Errorf("%s is not the installed UI and no client allow-list is set", s.UIPath)
+	}
+	if err == nil {
+		pid, err = launcher(sessionID, s.UIPath)
+	}
+	if err != nil {
+		log.Printf("warning: failed to start the UI at the logon to session %d: %v", sessionID, err)
+	} else {
+		log.Printf("started the UI in session %d (pid %d)", sessionID, pid)
+	}
+	h.auditUILaunch(sessionID, s.UIPath, pid, err)
+}
+
+// auditUILaunch records a UI started at logon, or the attempt.
+func (h *Handler) auditUILaunch(sessionID uint32, path string, pid uint32, err error) {
+	h.mu.RLock()
+	l := h.audit
+	h.mu.RUnlock()
+	if l == nil {
+		return
+	}
+	entry := audit.Entry{
+		Time:    time.Now(),
+		Method:  auditUILaunch,
+		Actor:   audit.Actor{Origin: "logon"},
+		Outcome: audit.OutcomeOK,
+	}
+	params := map[string]interface{}{"sessionId": sessionID, "path": path}
+	if err != nil {
+		entry.Outcome = audit.OutcomeError
+		params["error"] = err.Error()
+	} else {
+		params["pid"] = pid
+	}
+	entry.Params, _ = json.Marshal(params)
+	if err := l.Append(entry); err != nil {
+		log.Printf("failed to write audit log: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/settings"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+func TestDecideUILaunch(t *testing.T) {
+	on := settings.Defaults()
+	on.LaunchUIOnLogon = true
+	on.UIPath = appImage
+	off := on
+	off.LaunchUIOnLogon = false
+	noPath := on
+	noPath.UIPath = ""
+
+	tests := []struct {
+		name    string
+		s       settings.Settings
+		console bool
+		state   vpn.State
+		pending bool
+		want    bool
+	}{
+		{"connected", on, true, vpn.StateConnected, false, true},
+		{"connecting at boot", on, true, vpn.StateConnecting, false, true},
+		{"connect held off by a portal", on, true, vpn.StateDisconnected, true, true},
+		{"disconnected", on, true, vpn.StateDisconnected, false, false},
+		{"error", on, true, vpn.StateError, false, false},
+		{"remote desktop logon", on, false, vpn.StateConnected, false, false},
+		{"option off", off, true, vpn.StateConnected, false, false},
+		{"no path", noPath, true, vpn.StateConnected, false, false},
+	}
+	for _, tt := range tests {
+		got, reason := decideUILaunch(&tt.s, tt.console, tt.state, tt.pending)
+		if got != tt.want || (!got && reason == "") {
+			t.Errorf("%s: decideUILaunch = %v, %q, want %v", tt.name, got, reason, tt.want)
+		}
+	}
+}
+
+func TestOnLogon(t *testing.T) {
+	h := newTestHandler(t)
+	auditPath := filepath.Join(t.TempDir(), audit.FileName)
+	h.SetAuditLog(audit.Open(auditPath, func() audit.Retention { return audit.DefaultRetention }))
+	h.verifySigner = func(string) (string, error) { return "", errors.New("TRUST_E_NOSIGNATURE") }
+	type launch struct {
+		session uint32
+		path    string
+	}
+	var launches []launch
+	launchErr := error(nil)
+	h.SetUILauncher(func(sessionID uint32, path string) (uint32, error) {
+		launches = append(launches, launch{sessionID, path})
+		return 4242, launchErr
+	})
+	h.stateMachine.SetState(vpn.StateConnected, nil)
+
+	// Off by default.
+	h.OnLogon(1, true)
+	if len(launches) != 0 {
+		t.Fatalf("launched with the option off: %v", launches)
+	}
+
+	// Turning it on takes the admin lock.
+	on := map[string]interface{}{"launchUiOnLogon": true, "uiPath": appImage}
+	if resp := call(h, "settings.set", on); resp.Error == nil || resp.Error.Key != ErrKeySettingsLocked {
+		t.Fatalf("unlocked: error = %+v", resp.Error)
+	}
+	const token = "correct-horse-battery"
+	if resp := call(h, "settings.adminLock", AdminLockParams{Token: token}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if resp := call(h, "settings.set", on); resp.Error == nil || resp.Error.Key != ErrKeySettingsLocked {
+		t.Fatalf("no token: error = %+v", resp.Error)
+	}
+	if resp := call(h, "settings.set", map[string]interface{}{"launchUiOnLogon": true, "uiPath": "mrvpn.exe", "adminToken": token}); resp.Error == nil || resp.Error.Key != ErrKeySettingsInvalid {
+		t.Errorf("relative uiPath: error = %+v", resp.Error)
+	}
+	on["adminToken"] = token
+	if resp := call(h, "settings.set", on); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+
+	// Neither the installed UI nor on an allow-list: refused.
+	h.installedUI = `C:\Program Files\Other\MRVPN.exe`
+	h.OnLogon(1, true)
+	if len(launches) != 0 {
+		t.Fatalf("launched an unchecked UI: %v", launches)
+	}
+
+	h.installedUI = `C:\PROGRAM FILES\MRVPN\MRVPN.EXE`
+	h.OnLogon(2, false) // Remote Desktop
+	h.OnLogon(1, true)
+	if len(launches) != 1 || launches[0] != (launch{1, appImage}) {
+		t.Fatalf("launches = %v", launches)
+	}
+
+	// A failed launch is only logged and audited.
+	launchErr = errors.New("ERROR_NO_TOKEN")
+	h.OnLogon(3, true)
+	launchErr = nil
+
+	// Elsewhere, the UI must pass the client allow-list.
+	h.installedUI = ""
+	if resp := call(h, "settings.set", map[string]interface{}{"allowedClientPaths": []string{`C:\Other\ui.exe`}, "adminToken": token}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	h.OnLogon(4, true)
+	if len(launches) != 2 {
+		t.Fatalf("launches = %v", launches)
+	}
+	if resp := call(h, "settings.set", map[string]interface{}{"allowedClientPaths": []string{appImage}, "adminToken": token}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	h.OnLogon(5, true)
+	if len(launches) != 3 || launches[2] != (launch{5, appImage}) {
+		t.Errorf("launches = %v", launches)
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e audit.Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if e.Method == auditUILaunch {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) != 5 {
+		t.Fatalf("got %d launch entries, want 5:\n%s", len(entries), data)
+	}
+	if e := entries[0]; e.Outcome != audit.OutcomeError || !strings.Contains(string(e.Params), "no client allow-list") {
+		t.Errorf("unchecked launch = %+v", e)
+	}
+	if e := entries[1]; e.Outcome != audit.OutcomeOK || e.Actor.Origin != "logon" || !strings.Contains(string(e.Params), `"pid":4242`) {
+		t.Errorf("launch = %+v", e)
+	}
+	if e := entries[2]; e.Outcome != audit.OutcomeError || !strings.Contains(string(e.Params), "ERROR_NO_TOKEN") {
+		t.Errorf("failed launch = %+v", e)
+	}
+	if e := entries[3]; e.Outcome != audit.OutcomeError || !strings.Contains(string(e.Params), "not an allowed client") {
+		t.Errorf("refused launch = %+v", e)
+	}
+	if e := entries[4]; e.Outcome != audit.OutcomeOK {
+		t.Errorf("allow-listed launch = %+v", e)
+	}
+}
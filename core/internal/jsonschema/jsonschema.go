@@ -0,0 +1,229 @@
+// Package jsonschema derives JSON Schema documents from Go types, following
+// the rules encoding/json marshals them by, so the UI can generate its
+// models from the same structs the service sends.
+package jsonschema
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Dialect is the JSON Schema version of generated schemas.
+const Dialect = "https://json-schema.org/draft/2020-12/schema"
+
+// Direction says which way a value travels, which decides what is required.
+type Direction int
+
+const (
+	// Input values are decoded, so a missing field keeps its zero value.
+	// Only fields tagged jsonschema:"required" are required.
+	Input Direction = iota
+	// Output values are encoded, so every field without omitempty is
+	// present and required.
+	Output
+)
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	rawMessageType    = reflect.TypeOf(json.RawMessage(nil))
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// For returns the schema of values of type t travelling in dir. Structs
+// are inlined, with their Go name as title. Besides the json tag, fields
+// may carry a jsonschema tag with comma-separated options:
+//
+//	required      the field is required in input too
+//	enum=a|b|c    the field is one of these strings
+//	description=  the rest of the tag, commas included, describes the field
+//
+// Types encoding/json cannot describe from their structure, such as
+// recursive structs, channels and custom MarshalJSON methods, are errors.
+func For(t reflect.Type, dir Direction) (map[string]interface{}, error) {
+	g := &generator{dir: dir}
+	return g.schema(t)
+}
+
+type generator struct {
+	dir   Direction
+	stack []reflect.Type // structs being expanded
+}
+
+func (g *generator) schema(t reflect.Type) (map[string]interface{}, error) {
+	if t.Kind() == reflect.Pointer {
+		s, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return nullable(s), nil
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}, nil
+	case t == rawMessageType:
+		return map[string]interface{}{}, nil
+	case t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType):
+		return nil, fmt.Errorf("%s has a custom JSON encoding", t)
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Interface:
+		return map[string]interface{}{}, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nullable(map[string]interface{}{"type": "string", "contentEncoding": "base64"}), nil
+		}
+		items, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return nullable(map[string]interface{}{"type": "array", "items": items}), nil
+	case reflect.Array:
+		items, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items, "minItems": t.Len(), "maxItems": t.Len()}, nil
+	case reflect.Map:
+		switch t.Key().Kind() {
+		case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			return nil, fmt.Errorf("%s: unsupported map key type", t)
+		}
+		values, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return nullable(map[string]interface{}{"type": "object", "additionalProperties": values}), nil
+	case reflect.Struct:
+		return g.object(t)
+	}
+	return nil, fmt.Errorf("%s: unsupported kind %s", t, t.Kind())
+}
+
+// nullable allows null for types encoding/json writes null for when nil.
+func nullable(s map[string]interface{}) map[string]interface{} {
+	if typ, ok := s["type"].(string); ok {
+		s["type"] = []string{typ, "null"}
+	}
+	return s
+}
+
+func (g *generator) object(t reflect.Type) (map[string]interface{}, error) {
+	for _, seen := range g.stack {
+		if seen == t {
+			return nil, fmt.Errorf("%s is recursive", t)
+		}
+	}
+	g.stack = append(g.stack, t)
+	defer func() { g.stack = g.stack[:len(g.stack)-1] }()
+
+	properties := map[string]interface{}{}
+	var required []string
+	if err := g.fields(t, properties, &required); err != nil {
+		return nil, err
+	}
+	s := map[string]interface{}{"type": "object", "properties": properties}
+	if t.Name() != "" {
+		s["title"] = t.Name()
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s, nil
+}
+
+// fields adds the properties of struct t. Untagged embedded structs are
+// flattened as encoding/json does; a field already named by the outer
+// struct wins.
+func (g *generator) fields(t reflect.Type, properties map[string]interface{}, required *[]string) error {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, ft)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if _, dup := properties[name]; dup {
+			continue
+		}
+
+		s, err := g.schema(f.Type)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+		if hasOption(opts, "string") {
+			s = map[string]interface{}{"type": "string"}
+		}
+		var isRequired bool
+		options, description, hasDescription := strings.Cut(f.Tag.Get("jsonschema"), "description=")
+		if hasDescription {
+			s["description"] = description
+		}
+		for _, opt := range strings.Split(options, ",") {
+			switch {
+			case opt == "":
+			case opt == "required":
+				isRequired = true
+			case strings.HasPrefix(opt, "enum="):
+				s["enum"] = strings.Split(strings.TrimPrefix(opt, "enum="), "|")
+			default:
+				return fmt.Errorf("%s.%s: unknown jsonschema option %q", t.Name(), f.Name, opt)
+			}
+		}
+		properties[name] = s
+		if isRequired || (g.dir == Output && !hasOption(opts, "omitempty")) {
+			*required = append(*required, name)
+		}
+	}
+	for _, et := range embedded {
+		if err := g.fields(et, properties, required); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasOption(opts, want string) bool {
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == want {
+			return true
+		}
+	}
+	return false
+}
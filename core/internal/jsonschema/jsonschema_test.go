@@ -0,0 +1,148 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type inner struct {
+	Level int `json:"level"`
+}
+
+type Base struct {
+	ID   string `json:"id"`
+	Name string `json:"name"` // shadowed by sample.Name
+}
+
+type sample struct {
+	Base
+	Name     string          `json:"name" jsonschema:"required"`
+	Mode     string          `json:"mode,omitempty" jsonschema:"enum=off|app|domain"`
+	Count    uint16          `json:"count"`
+	Ratio    float64         `json:"ratio,omitempty"`
+	Tags     []string        `json:"tags"`
+	Inner    *inner          `json:"inner,omitempty"`
+	Labels   map[string]int  `json:"labels,omitempty"`
+	Data     []byte          `json:"data,omitempty"`
+	At       time.Time       `json:"at"`
+	Until    *time.Time      `json:"until,omitempty"`
+	Addr     netip.Addr      `json:"addr,omitempty"`
+	Raw      json.RawMessage `json:"raw,omitempty"`
+	Any      interface{}     `json:"any,omitempty"`
+	Quoted   int64           `json:"quoted,string"`
+	Untagged bool
+	Skipped  string `json:"-"`
+	private  string
+	Pair     [2]int            `json:"pair,omitempty"`
+	ByID     map[int]*struct{} `json:"byId,omitempty"`
+}
+
+func TestFor(t *testing.T) {
+	s, err := For(reflect.TypeOf(sample{}), Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s["title"] != "sample" || s["type"] != "object" {
+		t.Errorf("schema = %v", s)
+	}
+	props := s["properties"].(map[string]interface{})
+	want := map[string]string{
+		"id":       `{"type":"string"}`,
+		"name":     `{"type":"string"}`,
+		"mode":     `{"enum":["off","app","domain"],"type":"string"}`,
+		"count":    `{"minimum":0,"type":"integer"}`,
+		"ratio":    `{"type":"number"}`,
+		"tags":     `{"items":{"type":"string"},"type":["array","null"]}`,
+		"inner":    `{"properties":{"level":{"type":"integer"}},"required":["level"],"title":"inner","type":["object","null"]}`,
+		"labels":   `{"additionalProperties":{"type":"integer"},"type":["object","null"]}`,
+		"data":     `{"contentEncoding":"base64","type":["string","null"]}`,
+		"at":       `{"format":"date-time","type":"string"}`,
+		"until":    `{"format":"date-time","type":["string","null"]}`,
+		"addr":     `{"type":"string"}`,
+		"raw":      `{}`,
+		"any":      `{}`,
+		"quoted":   `{"type":"string"}`,
+		"Untagged": `{"type":"boolean"}`,
+		"pair":     `{"items":{"type":"integer"},"maxItems":2,"minItems":2,"type":"array"}`,
+		"byId":     `{"additionalProperties":{"properties":{},"type":["object","null"]},"type":["object","null"]}`,
+	}
+	if len(props) != len(want) {
+		t.Errorf("properties = %v", props)
+	}
+	for name, w := range want {
+		got, _ := json.Marshal(props[name])
+		if string(got) != w {
+			t.Errorf("%s = %s, want %s", name, got, w)
+		}
+	}
+	wantRequired := []string{"name", "count", "tags", "at", "quoted", "Untagged", "id"}
+	if !reflect.DeepEqual(s["required"], wantRequired) {
+		t.Errorf("required = %v, want %v", s["required"], wantRequired)
+	}
+
+	s, err = For(reflect.TypeOf(sample{}), Input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"name"}; !reflect.DeepEqual(s["required"], want) {
+		t.Errorf("input required = %v, want %v", s["required"], want)
+	}
+}
+
+type recursive struct {
+	Children []recursive `json:"children"`
+}
+
+type custom struct{}
+
+func (custom) MarshalJSON() ([]byte, error) { return []byte("1"), nil }
+
+func TestForRejects(t *testing.T) {
+	for _, tt := range []struct {
+		value interface{}
+		want  string
+	}{
+		{recursive{}, "recursive"},
+		{struct {
+			C custom `json:"c"`
+		}{}, "custom JSON encoding"},
+		{struct {
+			C chan int `json:"c"`
+		}{}, "unsupported kind"},
+		{struct {
+			M map[bool]int `json:"m"`
+		}{}, "map key"},
+		{struct {
+			S string `json:"s" jsonschema:"optional"`
+		}{}, "unknown jsonschema option"},
+	} {
+		if _, err := For(reflect.TypeOf(tt.value), Output); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("For(%T) error = %v, want %q", tt.value, err, tt.want)
+		}
+	}
+}
+
+func TestForDescription(t *testing.T) {
+	type described struct {
+		N int    `json:"n" jsonschema:"required,description=bytes, counted since connect"`
+		M string `json:"m" jsonschema:"description=one of a|b"`
+	}
+	s, err := For(reflect.TypeOf(described{}), Input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := s["properties"].(map[string]interface{})
+	if got := props["n"].(map[string]interface{})["description"]; got != "bytes, counted since connect" {
+		t.Errorf("n description = %v", got)
+	}
+	if got := props["m"].(map[string]interface{})["description"]; got != "one of a|b" {
+		t.Errorf("m description = %v", got)
+	}
+	if !reflect.DeepEqual(s["required"], []string{"n"}) {
+		t.Errorf("required = %v", s["required"])
+	}
+}
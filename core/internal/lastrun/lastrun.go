@@ -0,0 +1,190 @@
+// Package lastrun keeps a summary of the service's current run on disk,
+// so that after a restart the previous run can be told apart as a clean
+// stop, a panic or an abrupt end (the process killed, a crash outside the
+// recovered goroutine, power loss), along with what the VPN was doing.
+//
+// The file is marked running while the service is up and rewritten on
+// every VPN state change; a run that ends without Recorder.End leaves it
+// marked running, which the next Start reports as EndAbrupt.
+package lastrun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileName is the summary file inside the data directory.
+const FileName = "lastrun.json"
+
+// ExitCodePanic is the process exit code after a recovered panic, distinct
+// from the 1 of a fatal startup error.
+const ExitCodePanic = 3
+
+// How a run ended.
+const (
+	EndStopped = "stopped" // shut down normally
+	EndPanic   = "panic"   // the service recovered a panic and exited
+	EndAbrupt  = "abrupt"  // the process went away without recording an end
+)
+
+// maxStackBytes caps the stack kept with a panic.
+const maxStackBytes = 16 << 10
+
+// Summary describes one run of the service.
+type Summary struct {
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"startedAt"`
+	// UpdatedAt is the time of the last write. For an abrupt end it is the
+	// last time the run is known to have been alive, and EndedAt is set
+	// from it.
+	UpdatedAt time.Time `json:"updatedAt"`
+	EndedAt   time.Time `json:"endedAt,omitempty"`
+	Running   bool      `json:"running"`
+	EndReason string    `json:"endReason,omitempty"`
+	// The last VPN state of the run, and the server while a connect or
+	// session was under way.
+	State  string `json:"state,omitempty"`
+	Server string `json:"server,omitempty"`
+	// Set for EndPanic.
+	Panic string `json:"panic,omitempty"`
+	Stack string `json:"stack,omitempty"`
+}
+
+// Recorder writes the summary of the current run.
+type Recorder struct {
+	path string
+	now  func() time.Time // replaced in tests
+
+	mu       sync.Mutex
+	current  Summary
+	previous *Summary
+}
+
+// Start reads the summary the previous run left at path, marking it
+// EndAbrupt if that run never recorded an end, and records the start of
+// this run. The recorder is usable even if the write fails.
+func Start(path string) (*Recorder, error) {
+	return start(path, time.Now)
+}
+
+func start(path string, now func() time.Time) (*Recorder, error) {
+	r := &Recorder{path: path, now: now}
+	prev, readErr := read(path)
+	if prev != nil && prev.Running {
+		prev.Running = false
+		prev.EndReason = EndAbrupt
+		prev.EndedAt = prev.UpdatedAt
+	}
+	r.previous = prev
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = Summary{PID: os.Getpid(), StartedAt: now(), Running: true}
+	if err := r.writeLocked(); err != nil {
+		return r, err
+	}
+	return r, readErr
+}
+
+// read loads a summary; a missing file is no previous run.
+func read(path string) (*Summary, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read last run summary: %w", err)
+	}
+	var s Summary
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse last run summary: %w", err)
+	}
+	return &s, nil
+}
+
+// Previous returns the summary of the previous run, nil if there was none
+// or it could not be read.
+func (r *Recorder) Previous() *Summary {
+	if r.previous == nil {
+		return nil
+	}
+	s := *r.previous
+	return &s
+}
+
+// SetState records the current VPN state and server, the empty string
+// when there is none.
+func (r *Recorder) SetState(state, server string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.current.Running {
+		return nil
+	}
+	r.current.State = state
+	r.current.Server = server
+	return r.writeLocked()
+}
+
+// End records how the run ended; later calls are ignored. panicValue and
+// stack are kept for EndPanic.
+func (r *Recorder) End(reason string, panicValue interface{}, stack []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.current.Running {
+		return nil
+	}
+	r.current.Running = false
+	r.current.EndReason = reason
+	if panicValue != nil {
+		r.current.Panic = fmt.Sprint(panicValue)
+		if len(stack) > maxStackBytes {
+			stack = stack[:maxStackBytes]
+		}
+		r.current.Stack = string(stack)
+	}
+	r.current.EndedAt = r.now()
+	return r.writeLocked()
+}
+
+// writeLocked writes the current summary to a temporary file, flushes it
+// to disk and renames it over the summary, so that a crash at any point
+// leaves either the old summary or the new one.
+func (r *Recorder) writeLocked() error {
+	r.current.UpdatedAt = r.now()
+	data, err := json.MarshalIndent(r.current, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
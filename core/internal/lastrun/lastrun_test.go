@@ -0,0 +1,120 @@
+package lastrun
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clock returns a now func starting at t and advancing a minute per call.
+func clock(t time.Time) func() time.Time {
+	return func() time.Time {
+		t = t.Add(time.Minute)
+		return t
+	}
+}
+
+func TestCleanStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	start0 := time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)
+
+	r, err := start(path, clock(start0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Previous() != nil {
+		t.Errorf("first run has a previous run: %+v", r.Previous())
+	}
+	r.SetState("connected", "DE Frankfurt")
+	r.SetState("disconnected", "")
+	if err := r.End(EndStopped, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Later ends and states do not overwrite the first end.
+	r.End(EndPanic, "late", nil)
+	r.SetState("connected", "late")
+
+	next, err := start(path, clock(start0.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := next.Previous()
+	if prev == nil || prev.Running || prev.EndReason != EndStopped || prev.State != "disconnected" || prev.Server != "" || prev.Panic != "" {
+		t.Fatalf("previous = %+v", prev)
+	}
+	if !prev.StartedAt.Equal(start0.Add(time.Minute)) || !prev.EndedAt.After(prev.StartedAt) {
+		t.Errorf("previous ran %v to %v", prev.StartedAt, prev.EndedAt)
+	}
+}
+
+func TestAbruptStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	start0 := time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)
+
+	r, _ := start(path, clock(start0))
+	r.SetState("connecting", "DE Frankfurt")
+	r.SetState("connected", "DE Frankfurt")
+	// The process is killed here: no End. A write cut short by the crash
+	// leaves a torn temporary file behind.
+	os.WriteFile(path+".tmp", []byte(`{"pid":1,"runn`), 0o644)
+
+	next, err := start(path, clock(start0.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := next.Previous()
+	if prev == nil || prev.Running || prev.EndReason != EndAbrupt || prev.State != "connected" || prev.Server != "DE Frankfurt" {
+		t.Fatalf("previous = %+v", prev)
+	}
+	// The end is the last time the run was seen alive: the fourth reading
+	// of the clock, by the write of the connected state.
+	if want := start0.Add(4 * time.Minute); !prev.EndedAt.Equal(want) {
+		t.Errorf("abrupt end at %v, want %v", prev.EndedAt, want)
+	}
+
+	// The run after a clean restart no longer reports the abrupt one.
+	next.End(EndStopped, nil, nil)
+	again, _ := start(path, clock(start0.Add(2*time.Hour)))
+	if prev := again.Previous(); prev == nil || prev.EndReason != EndStopped {
+		t.Errorf("previous after a clean run = %+v", prev)
+	}
+}
+
+func TestPanicEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	r, _ := start(path, clock(time.Now()))
+	r.SetState("connected", "NL")
+	stack := []byte(strings.Repeat("goroutine 1 [running]:\n", 2000))
+	if err := r.End(EndPanic, "runtime error: index out of range", stack); err != nil {
+		t.Fatal(err)
+	}
+
+	next, _ := start(path, clock(time.Now()))
+	prev := next.Previous()
+	if prev == nil || prev.EndReason != EndPanic || prev.Panic != "runtime error: index out of range" || prev.State != "connected" {
+		t.Fatalf("previous = %+v", prev)
+	}
+	if len(prev.Stack) != maxStackBytes || !strings.HasPrefix(prev.Stack, "goroutine 1") {
+		t.Errorf("stack of %d bytes", len(prev.Stack))
+	}
+}
+
+func TestUnreadableSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	os.WriteFile(path, []byte("not json"), 0o644)
+
+	r, err := start(path, clock(time.Now()))
+	if err == nil {
+		t.Error("corrupt summary not reported")
+	}
+	if r.Previous() != nil {
+		t.Errorf("previous = %+v", r.Previous())
+	}
+	// The current run is recorded regardless.
+	next, err := start(path, clock(time.Now()))
+	if err != nil || next.Previous() == nil || next.Previous().EndReason != EndAbrupt {
+		t.Errorf("after overwriting: %+v, %v", next.Previous(), err)
+	}
+}
@@ -0,0 +1,215 @@
+// Package netinfo takes an annotated snapshot of the IPv4 and IPv6 routing
+// tables and the network adapters, for diagnostics.routes: which routes
+// point at the MRVPN adapter, which defaults were there before it, and the
+// metrics Windows picks routes by.
+package netinfo
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Adapter is a network adapter as reported by the provider.
+type Adapter struct {
+	Index       uint32
+	LUID        uint64
+	Name        string // friendly name, e.g. "Wi-Fi"
+	Description string // driver description
+	Up          bool
+	IPv4Metric  uint32 // interface metric; 0 if IPv4 is not enabled
+	IPv6Metric  uint32 // interface metric; 0 if IPv6 is not enabled
+}
+
+// Route is an entry of the IPv4 or IPv6 routing table as reported by the
+// provider.
+type Route struct {
+	Prefix         netip.Prefix
+	NextHop        netip.Addr // unspecified for an on-link route
+	InterfaceIndex uint32
+	InterfaceLUID  uint64
+	Metric         uint32 // route metric, added to the interface metric
+	Protocol       uint32 // NL_ROUTE_PROTOCOL / MIB_IPFORWARD_PROTO
+}
+
+// Provider reads the routing tables and adapters. The Windows
+// implementation is WindowsProvider; tests use fakes.
+type Provider interface {
+	Adapters() ([]Adapter, error)
+	Routes() ([]Route, error)
+}
+
+// RouteEntry is an annotated route of a Snapshot.
+type RouteEntry struct {
+	Destination     string `json:"destination"` // prefix, e.g. "0.0.0.0/0"
+	NextHop         string `json:"nextHop"`     // gateway address, or "on-link"
+	Interface       string `json:"interface"`   // adapter name, or "interface N" if unknown
+	InterfaceIndex  uint32 `json:"interfaceIndex"`
+	InterfaceLUID   uint64 `json:"interfaceLuid"`
+	RouteMetric     uint32 `json:"routeMetric"`
+	InterfaceMetric uint32 `json:"interfaceMetric"`
+	Metric          uint32 `json:"metric"` // route plus interface metric, what Windows compares
+	Protocol        string `json:"protocol"`
+
+	OwnAdapter bool `json:"ownAdapter"` // points at the MRVPN adapter
+	Default    bool `json:"default"`    // a default route, or one of the /1 halves VPNs cover it with
+	// PreExistingDefault marks a default route of another adapter: the
+	// route traffic takes when the tunnel is down.
+	PreExistingDefault bool `json:"preExistingDefault"`
+	// Preferred marks the default route of a family with the lowest metric,
+	// or of each /1 half, which win over any /0 as longer prefixes.
+	Preferred bool `json:"preferred"`
+}
+
+// AdapterEntry is an adapter of a Snapshot.
+type AdapterEntry struct {
+	Index       uint32 `json:"index"`
+	LUID        uint64 `json:"luid"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Up          bool   `json:"up"`
+	IPv4Metric  uint32 `json:"ipv4Metric"`
+	IPv6Metric  uint32 `json:"ipv6Metric"`
+	OwnAdapter  bool   `json:"ownAdapter"`
+}
+
+// Snapshot is the routing tables and adapters at one point in time.
+// Provider failures are listed in Errors; the rest is still filled in.
+type Snapshot struct {
+	IPv4     []RouteEntry   `json:"ipv4"`
+	IPv6     []RouteEntry   `json:"ipv6"`
+	Adapters []AdapterEntry `json:"adapters"`
+	Errors   []string       `json:"errors,omitempty"`
+}
+
+// routeProtocols names the route protocols seen in practice.
+var routeProtocols = map[uint32]string{
+	1:     "other",
+	2:     "local",
+	3:     "netmgmt", // static, DHCP and router advertisement routes
+	4:     "icmp",
+	10002: "autostatic",
+	10006: "static",
+	10007: "static-non-dod",
+}
+
+// Take reads the routing tables and adapters through p and annotates them.
+// ownAdapter is the name of the MRVPN TUN adapter.
+func Take(p Provider, ownAdapter string) Snapshot {
+	snap := Snapshot{IPv4: []RouteEntry{}, IPv6: []RouteEntry{}, Adapters: []AdapterEntry{}}
+
+	adapters, err := p.Adapters()
+	if err != nil {
+		snap.Errors = append(snap.Errors, fmt.Sprintf("list adapters: %v", err))
+	}
+	byIndex := make(map[uint32]Adapter, len(adapters))
+	for _, a := range adapters {
+		byIndex[a.Index] = a
+		snap.Adapters = append(snap.Adapters, AdapterEntry{
+			Index:       a.Index,
+			LUID:        a.LUID,
+			Name:        a.Name,
+			Description: a.Description,
+			Up:          a.Up,
+			IPv4Metric:  a.IPv4Metric,
+			IPv6Metric:  a.IPv6Metric,
+			OwnAdapter:  isOwn(a.Name, ownAdapter),
+		})
+	}
+	slices.SortFunc(snap.Adapters, func(a, b AdapterEntry) int { return cmp.Compare(a.Index, b.Index) })
+
+	routes, err := p.Routes()
+	if err != nil {
+		snap.Errors = append(snap.Errors, fmt.Sprintf("read routes: %v", err))
+	}
+	sorted := slices.Clone(routes)
+	slices.SortStableFunc(sorted, compareRoutes)
+	for _, r := range sorted {
+		entry := annotate(r, byIndex, ownAdapter)
+		if r.Prefix.Addr().Is4() {
+			snap.IPv4 = append(snap.IPv4, entry)
+		} else {
+			snap.IPv6 = append(snap.IPv6, entry)
+		}
+	}
+	markPreferred(snap.IPv4)
+	markPreferred(snap.IPv6)
+	return snap
+}
+
+func isOwn(name, ownAdapter string) bool {
+	return ownAdapter != "" && strings.EqualFold(name, ownAdapter)
+}
+
+// annotate describes r, adding what its adapter says about it.
+func annotate(r Route, byIndex map[uint32]Adapter, ownAdapter string) RouteEntry {
+	entry := RouteEntry{
+		Destination:    r.Prefix.String(),
+		NextHop:        "on-link",
+		Interface:      fmt.Sprintf("interface %d", r.InterfaceIndex),
+		InterfaceIndex: r.InterfaceIndex,
+		InterfaceLUID:  r.InterfaceLUID,
+		RouteMetric:    r.Metric,
+		Protocol:       routeProtocols[r.Protocol],
+		Default:        r.Prefix.Bits() <= 1,
+	}
+	if r.NextHop.IsValid() && !r.NextHop.IsUnspecified() {
+		entry.NextHop = r.NextHop.String()
+	}
+	if entry.Protocol == "" {
+		entry.Protocol = fmt.Sprintf("protocol %d", r.Protocol)
+	}
+	if a, ok := byIndex[r.InterfaceIndex]; ok {
+		entry.Interface = a.Name
+		entry.OwnAdapter = isOwn(a.Name, ownAdapter)
+		if r.Prefix.Addr().Is4() {
+			entry.InterfaceMetric = a.IPv4Metric
+		} else {
+			entry.InterfaceMetric = a.IPv6Metric
+		}
+		if entry.InterfaceLUID == 0 {
+			entry.InterfaceLUID = a.LUID
+		}
+	}
+	entry.Metric = entry.RouteMetric + entry.InterfaceMetric
+	entry.PreExistingDefault = entry.Default && !entry.OwnAdapter
+	return entry
+}
+
+// markPreferred marks the default routes traffic to the internet takes:
+// among the longest default prefixes, the one with the lowest metric for
+// each, so both /1 halves when a VPN added them.
+func markPreferred(entries []RouteEntry) {
+	longest := -1
+	for _, e := range entries {
+		if e.Default {
+			longest = max(longest, netip.MustParsePrefix(e.Destination).Bits())
+		}
+	}
+	best := make(map[string]int)
+	for i, e := range entries {
+		if !e.Default || netip.MustParsePrefix(e.Destination).Bits() != longest {
+			continue
+		}
+		if j, ok := best[e.Destination]; !ok || e.Metric < entries[j].Metric {
+			best[e.Destination] = i
+		}
+	}
+	for _, i := range best {
+		entries[i].Preferred = true
+	}
+}
+
+// compareRoutes orders routes like route print: by destination address,
+// then prefix length, then metric.
+func compareRoutes(a, b Route) int {
+	if c := a.Prefix.Addr().Compare(b.Prefix.Addr()); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Prefix.Bits(), b.Prefix.Bits()); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Metric, b.Metric)
+}
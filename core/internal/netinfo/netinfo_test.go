@@ -0,0 +1,149 @@
+package netinfo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fixtureProvider serves tables captured from a machine, as stored in
+// testdata.
+type fixtureProvider struct {
+	adapters []Adapter
+	routes   []Route
+	err      error
+}
+
+func (p fixtureProvider) Adapters() ([]Adapter, error) { return p.adapters, p.err }
+func (p fixtureProvider) Routes() ([]Route, error)     { return p.routes, p.err }
+
+func loadFixture(t *testing.T, name string) fixtureProvider {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture struct {
+		Adapters []struct {
+			Index       uint32 `json:"index"`
+			LUID        uint64 `json:"luid"`
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Up          bool   `json:"up"`
+			IPv4Metric  uint32 `json:"ipv4Metric"`
+			IPv6Metric  uint32 `json:"ipv6Metric"`
+		} `json:"adapters"`
+		Routes []struct {
+			Prefix         netip.Prefix `json:"prefix"`
+			NextHop        netip.Addr   `json:"nextHop"`
+			InterfaceIndex uint32       `json:"interfaceIndex"`
+			InterfaceLUID  uint64       `json:"interfaceLuid"`
+			Metric         uint32       `json:"metric"`
+			Protocol       uint32       `json:"protocol"`
+		} `json:"routes"`
+	}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	var p fixtureProvider
+	for _, a := range fixture.Adapters {
+		p.adapters = append(p.adapters, Adapter(a))
+	}
+	for _, r := range fixture.Routes {
+		p.routes = append(p.routes, Route(r))
+	}
+	return p
+}
+
+// find returns the entries for destination, in table order.
+func find(entries []RouteEntry, destination string) []RouteEntry {
+	var out []RouteEntry
+	for _, e := range entries {
+		if e.Destination == destination {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestTakeConnected(t *testing.T) {
+	snap := Take(loadFixture(t, "connected.json"), "MRVPN")
+	if len(snap.IPv4) != 9 || len(snap.IPv6) != 5 || len(snap.Adapters) != 4 || len(snap.Errors) != 0 {
+		t.Fatalf("snapshot has %d IPv4 and %d IPv6 routes, %d adapters, errors %v",
+			len(snap.IPv4), len(snap.IPv6), len(snap.Adapters), snap.Errors)
+	}
+
+	for _, family := range [][]RouteEntry{snap.IPv4, snap.IPv6} {
+		defaults := find(family, family[0].Destination)
+		if len(defaults) != 2 {
+			t.Fatalf("defaults = %+v", defaults)
+		}
+		// The tunnel's metric 0 route on a metric 0 interface wins.
+		var own, wifi RouteEntry
+		for _, d := range defaults {
+			if d.OwnAdapter {
+				own = d
+			} else {
+				wifi = d
+			}
+		}
+		if !own.Default || own.PreExistingDefault || !own.Preferred || own.Interface != "MRVPN" || own.NextHop != "on-link" {
+			t.Errorf("tunnel default = %+v", own)
+		}
+		if !wifi.Default || !wifi.PreExistingDefault || wifi.Preferred || wifi.Interface != "Wi-Fi" || wifi.Metric != wifi.RouteMetric+35 {
+			t.Errorf("Wi-Fi default = %+v", wifi)
+		}
+	}
+
+	lan := find(snap.IPv4, "192.168.1.0/24")[0]
+	if lan.Default || lan.OwnAdapter || lan.Protocol != "local" || lan.Metric != 291 || lan.InterfaceLUID != 19984723346456576 {
+		t.Errorf("LAN route = %+v", lan)
+	}
+	if gw := find(snap.IPv6, "::/0"); gw[0].NextHop != "fe80::1" && gw[1].NextHop != "fe80::1" {
+		t.Errorf("IPv6 gateway lost: %+v", gw)
+	}
+	// Sorted like route print.
+	if snap.IPv4[0].Destination != "0.0.0.0/0" || snap.IPv4[len(snap.IPv4)-1].Destination != "224.0.0.0/4" {
+		t.Errorf("IPv4 order: first %s, last %s", snap.IPv4[0].Destination, snap.IPv4[len(snap.IPv4)-1].Destination)
+	}
+	for i, a := range snap.Adapters {
+		if a.OwnAdapter != (a.Name == "MRVPN") || i > 0 && a.Index < snap.Adapters[i-1].Index {
+			t.Errorf("adapter %+v", a)
+		}
+	}
+}
+
+func TestTakeSplitDefault(t *testing.T) {
+	// Another VPN covers the default route with two /1 halves, which win
+	// over it as longer prefixes.
+	snap := Take(loadFixture(t, "other_vpn.json"), "MRVPN")
+	for _, dest := range []string{"0.0.0.0/1", "128.0.0.0/1"} {
+		if half := find(snap.IPv4, dest)[0]; !half.Default || !half.PreExistingDefault || !half.Preferred || half.NextHop != "10.8.0.1" {
+			t.Errorf("%s = %+v", dest, half)
+		}
+	}
+	if whole := find(snap.IPv4, "0.0.0.0/0")[0]; !whole.Default || whole.Preferred {
+		t.Errorf("0.0.0.0/0 = %+v", whole)
+	}
+	if host := find(snap.IPv4, "198.51.100.7/32")[0]; host.Default || host.Interface != "Wi-Fi" {
+		t.Errorf("server route = %+v", host)
+	}
+	// A route of an interface the adapter list missed, with an unknown
+	// protocol, is still listed.
+	if orphan := find(snap.IPv4, "192.168.1.0/24")[0]; orphan.Interface != "interface 40" || orphan.Protocol != "protocol 99" || orphan.InterfaceMetric != 0 {
+		t.Errorf("orphan route = %+v", orphan)
+	}
+	if len(snap.IPv6) != 0 || snap.IPv6 == nil {
+		t.Errorf("IPv6 = %#v, want empty", snap.IPv6)
+	}
+}
+
+func TestTakeProviderErrors(t *testing.T) {
+	snap := Take(fixtureProvider{err: errors.New("access denied")}, "MRVPN")
+	if len(snap.Errors) != 2 || snap.IPv4 == nil || snap.Adapters == nil {
+		t.Errorf("snapshot = %+v", snap)
+	}
+}
@@ -0,0 +1,82 @@
+package netinfo
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// WindowsProvider reads adapters and routes from the IP Helper API.
+type WindowsProvider struct{}
+
+func (WindowsProvider) Adapters() ([]Adapter, error) {
+	size := uint32(15 * 1024)
+	for {
+		buf := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, windows.GAA_FLAG_INCLUDE_ALL_INTERFACES, 0, first, &size)
+		if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GetAdaptersAddresses: %w", err)
+		}
+
+		var adapters []Adapter
+		for a := first; a != nil; a = a.Next {
+			index := a.IfIndex
+			if index == 0 {
+				index = a.Ipv6IfIndex // IPv6-only adapter
+			}
+			adapters = append(adapters, Adapter{
+				Index:       index,
+				LUID:        a.Luid,
+				Name:        windows.UTF16PtrToString(a.FriendlyName),
+				Description: windows.UTF16PtrToString(a.Description),
+				Up:          a.OperStatus == windows.IfOperStatusUp,
+				IPv4Metric:  a.Ipv4Metric,
+				IPv6Metric:  a.Ipv6Metric,
+			})
+		}
+		return adapters, nil
+	}
+}
+
+func (WindowsProvider) Routes() ([]Route, error) {
+	var table *windows.MibIpForwardTable2
+	if err := windows.GetIpForwardTable2(windows.AF_UNSPEC, &table); err != nil {
+		return nil, fmt.Errorf("GetIpForwardTable2: %w", err)
+	}
+	defer windows.FreeMibTable(unsafe.Pointer(table))
+
+	var routes []Route
+	for _, row := range table.Rows() {
+		addr, ok := sockaddrAddr(&row.DestinationPrefix.Prefix)
+		if !ok {
+			continue
+		}
+		nextHop, _ := sockaddrAddr(&row.NextHop)
+		routes = append(routes, Route{
+			Prefix:         netip.PrefixFrom(addr, int(row.DestinationPrefix.PrefixLength)),
+			NextHop:        nextHop,
+			InterfaceIndex: row.InterfaceIndex,
+			InterfaceLUID:  row.InterfaceLuid,
+			Metric:         row.Metric,
+			Protocol:       row.Protocol,
+		})
+	}
+	return routes, nil
+}
+
+func sockaddrAddr(sa *windows.RawSockaddrInet) (netip.Addr, bool) {
+	switch sa.Family {
+	case windows.AF_INET:
+		return netip.AddrFrom4((*windows.RawSockaddrInet4)(unsafe.Pointer(sa)).Addr), true
+	case windows.AF_INET6:
+		return netip.AddrFrom16((*windows.RawSockaddrInet6)(unsafe.Pointer(sa)).Addr), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,118 @@
+// Package netready tells whether the machine has network access yet. With
+// automatic start the service often runs before the network stack is up
+// at boot, and the adapter takes a moment after a wake too; a connect made
+// then fails at once. Work the user did not ask for just now, such as an
+// auto-connect, waits on a Gate instead.
+package netready
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Level is a network connectivity level hint, as reported by Windows'
+// GetNetworkConnectivityHint (NL_NETWORK_CONNECTIVITY_LEVEL_HINT).
+type Level int
+
+const (
+	LevelUnknown                   Level = 0 // not yet determined, as early in boot
+	LevelNone                      Level = 1
+	LevelLocalAccess               Level = 2 // a network without verified internet access
+	LevelInternetAccess            Level = 3
+	LevelConstrainedInternetAccess Level = 4 // e.g. behind a captive portal
+	LevelHidden                    Level = 5 // not shown to the user; treated as available
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelNone:
+		return "none"
+	case LevelLocalAccess:
+		return "local access"
+	case LevelInternetAccess:
+		return "internet access"
+	case LevelConstrainedInternetAccess:
+		return "constrained internet access"
+	case LevelHidden:
+		return "hidden"
+	}
+	return "unknown"
+}
+
+// Available reports whether l is enough to try reaching a server. Local
+// access is not: at boot the adapter has a link well before Windows has
+// verified the route out. A constrained network is, as the connect is what
+// finds the captive portal.
+func (l Level) Available() bool {
+	return l == LevelInternetAccess || l == LevelConstrainedInternetAccess || l == LevelHidden
+}
+
+// ErrUnsupported is returned by a provider on Windows versions without the
+// connectivity hint (before Windows 10 2004). A gate then never waits.
+var ErrUnsupported = errors.New("network connectivity hint not supported")
+
+// Provider reads the current connectivity level. The Windows
+// implementation is WindowsProvider; tests use fakes.
+type Provider interface {
+	Level() (Level, error)
+}
+
+// pollInterval is how often a waiting gate reads the level again.
+const pollInterval = time.Second
+
+// Gate holds work back until the network is available.
+type Gate struct {
+	provider Provider
+	interval time.Duration    // replaced in tests
+	now      func() time.Time // replaced in tests
+}
+
+// NewGate returns a gate that reads the connectivity level from p.
+func NewGate(p Provider) *Gate {
+	return &Gate{provider: p, interval: pollInterval, now: time.Now}
+}
+
+// Result is the outcome of a wait.
+type Result struct {
+	Ready  bool          // the network became available; false if the wait gave up
+	Level  Level         // the last level read
+	Waited time.Duration // zero if the network was available at once
+	Err    error         // the provider's error, if it failed; the gate then does not wait
+}
+
+// Ready reports whether the network is available now. A provider that
+// cannot tell counts as available, so it never holds work back.
+func (g *Gate) Ready() bool {
+	level, err := g.provider.Level()
+	return err != nil || level.Available()
+}
+
+// Wait blocks until the network is available, max has passed or ctx is
+// done, whichever comes first. It returns at once if the provider fails.
+// Callers go ahead either way: a network whose internet access Windows
+// cannot verify, as where probes are blocked, may still reach the server.
+func (g *Gate) Wait(ctx context.Context, max time.Duration) Result {
+	start := g.now()
+	deadline := start.Add(max)
+	for {
+		level, err := g.provider.Level()
+		if err != nil || level.Available() {
+			return Result{Ready: true, Level: level, Waited: g.now().Sub(start), Err: err}
+		}
+		wait := g.interval
+		if left := deadline.Sub(g.now()); left < wait {
+			wait = left
+		}
+		if wait <= 0 {
+			return Result{Level: level, Waited: g.now().Sub(start)}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Result{Level: level, Waited: g.now().Sub(start)}
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package netready
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider reports levels in turn, repeating the last one.
+type fakeProvider struct {
+	mu     sync.Mutex
+	levels []Level
+	err    error
+	reads  int
+}
+
+func (f *fakeProvider) Level() (Level, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reads++
+	if f.err != nil {
+		return LevelUnknown, f.err
+	}
+	level := f.levels[0]
+	if len(f.levels) > 1 {
+		f.levels = f.levels[1:]
+	}
+	return level, nil
+}
+
+func newTestGate(p Provider) *Gate {
+	g := NewGate(p)
+	g.interval = time.Millisecond
+	return g
+}
+
+func TestWaitReadyAtOnce(t *testing.T) {
+	p := &fakeProvider{levels: []Level{LevelInternetAccess}}
+	res := newTestGate(p).Wait(context.Background(), time.Minute)
+	if !res.Ready || res.Level != LevelInternetAccess || p.reads != 1 {
+		t.Errorf("got %+v after %d reads, want ready after 1", res, p.reads)
+	}
+}
+
+func TestWaitUntilAvailable(t *testing.T) {
+	// Boot: nothing, then a link, then verified internet access.
+	p := &fakeProvider{levels: []Level{LevelUnknown, LevelNone, LevelLocalAccess, LevelLocalAccess, LevelInternetAccess}}
+	res := newTestGate(p).Wait(context.Background(), time.Minute)
+	if !res.Ready || res.Level != LevelInternetAccess || p.reads != 5 {
+		t.Errorf("got %+v after %d reads, want ready after 5", res, p.reads)
+	}
+	if res.Waited <= 0 {
+		t.Errorf("waited %v, want > 0", res.Waited)
+	}
+}
+
+func TestWaitGivesUpAfterMax(t *testing.T) {
+	p := &fakeProvider{levels: []Level{LevelLocalAccess}}
+	g := newTestGate(p)
+	start := time.Now()
+	res := g.Wait(context.Background(), 30*time.Millisecond)
+	if res.Ready || res.Level != LevelLocalAccess {
+		t.Errorf("got %+v, want not ready at local access", res)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond || elapsed > time.Second {
+		t.Errorf("gave up after %v, want about 30ms", elapsed)
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	p := &fakeProvider{levels: []Level{LevelNone}}
+	g := newTestGate(p)
+	g.interval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	done := make(chan Result)
+	go func() { done <- g.Wait(ctx, time.Hour) }()
+	select {
+	case res := <-done:
+		if res.Ready {
+			t.Errorf("got %+v, want not ready", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return on cancel")
+	}
+}
+
+func TestProviderErrorDoesNotWait(t *testing.T) {
+	p := &fakeProvider{err: ErrUnsupported}
+	g := newTestGate(p)
+	res := g.Wait(context.Background(), time.Minute)
+	if !res.Ready || !errors.Is(res.Err, ErrUnsupported) || p.reads != 1 {
+		t.Errorf("got %+v after %d reads, want ready with the error after 1", res, p.reads)
+	}
+	if !g.Ready() {
+		t.Error("Ready() = false for a provider that cannot tell")
+	}
+}
+
+func TestLevelAvailable(t *testing.T) {
+	for level, want := range map[Level]bool{
+		LevelUnknown:                   false,
+		LevelNone:                      false,
+		LevelLocalAccess:               false,
+		LevelInternetAccess:            true,
+		LevelConstrainedInternetAccess: true,
+		LevelHidden:                    true,
+	} {
+		if got := level.Available(); got != want {
+			t.Errorf("%s: Available() = %v, want %v", level, got, want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package netready
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modiphlpapi                    = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetNetworkConnectivityHint = modiphlpapi.NewProc("GetNetworkConnectivityHint")
+)
+
+// connectivityHint is NL_NETWORK_CONNECTIVITY_HINT.
+type connectivityHint struct {
+	level            int32
+	costHint         int32
+	approachingLimit uint8
+	overDataLimit    uint8
+	roaming          uint8
+}
+
+// WindowsProvider reads the system-wide connectivity hint of the IP Helper
+// API, which Windows updates as adapters come up and its internet probes
+// succeed.
+type WindowsProvider struct{}
+
+func (WindowsProvider) Level() (Level, error) {
+	if err := procGetNetworkConnectivityHint.Find(); err != nil {
+		return LevelUnknown, ErrUnsupported
+	}
+	var hint connectivityHint
+	r, _, _ := procGetNetworkConnectivityHint.Call(uintptr(unsafe.Pointer(&hint)))
+	if r != 0 {
+		return LevelUnknown, fmt.Errorf("GetNetworkConnectivityHint: %w", windows.Errno(r))
+	}
+	return Level(hint.level), nil
+}
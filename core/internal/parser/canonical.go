@@ -0,0 +1,167 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CanonicalKey returns a stable identity for the server a config reaches:
+// protocol, address, port, credential and the params that change which
+// endpoint is contacted or how it authenticates. Cosmetic and tuning params
+// (name, fingerprint, early data, bandwidth hints) are ignored, so links
+// that differ only in those produce the same key.
+//
+// The key is a hash, so it can be shown or stored without exposing the
+// credential.
+func CanonicalKey(cfg *ServerConfig) string {
+	values := identityParams(cfg)
+	identity := strings.Join([]string{
+		cfg.Protocol,
+		canonicalHost(cfg.Address),
+		strconv.Itoa(int(cfg.Port)),
+		values.Encode(), // sorted by key
+	}, "\n")
+	sum := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(sum[:16])
+}
+
+// identityParams returns the identity-relevant params of cfg in canonical
+// form.
+func identityParams(cfg *ServerConfig) url.Values {
+	p := cfg.Params
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+
+	switch cfg.Protocol {
+	case "vless":
+		// UUIDs compare case-insensitively.
+		set("uuid", strings.ToLower(p["uuid"]))
+		set("type", p["type"])
+		set("security", p["security"])
+		set("flow", p["flow"])
+
+		// Transport params only count for the transports that read them.
+		switch p["type"] {
+		case "ws":
+			path, _, _ := WSEarlyData(p) // early data and headers are tuning, not identity
+			set("path", defaultPath(path))
+			set("host", strings.ToLower(p["host"]))
+		case "h2", "http", "httpupgrade", "xhttp", "splithttp":
+			set("path", defaultPath(p["path"]))
+			set("host", strings.ToLower(p["host"]))
+		case "grpc":
+			set("serviceName", p["serviceName"])
+		}
+
+		switch p["security"] {
+		case "tls":
+			set("sni", canonicalSNI(p["sni"], cfg.Address))
+			set("alpn", canonicalALPN(p["alpn"]))
+		case "reality":
+			set("sni", canonicalSNI(p["sni"], cfg.Address))
+			set("pbk", p["pbk"])
+			set("sid", strings.ToLower(p["sid"]))
+		}
+
+	case "hysteria2":
+		set("password", p["password"])
+		set("sni", canonicalSNI(p["sni"], cfg.Address))
+		set("alpn", canonicalALPN(p["alpn"]))
+		if p["obfs"] != "" {
+			set("obfs", p["obfs"])
+			set("obfs-password", p["obfs-password"])
+		}
+	}
+	return v
+}
+
+// canonicalHost lowercases hostnames and normalizes IP literals.
+func canonicalHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// canonicalSNI resolves an empty SNI to the server address, which is what
+// the TLS client sends in that case.
+func canonicalSNI(sni, address string) string {
+	if sni == "" {
+		return canonicalHost(address)
+	}
+	return canonicalHost(sni)
+}
+
+// canonicalALPN treats ALPN as a set: order and duplicates don't change
+// which protocols the server may pick.
+func canonicalALPN(alpn string) string {
+	seen := map[string]bool{}
+	var protos []string
+	for _, proto := range strings.Split(alpn, ",") {
+		proto = strings.TrimSpace(proto)
+		if proto != "" && !seen[proto] {
+			seen[proto] = true
+			protos = append(protos, proto)
+		}
+	}
+	sort.Strings(protos)
+	return strings.Join(protos, ",")
+}
+
+func defaultPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// DuplicateGroup is a set of configs with the same CanonicalKey.
+type DuplicateGroup struct {
+	Key       string
+	Members   []int // indices into the input, ascending
+	Canonical int   // suggested entry to keep
+}
+
+// FindDuplicates groups configs by CanonicalKey and returns the groups
+// with more than one member, in order of first occurrence. Nil entries are
+// skipped. The suggested canonical entry is the one carrying the most
+// params, since duplicates often differ in optional extras such as the
+// fingerprint; ties go to the earliest.
+func FindDuplicates(cfgs []*ServerConfig) []DuplicateGroup {
+	byKey := map[string]int{} // key -> index into groups
+	var groups []DuplicateGroup
+	for i, cfg := range cfgs {
+		if cfg == nil {
+			continue
+		}
+		key := CanonicalKey(cfg)
+		g, ok := byKey[key]
+		if !ok {
+			byKey[key] = len(groups)
+			groups = append(groups, DuplicateGroup{Key: key, Members: []int{i}, Canonical: i})
+			continue
+		}
+		groups[g].Members = append(groups[g].Members, i)
+		if len(cfg.Params) > len(cfgs[groups[g].Canonical].Params) {
+			groups[g].Canonical = i
+		}
+	}
+
+	dups := groups[:0]
+	for _, g := range groups {
+		if len(g.Members) > 1 {
+			dups = append(dups, g)
+		}
+	}
+	return dups
+}
@@ -0,0 +1,120 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+// TestCanonicalKey records, per protocol, which link differences change a
+// server's identity.
+func TestCanonicalKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		// Cosmetic or order-only differences.
+		{"name fragment", "vless://" + testUUID + "@example.com:443?security=tls#A", "vless://" + testUUID + "@example.com:443?security=tls#B", true},
+		{"param order", "vless://" + testUUID + "@example.com:443?security=tls&type=ws&path=%2Fws", "vless://" + testUUID + "@example.com:443?path=%2Fws&type=ws&security=tls", true},
+		{"host case", "vless://" + testUUID + "@Example.COM:443", "vless://" + testUUID + "@example.com:443", true},
+		{"uuid case", "vless://B831381D-6324-4D53-AD4F-8CDA48B30811@example.com:443", "vless://" + testUUID + "@example.com:443", true},
+		{"default port", "vless://" + testUUID + "@example.com", "vless://" + testUUID + "@example.com:443", true},
+		{"explicit defaults", "vless://" + testUUID + "@example.com:443?type=tcp&security=none", "vless://" + testUUID + "@example.com:443", true},
+		{"fingerprint", "vless://" + testUUID + "@example.com:443?security=tls&fp=chrome", "vless://" + testUUID + "@example.com:443?security=tls&fp=firefox", true},
+		{"alpn order", "vless://" + testUUID + "@example.com:443?security=tls&alpn=h2,http/1.1", "vless://" + testUUID + "@example.com:443?security=tls&alpn=http/1.1,h2", true},
+		{"sni equal to address", "vless://" + testUUID + "@example.com:443?security=tls&sni=example.com", "vless://" + testUUID + "@example.com:443?security=tls", true},
+		{"ws early data", "vless://" + testUUID + "@example.com:443?type=ws&path=%2Fws%3Fed%3D2048", "vless://" + testUUID + "@example.com:443?type=ws&path=%2Fws", true},
+		{"ws empty path", "vless://" + testUUID + "@example.com:443?type=ws", "vless://" + testUUID + "@example.com:443?type=ws&path=%2F", true},
+		{"path on tcp ignored", "vless://" + testUUID + "@example.com:443?path=%2Fx", "vless://" + testUUID + "@example.com:443", true},
+		{"sni without tls ignored", "vless://" + testUUID + "@example.com:443?sni=other.com", "vless://" + testUUID + "@example.com:443", true},
+		{"ipv6 literal", "vless://" + testUUID + "@[2001:DB8::1]:443", "vless://" + testUUID + "@[2001:db8:0::1]:443", true},
+		{"hy2 scheme alias", "hy2://secret@example.com:443", "hysteria2://secret@example.com:443", true},
+		{"hy2 bandwidth hints", "hy2://secret@example.com:443?up=100&down=500", "hy2://secret@example.com:443", true},
+		{"hy2 insecure", "hy2://secret@example.com:443?insecure=1", "hy2://secret@example.com:443", true},
+
+		// Identity-relevant differences.
+		{"protocol", "vless://secret@example.com:443", "hy2://secret@example.com:443", false},
+		{"address", "vless://" + testUUID + "@a.example.com:443", "vless://" + testUUID + "@b.example.com:443", false},
+		{"port", "vless://" + testUUID + "@example.com:443", "vless://" + testUUID + "@example.com:8443", false},
+		{"uuid", "vless://" + testUUID + "@example.com:443", "vless://00000000-6324-4d53-ad4f-8cda48b30811@example.com:443", false},
+		{"transport", "vless://" + testUUID + "@example.com:443?type=ws", "vless://" + testUUID + "@example.com:443?type=grpc", false},
+		{"security", "vless://" + testUUID + "@example.com:443?security=tls", "vless://" + testUUID + "@example.com:443", false},
+		{"flow", "vless://" + testUUID + "@example.com:443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&flow=xtls-rprx-vision", "vless://" + testUUID + "@example.com:443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc", false},
+		{"sni", "vless://" + testUUID + "@example.com:443?security=tls&sni=a.com", "vless://" + testUUID + "@example.com:443?security=tls&sni=b.com", false},
+		{"alpn set", "vless://" + testUUID + "@example.com:443?security=tls&alpn=h2", "vless://" + testUUID + "@example.com:443?security=tls&alpn=h2,http/1.1", false},
+		{"ws path", "vless://" + testUUID + "@example.com:443?type=ws&path=%2Fa", "vless://" + testUUID + "@example.com:443?type=ws&path=%2Fb", false},
+		{"ws host", "vless://" + testUUID + "@example.com:443?type=ws&host=a.com", "vless://" + testUUID + "@example.com:443?type=ws&host=b.com", false},
+		{"grpc service", "vless://" + testUUID + "@example.com:443?type=grpc&serviceName=a", "vless://" + testUUID + "@example.com:443?type=grpc&serviceName=b", false},
+		{"reality public key", "vless://" + testUUID + "@example.com:443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc", "vless://" + testUUID + "@example.com:443?security=reality&pbk=ZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXp7fH1-f4CBgoM", false},
+		{"reality short id", "vless://" + testUUID + "@example.com:443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&sid=01", "vless://" + testUUID + "@example.com:443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&sid=02", false},
+		{"hy2 password", "hy2://one@example.com:443", "hy2://two@example.com:443", false},
+		{"hy2 obfs", "hy2://secret@example.com:443?obfs=salamander&obfs-password=x", "hy2://secret@example.com:443", false},
+		{"hy2 obfs password", "hy2://secret@example.com:443?obfs=salamander&obfs-password=x", "hy2://secret@example.com:443?obfs=salamander&obfs-password=y", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := ParseLink(tt.a)
+			if err != nil {
+				t.Fatalf("ParseLink(%q): %v", tt.a, err)
+			}
+			b, err := ParseLink(tt.b)
+			if err != nil {
+				t.Fatalf("ParseLink(%q): %v", tt.b, err)
+			}
+			if same := CanonicalKey(a) == CanonicalKey(b); same != tt.same {
+				t.Errorf("same identity = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestCanonicalKeyHidesCredential(t *testing.T) {
+	cfg, err := ParseLink("hy2://supersecret@example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := CanonicalKey(cfg); len(key) != 32 || strings.Contains(key, "supersecret") {
+		t.Errorf("key = %q", key)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	links := []string{
+		"vless://" + testUUID + "@example.com:443?security=tls#A",
+		"hy2://secret@example.com:443",
+		"vless://" + testUUID + "@example.com:443?security=tls&fp=chrome#B",
+		"vless://" + testUUID + "@other.com:443",
+		"",
+		"hy2://secret@example.com:443?up=100#copy",
+		"vless://" + testUUID + "@example.com:443?security=tls#C",
+	}
+	cfgs := make([]*ServerConfig, len(links))
+	for i, link := range links {
+		if link != "" {
+			cfgs[i] = mustParseLink(t, link)
+		}
+	}
+
+	groups := FindDuplicates(cfgs)
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2: %+v", len(groups), groups)
+	}
+	if !reflect.DeepEqual(groups[0].Members, []int{0, 2, 6}) || groups[0].Canonical != 2 {
+		t.Errorf("vless group = %+v, want members 0,2,6 keeping 2 (has fp)", groups[0])
+	}
+	if !reflect.DeepEqual(groups[1].Members, []int{1, 5}) || groups[1].Canonical != 5 {
+		t.Errorf("hy2 group = %+v, want members 1,5 keeping 5", groups[1])
+	}
+}
+
+func mustParseLink(t *testing.T, link string) *ServerConfig {
+	t.Helper()
+	cfg, err := ParseLink(link)
+	if err != nil {
+		t.Fatalf("ParseLink(%q): %v", link, err)
+	}
+	return cfg
+}
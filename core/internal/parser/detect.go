@@ -1,9 +1,10 @@
+// Package parser holds server configs in the flat param-map form stored in
+// profiles and exchanged over IPC. Parsing and validation are done by the
+// public linkparser package; this package adapts its results and adds what
+// only the service needs, such as deduplication and link extraction.
 package parser
 
-import (
-	"fmt"
-	"strings"
-)
+import "github.com/mriaz/vpn-core/pkg/linkparser"
 
 // ServerConfig holds parsed proxy server configuration.
 type ServerConfig struct {
@@ -16,21 +17,30 @@ type ServerConfig struct {
 
 // ParseLink auto-detects and parses a proxy link.
 func ParseLink(link string) (*ServerConfig, error) {
-	link = strings.TrimSpace(link)
+	return fromPublic(linkparser.ParseLink(link))
+}
 
-	switch {
-	case strings.HasPrefix(link, "vless://"):
-		return ParseVLESS(link)
-	case strings.HasPrefix(link, "hysteria2://"), strings.HasPrefix(link, "hy2://"):
-		return ParseHysteria2(link)
-	default:
-		return nil, fmt.Errorf("unsupported link scheme: %s", link[:min(20, len(link))])
+// BuildLink returns cfg as a canonical share link, which ParseLink reads
+// back into cfg; see linkparser.ServerConfig.Link. cfg is validated as
+// ParseLink would.
+func BuildLink(cfg *ServerConfig) (string, error) {
+	pub, err := linkparser.FromParams(linkparser.Protocol(cfg.Protocol), cfg.Name, cfg.Address, cfg.Port, cfg.Params)
+	if err != nil {
+		return "", err
 	}
+	return pub.Link(), nil
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// fromPublic converts a linkparser result to the param-map form.
+func fromPublic(cfg *linkparser.ServerConfig, err error) (*ServerConfig, error) {
+	if err != nil {
+		return nil, err
 	}
-	return b
+	return &ServerConfig{
+		Protocol: string(cfg.Protocol),
+		Name:     cfg.Name,
+		Address:  cfg.Address,
+		Port:     cfg.Port,
+		Params:   cfg.Params(),
+	}, nil
 }
@@ -0,0 +1,200 @@
+package parser
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// supportedSchemes are the link schemes ParseLink accepts, longest first.
+var supportedSchemes = []string{"hysteria2", "vless", "hy2"}
+
+// otherSchemes are proxy link schemes found in shared posts that ParseLink
+// does not support yet. They are extracted so they are reported as
+// unsupported instead of silently skipped.
+var otherSchemes = []string{"vmess", "trojan", "ss", "ssr", "tuic", "wireguard", "wg", "socks", "socks5", "hysteria"}
+
+// Candidate is a link-like string found in text.
+type Candidate struct {
+	Link   string        // the extracted link
+	Server *ServerConfig // nil if the link did not parse
+	Err    error         // why the link did not parse
+}
+
+// ExtractLinks finds proxy links in free-form text, such as a channel post
+// with links mixed into prose, and parses each one. Identical links are
+// returned once, in order of first appearance.
+//
+// A link ends at whitespace or a character that cannot appear in a link,
+// or where another supported link starts, even when glued to it. Trailing
+// sentence punctuation, an unbalanced closing bracket (a markdown link
+// target) and HTML-escaped ampersands are cleaned up. A link hard-wrapped
+// across lines is joined with the next line when that line holds nothing
+// else and the joined link parses.
+func ExtractLinks(text string) []Candidate {
+	var out []Candidate
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(text); {
+		start, scheme := nextLink(text, i)
+		if start < 0 {
+			break
+		}
+		end := linkEnd(text, start+len(scheme)+len("://"))
+		link := cleanLink(text[start:end], scheme)
+		server, err := ParseLink(link)
+
+		// Links hard-wrapped by the sender's client continue on the next
+		// line. A link that already parses is only extended when it stands
+		// alone on its line and has no name yet, since the name comes last.
+		for err != nil || (lineStart(text, start) && !strings.Contains(link, "#")) {
+			next, rest := continuation(text, end)
+			if rest == "" {
+				break
+			}
+			joined := cleanLink(text[start:end]+rest, scheme)
+			s, e := ParseLink(joined)
+			if e != nil {
+				break
+			}
+			link, server, err, end = joined, s, nil, next
+		}
+		i = end
+
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+		out = append(out, Candidate{Link: link, Server: server, Err: err})
+	}
+	return out
+}
+
+// nextLink returns the start and lowercase scheme of the first link at or
+// after from, or -1.
+func nextLink(text string, from int) (int, string) {
+	for at := from; at < len(text); {
+		idx := strings.Index(text[at:], "://")
+		if idx < 0 {
+			break
+		}
+		idx += at
+		if start, scheme := schemeBefore(text, from, idx); start >= 0 {
+			return start, scheme
+		}
+		at = idx + len("://")
+	}
+	return -1, ""
+}
+
+// schemeBefore returns the scheme ending at the "://" at idx. The word
+// before it may not extend before lo. A supported scheme also matches as a
+// suffix of the word, which splits links glued together ("...#Avless://").
+func schemeBefore(text string, lo, idx int) (int, string) {
+	start := idx
+	for start > lo && isSchemeByte(text[start-1]) {
+		start--
+	}
+	word := strings.ToLower(text[start:idx])
+	for _, scheme := range otherSchemes {
+		if word == scheme {
+			return start, scheme
+		}
+	}
+	for _, scheme := range supportedSchemes {
+		if strings.HasSuffix(word, scheme) {
+			return idx - len(scheme), scheme
+		}
+	}
+	return -1, ""
+}
+
+// linkEnd returns the index just past the link body starting at from.
+func linkEnd(text string, from int) int {
+	for i := from; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if !isLinkRune(r) {
+			return i
+		}
+		if strings.HasPrefix(text[i:], "://") {
+			if start, scheme := schemeBefore(text, from, i); start > from && scheme != "" {
+				return start
+			}
+		}
+		i += size
+	}
+	return len(text)
+}
+
+// lineStart reports whether i is at the start of a line.
+func lineStart(text string, i int) bool {
+	return i == 0 || text[i-1] == '\n'
+}
+
+// continuation returns the line after end when end is a line break and
+// that line is a single link-like token, and the index just past it.
+func continuation(text string, end int) (int, string) {
+	i := end
+	if i < len(text) && text[i] == '\r' {
+		i++
+	}
+	if i >= len(text) || text[i] != '\n' {
+		return end, ""
+	}
+	i++
+	if start, _ := nextLink(text, i); start >= 0 && start < linkEnd(text, i) {
+		return end, "" // the next line holds another link
+	}
+	j := linkEnd(text, i)
+	if j < len(text) && text[j] != '\r' && text[j] != '\n' {
+		return end, ""
+	}
+	return j, text[i:j]
+}
+
+// trailingPunct is punctuation that ends a sentence rather than a link.
+const trailingPunct = ".,;:!?'*_…»«“”‘’"
+
+// cleanLink strips characters the boundary scan picked up around a link
+// and lowercases its scheme, which ParseLink matches case-sensitively.
+func cleanLink(link, scheme string) string {
+	link = strings.ReplaceAll(link, "&amp;", "&")
+	for {
+		trimmed := strings.TrimRight(link, trailingPunct)
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, ")") > strings.Count(trimmed, "(") {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if strings.HasSuffix(trimmed, "]") && strings.Count(trimmed, "]") > strings.Count(trimmed, "[") {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if trimmed == link {
+			break
+		}
+		link = trimmed
+	}
+	return scheme + link[len(scheme):]
+}
+
+// isLinkRune reports whether r can be part of a link. Non-ASCII letters
+// and symbols are allowed because names in fragments are often unescaped
+// (e.g. flag emoji).
+func isLinkRune(r rune) bool {
+	switch {
+	case r == utf8.RuneError:
+		return false
+	case r < 0x80:
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+		return !strings.ContainsRune(`<>"`+"`"+`{}|\^`, r)
+	case unicode.IsSpace(r), r >= 0x200b && r <= 0x200d, r == 0xfeff:
+		return false
+	case r >= 0x3000 && r <= 0x303f, r >= 0xff01 && r <= 0xff65:
+		return false // CJK and fullwidth punctuation, e.g. "，" after a link
+	}
+	return true
+}
+
+func isSchemeByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'
+}
@@ -0,0 +1,180 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	extractVLESS   = "vless://" + testUUID + "@de1.example.com:443?security=tls&sni=de1.example.com&type=ws&path=%2Fws#%F0%9F%87%A9%F0%9F%87%AA%20Germany"
+	extractReality = "vless://" + testUUID + "@nl.example.net:8443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&sid=6ba85179e30d4fc2&fp=chrome&flow=xtls-rprx-vision#NL%20Reality"
+	extractHy2     = "hy2://s3cret@fi.example.org:8443?sni=fi.example.org&obfs=salamander&obfs-password=x#Finland"
+)
+
+// TestExtractLinks runs the extractor over posts shaped like the ones users
+// paste from Telegram channels and chats.
+func TestExtractLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string // extracted links, in order
+		bad  int      // how many of them fail to parse
+	}{
+		{
+			name: "one link per line",
+			text: extractVLESS + "\n" + extractHy2 + "\n",
+			want: []string{extractVLESS, extractHy2},
+		},
+		{
+			name: "channel post with prose and emoji",
+			text: "🔥 Free servers for today! 🔥\n\n🇩🇪 Germany:\n" + extractVLESS + "\n\n🇫🇮 Finland (fast):\n" + extractHy2 + "\n\nShare with friends ❤️ @somechannel",
+			want: []string{extractVLESS, extractHy2},
+		},
+		{
+			name: "sentence punctuation",
+			text: "Try this one: " + extractHy2 + ". Or this: " + extractVLESS + ", both work!",
+			want: []string{extractHy2, extractVLESS},
+		},
+		{
+			name: "markdown link target",
+			text: "[Germany](" + extractVLESS + ") and [Finland](" + extractHy2 + ")",
+			want: []string{extractVLESS, extractHy2},
+		},
+		{
+			name: "name with balanced parentheses",
+			text: "(see vless://" + testUUID + "@example.com:443#Server%20(DE))",
+			want: []string{"vless://" + testUUID + "@example.com:443#Server%20(DE)"},
+		},
+		{
+			name: "quoted and in angle brackets",
+			text: `"` + extractHy2 + `" <` + extractVLESS + `>`,
+			want: []string{extractHy2, extractVLESS},
+		},
+		{
+			name: "backticks from code blocks",
+			text: "```\n" + extractReality + "\n```\n`" + extractHy2 + "`",
+			want: []string{extractReality, extractHy2},
+		},
+		{
+			name: "glued links",
+			text: extractHy2 + extractVLESS,
+			want: []string{extractHy2, extractVLESS},
+		},
+		{
+			name: "uppercase scheme",
+			text: "VLESS://" + testUUID + "@example.com:443#Caps",
+			want: []string{"vless://" + testUUID + "@example.com:443#Caps"},
+		},
+		{
+			name: "hysteria2 long scheme",
+			text: "Link:hysteria2://pw@example.com:443#Long",
+			want: []string{"hysteria2://pw@example.com:443#Long"},
+		},
+		{
+			name: "html escaped ampersands",
+			text: "<p>vless://" + testUUID + "@example.com:443?security=tls&amp;type=ws&amp;path=%2F#Web</p>",
+			want: []string{"vless://" + testUUID + "@example.com:443?security=tls&type=ws&path=%2F#Web"},
+		},
+		{
+			name: "unescaped emoji name",
+			text: "hy2://pw@example.com:443#🇺🇸 US",
+			want: []string{"hy2://pw@example.com:443#🇺🇸"},
+		},
+		{
+			name: "fullwidth punctuation after link",
+			text: "节点：hy2://pw@example.com:443#HK，复制使用",
+			want: []string{"hy2://pw@example.com:443#HK"},
+		},
+		{
+			name: "zero-width and non-breaking spaces",
+			text: "hy2://pw@a.example.com:443#A\u200bhy2://pw@b.example.com:443#B\u00a0done",
+			want: []string{"hy2://pw@a.example.com:443#A", "hy2://pw@b.example.com:443#B"},
+		},
+		{
+			name: "link wrapped across lines",
+			text: "vless://" + testUUID + "@nl.example.net:8443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5K\nZwwB-ed4eEE7YnRc&sid=6ba85179e30d4fc2&fp=chrome&flow=xtls-rprx-vision#NL%20Reality\nEnjoy!",
+			want: []string{extractReality},
+		},
+		{
+			name: "wrapped across CRLF lines",
+			text: "hy2://pw@example.co\r\nm:443#X\r\n",
+			want: []string{"hy2://pw@example.com:443#X"},
+		},
+		{
+			name: "complete link is not joined with the next line",
+			text: extractHy2 + "\nfast-and-free",
+			want: []string{extractHy2},
+		},
+		{
+			name: "nameless link followed by prose",
+			text: "hy2://pw@example.com:443\nEnjoy the ride",
+			want: []string{"hy2://pw@example.com:443"},
+		},
+		{
+			name: "next line is another link",
+			text: "vless://" + testUUID + "@\n" + extractHy2,
+			want: []string{"vless://" + testUUID + "@", extractHy2},
+			bad:  1,
+		},
+		{
+			name: "duplicates reported once",
+			text: extractHy2 + "\nagain: " + extractHy2,
+			want: []string{extractHy2},
+		},
+		{
+			name: "unsupported schemes are reported",
+			text: "vmess://eyJhZGQiOiJleGFtcGxlLmNvbSJ9 and trojan://pw@example.com:443#T and " + extractHy2,
+			want: []string{"vmess://eyJhZGQiOiJleGFtcGxlLmNvbSJ9", "trojan://pw@example.com:443#T", extractHy2},
+			bad:  2,
+		},
+		{
+			name: "scheme inside a word is not a link",
+			text: "https://t.me/channel and class://foo and bypass://x",
+		},
+		{
+			name: "ss inside vless is not a separate link",
+			text: extractVLESS,
+			want: []string{extractVLESS},
+		},
+		{
+			name: "invalid vless link",
+			text: "vless://" + testUUID + "@example.com:99999#Bad",
+			want: []string{"vless://" + testUUID + "@example.com:99999#Bad"},
+			bad:  1,
+		},
+		{
+			name: "empty text",
+			text: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExtractLinks(tt.text)
+			var links []string
+			bad := 0
+			for _, c := range got {
+				links = append(links, c.Link)
+				if (c.Err == nil) == (c.Server == nil) {
+					t.Errorf("candidate %q: server %v, err %v", c.Link, c.Server, c.Err)
+				}
+				if c.Err != nil {
+					bad++
+				}
+			}
+			if strings.Join(links, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("links:\n%s\nwant:\n%s", strings.Join(links, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if bad != tt.bad {
+				t.Errorf("%d unparseable, want %d", bad, tt.bad)
+			}
+		})
+	}
+}
+
+func TestExtractLinksParsesNames(t *testing.T) {
+	got := ExtractLinks("Germany → " + extractVLESS)
+	if len(got) != 1 || got[0].Server == nil || got[0].Server.Name != "🇩🇪 Germany" {
+		t.Fatalf("got %+v", got)
+	}
+}
@@ -0,0 +1,315 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Subscriptions encode what the UI groups servers by in their display
+// names: "🇺🇸 US-01", "[HK] Hong Kong 2 x1.5", "日本 东京 02". DescribeName
+// derives that metadata so the app does not re-parse names itself; the
+// name is never changed.
+
+// NameInfo is the metadata derived from a server's display name.
+type NameInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code of a flag emoji in the name
+	// or, failing that, of the first country name or code in it.
+	Country string `json:"country,omitempty"`
+	// Group is the label of the first group rule matching the name.
+	Group string `json:"group,omitempty"`
+	// Multiplier is the traffic billing rate a name states, such as "x2"
+	// or "0.5倍"; 0 when it states none.
+	Multiplier float64 `json:"multiplier,omitempty"`
+}
+
+// DescribeName derives the metadata of a display name, grouping it by the
+// first of groups that matches; groups may be nil.
+func DescribeName(name string, groups *GroupMatcher) NameInfo {
+	return NameInfo{
+		Country:    nameCountry(name),
+		Group:      groups.Group(name),
+		Multiplier: nameMultiplier(name),
+	}
+}
+
+// GroupRule labels servers by display name. Exactly one of Prefix, matched
+// case-insensitively at the start of the name, and Regex is set. A regex
+// rule without a Label takes the label from its first capture group.
+type GroupRule struct {
+	Prefix string `json:"prefix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Label  string `json:"label,omitempty"`
+}
+
+// Limits of a group rule list.
+const (
+	maxGroupRules    = 100
+	maxGroupRuleLen  = 256
+	maxGroupLabelLen = 64
+)
+
+// DefaultGroupRules group names that start with a bracketed tag, such as
+// "[US]" or "【香港】", by the tag.
+var DefaultGroupRules = []GroupRule{
+	{Regex: `^\s*[\[【(（]\s*([^\]】)）]+?)\s*[\]】)）]`},
+}
+
+// GroupMatcher is a compiled group rule list.
+type GroupMatcher struct {
+	rules []compiledGroupRule
+}
+
+type compiledGroupRule struct {
+	prefix string // lower case
+	re     *regexp.Regexp
+	label  string
+}
+
+// CompileGroupRules validates and compiles a group rule list.
+func CompileGroupRules(rules []GroupRule) (*GroupMatcher, error) {
+	if len(rules) > maxGroupRules {
+		return nil, fmt.Errorf("at most %d group rules", maxGroupRules)
+	}
+	m := &GroupMatcher{}
+	for i, r := range rules {
+		if len(r.Prefix) > maxGroupRuleLen || len(r.Regex) > maxGroupRuleLen || len(r.Label) > maxGroupLabelLen {
+			return nil, fmt.Errorf("rule %d is too long", i+1)
+		}
+		c := compiledGroupRule{label: strings.TrimSpace(r.Label)}
+		switch {
+		case (r.Prefix == "") == (r.Regex == ""):
+			return nil, fmt.Errorf("rule %d needs exactly one of prefix and regex", i+1)
+		case r.Prefix != "":
+			if c.label == "" {
+				return nil, fmt.Errorf("rule %d: a prefix rule needs a label", i+1)
+			}
+			c.prefix = strings.ToLower(r.Prefix)
+		default:
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+			if c.label == "" && re.NumSubexp() == 0 {
+				return nil, fmt.Errorf("rule %d: a regex rule needs a label or a capture group", i+1)
+			}
+			c.re = re
+		}
+		m.rules = append(m.rules, c)
+	}
+	return m, nil
+}
+
+// ValidateGroupRules checks a group rule list compiles.
+func ValidateGroupRules(rules []GroupRule) error {
+	_, err := CompileGroupRules(rules)
+	return err
+}
+
+// Group returns the label of the first rule matching name, or "".
+func (m *GroupMatcher) Group(name string) string {
+	if m == nil {
+		return ""
+	}
+	trimmed := strings.TrimSpace(name)
+	for _, r := range m.rules {
+		if r.re == nil {
+			if strings.HasPrefix(strings.ToLower(trimmed), r.prefix) {
+				return r.label
+			}
+			continue
+		}
+		match := r.re.FindStringSubmatch(name)
+		switch {
+		case match == nil:
+		case r.label != "":
+			return r.label
+		case strings.TrimSpace(match[1]) != "":
+			return strings.TrimSpace(match[1])
+		}
+	}
+	return ""
+}
+
+// countryNames maps country and city names seen in subscription names to
+// country codes. English names match whole words, case-insensitively.
+var countryNames = map[string]string{
+	"united states": "US", "usa": "US", "america": "US", "new york": "US", "los angeles": "US",
+	"silicon valley": "US", "san jose": "US", "seattle": "US", "dallas": "US", "chicago": "US",
+	"美国": "US", "美國": "US", "洛杉矶": "US", "纽约": "US", "硅谷": "US",
+	"hong kong": "HK", "hongkong": "HK", "香港": "HK",
+	"taiwan": "TW", "taipei": "TW", "台湾": "TW", "台灣": "TW", "台北": "TW",
+	"japan": "JP", "tokyo": "JP", "osaka": "JP", "日本": "JP", "东京": "JP", "東京": "JP", "大阪": "JP",
+	"singapore": "SG", "新加坡": "SG", "狮城": "SG",
+	"korea": "KR", "south korea": "KR", "seoul": "KR", "韩国": "KR", "韓國": "KR", "首尔": "KR",
+	"china": "CN", "中国": "CN", "中國": "CN",
+	"united kingdom": "GB", "britain": "GB", "london": "GB", "英国": "GB", "英國": "GB", "伦敦": "GB",
+	"germany": "DE", "frankfurt": "DE", "德国": "DE", "德國": "DE",
+	"france": "FR", "paris": "FR", "法国": "FR", "法國": "FR",
+	"netherlands": "NL", "amsterdam": "NL", "荷兰": "NL", "荷蘭": "NL",
+	"russia": "RU", "moscow": "RU", "俄罗斯": "RU", "俄羅斯": "RU",
+	"canada": "CA", "toronto": "CA", "加拿大": "CA",
+	"australia": "AU", "sydney": "AU", "澳大利亚": "AU", "澳洲": "AU",
+	"india": "IN", "mumbai": "IN", "印度": "IN",
+	"turkey": "TR", "türkiye": "TR", "istanbul": "TR", "土耳其": "TR",
+	"iran": "IR", "tehran": "IR", "伊朗": "IR",
+	"uae": "AE", "dubai": "AE", "阿联酋": "AE", "迪拜": "AE",
+	"finland": "FI", "helsinki": "FI", "芬兰": "FI",
+	"sweden": "SE", "stockholm": "SE", "瑞典": "SE",
+	"switzerland": "CH", "zurich": "CH", "瑞士": "CH",
+	"poland": "PL", "warsaw": "PL", "波兰": "PL",
+	"ukraine": "UA", "kyiv": "UA", "乌克兰": "UA",
+	"brazil": "BR", "são paulo": "BR", "sao paulo": "BR", "巴西": "BR",
+	"malaysia": "MY", "kuala lumpur": "MY", "马来西亚": "MY",
+	"thailand": "TH", "bangkok": "TH", "泰国": "TH",
+	"vietnam": "VN", "越南": "VN",
+	"philippines": "PH", "manila": "PH", "菲律宾": "PH",
+	"indonesia": "ID", "jakarta": "ID", "印尼": "ID", "印度尼西亚": "ID",
+	"macau": "MO", "macao": "MO", "澳门": "MO", "澳門": "MO",
+}
+
+// countryCodes are the codes accepted as upper-case name tokens: the
+// countries servers are commonly placed in, less ID and IS, which are
+// more often words, and GB, which is more often gigabytes in traffic
+// notices ("UK" stands for it). Other codes still come through flag emoji.
+var countryCodes = map[string]bool{
+	"AE": true, "AR": true, "AT": true, "AU": true, "BE": true, "BG": true, "BR": true, "CA": true,
+	"CH": true, "CL": true, "CN": true, "CZ": true, "DE": true, "DK": true, "EE": true, "ES": true,
+	"FI": true, "FR": true, "GR": true, "HK": true, "HU": true, "IE": true, "IL": true,
+	"IN": true, "IR": true, "IT": true, "JP": true, "KR": true, "KZ": true,
+	"LT": true, "LU": true, "LV": true, "MD": true, "MO": true, "MX": true, "MY": true, "NL": true,
+	"NO": true, "NZ": true, "PH": true, "PL": true, "PT": true, "RO": true, "RS": true, "RU": true,
+	"SE": true, "SG": true, "TH": true, "TR": true, "TW": true, "UA": true, "US": true, "VN": true,
+	"ZA": true,
+}
+
+// countryAliases are name tokens that mean a code other than themselves.
+var countryAliases = map[string]string{"UK": "GB", "USA": "US", "UAE": "AE"}
+
+// nameCountry returns the country a display name points at, or "".
+func nameCountry(name string) string {
+	if code := flagCountry(name); code != "" {
+		return code
+	}
+
+	// Otherwise the earliest country name or code token wins. China only
+	// counts when nothing else does: names mention it for routes ("中国移动",
+	// "China Telecom") and as a prefix of regions ("中国香港").
+	best, bestAt := "", len(name)+1
+	weak, weakAt := "", len(name)+1
+	consider := func(code string, at int) {
+		switch {
+		case code == "CN" && at < weakAt:
+			weak, weakAt = code, at
+		case code != "CN" && (at < bestAt || at == bestAt && code < best):
+			best, bestAt = code, at
+		}
+	}
+	lower := strings.ToLower(name)
+	for word, code := range countryNames {
+		if at := indexWord(lower, word); at >= 0 {
+			consider(code, at)
+		}
+	}
+	at := 0
+	for _, token := range strings.FieldsFunc(name, func(r rune) bool { return !isNameToken(r) }) {
+		at += strings.Index(name[at:], token)
+		if code := tokenCountry(token); code != "" {
+			consider(code, at)
+		}
+		at += len(token)
+	}
+	if best != "" {
+		return best
+	}
+	return weak
+}
+
+// flagCountry returns the country of the first flag emoji in name: a pair
+// of regional indicator symbols spelling its code.
+func flagCountry(name string) string {
+	var prev rune
+	for _, r := range name {
+		if r < 0x1F1E6 || r > 0x1F1FF {
+			prev = 0
+			continue
+		}
+		if prev != 0 {
+			code := string([]rune{'A' + prev - 0x1F1E6, 'A' + r - 0x1F1E6})
+			if alias, ok := countryAliases[code]; ok {
+				return alias
+			}
+			return code
+		}
+		prev = r
+	}
+	return ""
+}
+
+func isNameToken(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// tokenCountry returns the country of an upper-case code token, which may
+// carry a server number ("HK01"). "CN2" is China Telecom's premium route,
+// named by servers anywhere, not a country.
+func tokenCountry(token string) string {
+	letters := strings.TrimRightFunc(token, unicode.IsDigit)
+	if letters != strings.ToUpper(letters) || token == "CN2" || len(token)-len(letters) > 3 {
+		return ""
+	}
+	if alias, ok := countryAliases[letters]; ok {
+		return alias
+	}
+	if countryCodes[letters] {
+		return letters
+	}
+	return ""
+}
+
+// indexWord returns the index of word in s where it is not part of a
+// longer ASCII word, or -1. CJK names have no word boundaries to check.
+func indexWord(s, word string) int {
+	for from := 0; ; {
+		i := strings.Index(s[from:], word)
+		if i < 0 {
+			return -1
+		}
+		i += from
+		end := i + len(word)
+		before, _ := utf8.DecodeLastRuneInString(s[:i])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if !isASCIILetter(before) && !isASCIILetter(after) || !isASCIILetter(rune(word[0])) {
+			return i
+		}
+		from = i + 1
+	}
+}
+
+func isASCIILetter(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+// multiplierPattern matches billing rates: "x2", "X0.5", "×1.5", "2x",
+// "2倍". A rate glued to letters, as in "vmx2", is not one.
+var multiplierPattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9.])(?:[x×]\s?(\d{1,2}(?:\.\d{1,2})?)|(\d{1,2}(?:\.\d{1,2})?)\s?(?:x|×|倍))(?:$|[^a-z0-9])`)
+
+// nameMultiplier returns the billing rate stated in a display name, or 0.
+func nameMultiplier(name string) float64 {
+	m := multiplierPattern.FindStringSubmatch(name)
+	if m == nil {
+		return 0
+	}
+	value := m[1]
+	if value == "" {
+		value = m[2]
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 {
+		return 0
+	}
+	return rate
+}
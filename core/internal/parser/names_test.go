@@ -0,0 +1,82 @@
+package parser
+
+import "testing"
+
+// TestDescribeName runs a corpus of display names from public
+// subscriptions.
+func TestDescribeName(t *testing.T) {
+	groups, err := CompileGroupRules(DefaultGroupRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want NameInfo
+	}{
+		{"🇺🇸 US-01", NameInfo{Country: "US"}},
+		{"🇭🇰 香港 IPLC 02 x1.5", NameInfo{Country: "HK", Multiplier: 1.5}},
+		{"🇬🇧 London", NameInfo{Country: "GB"}},
+		{"[US] New York 1", NameInfo{Country: "US", Group: "US"}},
+		{"【香港】HK-BGP 03 [2x]", NameInfo{Country: "HK", Group: "香港", Multiplier: 2}},
+		{"(JP) Tokyo x2", NameInfo{Country: "JP", Group: "JP", Multiplier: 2}},
+		{"日本 东京 02", NameInfo{Country: "JP"}},
+		{"美国 洛杉矶 CN2 GIA", NameInfo{Country: "US"}},
+		{"CN2 GIA Los Angeles", NameInfo{Country: "US"}},
+		{"中国香港 01 | 0.5倍", NameInfo{Country: "HK", Multiplier: 0.5}},
+		{"中国移动 直连", NameInfo{Country: "CN"}},
+		{"台湾 HiNet 家宽 ×3", NameInfo{Country: "TW", Multiplier: 3}},
+		{"SG01 | Singapore | Premium", NameInfo{Country: "SG"}},
+		{"UK-LON-01", NameInfo{Country: "GB"}},
+		{"Germany Frankfurt", NameInfo{Country: "DE"}},
+		{"Free server for you", NameInfo{}},
+		{"Indianapolis relay", NameInfo{}},
+		{"vmx2 node", NameInfo{}},
+		{"剩余流量：100 GB", NameInfo{}},
+		{"", NameInfo{}},
+	}
+	for _, tt := range tests {
+		if got := DescribeName(tt.name, groups); got != tt.want {
+			t.Errorf("DescribeName(%q) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGroupRules(t *testing.T) {
+	groups, err := CompileGroupRules([]GroupRule{
+		{Prefix: "VIP", Label: "Premium"},
+		{Regex: `(?i)game`, Label: "Gaming"},
+		{Regex: `^(\p{Han}+)\s`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"vip HK 01":        "Premium",
+		"  VIP-JP":         "Premium",
+		"JP Game 3":        "Gaming",
+		"日本 东京 02":         "日本",
+		"US 01 VIP":        "",
+		"[US] New York 01": "",
+	} {
+		if got := groups.Group(name); got != want {
+			t.Errorf("Group(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	var none *GroupMatcher
+	if none.Group("VIP") != "" {
+		t.Error("nil matcher grouped a name")
+	}
+
+	for _, bad := range [][]GroupRule{
+		{{Prefix: "VIP"}},
+		{{Prefix: "VIP", Regex: "VIP", Label: "x"}},
+		{{}},
+		{{Regex: "["}},
+		{{Regex: "plain"}},
+	} {
+		if err := ValidateGroupRules(bad); err == nil {
+			t.Errorf("rules %+v accepted", bad)
+		}
+	}
+}
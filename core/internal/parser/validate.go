@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mriaz/vpn-core/pkg/linkparser"
+)
+
+// Validate checks a ServerConfig against the same rules the link parsers
+// apply, so configs supplied as JSON are held to the same standard as links.
+// Missing protocol defaults (VLESS type/security) are filled in and an empty
+// name falls back to the address.
+func Validate(cfg *ServerConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("no server configuration provided")
+	}
+	valid, err := linkparser.FromParams(linkparser.Protocol(cfg.Protocol), cfg.Name, cfg.Address, cfg.Port, cfg.Params)
+	if err != nil {
+		return err
+	}
+	cfg.Name = valid.Name
+	cfg.Params = valid.Params()
+	return nil
+}
+
+// ValidateHeaderName checks that name is a plausible HTTP header name.
+func ValidateHeaderName(name string) error {
+	return linkparser.ValidateHeaderName(name)
+}
+
+// knownParams lists, per protocol, the link params the outbound builders
+// read or deliberately ignore (encryption and headerType only ever carry
+// their default for the transports we support).
+var knownParams = map[string]map[string]bool{
+	"vless": {
+		"uuid": true, "type": true, "security": true, "flow": true, "encryption": true, "headerType": true,
+		"path": true, "host": true, "serviceName": true, "mode": true, "ed": true, "eh": true, "headers": true,
+		"sni": true, "alpn": true, "fp": true, "pbk": true, "sid": true,
+	},
+	"hysteria2": {
+		"password": true, "sni": true, "alpn": true, "insecure": true,
+		"obfs": true, "obfs-password": true, "up": true, "down": true,
+	},
+}
+
+// UnknownParams returns the params of cfg that no outbound builder uses,
+// sorted. They are silently dropped from the generated config.
+func UnknownParams(cfg *ServerConfig) []string {
+	known := knownParams[cfg.Protocol]
+	var unknown []string
+	for key := range cfg.Params {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,138 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *ServerConfig
+		wantErr string
+	}{
+		{
+			name: "vless ok",
+			cfg: &ServerConfig{Protocol: "vless", Address: "example.com", Port: 443,
+				Params: map[string]string{"uuid": "b831381d-6324-4d53-ad4f-8cda48b30811"}},
+		},
+		{
+			name: "hysteria2 ok",
+			cfg: &ServerConfig{Protocol: "hysteria2", Address: "1.2.3.4", Port: 8443,
+				Params: map[string]string{"password": "secret", "alpn": "h3,h2"}},
+		},
+		{
+			name:    "nil",
+			wantErr: "no server configuration",
+		},
+		{
+			name:    "unknown protocol",
+			cfg:     &ServerConfig{Protocol: "vmess", Address: "example.com", Port: 443},
+			wantErr: "unsupported protocol",
+		},
+		{
+			name:    "vless missing uuid",
+			cfg:     &ServerConfig{Protocol: "vless", Address: "example.com", Port: 443},
+			wantErr: "missing UUID",
+		},
+		{
+			name:    "hysteria2 missing password",
+			cfg:     &ServerConfig{Protocol: "hysteria2", Address: "example.com", Port: 443, Params: map[string]string{}},
+			wantErr: "missing password",
+		},
+		{
+			name: "missing host",
+			cfg: &ServerConfig{Protocol: "vless", Port: 443,
+				Params: map[string]string{"uuid": "u"}},
+			wantErr: "missing host",
+		},
+		{
+			name: "host with scheme",
+			cfg: &ServerConfig{Protocol: "vless", Address: "https://example.com", Port: 443,
+				Params: map[string]string{"uuid": "u"}},
+			wantErr: "invalid host",
+		},
+		{
+			name: "ws early data too large",
+			cfg: &ServerConfig{Protocol: "vless", Address: "example.com", Port: 443,
+				Params: map[string]string{"uuid": "u", "type": "ws", "ed": "100000"}},
+			wantErr: "early data",
+		},
+		{
+			name: "ws early data in path not a number",
+			cfg: &ServerConfig{Protocol: "vless", Address: "example.com", Port: 443,
+				Params: map[string]string{"uuid": "u", "type": "ws", "path": "/ws?ed=lots"}},
+			wantErr: "early data",
+		},
+		{
+			name: "ws bad early data header",
+			cfg: &ServerConfig{Protocol: "vless", Address: "example.com", Port: 443,
+				Params: map[string]string{"uuid": "u", "type": "ws", "ed": "2048", "eh": "X Bad"}},
+			wantErr: "invalid header name",
+		},
+		{
+			name: "zero port",
+			cfg: &ServerConfig{Protocol: "hysteria2", Address: "example.com",
+				Params: map[string]string{"password": "p"}},
+			wantErr: "invalid port",
+		},
+	}
+
+	for _, tt := range tests {
+		err := Validate(tt.cfg)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateFillsDefaults(t *testing.T) {
+	cfg := &ServerConfig{Protocol: "vless", Address: "example.com", Port: 443,
+		Params: map[string]string{"uuid": "u"}}
+	if err := Validate(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Params["type"] != "tcp" || cfg.Params["security"] != "none" {
+		t.Errorf("defaults not applied: %v", cfg.Params)
+	}
+	if cfg.Name != "example.com" {
+		t.Errorf("Name = %q, want address fallback", cfg.Name)
+	}
+}
+
+func TestParsersShareValidation(t *testing.T) {
+	if _, err := ParseLink("vless://@example.com:443"); err == nil || !strings.Contains(err.Error(), "missing UUID") {
+		t.Errorf("ParseVLESS without uuid: got %v", err)
+	}
+	if _, err := ParseLink("hy2://@example.com:443"); err == nil || !strings.Contains(err.Error(), "missing password") {
+		t.Errorf("ParseHysteria2 without password: got %v", err)
+	}
+}
+
+func TestWSEarlyData(t *testing.T) {
+	tests := []struct {
+		params     map[string]string
+		wantPath   string
+		wantSize   int
+		wantHeader string
+	}{
+		{map[string]string{"path": "/ws"}, "/ws", 0, DefaultEarlyDataHeader},
+		{map[string]string{"path": "/ws", "ed": "2048"}, "/ws", 2048, DefaultEarlyDataHeader},
+		{map[string]string{"path": "/ws?ed=2560"}, "/ws", 2560, DefaultEarlyDataHeader},
+		{map[string]string{"path": "/ws?ed=2560", "ed": "1024", "eh": "X-Early"}, "/ws", 1024, "X-Early"},
+		{map[string]string{"path": "/ws?token=abc"}, "/ws?token=abc", 0, DefaultEarlyDataHeader},
+	}
+	for _, tt := range tests {
+		path, size, header := WSEarlyData(tt.params)
+		if path != tt.wantPath || size != tt.wantSize || header != tt.wantHeader {
+			t.Errorf("WSEarlyData(%v) = %q, %d, %q; want %q, %d, %q",
+				tt.params, path, size, header, tt.wantPath, tt.wantSize, tt.wantHeader)
+		}
+	}
+}
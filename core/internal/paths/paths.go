@@ -0,0 +1,50 @@
+package paths
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+)
+
+// appDirName is the directory name used under %ProgramData%; see
+// SetInstance.
+var appDirName = instance.Default.DataDirName()
+
+// SetInstance keeps the data of inst in its own directory. Call it before
+// any path is used.
+func SetInstance(inst instance.Instance) {
+	appDirName = inst.DataDirName()
+}
+
+// DataDir returns the directory holding the service's persisted state,
+// normally C:\ProgramData\MRVPN.
+func DataDir() string {
+	base := os.Getenv("ProgramData")
+	if base == "" {
+		base = `C:\ProgramData`
+	}
+	return filepath.Join(base, appDirName)
+}
+
+// File returns the path of a named file inside DataDir.
+func File(name string) string {
+	return filepath.Join(DataDir(), name)
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never observe a partially written file.
+func WriteFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
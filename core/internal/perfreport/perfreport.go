@@ -0,0 +1,237 @@
+// Package perfreport answers "why am I slow" for diagnostics.performanceReport:
+// it combines the figures of the connected session, RTT, loss, throughput,
+// CPU use, the transport and the warnings other checks raised, into
+// findings with plain-language explanations.
+package perfreport
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Severities of a finding.
+const (
+	SeverityWarning = "warning" // likely slowing the connection down
+	SeverityInfo    = "info"    // worth knowing when it feels slow
+)
+
+// Explanation keys, which the UI translates.
+const (
+	KeyHighRTT         = "perf.high_rtt"         // the server is far away or overloaded
+	KeyPacketLoss      = "perf.packet_loss"      // packets to the server get lost
+	KeyMuxHeadOfLine   = "perf.mux_head_of_line" // multiplexing makes one lost packet stall every connection
+	KeyCPUSaturated    = "perf.cpu_saturated"    // the service uses a whole core
+	KeyMTUMismatch     = "perf.mtu_mismatch"     // packets of the configured MTU stall
+	KeySessionDegraded = "perf.session_degraded" // the health probes failed or were slow
+	KeyUpstreamProxy   = "perf.upstream_proxy"   // traffic goes through another proxy first
+	KeyQUICBlocked     = "perf.quic_blocked"     // the transport policy makes apps fall back from QUIC to TCP
+	KeyTCPOverTCP      = "perf.tcp_over_tcp"     // TCP tunneled over a lossy TCP connection retransmits twice
+	KeyNoIssues        = "perf.no_issues"        // nothing above applies
+)
+
+// Thresholds of the findings.
+const (
+	HighRTTMs         = 250  // RTT above which KeyHighRTT is reported
+	LossPercent       = 2.0  // loss above which KeyPacketLoss is reported
+	MuxLossPercent    = 0.5  // loss above which multiplexing hurts
+	CPUSaturatedPct   = 85.0 // share of one core above which KeyCPUSaturated is reported
+	TCPOverTCPLossPct = 1.0  // loss above which KeyTCPOverTCP is reported
+)
+
+// Transport is how the session reaches the server.
+type Transport struct {
+	Protocol        string `json:"protocol"`
+	Transport       string `json:"transport"` // "tcp", "ws", "grpc", ..., or "quic"
+	Security        string `json:"security"`  // "tls", "reality" or "none"
+	Mux             bool   `json:"mux"`
+	MuxProtocol     string `json:"muxProtocol,omitempty"`
+	TransportPolicy string `json:"transportPolicy"` // "auto", "tcp-only" or "block-quic"
+}
+
+// Inputs are the figures of the connected session a report is built from.
+// Unknown figures are zero or nil.
+type Inputs struct {
+	Transport     Transport
+	RTTMs         int64
+	LossPercent   *float64
+	Throughput    Throughput
+	CPUPercent    *float64 // of one core, over a short sample
+	CPUCores      int
+	SplitMode     string // "off", "app" or "domain"
+	MTU           int
+	SuggestedMTU  int    // from the last MTU probe that found a mismatch; 0 if none
+	Degraded      bool   // the session health probes say so
+	HealthReason  string // why, while Degraded
+	UpstreamProxy bool
+}
+
+// Finding is one explanation of the report.
+type Finding struct {
+	Key      string `json:"key"`
+	Severity string `json:"severity" jsonschema:"enum=warning|info"`
+	Detail   string `json:"detail"` // English description for logs and support
+}
+
+// Report is the result of diagnostics.performanceReport.
+type Report struct {
+	Transport    Transport  `json:"transport"`
+	RTTMs        int64      `json:"rttMs,omitempty"`
+	LossPercent  *float64   `json:"lossPercent,omitempty"`
+	Throughput   Throughput `json:"throughput"`
+	CPUPercent   *float64   `json:"cpuPercent,omitempty"` // of one core
+	CPUCores     int        `json:"cpuCores"`
+	MTU          int        `json:"mtu"`
+	SuggestedMTU int        `json:"suggestedMtu,omitempty"`
+	// Findings lists warnings before information; it holds KeyNoIssues
+	// alone when nothing applies.
+	Findings    []Finding `json:"findings"`
+	GeneratedAt int64     `json:"generatedAt"` // Unix seconds
+}
+
+// Build applies the heuristics to in.
+func Build(in Inputs, now time.Time) Report {
+	report := Report{
+		Transport:    in.Transport,
+		RTTMs:        in.RTTMs,
+		LossPercent:  in.LossPercent,
+		Throughput:   in.Throughput,
+		CPUPercent:   in.CPUPercent,
+		CPUCores:     in.CPUCores,
+		MTU:          in.MTU,
+		SuggestedMTU: in.SuggestedMTU,
+		GeneratedAt:  now.Unix(),
+	}
+	report.Findings = findings(in)
+	return report
+}
+
+// findings returns the findings of in, warnings first.
+func findings(in Inputs) []Finding {
+	var warnings, infos []Finding
+	warn := func(key, detail string) {
+		warnings = append(warnings, Finding{Key: key, Severity: SeverityWarning, Detail: detail})
+	}
+	inform := func(key, detail string) {
+		infos = append(infos, Finding{Key: key, Severity: SeverityInfo, Detail: detail})
+	}
+	loss := 0.0
+	if in.LossPercent != nil {
+		loss = *in.LossPercent
+	}
+
+	if in.Degraded {
+		warn(KeySessionDegraded, fmt.Sprintf("the server stopped answering health probes in time (%s)", in.HealthReason))
+	}
+	if in.RTTMs > HighRTTMs {
+		warn(KeyHighRTT, fmt.Sprintf("high RTT to the server (%d ms); a closer server will feel faster", in.RTTMs))
+	}
+	if loss > LossPercent {
+		warn(KeyPacketLoss, fmt.Sprintf("%.1f%% of packets to the server are lost", loss))
+	}
+	if in.Transport.Mux && (loss > MuxLossPercent || in.RTTMs > HighRTTMs) {
+		warn(KeyMuxHeadOfLine, "multiplexing carries every connection over one stream, so a lost packet stalls all of them; consider turning mux off")
+	}
+	if in.Transport.Transport != "quic" && loss > TCPOverTCPLossPct {
+		warn(KeyTCPOverTCP, "the tunnel runs over TCP, so lost packets are retransmitted by both the tunnel and the apps; a QUIC-based server copes better")
+	}
+	if in.CPUPercent != nil && *in.CPUPercent > CPUSaturatedPct {
+		detail := fmt.Sprintf("CPU saturated: the service uses %.0f%% of a core", *in.CPUPercent)
+		if in.SplitMode == "app" {
+			detail += "; consider disabling per-app mode, which looks up the process of every connection"
+		}
+		warn(KeyCPUSaturated, detail)
+	}
+	if in.SuggestedMTU > 0 && in.SuggestedMTU < in.MTU {
+		warn(KeyMTUMismatch, fmt.Sprintf("packets of MTU %d stall through the tunnel; MTU %d gets through", in.MTU, in.SuggestedMTU))
+	}
+
+	if in.UpstreamProxy {
+		inform(KeyUpstreamProxy, "traffic goes through an upstream proxy before the server, which adds its latency")
+	}
+	if in.Transport.TransportPolicy == "tcp-only" || in.Transport.TransportPolicy == "block-quic" {
+		inform(KeyQUICBlocked, "QUIC is blocked by the transport policy, so browsers fall back from HTTP/3 to TCP")
+	}
+
+	if len(warnings) == 0 && len(infos) == 0 {
+		return []Finding{{Key: KeyNoIssues, Severity: SeverityInfo, Detail: "no known cause of slowness found"}}
+	}
+	return append(warnings, infos...)
+}
+
+// Throughput is the tunnel's speed over the last window, in bytes per
+// second.
+type Throughput struct {
+	UpBps         int64 `json:"upBps"`
+	DownBps       int64 `json:"downBps"`
+	PeakUpBps     int64 `json:"peakUpBps"`
+	PeakDownBps   int64 `json:"peakDownBps"`
+	WindowSeconds int   `json:"windowSeconds"` // covered by samples; 0 if none
+}
+
+type speedSample struct {
+	at       time.Time
+	up, down int64
+}
+
+// Meter keeps the speed samples of the stats poller over a window.
+type Meter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples []speedSample
+}
+
+// NewMeter returns a meter averaging over window.
+func NewMeter(window time.Duration) *Meter {
+	return &Meter{window: window}
+}
+
+// Record adds the speeds the stats poller measured at at.
+func (m *Meter) Record(at time.Time, up, down int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, speedSample{at: at, up: up, down: down})
+	m.trim(at)
+}
+
+// Reset drops the samples, when a session ends.
+func (m *Meter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = nil
+}
+
+// trim drops samples older than the window. Caller holds m.mu.
+func (m *Meter) trim(now time.Time) {
+	cut := 0
+	for cut < len(m.samples) && now.Sub(m.samples[cut].at) > m.window {
+		cut++
+	}
+	m.samples = append(m.samples[:0], m.samples[cut:]...)
+}
+
+// Throughput averages the samples of the window ending at now. A nil
+// meter has none.
+func (m *Meter) Throughput(now time.Time) Throughput {
+	if m == nil {
+		return Throughput{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trim(now)
+	var t Throughput
+	if len(m.samples) == 0 {
+		return t
+	}
+	var up, down int64
+	for _, s := range m.samples {
+		up += s.up
+		down += s.down
+		t.PeakUpBps = max(t.PeakUpBps, s.up)
+		t.PeakDownBps = max(t.PeakDownBps, s.down)
+	}
+	n := int64(len(m.samples))
+	t.UpBps, t.DownBps = up/n, down/n
+	t.WindowSeconds = int(now.Sub(m.samples[0].at).Round(time.Second) / time.Second)
+	return t
+}
@@ -0,0 +1,126 @@
+package perfreport
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ptr(f float64) *float64 { return &f }
+
+func keys(findings []Finding) string {
+	var out []string
+	for _, f := range findings {
+		out = append(out, f.Key)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestFindings(t *testing.T) {
+	tcp := Transport{Protocol: "vless", Transport: "tcp", Security: "reality", TransportPolicy: "auto"}
+	quic := Transport{Protocol: "hysteria2", Transport: "quic", Security: "tls", TransportPolicy: "auto"}
+	mux := tcp
+	mux.Mux = true
+
+	tests := []struct {
+		name string
+		in   Inputs
+		want string
+	}{
+		{"healthy", Inputs{Transport: tcp, RTTMs: 40, LossPercent: ptr(0), CPUPercent: ptr(12)}, KeyNoIssues},
+		{"thresholds are exclusive", Inputs{Transport: quic, RTTMs: HighRTTMs, LossPercent: ptr(LossPercent), CPUPercent: ptr(CPUSaturatedPct)}, KeyNoIssues},
+		{"far server", Inputs{Transport: tcp, RTTMs: 420}, KeyHighRTT},
+		{"lossy quic", Inputs{Transport: quic, LossPercent: ptr(3.5)}, KeyPacketLoss},
+		{"lossy tcp", Inputs{Transport: tcp, LossPercent: ptr(3.5)}, KeyPacketLoss + "," + KeyTCPOverTCP},
+		{"slight loss over tcp", Inputs{Transport: tcp, LossPercent: ptr(1.5)}, KeyTCPOverTCP},
+		{"mux with loss", Inputs{Transport: mux, LossPercent: ptr(0.8)}, KeyMuxHeadOfLine},
+		{"mux far away", Inputs{Transport: mux, RTTMs: 300}, KeyHighRTT + "," + KeyMuxHeadOfLine},
+		{"mux on a good link", Inputs{Transport: mux, RTTMs: 30, LossPercent: ptr(0.1)}, KeyNoIssues},
+		{"cpu", Inputs{Transport: tcp, CPUPercent: ptr(97)}, KeyCPUSaturated},
+		{"mtu", Inputs{Transport: tcp, MTU: 1500, SuggestedMTU: 1400}, KeyMTUMismatch},
+		{"stale mtu suggestion", Inputs{Transport: tcp, MTU: 1400, SuggestedMTU: 1400}, KeyNoIssues},
+		{"degraded", Inputs{Transport: tcp, Degraded: true, HealthReason: "probe_failed"}, KeySessionDegraded},
+		// Information comes after warnings, whatever was checked first.
+		{"upstream and quic blocked", Inputs{
+			Transport:     Transport{Protocol: "vless", Transport: "ws", TransportPolicy: "block-quic"},
+			UpstreamProxy: true,
+			RTTMs:         600,
+		}, KeyHighRTT + "," + KeyUpstreamProxy + "," + KeyQUICBlocked},
+	}
+	for _, tt := range tests {
+		got := Build(tt.in, time.Unix(1700000000, 0)).Findings
+		if keys(got) != tt.want {
+			t.Errorf("%s: findings %s, want %s", tt.name, keys(got), tt.want)
+		}
+		for _, f := range got {
+			if f.Detail == "" || (f.Severity != SeverityWarning && f.Severity != SeverityInfo) {
+				t.Errorf("%s: finding %+v", tt.name, f)
+			}
+		}
+	}
+}
+
+func TestCPUSaturatedSuggestsPerAppMode(t *testing.T) {
+	in := Inputs{CPUPercent: ptr(99), SplitMode: "app"}
+	if f := Build(in, time.Now()).Findings[0]; !strings.Contains(f.Detail, "per-app mode") {
+		t.Errorf("per-app mode: %q", f.Detail)
+	}
+	in.SplitMode = "domain"
+	if f := Build(in, time.Now()).Findings[0]; strings.Contains(f.Detail, "per-app mode") {
+		t.Errorf("domain mode: %q", f.Detail)
+	}
+}
+
+func TestReportSchema(t *testing.T) {
+	report := Build(Inputs{
+		Transport:  Transport{Protocol: "hysteria2", Transport: "quic", Security: "tls", TransportPolicy: "auto"},
+		RTTMs:      80,
+		Throughput: Throughput{UpBps: 1000, DownBps: 50000, PeakUpBps: 2000, PeakDownBps: 90000, WindowSeconds: 60},
+		CPUCores:   8,
+		MTU:        1500,
+	}, time.Unix(1700000000, 0))
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"transport", "rttMs", "throughput", "cpuCores", "mtu", "findings", "generatedAt"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("report lacks %q: %s", key, data)
+		}
+	}
+	// Figures that could not be measured are left out, not reported as 0.
+	for _, key := range []string{"lossPercent", "cpuPercent", "suggestedMtu"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("report has unmeasured %q: %s", key, data)
+		}
+	}
+}
+
+func TestMeter(t *testing.T) {
+	var nilMeter *Meter
+	if got := nilMeter.Throughput(time.Now()); got != (Throughput{}) {
+		t.Errorf("nil meter = %+v", got)
+	}
+
+	m := NewMeter(time.Minute)
+	start := time.Unix(1700000000, 0)
+	m.Record(start, 9999, 9999) // falls out of the window
+	for i := 1; i <= 60; i++ {
+		m.Record(start.Add(time.Duration(i)*time.Second), 100, int64(i*10))
+	}
+	got := m.Throughput(start.Add(70 * time.Second))
+	want := Throughput{UpBps: 100, DownBps: 350, PeakUpBps: 100, PeakDownBps: 600, WindowSeconds: 60}
+	if got != want {
+		t.Errorf("throughput = %+v, want %+v", got, want)
+	}
+
+	m.Reset()
+	if got := m.Throughput(start.Add(70 * time.Second)); got != (Throughput{}) {
+		t.Errorf("after reset = %+v", got)
+	}
+}
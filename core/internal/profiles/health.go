@@ -0,0 +1,228 @@
+package profiles
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/paths"
+)
+
+// HealthFileName is the health history file inside the data directory.
+const HealthFileName = "health.json"
+
+const (
+	healthWindow     = 7 * 24 * time.Hour // history kept per profile
+	maxHealthSamples = 200                // hard cap per profile
+	probeGap         = 2 * time.Second    // spacing between probes so a round doesn't look like a scan
+)
+
+// HealthSample is one latency probe result.
+type HealthSample struct {
+	At        time.Time `json:"at"`
+	LatencyMs int       `json:"latencyMs"`
+	OK        bool      `json:"ok"`
+}
+
+// ProfileHealth summarizes a profile's recent probe history.
+type ProfileHealth struct {
+	ProfileID     string  `json:"profileId"`
+	LastLatencyMs int     `json:"lastLatencyMs"` // 0 if the last probe failed
+	SuccessRate7d float64 `json:"successRate7d"` // 0..1
+	LastChecked   int64   `json:"lastChecked"`   // unix seconds, 0 if never checked
+	avgLatencyMs  int
+}
+
+// ProbeFunc measures latency to a server.
+type ProbeFunc func(server *parser.ServerConfig) (time.Duration, error)
+
+// HealthMonitor periodically probes saved profiles and keeps a rolling
+// latency/availability history for each.
+type HealthMonitor struct {
+	mu        sync.Mutex
+	store     *Store
+	path      string
+	probe     ProbeFunc
+	history   map[string][]HealthSample
+	lastRound time.Time
+
+	now   func() time.Time
+	sleep func(d time.Duration, stop <-chan struct{}) bool
+}
+
+// NewHealthMonitor creates a monitor over the given store, loading any
+// history persisted at path.
+func NewHealthMonitor(store *Store, path string, probe ProbeFunc) *HealthMonitor {
+	m := &HealthMonitor{
+		store:   store,
+		path:    path,
+		probe:   probe,
+		history: make(map[string][]HealthSample),
+		now:     time.Now,
+		sleep:   sleepOrStop,
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &m.history); err != nil {
+			log.Printf("warning: discarding unreadable health history: %v", err)
+			m.history = make(map[string][]HealthSample)
+		}
+	}
+	return m
+}
+
+// Run checks once a minute whether a probe round is due and runs it.
+// enabled reports whether monitoring is on and the round interval; busy
+// reports whether a VPN session is active, in which case probes would go
+// through the tunnel and skew results, so the round is skipped.
+func (m *HealthMonitor) Run(stop <-chan struct{}, enabled func() (bool, time.Duration), busy func() bool) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			on, interval := enabled()
+			if !on || busy() {
+				continue
+			}
+			m.mu.Lock()
+			due := m.now().Sub(m.lastRound) >= interval
+			m.mu.Unlock()
+			if due {
+				m.CheckAll(stop)
+			}
+		}
+	}
+}
+
+// CheckAll probes every saved profile once, spacing probes apart.
+func (m *HealthMonitor) CheckAll(stop <-chan struct{}) {
+	m.mu.Lock()
+	m.lastRound = m.now()
+	m.mu.Unlock()
+
+	for i, p := range m.store.List() {
+		if i > 0 && !m.sleep(probeGap, stop) {
+			return
+		}
+		server, err := parser.ParseLink(p.Link)
+		if err != nil {
+			continue
+		}
+		latency, err := m.probe(server)
+		m.record(p.ID, HealthSample{
+			At:        m.now(),
+			LatencyMs: int(latency.Milliseconds()),
+			OK:        err == nil,
+		})
+	}
+	m.save()
+}
+
+// record appends a sample and prunes history outside the window.
+func (m *HealthMonitor) record(id string, sample HealthSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !sample.OK {
+		sample.LatencyMs = 0
+	}
+	cutoff := m.now().Add(-healthWindow)
+	samples := append(m.history[id], sample)
+	start := 0
+	for start < len(samples) && !samples[start].At.After(cutoff) {
+		start++
+	}
+	if len(samples)-start > maxHealthSamples {
+		start = len(samples) - maxHealthSamples
+	}
+	m.history[id] = append([]HealthSample(nil), samples[start:]...)
+}
+
+// Forget drops the history of a deleted profile.
+func (m *HealthMonitor) Forget(id string) {
+	m.mu.Lock()
+	delete(m.history, id)
+	m.mu.Unlock()
+	m.save()
+}
+
+// Health returns a summary for every saved profile, in store order.
+func (m *HealthMonitor) Health() []ProfileHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := m.now().Add(-healthWindow)
+	profiles := m.store.List()
+	out := make([]ProfileHealth, 0, len(profiles))
+	for _, p := range profiles {
+		h := ProfileHealth{ProfileID: p.ID}
+		var total, ok, latencySum int
+		for _, s := range m.history[p.ID] {
+			if !s.At.After(cutoff) {
+				continue
+			}
+			total++
+			if s.OK {
+				ok++
+				latencySum += s.LatencyMs
+			}
+			h.LastLatencyMs = s.LatencyMs
+			h.LastChecked = s.At.Unix()
+		}
+		if total > 0 {
+			h.SuccessRate7d = float64(ok) / float64(total)
+		}
+		if ok > 0 {
+			h.avgLatencyMs = latencySum / ok
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// SuggestBest returns the profile with the best recent score: highest
+// success rate, then lowest average latency. Profiles that never answered
+// are not candidates.
+func (m *HealthMonitor) SuggestBest() (ProfileHealth, bool) {
+	var best ProfileHealth
+	found := false
+	for _, h := range m.Health() {
+		if h.SuccessRate7d == 0 {
+			continue
+		}
+		if !found || h.SuccessRate7d > best.SuccessRate7d ||
+			(h.SuccessRate7d == best.SuccessRate7d && h.avgLatencyMs < best.avgLatencyMs) {
+			best = h
+			found = true
+		}
+	}
+	return best, found
+}
+
+func (m *HealthMonitor) save() {
+	m.mu.Lock()
+	data, err := json.Marshal(m.history)
+	m.mu.Unlock()
+	if err != nil {
+		return
+	}
+	if err := paths.WriteFileAtomic(m.path, data); err != nil {
+		log.Printf("warning: failed to save health history: %v", err)
+	}
+}
+
+// sleepOrStop waits for d and returns false if stop closed first.
+func sleepOrStop(d time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
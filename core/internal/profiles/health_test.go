@@ -0,0 +1,121 @@
+package profiles
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestMonitor(t *testing.T, links map[string]string, probe ProbeFunc) (*HealthMonitor, map[string]string, *fakeClock) {
+	t.Helper()
+	dir := t.TempDir()
+	store := Open(filepath.Join(dir, FileName), nil)
+	ids := make(map[string]string)
+	for name, link := range links {
+		p, err := store.Save(Profile{Name: name, Link: link})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = p.ID
+	}
+
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewHealthMonitor(store, filepath.Join(dir, HealthFileName), probe)
+	m.now = clock.now
+	m.sleep = func(time.Duration, <-chan struct{}) bool { return true }
+	return m, ids, clock
+}
+
+func TestHealthSuggestBest(t *testing.T) {
+	latency := map[string]time.Duration{
+		"fast.example.com": 20 * time.Millisecond,
+		"slow.example.com": 200 * time.Millisecond,
+	}
+	down := map[string]bool{"dead.example.com": true}
+	probe := func(s *parser.ServerConfig) (time.Duration, error) {
+		if down[s.Address] {
+			return 0, errors.New("timeout")
+		}
+		return latency[s.Address], nil
+	}
+
+	m, ids, clock := newTestMonitor(t, map[string]string{
+		"fast": "vless://u@fast.example.com:443",
+		"slow": "vless://u@slow.example.com:443",
+		"dead": "hy2://p@dead.example.com:443",
+	}, probe)
+
+	m.CheckAll(nil)
+	clock.advance(time.Hour)
+	m.CheckAll(nil)
+
+	best, ok := m.SuggestBest()
+	if !ok || best.ProfileID != ids["fast"] {
+		t.Fatalf("SuggestBest = %+v, want fast", best)
+	}
+
+	// The fast server starts failing; a perfect success rate beats latency.
+	down["fast.example.com"] = true
+	clock.advance(time.Hour)
+	m.CheckAll(nil)
+
+	best, _ = m.SuggestBest()
+	if best.ProfileID != ids["slow"] {
+		t.Fatalf("SuggestBest after failures = %+v, want slow", best)
+	}
+
+	for _, h := range m.Health() {
+		switch h.ProfileID {
+		case ids["dead"]:
+			if h.SuccessRate7d != 0 || h.LastLatencyMs != 0 {
+				t.Errorf("dead health = %+v", h)
+			}
+		case ids["fast"]:
+			if h.SuccessRate7d < 0.66 || h.SuccessRate7d > 0.67 || h.LastLatencyMs != 0 {
+				t.Errorf("fast health = %+v, want 2/3 success and failed last probe", h)
+			}
+			if h.LastChecked != clock.t.Unix() {
+				t.Errorf("fast LastChecked = %d, want %d", h.LastChecked, clock.t.Unix())
+			}
+		}
+	}
+}
+
+func TestHealthHistoryPruned(t *testing.T) {
+	m, ids, clock := newTestMonitor(t, map[string]string{
+		"a": "vless://u@a.example.com:443",
+	}, func(*parser.ServerConfig) (time.Duration, error) { return 10 * time.Millisecond, nil })
+
+	for i := 0; i < 10; i++ {
+		m.CheckAll(nil)
+		clock.advance(24 * time.Hour)
+	}
+	if n := len(m.history[ids["a"]]); n != 7 {
+		t.Errorf("history length = %d, want 7 samples inside the 7-day window", n)
+	}
+
+	m.Forget(ids["a"])
+	if _, ok := m.history[ids["a"]]; ok {
+		t.Error("Forget did not drop history")
+	}
+}
+
+func TestHealthHistoryPersisted(t *testing.T) {
+	m, ids, _ := newTestMonitor(t, map[string]string{
+		"a": "vless://u@a.example.com:443",
+	}, func(*parser.ServerConfig) (time.Duration, error) { return 10 * time.Millisecond, nil })
+	m.CheckAll(nil)
+
+	reloaded := NewHealthMonitor(m.store, m.path, m.probe)
+	if len(reloaded.history[ids["a"]]) != 1 {
+		t.Errorf("reloaded history = %v, want 1 sample", reloaded.history)
+	}
+}
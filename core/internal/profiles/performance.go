@@ -0,0 +1,268 @@
+package profiles
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/paths"
+)
+
+// PerformanceFileName is the connect timing history file inside the data
+// directory.
+const PerformanceFileName = "performance.json"
+
+const (
+	maxConnectSamples = 20  // kept per server
+	maxTrackedServers = 100 // least recently used servers are pruned beyond this
+	maxReconnects     = 50  // kept per sample
+)
+
+// ConnectSample is the stage timing of one successful connect.
+type ConnectSample struct {
+	At             time.Time `json:"at"`
+	BuildMs        int64     `json:"buildMs"`
+	StartMs        int64     `json:"startMs"`
+	TotalMs        int64     `json:"totalMs"`
+	FirstTrafficMs int64     `json:"firstTrafficMs,omitempty"` // 0 if no traffic was verified
+
+	// Links re-established during the session, oldest first; see
+	// RecordReconnect.
+	Reconnects []time.Time `json:"reconnects,omitempty"`
+
+	// Set when the session ends; see RecordEnd.
+	EndedAt          *time.Time `json:"endedAt,omitempty"`
+	DisconnectReason string     `json:"disconnectReason,omitempty"`
+}
+
+// serverPerformance is the persisted history of one server.
+type serverPerformance struct {
+	Name     string          `json:"name"` // last name seen; display only
+	Address  string          `json:"address"`
+	Protocol string          `json:"protocol"`
+	LastUsed time.Time       `json:"lastUsed"`
+	Samples  []ConnectSample `json:"samples"` // oldest first
+}
+
+// ServerPerformance summarizes a server's connect history.
+type ServerPerformance struct {
+	Key               string        `json:"key"`            // parser.CanonicalKey
+	Link              string        `json:"link,omitempty"` // the queried link, when looked up by link
+	Name              string        `json:"name"`
+	Address           string        `json:"address"`
+	Protocol          string        `json:"protocol"`
+	LastUsed          int64         `json:"lastUsed"` // unix seconds
+	Samples           int           `json:"samples"`
+	AvgBuildMs        int64         `json:"avgBuildMs"`
+	AvgStartMs        int64         `json:"avgStartMs"`
+	AvgTotalMs        int64         `json:"avgTotalMs"`
+	AvgFirstTrafficMs int64         `json:"avgFirstTrafficMs"` // over samples that verified traffic; 0 if none did
+	Last              ConnectSample `json:"last"`
+}
+
+// PerformanceStore keeps recent connect timings per server, keyed by
+// parser.CanonicalKey so duplicate links share one history.
+type PerformanceStore struct {
+	mu      sync.Mutex
+	path    string
+	servers map[string]*serverPerformance
+}
+
+// OpenPerformance loads the history persisted at path. A missing or
+// unreadable file starts an empty history.
+func OpenPerformance(path string) *PerformanceStore {
+	s := &PerformanceStore{path: path, servers: make(map[string]*serverPerformance)}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &s.servers); err != nil {
+			log.Printf("warning: discarding unreadable performance history: %v", err)
+			s.servers = make(map[string]*serverPerformance)
+		}
+	}
+	return s
+}
+
+// Record adds a sample for server and persists the history.
+func (s *PerformanceStore) Record(server *parser.ServerConfig, sample ConnectSample) {
+	s.record(server, sample)
+	s.save()
+}
+
+func (s *PerformanceStore) record(server *parser.ServerConfig, sample ConnectSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := parser.CanonicalKey(server)
+	sp := s.servers[key]
+	if sp == nil {
+		sp = &serverPerformance{}
+		s.servers[key] = sp
+	}
+	sp.Name = server.Name
+	sp.Address = server.Address
+	sp.Protocol = server.Protocol
+	sp.LastUsed = sample.At
+	sp.Samples = append(sp.Samples, sample)
+	if len(sp.Samples) > maxConnectSamples {
+		sp.Samples = append([]ConnectSample(nil), sp.Samples[len(sp.Samples)-maxConnectSamples:]...)
+	}
+	s.prune()
+}
+
+// RecordEnd marks the sample of the connect started at startedAt as ended
+// for reason and persists the history. Sessions without a sample, such as
+// ones for servers pruned since, are ignored.
+func (s *PerformanceStore) RecordEnd(server *parser.ServerConfig, startedAt, endedAt time.Time, reason string) {
+	if s.recordEnd(server, startedAt, endedAt, reason) {
+		s.save()
+	}
+}
+
+func (s *PerformanceStore) recordEnd(server *parser.ServerConfig, startedAt, endedAt time.Time, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp := s.servers[parser.CanonicalKey(server)]
+	if sp == nil {
+		return false
+	}
+	for i := len(sp.Samples) - 1; i >= 0; i-- {
+		if sp.Samples[i].At.Equal(startedAt) {
+			sp.Samples[i].EndedAt = &endedAt
+			sp.Samples[i].DisconnectReason = reason
+			return true
+		}
+	}
+	return false
+}
+
+// RecordReconnect adds a reconnect at at to the sample of the session
+// started at sessionStarted and persists the history. Like RecordEnd it
+// ignores sessions without a sample.
+func (s *PerformanceStore) RecordReconnect(server *parser.ServerConfig, sessionStarted, at time.Time) {
+	if s.recordReconnect(server, sessionStarted, at) {
+		s.save()
+	}
+}
+
+func (s *PerformanceStore) recordReconnect(server *parser.ServerConfig, sessionStarted, at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp := s.servers[parser.CanonicalKey(server)]
+	if sp == nil {
+		return false
+	}
+	for i := len(sp.Samples) - 1; i >= 0; i-- {
+		if sp.Samples[i].At.Equal(sessionStarted) {
+			r := append(sp.Samples[i].Reconnects, at)
+			if len(r) > maxReconnects {
+				r = append([]time.Time(nil), r[len(r)-maxReconnects:]...)
+			}
+			sp.Samples[i].Reconnects = r
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops the least recently used servers beyond maxTrackedServers.
+func (s *PerformanceStore) prune() {
+	if len(s.servers) <= maxTrackedServers {
+		return
+	}
+	keys := s.keysByLastUse()
+	for _, key := range keys[maxTrackedServers:] {
+		delete(s.servers, key)
+	}
+}
+
+// keysByLastUse returns the server keys, most recently used first.
+func (s *PerformanceStore) keysByLastUse() []string {
+	keys := make([]string, 0, len(s.servers))
+	for key := range s.servers {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := s.servers[keys[i]].LastUsed, s.servers[keys[j]].LastUsed
+		if a.Equal(b) {
+			return keys[i] < keys[j]
+		}
+		return a.After(b)
+	})
+	return keys
+}
+
+// All returns a summary for every tracked server, most recently used first.
+func (s *PerformanceStore) All() []ServerPerformance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]ServerPerformance, 0, len(s.servers))
+	for _, key := range s.keysByLastUse() {
+		out = append(out, s.summary(key))
+	}
+	return out
+}
+
+// Get returns the summary for server, if it has any history.
+func (s *PerformanceStore) Get(server *parser.ServerConfig) (ServerPerformance, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := parser.CanonicalKey(server)
+	if s.servers[key] == nil {
+		return ServerPerformance{}, false
+	}
+	return s.summary(key), true
+}
+
+func (s *PerformanceStore) summary(key string) ServerPerformance {
+	sp := s.servers[key]
+	out := ServerPerformance{
+		Key:      key,
+		Name:     sp.Name,
+		Address:  sp.Address,
+		Protocol: sp.Protocol,
+		LastUsed: sp.LastUsed.Unix(),
+		Samples:  len(sp.Samples),
+	}
+	if len(sp.Samples) == 0 {
+		return out
+	}
+
+	var build, start, total, traffic, verified int64
+	for _, sample := range sp.Samples {
+		build += sample.BuildMs
+		start += sample.StartMs
+		total += sample.TotalMs
+		if sample.FirstTrafficMs > 0 {
+			traffic += sample.FirstTrafficMs
+			verified++
+		}
+	}
+	n := int64(len(sp.Samples))
+	out.AvgBuildMs = build / n
+	out.AvgStartMs = start / n
+	out.AvgTotalMs = total / n
+	if verified > 0 {
+		out.AvgFirstTrafficMs = traffic / verified
+	}
+	out.Last = sp.Samples[len(sp.Samples)-1]
+	return out
+}
+
+func (s *PerformanceStore) save() {
+	s.mu.Lock()
+	data, err := json.Marshal(s.servers)
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+	if err := paths.WriteFileAtomic(s.path, data); err != nil {
+		log.Printf("warning: failed to save performance history: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package profiles
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+func mustParse(t *testing.T, link string) *parser.ServerConfig {
+	t.Helper()
+	cfg, err := parser.ParseLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestPerformanceAveraging(t *testing.T) {
+	s := OpenPerformance(filepath.Join(t.TempDir(), PerformanceFileName))
+	server := mustParse(t, "vless://u@example.com:443#Main")
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s.Record(server, ConnectSample{At: at, BuildMs: 10, StartMs: 100, TotalMs: 120, FirstTrafficMs: 400})
+	s.Record(server, ConnectSample{At: at.Add(time.Hour), BuildMs: 20, StartMs: 300, TotalMs: 330})
+
+	// A duplicate link with a different name shares the history.
+	got, ok := s.Get(mustParse(t, "vless://u@example.com:443?fp=chrome#Copy"))
+	if !ok {
+		t.Fatal("no history for duplicate link")
+	}
+	if got.Samples != 2 || got.AvgBuildMs != 15 || got.AvgStartMs != 200 || got.AvgTotalMs != 225 {
+		t.Errorf("averages = %+v", got)
+	}
+	// Samples without verified traffic don't drag the average to zero.
+	if got.AvgFirstTrafficMs != 400 {
+		t.Errorf("AvgFirstTrafficMs = %d, want 400", got.AvgFirstTrafficMs)
+	}
+	if got.Last.TotalMs != 330 || got.Name != "Main" {
+		t.Errorf("last = %+v, name = %q", got.Last, got.Name)
+	}
+}
+
+func TestPerformanceKeepsRecentSamples(t *testing.T) {
+	s := OpenPerformance(filepath.Join(t.TempDir(), PerformanceFileName))
+	server := mustParse(t, "hy2://p@example.com:443")
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < maxConnectSamples+5; i++ {
+		s.record(server, ConnectSample{At: at.Add(time.Duration(i) * time.Minute), TotalMs: int64(i)})
+	}
+	got, _ := s.Get(server)
+	if got.Samples != maxConnectSamples || got.Last.TotalMs != maxConnectSamples+4 {
+		t.Errorf("summary = %+v", got)
+	}
+	// Only the newest samples remain: 5..24.
+	if want := int64(5+maxConnectSamples+4) / 2; got.AvgTotalMs != want {
+		t.Errorf("AvgTotalMs = %d, want %d", got.AvgTotalMs, want)
+	}
+}
+
+func TestPerformancePrunesLeastRecentlyUsed(t *testing.T) {
+	s := OpenPerformance(filepath.Join(t.TempDir(), PerformanceFileName))
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	first := mustParse(t, "vless://u@server0.example.com:443")
+	s.record(first, ConnectSample{At: at})
+	for i := 1; i <= maxTrackedServers; i++ {
+		server := mustParse(t, fmt.Sprintf("vless://u@server%d.example.com:443", i))
+		s.record(server, ConnectSample{At: at.Add(time.Duration(i) * time.Minute)})
+		if i == maxTrackedServers/2 {
+			// Using the oldest server again protects it from pruning.
+			s.record(first, ConnectSample{At: at.Add(time.Duration(i)*time.Minute + time.Second)})
+		}
+	}
+
+	all := s.All()
+	if len(all) != maxTrackedServers {
+		t.Fatalf("tracked %d servers, want %d", len(all), maxTrackedServers)
+	}
+	if _, ok := s.Get(first); !ok {
+		t.Error("recently used server was pruned")
+	}
+	if _, ok := s.Get(mustParse(t, "vless://u@server1.example.com:443")); ok {
+		t.Error("least recently used server survived")
+	}
+	if all[0].Address != fmt.Sprintf("server%d.example.com", maxTrackedServers) {
+		t.Errorf("All()[0] = %s, want most recent first", all[0].Address)
+	}
+}
+
+func TestPerformancePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PerformanceFileName)
+	server := mustParse(t, "vless://u@example.com:443")
+	OpenPerformance(path).Record(server, ConnectSample{At: time.Now(), TotalMs: 42})
+
+	got, ok := OpenPerformance(path).Get(server)
+	if !ok || got.Last.TotalMs != 42 {
+		t.Errorf("reloaded = %+v, %v", got, ok)
+	}
+}
+
+func TestPerformanceRecordEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PerformanceFileName)
+	s := OpenPerformance(path)
+	server := mustParse(t, "vless://u@example.com:443#Main")
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s.Record(server, ConnectSample{At: at, TotalMs: 100})
+	s.Record(server, ConnectSample{At: at.Add(time.Hour), TotalMs: 200})
+
+	// The end is matched to its session, not simply the newest sample.
+	s.RecordEnd(server, at, at.Add(30*time.Minute), "idle")
+	// Unknown sessions and servers are ignored.
+	s.RecordEnd(server, at.Add(time.Minute), at.Add(2*time.Minute), "user")
+	s.RecordEnd(mustParse(t, "hy2://p@other.example.com:443"), at, at, "user")
+
+	reopened := OpenPerformance(path)
+	sp := reopened.servers[parser.CanonicalKey(server)]
+	if sp == nil || len(sp.Samples) != 2 {
+		t.Fatalf("history = %+v", sp)
+	}
+	first, last := sp.Samples[0], sp.Samples[1]
+	if first.DisconnectReason != "idle" || first.EndedAt == nil || !first.EndedAt.Equal(at.Add(30*time.Minute)) {
+		t.Errorf("ended sample = %+v", first)
+	}
+	if last.DisconnectReason != "" || last.EndedAt != nil {
+		t.Errorf("running sample = %+v", last)
+	}
+	if len(reopened.servers) != 1 {
+		t.Errorf("RecordEnd added servers: %d", len(reopened.servers))
+	}
+}
+
+func TestPerformanceRecordReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PerformanceFileName)
+	s := OpenPerformance(path)
+	server := mustParse(t, "vless://u@example.com:443#Main")
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s.Record(server, ConnectSample{At: at, TotalMs: 100})
+	s.Record(server, ConnectSample{At: at.Add(time.Hour), TotalMs: 200})
+
+	// Reconnects stay events of their session rather than new samples.
+	s.RecordReconnect(server, at, at.Add(10*time.Minute))
+	s.RecordReconnect(server, at, at.Add(20*time.Minute))
+	s.RecordReconnect(server, at.Add(time.Minute), at.Add(2*time.Minute))
+	s.RecordEnd(server, at, at.Add(30*time.Minute), "user")
+
+	sp := OpenPerformance(path).servers[parser.CanonicalKey(server)]
+	if sp == nil || len(sp.Samples) != 2 {
+		t.Fatalf("history = %+v", sp)
+	}
+	first := sp.Samples[0]
+	if len(first.Reconnects) != 2 || !first.Reconnects[1].Equal(at.Add(20*time.Minute)) || first.DisconnectReason != "user" {
+		t.Errorf("session = %+v", first)
+	}
+	if sp.Samples[1].Reconnects != nil {
+		t.Errorf("other session = %+v", sp.Samples[1])
+	}
+
+	for i := 0; i < maxReconnects+5; i++ {
+		s.recordReconnect(server, at, at.Add(time.Duration(i)*time.Second))
+	}
+	if got := s.servers[parser.CanonicalKey(server)].Samples[0].Reconnects; len(got) != maxReconnects {
+		t.Errorf("kept %d reconnects, want %d", len(got), maxReconnects)
+	}
+}
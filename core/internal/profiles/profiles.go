@@ -0,0 +1,289 @@
+package profiles
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/mriaz/vpn-core/internal/datafile"
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// FileName is the profiles file inside the data directory.
+const FileName = "profiles.json"
+
+// Bounds of the profiles and subscriptions files. A larger file is not
+// read; a profile or subscription over the others is dropped at load.
+// A profile whose link no longer parses, as after validation got
+// stricter, is within bounds: it is kept and marked Invalid.
+const (
+	maxProfilesFileBytes      = 32 << 20
+	maxSubscriptionsFileBytes = 8 << 20
+	maxProfiles               = 20000
+	maxSubscriptions          = 500
+	maxIDLength               = 64
+	maxNameLength             = 1024
+	maxLinkLength             = 64 << 10
+	maxExcluded               = 20000 // of a subscription
+)
+
+// ErrNotFound is returned when a profile ID does not exist.
+var ErrNotFound = errors.New("profile not found")
+
+// Profile is a saved server the user can connect to.
+type Profile struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Link string `json:"link"`
+
+	// Set on profiles a subscription added, and kept by Save: the
+	// subscription's ID, the server's parser.CanonicalKey by which updates
+	// find the profile, and the name and link the subscription last
+	// published. A Name or Link that differs from them is the user's and
+	// survives updates.
+	Subscription string `json:"subscription,omitempty"`
+	Key          string `json:"key,omitempty"`
+	SourceName   string `json:"sourceName,omitempty"`
+	SourceLink   string `json:"sourceLink,omitempty"`
+
+	// Invalid is why Link no longer parses, set at load. Such a profile
+	// cannot connect until saved with a link that does.
+	Invalid string `json:"invalid,omitempty"`
+}
+
+// Store holds saved profiles and subscriptions and persists changes to
+// disk.
+type Store struct {
+	mu            sync.RWMutex
+	path          string
+	subsPath      string // SubscriptionsFileName, next to path
+	guard         *datafile.Guard
+	profiles      []Profile
+	subscriptions []Subscription
+	loadIssues    []datafile.Issue // what Open found wrong with the files
+}
+
+// Open loads profiles from path, and subscriptions from the
+// SubscriptionsFileName next to it, checking the files with guard unless
+// it is nil. It never fails: a missing file yields an empty list, one that
+// cannot be read or fails the guard is quarantined and yields an empty
+// list, and a profile or subscription out of bounds is dropped.
+// LoadIssues reports what was found. A profile whose link does not parse
+// is kept, marked Invalid.
+func Open(path string, guard *datafile.Guard) *Store {
+	s := &Store{path: path, subsPath: filepath.Join(filepath.Dir(path), SubscriptionsFileName), guard: guard}
+
+	_, issues := datafile.Load(s.subsPath, maxSubscriptionsFileBytes, guard, func(data []byte) error {
+		var subs []Subscription
+		if err := json.Unmarshal(data, &subs); err != nil {
+			return fmt.Errorf("failed to parse subscriptions: %w", err)
+		}
+		s.subscriptions = validSubscriptions(s.subsPath, subs, &s.loadIssues)
+		return nil
+	})
+	s.loadIssues = append(s.loadIssues, issues...)
+
+	_, issues = datafile.Load(path, maxProfilesFileBytes, guard, func(data []byte) error {
+		var profiles []Profile
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return fmt.Errorf("failed to parse profiles: %w", err)
+		}
+		s.profiles = validProfiles(path, profiles, &s.loadIssues)
+		return nil
+	})
+	s.loadIssues = append(s.loadIssues, issues...)
+	return s
+}
+
+// LoadIssues returns what Open found wrong with the files.
+func (s *Store) LoadIssues() []datafile.Issue {
+	return slices.Clone(s.loadIssues)
+}
+
+// validProfiles returns the profiles loaded from file that are within
+// bounds, adding an issue for each one dropped, and marks those whose
+// link does not parse Invalid.
+func validProfiles(file string, profiles []Profile, issues *[]datafile.Issue) []Profile {
+	valid := make([]Profile, 0, len(profiles))
+	seen := make(map[string]bool, len(profiles))
+	for i, p := range profiles {
+		var err error
+		switch {
+		case len(valid) == maxProfiles:
+			err = fmt.Errorf("more than %d profiles", maxProfiles)
+		case p.ID == "" || len(p.ID) > maxIDLength:
+			err = fmt.Errorf("id must be 1 to %d characters", maxIDLength)
+		case seen[p.ID]:
+			err = fmt.Errorf("id %q is used twice", p.ID)
+		case len(p.Name) > maxNameLength || len(p.SourceName) > maxNameLength:
+			err = fmt.Errorf("name is longer than %d bytes", maxNameLength)
+		case len(p.Link) > maxLinkLength || len(p.SourceLink) > maxLinkLength:
+			err = fmt.Errorf("link is longer than %d bytes", maxLinkLength)
+		}
+		if err != nil {
+			*issues = append(*issues, datafile.InvalidField(file, fmt.Sprintf("[%d]", i), err))
+			continue
+		}
+		p.Invalid = ""
+		if _, err := parser.ParseLink(p.Link); err != nil {
+			p.Invalid = err.Error()
+		}
+		seen[p.ID] = true
+		valid = append(valid, p)
+	}
+	return valid
+}
+
+// validSubscriptions returns the subscriptions loaded from file that are
+// within bounds, adding an issue for each one dropped.
+func validSubscriptions(file string, subs []Subscription, issues *[]datafile.Issue) []Subscription {
+	valid := make([]Subscription, 0, len(subs))
+	seen := make(map[string]bool, len(subs))
+	for i, sub := range subs {
+		var err error
+		switch {
+		case len(valid) == maxSubscriptions:
+			err = fmt.Errorf("more than %d subscriptions", maxSubscriptions)
+		case sub.ID == "" || len(sub.ID) > maxIDLength:
+			err = fmt.Errorf("id must be 1 to %d characters", maxIDLength)
+		case seen[sub.ID]:
+			err = fmt.Errorf("id %q is used twice", sub.ID)
+		case len(sub.Name) > maxNameLength || len(sub.URL) > maxLinkLength:
+			err = errors.New("name or url too long")
+		case len(sub.Excluded) > maxExcluded:
+			err = fmt.Errorf("more than %d excluded servers", maxExcluded)
+		default:
+			err = sub.Validate()
+		}
+		if err != nil {
+			*issues = append(*issues, datafile.InvalidField(file, fmt.Sprintf("[%d]", i), err))
+			continue
+		}
+		seen[sub.ID] = true
+		valid = append(valid, sub)
+	}
+	return valid
+}
+
+// List returns a copy of all profiles in saved order.
+func (s *Store) List() []Profile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Profile, len(s.profiles))
+	copy(out, s.profiles)
+	return out
+}
+
+// Get returns the profile with the given ID.
+func (s *Store) Get(id string) (Profile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.profiles {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Save adds a new profile (empty ID) or replaces an existing one. The link
+// must parse; an empty name defaults to the link's name. A replaced
+// profile stays linked to its subscription; a new one never is.
+func (s *Store) Save(p Profile) (Profile, error) {
+	server, err := parser.ParseLink(p.Link)
+	if err != nil {
+		return p, err
+	}
+	if p.Name == "" {
+		p.Name = server.Name
+	}
+	p.Invalid = ""
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := make([]Profile, len(s.profiles))
+	copy(next, s.profiles)
+	if p.ID == "" {
+		p.ID = newID()
+		p.Subscription, p.Key, p.SourceName, p.SourceLink = "", "", "", ""
+		next = append(next, p)
+	} else {
+		found := false
+		for i := range next {
+			if next[i].ID == p.ID {
+				old := next[i]
+				p.Subscription, p.Key, p.SourceName, p.SourceLink = old.Subscription, old.Key, old.SourceName, old.SourceLink
+				next[i] = p
+				found = true
+				break
+			}
+		}
+		if !found {
+			return p, ErrNotFound
+		}
+	}
+
+	if err := s.persist(next); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// Delete removes the profile with the given ID. A server deleted from a
+// subscription stays excluded from its updates.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := make([]Profile, 0, len(s.profiles))
+	var deleted Profile
+	for _, p := range s.profiles {
+		if p.ID != id {
+			next = append(next, p)
+		} else {
+			deleted = p
+		}
+	}
+	if len(next) == len(s.profiles) {
+		return ErrNotFound
+	}
+	if err := s.persist(next); err != nil {
+		return err
+	}
+	if deleted.Subscription == "" {
+		return nil
+	}
+	subs := s.cloneSubscriptions()
+	for i := range subs {
+		if subs[i].ID == deleted.Subscription && !slices.Contains(subs[i].Excluded, deleted.Key) {
+			subs[i].Excluded = append(subs[i].Excluded, deleted.Key)
+			return s.persistSubscriptions(subs)
+		}
+	}
+	return nil
+}
+
+// persist writes profiles to disk and swaps them in. Caller holds s.mu.
+func (s *Store) persist(profiles []Profile) error {
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.guard.WriteFile(s.path, data); err != nil {
+		return fmt.Errorf("failed to save profiles: %w", err)
+	}
+	s.profiles = profiles
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
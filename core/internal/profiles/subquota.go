@@ -0,0 +1,235 @@
+package profiles
+
+import (
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subscription servers commonly report the user's traffic quota and
+// expiry in a subscription-userinfo header, such as
+//
+//	upload=455727941; download=6174315083; total=1073741824000; expire=1671815872
+//
+// A refresh keeps the last one on the subscription. CheckQuotas warns when
+// usage crosses QuotaWarnUsed80 or QuotaWarnUsed95 of the total, or the
+// expiry is within quotaExpiryWarning, once each until the quota is
+// renewed.
+
+// SubscriptionUserinfoHeader is the response header carrying the quota.
+const SubscriptionUserinfoHeader = "Subscription-Userinfo"
+
+// Quota warnings, each sent once until the quota is renewed.
+const (
+	QuotaWarnUsed80   = "used80"   // 80% of the total used
+	QuotaWarnUsed95   = "used95"   // 95% of the total used
+	QuotaWarnExpiring = "expiring" // expires within 3 days, or has expired
+)
+
+// quotaExpiryWarning is how close to its expiry a subscription warns.
+const quotaExpiryWarning = 3 * 24 * time.Hour
+
+// SubscriptionQuota is a subscription's quota as its server reported it.
+// A zero Total is unlimited, a zero Expire never expires.
+type SubscriptionQuota struct {
+	Upload   int64 `json:"upload"`   // bytes
+	Download int64 `json:"download"` // bytes
+	Total    int64 `json:"total"`    // bytes
+	Expire   int64 `json:"expire"`   // unix seconds
+}
+
+// QuotaStatus is a quota with the figures derived from it at some time.
+type QuotaStatus struct {
+	SubscriptionQuota
+	Used        int64   `json:"used"`                  // upload plus download
+	PercentUsed float64 `json:"percentUsed,omitempty"` // of Total, to one decimal; 0 when unlimited
+	// Whole days left until Expire, negative once expired; absent when it
+	// never expires.
+	DaysUntilExpiry *int `json:"daysUntilExpiry,omitempty"`
+}
+
+// QuotaWarning is a quota warning due for a subscription.
+type QuotaWarning struct {
+	ID     string      `json:"id"`
+	Name   string      `json:"name"`
+	Kind   string      `json:"kind" jsonschema:"enum=used80|used95|expiring"`
+	Status QuotaStatus `json:"status"`
+}
+
+// Status returns q with its derived figures at now.
+func (q SubscriptionQuota) Status(now time.Time) QuotaStatus {
+	status := QuotaStatus{SubscriptionQuota: q, Used: q.Upload + q.Download}
+	if q.Total > 0 {
+		status.PercentUsed = math.Round(float64(status.Used)*1000/float64(q.Total)) / 10
+	}
+	if q.Expire > 0 {
+		days := int(math.Floor(time.Unix(q.Expire, 0).Sub(now).Hours() / 24))
+		status.DaysUntilExpiry = &days
+	}
+	return status
+}
+
+// warnings returns the quota warnings that apply to q at now, in order of
+// severity.
+func (q SubscriptionQuota) warnings(now time.Time) []string {
+	var kinds []string
+	if q.Total > 0 {
+		used := q.Upload + q.Download
+		if used*100 >= q.Total*80 {
+			kinds = append(kinds, QuotaWarnUsed80)
+		}
+		if used*100 >= q.Total*95 {
+			kinds = append(kinds, QuotaWarnUsed95)
+		}
+	}
+	if q.Expire > 0 && time.Unix(q.Expire, 0).Sub(now) <= quotaExpiryWarning {
+		kinds = append(kinds, QuotaWarnExpiring)
+	}
+	return kinds
+}
+
+// ParseSubscriptionUserinfo parses a subscription-userinfo header. Fields
+// may be separated by semicolons or commas and come in any order; missing
+// ones are zero. Sizes are bytes or human strings like "10GB" or
+// "1.5 GiB", where every unit is a power of 1024. Expire is unix seconds
+// or milliseconds, or a date. ok is false when no field could be read.
+func ParseSubscriptionUserinfo(header string) (q SubscriptionQuota, ok bool) {
+	fields := strings.FieldsFunc(header, func(r rune) bool { return r == ';' || r == ',' })
+	for _, field := range fields {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		var target *int64
+		parse := parseQuotaSize
+		switch key {
+		case "upload":
+			target = &q.Upload
+		case "download":
+			target = &q.Download
+		case "total":
+			target = &q.Total
+		case "expire", "expiry":
+			target, parse = &q.Expire, parseQuotaExpire
+		default:
+			continue
+		}
+		if v, valid := parse(value); valid {
+			*target = v
+			ok = true
+		}
+	}
+	return q, ok
+}
+
+var quotaSizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]*)$`)
+
+var quotaUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40, "tib": 1 << 40,
+	"p": 1 << 50, "pb": 1 << 50, "pib": 1 << 50,
+}
+
+// parseQuotaSize parses a size in bytes, such as "1073741824", "1.07e9"
+// or "1 GB".
+func parseQuotaSize(s string) (int64, bool) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, n >= 0
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(f), f >= 0 && f < math.MaxInt64
+	}
+	m := quotaSizePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	unit, known := quotaUnits[strings.ToLower(m[2])]
+	f, err := strconv.ParseFloat(m[1], 64)
+	if !known || err != nil || f*unit >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f * unit), true
+}
+
+// parseQuotaExpire parses an expiry in unix seconds or milliseconds, or as
+// an RFC 3339 time or a date, taken as UTC.
+func parseQuotaExpire(s string) (int64, bool) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f < 0 {
+			return 0, false
+		}
+		if f > 1e12 { // milliseconds
+			f /= 1000
+		}
+		return int64(f), true
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix(), true
+		}
+	}
+	return 0, false
+}
+
+// Info returns the subscription with the given ID and the status of its
+// quota at the updater's clock, nil when its server reports none.
+func (u *SubscriptionUpdater) Info(id string) (Subscription, *QuotaStatus, bool) {
+	sub, ok := u.store.GetSubscription(id)
+	if !ok || sub.Quota == nil {
+		return sub, nil, ok
+	}
+	status := sub.Quota.Status(u.now())
+	return sub, &status, true
+}
+
+// CheckQuotas returns the quota warnings due for the subscriptions at the
+// updater's clock and records them as sent. A warning that no longer
+// applies, as after the quota was renewed, is forgotten so it can be
+// sent again.
+func (u *SubscriptionUpdater) CheckQuotas() ([]QuotaWarning, error) {
+	return u.store.checkQuotas(u.now())
+}
+
+func (s *Store) checkQuotas(now time.Time) ([]QuotaWarning, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := s.cloneSubscriptions()
+	var due []QuotaWarning
+	changed := false
+	for i := range subs {
+		sub := &subs[i]
+		var applying []string
+		if sub.Quota != nil {
+			applying = sub.Quota.warnings(now)
+		}
+		// Only the most severe new usage warning is sent.
+		var fresh []string
+		for _, kind := range applying {
+			if !slices.Contains(sub.QuotaWarned, kind) {
+				fresh = append(fresh, kind)
+			}
+		}
+		if slices.Contains(fresh, QuotaWarnUsed80) && slices.Contains(fresh, QuotaWarnUsed95) {
+			fresh = slices.DeleteFunc(fresh, func(kind string) bool { return kind == QuotaWarnUsed80 })
+		}
+		for _, kind := range fresh {
+			due = append(due, QuotaWarning{ID: sub.ID, Name: sub.Name, Kind: kind, Status: sub.Quota.Status(now)})
+		}
+		if !slices.Equal(applying, sub.QuotaWarned) {
+			sub.QuotaWarned = applying
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return due, s.persistSubscriptions(subs)
+}
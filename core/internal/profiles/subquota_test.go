@@ -0,0 +1,139 @@
+package profiles
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseSubscriptionUserinfo(t *testing.T) {
+	const gb = 1 << 30
+	tests := []struct {
+		header string
+		want   SubscriptionQuota
+		ok     bool
+	}{
+		{"upload=455727941; download=6174315083; total=1073741824000; expire=1671815872",
+			SubscriptionQuota{Upload: 455727941, Download: 6174315083, Total: 1073741824000, Expire: 1671815872}, true},
+		{"upload=0;download=0;total=0;expire=0", SubscriptionQuota{}, true},
+		// Comma separated, another order, spaces.
+		{"total=107374182400, upload=1024 , download=2048, expire=1735689600",
+			SubscriptionQuota{Upload: 1024, Download: 2048, Total: 107374182400, Expire: 1735689600}, true},
+		// Missing fields, a trailing separator.
+		{"upload=10; download=20;", SubscriptionQuota{Upload: 10, Download: 20}, true},
+		{"total=53687091200; expire=", SubscriptionQuota{Total: 50 * gb}, true},
+		// Human sizes and float notation.
+		{"upload=1.5 GB; download=512MB; total=100GiB", SubscriptionQuota{Upload: gb * 3 / 2, Download: 512 << 20, Total: 100 * gb}, true},
+		{"upload=2.5e+09; download=0; total=1.073741824E11", SubscriptionQuota{Upload: 2500000000, Total: 107374182400}, true},
+		{"Upload=1; DOWNLOAD=2; Total=\"3 kb\"", SubscriptionQuota{Upload: 1, Download: 2, Total: 3 << 10}, true},
+		// Expiry in milliseconds, or as a date.
+		{"expire=1735689600000", SubscriptionQuota{Expire: 1735689600}, true},
+		{"expire=2025-01-01", SubscriptionQuota{Expire: 1735689600}, true},
+		{"expiry=2025-01-01T00:00:00Z", SubscriptionQuota{Expire: 1735689600}, true},
+		// Broken values are skipped, the rest kept.
+		{"upload=lots; download=-5; total=10XB; expire=soon; used=1", SubscriptionQuota{}, false},
+		{"upload=lots; download=7", SubscriptionQuota{Download: 7}, true},
+		{"", SubscriptionQuota{}, false},
+		{"garbage", SubscriptionQuota{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseSubscriptionUserinfo(tt.header)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%q = %+v, %v; want %+v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestQuotaStatus(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	q := SubscriptionQuota{Upload: 100, Download: 233, Total: 1000, Expire: now.Add(50 * time.Hour).Unix()}
+	status := q.Status(now)
+	if status.Used != 333 || status.PercentUsed != 33.3 || status.DaysUntilExpiry == nil || *status.DaysUntilExpiry != 2 {
+		t.Errorf("status = %+v", status)
+	}
+	expired := SubscriptionQuota{Expire: now.Add(-time.Hour).Unix()}.Status(now)
+	if expired.DaysUntilExpiry == nil || *expired.DaysUntilExpiry != -1 || expired.PercentUsed != 0 {
+		t.Errorf("expired = %+v", expired)
+	}
+	if unlimited := (SubscriptionQuota{Download: 5}).Status(now); unlimited.DaysUntilExpiry != nil || unlimited.PercentUsed != 0 {
+		t.Errorf("unlimited = %+v", unlimited)
+	}
+}
+
+func TestQuotaWarnings(t *testing.T) {
+	u, store, feed, clock := newTestUpdater(t)
+	sub, _ := store.SaveSubscription(Subscription{Name: "Provider", URL: "https://sub.example.com/list"})
+	feed.body = readFixture(t, "subscription_v1.txt")
+	expire := clock.t.Add(10 * 24 * time.Hour).Unix()
+
+	// refresh sets the reported quota and returns the warnings then due.
+	refresh := func(used int64) []QuotaWarning {
+		t.Helper()
+		feed.quota = &SubscriptionQuota{Upload: used / 2, Download: used - used/2, Total: 1000, Expire: expire}
+		if _, _, err := u.Refresh(context.Background(), sub.ID); err != nil {
+			t.Fatal(err)
+		}
+		warnings, err := u.CheckQuotas()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return warnings
+	}
+	kinds := func(warnings []QuotaWarning) []string {
+		var out []string
+		for _, w := range warnings {
+			if w.ID != sub.ID || w.Name != "Provider" {
+				t.Errorf("warning %+v", w)
+			}
+			out = append(out, w.Kind)
+		}
+		return out
+	}
+	steps := []struct {
+		name    string
+		used    int64
+		advance time.Duration
+		want    []string
+	}{
+		{"below 80%", 799, 0, nil},
+		{"crossing 80%", 800, 0, []string{QuotaWarnUsed80}},
+		{"still over 80%", 900, 0, nil},
+		{"crossing 95%", 950, 0, []string{QuotaWarnUsed95}},
+		{"3 days to expiry", 960, 7 * 24 * time.Hour, []string{QuotaWarnExpiring}},
+		{"expired", 960, 4 * 24 * time.Hour, nil},
+	}
+	for _, step := range steps {
+		clock.advance(step.advance)
+		if got := kinds(refresh(step.used)); !slices.Equal(got, step.want) {
+			t.Errorf("%s: warnings %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// A renewed quota warns again, and a jump past both thresholds warns
+	// only of the higher one.
+	expire = clock.t.Add(30 * 24 * time.Hour).Unix()
+	if got := kinds(refresh(10)); got != nil {
+		t.Errorf("renewed: warnings %v", got)
+	}
+	warnings := refresh(990)
+	if got := kinds(warnings); !slices.Equal(got, []string{QuotaWarnUsed95}) {
+		t.Errorf("jump to 99%%: warnings %v", got)
+	} else if warnings[0].Status.PercentUsed != 99 || *warnings[0].Status.DaysUntilExpiry != 30 {
+		t.Errorf("status = %+v", warnings[0].Status)
+	}
+
+	// The sent warnings survive a restart.
+	reopened := Open(store.path, nil)
+	if warnings, err := reopened.checkQuotas(clock.t); err != nil || warnings != nil {
+		t.Errorf("after reopening: %+v, %v", warnings, err)
+	}
+
+	// A not-modified answer without the header keeps the quota.
+	feed.etag = `"v2"`
+	refresh(990)
+	feed.quota = nil
+	if got, _, err := u.Refresh(context.Background(), sub.ID); err != nil || got.Quota == nil || got.Quota.Upload != 495 {
+		t.Errorf("not modified: quota %+v, %v", got.Quota, err)
+	}
+}
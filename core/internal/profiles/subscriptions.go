@@ -0,0 +1,574 @@
+package profiles
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// A subscription is a URL serving a list of server links, usually base64
+// encoded, one per line. Its servers are saved as profiles linked to it,
+// and refreshes merge the list into them by canonical key: a server that
+// is still listed keeps its profile, with its ID and everything the user
+// changed; one that is gone is removed; a new one is added, unless the
+// user deleted it before.
+
+// SubscriptionsFileName is the subscriptions file inside the data
+// directory.
+const SubscriptionsFileName = "subscriptions.json"
+
+const (
+	// MaxAutoUpdateHours is the longest auto-update interval.
+	MaxAutoUpdateHours = 30 * 24
+	// maxSubscriptionBytes caps the size of a subscription payload.
+	maxSubscriptionBytes = 4 << 20
+	// subscriptionTimeout bounds one fetch.
+	subscriptionTimeout = 30 * time.Second
+	// maxSubscriptionRedirects caps the redirects one fetch follows.
+	maxSubscriptionRedirects = 5
+	// A failed refresh is retried after minSubscriptionBackoff, doubling
+	// with each further failure up to maxSubscriptionBackoff.
+	minSubscriptionBackoff = 5 * time.Minute
+	maxSubscriptionBackoff = 6 * time.Hour
+)
+
+var (
+	// ErrSubscriptionNotFound is returned when a subscription ID does not
+	// exist.
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	// ErrSubscriptionEmpty is returned for a payload without a supported
+	// server, which fails the refresh rather than removing every server.
+	ErrSubscriptionEmpty = errors.New("subscription lists no supported servers")
+	// errLocalTarget refuses a fetch from a loopback or link-local
+	// address. The service runs as SYSTEM, and services listening there
+	// may trust local callers.
+	errLocalTarget = errors.New("subscription URL points to a loopback or link-local address")
+)
+
+// Subscription is a server list the user subscribed to. ID, Name, URL and
+// AutoUpdateHours are the user's; the rest is refresh state the store
+// keeps.
+type Subscription struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	URL             string `json:"url" jsonschema:"required"`
+	AutoUpdateHours int    `json:"autoUpdateHours"` // 0 refreshes only on request
+
+	LastUpdated  int64    `json:"lastUpdated"`            // unix seconds of the last successful refresh, 0 if never
+	ETag         string   `json:"etag,omitempty"`         // of the last payload, for conditional requests
+	LastModified string   `json:"lastModified,omitempty"` // of the last payload, for conditional requests
+	Failures     int      `json:"failures,omitempty"`     // refreshes failed in a row
+	RetryAt      int64    `json:"retryAt,omitempty"`      // unix seconds before which it is not refreshed automatically
+	LastError    string   `json:"lastError,omitempty"`    // why the last refresh failed
+	Excluded     []string `json:"excluded,omitempty"`     // canonical keys of servers the user deleted
+
+	Quota       *SubscriptionQuota `json:"quota,omitempty"`       // as the server last reported it; see subquota.go
+	QuotaWarned []string           `json:"quotaWarned,omitempty"` // quota warnings sent for it
+}
+
+// clone returns a deep copy of s.
+func (s Subscription) clone() Subscription {
+	s.Excluded = slices.Clone(s.Excluded)
+	s.QuotaWarned = slices.Clone(s.QuotaWarned)
+	if s.Quota != nil {
+		quota := *s.Quota
+		s.Quota = &quota
+	}
+	return s
+}
+
+// Validate checks the user's fields of s.
+func (s Subscription) Validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	if s.AutoUpdateHours < 0 || s.AutoUpdateHours > MaxAutoUpdateHours {
+		return fmt.Errorf("autoUpdateHours must be between 0 and %d", MaxAutoUpdateHours)
+	}
+	return nil
+}
+
+// SubscriptionDiff summarizes what a refresh changed.
+type SubscriptionDiff struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	Changed int `json:"changed"` // still listed, with a different link
+
+	RemovedIDs []string `json:"-"` // the removed profiles
+}
+
+// Subscriptions returns a copy of all subscriptions in saved order.
+func (s *Store) Subscriptions() []Subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cloneSubscriptions()
+}
+
+// GetSubscription returns the subscription with the given ID.
+func (s *Store) GetSubscription(id string) (Subscription, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sub := range s.subscriptions {
+		if sub.ID == id {
+			return sub.clone(), true
+		}
+	}
+	return Subscription{}, false
+}
+
+// SaveSubscription adds a new subscription (empty ID) or changes the
+// user's fields of an existing one. A new URL starts its refresh state
+// over, making it due at once.
+func (s *Store) SaveSubscription(sub Subscription) (Subscription, error) {
+	if err := sub.Validate(); err != nil {
+		return sub, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.cloneSubscriptions()
+	user := sub
+	if sub.ID == "" {
+		sub = Subscription{ID: newID()}
+		next = append(next, sub)
+	}
+	i := slices.IndexFunc(next, func(x Subscription) bool { return x.ID == sub.ID })
+	if i < 0 {
+		return user, ErrSubscriptionNotFound
+	}
+	if next[i].URL != user.URL {
+		next[i] = Subscription{ID: next[i].ID, Excluded: next[i].Excluded}
+	}
+	next[i].Name, next[i].URL, next[i].AutoUpdateHours = user.Name, user.URL, user.AutoUpdateHours
+	if err := s.persistSubscriptions(next); err != nil {
+		return user, err
+	}
+	return next[i], nil
+}
+
+// DeleteSubscription removes a subscription and its profiles, returning
+// the IDs of the removed profiles.
+func (s *Store) DeleteSubscription(id string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := slices.DeleteFunc(s.cloneSubscriptions(), func(x Subscription) bool { return x.ID == id })
+	if len(subs) == len(s.subscriptions) {
+		return nil, ErrSubscriptionNotFound
+	}
+	var removed []string
+	profiles := make([]Profile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		if p.Subscription == id {
+			removed = append(removed, p.ID)
+		} else {
+			profiles = append(profiles, p)
+		}
+	}
+	// Profiles go first: a subscription left behind by a crash in between
+	// only adds its servers again.
+	if err := s.persist(profiles); err != nil {
+		return nil, err
+	}
+	return removed, s.persistSubscriptions(subs)
+}
+
+// DueSubscriptions returns the subscriptions whose auto-update interval
+// has passed at now, except those backing off after a failure.
+func (s *Store) DueSubscriptions(now time.Time) []Subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var due []Subscription
+	for _, sub := range s.subscriptions {
+		interval := time.Duration(sub.AutoUpdateHours) * time.Hour
+		if interval > 0 && now.Unix() >= sub.RetryAt && now.Sub(time.Unix(sub.LastUpdated, 0)) >= interval {
+			due = append(due, sub)
+		}
+	}
+	return due
+}
+
+// applySubscription merges what a fetch of the subscription at fetchedURL
+// returned into the profiles and records the refresh. The profiles are
+// saved before the refresh state, so a crash in between makes the next
+// fetch unconditional, and the merge it repeats changes nothing.
+func (s *Store) applySubscription(id, fetchedURL string, res FetchResult, now time.Time) (Subscription, SubscriptionDiff, error) {
+	var diff SubscriptionDiff
+	var published []publishedServer
+	if !res.NotModified {
+		if published = parseSubscription(res.Body); len(published) == 0 {
+			return Subscription{}, diff, ErrSubscriptionEmpty
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := s.cloneSubscriptions()
+	i := slices.IndexFunc(subs, func(x Subscription) bool { return x.ID == id })
+	if i < 0 {
+		return Subscription{}, diff, ErrSubscriptionNotFound
+	}
+	sub := &subs[i]
+	if sub.URL != fetchedURL {
+		return *sub, diff, fmt.Errorf("subscription URL changed during the refresh")
+	}
+	if !res.NotModified {
+		var profiles []Profile
+		profiles, diff = mergeSubscription(s.profiles, sub, published)
+		if err := s.persist(profiles); err != nil {
+			return *sub, SubscriptionDiff{}, err
+		}
+		sub.ETag, sub.LastModified = res.ETag, res.LastModified
+		sub.Quota = res.Quota
+	} else if res.Quota != nil {
+		sub.Quota = res.Quota
+	}
+	sub.LastUpdated = now.Unix()
+	sub.Failures, sub.RetryAt, sub.LastError = 0, 0, ""
+	return *sub, diff, s.persistSubscriptions(subs)
+}
+
+// subscriptionFailed records a failed refresh and backs the subscription
+// off.
+func (s *Store) subscriptionFailed(id string, cause error, now time.Time) (Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := s.cloneSubscriptions()
+	i := slices.IndexFunc(subs, func(x Subscription) bool { return x.ID == id })
+	if i < 0 {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	sub := &subs[i]
+	sub.Failures++
+	sub.RetryAt = now.Add(subscriptionBackoff(sub.Failures)).Unix()
+	sub.LastError = cause.Error()
+	return *sub, s.persistSubscriptions(subs)
+}
+
+// subscriptionBackoff returns how long to wait after failures refreshes
+// failed in a row.
+func subscriptionBackoff(failures int) time.Duration {
+	backoff := minSubscriptionBackoff
+	for i := 1; i < failures && backoff < maxSubscriptionBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxSubscriptionBackoff)
+}
+
+// cloneSubscriptions returns a deep copy of the subscriptions. Caller
+// holds s.mu.
+func (s *Store) cloneSubscriptions() []Subscription {
+	out := make([]Subscription, len(s.subscriptions))
+	for i, sub := range s.subscriptions {
+		out[i] = sub.clone()
+	}
+	return out
+}
+
+// persistSubscriptions writes subs to disk and swaps them in. Caller
+// holds s.mu.
+func (s *Store) persistSubscriptions(subs []Subscription) error {
+	data, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.guard.WriteFile(s.subsPath, data); err != nil {
+		return fmt.Errorf("failed to save subscriptions: %w", err)
+	}
+	s.subscriptions = subs
+	return nil
+}
+
+// publishedServer is a server as a subscription lists it.
+type publishedServer struct {
+	key  string // parser.CanonicalKey
+	name string
+	link string
+}
+
+// parseSubscription returns the supported servers of a payload, the first
+// of each canonical key. Unsupported and broken links are skipped.
+func parseSubscription(body []byte) []publishedServer {
+	var out []publishedServer
+	seen := make(map[string]bool)
+	for _, c := range parser.ExtractLinks(decodeSubscription(body)) {
+		if c.Server == nil {
+			continue
+		}
+		key := parser.CanonicalKey(c.Server)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, publishedServer{key: key, name: c.Server.Name, link: c.Link})
+	}
+	return out
+}
+
+// decodeSubscription returns the text of a payload, which is base64 in
+// any of its variants, line wrapped or not, or the plain list of links.
+func decodeSubscription(body []byte) string {
+	compact := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, string(body))
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(compact); err == nil && utf8.Valid(decoded) {
+			return string(decoded)
+		}
+	}
+	return string(body)
+}
+
+// mergeSubscription merges the servers sub publishes into profiles,
+// returning the new profiles and what changed. Profiles of other
+// subscriptions and the user's own are left alone, in place.
+//
+// A profile whose server is still published keeps its place, ID and
+// everything not published; its name and link follow the subscription
+// unless the user changed them from what it published last. A profile
+// whose server is no longer published, or that repeats another's key, is
+// removed. A newly published server is added at the end, unless the user
+// deleted it before; exclusions of servers no longer published are
+// dropped from sub.
+func mergeSubscription(profiles []Profile, sub *Subscription, published []publishedServer) ([]Profile, SubscriptionDiff) {
+	var diff SubscriptionDiff
+	byKey := make(map[string]publishedServer, len(published))
+	for _, server := range published {
+		byKey[server.key] = server
+	}
+
+	kept := make(map[string]bool)
+	next := make([]Profile, 0, len(profiles)+len(published))
+	for _, p := range profiles {
+		if p.Subscription != sub.ID {
+			next = append(next, p)
+			continue
+		}
+		server, ok := byKey[p.Key]
+		if !ok || kept[p.Key] {
+			diff.Removed++
+			diff.RemovedIDs = append(diff.RemovedIDs, p.ID)
+			continue
+		}
+		kept[p.Key] = true
+		if server.link != p.SourceLink {
+			diff.Changed++
+			if p.Link == p.SourceLink {
+				p.Link = server.link
+				p.Invalid = ""
+			}
+			if p.Name == p.SourceName {
+				p.Name = server.name
+			}
+			p.SourceName, p.SourceLink = server.name, server.link
+		}
+		next = append(next, p)
+	}
+
+	sub.Excluded = slices.DeleteFunc(sub.Excluded, func(key string) bool {
+		_, listed := byKey[key]
+		return !listed
+	})
+	for _, server := range published {
+		if kept[server.key] || slices.Contains(sub.Excluded, server.key) {
+			continue
+		}
+		next = append(next, Profile{
+			ID:           newID(),
+			Name:         server.name,
+			Link:         server.link,
+			Subscription: sub.ID,
+			Key:          server.key,
+			SourceName:   server.name,
+			SourceLink:   server.link,
+		})
+		diff.Added++
+	}
+	return next, diff
+}
+
+// FetchResult is what fetching a subscription returned.
+type FetchResult struct {
+	NotModified  bool // the payload is unchanged since the given validators
+	Body         []byte
+	ETag         string
+	LastModified string
+	Quota        *SubscriptionQuota // from the subscription-userinfo header, nil without one
+}
+
+// FetchFunc fetches a subscription's payload, conditionally on the
+// validators of the last one when given.
+type FetchFunc func(ctx context.Context, url, etag, lastModified string) (FetchResult, error)
+
+// NewSubscriptionFetch returns a FetchFunc with its own HTTP client, which
+// follows at most maxSubscriptionRedirects redirects, goes through the
+// proxy that proxy returns unless it returns nil, and never connects to a
+// loopback or link-local address other than the proxy's.
+func NewSubscriptionFetch(proxy func() *url.URL) FetchFunc {
+	client := newSubscriptionClient(proxy, localAddress)
+	return func(ctx context.Context, url, etag, lastModified string) (FetchResult, error) {
+		return fetchSubscription(ctx, client, url, etag, lastModified)
+	}
+}
+
+// localAddress reports whether a subscription fetch must not reach ip.
+func localAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// newSubscriptionClient returns the client of NewSubscriptionFetch,
+// refusing the addresses refused reports. Names are checked as they
+// resolve, when dialed; through a proxy, which resolves them itself, only
+// literal addresses and localhost are.
+func newSubscriptionClient(proxy func() *url.URL, refused func(net.IP) bool) *http.Client {
+	direct := &net.Dialer{Timeout: 10 * time.Second}
+	guarded := &net.Dialer{Timeout: 10 * time.Second, Control: func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if ip := net.ParseIP(host); err == nil && ip != nil && refused(ip) {
+			return errLocalTarget
+		}
+		return nil
+	}}
+	transport := &http.Transport{
+		Proxy: func(*http.Request) (*url.URL, error) { return proxy(), nil },
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if p := proxy(); p != nil && addr == p.Host {
+				return direct.DialContext(ctx, network, addr)
+			}
+			return guarded.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{
+		Transport: &targetGuard{next: transport, refused: refused},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxSubscriptionRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxSubscriptionRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// targetGuard refuses requests, redirects included, to localhost or a
+// refused literal address before they reach a proxy.
+type targetGuard struct {
+	next    http.RoundTripper
+	refused func(net.IP) bool
+}
+
+func (g *targetGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if ip := net.ParseIP(host); strings.EqualFold(host, "localhost") || (ip != nil && g.refused(ip)) {
+		return nil, errLocalTarget
+	}
+	return g.next.RoundTrip(req)
+}
+
+// fetchSubscription fetches a subscription with client, asking the server
+// to answer 304 Not Modified if the payload still matches etag or has
+// not changed since lastModified.
+func fetchSubscription(ctx context.Context, client *http.Client, url, etag, lastModified string) (FetchResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, subscriptionTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	defer resp.Body.Close()
+	var quota *SubscriptionQuota
+	if q, ok := ParseSubscriptionUserinfo(resp.Header.Get(SubscriptionUserinfoHeader)); ok {
+		quota = &q
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return FetchResult{NotModified: true, Quota: quota}, nil
+	case resp.StatusCode != http.StatusOK:
+		return FetchResult{}, fmt.Errorf("server answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSubscriptionBytes+1))
+	if err != nil {
+		return FetchResult{}, fmt.Errorf("failed to read the payload: %w", err)
+	}
+	if len(body) > maxSubscriptionBytes {
+		return FetchResult{}, fmt.Errorf("payload is larger than %d bytes", maxSubscriptionBytes)
+	}
+	return FetchResult{Body: body, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified"), Quota: quota}, nil
+}
+
+// SubscriptionUpdater refreshes subscriptions, one at a time.
+type SubscriptionUpdater struct {
+	store *Store
+	fetch FetchFunc        // replaced in tests
+	now   func() time.Time // replaced in tests
+	mu    sync.Mutex       // held through a refresh
+}
+
+// NewSubscriptionUpdater returns an updater of store's subscriptions,
+// fetching them through the proxy that proxy returns, if any (see
+// NewSubscriptionFetch).
+func NewSubscriptionUpdater(store *Store, proxy func() *url.URL) *SubscriptionUpdater {
+	return &SubscriptionUpdater{store: store, fetch: NewSubscriptionFetch(proxy), now: time.Now}
+}
+
+// Due returns the subscriptions due for an automatic refresh.
+func (u *SubscriptionUpdater) Due() []Subscription {
+	return u.store.DueSubscriptions(u.now())
+}
+
+// Refresh fetches a subscription and merges its servers into the
+// profiles, whether or not it is due. A failure is recorded on the
+// subscription, which then backs off, and returned with it.
+func (u *SubscriptionUpdater) Refresh(ctx context.Context, id string) (Subscription, SubscriptionDiff, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	sub, ok := u.store.GetSubscription(id)
+	if !ok {
+		return Subscription{}, SubscriptionDiff{}, ErrSubscriptionNotFound
+	}
+	res, err := u.fetch(ctx, sub.URL, sub.ETag, sub.LastModified)
+	if err == nil {
+		var diff SubscriptionDiff
+		if sub, diff, err = u.store.applySubscription(id, sub.URL, res, u.now()); err == nil {
+			return sub, diff, nil
+		}
+	}
+	if errors.Is(err, ErrSubscriptionNotFound) {
+		return Subscription{}, SubscriptionDiff{}, err
+	}
+	if failed, ferr := u.store.subscriptionFailed(id, err, u.now()); ferr == nil {
+		sub = failed
+	}
+	return sub, SubscriptionDiff{}, err
+}
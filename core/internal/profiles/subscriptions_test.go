@@ -0,0 +1,431 @@
+package profiles
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFeed serves subscription payloads to an updater.
+type fakeFeed struct {
+	body  []byte
+	etag  string
+	err   error
+	quota *SubscriptionQuota
+	asked string // the etag of the last request
+}
+
+func (f *fakeFeed) fetch(ctx context.Context, url, etag, lastModified string) (FetchResult, error) {
+	f.asked = etag
+	if f.err != nil {
+		return FetchResult{}, f.err
+	}
+	if etag != "" && etag == f.etag {
+		return FetchResult{NotModified: true, Quota: f.quota}, nil
+	}
+	return FetchResult{Body: f.body, ETag: f.etag, Quota: f.quota}, nil
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newTestUpdater(t *testing.T) (*SubscriptionUpdater, *Store, *fakeFeed, *fakeClock) {
+	t.Helper()
+	store := Open(filepath.Join(t.TempDir(), FileName), nil)
+	feed := &fakeFeed{}
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	u := NewSubscriptionUpdater(store, func() *url.URL { return nil })
+	u.fetch = feed.fetch
+	u.now = clock.now
+	return u, store, feed, clock
+}
+
+// byName returns the subscription's profiles by published name.
+func byName(store *Store, subID string) map[string]Profile {
+	out := make(map[string]Profile)
+	for _, p := range store.List() {
+		if p.Subscription == subID {
+			out[p.SourceName] = p
+		}
+	}
+	return out
+}
+
+func TestSubscriptionMergeKeepsCustomizations(t *testing.T) {
+	u, store, feed, _ := newTestUpdater(t)
+	own, err := store.Save(Profile{Link: "vless://u@own.example.com:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := store.SaveSubscription(Subscription{Name: "Provider", URL: "https://sub.example.com/list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// v1 is base64, line wrapped, and lists a trojan server, which is not
+	// supported.
+	feed.body, feed.etag = readFixture(t, "subscription_v1.txt"), `"v1"`
+	_, diff, err := u.Refresh(context.Background(), sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Added != 4 || diff.Removed != 0 || diff.Changed != 0 {
+		t.Fatalf("first refresh diff = %+v", diff)
+	}
+	v1 := byName(store, sub.ID)
+
+	// The user renames Alpha, points Bravo at a link of their own, and
+	// deletes Delta.
+	alpha := v1["Alpha"]
+	alpha.Name = "My Alpha"
+	if _, err := store.Save(alpha); err != nil {
+		t.Fatal(err)
+	}
+	bravo := v1["Bravo"]
+	bravo.Link = "vless://22222222-2222-2222-2222-222222222222@b.example.com:443?security=tls&fp=firefox#Bravo"
+	if _, err := store.Save(bravo); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(v1["Delta"].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// v2 is plain text: Alpha and Bravo change cosmetically, Charlie is
+	// gone, Delta is still listed, Echo is new (twice) and a line is junk.
+	feed.body, feed.etag = readFixture(t, "subscription_v2.txt"), `"v2"`
+	got, diff, err := u.Refresh(context.Background(), sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Added != 1 || diff.Removed != 1 || diff.Changed != 2 {
+		t.Errorf("second refresh diff = %+v", diff)
+	}
+	if len(diff.RemovedIDs) != 1 || diff.RemovedIDs[0] != v1["Charlie"].ID {
+		t.Errorf("RemovedIDs = %v, want Charlie's", diff.RemovedIDs)
+	}
+	if got.ETag != `"v2"` {
+		t.Errorf("etag = %q", got.ETag)
+	}
+
+	v2 := byName(store, sub.ID)
+	if len(v2) != 3 {
+		t.Fatalf("profiles = %v", v2)
+	}
+	if a := v2["Alpha v2"]; a.ID != alpha.ID || a.Name != "My Alpha" || a.Link != a.SourceLink {
+		t.Errorf("Alpha = %+v, want its ID, the user's name and the new link", a)
+	}
+	if b := v2["Bravo NL"]; b.ID != bravo.ID || b.Name != "Bravo NL" || b.Link != bravo.Link {
+		t.Errorf("Bravo = %+v, want its ID, the new name and the user's link", b)
+	}
+	if _, ok := v2["Delta"]; ok {
+		t.Error("a deleted server came back")
+	}
+	if e := v2["Echo"]; e.Name != "Echo" || e.Link != e.SourceLink {
+		t.Errorf("Echo = %+v", e)
+	}
+	if p, ok := store.Get(own.ID); !ok || p.Subscription != "" {
+		t.Errorf("the user's own profile = %+v, %v", p, ok)
+	}
+	if s, _ := store.GetSubscription(sub.ID); len(s.Excluded) != 1 || s.Excluded[0] != v1["Delta"].Key {
+		t.Errorf("excluded = %v, want Delta's key", s.Excluded)
+	}
+
+	// Once Delta is delisted, its exclusion is dropped, and a later listing
+	// adds it again.
+	feed.body = []byte("vless://55555555-5555-5555-5555-555555555555@e.example.com:443?security=tls#Echo\n")
+	feed.etag = `"v3"`
+	if _, diff, err = u.Refresh(context.Background(), sub.ID); err != nil || diff.Removed != 2 {
+		t.Fatalf("third refresh: %+v, %v", diff, err)
+	}
+	if s, _ := store.GetSubscription(sub.ID); len(s.Excluded) != 0 {
+		t.Errorf("excluded = %v after Delta was delisted", s.Excluded)
+	}
+	feed.body, feed.etag = readFixture(t, "subscription_v1.txt"), `"v4"`
+	if _, diff, err = u.Refresh(context.Background(), sub.ID); err != nil || diff.Added != 4 || diff.Removed != 1 {
+		t.Errorf("fourth refresh: %+v, %v", diff, err)
+	}
+}
+
+func TestSubscriptionNotModified(t *testing.T) {
+	u, store, feed, clock := newTestUpdater(t)
+	sub, _ := store.SaveSubscription(Subscription{URL: "https://sub.example.com/list", AutoUpdateHours: 12})
+	feed.body, feed.etag = readFixture(t, "subscription_v1.txt"), `"v1"`
+	if _, _, err := u.Refresh(context.Background(), sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	before := store.List()
+
+	clock.advance(12 * time.Hour)
+	got, diff, err := u.Refresh(context.Background(), sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.asked != `"v1"` || diff.Added+diff.Removed+diff.Changed != 0 || len(store.List()) != len(before) {
+		t.Errorf("asked %q, diff %+v", feed.asked, diff)
+	}
+	if got.LastUpdated != clock.t.Unix() {
+		t.Errorf("LastUpdated = %d, want the refresh time", got.LastUpdated)
+	}
+}
+
+func TestSubscriptionFailureBacksOff(t *testing.T) {
+	u, store, feed, clock := newTestUpdater(t)
+	sub, _ := store.SaveSubscription(Subscription{URL: "https://sub.example.com/list", AutoUpdateHours: 1})
+	feed.body, feed.etag = readFixture(t, "subscription_v1.txt"), `"v1"`
+	if _, _, err := u.Refresh(context.Background(), sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	before := store.List()
+
+	// An empty payload fails the refresh instead of removing every server.
+	feed.body, feed.etag = []byte("<html>maintenance</html>"), `"v2"`
+	clock.advance(time.Hour)
+	if _, _, err := u.Refresh(context.Background(), sub.ID); !errors.Is(err, ErrSubscriptionEmpty) {
+		t.Fatalf("err = %v, want ErrSubscriptionEmpty", err)
+	}
+	if len(store.List()) != len(before) {
+		t.Errorf("profiles = %d, want %d", len(store.List()), len(before))
+	}
+
+	feed.err = errors.New("connection refused")
+	for failures := 2; failures <= 4; failures++ {
+		got, _, err := u.Refresh(context.Background(), sub.ID)
+		if err == nil {
+			t.Fatal("refresh succeeded")
+		}
+		want := clock.t.Add(subscriptionBackoff(failures)).Unix()
+		if got.Failures != failures || got.RetryAt != want || got.LastError != "connection refused" {
+			t.Errorf("after %d failures: %+v", failures, got)
+		}
+	}
+	if len(u.Due()) != 0 {
+		t.Error("due while backing off")
+	}
+	clock.advance(subscriptionBackoff(4))
+	if len(u.Due()) != 1 {
+		t.Error("not due once the backoff passed")
+	}
+
+	// A success resets the failures, and the etag is kept from the last
+	// payload that applied.
+	feed.err = nil
+	feed.body, feed.etag = readFixture(t, "subscription_v1.txt"), `"v1"`
+	got, _, err := u.Refresh(context.Background(), sub.ID)
+	if err != nil || got.Failures != 0 || got.RetryAt != 0 || got.LastError != "" {
+		t.Errorf("after success: %+v, %v", got, err)
+	}
+}
+
+func TestSubscriptionBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{4, 40 * time.Minute},
+		{8, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := subscriptionBackoff(tt.failures); got != tt.want {
+			t.Errorf("subscriptionBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestDueSubscriptions(t *testing.T) {
+	u, store, feed, clock := newTestUpdater(t)
+	manual, _ := store.SaveSubscription(Subscription{URL: "https://a.example.com/"})
+	daily, _ := store.SaveSubscription(Subscription{URL: "https://b.example.com/", AutoUpdateHours: 24})
+	if due := u.Due(); len(due) != 1 || due[0].ID != daily.ID {
+		t.Fatalf("due = %+v, want the never refreshed auto-update", due)
+	}
+
+	feed.body = readFixture(t, "subscription_v1.txt")
+	if _, _, err := u.Refresh(context.Background(), daily.ID); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(23 * time.Hour)
+	if due := u.Due(); len(due) != 0 {
+		t.Errorf("due = %+v before the interval passed", due)
+	}
+	clock.advance(time.Hour)
+	if due := u.Due(); len(due) != 1 {
+		t.Errorf("due = %+v once the interval passed", due)
+	}
+
+	// Changing the URL starts over; changing the interval does not.
+	daily.AutoUpdateHours = 48
+	if daily, _ = store.SaveSubscription(daily); daily.LastUpdated == 0 {
+		t.Error("refresh state lost on an interval change")
+	}
+	daily.URL = "https://c.example.com/"
+	if daily, _ = store.SaveSubscription(daily); daily.LastUpdated != 0 || daily.ETag != "" {
+		t.Errorf("refresh state kept on a URL change: %+v", daily)
+	}
+	if _, ok := store.GetSubscription(manual.ID); !ok {
+		t.Error("manual subscription lost")
+	}
+}
+
+func TestSubscriptionValidate(t *testing.T) {
+	store := Open(filepath.Join(t.TempDir(), FileName), nil)
+	for _, sub := range []Subscription{
+		{URL: "ftp://sub.example.com/"},
+		{URL: "https:///list"},
+		{URL: "https://sub.example.com/", AutoUpdateHours: -1},
+		{URL: "https://sub.example.com/", AutoUpdateHours: MaxAutoUpdateHours + 1},
+	} {
+		if _, err := store.SaveSubscription(sub); err == nil {
+			t.Errorf("SaveSubscription(%+v) succeeded", sub)
+		}
+	}
+	if _, err := store.SaveSubscription(Subscription{ID: "missing", URL: "https://sub.example.com/"}); !errors.Is(err, ErrSubscriptionNotFound) {
+		t.Errorf("err = %v, want ErrSubscriptionNotFound", err)
+	}
+}
+
+func TestDeleteSubscription(t *testing.T) {
+	u, store, feed, _ := newTestUpdater(t)
+	own, _ := store.Save(Profile{Link: "vless://u@own.example.com:443"})
+	sub, _ := store.SaveSubscription(Subscription{URL: "https://sub.example.com/list"})
+	feed.body = readFixture(t, "subscription_v1.txt")
+	if _, _, err := u.Refresh(context.Background(), sub.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.DeleteSubscription(sub.ID)
+	if err != nil || len(removed) != 4 {
+		t.Fatalf("removed %v, %v", removed, err)
+	}
+	if list := store.List(); len(list) != 1 || list[0].ID != own.ID {
+		t.Errorf("profiles = %+v, want the user's own", list)
+	}
+
+	// Both files survive a reopen.
+	reopened := Open(store.path, nil)
+	if len(reopened.Subscriptions()) != 0 || len(reopened.List()) != 1 {
+		t.Errorf("reopened: %d subscriptions, %d profiles", len(reopened.Subscriptions()), len(reopened.List()))
+	}
+	if _, err := store.DeleteSubscription(sub.ID); !errors.Is(err, ErrSubscriptionNotFound) {
+		t.Errorf("err = %v, want ErrSubscriptionNotFound", err)
+	}
+}
+
+func TestFetchSubscriptionConditional(t *testing.T) {
+	const lastModified = "Wed, 01 Jan 2025 12:00:00 GMT"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			if r.Header.Get("If-None-Match") == `"v1"` || r.Header.Get("If-Modified-Since") == lastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Subscription-Userinfo", "upload=1; download=2; total=10")
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Last-Modified", lastModified)
+			w.Write([]byte("vless://u@a.example.com:443#A\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// The test server listens on loopback, which fetches refuse.
+	client := newSubscriptionClient(func() *url.URL { return nil }, func(net.IP) bool { return false })
+	fetch := func(ctx context.Context, url, etag, lastModified string) (FetchResult, error) {
+		return fetchSubscription(ctx, client, url, etag, lastModified)
+	}
+	ctx := context.Background()
+	res, err := fetch(ctx, srv.URL+"/list", "", "")
+	if err != nil || res.NotModified || res.ETag != `"v1"` || res.LastModified != lastModified || len(res.Body) == 0 ||
+		res.Quota == nil || *res.Quota != (SubscriptionQuota{Upload: 1, Download: 2, Total: 10}) {
+		t.Fatalf("first fetch = %+v, %v", res, err)
+	}
+	if res, err = fetch(ctx, srv.URL+"/list", `"v1"`, ""); err != nil || !res.NotModified {
+		t.Errorf("fetch with etag = %+v, %v", res, err)
+	}
+	if res, err = fetch(ctx, srv.URL+"/list", "", lastModified); err != nil || !res.NotModified {
+		t.Errorf("fetch with last-modified = %+v, %v", res, err)
+	}
+	if _, err = fetch(ctx, srv.URL+"/gone", "", ""); err == nil {
+		t.Error("fetch of a missing list succeeded")
+	}
+}
+
+func TestFetchSubscriptionRefusesLocalTargets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		w.Write([]byte("vless://u@a.example.com:443#A\n"))
+	}))
+	defer srv.Close()
+	noProxy := func() *url.URL { return nil }
+	ctx := context.Background()
+
+	fetch := NewSubscriptionFetch(noProxy)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	for _, target := range []string{
+		srv.URL + "/list",                    // 127.0.0.1
+		"http://localhost:" + port + "/list", // resolves to loopback
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]:" + port + "/list",
+	} {
+		if _, err := fetch(ctx, target, "", ""); !errors.Is(err, errLocalTarget) {
+			t.Errorf("%s: err = %v, want errLocalTarget", target, err)
+		}
+	}
+
+	// Redirects are capped.
+	client := newSubscriptionClient(noProxy, func(net.IP) bool { return false })
+	if _, err := fetchSubscription(ctx, client, srv.URL+"/loop", "", ""); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Errorf("redirect loop: err = %v", err)
+	}
+}
+
+func TestFetchSubscriptionThroughProxy(t *testing.T) {
+	// A forward proxy on loopback: the proxy's own address is allowed.
+	var requested []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.String())
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:s3cret")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.Write([]byte("vless://u@a.example.com:443#A\n"))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("alice", "s3cret")
+
+	fetch := NewSubscriptionFetch(func() *url.URL { return proxyURL })
+	res, err := fetch(context.Background(), "http://sub.example.com/list", "", "")
+	if err != nil || len(res.Body) == 0 {
+		t.Fatalf("fetch = %+v, %v", res, err)
+	}
+	if len(requested) != 1 || requested[0] != "http://sub.example.com/list" {
+		t.Errorf("proxy saw %q", requested)
+	}
+	// Through the proxy, literal local targets are still refused.
+	if _, err := fetch(context.Background(), "http://127.0.0.1/list", "", ""); !errors.Is(err, errLocalTarget) {
+		t.Errorf("loopback through the proxy: err = %v", err)
+	}
+}
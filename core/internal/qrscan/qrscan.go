@@ -0,0 +1,88 @@
+// Package qrscan reads the QR codes in a screenshot or photo, such as a
+// server link shared as a QR code.
+package qrscan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // registers the JPEG decoder
+	_ "image/png"  // registers the PNG decoder
+
+	"github.com/makiuchi-d/gozxing"
+	multiqr "github.com/makiuchi-d/gozxing/multi/qrcode"
+)
+
+// MaxImageBytes caps the encoded image Decode accepts.
+const MaxImageBytes = 5 << 20
+
+// An image's header states its size before any pixels are decoded, so a
+// small file that would inflate to gigabytes is rejected up front. The
+// limits admit an 8K screenshot.
+const (
+	maxSide   = 8192
+	maxPixels = 36 << 20
+)
+
+var (
+	// ErrUnsupportedImage means the data is not a PNG or JPEG image, or is
+	// corrupt.
+	ErrUnsupportedImage = errors.New("not a valid PNG or JPEG image")
+	// ErrImageTooLarge means the file or its dimensions exceed the limits.
+	ErrImageTooLarge = errors.New("image is too large")
+)
+
+// Decode returns the text of every QR code in a PNG or JPEG image, in the
+// order they were found; identical codes are returned once. An image
+// without QR codes returns none and no error. Codes drawn light on dark,
+// as in a dark theme, are found too.
+func Decode(data []byte) ([]string, error) {
+	if len(data) > MaxImageBytes {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrImageTooLarge, len(data), MaxImageBytes)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return nil, ErrUnsupportedImage
+	}
+	if cfg.Width > maxSide || cfg.Height > maxSide || cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("%w: %d×%d pixels", ErrImageTooLarge, cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+	}
+
+	source := gozxing.NewLuminanceSourceFromImage(img)
+	texts, err := decodeSource(source)
+	if err == nil && len(texts) == 0 {
+		texts, err = decodeSource(gozxing.NewInvertedLuminanceSource(source))
+	}
+	return texts, err
+}
+
+// decodeSource returns the distinct texts of the QR codes in source.
+func decodeSource(source gozxing.LuminanceSource) ([]string, error) {
+	bitmap, err := gozxing.NewBinaryBitmap(gozxing.NewHybridBinarizer(source))
+	if err != nil {
+		return nil, err
+	}
+	hints := map[gozxing.DecodeHintType]interface{}{gozxing.DecodeHintType_TRY_HARDER: true}
+	results, err := multiqr.NewQRCodeMultiReader().DecodeMultiple(bitmap, hints)
+	if _, notFound := err.(gozxing.NotFoundException); notFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var texts []string
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if text := r.GetText(); !seen[text] {
+			seen[text] = true
+			texts = append(texts, text)
+		}
+	}
+	return texts, nil
+}
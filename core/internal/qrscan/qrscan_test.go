@@ -0,0 +1,142 @@
+package qrscan
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// qrImage renders text as a size×size QR code, dark on light.
+func qrImage(t *testing.T, text string, size int) *image.Gray {
+	t.Helper()
+	m, err := qrcode.NewQRCodeWriter().Encode(text, gozxing.BarcodeFormat_QR_CODE, size, size, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), m, image.Point{}, draw.Src)
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const (
+	vlessLink = "vless://11111111-2222-3333-4444-555555555555@example.com:443?security=reality&sni=www.microsoft.com&pbk=abc&sid=01&fp=chrome&type=tcp#Frankfurt"
+	hy2Link   = "hysteria2://secret@hy.example.com:8443?sni=hy.example.com#Tokyo"
+	ssLink    = "ss://YWVzLTI1Ni1nY206cGFzcw@ss.example.com:8388#Paris"
+)
+
+func TestDecodeSchemes(t *testing.T) {
+	for _, link := range []string{vlessLink, hy2Link, "hy2://secret@hy.example.com:8443#Short", ssLink} {
+		got, err := Decode(encodePNG(t, qrImage(t, link, 300)))
+		if err != nil {
+			t.Fatalf("%s: %v", link, err)
+		}
+		if want := []string{link}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDecodeJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, qrImage(t, hy2Link, 300), &jpeg.Options{Quality: 80}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(buf.Bytes())
+	if err != nil || !reflect.DeepEqual(got, []string{hy2Link}) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestDecodeMultipleCodes(t *testing.T) {
+	// Two codes side by side, as in a post sharing a server list.
+	canvas := image.NewGray(image.Rect(0, 0, 700, 340))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(canvas, image.Rect(20, 20, 320, 320), qrImage(t, vlessLink, 300), image.Point{}, draw.Src)
+	draw.Draw(canvas, image.Rect(380, 20, 680, 320), qrImage(t, hy2Link, 300), image.Point{}, draw.Src)
+
+	got, err := Decode(encodePNG(t, canvas))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !(contains(got, vlessLink) && contains(got, hy2Link)) {
+		t.Errorf("got %q, want both links", got)
+	}
+}
+
+func TestDecodeInverted(t *testing.T) {
+	img := qrImage(t, vlessLink, 300)
+	for i := range img.Pix {
+		img.Pix[i] = 255 - img.Pix[i]
+	}
+	got, err := Decode(encodePNG(t, img))
+	if err != nil || !reflect.DeepEqual(got, []string{vlessLink}) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestDecodeNoCode(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 200, 200))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	got, err := Decode(encodePNG(t, img))
+	if err != nil || len(got) != 0 {
+		t.Errorf("got %q, %v; want nothing", got, err)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	valid := encodePNG(t, qrImage(t, vlessLink, 300))
+	truncated := valid[:len(valid)/2]
+	corrupted := append([]byte(nil), valid...)
+	for i := 60; i < len(corrupted); i += 7 {
+		corrupted[i] ^= 0xff
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrUnsupportedImage},
+		{"not an image", []byte("vless://not-an-image"), ErrUnsupportedImage},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"), ErrUnsupportedImage},
+		{"truncated", truncated, ErrUnsupportedImage},
+		{"corrupted", corrupted, ErrUnsupportedImage},
+		// Rejected from the header: decoding would not be attempted.
+		{"too wide", encodePNG(t, image.NewGray(image.Rect(0, 0, maxSide+1, 1))), ErrImageTooLarge},
+		{"file too large", make([]byte, MaxImageBytes+1), ErrImageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
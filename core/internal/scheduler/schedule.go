@@ -0,0 +1,118 @@
+// Package scheduler applies time-of-day rules: connect to a profile,
+// disconnect, or switch the split tunnel config during weekly windows.
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxEntries bounds the schedule list.
+const MaxEntries = 32
+
+// Actions a schedule entry takes when its window opens.
+const (
+	ActionConnectProfile = "connectProfile"
+	ActionDisconnect     = "disconnect"
+	ActionSetSplitConfig = "setSplitConfig"
+)
+
+// AllDays is the day mask of every day of the week.
+const AllDays = 1<<7 - 1
+
+// Entry is one scheduled window. The window repeats on the days in Days,
+// from StartTime up to EndTime in local wall-clock time.
+//
+// While the window is open its action is in force: connectProfile connects
+// to ProfileID, disconnect ends the session, setSplitConfig applies
+// SplitConfig. When the last open window closes, a connectProfile session
+// is disconnected and a split config changed by the schedule is restored.
+type Entry struct {
+	Days      int    `json:"days"`      // bit mask, bit 0 = Sunday ... bit 6 = Saturday
+	StartTime string `json:"startTime"` // "HH:MM"
+	EndTime   string `json:"endTime"`   // "HH:MM", after StartTime; "24:00" is midnight
+	Action    string `json:"action"`
+
+	ProfileID   string          `json:"profileId,omitempty"`   // connectProfile
+	SplitConfig json.RawMessage `json:"splitConfig,omitempty"` // setSplitConfig, as split.setConfig takes it
+}
+
+// Validate checks a schedule list. The embedded split config is only
+// checked to be a JSON object; its contents are the caller's to validate.
+func Validate(entries []Entry) error {
+	if len(entries) > MaxEntries {
+		return fmt.Errorf("at most %d entries", MaxEntries)
+	}
+	for i := range entries {
+		if err := entries[i].validate(); err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (e *Entry) validate() error {
+	if e.Days < 1 || e.Days > AllDays {
+		return fmt.Errorf("days must be a mask between 1 and %d", AllDays)
+	}
+	start, err := parseClock(e.StartTime)
+	if err != nil || start == minutesPerDay {
+		return fmt.Errorf("invalid startTime %q", e.StartTime)
+	}
+	end, err := parseClock(e.EndTime)
+	if err != nil {
+		return fmt.Errorf("invalid endTime %q", e.EndTime)
+	}
+	if end <= start {
+		return fmt.Errorf("endTime must be after startTime")
+	}
+
+	switch e.Action {
+	case ActionConnectProfile:
+		if e.ProfileID == "" {
+			return fmt.Errorf("connectProfile needs a profileId")
+		}
+	case ActionDisconnect:
+	case ActionSetSplitConfig:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(e.SplitConfig, &obj); err != nil || obj == nil {
+			return fmt.Errorf("setSplitConfig needs a splitConfig object")
+		}
+	default:
+		return fmt.Errorf("action must be connectProfile, disconnect or setSplitConfig")
+	}
+	return nil
+}
+
+const minutesPerDay = 24 * 60
+
+// parseClock parses "HH:MM" into minutes after midnight. "24:00" is
+// accepted as the end of the day.
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	if !ok || len(hh) != 2 || len(mm) != 2 {
+		return 0, fmt.Errorf("want HH:MM")
+	}
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("want HH:MM")
+	}
+	return h*60 + m, nil
+}
+
+// window returns the validated entry's window in minutes after midnight.
+func (e *Entry) window() (start, end int) {
+	start, _ = parseClock(e.StartTime)
+	end, _ = parseClock(e.EndTime)
+	return start, end
+}
+
+// key identifies the entry across schedule edits, so an unchanged entry
+// keeps its state when others are added or removed.
+func (e *Entry) key() string {
+	data, _ := json.Marshal(e)
+	return string(data)
+}
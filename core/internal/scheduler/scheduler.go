@@ -0,0 +1,189 @@
+package scheduler
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// catchUpAfter is the gap between evaluations, and the delay after a window
+// opened, beyond which its firing counts as a catch-up: the machine was
+// asleep or the service stopped when the window opened.
+const catchUpAfter = 2 * time.Minute
+
+// Firing is a window occurrence the scheduler acts on.
+type Firing struct {
+	Index int // position in the schedule list when it fired
+	Entry Entry
+	Start time.Time // when the window opened
+}
+
+// Transition is a change of the window in force. From is nil when no
+// window was open, To is nil when the last one closed. CatchUp reports that
+// To opened well before the scheduler noticed, typically while the machine
+// slept or the service was stopped.
+type Transition struct {
+	From    *Firing
+	To      *Firing
+	CatchUp bool
+}
+
+// occurrence is one day's window of an entry.
+type occurrence struct {
+	key  string
+	date string // local date, 2006-01-02
+}
+
+// Scheduler evaluates the schedule once a minute and reports each change of
+// the window in force.
+//
+// When windows overlap, the one that opened last is in force; on a tie the
+// later entry wins. An occurrence ends once and never reopens on the same
+// day, so the hour repeated when daylight saving time ends does not fire a
+// window twice, and an open window stays open through it. A window inside
+// the hour skipped when daylight saving time starts does not occur that
+// day. A window that opened and closed while the machine was asleep is
+// skipped; one still open on resume fires as a catch-up.
+type Scheduler struct {
+	entries func() []Entry
+	apply   func(Transition)
+	now     func() time.Time // replaced in tests
+	loc     *time.Location   // replaced in tests
+	poke    chan struct{}
+
+	mu      sync.Mutex
+	last    time.Time // previous evaluation
+	open    map[occurrence]bool
+	done    map[occurrence]bool
+	current *Firing
+}
+
+// New returns a scheduler that reads the schedule from entries and passes
+// every transition to apply. Transitions are applied one at a time.
+func New(entries func() []Entry, apply func(Transition)) *Scheduler {
+	return &Scheduler{
+		entries: entries,
+		apply:   apply,
+		now:     time.Now,
+		loc:     time.Local,
+		poke:    make(chan struct{}, 1),
+		open:    make(map[occurrence]bool),
+		done:    make(map[occurrence]bool),
+	}
+}
+
+// Run evaluates the schedule at start, at every minute boundary, on resume
+// from sleep and when poked, until stop is closed. resume may be nil.
+func (s *Scheduler) Run(stop, resume <-chan struct{}) {
+	s.Evaluate()
+	for {
+		timer := time.NewTimer(untilNextMinute(s.now()))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-resume:
+			log.Println("scheduler: resumed from sleep, catching up")
+		case <-s.poke:
+		case <-timer.C:
+		}
+		timer.Stop()
+		s.Evaluate()
+	}
+}
+
+// Poke makes Run evaluate the schedule now, e.g. after it was edited.
+func (s *Scheduler) Poke() {
+	select {
+	case s.poke <- struct{}{}:
+	default:
+	}
+}
+
+// Evaluate applies the schedule as of now.
+func (s *Scheduler) Evaluate() {
+	s.evaluate(s.now())
+}
+
+func (s *Scheduler) evaluate(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	local := now.In(s.loc)
+	date := local.Format("2006-01-02")
+	minute := local.Hour()*60 + local.Minute()
+	weekday := 1 << uint(local.Weekday())
+
+	active := make(map[occurrence]bool)
+	var next *Firing
+	var nextOcc occurrence
+	for i, e := range s.entries() {
+		if e.Days&weekday == 0 {
+			continue
+		}
+		start, end := e.window()
+		occ := occurrence{key: e.key(), date: date}
+		// An open window stays open while the clock is turned back, so
+		// only its end is checked.
+		inWindow := minute >= start && minute < end && !s.done[occ]
+		if !inWindow && !(s.open[occ] && minute < end) {
+			continue
+		}
+		active[occ] = true
+		f := &Firing{
+			Index: i,
+			Entry: e,
+			Start: time.Date(local.Year(), local.Month(), local.Day(), start/60, start%60, 0, 0, s.loc),
+		}
+		if next == nil || !f.Start.Before(next.Start) {
+			next, nextOcc = f, occ
+		}
+	}
+
+	wasOpen := s.open[nextOcc]
+	for occ := range s.open {
+		if !active[occ] {
+			s.done[occ] = true
+		}
+	}
+	s.open = active
+	s.pruneDone(local)
+	missed := s.last.IsZero() || now.Sub(s.last) >= catchUpAfter
+	s.last = now
+
+	prev := s.current
+	if sameWindow(prev, next) {
+		if next != nil {
+			s.current = next // keep the index current after edits
+		}
+		return
+	}
+	s.current = next
+	t := Transition{From: prev, To: next}
+	if next != nil {
+		t.CatchUp = !wasOpen && missed && now.Sub(next.Start) >= catchUpAfter
+	}
+	s.apply(t)
+}
+
+// pruneDone forgets occurrences older than yesterday.
+func (s *Scheduler) pruneDone(local time.Time) {
+	yesterday := local.AddDate(0, 0, -1).Format("2006-01-02")
+	for occ := range s.done {
+		if occ.date < yesterday {
+			delete(s.done, occ)
+		}
+	}
+}
+
+func sameWindow(a, b *Firing) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Entry.key() == b.Entry.key() && a.Start.Equal(b.Start)
+}
+
+// untilNextMinute returns the delay to just after the next minute boundary.
+func untilNextMinute(now time.Time) time.Duration {
+	return now.Truncate(time.Minute).Add(time.Minute + time.Second).Sub(now)
+}
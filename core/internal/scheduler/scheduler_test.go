@@ -0,0 +1,254 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata" // America/New_York for the DST cases
+)
+
+// fakeClock drives a scheduler by hand and records its transitions.
+type fakeClock struct {
+	t       *testing.T
+	s       *Scheduler
+	now     time.Time
+	entries []Entry
+	fired   []Transition
+}
+
+func newFakeClock(t *testing.T, start time.Time, entries ...Entry) *fakeClock {
+	t.Helper()
+	if err := Validate(entries); err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeClock{t: t, now: start, entries: entries}
+	c.s = New(func() []Entry { return c.entries }, func(tr Transition) { c.fired = append(c.fired, tr) })
+	c.s.now = func() time.Time { return c.now }
+	c.s.loc = start.Location()
+	return c
+}
+
+// advance moves the clock forward a minute at a time, as Run would.
+func (c *fakeClock) advance(d time.Duration) {
+	for end := c.now.Add(d); c.now.Before(end); {
+		c.now = c.now.Add(time.Minute)
+		c.s.Evaluate()
+	}
+}
+
+// jump moves the clock without evaluating in between, as sleep does.
+func (c *fakeClock) jump(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.s.Evaluate()
+}
+
+// take returns the transitions since the last call as "from>to" strings
+// of entry indexes, with "-" for none and a "*" suffix for catch-ups.
+func (c *fakeClock) take() []string {
+	var out []string
+	for _, tr := range c.fired {
+		s := firingName(tr.From) + ">" + firingName(tr.To)
+		if tr.CatchUp {
+			s += "*"
+		}
+		out = append(out, s)
+	}
+	c.fired = nil
+	return out
+}
+
+func firingName(f *Firing) string {
+	if f == nil {
+		return "-"
+	}
+	return string(rune('0' + f.Index))
+}
+
+func (c *fakeClock) expect(want ...string) {
+	c.t.Helper()
+	got := c.take()
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		c.t.Errorf("at %s: transitions = %v, want %v", c.now.Format("Mon 15:04 MST"), got, want)
+	}
+}
+
+func disconnect(days int, start, end string) Entry {
+	return Entry{Days: days, StartTime: start, EndTime: end, Action: ActionDisconnect}
+}
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+const weekdays = 1<<time.Monday | 1<<time.Tuesday | 1<<time.Wednesday | 1<<time.Thursday | 1<<time.Friday
+
+func TestWindowOpensAndCloses(t *testing.T) {
+	// Monday 2026-10-12, 08:58.
+	c := newFakeClock(t, time.Date(2026, 10, 12, 8, 58, 0, 0, time.UTC), disconnect(weekdays, "09:00", "17:00"))
+	c.s.Evaluate()
+	c.expect()
+	c.advance(2 * time.Minute)
+	c.expect("->0")
+	c.advance(8 * time.Hour)
+	c.expect("0>-")
+
+	// Saturday is not in the mask.
+	c.jump(4*24*time.Hour + time.Hour)
+	c.expect()
+}
+
+func TestOverlappingWindows(t *testing.T) {
+	c := newFakeClock(t, time.Date(2026, 10, 12, 8, 0, 0, 0, time.UTC),
+		disconnect(AllDays, "09:00", "17:00"),
+		disconnect(AllDays, "12:00", "13:00"),
+		disconnect(AllDays, "09:00", "10:00"),
+	)
+	// Entries 0 and 2 open together; the later entry wins the tie.
+	c.advance(time.Hour)
+	c.expect("->2")
+	// When 2 closes, 0 is still open and comes back in force.
+	c.advance(time.Hour)
+	c.expect("2>0")
+	// The window that opened last wins.
+	c.advance(2 * time.Hour)
+	c.expect("0>1")
+	c.advance(time.Hour)
+	c.expect("1>0")
+	c.advance(4 * time.Hour)
+	c.expect("0>-")
+}
+
+func TestCatchUpAfterSleep(t *testing.T) {
+	c := newFakeClock(t, time.Date(2026, 10, 12, 8, 50, 0, 0, time.UTC),
+		disconnect(AllDays, "09:00", "17:00"),
+		disconnect(AllDays, "09:30", "10:00"),
+	)
+	c.s.Evaluate()
+	// Asleep from 08:50 to 10:15: entry 1 opened and closed unseen and is
+	// skipped; entry 0 is still open and fires late.
+	c.jump(85 * time.Minute)
+	c.expect("->0*")
+	// Waking after the window closed ends it.
+	c.jump(8 * time.Hour)
+	c.expect("0>-")
+}
+
+func TestStartInsideWindow(t *testing.T) {
+	c := newFakeClock(t, time.Date(2026, 10, 12, 9, 0, 30, 0, time.UTC), disconnect(AllDays, "09:00", "17:00"))
+	c.s.Evaluate()
+	c.expect("->0")
+
+	c = newFakeClock(t, time.Date(2026, 10, 12, 11, 0, 0, 0, time.UTC), disconnect(AllDays, "09:00", "17:00"))
+	c.s.Evaluate()
+	c.expect("->0*")
+}
+
+func TestDaylightSavingEnds(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	// Clocks go from 01:59 EDT back to 01:00 EST on 2026-11-01.
+	c := newFakeClock(t, time.Date(2026, 11, 1, 0, 50, 0, 0, ny),
+		disconnect(AllDays, "01:10", "01:20"),
+		disconnect(AllDays, "01:40", "02:30"),
+	)
+	c.advance(20 * time.Minute)
+	c.expect("->0")
+	c.advance(10 * time.Minute)
+	c.expect("0>-")
+	c.advance(20 * time.Minute)
+	c.expect("->1")
+	// The repeated hour neither reopens entry 0 nor closes entry 1.
+	c.advance(time.Hour)
+	c.expect()
+	c.advance(40 * time.Minute) // 02:20 EST
+	c.expect()
+	c.advance(10 * time.Minute)
+	c.expect("1>-")
+}
+
+func TestDaylightSavingStarts(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	// Clocks go from 01:59 EST to 03:00 EDT on 2026-03-08.
+	c := newFakeClock(t, time.Date(2026, 3, 8, 1, 50, 0, 0, ny),
+		disconnect(AllDays, "02:15", "02:45"),
+		disconnect(AllDays, "02:30", "04:00"),
+	)
+	c.advance(15 * time.Minute)
+	// 02:15-02:45 does not exist; 02:30-04:00 is open from 03:00.
+	c.expect("->1")
+	c.advance(time.Hour)
+	c.expect("1>-")
+}
+
+func TestScheduleEdits(t *testing.T) {
+	c := newFakeClock(t, time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC), disconnect(AllDays, "09:00", "17:00"))
+	c.s.Evaluate()
+	c.take()
+
+	// Adding an entry before the open one does not refire it.
+	c.entries = append([]Entry{disconnect(AllDays, "20:00", "21:00")}, c.entries...)
+	c.s.Evaluate()
+	c.expect()
+	if f := c.s.current; f == nil || f.Index != 1 {
+		t.Errorf("current = %+v, want index 1", f)
+	}
+
+	// Removing the open entry closes its window.
+	c.entries = c.entries[:1]
+	c.s.Evaluate()
+	c.expect("1>-")
+}
+
+func TestValidate(t *testing.T) {
+	split := json.RawMessage(`{"mode":"app","apps":["game.exe"]}`)
+	tests := []struct {
+		name    string
+		entry   Entry
+		wantErr string
+	}{
+		{"disconnect", disconnect(weekdays, "09:00", "17:00"), ""},
+		{"until midnight", disconnect(AllDays, "22:00", "24:00"), ""},
+		{"connect profile", Entry{Days: 1, StartTime: "09:00", EndTime: "10:00", Action: ActionConnectProfile, ProfileID: "p1"}, ""},
+		{"split config", Entry{Days: 1, StartTime: "09:00", EndTime: "10:00", Action: ActionSetSplitConfig, SplitConfig: split}, ""},
+		{"no days", disconnect(0, "09:00", "17:00"), "days"},
+		{"days out of range", disconnect(128, "09:00", "17:00"), "days"},
+		{"end before start", disconnect(AllDays, "17:00", "09:00"), "after startTime"},
+		{"empty window", disconnect(AllDays, "09:00", "09:00"), "after startTime"},
+		{"bad start", disconnect(AllDays, "9:00", "17:00"), "startTime"},
+		{"start at midnight end", disconnect(AllDays, "24:00", "24:00"), "startTime"},
+		{"bad end", disconnect(AllDays, "09:00", "17:60"), "endTime"},
+		{"unknown action", Entry{Days: 1, StartTime: "09:00", EndTime: "10:00", Action: "reboot"}, "action"},
+		{"connect without profile", Entry{Days: 1, StartTime: "09:00", EndTime: "10:00", Action: ActionConnectProfile}, "profileId"},
+		{"split without config", Entry{Days: 1, StartTime: "09:00", EndTime: "10:00", Action: ActionSetSplitConfig}, "splitConfig"},
+		{"split config not an object", Entry{Days: 1, StartTime: "09:00", EndTime: "10:00", Action: ActionSetSplitConfig,
+			SplitConfig: json.RawMessage(`["app"]`)}, "splitConfig"},
+	}
+	for _, tt := range tests {
+		err := Validate([]Entry{tt.entry})
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if err := Validate(make([]Entry, MaxEntries+1)); err == nil {
+		t.Error("too many entries accepted")
+	}
+}
+
+func TestUntilNextMinute(t *testing.T) {
+	now := time.Date(2026, 10, 12, 9, 0, 45, 0, time.UTC)
+	if got := untilNextMinute(now); got != 16*time.Second {
+		t.Errorf("untilNextMinute = %v, want 16s", got)
+	}
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+	"github.com/mriaz/vpn-core/internal/paths"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// errNothingToRemove marks a cleanup step that found nothing to do.
+var errNothingToRemove = errors.New("nothing to remove")
+
+// cleanupStep is one independent part of an uninstall.
+type cleanupStep struct {
+	name string
+	run  func() error
+}
+
+// CleanupReport summarizes what an uninstall removed.
+type CleanupReport struct {
+	Removed []string
+	Skipped []string          // steps that found nothing to remove
+	Failed  map[string]string // step name → error
+}
+
+// Err returns a combined error if any step failed.
+func (r *CleanupReport) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	var parts []string
+	for name, msg := range r.Failed {
+		parts = append(parts, fmt.Sprintf("%s: %s", name, msg))
+	}
+	return fmt.Errorf("cleanup incomplete: %s", strings.Join(parts, "; "))
+}
+
+// String formats the report for console output.
+func (r *CleanupReport) String() string {
+	var b strings.Builder
+	for _, name := range r.Removed {
+		fmt.Fprintf(&b, "  removed: %s\n", name)
+	}
+	for _, name := range r.Skipped {
+		fmt.Fprintf(&b, "  not present: %s\n", name)
+	}
+	for name, msg := range r.Failed {
+		fmt.Fprintf(&b, "  FAILED: %s (%s)\n", name, msg)
+	}
+	return b.String()
+}
+
+// runCleanup runs every step regardless of earlier failures.
+func runCleanup(steps []cleanupStep) *CleanupReport {
+	report := &CleanupReport{Failed: make(map[string]string)}
+	for _, step := range steps {
+		err := step.run()
+		switch {
+		case err == nil:
+			report.Removed = append(report.Removed, step.name)
+		case errors.Is(err, errNothingToRemove), errors.Is(err, vpn.ErrNotFound):
+			report.Skipped = append(report.Skipped, step.name)
+		default:
+			report.Failed[step.name] = err.Error()
+		}
+	}
+	return report
+}
+
+// uninstallSteps returns the cleanup steps for Uninstall of inst. Without
+// purge only the service registration and event log source are removed.
+// The program data step removes paths.DataDir, which must be inst's.
+func uninstallSteps(inst instance.Instance, purge bool) []cleanupStep {
+	var steps []cleanupStep
+	if purge {
+		steps = append(steps, cleanupStep{"running tunnel", func() error { return shutdownRunningCore(inst) }})
+	}
+	steps = append(steps,
+		cleanupStep{"service", func() error { return deleteService(inst) }},
+		cleanupStep{"event log source", func() error { return removeEventLog(inst) }},
+	)
+	if purge {
+		steps = append(steps,
+			cleanupStep{"TUN adapter", func() error { return vpn.RemoveTunAdapter(inst) }},
+			cleanupStep{"firewall rules", func() error { return vpn.DeleteFirewallRules(inst) }},
+			cleanupStep{"program data", removeDataDir},
+		)
+	}
+	return steps
+}
+
+// shutdownRequest asks the core to disconnect and exit. It is forced: the
+// core otherwise asks for confirmation while transfers run, and an
+// uninstall removes the adapter either way.
+const shutdownRequest = `{"id":"uninstall","method":"service.shutdown","params":{"force":true,"reason":"user"}}` + "\n"
+
+// shutdownRunningCore asks a running backend to disconnect and exit over IPC.
+func shutdownRunningCore(inst instance.Instance) error {
+	timeout := 2 * time.Second
+	conn, err := winio.DialPipe(inst.PipeName(), &timeout)
+	if err != nil {
+		return errNothingToRemove
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(shutdownRequest)); err != nil {
+		return fmt.Errorf("failed to send shutdown: %w", err)
+	}
+	if err := readShutdownResponse(conn); err != nil {
+		return err
+	}
+	// Give the core time to tear down the tunnel before the adapter step.
+	time.Sleep(1 * time.Second)
+	return nil
+}
+
+// readShutdownResponse reads the response to shutdownRequest from r,
+// skipping the notifications the core pushes meanwhile, and returns the
+// error it carries, if any.
+func readShutdownResponse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+	for scanner.Scan() {
+		var resp struct {
+			ID    string `json:"id"`
+			Error *struct {
+				Key     string `json:"key"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			return fmt.Errorf("invalid response to shutdown: %w", err)
+		}
+		if resp.ID != "uninstall" {
+			continue
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("shutdown refused: %s (%s)", resp.Error.Message, resp.Error.Key)
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("no response to shutdown: %w", err)
+	}
+	return errors.New("no response to shutdown: the core closed the connection")
+}
+
+func deleteService(inst instance.Instance) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(inst.ServiceName())
+	if err != nil {
+		return errNothingToRemove
+	}
+	defer s.Close()
+
+	// Stop if running
+	status, err := s.Query()
+	if err == nil && status.State != svc.Stopped {
+		_, _ = s.Control(svc.Stop)
+		// Wait a bit for stop
+		time.Sleep(2 * time.Second)
+	}
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+	return nil
+}
+
+func removeEventLog(inst instance.Instance) error {
+	err := eventlog.Remove(inst.ServiceName())
+	if errors.Is(err, windows.ERROR_FILE_NOT_FOUND) {
+		return errNothingToRemove
+	}
+	return err
+}
+
+func removeDataDir() error {
+	dir := paths.DataDir()
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return errNothingToRemove
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+func TestRunCleanupContinuesAfterFailure(t *testing.T) {
+	var ran []string
+	step := func(name string, err error) cleanupStep {
+		return cleanupStep{name: name, run: func() error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+
+	report := runCleanup([]cleanupStep{
+		step("tunnel", errNothingToRemove),
+		step("service", errors.New("access denied")),
+		step("adapter", vpn.ErrNotFound),
+		step("data", nil),
+	})
+
+	if want := []string{"tunnel", "service", "adapter", "data"}; !reflect.DeepEqual(ran, want) {
+		t.Fatalf("steps run = %v, want %v", ran, want)
+	}
+	if want := []string{"data"}; !reflect.DeepEqual(report.Removed, want) {
+		t.Errorf("Removed = %v, want %v", report.Removed, want)
+	}
+	if want := []string{"tunnel", "adapter"}; !reflect.DeepEqual(report.Skipped, want) {
+		t.Errorf("Skipped = %v, want %v", report.Skipped, want)
+	}
+	if report.Failed["service"] != "access denied" || len(report.Failed) != 1 {
+		t.Errorf("Failed = %v, want only service", report.Failed)
+	}
+	if report.Err() == nil {
+		t.Error("Err() = nil, want error for failed step")
+	}
+}
+
+func TestUninstallStepsPurge(t *testing.T) {
+	names := func(steps []cleanupStep) []string {
+		var out []string
+		for _, s := range steps {
+			out = append(out, s.name)
+		}
+		return out
+	}
+
+	if got, want := names(uninstallSteps(instance.Default, false)), []string{"service", "event log source"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uninstallSteps(false) = %v, want %v", got, want)
+	}
+	got := names(uninstallSteps(instance.Default, true))
+	want := []string{"running tunnel", "service", "event log source", "TUN adapter", "firewall rules", "program data"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uninstallSteps(true) = %v, want %v", got, want)
+	}
+}
+
+func TestReadShutdownResponse(t *testing.T) {
+	stateChanged := `{"method":"vpn.stateChanged","params":{"state":"disconnecting"}}` + "\n"
+	tests := []struct {
+		name, input, err string
+	}{
+		{"ok after a notification", stateChanged + `{"id":"uninstall","result":{"ok":true}}` + "\n", ""},
+		{"confirmation required", `{"id":"uninstall","error":{"code":-32001,"key":"confirmation_required","message":"transfers are running"}}` + "\n", "confirmation_required"},
+		{"closed", stateChanged, "closed the connection"},
+		{"garbage", "not json\n", "invalid response"},
+	}
+	for _, tt := range tests {
+		err := readShutdownResponse(strings.NewReader(tt.input))
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	if !strings.Contains(shutdownRequest, `"force":true`) {
+		t.Errorf("shutdown request = %s, want it forced", shutdownRequest)
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// LaunchInSession starts the executable at path in Windows session
+// sessionID as the user logged on to it, on the interactive desktop, and
+// returns its process ID. The service runs as SYSTEM, so it takes the
+// user's token from the session rather than starting the program itself.
+func LaunchInSession(sessionID uint32, path string) (uint32, error) {
+	var token windows.Token
+	if err := windows.WTSQueryUserToken(sessionID, &token); err != nil {
+		return 0, fmt.Errorf("failed to get the user token of session %d: %w", sessionID, err)
+	}
+	defer token.Close()
+
+	var env *uint16
+	if err := windows.CreateEnvironmentBlock(&env, token, false); err != nil {
+		return 0, fmt.Errorf("failed to create the user's environment: %w", err)
+	}
+	defer windows.DestroyEnvironmentBlock(env)
+
+	app, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	cmdLine, err := windows.UTF16PtrFromString(windows.EscapeArg(path))
+	if err != nil {
+		return 0, err
+	}
+	dir, err := windows.UTF16PtrFromString(filepath.Dir(path))
+	if err != nil {
+		return 0, err
+	}
+	desktop, _ := windows.UTF16PtrFromString(`winsta0\default`)
+	si := &windows.StartupInfo{Cb: uint32(unsafe.Sizeof(windows.StartupInfo{})), Desktop: desktop}
+	var pi windows.ProcessInformation
+	if err := windows.CreateProcessAsUser(token, app, cmdLine, nil, nil, false,
+		windows.CREATE_UNICODE_ENVIRONMENT, env, dir, si, &pi); err != nil {
+		return 0, fmt.Errorf("failed to start %s: %w", path, err)
+	}
+	windows.CloseHandle(pi.Thread)
+	windows.CloseHandle(pi.Process)
+	return pi.ProcessId, nil
+}
@@ -1,23 +1,46 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"time"
+	"unsafe"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/mriaz/vpn-core/internal/instance"
 )
 
-const serviceName = "MRVPN"
-const serviceDisplay = "MRVPN Service"
+// The service name and display name derive from the instance; see
+// instance.Instance.ServiceName.
 const serviceDescription = "MRVPN backend service - manages VPN connections via sing-box"
 
-// RunFunc is the function called when the service starts.
-type RunFunc func(stop <-chan struct{})
+// serviceDependencies are the services started before ours: the TCP/IP
+// driver and the DNS client, without which nothing the core does at start
+// can work.
+var serviceDependencies = []string{"Tcpip", "Dnscache"}
+
+// RunFunc is the function called when the service starts. resume receives
+// a value each time the machine wakes from sleep, and logons each user
+// logon.
+type RunFunc func(stop, resume <-chan struct{}, logons <-chan Logon)
+
+// Logon is a user logging on to a Windows session.
+type Logon struct {
+	SessionID uint32
+	Console   bool // at the physical console, rather than over Remote Desktop
+}
+
+// Power broadcast event types (PBT_*) delivered with svc.PowerEvent.
+const (
+	pbtAPMResumeSuspend   = 0x7
+	pbtAPMResumeAutomatic = 0x12
+)
 
 // MriazService implements the Windows service interface.
 type MriazService struct {
@@ -29,14 +52,40 @@ func (s *MriazService) Execute(args []string, r <-chan svc.ChangeRequest, change
 	changes <- svc.Status{State: svc.StartPending}
 
 	stop := make(chan struct{})
-	go s.run(stop)
+	resume := make(chan struct{}, 1)
+	logons := make(chan Logon, 4)
+	go s.run(stop, resume, logons)
 
-	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	// Session changes are the service counterpart of
+	// WTSRegisterSessionNotification.
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPowerEvent | svc.AcceptSessionChange}
 
 	for c := range r {
 		switch c.Cmd {
 		case svc.Interrogate:
 			changes <- c.CurrentStatus
+		case svc.PowerEvent:
+			// Windows sends both events on a user wake; one pending
+			// signal is enough.
+			if c.EventType == pbtAPMResumeAutomatic || c.EventType == pbtAPMResumeSuspend {
+				select {
+				case resume <- struct{}{}:
+				default:
+				}
+			}
+		case svc.SessionChange:
+			if c.EventType != windows.WTS_SESSION_LOGON {
+				break
+			}
+			// EventData points to a WTSSESSION_NOTIFICATION the service
+			// manager owns for the duration of the call.
+			n := (*windows.WTSSESSION_NOTIFICATION)(*(*unsafe.Pointer)(unsafe.Pointer(&c.EventData)))
+			logon := Logon{SessionID: n.SessionID, Console: n.SessionID == windows.WTSGetActiveConsoleSessionId()}
+			select {
+			case logons <- logon:
+			default:
+				log.Printf("warning: dropped the logon of session %d", logon.SessionID)
+			}
 		case svc.Stop, svc.Shutdown:
 			changes <- svc.Status{State: svc.StopPending}
 			close(stop)
@@ -46,14 +95,9 @@ func (s *MriazService) Execute(args []string, r <-chan svc.ChangeRequest, change
 	return
 }
 
-// RunAsService runs the given function as a Windows service.
-func RunAsService(run RunFunc) error {
-	elog, err := eventlog.Open(serviceName)
-	if err == nil {
-		defer elog.Close()
-	}
-
-	return svc.Run(serviceName, &MriazService{run: run})
+// RunAsService runs the given function as the Windows service of inst.
+func RunAsService(inst instance.Instance, run RunFunc) error {
+	return svc.Run(inst.ServiceName(), &MriazService{run: run})
 }
 
 // IsRunningAsService detects if we're running as a Windows service.
@@ -65,8 +109,10 @@ func IsRunningAsService() bool {
 	return isService
 }
 
-// Install installs the service in Windows Service Manager.
-func Install() error {
+// Install installs the service of inst in Windows Service Manager, started
+// with the flags that select inst.
+func Install(inst instance.Instance) error {
+	serviceName := inst.ServiceName()
 	exePath, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("failed to get executable path: %w", err)
@@ -89,10 +135,14 @@ func Install() error {
 	}
 
 	s, err = m.CreateService(serviceName, exePath, mgr.Config{
-		DisplayName: serviceDisplay,
+		DisplayName: inst.ServiceDisplayName(),
 		Description: serviceDescription,
 		StartType:   mgr.StartAutomatic,
-	}, "service")
+		// Started shortly after the other automatic services, by when the
+		// network stack is usually up; see also netready.
+		DelayedAutoStart: true,
+		Dependencies:     serviceDependencies,
+	}, append(inst.Args(), "service")...)
 	if err != nil {
 		return fmt.Errorf("failed to create service: %w", err)
 	}
@@ -107,8 +157,32 @@ func Install() error {
 	return nil
 }
 
-// Uninstall removes the service from Windows Service Manager.
-func Uninstall() error {
+// Uninstall removes the service of inst from Windows Service Manager. With
+// purge it also shuts down a running tunnel and removes the TUN adapter,
+// firewall rules and all data under %ProgramData%\MRVPN (MRVPN-<name> for
+// a named instance). Every step runs even if an earlier one fails; the
+// report lists what was removed and what failed.
+func Uninstall(inst instance.Instance, purge bool) (*CleanupReport, error) {
+	serviceName := inst.ServiceName()
+	report := runCleanup(uninstallSteps(inst, purge))
+	if !purge {
+		for _, name := range report.Skipped {
+			if name == "service" {
+				return report, fmt.Errorf("service %s not found", serviceName)
+			}
+		}
+	}
+	if err := report.Err(); err != nil {
+		return report, err
+	}
+
+	log.Printf("service %s uninstalled successfully", serviceName)
+	return report, nil
+}
+
+// Start starts the Windows service of inst.
+func Start(inst instance.Instance) error {
+	serviceName := inst.ServiceName()
 	m, err := mgr.Connect()
 	if err != nil {
 		return fmt.Errorf("failed to connect to service manager: %w", err)
@@ -121,26 +195,12 @@ func Uninstall() error {
 	}
 	defer s.Close()
 
-	// Stop if running
-	status, err := s.Query()
-	if err == nil && status.State != svc.Stopped {
-		_, _ = s.Control(svc.Stop)
-		// Wait a bit for stop
-		time.Sleep(2 * time.Second)
-	}
-
-	if err := s.Delete(); err != nil {
-		return fmt.Errorf("failed to delete service: %w", err)
-	}
-
-	_ = eventlog.Remove(serviceName)
-
-	log.Printf("service %s uninstalled successfully", serviceName)
-	return nil
+	return s.Start()
 }
 
-// Start starts the Windows service.
-func Start() error {
+// Stop stops the Windows service of inst.
+func Stop(inst instance.Instance) error {
+	serviceName := inst.ServiceName()
 	m, err := mgr.Connect()
 	if err != nil {
 		return fmt.Errorf("failed to connect to service manager: %w", err)
@@ -153,23 +213,46 @@ func Start() error {
 	}
 	defer s.Close()
 
-	return s.Start()
+	_, err = s.Control(svc.Stop)
+	return err
+}
+
+// Info is the service's registration as the service manager reports it.
+type Info struct {
+	Installed bool
+	Running   bool
+	AutoStart bool // starts with Windows
 }
 
-// Stop stops the Windows service.
-func Stop() error {
+// Status reports whether the service of inst is installed, running and set
+// to start automatically. A missing service is not an error.
+func Status(inst instance.Instance) (Info, error) {
+	serviceName := inst.ServiceName()
 	m, err := mgr.Connect()
 	if err != nil {
-		return fmt.Errorf("failed to connect to service manager: %w", err)
+		return Info{}, fmt.Errorf("failed to connect to service manager: %w", err)
 	}
 	defer m.Disconnect()
 
 	s, err := m.OpenService(serviceName)
 	if err != nil {
-		return fmt.Errorf("service %s not found: %w", serviceName, err)
+		if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+			return Info{}, nil
+		}
+		return Info{}, fmt.Errorf("failed to open service %s: %w", serviceName, err)
 	}
 	defer s.Close()
 
-	_, err = s.Control(svc.Stop)
-	return err
+	info := Info{Installed: true}
+	status, err := s.Query()
+	if err != nil {
+		return info, fmt.Errorf("failed to query service %s: %w", serviceName, err)
+	}
+	info.Running = status.State == svc.Running
+	config, err := s.Config()
+	if err != nil {
+		return info, fmt.Errorf("failed to read service %s configuration: %w", serviceName, err)
+	}
+	info.AutoStart = config.StartType == mgr.StartAutomatic
+	return info, nil
 }
@@ -0,0 +1,708 @@
+package settings
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mriaz/vpn-core/internal/audit"
+	"github.com/mriaz/vpn-core/internal/datafile"
+	"github.com/mriaz/vpn-core/internal/desktopnotify"
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/scheduler"
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+	"github.com/mriaz/vpn-core/internal/sysproxy"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// FileName is the settings file inside the data directory.
+const FileName = "settings.json"
+
+// maxFileBytes bounds the settings file; a larger one is not read.
+const maxFileBytes = 1 << 20
+
+// maxListEntries bounds each list setting.
+const maxListEntries = 1000
+
+// Settings holds service preferences persisted across restarts.
+type Settings struct {
+	HealthMonitor         bool `json:"healthMonitor"`         // periodic latency checks of saved profiles
+	HealthIntervalMinutes int  `json:"healthIntervalMinutes"` // delay between health check rounds
+
+	// PowerMode is "normal" or "low"; low trades stats freshness and
+	// diagnostics for CPU time on battery (see vpn.PowerLow).
+	PowerMode string `json:"powerMode" jsonschema:"enum=normal|low"`
+
+	// A connected session is degraded after DegradedAfterProbes consecutive
+	// health probes through the proxy fail or take longer than DegradedRTTMs,
+	// and healthy again after RecoverAfterProbes good ones (see
+	// vpn.HealthThresholds).
+	DegradedAfterProbes int `json:"degradedAfterProbes"`
+	DegradedRTTMs       int `json:"degradedRttMs"`
+	RecoverAfterProbes  int `json:"recoverAfterProbes"`
+
+	// AutoTuneMTU applies the MTU an MTU probe suggested for a server (see
+	// vpn.Engine.ProbeMTU) the next time it is connected.
+	AutoTuneMTU bool `json:"autoTuneMtu"`
+
+	// PersistCache gives sing-box a cache file, so urltest selections and
+	// rule-set downloads survive reconnects (see vpn.CacheFileName).
+	PersistCache bool `json:"persistCache"`
+
+	// CaptivePortalGraceMinutes is how long scheduled connects are held
+	// off after a connect ran into a captive portal, giving the user time
+	// to sign in before the connect is tried again.
+	CaptivePortalGraceMinutes int `json:"captivePortalGraceMinutes"`
+
+	// SystemProxyBypass lists host wildcards and IPv4 CIDRs that skip the
+	// system proxy, added to sysproxy.DefaultBypass and to the user's own
+	// Windows exceptions.
+	SystemProxyBypass []string `json:"systemProxyBypass"`
+
+	// BuiltinBypasses names curated destination bundles that skip the
+	// tunnel, such as "windowsUpdate" (see splittunnel.BypassNames).
+	BuiltinBypasses []string `json:"builtinBypasses"`
+
+	// ServerGroupRules group imported servers by display name; the first
+	// matching rule gives the group (see parser.GroupRule).
+	ServerGroupRules []parser.GroupRule `json:"serverGroupRules"`
+
+	// Schedules are weekly windows that connect, disconnect or switch the
+	// split tunnel config (see scheduler.Entry).
+	Schedules []scheduler.Entry `json:"schedules"`
+
+	// DesktopNotifications shows Windows toasts for session events, such
+	// as an unexpected disconnect, while no UI is connected (see
+	// desktopnotify.Dispatcher).
+	DesktopNotifications desktopnotify.Settings `json:"desktopNotifications"`
+
+	// MaxDownMbps and MaxUpMbps cap the tunnel's throughput for connects
+	// that set no limit of their own; zero is unlimited (see
+	// vpn.RateLimit).
+	MaxDownMbps int `json:"maxDownMbps"`
+	MaxUpMbps   int `json:"maxUpMbps"`
+
+	// MaxConfigRules, MaxConfigDomains, MaxConfigOutbounds and
+	// MaxConfigKB raise or lower the complexity limits of the generated
+	// sing-box config; zero keeps the default (see vpn.ConfigLimits).
+	// Raising them lets configs through that can make the core slow to
+	// start.
+	MaxConfigRules     int `json:"maxConfigRules"`
+	MaxConfigDomains   int `json:"maxConfigDomains"`
+	MaxConfigOutbounds int `json:"maxConfigOutbounds"`
+	MaxConfigKB        int `json:"maxConfigKb"`
+
+	// EventLogEnabled writes connects, disconnects and errors to the
+	// Windows Event Log (see winevent.Emitter). Unset, it is on when
+	// running as a service and off interactively.
+	EventLogEnabled *bool `json:"eventLogEnabled"`
+
+	// AllowedServerPorts lists the server ports, such as "443", and port
+	// ranges, such as "8000-8999", connects and pings may use. Empty allows
+	// every port.
+	AllowedServerPorts []string `json:"allowedServerPorts"`
+
+	// AllowedClientPaths and AllowedClientSigners restrict which programs
+	// may use the IPC pipe: a client is admitted if its executable is one
+	// of AllowedClientPaths (full paths, compared case-insensitively) or
+	// carries a valid Authenticode signature by a certificate whose SHA-1
+	// thumbprint is in AllowedClientSigners. Both empty admits every
+	// client. Setting either takes an admin lock and its token; a list
+	// that shuts out the app itself is undone by deleting the settings file
+	// as an administrator; an edited file fails the integrity check and
+	// is set aside as well (see datafile.Guard), so either way the
+	// settings return to their defaults.
+	AllowedClientPaths   []string `json:"allowedClientPaths"`
+	AllowedClientSigners []string `json:"allowedClientSigners"`
+
+	// AuditMaxSizeMB and AuditKeepFiles bound the audit log of state
+	// changes: it is rotated at AuditMaxSizeMB and that many rotated files
+	// are kept (see audit.Retention).
+	AuditMaxSizeMB int `json:"auditMaxSizeMb"`
+	AuditKeepFiles int `json:"auditKeepFiles"`
+
+	// UpstreamProxy is the HTTP or SOCKS5 proxy connects reach the server
+	// through, for networks that allow no direct connections; nil
+	// connects directly.
+	UpstreamProxy *UpstreamProxy `json:"upstreamProxy"`
+
+	// Simulation connects links whose user ID is vpn.SimulationUUID to a
+	// simulated server instead (see vpn.SimulationFor), for developing
+	// and testing the app without a server or network access.
+	Simulation bool `json:"simulation"`
+
+	// DNSQueryLog indexes which domains each app reaches during a session,
+	// for apps.domainActivity. It is off by default, since it records
+	// browsing, and the index stays in memory (see
+	// vpn.Engine.SetDNSQueryLog).
+	DNSQueryLog bool `json:"dnsQueryLog"`
+
+	// LaunchUIOnLogon starts UIPath in the user's session when someone logs
+	// on at the console while a session is connected or a connect is
+	// pending, so the tray UI shows a tunnel auto-connect brought up. The
+	// UI must be the one installed beside the service or pass the client
+	// allow-list; it runs as the user. Both take the admin lock to change.
+	LaunchUIOnLogon bool   `json:"launchUiOnLogon"`
+	UIPath          string `json:"uiPath"` // full path of the UI executable
+
+	// AdminLocked is set while an admin token locks the server policy (see
+	// Store.SetAdminLock). It is read-only; patches cannot change it.
+	AdminLocked bool `json:"adminLocked"`
+}
+
+// UpstreamProxy is the upstream proxy setting. The password is
+// write-only: a patch sets it, the settings file keeps it encrypted for
+// the service account (see datafile.AccountSealer), and reads only report
+// PasswordSet. A patch without a password keeps the stored one as long as
+// the proxy has a username.
+type UpstreamProxy struct {
+	Type     string  `json:"type" jsonschema:"enum=http|socks5"`
+	Host     string  `json:"host"`
+	Port     int     `json:"port"`
+	Username string  `json:"username,omitempty"`
+	Password *string `json:"password,omitempty"`
+	// PasswordSet is read-only; patches cannot change it.
+	PasswordSet bool `json:"passwordSet"`
+}
+
+// Config returns the proxy with password for connects.
+func (p *UpstreamProxy) Config(password string) *vpn.UpstreamProxy {
+	return &vpn.UpstreamProxy{Type: p.Type, Host: p.Host, Port: p.Port, Username: p.Username, Password: password}
+}
+
+// Defaults returns the settings used when nothing has been saved.
+func Defaults() Settings {
+	return Settings{
+		HealthMonitor:             false,
+		HealthIntervalMinutes:     60,
+		PowerMode:                 "normal",
+		DegradedAfterProbes:       3,
+		DegradedRTTMs:             1500,
+		RecoverAfterProbes:        2,
+		PersistCache:              true,
+		CaptivePortalGraceMinutes: 5,
+		SystemProxyBypass:         []string{},
+		BuiltinBypasses:           []string{},
+		ServerGroupRules:          append([]parser.GroupRule(nil), parser.DefaultGroupRules...),
+		Schedules:                 []scheduler.Entry{},
+		DesktopNotifications:      desktopnotify.DefaultSettings(),
+		AllowedServerPorts:        []string{},
+		AllowedClientPaths:        []string{},
+		AllowedClientSigners:      []string{},
+		AuditMaxSizeMB:            audit.DefaultRetention.MaxSizeMB,
+		AuditKeepFiles:            audit.DefaultRetention.Keep,
+	}
+}
+
+// Validate checks every field is within its allowed range.
+func (s *Settings) Validate() error {
+	for _, list := range []struct {
+		name string
+		len  int
+	}{
+		{"systemProxyBypass", len(s.SystemProxyBypass)},
+		{"builtinBypasses", len(s.BuiltinBypasses)},
+		{"serverGroupRules", len(s.ServerGroupRules)},
+		{"schedules", len(s.Schedules)},
+		{"allowedServerPorts", len(s.AllowedServerPorts)},
+		{"allowedClientPaths", len(s.AllowedClientPaths)},
+		{"allowedClientSigners", len(s.AllowedClientSigners)},
+	} {
+		if list.len > maxListEntries {
+			return fmt.Errorf("%s must have at most %d entries", list.name, maxListEntries)
+		}
+	}
+	if s.HealthIntervalMinutes < 5 || s.HealthIntervalMinutes > 24*60 {
+		return fmt.Errorf("healthIntervalMinutes must be between 5 and 1440")
+	}
+	if s.PowerMode != "normal" && s.PowerMode != "low" {
+		return fmt.Errorf("powerMode must be normal or low")
+	}
+	if s.DegradedAfterProbes < 1 || s.DegradedAfterProbes > 20 {
+		return fmt.Errorf("degradedAfterProbes must be between 1 and 20")
+	}
+	if s.DegradedRTTMs < 100 || s.DegradedRTTMs > 10000 {
+		return fmt.Errorf("degradedRttMs must be between 100 and 10000")
+	}
+	if s.RecoverAfterProbes < 1 || s.RecoverAfterProbes > 20 {
+		return fmt.Errorf("recoverAfterProbes must be between 1 and 20")
+	}
+	if s.CaptivePortalGraceMinutes < 1 || s.CaptivePortalGraceMinutes > 60 {
+		return fmt.Errorf("captivePortalGraceMinutes must be between 1 and 60")
+	}
+	if err := sysproxy.Validate(s.SystemProxyBypass); err != nil {
+		return fmt.Errorf("systemProxyBypass: %w", err)
+	}
+	if err := splittunnel.ValidateBypasses(s.BuiltinBypasses); err != nil {
+		return fmt.Errorf("builtinBypasses: %w", err)
+	}
+	if err := parser.ValidateGroupRules(s.ServerGroupRules); err != nil {
+		return fmt.Errorf("serverGroupRules: %w", err)
+	}
+	if err := scheduler.Validate(s.Schedules); err != nil {
+		return fmt.Errorf("schedules: %w", err)
+	}
+	if err := desktopnotify.Validate(s.DesktopNotifications); err != nil {
+		return fmt.Errorf("desktopNotifications: %w", err)
+	}
+	if err := s.RateLimit().Validate(); err != nil {
+		return err
+	}
+	ceiling := vpn.CeilingConfigLimits
+	for _, limit := range []struct {
+		name       string
+		value, max int
+	}{
+		{"maxConfigRules", s.MaxConfigRules, ceiling.MaxRules},
+		{"maxConfigDomains", s.MaxConfigDomains, ceiling.MaxDomainEntries},
+		{"maxConfigOutbounds", s.MaxConfigOutbounds, ceiling.MaxOutbounds},
+		{"maxConfigKb", s.MaxConfigKB, ceiling.MaxJSONBytes >> 10},
+	} {
+		if limit.value < 0 || limit.value > limit.max {
+			return fmt.Errorf("%s must be between 0 (default) and %d", limit.name, limit.max)
+		}
+	}
+	if err := s.AuditRetention().Validate(); err != nil {
+		return err
+	}
+	for _, entry := range s.AllowedServerPorts {
+		if _, _, err := parsePortRange(entry); err != nil {
+			return fmt.Errorf("allowedServerPorts: %w", err)
+		}
+	}
+	for _, path := range s.AllowedClientPaths {
+		if !isAbsWindowsPath(path) {
+			return fmt.Errorf("allowedClientPaths: %q is not a full path", path)
+		}
+	}
+	if s.UIPath != "" && !isAbsWindowsPath(s.UIPath) {
+		return fmt.Errorf("uiPath: %q is not a full path", s.UIPath)
+	}
+	for _, thumbprint := range s.AllowedClientSigners {
+		if b, err := hex.DecodeString(thumbprint); err != nil || len(b) != sha1.Size {
+			return fmt.Errorf("allowedClientSigners: %q is not a SHA-1 certificate thumbprint", thumbprint)
+		}
+	}
+	if s.UpstreamProxy != nil {
+		if err := s.UpstreamProxy.Config("").Validate(); err != nil {
+			return fmt.Errorf("upstreamProxy: %w", err)
+		}
+	}
+	return nil
+}
+
+// RateLimit returns the default rate limit of connects.
+func (s Settings) RateLimit() vpn.RateLimit {
+	return vpn.RateLimit{MaxDownMbps: s.MaxDownMbps, MaxUpMbps: s.MaxUpMbps}
+}
+
+// ConfigLimits returns the complexity limits of generated configs.
+func (s Settings) ConfigLimits() vpn.ConfigLimits {
+	return vpn.ConfigLimits{
+		MaxRules:         s.MaxConfigRules,
+		MaxDomainEntries: s.MaxConfigDomains,
+		MaxOutbounds:     s.MaxConfigOutbounds,
+		MaxJSONBytes:     s.MaxConfigKB << 10,
+	}
+}
+
+// AuditRetention returns how much audit log history to keep.
+func (s Settings) AuditRetention() audit.Retention {
+	return audit.Retention{MaxSizeMB: s.AuditMaxSizeMB, Keep: s.AuditKeepFiles}
+}
+
+// ServerPortAllowed reports whether AllowedServerPorts lets servers on port
+// be used.
+func (s *Settings) ServerPortAllowed(port uint16) bool {
+	if len(s.AllowedServerPorts) == 0 {
+		return true
+	}
+	for _, entry := range s.AllowedServerPorts {
+		if lo, hi, err := parsePortRange(entry); err == nil && port >= lo && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAllowListed reports whether AllowedClientPaths or
+// AllowedClientSigners restrict the IPC clients.
+func (s *Settings) ClientAllowListed() bool {
+	return len(s.AllowedClientPaths) > 0 || len(s.AllowedClientSigners) > 0
+}
+
+// ClientPathAllowed reports whether AllowedClientPaths lists image.
+func (s *Settings) ClientPathAllowed(image string) bool {
+	for _, path := range s.AllowedClientPaths {
+		if strings.EqualFold(path, image) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientSignerAllowed reports whether AllowedClientSigners lists the
+// certificate thumbprint.
+func (s *Settings) ClientSignerAllowed(thumbprint string) bool {
+	for _, allowed := range s.AllowedClientSigners {
+		if strings.EqualFold(allowed, thumbprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAbsWindowsPath reports whether path is a full Windows path, such as
+// C:\Program Files\app.exe or \\server\share\app.exe.
+func isAbsWindowsPath(path string) bool {
+	if strings.HasPrefix(path, `\\`) {
+		return len(path) > 2
+	}
+	return len(path) > 3 && path[1] == ':' && path[2] == '\\' &&
+		('a' <= path[0]|0x20 && path[0]|0x20 <= 'z')
+}
+
+// parsePortRange parses "443" or "8000-8999".
+func parsePortRange(entry string) (lo, hi uint16, err error) {
+	first, last, isRange := strings.Cut(entry, "-")
+	if !isRange {
+		last = first
+	}
+	a, errA := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	b, errB := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+	if errA != nil || errB != nil || a == 0 || b < a {
+		return 0, 0, fmt.Errorf("%q is not a port or port range", entry)
+	}
+	return uint16(a), uint16(b), nil
+}
+
+// Errors of Store.Set and Store.SetAdminLock.
+var (
+	ErrAdminLocked       = errors.New("locked by an administrator; the admin token is required")
+	ErrAdminToken        = errors.New("wrong admin token")
+	ErrAdminLockRequired = errors.New("the client allow-list and UI launch require an admin lock")
+	ErrTokenTooWeak      = fmt.Errorf("admin token must be at least %d characters", minAdminTokenLength)
+)
+
+const minAdminTokenLength = 12
+
+// clone returns a copy of s that shares no pointers or arrays with it,
+// so that decoding into the copy leaves s as it was.
+func (s Settings) clone() Settings {
+	if s.EventLogEnabled != nil {
+		enabled := *s.EventLogEnabled
+		s.EventLogEnabled = &enabled
+	}
+	if s.UpstreamProxy != nil {
+		proxy := *s.UpstreamProxy
+		s.UpstreamProxy = &proxy
+	}
+	s.SystemProxyBypass = slices.Clone(s.SystemProxyBypass)
+	s.BuiltinBypasses = slices.Clone(s.BuiltinBypasses)
+	s.ServerGroupRules = slices.Clone(s.ServerGroupRules)
+	s.Schedules = slices.Clone(s.Schedules)
+	s.AllowedServerPorts = slices.Clone(s.AllowedServerPorts)
+	s.AllowedClientPaths = slices.Clone(s.AllowedClientPaths)
+	s.AllowedClientSigners = slices.Clone(s.AllowedClientSigners)
+	return s
+}
+
+// Store holds the current settings and persists changes to disk.
+type Store struct {
+	mu      sync.RWMutex
+	path    string
+	guard   *datafile.Guard
+	current Settings
+	// lockHash is the salted hash of the admin token, "salt:hash" in hex,
+	// or empty while unlocked.
+	lockHash string
+	// proxyPassword is the upstream proxy's password, in the clear.
+	proxyPassword string
+	// loadIssues is what Open found wrong with the file.
+	loadIssues []datafile.Issue
+}
+
+// stored is the settings file: the settings plus the admin lock, which
+// patches cannot reach, and the upstream proxy password, encrypted with
+// datafile.AccountSealer and base64 encoded.
+type stored struct {
+	Settings
+	AdminLockHash         string `json:"adminLockHash,omitempty"`
+	UpstreamProxyPassword string `json:"upstreamProxyPassword,omitempty"`
+}
+
+// Open loads settings from path, checking the file with guard unless it
+// is nil. It never fails: a missing file yields defaults, one that cannot
+// be read or fails the guard is quarantined and yields defaults, and a
+// field out of its bounds keeps its default. LoadIssues reports what was
+// found.
+func Open(path string, guard *datafile.Guard) *Store {
+	s := &Store{path: path, guard: guard, current: Defaults()}
+	var loaded stored
+	var fieldIssues []datafile.Issue
+	found, issues := datafile.Load(path, maxFileBytes, guard, func(data []byte) error {
+		var err error
+		loaded, fieldIssues, err = decodeStored(path, data)
+		return err
+	})
+	s.loadIssues = append(fieldIssues, issues...)
+	if !found {
+		return s
+	}
+	s.current = loaded.Settings
+	s.lockHash = loaded.AdminLockHash
+	s.current.AdminLocked = s.lockHash != ""
+	if p := s.current.UpstreamProxy; p != nil {
+		// A password that no longer decrypts, as after a move to another
+		// machine or account, is dropped: the proxy then reports no
+		// password set and the user enters it again.
+		p.Password = nil
+		s.proxyPassword = ""
+		if sealed, err := base64.StdEncoding.DecodeString(loaded.UpstreamProxyPassword); err == nil && len(sealed) > 0 {
+			if plain, err := datafile.AccountSealer.Unseal(sealed); err == nil {
+				s.proxyPassword = string(plain)
+			}
+		}
+		p.PasswordSet = s.proxyPassword != ""
+	}
+	return s
+}
+
+// decodeStored decodes a settings file over the defaults and validates
+// the result once. If that fails, it falls back field by field: a field
+// that does not decode or fails Validate on its own keeps its default and
+// is reported, and the others are applied together. Only a file that is
+// not a JSON object fails.
+func decodeStored(path string, data []byte) (stored, []datafile.Issue, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return stored{}, nil, fmt.Errorf("failed to parse settings: %w", err)
+	}
+	loaded := stored{Settings: Defaults()}
+	if err := json.Unmarshal(data, &loaded); err == nil && loaded.Validate() == nil {
+		return loaded, nil, nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var issues []datafile.Issue
+	good := make(map[string]json.RawMessage, len(fields))
+	for _, key := range keys {
+		field, _ := json.Marshal(map[string]json.RawMessage{key: fields[key]})
+		alone := stored{Settings: Defaults()}
+		if err := json.Unmarshal(field, &alone); err != nil {
+			issues = append(issues, datafile.InvalidField(path, key, err))
+			continue
+		}
+		if err := alone.Validate(); err != nil {
+			issues = append(issues, datafile.InvalidField(path, key, err))
+			continue
+		}
+		good[key] = fields[key]
+	}
+	merged, _ := json.Marshal(good)
+	loaded = stored{Settings: Defaults()}
+	if err := json.Unmarshal(merged, &loaded); err == nil && loaded.Validate() == nil {
+		return loaded, issues, nil
+	}
+
+	// Fields valid on their own but not together: apply them in order,
+	// keeping each that leaves the whole valid.
+	loaded = stored{Settings: Defaults()}
+	for _, key := range keys {
+		if _, ok := good[key]; !ok {
+			continue
+		}
+		field, _ := json.Marshal(map[string]json.RawMessage{key: good[key]})
+		next := loaded
+		next.Settings = loaded.Settings.clone()
+		if err := json.Unmarshal(field, &next); err != nil {
+			issues = append(issues, datafile.InvalidField(path, key, err))
+			continue
+		}
+		if err := next.Validate(); err != nil {
+			issues = append(issues, datafile.InvalidField(path, key, err))
+			continue
+		}
+		loaded = next
+	}
+	return loaded, issues, nil
+}
+
+// LoadIssues returns what Open found wrong with the settings file.
+func (s *Store) LoadIssues() []datafile.Issue {
+	return slices.Clone(s.loadIssues)
+}
+
+// UpstreamProxy returns the upstream proxy with its password, or nil if
+// connects go direct.
+func (s *Store) UpstreamProxy() *vpn.UpstreamProxy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current.UpstreamProxy == nil {
+		return nil
+	}
+	return s.current.UpstreamProxy.Config(s.proxyPassword)
+}
+
+// Get returns a copy of the current settings.
+func (s *Store) Get() Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// Set merges a partial JSON object into the current settings, validates
+// the result, and persists it. Fields absent from patch are unchanged.
+// While admin locked, changing AllowedServerPorts needs token to be the
+// admin token, and fails with ErrAdminLocked otherwise. Changing
+// AllowedClientPaths, AllowedClientSigners, LaunchUIOnLogon or UIPath
+// always needs the token, and fails with ErrAdminLockRequired while
+// unlocked, except to clear them.
+func (s *Store) Set(patch json.RawMessage, token string) (Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Unmarshal would write through the pointers and into the arrays
+	// shared with current; a refused patch must leave it as it was.
+	next := s.current.clone()
+	if err := json.Unmarshal(patch, &next); err != nil {
+		return s.current, fmt.Errorf("invalid settings: %w", err)
+	}
+	next.AdminLocked = s.current.AdminLocked
+	password := ""
+	if p := next.UpstreamProxy; p != nil {
+		switch {
+		case p.Password != nil:
+			password = *p.Password
+		case p.Username != "":
+			password = s.proxyPassword
+		}
+		p.Password = nil
+		p.PasswordSet = password != ""
+	}
+	if err := next.Validate(); err != nil {
+		return s.current, err
+	}
+	if next.UpstreamProxy != nil {
+		if err := next.UpstreamProxy.Config(password).Validate(); err != nil {
+			return s.current, fmt.Errorf("upstreamProxy: %w", err)
+		}
+	}
+	if s.lockHash != "" && !reflect.DeepEqual(next.AllowedServerPorts, s.current.AllowedServerPorts) && !tokenMatches(s.lockHash, token) {
+		return s.current, ErrAdminLocked
+	}
+	if !reflect.DeepEqual(next.AllowedClientPaths, s.current.AllowedClientPaths) ||
+		!reflect.DeepEqual(next.AllowedClientSigners, s.current.AllowedClientSigners) {
+		switch {
+		case s.lockHash == "" && next.ClientAllowListed():
+			return s.current, ErrAdminLockRequired
+		case s.lockHash != "" && !tokenMatches(s.lockHash, token):
+			return s.current, ErrAdminLocked
+		}
+	}
+	// The service starts UIPath as whoever logs on, so it takes the same
+	// lock as the allow-list.
+	if next.LaunchUIOnLogon != s.current.LaunchUIOnLogon || next.UIPath != s.current.UIPath {
+		switch {
+		case s.lockHash == "" && (next.LaunchUIOnLogon || next.UIPath != ""):
+			return s.current, ErrAdminLockRequired
+		case s.lockHash != "" && !tokenMatches(s.lockHash, token):
+			return s.current, ErrAdminLocked
+		}
+	}
+
+	if err := s.save(next, s.lockHash, password); err != nil {
+		return s.current, err
+	}
+	s.current = next
+	s.proxyPassword = password
+	return next, nil
+}
+
+// SetAdminLock locks the server policy with token, or unlocks it. Locking
+// an unlocked store takes any token of minAdminTokenLength or more;
+// relocking with a new token and unlocking take the current token.
+func (s *Store) SetAdminLock(token string, locked bool) (Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lockHash != "" && !tokenMatches(s.lockHash, token) {
+		return s.current, ErrAdminToken
+	}
+	hash := ""
+	if locked {
+		if len(token) < minAdminTokenLength {
+			return s.current, ErrTokenTooWeak
+		}
+		var err error
+		if hash, err = hashToken(token); err != nil {
+			return s.current, err
+		}
+	}
+	next := s.current
+	next.AdminLocked = locked
+	if err := s.save(next, hash, s.proxyPassword); err != nil {
+		return s.current, err
+	}
+	s.current = next
+	s.lockHash = hash
+	return next, nil
+}
+
+func (s *Store) save(next Settings, lockHash, proxyPassword string) error {
+	file := stored{Settings: next, AdminLockHash: lockHash}
+	if proxyPassword != "" {
+		sealed, err := datafile.AccountSealer.Seal([]byte(proxyPassword))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt the upstream proxy password: %w", err)
+		}
+		file.UpstreamProxyPassword = base64.StdEncoding.EncodeToString(sealed)
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.guard.WriteFile(s.path, data); err != nil {
+		return fmt.Errorf("failed to save settings: %w", err)
+	}
+	return nil
+}
+
+// hashToken returns "salt:hash" of token, in hex.
+func hashToken(token string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append(salt, token...))
+	return hex.EncodeToString(salt) + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// tokenMatches reports whether token hashes to lockHash.
+func tokenMatches(lockHash, token string) bool {
+	saltHex, hashHex, ok := strings.Cut(lockHash, ":")
+	salt, errSalt := hex.DecodeString(saltHex)
+	want, errHash := hex.DecodeString(hashHex)
+	if !ok || errSalt != nil || errHash != nil {
+		return false
+	}
+	sum := sha256.Sum256(append(salt, token...))
+	return subtle.ConstantTimeCompare(sum[:], want) == 1
+}
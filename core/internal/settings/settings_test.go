@@ -0,0 +1,41 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/datafile"
+)
+
+func TestOpenResetsInvalidFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	os.WriteFile(path, []byte(`{"healthIntervalMinutes": 1, "powerMode": "low", "maxDownMbps": 50}`), 0o644)
+
+	s := Open(path, nil)
+	got := s.Get()
+	if got.HealthIntervalMinutes != Defaults().HealthIntervalMinutes || got.PowerMode != "low" || got.MaxDownMbps != 50 {
+		t.Errorf("settings = %+v", got)
+	}
+	issues := s.LoadIssues()
+	if len(issues) != 1 || issues[0].Kind != datafile.IssueInvalidField {
+		t.Errorf("issues = %+v", issues)
+	}
+}
+
+func TestUpstreamProxyPasswordSealed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	s := Open(path, nil)
+	patch := `{"upstreamProxy": {"type": "socks5", "host": "proxy.example.com", "port": 1080, "username": "u", "password": "p4ss"}}`
+	if _, err := s.Set([]byte(patch), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get().UpstreamProxy; got == nil || got.Password != nil || !got.PasswordSet {
+		t.Fatalf("read back = %+v", got)
+	}
+
+	// The password survives a restart; only the store hands it out.
+	if p := Open(path, nil).UpstreamProxy(); p == nil || p.Password != "p4ss" {
+		t.Errorf("after reopening: %+v", p)
+	}
+}
@@ -0,0 +1,152 @@
+package splittunnel
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// apps.listDiff lets the UI keep the app list it cached and fetch only
+// what changed. Every listing is compared with the previous one; a list
+// that differs gets the next version. An app is identified by its key, a
+// hash of its install path, exe name and display name, and a keyed app
+// whose other fields differ is changed. The per-entry hashes of the last
+// maxAppSnapshots versions are kept to diff against; a client at an older
+// or unknown version gets the full list.
+
+// maxAppSnapshots is how many versions of a list apps.listDiff can diff
+// against.
+const maxAppSnapshots = 8
+
+// KeyedApp is an app with the key apps.listDiff identifies it by.
+type KeyedApp struct {
+	Key string `json:"key"`
+	AppInfo
+}
+
+// AppListDiff is the result of apps.listDiff. When Full is set, Apps is
+// the whole list and replaces the client's; otherwise Added, Removed (by
+// key) and Changed turn the client's version into Version.
+type AppListDiff struct {
+	Version uint64     `json:"version"`
+	Full    bool       `json:"full"`
+	Apps    []KeyedApp `json:"apps,omitempty"`
+	Added   []KeyedApp `json:"added"`
+	Removed []string   `json:"removed"`
+	Changed []KeyedApp `json:"changed"`
+}
+
+// appSnapshot is one version of a list: the content hash of each app by
+// key.
+type appSnapshot struct {
+	version uint64
+	hashes  map[string]uint64
+}
+
+// appList is the versions of the list at one icon size.
+type appList struct {
+	snapshots []appSnapshot // oldest first; the last is current
+}
+
+// AppCatalog versions the app lists served by apps.listDiff. Lists with
+// different icon sizes are versioned apart, from one counter, so a version
+// of one is never mistaken for a version of another.
+type AppCatalog struct {
+	mu      sync.Mutex
+	version uint64
+	lists   map[int]*appList // by icon size; 0 for no icons
+}
+
+// NewAppCatalog returns an empty catalog.
+func NewAppCatalog() *AppCatalog {
+	return &AppCatalog{lists: make(map[int]*appList)}
+}
+
+// AppKey identifies app across listings.
+func AppKey(app AppInfo) string {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(app.InstallPath) + "\x00" + strings.ToLower(app.ExeName) + "\x00" + app.Name))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+func appHash(app AppInfo) uint64 {
+	data, _ := json.Marshal(app)
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// Diff records apps as the current list at iconSize and returns what
+// changed since version since.
+func (c *AppCatalog) Diff(iconSize int, apps []AppInfo, since uint64) AppListDiff {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := c.lists[iconSize]
+	if list == nil {
+		list = &appList{}
+		c.lists[iconSize] = list
+	}
+	keyed := make([]KeyedApp, 0, len(apps))
+	hashes := make(map[string]uint64, len(apps))
+	for _, app := range apps {
+		key := AppKey(app)
+		if _, dup := hashes[key]; dup {
+			continue
+		}
+		keyed = append(keyed, KeyedApp{Key: key, AppInfo: app})
+		hashes[key] = appHash(app)
+	}
+	if n := len(list.snapshots); n == 0 || !sameHashes(list.snapshots[n-1].hashes, hashes) {
+		c.version++
+		list.snapshots = append(list.snapshots, appSnapshot{version: c.version, hashes: hashes})
+		if over := len(list.snapshots) - maxAppSnapshots; over > 0 {
+			list.snapshots = list.snapshots[over:]
+		}
+	}
+	latest := list.snapshots[len(list.snapshots)-1]
+
+	diff := AppListDiff{Version: latest.version, Added: []KeyedApp{}, Removed: []string{}, Changed: []KeyedApp{}}
+	var base *appSnapshot
+	for i := range list.snapshots {
+		if list.snapshots[i].version == since {
+			base = &list.snapshots[i]
+		}
+	}
+	if base == nil {
+		diff.Full = true
+		diff.Apps = keyed
+		return diff
+	}
+	for _, app := range keyed {
+		old, ok := base.hashes[app.Key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, app)
+		case old != hashes[app.Key]:
+			diff.Changed = append(diff.Changed, app)
+		}
+	}
+	for key := range base.hashes {
+		if _, ok := hashes[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+	slices.Sort(diff.Removed)
+	return diff
+}
+
+func sameHashes(a, b map[string]uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, h := range a {
+		if other, ok := b[key]; !ok || other != h {
+			return false
+		}
+	}
+	return true
+}
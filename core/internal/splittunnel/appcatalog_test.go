@@ -0,0 +1,113 @@
+package splittunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func catalogApps(n int) []AppInfo {
+	apps := make([]AppInfo, n)
+	for i := range apps {
+		apps[i] = AppInfo{
+			Name:        fmt.Sprintf("App %d", i),
+			ExeName:     fmt.Sprintf("app%d.exe", i),
+			InstallPath: fmt.Sprintf(`C:\Program Files\App%d`, i),
+			Icon:        strings.Repeat("A", 2000),
+		}
+	}
+	return apps
+}
+
+func TestAppCatalogDiff(t *testing.T) {
+	c := NewAppCatalog()
+	apps := catalogApps(200)
+
+	first := c.Diff(IconSizeSmall, apps, 0)
+	if !first.Full || len(first.Apps) != 200 || first.Version == 0 {
+		t.Fatalf("first listing: full %v, %d apps, version %d", first.Full, len(first.Apps), first.Version)
+	}
+
+	// A reopen with nothing changed keeps the version and sends almost
+	// nothing.
+	same := c.Diff(IconSizeSmall, apps, first.Version)
+	data, err := json.Marshal(same)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.Full || same.Version != first.Version || len(data) >= 1024 {
+		t.Errorf("unchanged reopen: %s (%d bytes)", data, len(data))
+	}
+
+	// An install, an uninstall and an icon update.
+	next := append([]AppInfo{}, apps[1:]...)
+	next[0].Icon = "updated"
+	next = append(next, AppInfo{Name: "New", ExeName: "new.exe", InstallPath: `C:\New`})
+	diff := c.Diff(IconSizeSmall, next, first.Version)
+	if diff.Full || diff.Version <= first.Version {
+		t.Fatalf("diff: full %v, version %d", diff.Full, diff.Version)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].ExeName != "new.exe" || diff.Added[0].Key != AppKey(next[len(next)-1]) {
+		t.Errorf("added = %+v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0] != AppKey(apps[0]) {
+		t.Errorf("removed = %v", diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].ExeName != "app1.exe" || diff.Changed[0].Icon != "updated" {
+		t.Errorf("changed = %+v", diff.Changed)
+	}
+
+	// The JSON of a keyed app is the app with its key.
+	var fields map[string]interface{}
+	data, _ = json.Marshal(diff.Added[0])
+	json.Unmarshal(data, &fields)
+	if fields["key"] == nil || fields["exeName"] != "new.exe" {
+		t.Errorf("keyed app JSON = %s", data)
+	}
+
+	// A client still at the first version gets the same diff later on.
+	if again := c.Diff(IconSizeSmall, next, first.Version); again.Version != diff.Version || len(again.Added)+len(again.Removed)+len(again.Changed) != 3 {
+		t.Errorf("repeated diff = %+v", again)
+	}
+}
+
+func TestAppCatalogFallsBackToFullList(t *testing.T) {
+	c := NewAppCatalog()
+	apps := catalogApps(3)
+	first := c.Diff(0, apps, 0)
+
+	// Unknown versions, including one of another icon size, get the full
+	// list.
+	other := c.Diff(IconSizeLarge, apps, 0)
+	if other.Version == first.Version {
+		t.Fatal("icon sizes share a version")
+	}
+	for _, since := range []uint64{other.Version, first.Version + 100} {
+		if d := c.Diff(0, apps, since); !d.Full || len(d.Apps) != 3 {
+			t.Errorf("since %d: full %v, %d apps", since, d.Full, len(d.Apps))
+		}
+	}
+
+	// Versions past the retention are forgotten.
+	for i := 0; i < maxAppSnapshots; i++ {
+		apps[0].Name = fmt.Sprintf("App renamed %d", i)
+		c.Diff(0, apps, 0)
+	}
+	if d := c.Diff(0, apps, first.Version); !d.Full {
+		t.Errorf("a version %d listings old is still diffed against", maxAppSnapshots)
+	}
+}
+
+func TestAppKey(t *testing.T) {
+	a := AppInfo{Name: "Chrome", ExeName: "chrome.exe", InstallPath: `C:\Program Files\Google`}
+	b := a
+	b.ExeName, b.InstallPath, b.Icon = "CHROME.EXE", `c:\program files\google`, "icon"
+	if AppKey(a) != AppKey(b) {
+		t.Error("key depends on case or icon")
+	}
+	b.InstallPath = `D:\Portable`
+	if AppKey(a) == AppKey(b) {
+		t.Error("same exe at another path has the same key")
+	}
+}
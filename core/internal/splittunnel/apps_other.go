@@ -0,0 +1,35 @@
+//go:build !windows
+
+package splittunnel
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// The app listings read the Windows registry, Appx packages and process
+// table. The service only ships for Windows; builds elsewhere are for
+// development and tests, and list nothing.
+var errWindowsOnly = errors.New("app listings are only supported on Windows")
+
+// ListInstalledApps fails: see errWindowsOnly.
+func ListInstalledApps(ctx context.Context, iconSize int) ([]AppInfo, error) {
+	return nil, errWindowsOnly
+}
+
+// ListRunningApps fails: see errWindowsOnly.
+func ListRunningApps() ([]RunningApp, error) {
+	return nil, errWindowsOnly
+}
+
+// PowerShellAvailable reports false: there is no Windows PowerShell.
+func PowerShellAvailable() bool {
+	return false
+}
+
+// secureIconExportDir limits an export directory to its owner, the
+// nearest equivalent of iconExportSDDL.
+func secureIconExportDir(dir string) error {
+	return os.Chmod(dir, 0o700)
+}
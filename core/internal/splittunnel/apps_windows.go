@@ -0,0 +1,311 @@
+package splittunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// ListInstalledApps returns all installed Windows applications with icons
+// of iconSize pixels (IconSizeSmall or IconSizeLarge), or none if iconSize
+// is 0. Icon extraction reads every executable and dominates the run time,
+// so it is optional, and it stops with ctx's error once ctx is done.
+func ListInstalledApps(ctx context.Context, iconSize int) ([]AppInfo, error) {
+	var apps []AppInfo
+
+	// Get Win32 apps from registry
+	win32Apps, err := listWin32Apps()
+	if err != nil {
+		log.Printf("warning: failed to list Win32 apps: %v", err)
+	} else {
+		apps = append(apps, win32Apps...)
+	}
+
+	// Get UWP apps from the package repository
+	uwpApps, err := listUWPApps()
+	if err != nil {
+		log.Printf("warning: failed to list UWP apps: %v", err)
+	} else {
+		apps = append(apps, uwpApps...)
+	}
+
+	// Deduplicate by ExeName
+	seen := make(map[string]bool)
+	var unique []AppInfo
+	for _, app := range apps {
+		key := strings.ToLower(app.ExeName)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, app)
+	}
+
+	// Extract icons
+	if iconSize > 0 {
+		err := newIconPool().extract(ctx, unique, func(app AppInfo) string {
+			return guardIconExtract(activeIconDenylist.Load(), resolveExePath(app), func(path string) string {
+				return extractIconBase64(path, iconSize)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Sort alphabetically by name
+	sort.Slice(unique, func(i, j int) bool {
+		return strings.ToLower(unique[i].Name) < strings.ToLower(unique[j].Name)
+	})
+
+	return unique, nil
+}
+
+func listWin32Apps() ([]AppInfo, error) {
+	var apps []AppInfo
+
+	// Registry hives: system-wide (HKLM) and per-user (HKCU)
+	hives := []registry.Key{registry.LOCAL_MACHINE, registry.CURRENT_USER}
+	resolver := &appResolver{
+		localAppData:       os.Getenv("LOCALAPPDATA"),
+		msiInstallLocation: msiInstallLocation,
+	}
+
+	for _, root := range hives {
+		for _, e := range readUninstallEntries(winRegistry{root}) {
+			exeName, exeDir := resolver.resolve(e)
+			if exeName == "" {
+				continue
+			}
+			installLocation := e.InstallLocation
+			if exeDir != "" {
+				installLocation = exeDir
+			}
+
+			apps = append(apps, AppInfo{
+				Name:        e.DisplayName,
+				ExeName:     exeName,
+				InstallPath: installLocation,
+				IsUWP:       false,
+			})
+		}
+	}
+
+	return apps, nil
+}
+
+// winRegistry reads a hive of the Windows registry.
+type winRegistry struct {
+	root registry.Key
+}
+
+func (r winRegistry) subKeyNames(path string) ([]string, error) {
+	key, err := registry.OpenKey(r.root, path, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Close()
+	return key.ReadSubKeyNames(-1)
+}
+
+func (r winRegistry) stringValue(path, name string) string {
+	key, err := registry.OpenKey(r.root, path, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+	value, _, _ := key.GetStringValue(name)
+	return value
+}
+
+var (
+	modMsi                 = syscall.NewLazyDLL("msi.dll")
+	procMsiGetProductInfoW = modMsi.NewProc("MsiGetProductInfoW")
+)
+
+// msiInstallLocation returns the InstallLocation Windows Installer
+// recorded for productCode, or "" if there is none.
+func msiInstallLocation(productCode string) string {
+	if procMsiGetProductInfoW.Find() != nil {
+		return ""
+	}
+	product, err := syscall.UTF16PtrFromString(productCode)
+	if err != nil {
+		return ""
+	}
+	property, _ := syscall.UTF16PtrFromString("InstallLocation")
+	buf := make([]uint16, syscall.MAX_PATH)
+	for {
+		size := uint32(len(buf))
+		ret, _, _ := procMsiGetProductInfoW.Call(
+			uintptr(unsafe.Pointer(product)),
+			uintptr(unsafe.Pointer(property)),
+			uintptr(unsafe.Pointer(&buf[0])),
+			uintptr(unsafe.Pointer(&size)),
+		)
+		switch syscall.Errno(ret) {
+		case 0:
+			return syscall.UTF16ToString(buf[:size])
+		case syscall.ERROR_MORE_DATA:
+			buf = make([]uint16, size+1)
+		default:
+			return ""
+		}
+	}
+}
+
+// appxRepositoryPath is where each user's installed packages are recorded,
+// under the user's classes hive.
+const appxRepositoryPath = `Local Settings\Software\Microsoft\Windows\CurrentVersion\AppModel\Repository\Packages`
+
+// listUWPApps lists Store apps by reading the package repository directly.
+// PowerShell is only a fallback: on locked-down machines it is blocked or
+// constrained and would stall every apps.list until its timeout.
+func listUWPApps() ([]AppInfo, error) {
+	apps, err := listAppxPackages()
+	if err == nil && len(apps) > 0 {
+		return apps, nil
+	}
+	if !PowerShellAvailable() {
+		return apps, err
+	}
+	if err != nil {
+		log.Printf("warning: failed to read the package repository, falling back to PowerShell: %v", err)
+	}
+	return listUWPAppsPowerShell()
+}
+
+// listAppxPackages reads the package repository of every loaded user
+// profile (the service runs as SYSTEM) and the current user, and parses
+// the manifest of each Store package.
+func listAppxPackages() ([]AppInfo, error) {
+	type hive struct {
+		root registry.Key
+		path string
+	}
+	hives := []hive{{registry.CURRENT_USER, `Software\Classes\` + appxRepositoryPath}}
+	if users, err := registry.OpenKey(registry.USERS, "", registry.ENUMERATE_SUB_KEYS); err == nil {
+		names, _ := users.ReadSubKeyNames(-1)
+		users.Close()
+		for _, name := range names {
+			if strings.HasSuffix(name, "_Classes") {
+				hives = append(hives, hive{registry.USERS, name + `\` + appxRepositoryPath})
+			}
+		}
+	}
+
+	var apps []AppInfo
+	found := false
+	seen := make(map[string]bool) // package roots shared by several users
+	for _, h := range hives {
+		key, err := registry.OpenKey(h.root, h.path, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			continue
+		}
+		packages, err := key.ReadSubKeyNames(-1)
+		key.Close()
+		if err != nil {
+			continue
+		}
+		found = true
+
+		for _, pkg := range packages {
+			pkgKey, err := registry.OpenKey(h.root, h.path+`\`+pkg, registry.QUERY_VALUE)
+			if err != nil {
+				continue
+			}
+			root, _, _ := pkgKey.GetStringValue("PackageRootFolder")
+			pkgKey.Close()
+			if root == "" || !isStorePackageRoot(root) || seen[strings.ToLower(root)] {
+				continue
+			}
+			seen[strings.ToLower(root)] = true
+
+			data, err := os.ReadFile(filepath.Join(root, "AppxManifest.xml"))
+			if err != nil {
+				continue
+			}
+			pkgApps, err := parseAppxManifest(data)
+			if err != nil {
+				log.Printf("warning: unreadable manifest for %s: %v", pkg, err)
+				continue
+			}
+			apps = append(apps, pkgApps...)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no package repository found")
+	}
+	return apps, nil
+}
+
+var (
+	powershellOnce sync.Once
+	powershellOK   bool
+)
+
+// PowerShellAvailable reports whether PowerShell runs in full language
+// mode. The probe runs once per service start with a short timeout.
+func PowerShellAvailable() bool {
+	powershellOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			`$ExecutionContext.SessionState.LanguageMode`).Output()
+		powershellOK = err == nil && strings.TrimSpace(string(out)) == "FullLanguage"
+		if !powershellOK {
+			log.Printf("PowerShell unavailable or constrained (%v); UWP apps come from the package repository only", err)
+		}
+	})
+	return powershellOK
+}
+
+func listUWPAppsPowerShell() ([]AppInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "powershell", "-NoProfile", "-Command",
+		`Get-AppxPackage | Where-Object {$_.IsFramework -eq $false -and $_.SignatureKind -eq 'Store'} | ForEach-Object { $manifest = Get-AppxPackageManifest $_; $app = $manifest.Package.Applications.Application; if ($app) { $name = $_.Name; $exe = if ($app.Executable) { $app.Executable } else { 'N/A' }; "$name|$exe" } }`)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("powershell Get-AppxPackage failed: %w", err)
+	}
+
+	var apps []AppInfo
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "|", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := parts[0]
+		exeName := filepath.Base(parts[1])
+		if exeName == "" || exeName == "N/A" {
+			continue
+		}
+
+		apps = append(apps, AppInfo{
+			Name:    name,
+			ExeName: exeName,
+			IsUWP:   true,
+		})
+	}
+
+	return apps, nil
+}
@@ -1,13 +1,14 @@
 package splittunnel
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"testing"
 )
 
 func TestListInstalledApps(t *testing.T) {
-	apps, err := ListInstalledApps()
+	apps, err := ListInstalledApps(context.Background(), IconSizeSmall)
 	if err != nil {
 		t.Fatalf("ListInstalledApps failed: %v", err)
 	}
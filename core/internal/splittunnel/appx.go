@@ -0,0 +1,68 @@
+package splittunnel
+
+import (
+	"encoding/xml"
+	"path"
+	"strings"
+)
+
+// appxManifest is the subset of AppxManifest.xml used to list a package's
+// apps. Element names are matched without namespace, so every manifest
+// schema version parses the same way.
+type appxManifest struct {
+	Identity struct {
+		Name string `xml:"Name,attr"`
+	} `xml:"Identity"`
+	Properties struct {
+		DisplayName     string `xml:"DisplayName"`
+		Framework       bool   `xml:"Framework"`
+		ResourcePackage bool   `xml:"ResourcePackage"`
+	} `xml:"Properties"`
+	Applications struct {
+		Application []struct {
+			Executable string `xml:"Executable,attr"`
+		} `xml:"Application"`
+	} `xml:"Applications"`
+}
+
+// parseAppxManifest returns the apps a package manifest declares.
+// Framework and resource packages have none. InstallPath stays empty: the
+// package folder is versioned, and a recorded path would make every Store
+// update look like a replaced app to FindStaleApps.
+func parseAppxManifest(data []byte) ([]AppInfo, error) {
+	var m appxManifest
+	if err := xml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Properties.Framework || m.Properties.ResourcePackage {
+		return nil, nil
+	}
+
+	// Store apps usually localize the display name through a resource
+	// reference only the package can resolve.
+	name := strings.TrimSpace(m.Properties.DisplayName)
+	if name == "" || strings.HasPrefix(name, "ms-resource:") {
+		name = m.Identity.Name
+	}
+
+	var apps []AppInfo
+	for _, app := range m.Applications.Application {
+		// Executables are package-relative with either separator.
+		exe := path.Base(strings.ReplaceAll(app.Executable, `\`, "/"))
+		if app.Executable == "" || !strings.HasSuffix(strings.ToLower(exe), ".exe") {
+			continue // e.g. JavaScript apps hosted by wwahost
+		}
+		apps = append(apps, AppInfo{
+			Name:    name,
+			ExeName: exe,
+			IsUWP:   true,
+		})
+	}
+	return apps, nil
+}
+
+// isStorePackageRoot reports whether a package is installed from the Store
+// (under WindowsApps), as opposed to system apps and sideloaded packages.
+func isStorePackageRoot(root string) bool {
+	return strings.Contains(strings.ToLower(root), `\windowsapps\`)
+}
@@ -0,0 +1,100 @@
+package splittunnel
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Trimmed from real AppxManifest.xml files.
+const (
+	spotifyManifest = `<?xml version="1.0" encoding="utf-8"?>
+<Package xmlns="http://schemas.microsoft.com/appx/manifest/foundation/windows10" xmlns:uap="http://schemas.microsoft.com/appx/manifest/uap/windows10" IgnorableNamespaces="uap">
+  <Identity Name="SpotifyAB.SpotifyMusic" Publisher="CN=453637B3-4E12-4CDF-B0D3-2A3C863BF6EF" Version="1.226.1033.0" ProcessorArchitecture="x86" />
+  <Properties>
+    <DisplayName>Spotify Music</DisplayName>
+    <PublisherDisplayName>Spotify AB</PublisherDisplayName>
+  </Properties>
+  <Applications>
+    <Application Id="Spotify" Executable="SpotifyMigrator.exe" EntryPoint="Windows.FullTrustApplication">
+      <uap:VisualElements DisplayName="Spotify" />
+    </Application>
+  </Applications>
+</Package>`
+
+	localizedManifest = `<?xml version="1.0" encoding="utf-8"?>
+<Package xmlns="http://schemas.microsoft.com/appx/manifest/foundation/windows10">
+  <Identity Name="Microsoft.WindowsTerminal" Version="1.18.3181.0" />
+  <Properties>
+    <DisplayName>ms-resource:AppStoreName</DisplayName>
+  </Properties>
+  <Applications>
+    <Application Id="App" Executable="WindowsTerminal.exe" />
+    <Application Id="Elevate" Executable="subdir\elevate-shim.exe" />
+    <Application Id="Web" StartPage="index.html" />
+  </Applications>
+</Package>`
+
+	frameworkManifest = `<?xml version="1.0" encoding="utf-8"?>
+<Package xmlns="http://schemas.microsoft.com/appx/2010/manifest">
+  <Identity Name="Microsoft.VCLibs.140.00" Version="14.0.33519.0" />
+  <Properties>
+    <DisplayName>Microsoft Visual C++ 2015 UWP Runtime Package</DisplayName>
+    <Framework>true</Framework>
+  </Properties>
+</Package>`
+
+	resourceManifest = `<?xml version="1.0" encoding="utf-8"?>
+<Package xmlns="http://schemas.microsoft.com/appx/manifest/foundation/windows10">
+  <Identity Name="Microsoft.WindowsTerminal" ResourceId="split.scale-100" />
+  <Properties>
+    <DisplayName>ms-resource:AppStoreName</DisplayName>
+    <ResourcePackage>true</ResourcePackage>
+  </Properties>
+</Package>`
+)
+
+func TestParseAppxManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     []AppInfo
+	}{
+		{"display name", spotifyManifest, []AppInfo{
+			{Name: "Spotify Music", ExeName: "SpotifyMigrator.exe", IsUWP: true},
+		}},
+		{"localized name and several apps", localizedManifest, []AppInfo{
+			{Name: "Microsoft.WindowsTerminal", ExeName: "WindowsTerminal.exe", IsUWP: true},
+			{Name: "Microsoft.WindowsTerminal", ExeName: "elevate-shim.exe", IsUWP: true},
+		}},
+		{"framework package", frameworkManifest, nil},
+		{"resource package", resourceManifest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAppxManifest([]byte(tt.manifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseAppxManifest([]byte("<Package><Identity")); err == nil {
+		t.Error("truncated manifest parsed")
+	}
+}
+
+func TestIsStorePackageRoot(t *testing.T) {
+	for root, want := range map[string]bool{
+		`C:\Program Files\WindowsApps\SpotifyAB.SpotifyMusic_1.226.1033.0_x86__zpdnekdrzrea0`: true,
+		`D:\WindowsApps\SpotifyAB.SpotifyMusic_1.226.1033.0_x86__zpdnekdrzrea0`:               true,
+		`C:\Windows\SystemApps\Microsoft.Windows.Search_cw5n1h2txyewy`:                        false,
+		`C:\Users\dev\source\MyApp\bin\x64\Debug\AppX`:                                        false,
+	} {
+		if got := isStorePackageRoot(root); got != want {
+			t.Errorf("isStorePackageRoot(%q) = %v, want %v", root, got, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package splittunnel
+
+import (
+	"embed"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Built-in bypass bundles, named as they appear in settings.builtinBypasses.
+const (
+	BypassWindowsUpdate = "windowsUpdate"
+	BypassWindowsStore  = "windowsStore"
+	BypassTeamsCalls    = "teamsCalls"
+)
+
+// bypassOrder is the order bundles are listed and their rules emitted in.
+var bypassOrder = []string{BypassWindowsUpdate, BypassWindowsStore, BypassTeamsCalls}
+
+// bypassTitles are the display names of the bundles.
+var bypassTitles = map[string]string{
+	BypassWindowsUpdate: "Windows Update",
+	BypassWindowsStore:  "Microsoft Store",
+	BypassTeamsCalls:    "Teams calls",
+}
+
+//go:embed bypasses/*.txt
+var bypassFiles embed.FS
+
+// BypassBundle is a curated set of destinations sent direct when its
+// built-in bypass is on.
+type BypassBundle struct {
+	Name           string
+	Title          string // e.g. "Windows Update"
+	DomainSuffixes []string
+	CIDRs          []string
+}
+
+var bypassBundles = loadBypassBundles()
+
+// loadBypassBundles parses bypasses/<name>.txt for every bundle. The files
+// hold one domain suffix or CIDR per line, with # comments.
+func loadBypassBundles() map[string]*BypassBundle {
+	bundles := make(map[string]*BypassBundle, len(bypassOrder))
+	for _, name := range bypassOrder {
+		data, err := bypassFiles.ReadFile("bypasses/" + name + ".txt")
+		if err != nil {
+			panic(err)
+		}
+		b, err := parseBypassBundle(name, string(data))
+		if err != nil {
+			panic(err)
+		}
+		bundles[name] = b
+	}
+	return bundles
+}
+
+func parseBypassBundle(name, data string) (*BypassBundle, error) {
+	b := &BypassBundle{Name: name, Title: bypassTitles[name]}
+	for i, line := range strings.Split(data, "\n") {
+		if idx := strings.IndexByte(line, '#'); idx != -1 {
+			line = line[:idx]
+		}
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(line); err == nil {
+			b.CIDRs = append(b.CIDRs, ipnet.String())
+			continue
+		}
+		if line != sanitizeDomain(line) || strings.ContainsAny(line, " */") || !strings.Contains(line, ".") {
+			return nil, fmt.Errorf("bypass %s: line %d: %q is neither a domain suffix nor a CIDR", name, i+1, line)
+		}
+		b.DomainSuffixes = append(b.DomainSuffixes, line)
+	}
+	if len(b.DomainSuffixes) == 0 && len(b.CIDRs) == 0 {
+		return nil, fmt.Errorf("bypass %s: no entries", name)
+	}
+	return b, nil
+}
+
+// BypassNames returns the names of all built-in bypasses.
+func BypassNames() []string {
+	return append([]string(nil), bypassOrder...)
+}
+
+// Bypass returns the named bundle, or nil if there is none.
+func Bypass(name string) *BypassBundle {
+	return bypassBundles[name]
+}
+
+// ValidateBypasses checks that every name is a built-in bypass.
+func ValidateBypasses(names []string) error {
+	for _, name := range names {
+		if bypassBundles[name] == nil {
+			return fmt.Errorf("unknown built-in bypass %q (want one of %s)", name, strings.Join(bypassOrder, ", "))
+		}
+	}
+	return nil
+}
+
+// BuildBypassRules generates one direct route rule per enabled bundle, in
+// bundle order whatever the order of names. sing-box ORs domain and IP
+// conditions within a rule, so a bundle with both needs only one. Unknown
+// names are skipped.
+func BuildBypassRules(names []string) []interface{} {
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		enabled[name] = true
+	}
+	var rules []interface{}
+	for _, name := range bypassOrder {
+		if !enabled[name] {
+			continue
+		}
+		b := bypassBundles[name]
+		rule := map[string]interface{}{"outbound": "direct"}
+		if len(b.DomainSuffixes) > 0 {
+			rule["domain_suffix"] = b.DomainSuffixes
+		}
+		if len(b.CIDRs) > 0 {
+			rule["ip_cidr"] = b.CIDRs
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// BypassRuleName reports which built-in bypass a route rule with these
+// domain suffixes and CIDRs was built from, if any.
+func BypassRuleName(domainSuffixes, cidrs []string) (string, bool) {
+	for _, name := range bypassOrder {
+		b := bypassBundles[name]
+		if slices.Equal(b.DomainSuffixes, domainSuffixes) && slices.Equal(b.CIDRs, cidrs) {
+			return name, true
+		}
+	}
+	return "", false
+}
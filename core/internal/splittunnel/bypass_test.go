@@ -0,0 +1,82 @@
+package splittunnel
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBypassDataFiles(t *testing.T) {
+	for _, name := range BypassNames() {
+		b := Bypass(name)
+		if b == nil || len(b.DomainSuffixes)+len(b.CIDRs) == 0 {
+			t.Errorf("bundle %s is empty", name)
+		}
+	}
+	if b := Bypass(BypassWindowsUpdate); !slices.Contains(b.DomainSuffixes, "windowsupdate.com") || len(b.CIDRs) != 0 {
+		t.Errorf("windowsUpdate = %+v", b)
+	}
+	if b := Bypass(BypassTeamsCalls); !slices.Contains(b.CIDRs, "52.112.0.0/14") || len(b.DomainSuffixes) != 0 {
+		t.Errorf("teamsCalls = %+v", b)
+	}
+}
+
+func TestParseBypassBundle(t *testing.T) {
+	b, err := parseBypassBundle("test", "# comment\n\nExample.COM  # trailing\n10.1.2.3/8\n2001:db8::/32\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com"}; !reflect.DeepEqual(b.DomainSuffixes, want) {
+		t.Errorf("DomainSuffixes = %v, want %v", b.DomainSuffixes, want)
+	}
+	if want := []string{"10.0.0.0/8", "2001:db8::/32"}; !reflect.DeepEqual(b.CIDRs, want) {
+		t.Errorf("CIDRs = %v, want %v", b.CIDRs, want)
+	}
+
+	for _, bad := range []string{"https://example.com/", "*.example.com", "localhost", "# only comments\n"} {
+		if _, err := parseBypassBundle("test", bad); err == nil {
+			t.Errorf("parseBypassBundle(%q) accepted invalid data", bad)
+		}
+	}
+}
+
+func TestBuildBypassRules(t *testing.T) {
+	rules := BuildBypassRules([]string{BypassTeamsCalls, BypassWindowsUpdate, BypassTeamsCalls})
+	if len(rules) != 2 {
+		t.Fatalf("rules = %v, want one per enabled bundle", rules)
+	}
+	update := rules[0].(map[string]interface{})
+	teams := rules[1].(map[string]interface{})
+	if update["outbound"] != "direct" || !reflect.DeepEqual(update["domain_suffix"], Bypass(BypassWindowsUpdate).DomainSuffixes) || update["ip_cidr"] != nil {
+		t.Errorf("windowsUpdate rule = %v", update)
+	}
+	if teams["outbound"] != "direct" || !reflect.DeepEqual(teams["ip_cidr"], Bypass(BypassTeamsCalls).CIDRs) || teams["domain_suffix"] != nil {
+		t.Errorf("teamsCalls rule = %v", teams)
+	}
+
+	if BuildBypassRules(nil) != nil || BuildBypassRules([]string{"printers"}) != nil {
+		t.Error("no known bypasses should yield no rules")
+	}
+}
+
+func TestBypassRuleName(t *testing.T) {
+	for _, name := range BypassNames() {
+		b := Bypass(name)
+		if got, ok := BypassRuleName(b.DomainSuffixes, b.CIDRs); !ok || got != name {
+			t.Errorf("BypassRuleName(%s) = %q, %v", name, got, ok)
+		}
+	}
+	if _, ok := BypassRuleName([]string{"example.com"}, nil); ok {
+		t.Error("user domains matched a built-in bypass")
+	}
+}
+
+func TestValidateBypasses(t *testing.T) {
+	if err := ValidateBypasses([]string{BypassWindowsStore, BypassTeamsCalls}); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateBypasses([]string{"windowsupdate"}); err == nil || !strings.Contains(err.Error(), "windowsupdate") {
+		t.Errorf("error = %v", err)
+	}
+}
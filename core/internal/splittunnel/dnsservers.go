@@ -0,0 +1,98 @@
+package splittunnel
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DNSServer resolves the domains under DomainSuffixes with a server of its
+// own, such as a corporate resolver reached through the tunnel, while
+// everything else resolves as before.
+type DNSServer struct {
+	DomainSuffixes []string `json:"domainSuffixes"`
+	// Address is a plain IP, a DoH URL (https://host/path) or a DoT
+	// address (tls://host).
+	Address string `json:"address"`
+	Detour  string `json:"detour" jsonschema:"enum=proxy|direct"` // the outbound queries take
+}
+
+// dnsServerTagPrefix tags the generated DNS servers, numbered in order.
+const dnsServerTagPrefix = "custom-dns-"
+
+// ValidateDNSServers checks each server's address, detour and suffixes. A
+// suffix may appear only once across all servers, since only the first
+// rule for it would ever match.
+func ValidateDNSServers(servers []DNSServer) error {
+	seen := make(map[string]int)
+	for i, s := range servers {
+		if err := validateDNSAddress(s.Address); err != nil {
+			return fmt.Errorf("dns server %d: %w", i+1, err)
+		}
+		if s.Detour != "proxy" && s.Detour != "direct" {
+			return fmt.Errorf("dns server %d: detour must be proxy or direct", i+1)
+		}
+		if len(s.DomainSuffixes) == 0 {
+			return fmt.Errorf("dns server %d: no domain suffixes", i+1)
+		}
+		for _, d := range s.DomainSuffixes {
+			suffix := normalizeSuffix(d)
+			if suffix == "" || strings.ContainsAny(suffix, " *") {
+				return fmt.Errorf("dns server %d: invalid domain suffix %q", i+1, d)
+			}
+			if j, ok := seen[suffix]; ok {
+				return fmt.Errorf("domain suffix %q is listed by dns servers %d and %d", suffix, j+1, i+1)
+			}
+			seen[suffix] = i
+		}
+	}
+	return nil
+}
+
+// validateDNSAddress accepts an IP, or an https:// or tls:// URL with a
+// host.
+func validateDNSAddress(address string) error {
+	if net.ParseIP(address) != nil {
+		return nil
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Hostname() == "" || (u.Scheme != "https" && u.Scheme != "tls") {
+		return fmt.Errorf("address %q must be an IP, an https:// (DoH) or a tls:// (DoT) address", address)
+	}
+	return nil
+}
+
+// normalizeSuffix reduces a suffix entry to the bare lowercase domain,
+// without a leading dot.
+func normalizeSuffix(d string) string {
+	return strings.TrimPrefix(strings.ToLower(sanitizeDomain(d)), ".")
+}
+
+// BuildDNSServers returns the sing-box dns.servers and dns.rules entries
+// for servers, which must be valid. Servers named by a domain resolve it
+// via resolverTag.
+func BuildDNSServers(servers []DNSServer, resolverTag string) (dnsServers, rules []interface{}) {
+	for i, s := range servers {
+		tag := fmt.Sprintf("%s%d", dnsServerTagPrefix, i+1)
+		server := map[string]interface{}{
+			"tag":     tag,
+			"address": s.Address,
+			"detour":  s.Detour,
+		}
+		if u, err := url.Parse(s.Address); err == nil && u.Hostname() != "" && net.ParseIP(u.Hostname()) == nil {
+			server["address_resolver"] = resolverTag
+		}
+		dnsServers = append(dnsServers, server)
+
+		suffixes := make([]string, 0, len(s.DomainSuffixes))
+		for _, d := range s.DomainSuffixes {
+			suffixes = append(suffixes, normalizeSuffix(d))
+		}
+		rules = append(rules, map[string]interface{}{
+			"domain_suffix": suffixes,
+			"server":        tag,
+		})
+	}
+	return dnsServers, rules
+}
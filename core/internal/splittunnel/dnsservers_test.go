@@ -0,0 +1,63 @@
+package splittunnel
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateDNSServers(t *testing.T) {
+	valid := []DNSServer{
+		{DomainSuffixes: []string{"corp.example", ".intranet.example"}, Address: "10.0.0.53", Detour: "proxy"},
+		{DomainSuffixes: []string{"lan"}, Address: "tls://192.168.1.1", Detour: "direct"},
+		{DomainSuffixes: []string{"https://Wiki.Example/page"}, Address: "https://dns.example/dns-query", Detour: "proxy"},
+	}
+	if err := ValidateDNSServers(valid); err != nil {
+		t.Fatalf("valid servers rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		server DNSServer
+		want   string
+	}{
+		{"plain hostname", DNSServer{DomainSuffixes: []string{"a.example"}, Address: "dns.example", Detour: "proxy"}, "must be an IP"},
+		{"udp url", DNSServer{DomainSuffixes: []string{"a.example"}, Address: "udp://10.0.0.53", Detour: "proxy"}, "must be an IP"},
+		{"doh without host", DNSServer{DomainSuffixes: []string{"a.example"}, Address: "https:///dns-query", Detour: "proxy"}, "must be an IP"},
+		{"unknown detour", DNSServer{DomainSuffixes: []string{"a.example"}, Address: "10.0.0.53", Detour: "block"}, "detour"},
+		{"no suffixes", DNSServer{Address: "10.0.0.53", Detour: "proxy"}, "no domain suffixes"},
+		{"wildcard suffix", DNSServer{DomainSuffixes: []string{"*.example"}, Address: "10.0.0.53", Detour: "proxy"}, "invalid domain suffix"},
+		// Only the first rule for a suffix would ever match.
+		{"suffix listed twice", DNSServer{DomainSuffixes: []string{".CORP.example"}, Address: "10.0.0.54", Detour: "direct"}, "listed by dns servers 1 and 4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDNSServers(append(append([]DNSServer(nil), valid...), tt.server))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildDNSServers(t *testing.T) {
+	servers, rules := BuildDNSServers([]DNSServer{
+		{DomainSuffixes: []string{".Corp.example"}, Address: "10.0.0.53", Detour: "proxy"},
+		{DomainSuffixes: []string{"lan"}, Address: "https://dns.example/dns-query", Detour: "direct"},
+	}, "local-dns")
+
+	wantServers := []interface{}{
+		map[string]interface{}{"tag": "custom-dns-1", "address": "10.0.0.53", "detour": "proxy"},
+		map[string]interface{}{"tag": "custom-dns-2", "address": "https://dns.example/dns-query", "detour": "direct", "address_resolver": "local-dns"},
+	}
+	if !reflect.DeepEqual(servers, wantServers) {
+		t.Errorf("servers = %v", servers)
+	}
+	wantRules := []interface{}{
+		map[string]interface{}{"domain_suffix": []string{"corp.example"}, "server": "custom-dns-1"},
+		map[string]interface{}{"domain_suffix": []string{"lan"}, "server": "custom-dns-2"},
+	}
+	if !reflect.DeepEqual(rules, wantRules) {
+		t.Errorf("rules = %v", rules)
+	}
+}
@@ -0,0 +1,24 @@
+package splittunnel
+
+import "golang.org/x/sys/windows"
+
+// iconExportSDDL gives full control to SYSTEM and Administrators and read
+// access to interactive users, the same principals the IPC pipe admits,
+// and blocks inheritance from the data directory. Files created in the
+// directory inherit it.
+const iconExportSDDL = "D:P(A;OICI;GA;;;SY)(A;OICI;GA;;;BA)(A;OICI;GR;;;IU)"
+
+// secureIconExportDir replaces the DACL of an export directory with
+// iconExportSDDL.
+func secureIconExportDir(dir string) error {
+	sd, err := windows.SecurityDescriptorFromString(iconExportSDDL)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
@@ -0,0 +1,300 @@
+package splittunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/paths"
+)
+
+// Some executables, typically ones an antivirus product wraps or holds
+// locked, make ExtractIconExW misbehave, and a GDI call on what it returns
+// can fault inside a Windows DLL, which no recover catches and which takes
+// the service down. Every extraction is therefore written to a journal
+// before it starts and after it ends. An extraction the journal shows
+// started but never ended was running when the process died, or never
+// returned before it stopped; at the next start its executable is added
+// to a persistent denylist and never extracted again, until the file
+// changes. Extractions running alongside the culprit are denied with it:
+// an icon too few is better than a second crash.
+
+const (
+	// IconDenylistFileName is the denylist inside the data directory.
+	IconDenylistFileName = "icon_denylist.json"
+	// iconJournalSuffix names the journal next to the denylist.
+	iconJournalSuffix = ".journal"
+	// maxIconDenylist caps the denylist; the oldest entries go first.
+	maxIconDenylist = 500
+	// maxIconExeBytes is the largest executable icons are read from.
+	maxIconExeBytes = 512 << 20
+)
+
+// Reasons an executable is denied.
+const (
+	denyCrashed = "crashed" // the process died, or stopped, during the extraction
+	denyPanic   = "panic"   // the extraction panicked
+)
+
+// deniedExe is an executable icons are not extracted from, as it was when
+// denied.
+type deniedExe struct {
+	Path    string `json:"path"`
+	ModTime int64  `json:"modTime"` // unix nanoseconds
+	Reason  string `json:"reason"`
+	Added   int64  `json:"added"` // unix seconds
+}
+
+// IconDenylist is the persistent list of executables whose icon
+// extraction crashed or hung. A nil *IconDenylist denies nothing and
+// records nothing.
+type IconDenylist struct {
+	mu       sync.Mutex
+	path     string
+	entries  []deniedExe
+	journal  *os.File         // nil if it could not be opened
+	inFlight map[string]int   // extractions running, by key
+	now      func() time.Time // replaced in tests
+}
+
+// OpenIconDenylist loads the denylist at path and adds the executables
+// whose extraction its journal shows unfinished. Problems are logged; the
+// list works without them, in memory only if the files cannot be written.
+func OpenIconDenylist(path string) *IconDenylist {
+	d := &IconDenylist{path: path, inFlight: make(map[string]int), now: time.Now}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &d.entries); err != nil {
+			log.Printf("warning: failed to parse icon denylist: %v", err)
+			d.entries = nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("warning: failed to read icon denylist: %v", err)
+	}
+
+	journalPath := path + iconJournalSuffix
+	if unfinished, err := readIconJournal(journalPath); err != nil {
+		log.Printf("warning: failed to read icon journal: %v", err)
+	} else if len(unfinished) > 0 {
+		for _, e := range unfinished {
+			log.Printf("icons: extraction from %s did not finish in the last run, skipping it from now on", e.Path)
+			d.add(e.Path, e.ModTime, denyCrashed)
+		}
+		if err := d.persist(); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+	d.journal, err = os.OpenFile(journalPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Printf("warning: failed to open icon journal: %v", err)
+	}
+	return d
+}
+
+// Close closes the journal. Extractions still running stay unfinished in
+// it, so the next start denies them.
+func (d *IconDenylist) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.journal == nil {
+		return nil
+	}
+	err := d.journal.Close()
+	d.journal = nil
+	return err
+}
+
+// readIconJournal returns the extractions a journal shows started but not
+// ended. Its lines are "begin" or "end", the modification time and the
+// path, tab separated.
+func readIconJournal(path string) ([]deniedExe, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	open := make(map[string]int)
+	var order []deniedExe
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) != 3 {
+			continue // torn by the crash
+		}
+		modTime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		key := iconKey(fields[2], modTime)
+		switch fields[0] {
+		case "begin":
+			if open[key] == 0 {
+				order = append(order, deniedExe{Path: fields[2], ModTime: modTime})
+			}
+			open[key]++
+		case "end":
+			open[key]--
+		}
+	}
+	var unfinished []deniedExe
+	for _, e := range order {
+		if open[iconKey(e.Path, e.ModTime)] > 0 {
+			unfinished = append(unfinished, e)
+		}
+	}
+	return unfinished, scanner.Err()
+}
+
+func iconKey(path string, modTime int64) string {
+	return strings.ToLower(path) + "\x00" + strconv.FormatInt(modTime, 10)
+}
+
+// Denied reports whether icons are not extracted from the executable at
+// path as last modified at modTime: it is on the denylist, or an earlier
+// extraction from it has not returned yet.
+func (d *IconDenylist) Denied(path string, modTime time.Time) bool {
+	if d == nil {
+		return false
+	}
+	key := iconKey(path, modTime.UnixNano())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inFlight[key] > 0 {
+		return true
+	}
+	for _, e := range d.entries {
+		if iconKey(e.Path, e.ModTime) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Deny adds the executable at path, as last modified at modTime, to the
+// denylist.
+func (d *IconDenylist) Deny(path string, modTime time.Time, reason string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.add(path, modTime.UnixNano(), reason)
+	if err := d.persist(); err != nil {
+		log.Printf("warning: %v", err)
+	}
+}
+
+// add adds an entry unless it is listed. Caller holds d.mu or owns d.
+func (d *IconDenylist) add(path string, modTime int64, reason string) {
+	key := iconKey(path, modTime)
+	for _, e := range d.entries {
+		if iconKey(e.Path, e.ModTime) == key {
+			return
+		}
+	}
+	d.entries = append(d.entries, deniedExe{Path: path, ModTime: modTime, Reason: reason, Added: d.now().Unix()})
+	if over := len(d.entries) - maxIconDenylist; over > 0 {
+		d.entries = d.entries[over:]
+	}
+}
+
+// persist writes the denylist. Caller holds d.mu or owns d.
+func (d *IconDenylist) persist() error {
+	data, err := json.MarshalIndent(d.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := paths.WriteFileAtomic(d.path, data); err != nil {
+		return fmt.Errorf("failed to save icon denylist: %w", err)
+	}
+	return nil
+}
+
+// begin journals an extraction about to start. The write goes to the
+// system's cache at once, so it survives the process.
+func (d *IconDenylist) begin(path string, modTime time.Time) {
+	d.mark("begin", path, modTime, 1)
+}
+
+// end journals an extraction that returned.
+func (d *IconDenylist) end(path string, modTime time.Time) {
+	d.mark("end", path, modTime, -1)
+}
+
+func (d *IconDenylist) mark(event, path string, modTime time.Time, delta int) {
+	if d == nil {
+		return
+	}
+	key := iconKey(path, modTime.UnixNano())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inFlight[key] += delta; d.inFlight[key] <= 0 {
+		delete(d.inFlight, key)
+	}
+	if d.journal != nil {
+		fmt.Fprintf(d.journal, "%s\t%d\t%s\n", event, modTime.UnixNano(), path)
+	}
+}
+
+// activeIconDenylist is the denylist ListInstalledApps consults; nil
+// until SetIconDenylist.
+var activeIconDenylist atomic.Pointer[IconDenylist]
+
+// SetIconDenylist sets the denylist icon extraction consults and records
+// crashes in.
+func SetIconDenylist(d *IconDenylist) {
+	activeIconDenylist.Store(d)
+}
+
+// guardIconExtract extracts the icon of the executable at path with
+// extract, unless the file is unsafe to try: it cannot be opened for
+// reading, is empty or implausibly large, or is denied. The extraction is
+// journaled in d, and a panic in it, including a memory fault in Go code
+// reading what the API returned, is recovered and denies the file. It
+// returns "" whenever there is no icon.
+func guardIconExtract(d *IconDenylist, path string, extract func(path string) string) (icon string) {
+	if path == "" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 || info.Size() > maxIconExeBytes {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "" // locked, typically by an antivirus scan
+	}
+	f.Close()
+	modTime := info.ModTime()
+	if d.Denied(path, modTime) {
+		return ""
+	}
+
+	d.begin(path, modTime)
+	defer d.end(path, modTime)
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("icons: extraction from %s panicked, skipping it from now on: %v", path, p)
+			d.Deny(path, modTime, denyPanic)
+			icon = ""
+		}
+	}()
+	return extract(path)
+}
@@ -0,0 +1,219 @@
+package splittunnel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeExe writes a fake executable and returns its path and
+// modification time.
+func writeExe(t *testing.T, dir, name string, size int) (string, time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, info.ModTime()
+}
+
+// openTestDenylist opens a denylist that is closed when the test ends.
+func openTestDenylist(t *testing.T, path string) *IconDenylist {
+	t.Helper()
+	d := OpenIconDenylist(path)
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestGuardIconExtractSkipsUnsafeFiles(t *testing.T) {
+	dir := t.TempDir()
+	d := openTestDenylist(t, filepath.Join(dir, IconDenylistFileName))
+	good, _ := writeExe(t, dir, "good.exe", 64)
+	empty, _ := writeExe(t, dir, "empty.exe", 0)
+
+	calls := 0
+	extract := func(string) string { calls++; return "icon" }
+	for _, path := range []string{"", empty, filepath.Join(dir, "missing.exe"), dir} {
+		if icon := guardIconExtract(d, path, extract); icon != "" {
+			t.Errorf("%q: icon %q", path, icon)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("extractor called %d times for unsafe files", calls)
+	}
+	if icon := guardIconExtract(d, good, extract); icon != "icon" || calls != 1 {
+		t.Errorf("good file: icon %q, %d calls", icon, calls)
+	}
+	// A nil denylist guards without recording.
+	if icon := guardIconExtract(nil, good, extract); icon != "icon" {
+		t.Errorf("without a denylist: icon %q", icon)
+	}
+}
+
+func TestGuardIconExtractPanic(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, IconDenylistFileName)
+	d := openTestDenylist(t, listPath)
+	path, modTime := writeExe(t, dir, "wrapped.exe", 64)
+
+	icon := guardIconExtract(d, path, func(string) string {
+		var pixels []byte
+		return string(pixels[3:]) // a decoding bug on a malformed icon
+	})
+	if icon != "" || !d.Denied(path, modTime) {
+		t.Fatalf("icon %q, denied %v", icon, d.Denied(path, modTime))
+	}
+	calls := 0
+	guardIconExtract(d, path, func(string) string { calls++; return "icon" })
+	if calls != 0 {
+		t.Error("a denied file was extracted again")
+	}
+
+	// The denylist persists, keyed by the file as it was: an updated
+	// executable gets another try.
+	if reopened := openTestDenylist(t, listPath); !reopened.Denied(path, modTime) {
+		t.Error("denial lost on reopen")
+	}
+	later := modTime.Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if icon := guardIconExtract(d, path, func(string) string { return "icon" }); icon != "icon" {
+		t.Errorf("updated file: icon %q", icon)
+	}
+}
+
+// TestIconJournalCrash simulates the process dying in an extraction and
+// checks the next start denies that executable only.
+func TestIconJournalCrash(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, IconDenylistFileName)
+	d := openTestDenylist(t, listPath)
+	crashing, crashTime := writeExe(t, dir, "crashing.exe", 64)
+	fine, fineTime := writeExe(t, dir, "fine.exe", 64)
+
+	guardIconExtract(d, fine, func(string) string { return "icon" })
+	d.begin(crashing, crashTime) // the process dies here
+	d.journal.WriteString("beg") // with a torn line
+
+	d = openTestDenylist(t, listPath)
+	if !d.Denied(crashing, crashTime) || d.Denied(fine, fineTime) {
+		t.Errorf("crashing denied %v, fine denied %v", d.Denied(crashing, crashTime), d.Denied(fine, fineTime))
+	}
+	if len(d.entries) != 1 || d.entries[0].Reason != denyCrashed {
+		t.Errorf("entries = %+v", d.entries)
+	}
+	// The journal starts over, so the next start denies nothing new.
+	d = openTestDenylist(t, listPath)
+	if len(d.entries) != 1 {
+		t.Errorf("entries after a clean start = %+v", d.entries)
+	}
+}
+
+// TestHungIconExtraction hangs an extraction, as ExtractIconExW does on
+// some locked executables, and checks later listings skip the executable
+// while the call is stuck, and the next start denies it.
+func TestHungIconExtraction(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, IconDenylistFileName)
+	d := openTestDenylist(t, listPath)
+	hung, hungTime := writeExe(t, dir, "hung.exe", 64)
+	writeExe(t, dir, "fine.exe", 64)
+
+	release := make(chan struct{})
+	defer close(release)
+	extract := func(path string) string {
+		if path == hung {
+			<-release
+		}
+		return "icon"
+	}
+	apps := []AppInfo{{ExeName: "hung.exe"}, {ExeName: "fine.exe"}}
+	pool := testIconPool(2, 50*time.Millisecond, 4)
+	list := func() {
+		for i := range apps {
+			apps[i].Icon = ""
+		}
+		err := pool.extract(context.Background(), apps, func(app AppInfo) string {
+			return guardIconExtract(d, filepath.Join(dir, app.ExeName), extract)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list()
+	if apps[0].Icon != "" || apps[1].Icon != "icon" {
+		t.Fatalf("icons = %q, %q", apps[0].Icon, apps[1].Icon)
+	}
+	start := time.Now()
+	list()
+	if elapsed := time.Since(start); elapsed >= pool.timeout {
+		t.Errorf("second listing waited %v on the stuck executable", elapsed)
+	}
+	if pool.abandoned.Load() != 1 {
+		t.Errorf("%d abandoned calls, want 1", pool.abandoned.Load())
+	}
+
+	if reopened := openTestDenylist(t, listPath); !reopened.Denied(hung, hungTime) {
+		t.Error("an extraction stuck at shutdown is not denied at the next start")
+	}
+}
+
+// TestExtractIconsAbandonedCap hangs every extraction and checks that once
+// maxAbandoned calls are stuck, the rest are skipped without a wait.
+func TestExtractIconsAbandonedCap(t *testing.T) {
+	apps := make([]AppInfo, 20)
+	for i := range apps {
+		apps[i].ExeName = fmt.Sprintf("app%d.exe", i)
+	}
+	release := make(chan struct{})
+	pool := testIconPool(1, 20*time.Millisecond, 32)
+	pool.maxAbandoned = 3
+
+	var calls atomic.Int32
+	start := time.Now()
+	err := pool.extract(context.Background(), apps, func(AppInfo) string {
+		calls.Add(1)
+		<-release
+		return "icon"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 3 || pool.abandoned.Load() != 3 {
+		t.Errorf("%d calls, %d abandoned; want 3 of each", calls.Load(), pool.abandoned.Load())
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("listing took %v", elapsed)
+	}
+
+	// Calls that return late give their place back.
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for pool.abandoned.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := pool.abandoned.Load(); n != 0 {
+		t.Errorf("%d abandoned calls after they returned", n)
+	}
+}
+
+func TestIconDenylistCap(t *testing.T) {
+	d := openTestDenylist(t, filepath.Join(t.TempDir(), IconDenylistFileName))
+	at := time.Unix(1700000000, 0)
+	for i := 0; i < maxIconDenylist+5; i++ {
+		d.Deny(fmt.Sprintf(`C:\Apps\app%d.exe`, i), at, denyPanic)
+	}
+	if len(d.entries) != maxIconDenylist || d.Denied(`C:\Apps\app0.exe`, at) || !d.Denied(`C:\APPS\APP5.EXE`, at) {
+		t.Errorf("%d entries; oldest denied %v", len(d.entries), d.Denied(`C:\Apps\app0.exe`, at))
+	}
+}
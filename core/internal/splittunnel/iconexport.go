@@ -0,0 +1,170 @@
+package splittunnel
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sending every icon as base64 over the pipe costs a third more than the
+// PNGs themselves and keeps the whole list in memory on both sides. The UI
+// runs on the same machine, so it can instead read the PNGs from a
+// directory the service writes them to.
+
+// IconExportDirName is the directory inside the data directory that holds
+// icon exports.
+const IconExportDirName = "icon-export"
+
+// IconExportTTL is how long an export is kept before the sweeper removes
+// it; the UI reads the files right after exporting.
+const IconExportTTL = time.Hour
+
+// iconExportPrefix starts the name of every export directory, so the
+// sweeper never touches anything else under the root.
+const iconExportPrefix = "session-"
+
+// IconExport is one export: a directory of PNG files and the manifest of
+// which app each belongs to.
+type IconExport struct {
+	Dir       string
+	Icons     []ExportedIcon
+	ExpiresAt time.Time
+}
+
+// ExportedIcon maps an app to its icon file. File is a bare name inside
+// the export directory, derived from the PNG's hash, so identical icons
+// share a file and no app-supplied name ever becomes part of a path.
+type ExportedIcon struct {
+	ExeName string `json:"exeName"`
+	File    string `json:"file"`
+	SHA256  string `json:"sha256"`
+}
+
+// IconExporter writes app icons to export directories and removes them
+// once they expire.
+type IconExporter struct {
+	root   string
+	now    func() time.Time       // replaced in tests
+	secure func(dir string) error // restricts access to an export; replaced in tests
+
+	mu sync.Mutex // held while writing or sweeping, so a sweep never sees half an export
+}
+
+// NewIconExporter returns an exporter writing under root.
+func NewIconExporter(root string) *IconExporter {
+	return &IconExporter{root: root, now: time.Now, secure: secureIconExportDir}
+}
+
+// Export writes the icons of apps to a new export directory. Apps without
+// an icon are left out, as are repeats of an exe name already exported.
+func (x *IconExporter) Export(apps []AppInfo) (IconExport, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := os.MkdirAll(x.root, 0o755); err != nil {
+		return IconExport{}, fmt.Errorf("failed to create icon export root: %w", err)
+	}
+	dir, err := os.MkdirTemp(x.root, iconExportPrefix+"*")
+	if err != nil {
+		return IconExport{}, fmt.Errorf("failed to create icon export directory: %w", err)
+	}
+	// Restrict access before any file exists, so files inherit the ACL.
+	if err := x.secure(dir); err != nil {
+		os.RemoveAll(dir)
+		return IconExport{}, fmt.Errorf("failed to secure icon export directory: %w", err)
+	}
+
+	export := IconExport{Dir: dir, Icons: []ExportedIcon{}, ExpiresAt: x.now().Add(IconExportTTL)}
+	seen := make(map[string]bool)
+	written := make(map[string]bool)
+	for _, app := range apps {
+		key := strings.ToLower(app.ExeName)
+		if app.Icon == "" || app.ExeName == "" || seen[key] {
+			continue
+		}
+		png, err := base64.StdEncoding.DecodeString(app.Icon)
+		if err != nil {
+			log.Printf("warning: skipping undecodable icon of %s: %v", app.ExeName, err)
+			continue
+		}
+		sum := sha256.Sum256(png)
+		hash := hex.EncodeToString(sum[:])
+		file := hash[:32] + ".png"
+		if !written[file] {
+			if err := os.WriteFile(filepath.Join(dir, file), png, 0o644); err != nil {
+				os.RemoveAll(dir)
+				return IconExport{}, fmt.Errorf("failed to write icon: %w", err)
+			}
+			written[file] = true
+		}
+		seen[key] = true
+		export.Icons = append(export.Icons, ExportedIcon{ExeName: app.ExeName, File: file, SHA256: hash})
+	}
+	return export, nil
+}
+
+// Sweep removes the exports older than IconExportTTL, including ones left
+// by an earlier run. An export whose files the UI still has open cannot be
+// removed on Windows; it is retried on the next sweep.
+func (x *IconExporter) Sweep() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeExports(x.now().Add(-IconExportTTL))
+}
+
+// RemoveAll removes every export, as on shutdown.
+func (x *IconExporter) RemoveAll() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeExports(time.Time{})
+}
+
+// removeExports removes the exports last written before cutoff, or all of
+// them for a zero cutoff.
+func (x *IconExporter) removeExports(cutoff time.Time) {
+	entries, err := os.ReadDir(x.root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("warning: failed to list icon exports: %v", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), iconExportPrefix) {
+			continue
+		}
+		if !cutoff.IsZero() {
+			info, err := entry.Info()
+			if err != nil || !info.ModTime().Before(cutoff) {
+				continue
+			}
+		}
+		if err := os.RemoveAll(filepath.Join(x.root, entry.Name())); err != nil {
+			log.Printf("warning: failed to remove icon export %s, retrying later: %v", entry.Name(), err)
+		}
+	}
+}
+
+// Run sweeps expired exports every interval until stop is closed, then
+// removes every export.
+func (x *IconExporter) Run(stop <-chan struct{}, interval time.Duration) {
+	x.Sweep()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			x.RemoveAll()
+			return
+		case <-ticker.C:
+			x.Sweep()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package splittunnel
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestExporter(t *testing.T) (*IconExporter, *time.Time) {
+	t.Helper()
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	x := NewIconExporter(filepath.Join(t.TempDir(), IconExportDirName))
+	x.now = func() time.Time { return now }
+	x.secure = func(string) error { return nil }
+	return x, &now
+}
+
+func TestIconExportManifest(t *testing.T) {
+	x, now := newTestExporter(t)
+	png := []byte("\x89PNG fake icon")
+	icon := base64.StdEncoding.EncodeToString(png)
+	other := base64.StdEncoding.EncodeToString([]byte("\x89PNG other"))
+
+	export, err := x.Export([]AppInfo{
+		{Name: "Chrome", ExeName: "chrome.exe", Icon: icon},
+		{Name: "Chrome Beta", ExeName: "CHROME.EXE", Icon: other}, // repeat of an exe name
+		{Name: "Evil", ExeName: `..\..\evil.exe`, Icon: icon},     // same icon, shared file
+		{Name: "Edge", ExeName: "msedge.exe", Icon: other},
+		{Name: "No icon", ExeName: "plain.exe"},
+		{Name: "Broken", ExeName: "broken.exe", Icon: "not base64!"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(export.Dir) != x.root || !export.ExpiresAt.Equal(now.Add(IconExportTTL)) {
+		t.Errorf("export = %+v", export)
+	}
+
+	sum := sha256.Sum256(png)
+	hash := hex.EncodeToString(sum[:])
+	want := []string{"chrome.exe", `..\..\evil.exe`, "msedge.exe"}
+	if len(export.Icons) != len(want) {
+		t.Fatalf("icons = %+v, want %v", export.Icons, want)
+	}
+	for i, icon := range export.Icons {
+		if icon.ExeName != want[i] {
+			t.Errorf("icon %d = %s, want %s", i, icon.ExeName, want[i])
+		}
+		if icon.File != filepath.Base(icon.File) || filepath.Ext(icon.File) != ".png" {
+			t.Errorf("file %q is not a bare PNG name", icon.File)
+		}
+	}
+	if export.Icons[0].SHA256 != hash || export.Icons[0].File != hash[:32]+".png" || export.Icons[1].File != export.Icons[0].File {
+		t.Errorf("manifest = %+v", export.Icons)
+	}
+	data, err := os.ReadFile(filepath.Join(export.Dir, export.Icons[0].File))
+	if err != nil || string(data) != string(png) {
+		t.Errorf("icon file = %q, %v", data, err)
+	}
+	files, _ := os.ReadDir(export.Dir)
+	if len(files) != 2 {
+		t.Errorf("export holds %d files, want 2", len(files))
+	}
+}
+
+func TestIconExportSecureFailure(t *testing.T) {
+	x, _ := newTestExporter(t)
+	x.secure = func(string) error { return errors.New("access denied") }
+	if _, err := x.Export(nil); err == nil {
+		t.Fatal("export succeeded without an ACL")
+	}
+	entries, _ := os.ReadDir(x.root)
+	if len(entries) != 0 {
+		t.Errorf("unsecured directory left behind: %v", entries)
+	}
+}
+
+func TestIconExportSweep(t *testing.T) {
+	x, now := newTestExporter(t)
+	old, err := x.Export(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := x.Export(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unrelated := filepath.Join(x.root, "keep")
+	os.Mkdir(unrelated, 0o755)
+
+	// The old export was written over an hour before the clock.
+	*now = time.Now()
+	past := now.Add(-IconExportTTL - time.Minute)
+	os.Chtimes(old.Dir, past, past)
+	os.Chtimes(unrelated, past, past)
+
+	x.Sweep()
+	if _, err := os.Stat(old.Dir); !os.IsNotExist(err) {
+		t.Error("expired export not removed")
+	}
+	if _, err := os.Stat(fresh.Dir); err != nil {
+		t.Errorf("fresh export removed: %v", err)
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("unrelated directory removed: %v", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		x.Run(stop, time.Hour)
+		close(done)
+	}()
+	close(stop)
+	<-done
+	if _, err := os.Stat(fresh.Dir); !os.IsNotExist(err) {
+		t.Error("export not removed on shutdown")
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Errorf("unrelated directory removed on shutdown: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package splittunnel
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+)
+
+// Icon sizes apps.list renders, in pixels.
+const (
+	IconSizeSmall = 32 // the default
+	IconSizeLarge = 64
+)
+
+// Executables often carry 256×256 icons that encode to well over 100 KB.
+// An encoded icon larger than maxIconBytes is rendered again at half size,
+// down to minIconSize, and dropped if it still does not fit.
+const (
+	maxIconBytes = 20 * 1024
+	minIconSize  = 16
+)
+
+// ValidIconSize reports whether size is one of the icon sizes.
+func ValidIconSize(size int) bool {
+	return size == IconSizeSmall || size == IconSizeLarge
+}
+
+// bgraToRGBA converts a top-down 32-bit DIB to an image. Many icons leave
+// the alpha channel all zero and rely on their mask instead; those are
+// made opaque rather than invisible.
+func bgraToRGBA(pixels []byte, w, h int) *image.RGBA {
+	n := w * h * 4
+	hasAlpha := false
+	for i := 3; i < n; i += 4 {
+		if pixels[i] != 0 {
+			hasAlpha = true
+			break
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < n; i += 4 {
+		img.Pix[i+0] = pixels[i+2] // R ← B
+		img.Pix[i+1] = pixels[i+1] // G
+		img.Pix[i+2] = pixels[i+0] // B ← R
+		if hasAlpha {
+			img.Pix[i+3] = pixels[i+3]
+		} else {
+			img.Pix[i+3] = 255
+		}
+	}
+	return img
+}
+
+// scaleRGBA resizes src to w×h with bilinear filtering. Shrinking by more
+// than half first halves the image repeatedly, which bilinear sampling
+// does as an exact 2×2 average, so large icons do not alias.
+func scaleRGBA(src *image.RGBA, w, h int) *image.RGBA {
+	for src.Rect.Dx() >= 2*w && src.Rect.Dy() >= 2*h {
+		src = resample(src, src.Rect.Dx()/2, src.Rect.Dy()/2)
+	}
+	if src.Rect.Dx() == w && src.Rect.Dy() == h {
+		return src
+	}
+	return resample(src, w, h)
+}
+
+// resample is one bilinear pass, sampling src at the centre of each
+// destination pixel.
+func resample(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1, fy := sampleAxis(y, h, sh)
+		for x := 0; x < w; x++ {
+			x0, x1, fx := sampleAxis(x, w, sw)
+			p00 := src.PixOffset(src.Rect.Min.X+x0, src.Rect.Min.Y+y0)
+			p10 := src.PixOffset(src.Rect.Min.X+x1, src.Rect.Min.Y+y0)
+			p01 := src.PixOffset(src.Rect.Min.X+x0, src.Rect.Min.Y+y1)
+			p11 := src.PixOffset(src.Rect.Min.X+x1, src.Rect.Min.Y+y1)
+			d := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				top := float64(src.Pix[p00+c])*(1-fx) + float64(src.Pix[p10+c])*fx
+				bottom := float64(src.Pix[p01+c])*(1-fx) + float64(src.Pix[p11+c])*fx
+				dst.Pix[d+c] = uint8(top*(1-fy) + bottom*fy + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
+// sampleAxis maps destination coordinate i of n onto a source axis of
+// length sn, returning the two neighbouring source pixels and the weight
+// of the second.
+func sampleAxis(i, n, sn int) (int, int, float64) {
+	pos := (float64(i)+0.5)*float64(sn)/float64(n) - 0.5
+	if pos < 0 {
+		pos = 0
+	}
+	i0 := int(pos)
+	if i0 >= sn-1 {
+		return sn - 1, sn - 1, 0
+	}
+	return i0, i0 + 1, pos - float64(i0)
+}
+
+// encodeIcon renders img at size×size as PNG, halving the size until the
+// result fits in limit bytes.
+func encodeIcon(img *image.RGBA, size, limit int) ([]byte, error) {
+	for ; size >= minIconSize; size /= 2 {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, scaleRGBA(img, size, size)); err != nil {
+			return nil, err
+		}
+		if buf.Len() <= limit {
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, errors.New("icon too large")
+}
@@ -0,0 +1,113 @@
+package splittunnel
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// solidBGRA returns a w×h DIB filled with one BGRA pixel.
+func solidBGRA(w, h int, b, g, r, a byte) []byte {
+	pixels := make([]byte, w*h*4)
+	for i := 0; i < len(pixels); i += 4 {
+		pixels[i], pixels[i+1], pixels[i+2], pixels[i+3] = b, g, r, a
+	}
+	return pixels
+}
+
+func TestBGRAToRGBA(t *testing.T) {
+	img := bgraToRGBA(solidBGRA(4, 4, 10, 20, 30, 128), 4, 4)
+	if got := img.RGBAAt(1, 2); got.R != 30 || got.G != 20 || got.B != 10 || got.A != 128 {
+		t.Errorf("pixel = %+v, want channels swapped and alpha kept", got)
+	}
+
+	// An all-zero alpha channel means the icon relies on its mask.
+	img = bgraToRGBA(solidBGRA(4, 4, 10, 20, 30, 0), 4, 4)
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 255 {
+			t.Fatalf("alpha at %d = %d, want opaque", i, img.Pix[i])
+		}
+	}
+}
+
+func TestScaleRGBADimensions(t *testing.T) {
+	for _, tt := range []struct{ from, to int }{{256, 32}, {256, 64}, {48, 32}, {32, 32}, {16, 32}, {20, 64}} {
+		src := bgraToRGBA(solidBGRA(tt.from, tt.from, 0, 128, 255, 0), tt.from, tt.from)
+		dst := scaleRGBA(src, tt.to, tt.to)
+		if dst.Rect.Dx() != tt.to || dst.Rect.Dy() != tt.to {
+			t.Errorf("%d → %d: got %v", tt.from, tt.to, dst.Rect)
+			continue
+		}
+		// Scaling a flat opaque image keeps it flat and opaque.
+		if got := dst.RGBAAt(tt.to-1, tt.to/2); got.R != 255 || got.G != 128 || got.B != 0 || got.A != 255 {
+			t.Errorf("%d → %d: pixel = %+v", tt.from, tt.to, got)
+		}
+	}
+}
+
+func TestScaleRGBAAverages(t *testing.T) {
+	// Black and white columns average to grey.
+	src := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8(0)
+			if x%2 == 1 {
+				v = 255
+			}
+			i := src.PixOffset(x, y)
+			src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = v, v, v, 255
+		}
+	}
+	dst := scaleRGBA(src, 8, 8)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		if r := dst.Pix[i]; r < 126 || r > 129 {
+			t.Fatalf("pixel %d = %d, want grey", i/4, r)
+		}
+	}
+
+	// Upscaling blends between neighbours.
+	src = image.NewRGBA(image.Rect(0, 0, 2, 1))
+	copy(src.Pix, []uint8{0, 0, 0, 255, 200, 200, 200, 255})
+	dst = scaleRGBA(src, 4, 1)
+	if want := []uint8{0, 50, 150, 200}; dst.Pix[0] != want[0] || dst.Pix[4] != want[1] || dst.Pix[8] != want[2] || dst.Pix[12] != want[3] {
+		t.Errorf("upscaled row = %v, want red channel %v", dst.Pix, want)
+	}
+}
+
+func TestEncodeIconCapsSize(t *testing.T) {
+	// Noise does not compress, so a 256×256 icon encodes to about 256 KB.
+	rng := rand.New(rand.NewSource(1))
+	pixels := make([]byte, 256*256*4)
+	rng.Read(pixels)
+	img := bgraToRGBA(pixels, 256, 256)
+
+	data, err := encodeIcon(img, IconSizeLarge, maxIconBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > maxIconBytes {
+		t.Errorf("encoded %d bytes, over the %d cap", len(data), maxIconBytes)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := decoded.Bounds(); b.Dx() != IconSizeLarge || b.Dy() != IconSizeLarge {
+		t.Errorf("decoded size = %v", b)
+	}
+
+	// Over the cap at 64 px, so it is rendered at 32.
+	data, err = encodeIcon(img, IconSizeLarge, 6*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := png.Decode(bytes.NewReader(data)); decoded.Bounds().Dx() != IconSizeSmall {
+		t.Errorf("downscaled size = %v, want %d", decoded.Bounds(), IconSizeSmall)
+	}
+
+	if _, err := encodeIcon(img, IconSizeSmall, 10); err == nil {
+		t.Error("icon over the cap at every size was not dropped")
+	}
+}
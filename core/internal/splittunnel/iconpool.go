@@ -0,0 +1,144 @@
+package splittunnel
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Icon extraction is mostly disk reads, so parallel workers hide the
+// latency. Each extraction holds a memory DC, two icons and their bitmaps,
+// so the extractions in flight across all listings, including ones that
+// timed out but are still stuck in shell32, are capped at iconCallBudget
+// to keep GDI handles and the desktop heap bounded. Once
+// maxAbandonedIconCalls timed-out calls are stuck, something is wrong
+// beyond one executable, and listings skip icons altogether rather than
+// wait out a timeout per app.
+const (
+	DefaultIconWorkers    = 8
+	maxIconWorkers        = 32
+	iconCallBudget        = maxIconWorkers
+	iconCallTimeout       = 3 * time.Second
+	maxAbandonedIconCalls = 8
+)
+
+var iconWorkers atomic.Int32
+
+func init() {
+	iconWorkers.Store(DefaultIconWorkers)
+}
+
+// SetIconWorkers sets how many icons ListInstalledApps extracts in
+// parallel, clamped to 1-32.
+func SetIconWorkers(n int) {
+	iconWorkers.Store(int32(min(max(n, 1), maxIconWorkers)))
+}
+
+// iconSlots counts the extractions in flight, shared by all listings.
+var iconSlots = make(chan struct{}, iconCallBudget)
+
+// abandonedIconCalls counts the timed-out extractions that have not
+// returned, shared by all listings.
+var abandonedIconCalls atomic.Int32
+
+// iconPool extracts icons in parallel. An extraction that does not get a
+// slot or finish within timeout is abandoned and its app left without an
+// icon; its slot is freed when the call returns.
+type iconPool struct {
+	workers      int
+	timeout      time.Duration
+	slots        chan struct{}
+	abandoned    *atomic.Int32
+	maxAbandoned int32
+}
+
+func newIconPool() *iconPool {
+	return &iconPool{
+		workers:      int(iconWorkers.Load()),
+		timeout:      iconCallTimeout,
+		slots:        iconSlots,
+		abandoned:    &abandonedIconCalls,
+		maxAbandoned: maxAbandonedIconCalls,
+	}
+}
+
+// extract sets the icon of every app using fn, spread over the pool's
+// workers. Once ctx is done no further extraction starts; it waits for the
+// ones in progress and returns ctx.Err().
+func (p *iconPool) extract(ctx context.Context, apps []AppInfo, fn func(AppInfo) string) error {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < p.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				apps[i].Icon = p.call(apps[i], fn)
+			}
+		}()
+	}
+
+feed:
+	for i := range apps {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Extraction states, for the race between a call returning and timing
+// out.
+const (
+	callRunning int32 = iota
+	callReturned
+	callAbandoned
+)
+
+// call runs one extraction within the pool's timeout, returning "" if it
+// runs out or too many abandoned calls are stuck.
+func (p *iconPool) call(app AppInfo, fn func(AppInfo) string) string {
+	if n := p.abandoned.Load(); n >= p.maxAbandoned {
+		return ""
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+	case <-timer.C:
+		log.Printf("warning: no icon slot for %s within %v", app.ExeName, p.timeout)
+		return ""
+	}
+
+	result := make(chan string, 1)
+	var state atomic.Int32
+	go func() {
+		defer func() {
+			<-p.slots
+			if !state.CompareAndSwap(callRunning, callReturned) {
+				p.abandoned.Add(-1)
+			}
+		}()
+		result <- fn(app)
+	}()
+	select {
+	case icon := <-result:
+		return icon
+	case <-timer.C:
+		if !state.CompareAndSwap(callRunning, callAbandoned) {
+			return <-result // returned just now
+		}
+		n := p.abandoned.Add(1)
+		log.Printf("warning: icon extraction for %s timed out after %v (%d abandoned calls stuck)", app.ExeName, p.timeout, n)
+		return ""
+	}
+}
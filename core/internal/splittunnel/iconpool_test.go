@@ -0,0 +1,158 @@
+package splittunnel
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIconPool returns a pool with its own slots and abandoned calls.
+func testIconPool(workers int, timeout time.Duration, slots int) *iconPool {
+	return &iconPool{workers: workers, timeout: timeout, slots: make(chan struct{}, slots),
+		abandoned: new(atomic.Int32), maxAbandoned: maxAbandonedIconCalls}
+}
+
+func TestExtractIcons(t *testing.T) {
+	apps := make([]AppInfo, 20)
+	for i := range apps {
+		apps[i].ExeName = fmt.Sprintf("app%d.exe", i)
+	}
+	pool := testIconPool(3, time.Second, 3)
+	err := pool.extract(context.Background(), apps, func(app AppInfo) string {
+		return "icon:" + app.ExeName
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, app := range apps {
+		if app.Icon != "icon:"+app.ExeName {
+			t.Errorf("%s has icon %q", app.ExeName, app.Icon)
+		}
+	}
+}
+
+// TestExtractIconsCancel cancels a listing partway through and checks the
+// workers stop promptly instead of extracting every remaining icon.
+func TestExtractIconsCancel(t *testing.T) {
+	apps := make([]AppInfo, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	var started, running atomic.Int32
+	done := make(chan error, 1)
+	go func() {
+		done <- newIconPool().extract(ctx, apps, func(AppInfo) string {
+			running.Add(1)
+			defer running.Add(-1)
+			if started.Add(1) == 10 {
+				cancel()
+			}
+			time.Sleep(5 * time.Millisecond) // a slow executable
+			return "icon"
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("err = %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("extraction did not stop after cancel")
+	}
+	if n := running.Load(); n != 0 {
+		t.Errorf("%d extractions still running after return", n)
+	}
+	// Only the extractions already handed to a worker may finish.
+	if n := started.Load(); n > 10+DefaultIconWorkers {
+		t.Errorf("%d extractions started, want at most %d", n, 10+DefaultIconWorkers)
+	}
+}
+
+// TestExtractIconsTimeout hangs one extraction and checks the rest of the
+// listing goes on without it.
+func TestExtractIconsTimeout(t *testing.T) {
+	apps := make([]AppInfo, 20)
+	for i := range apps {
+		apps[i].ExeName = fmt.Sprintf("app%d.exe", i)
+	}
+	hang := make(chan struct{})
+	defer close(hang)
+	pool := testIconPool(4, 50*time.Millisecond, 8)
+
+	start := time.Now()
+	err := pool.extract(context.Background(), apps, func(app AppInfo) string {
+		if app.ExeName == "app3.exe" {
+			<-hang
+		}
+		return "icon"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("listing took %v with one hung extraction", elapsed)
+	}
+	for _, app := range apps {
+		if want := "icon"; app.ExeName == "app3.exe" {
+			if app.Icon != "" {
+				t.Errorf("hung extraction has icon %q", app.Icon)
+			}
+		} else if app.Icon != want {
+			t.Errorf("%s has icon %q", app.ExeName, app.Icon)
+		}
+	}
+	// The hung call keeps its slot until it returns.
+	if n := len(pool.slots); n != 1 {
+		t.Errorf("%d slots held, want 1", n)
+	}
+}
+
+// TestExtractIconsBudget checks extractions in flight never exceed the
+// slots, even with more workers, and that apps degrade to no icon when
+// abandoned calls hold every slot.
+func TestExtractIconsBudget(t *testing.T) {
+	apps := make([]AppInfo, 50)
+	pool := testIconPool(8, time.Second, 3)
+	var running, peak atomic.Int32
+	err := pool.extract(context.Background(), apps, func(AppInfo) string {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(time.Millisecond)
+		return "icon"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := peak.Load(); p > 3 {
+		t.Errorf("%d extractions ran at once, want at most 3", p)
+	}
+
+	// Every slot is held by a call that never returns.
+	for i := 0; i < cap(pool.slots); i++ {
+		pool.slots <- struct{}{}
+	}
+	pool.timeout = 20 * time.Millisecond
+	apps = make([]AppInfo, 4)
+	err = pool.extract(context.Background(), apps, func(AppInfo) string { return "icon" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, app := range apps {
+		if app.Icon != "" {
+			t.Errorf("app %d has icon %q without a slot", i, app.Icon)
+		}
+	}
+}
+
+func TestSetIconWorkers(t *testing.T) {
+	defer SetIconWorkers(DefaultIconWorkers)
+	for _, tt := range []struct{ set, want int }{{4, 4}, {0, 1}, {-3, 1}, {100, maxIconWorkers}} {
+		SetIconWorkers(tt.set)
+		if got := newIconPool().workers; got != tt.want {
+			t.Errorf("SetIconWorkers(%d): %d workers, want %d", tt.set, got, tt.want)
+		}
+	}
+}
@@ -1,11 +1,8 @@
 package splittunnel
 
 import (
-	"bytes"
 	"encoding/base64"
 	"errors"
-	"image"
-	"image/png"
 	"os"
 	"path/filepath"
 	"syscall"
@@ -19,8 +16,6 @@ var (
 	procExtractIconExW = modShell32.NewProc("ExtractIconExW")
 	procDestroyIcon    = modUser32.NewProc("DestroyIcon")
 	procGetIconInfo    = modUser32.NewProc("GetIconInfo")
-	procGetDC          = modUser32.NewProc("GetDC")
-	procReleaseDC      = modUser32.NewProc("ReleaseDC")
 	procCreateCompatDC = modGdi32.NewProc("CreateCompatibleDC")
 	procDeleteDC       = modGdi32.NewProc("DeleteDC")
 	procGetObjectW     = modGdi32.NewProc("GetObjectW")
@@ -63,8 +58,9 @@ type winBITMAPINFOHEADER struct {
 }
 
 // extractIconBase64 extracts the first icon from an exe file and returns it
-// as a base64-encoded PNG string. Returns "" on any failure.
-func extractIconBase64(exePath string) string {
+// as a base64-encoded PNG of size×size pixels (see encodeIcon). Returns ""
+// on any failure.
+func extractIconBase64(exePath string, size int) string {
 	if exePath == "" {
 		return ""
 	}
@@ -106,7 +102,7 @@ func extractIconBase64(exePath string) string {
 		return ""
 	}
 
-	pngData, err := hIconToPNG(hIcon)
+	pngData, err := hIconToPNG(hIcon, size)
 	if err != nil {
 		return ""
 	}
@@ -114,7 +110,7 @@ func extractIconBase64(exePath string) string {
 	return base64.StdEncoding.EncodeToString(pngData)
 }
 
-func hIconToPNG(hIcon uintptr) ([]byte, error) {
+func hIconToPNG(hIcon uintptr, size int) ([]byte, error) {
 	var ii winICONINFO
 	ret, _, _ := procGetIconInfo.Call(hIcon, uintptr(unsafe.Pointer(&ii)))
 	if ret == 0 {
@@ -142,13 +138,9 @@ func hIconToPNG(hIcon uintptr) ([]byte, error) {
 		return nil, errors.New("invalid bitmap size")
 	}
 
-	hdc, _, _ := procGetDC.Call(0)
-	if hdc == 0 {
-		return nil, errors.New("GetDC failed")
-	}
-	defer procReleaseDC.Call(0, hdc)
-
-	memDC, _, _ := procCreateCompatDC.Call(hdc)
+	// A memory DC compatible with the screen, without holding the screen
+	// DC itself while extractions run in parallel.
+	memDC, _, _ := procCreateCompatDC.Call(0)
 	if memDC == 0 {
 		return nil, errors.New("CreateCompatibleDC failed")
 	}
@@ -162,8 +154,7 @@ func hIconToPNG(hIcon uintptr) ([]byte, error) {
 		BitCount: 32,
 	}
 
-	pixelCount := w * h * 4
-	pixels := make([]byte, pixelCount)
+	pixels := make([]byte, w*h*4)
 	ret, _, _ = procGetDIBits.Call(
 		memDC,
 		ii.HbmColor,
@@ -177,33 +168,7 @@ func hIconToPNG(hIcon uintptr) ([]byte, error) {
 		return nil, errors.New("GetDIBits failed")
 	}
 
-	// Check if alpha channel has data (some icons have all-zero alpha).
-	hasAlpha := false
-	for i := 3; i < pixelCount; i += 4 {
-		if pixels[i] != 0 {
-			hasAlpha = true
-			break
-		}
-	}
-
-	// Convert BGRA → RGBA.
-	img := image.NewRGBA(image.Rect(0, 0, w, h))
-	for i := 0; i < pixelCount; i += 4 {
-		img.Pix[i+0] = pixels[i+2] // R ← B
-		img.Pix[i+1] = pixels[i+1] // G
-		img.Pix[i+2] = pixels[i+0] // B ← R
-		if hasAlpha {
-			img.Pix[i+3] = pixels[i+3]
-		} else {
-			img.Pix[i+3] = 255
-		}
-	}
-
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, img); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return encodeIcon(bgraToRGBA(pixels, w, h), size, maxIconBytes)
 }
 
 // resolveExePath attempts to build the full path to an application executable.
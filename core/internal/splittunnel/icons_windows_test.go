@@ -0,0 +1,104 @@
+package splittunnel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var (
+	modKernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procGetCurrentProc  = modKernel32.NewProc("GetCurrentProcess")
+	procGetGuiResources = modUser32.NewProc("GetGuiResources")
+)
+
+const (
+	grGDIObjects  = 0
+	grUserObjects = 1
+)
+
+func guiResources(kind uintptr) int {
+	proc, _, _ := procGetCurrentProc.Call()
+	n, _, _ := procGetGuiResources.Call(proc, kind)
+	return int(n)
+}
+
+// systemApps returns up to n apps for the executables in System32, a
+// synthetic listing that exists on every machine.
+func systemApps(t testing.TB, n int) []AppInfo {
+	dir := filepath.Join(os.Getenv("SystemRoot"), "System32")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Skip(err)
+	}
+	var apps []AppInfo
+	for _, e := range entries {
+		if len(apps) == n {
+			break
+		}
+		if !e.IsDir() && strings.EqualFold(filepath.Ext(e.Name()), ".exe") {
+			apps = append(apps, AppInfo{ExeName: e.Name(), InstallPath: dir})
+		}
+	}
+	if len(apps) < 20 {
+		t.Skipf("only %d executables in %s", len(apps), dir)
+	}
+	return apps
+}
+
+func extractSystemIcon(app AppInfo) string {
+	return extractIconBase64(resolveExePath(app), IconSizeSmall)
+}
+
+// TestIconExtractionReleasesHandles lists icons for a few hundred
+// executables in parallel and checks the GDI and USER handle counts
+// return to where they started.
+func TestIconExtractionReleasesHandles(t *testing.T) {
+	apps := systemApps(t, 300)
+	// Load the DLLs and any per-process GDI state first.
+	extractSystemIcon(apps[0])
+	gdi, user := guiResources(grGDIObjects), guiResources(grUserObjects)
+
+	pool := testIconPool(maxIconWorkers, 10*time.Second, iconCallBudget)
+	if err := pool.extract(context.Background(), apps, extractSystemIcon); err != nil {
+		t.Fatal(err)
+	}
+	withIcon := 0
+	for _, app := range apps {
+		if app.Icon != "" {
+			withIcon++
+		}
+	}
+	t.Logf("%d of %d executables have icons", withIcon, len(apps))
+
+	const tolerance = 2
+	if got := guiResources(grGDIObjects); got > gdi+tolerance {
+		t.Errorf("GDI objects: %d before, %d after", gdi, got)
+	}
+	if got := guiResources(grUserObjects); got > user+tolerance {
+		t.Errorf("USER objects: %d before, %d after", user, got)
+	}
+}
+
+func BenchmarkIconExtraction(b *testing.B) {
+	apps := systemApps(b, 100)
+	for _, workers := range []int{1, DefaultIconWorkers} {
+		name := "sequential"
+		if workers > 1 {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			pool := testIconPool(workers, 10*time.Second, iconCallBudget)
+			for i := 0; i < b.N; i++ {
+				listing := append([]AppInfo(nil), apps...)
+				if err := pool.extract(context.Background(), listing, extractSystemIcon); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
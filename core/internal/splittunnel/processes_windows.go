@@ -0,0 +1,46 @@
+package splittunnel
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// ListRunningApps returns the executables of running processes. Paths of
+// processes the service cannot open (protected processes) are left empty.
+func ListRunningApps() ([]RunningApp, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("CreateToolhelp32Snapshot: %w", err)
+	}
+	defer windows.CloseHandle(snapshot)
+
+	var apps []RunningApp
+	entry := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+		apps = append(apps, RunningApp{
+			ExeName: windows.UTF16ToString(entry.ExeFile[:]),
+			Path:    processImagePath(entry.ProcessID),
+		})
+	}
+	if err != windows.ERROR_NO_MORE_FILES {
+		return apps, fmt.Errorf("Process32Next: %w", err)
+	}
+	return apps, nil
+}
+
+func processImagePath(pid uint32) string {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h)
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return ""
+	}
+	return windows.UTF16ToString(buf[:size])
+}
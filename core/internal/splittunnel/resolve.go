@@ -0,0 +1,260 @@
+package splittunnel
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// uninstallPaths are the Uninstall keys under each hive, 64-bit and 32-bit.
+var uninstallPaths = []string{
+	`SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`,
+	`SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`,
+}
+
+// registryReader reads keys of one registry hive, so app discovery runs
+// against fixture data in tests.
+type registryReader interface {
+	subKeyNames(path string) ([]string, error)
+	stringValue(path, name string) string
+}
+
+// uninstallEntry is the part of an Uninstall subkey that identifies an app.
+type uninstallEntry struct {
+	Key             string // subkey name; the product code of MSI installs
+	DisplayName     string
+	InstallLocation string
+	DisplayIcon     string
+	UninstallString string
+}
+
+// readUninstallEntries returns the named entries under the Uninstall keys
+// of r.
+func readUninstallEntries(r registryReader) []uninstallEntry {
+	var entries []uninstallEntry
+	for _, regPath := range uninstallPaths {
+		subKeys, err := r.subKeyNames(regPath)
+		if err != nil {
+			continue
+		}
+		for _, name := range subKeys {
+			path := regPath + `\` + name
+			e := uninstallEntry{
+				Key:             name,
+				DisplayName:     r.stringValue(path, "DisplayName"),
+				InstallLocation: r.stringValue(path, "InstallLocation"),
+				DisplayIcon:     r.stringValue(path, "DisplayIcon"),
+				UninstallString: r.stringValue(path, "UninstallString"),
+			}
+			if e.DisplayName != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries
+}
+
+// appResolver finds the exe of an Uninstall entry on disk.
+type appResolver struct {
+	// localAppData is %LocalAppData%, where per-user installers put apps
+	// under Programs. Empty skips that guess.
+	localAppData string
+	// msiInstallLocation returns the install directory Windows Installer
+	// recorded for a product code, or "".
+	msiInstallLocation func(productCode string) string
+}
+
+// resolve determines the exe name and its directory from registry values.
+// Handles normal installs, DisplayIcon paths, Squirrel/Electron apps
+// (Discord, Telegram, Slack, VS Code, etc.) where the real exe lives in an
+// app-<version> subdirectory, and per-user installs that leave
+// InstallLocation empty (Spotify, WhatsApp).
+func (r *appResolver) resolve(e uninstallEntry) (exeName string, exeDir string) {
+	// Strategy 1: DisplayIcon points directly to an exe.
+	icon := ""
+	if e.DisplayIcon != "" {
+		icon = strings.Split(e.DisplayIcon, ",")[0]
+		icon = strings.Trim(icon, `"`)
+		if strings.HasSuffix(strings.ToLower(icon), ".exe") {
+			base := filepath.Base(icon)
+			// Skip generic updaters — we want the real app exe.
+			if !isUpdaterExe(base) {
+				if _, err := os.Stat(icon); err == nil {
+					return base, filepath.Dir(icon)
+				}
+			}
+		}
+	}
+
+	// Strategies 2 and 3: the exe in InstallLocation.
+	if exe, dir := findAppExe(e.InstallLocation, e.DisplayName); exe != "" {
+		return exe, dir
+	}
+
+	// Strategy 4: Derive from UninstallString path.
+	if e.UninstallString != "" {
+		uPath := strings.Split(e.UninstallString, " ")[0]
+		uPath = strings.Trim(uPath, `"`)
+		if strings.HasSuffix(strings.ToLower(uPath), ".exe") && !isUpdaterExe(filepath.Base(uPath)) {
+			if _, err := os.Stat(uPath); err == nil {
+				return filepath.Base(uPath), filepath.Dir(uPath)
+			}
+		}
+	}
+
+	// Strategy 5: DisplayIcon is an .ico next to the app's exe.
+	if strings.HasSuffix(strings.ToLower(icon), ".ico") {
+		dir := filepath.Dir(icon)
+		if exe := findNamedExeInDir(dir, e.DisplayName); exe != "" {
+			return filepath.Base(exe), dir
+		}
+	}
+
+	// Strategy 6: ask Windows Installer where an MSI install went.
+	if code := msiProductCode(e); code != "" && r.msiInstallLocation != nil {
+		if exe, dir := findAppExe(r.msiInstallLocation(code), e.DisplayName); exe != "" {
+			return exe, dir
+		}
+	}
+
+	// Strategy 7: guess the usual per-user location.
+	if r.localAppData != "" && isPlainName(e.DisplayName) {
+		if exe, dir := findAppExe(filepath.Join(r.localAppData, "Programs", e.DisplayName), e.DisplayName); exe != "" {
+			return exe, dir
+		}
+	}
+
+	return "", ""
+}
+
+// findAppExe looks for the main exe of the app installed in dir: in the
+// latest Squirrel app-<version> subdirectory, then in dir itself.
+func findAppExe(dir, displayName string) (exeName string, exeDir string) {
+	if dir == "" {
+		return "", ""
+	}
+	// Squirrel/Electron pattern — look in app-* subdirectories.
+	// These apps (Discord, Telegram Desktop, Slack, etc.) have:
+	//   InstallLocation/app-<version>/<AppName>.exe
+	//   UninstallString contains Update.exe --uninstall
+	if exe := findExeInSquirrelApp(dir, displayName); exe != "" {
+		return filepath.Base(exe), filepath.Dir(exe)
+	}
+	// Direct exe in the directory (skip updaters).
+	if exe := findMainExeInDir(dir); exe != "" {
+		return exe, dir
+	}
+	return "", ""
+}
+
+// isPlainName reports whether a display name can be used as a directory
+// name as is.
+func isPlainName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `\/:*?"<>|`)
+}
+
+var productCodePattern = regexp.MustCompile(`\{[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}\}`)
+
+// msiProductCode returns the product code of an entry whose uninstaller is
+// msiexec, such as "MsiExec.exe /X{...}", or "" for other installers.
+func msiProductCode(e uninstallEntry) string {
+	if !strings.Contains(strings.ToLower(e.UninstallString), "msiexec") {
+		return ""
+	}
+	if code := productCodePattern.FindString(e.UninstallString); code != "" {
+		return strings.ToUpper(code)
+	}
+	if productCodePattern.MatchString(e.Key) && len(e.Key) == 38 {
+		return strings.ToUpper(e.Key)
+	}
+	return ""
+}
+
+// findExeInSquirrelApp looks for app-<version> subdirectories (Squirrel pattern)
+// and returns the path to the main exe inside the latest one.
+func findExeInSquirrelApp(dir, displayName string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	// Find the latest app-* directory (sorted descending by name → latest version).
+	var latestAppDir string
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.IsDir() && strings.HasPrefix(e.Name(), "app-") {
+			latestAppDir = filepath.Join(dir, e.Name())
+			break
+		}
+	}
+	if latestAppDir == "" {
+		return ""
+	}
+	return findNamedExeInDir(latestAppDir, displayName)
+}
+
+// findNamedExeInDir returns the path of an exe in dir, preferring one
+// matching the display name, and skipping known updaters.
+func findNamedExeInDir(dir, displayName string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	nameLower := strings.ToLower(strings.ReplaceAll(displayName, " ", ""))
+	var fallback string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		n := e.Name()
+		nLower := strings.ToLower(n)
+		if !strings.HasSuffix(nLower, ".exe") || isUpdaterExe(n) {
+			continue
+		}
+		// Prefer exe whose name matches the display name.
+		stripped := strings.ToLower(strings.TrimSuffix(n, filepath.Ext(n)))
+		stripped = strings.ReplaceAll(stripped, " ", "")
+		if stripped == nameLower || strings.Contains(nameLower, stripped) {
+			return filepath.Join(dir, n)
+		}
+		if fallback == "" {
+			fallback = filepath.Join(dir, n)
+		}
+	}
+
+	return fallback
+}
+
+// findMainExeInDir finds the main exe in a directory, skipping known updaters.
+func findMainExeInDir(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if strings.HasSuffix(strings.ToLower(name), ".exe") && !isUpdaterExe(name) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// isUpdaterExe returns true for known updater/helper executables that should
+// be skipped in favor of the real application exe.
+func isUpdaterExe(name string) bool {
+	lower := strings.ToLower(name)
+	return lower == "update.exe" ||
+		lower == "unins000.exe" ||
+		lower == "uninstall.exe" ||
+		strings.Contains(lower, "updater") ||
+		strings.Contains(lower, "uninstall") ||
+		strings.Contains(lower, "helper")
+}
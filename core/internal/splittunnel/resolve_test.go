@@ -0,0 +1,171 @@
+package splittunnel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeRegistry is a hive of fixture keys: key path to value name to value.
+type fakeRegistry map[string]map[string]string
+
+func (r fakeRegistry) subKeyNames(path string) ([]string, error) {
+	var names []string
+	for key := range r {
+		if rest, ok := strings.CutPrefix(key, path+`\`); ok && !strings.Contains(rest, `\`) {
+			names = append(names, rest)
+		}
+	}
+	if names == nil {
+		return nil, os.ErrNotExist
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r fakeRegistry) stringValue(path, name string) string {
+	return r[path][name]
+}
+
+// touch creates the files under dir, making parent directories.
+func touch(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadUninstallEntries(t *testing.T) {
+	reg := fakeRegistry{
+		uninstallPaths[0] + `\Spotify`: {
+			"DisplayName": "Spotify",
+			"DisplayIcon": `C:\Users\u\AppData\Roaming\Spotify\Spotify.exe`,
+		},
+		uninstallPaths[0] + `\KB123`:      {"UninstallString": "wusa.exe"}, // no DisplayName
+		uninstallPaths[1] + `\{GUID}`:     {"DisplayName": "Tool", "InstallLocation": `C:\Tool`},
+		uninstallPaths[1] + `\{GUID}\Sub`: {"DisplayName": "Nested"},
+	}
+	want := []uninstallEntry{
+		{Key: "Spotify", DisplayName: "Spotify", DisplayIcon: `C:\Users\u\AppData\Roaming\Spotify\Spotify.exe`},
+		{Key: "{GUID}", DisplayName: "Tool", InstallLocation: `C:\Tool`},
+	}
+	if got := readUninstallEntries(reg); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %+v, want %+v", got, want)
+	}
+}
+
+func TestResolveExeIcon(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "App/App.exe", "App/Update.exe")
+	r := &appResolver{}
+
+	exe, exeDir := r.resolve(uninstallEntry{DisplayName: "App", DisplayIcon: `"` + filepath.Join(dir, "App", "App.exe") + `",0`})
+	if exe != "App.exe" || exeDir != filepath.Join(dir, "App") {
+		t.Errorf("resolve = %q, %q", exe, exeDir)
+	}
+	// An updater icon falls through to the other strategies.
+	exe, _ = r.resolve(uninstallEntry{DisplayName: "App", DisplayIcon: filepath.Join(dir, "App", "Update.exe")})
+	if exe != "" {
+		t.Errorf("resolve = %q, want nothing", exe)
+	}
+}
+
+func TestResolveInstallLocation(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "Discord/Update.exe", "Discord/app-1.0.1/Discord.exe", "Discord/app-1.0.9/Discord.exe",
+		"Discord/app-1.0.9/crashpad.exe", "Tool/unins000.exe", "Tool/tool.exe")
+	r := &appResolver{}
+
+	exe, exeDir := r.resolve(uninstallEntry{DisplayName: "Discord", InstallLocation: filepath.Join(dir, "Discord")})
+	if exe != "Discord.exe" || exeDir != filepath.Join(dir, "Discord", "app-1.0.9") {
+		t.Errorf("squirrel: resolve = %q, %q", exe, exeDir)
+	}
+	exe, exeDir = r.resolve(uninstallEntry{DisplayName: "Tool", InstallLocation: filepath.Join(dir, "Tool")})
+	if exe != "tool.exe" || exeDir != filepath.Join(dir, "Tool") {
+		t.Errorf("direct: resolve = %q, %q", exe, exeDir)
+	}
+}
+
+func TestResolveIcoDisplayIcon(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "WhatsApp/app.ico", "WhatsApp/crashreporter.exe", "WhatsApp/WhatsApp.exe")
+	r := &appResolver{}
+
+	exe, exeDir := r.resolve(uninstallEntry{DisplayName: "WhatsApp", DisplayIcon: filepath.Join(dir, "WhatsApp", "app.ico")})
+	if exe != "WhatsApp.exe" || exeDir != filepath.Join(dir, "WhatsApp") {
+		t.Errorf("resolve = %q, %q", exe, exeDir)
+	}
+	if exe, _ := r.resolve(uninstallEntry{DisplayName: "Gone", DisplayIcon: filepath.Join(dir, "Gone", "app.ico")}); exe != "" {
+		t.Errorf("missing directory: resolve = %q", exe)
+	}
+}
+
+func TestMSIProductCode(t *testing.T) {
+	const code = "{8A69D345-D564-463C-AFF1-A69D9E530F96}"
+	tests := []struct {
+		entry uninstallEntry
+		want  string
+	}{
+		{uninstallEntry{UninstallString: "MsiExec.exe /X" + code}, code},
+		{uninstallEntry{UninstallString: "MsiExec.exe /I" + strings.ToLower(code)}, code},
+		{uninstallEntry{Key: code, UninstallString: `"C:\Windows\System32\msiexec.exe" /uninstall`}, code},
+		{uninstallEntry{Key: code, UninstallString: `"C:\App\uninstall.exe"`}, ""},
+		{uninstallEntry{Key: "App", UninstallString: "msiexec.exe /x"}, ""},
+	}
+	for _, tt := range tests {
+		if got := msiProductCode(tt.entry); got != tt.want {
+			t.Errorf("msiProductCode(%+v) = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestResolveMSI(t *testing.T) {
+	const code = "{8A69D345-D564-463C-AFF1-A69D9E530F96}"
+	dir := t.TempDir()
+	touch(t, dir, "Tool/Tool.exe")
+	var asked string
+	r := &appResolver{msiInstallLocation: func(productCode string) string {
+		asked = productCode
+		if productCode == code {
+			return filepath.Join(dir, "Tool")
+		}
+		return ""
+	}}
+
+	exe, exeDir := r.resolve(uninstallEntry{DisplayName: "Tool", UninstallString: "MsiExec.exe /X" + code})
+	if exe != "Tool.exe" || exeDir != filepath.Join(dir, "Tool") || asked != code {
+		t.Errorf("resolve = %q, %q (asked %q)", exe, exeDir, asked)
+	}
+	asked = ""
+	if exe, _ := r.resolve(uninstallEntry{DisplayName: "Tool", UninstallString: `C:\Tool\remove.cmd`}); exe != "" || asked != "" {
+		t.Errorf("non-MSI entry: resolve = %q (asked %q)", exe, asked)
+	}
+}
+
+func TestResolveLocalAppDataPrograms(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "Programs/Signal/Signal.exe", "Programs/Signal/Uninstall Signal.exe")
+	r := &appResolver{localAppData: dir}
+
+	exe, exeDir := r.resolve(uninstallEntry{DisplayName: "Signal"})
+	if exe != "Signal.exe" || exeDir != filepath.Join(dir, "Programs", "Signal") {
+		t.Errorf("resolve = %q, %q", exe, exeDir)
+	}
+	for _, name := range []string{"Other", "..", `Signal\..\Signal`} {
+		if exe, _ := r.resolve(uninstallEntry{DisplayName: name}); exe != "" {
+			t.Errorf("resolve(%q) = %q, want nothing", name, exe)
+		}
+	}
+	if exe, _ := (&appResolver{}).resolve(uninstallEntry{DisplayName: "Signal"}); exe != "" {
+		t.Errorf("without LocalAppData: resolve = %q", exe)
+	}
+}
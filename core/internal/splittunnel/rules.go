@@ -1,6 +1,12 @@
 package splittunnel
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp/syntax"
+	"strings"
+)
 
 // sanitizeDomain strips protocol, path, port from a domain string.
 // Handles cases where user pastes a URL instead of a bare domain.
@@ -21,10 +27,91 @@ func sanitizeDomain(d string) string {
 	return strings.TrimSpace(d)
 }
 
+// NormalizeAppName reduces a user-supplied app entry to the bare process
+// name sing-box matches on: surrounding space and any directory are
+// removed, so "C:\Program Files\App\app.exe" becomes "app.exe".
+func NormalizeAppName(name string) string {
+	name = strings.Trim(strings.TrimSpace(name), `"`)
+	if idx := strings.LastIndexAny(name, `\/`); idx != -1 {
+		name = name[idx+1:]
+	}
+	return strings.TrimSpace(name)
+}
+
+// normalizeApps applies NormalizeAppName and drops empty entries.
+func normalizeApps(apps []string) []string {
+	var out []string
+	for _, app := range apps {
+		if app = NormalizeAppName(app); app != "" {
+			out = append(out, app)
+		}
+	}
+	return out
+}
+
+// ParseDNSExceptions splits DNS hijack exceptions into process names and
+// destination CIDRs. Entries that parse as an IP or CIDR are destinations;
+// everything else is normalized as an app name.
+func ParseDNSExceptions(entries []string) (apps, cidrs []string, err error) {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			if ip.To4() != nil {
+				cidrs = append(cidrs, entry+"/32")
+			} else {
+				cidrs = append(cidrs, entry+"/128")
+			}
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			cidrs = append(cidrs, ipnet.String())
+			continue
+		}
+		app := NormalizeAppName(entry)
+		if app == "" || strings.ContainsAny(app, `:*?<>|`) {
+			return nil, nil, fmt.Errorf("invalid DNS exception: %q is neither an app name nor an IP", entry)
+		}
+		apps = append(apps, app)
+	}
+	return apps, cidrs, nil
+}
+
+// BuildDNSExceptionRules generates route rules that send port-53 traffic of
+// the excepted apps and destinations direct. They must precede the DNS
+// hijack rule, which would otherwise capture the traffic first. Apps and
+// destinations are separate rules because sing-box ANDs process and IP
+// conditions within one rule.
+func BuildDNSExceptionRules(entries []string) []interface{} {
+	apps, cidrs, err := ParseDNSExceptions(entries)
+	if err != nil {
+		return nil
+	}
+	var rules []interface{}
+	if len(apps) > 0 {
+		rules = append(rules, map[string]interface{}{
+			"port":         53,
+			"process_name": apps,
+			"outbound":     "direct",
+		})
+	}
+	if len(cidrs) > 0 {
+		rules = append(rules, map[string]interface{}{
+			"port":     53,
+			"ip_cidr":  cidrs,
+			"outbound": "direct",
+		})
+	}
+	return rules
+}
+
 // BuildAppRules generates sing-box route rules for per-app split tunneling.
 // If invert is false ("only selected apps use VPN"): selected -> proxy
 // If invert is true ("all except selected use VPN"): selected -> direct
 func BuildAppRules(apps []string, invert bool) []interface{} {
+	apps = normalizeApps(apps)
 	if len(apps) == 0 {
 		return nil
 	}
@@ -42,12 +129,114 @@ func BuildAppRules(apps []string, invert bool) []interface{} {
 	}
 }
 
+// Prefixes of domain entries that are not domains.
+const (
+	keywordPrefix = "keyword:" // the domain contains the text
+	regexPrefix   = "regex:"   // the domain matches the expression
+)
+
+// Caps on domain_regex entries. Go's RE2 engine runs in linear time, but
+// a short expression with counted repetitions can still compile into a
+// program big enough to slow every connection's match.
+const (
+	maxDomainRegexLen  = 256
+	maxDomainRegexInst = 2000
+)
+
+// DomainMatch is a domain list sorted into the sing-box rule fields.
+type DomainMatch struct {
+	Domains  []string // domain
+	Suffixes []string // domain_suffix
+	Keywords []string // domain_keyword
+	Regexes  []string // domain_regex
+}
+
+// DomainEntryError is an invalid entry of a domain list.
+type DomainEntryError struct {
+	Index  int // position in the list
+	Entry  string
+	Reason string
+}
+
+func (e *DomainEntryError) Error() string {
+	return fmt.Sprintf("domain entry %d (%q): %s", e.Index, e.Entry, e.Reason)
+}
+
+// ParseDomains sorts split tunnel domain entries into rule fields.
+// "keyword:text" matches domains containing text and "regex:expr" domains
+// matching expr; anything else is a domain, matched with its subdomains,
+// or a suffix if it starts with a dot. Plain entries are never refused,
+// only dropped if nothing is left of them.
+func ParseDomains(domains []string) (DomainMatch, error) {
+	var m DomainMatch
+	for i, entry := range domains {
+		trimmed := strings.TrimSpace(entry)
+		lower := strings.ToLower(trimmed)
+		switch {
+		case strings.HasPrefix(lower, keywordPrefix):
+			keyword := strings.ToLower(strings.TrimSpace(trimmed[len(keywordPrefix):]))
+			if keyword == "" || strings.ContainsAny(keyword, " \t/") {
+				return DomainMatch{}, &DomainEntryError{Index: i, Entry: entry, Reason: "keyword must be non-empty text without spaces or slashes"}
+			}
+			m.Keywords = append(m.Keywords, keyword)
+		case strings.HasPrefix(lower, regexPrefix):
+			expr := strings.TrimSpace(trimmed[len(regexPrefix):])
+			if err := checkDomainRegex(expr); err != nil {
+				return DomainMatch{}, &DomainEntryError{Index: i, Entry: entry, Reason: err.Error()}
+			}
+			m.Regexes = append(m.Regexes, expr)
+		default:
+			d := sanitizeDomain(entry)
+			if d == "" {
+				continue
+			}
+			if d[0] == '.' {
+				m.Suffixes = append(m.Suffixes, d[1:])
+			} else {
+				// Treat as both exact domain and suffix
+				m.Domains = append(m.Domains, d)
+				m.Suffixes = append(m.Suffixes, d)
+			}
+		}
+	}
+	return m, nil
+}
+
+// checkDomainRegex compiles expr with the RE2 syntax sing-box uses and
+// refuses expressions over the size caps.
+func checkDomainRegex(expr string) error {
+	if expr == "" {
+		return errors.New("regex is empty")
+	}
+	if len(expr) > maxDomainRegexLen {
+		return fmt.Errorf("regex is longer than %d characters", maxDomainRegexLen)
+	}
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("invalid regex: %w", err)
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return fmt.Errorf("invalid regex: %w", err)
+	}
+	if len(prog.Inst) > maxDomainRegexInst {
+		return errors.New("regex is too complex")
+	}
+	return nil
+}
+
 // BuildDomainRules generates sing-box route rules for per-domain split tunneling.
 // If invert is false ("only selected domains use VPN"): selected -> proxy
 // If invert is true ("all except selected use VPN"): selected -> direct
-func BuildDomainRules(domains []string, invert bool) []interface{} {
-	if len(domains) == 0 {
-		return nil
+// sing-box matches a rule if any of its domain fields does, so one rule
+// carries them all.
+func BuildDomainRules(domains []string, invert bool) ([]interface{}, error) {
+	m, err := ParseDomains(domains)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Domains)+len(m.Suffixes)+len(m.Keywords)+len(m.Regexes) == 0 {
+		return nil, nil
 	}
 
 	outbound := "proxy"
@@ -55,34 +244,22 @@ func BuildDomainRules(domains []string, invert bool) []interface{} {
 		outbound = "direct"
 	}
 
-	// Separate full domains from suffixes
-	var fullDomains []string
-	var domainSuffixes []string
-
-	for _, d := range domains {
-		d = sanitizeDomain(d)
-		if d == "" {
-			continue
-		}
-		if d[0] == '.' {
-			domainSuffixes = append(domainSuffixes, d[1:])
-		} else {
-			// Treat as both exact domain and suffix
-			fullDomains = append(fullDomains, d)
-			domainSuffixes = append(domainSuffixes, d)
-		}
-	}
-
 	rule := map[string]interface{}{
 		"outbound": outbound,
 	}
 
-	if len(fullDomains) > 0 {
-		rule["domain"] = fullDomains
+	if len(m.Domains) > 0 {
+		rule["domain"] = m.Domains
+	}
+	if len(m.Suffixes) > 0 {
+		rule["domain_suffix"] = m.Suffixes
+	}
+	if len(m.Keywords) > 0 {
+		rule["domain_keyword"] = m.Keywords
 	}
-	if len(domainSuffixes) > 0 {
-		rule["domain_suffix"] = domainSuffixes
+	if len(m.Regexes) > 0 {
+		rule["domain_regex"] = m.Regexes
 	}
 
-	return []interface{}{rule}
+	return []interface{}{rule}, nil
 }
@@ -0,0 +1,127 @@
+package splittunnel
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAppName(t *testing.T) {
+	tests := map[string]string{
+		"chrome.exe":                             "chrome.exe",
+		"  steam.exe ":                           "steam.exe",
+		`C:\Program Files\Corp VPN\vpnagent.exe`: "vpnagent.exe",
+		`"C:\Games\launcher.exe"`:                "launcher.exe",
+		"/usr/bin/app":                           "app",
+		`C:\dir\`:                                "",
+	}
+	for in, want := range tests {
+		if got := NormalizeAppName(in); got != want {
+			t.Errorf("NormalizeAppName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseDNSExceptions(t *testing.T) {
+	apps, cidrs, err := ParseDNSExceptions([]string{
+		`C:\Corp\vpnagent.exe`, "10.0.0.53", "fd00::53", "192.168.10.0/24", " ", "launcher.exe",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"vpnagent.exe", "launcher.exe"}; !reflect.DeepEqual(apps, want) {
+		t.Errorf("apps = %v, want %v", apps, want)
+	}
+	if want := []string{"10.0.0.53/32", "fd00::53/128", "192.168.10.0/24"}; !reflect.DeepEqual(cidrs, want) {
+		t.Errorf("cidrs = %v, want %v", cidrs, want)
+	}
+
+	for _, bad := range []string{"app?.exe", "10.0.0.1:53", `C:\dir\`} {
+		if _, _, err := ParseDNSExceptions([]string{bad}); err == nil {
+			t.Errorf("ParseDNSExceptions(%q) accepted invalid entry", bad)
+		}
+	}
+}
+
+func TestBuildDNSExceptionRules(t *testing.T) {
+	rules := BuildDNSExceptionRules([]string{"game.exe", "1.1.1.1"})
+	if len(rules) != 2 {
+		t.Fatalf("rules = %v, want separate app and IP rules", rules)
+	}
+	app := rules[0].(map[string]interface{})
+	ip := rules[1].(map[string]interface{})
+	if app["port"] != 53 || app["outbound"] != "direct" || app["ip_cidr"] != nil {
+		t.Errorf("app rule = %v", app)
+	}
+	if ip["port"] != 53 || ip["outbound"] != "direct" || ip["process_name"] != nil {
+		t.Errorf("ip rule = %v", ip)
+	}
+	if BuildDNSExceptionRules(nil) != nil {
+		t.Error("no exceptions should yield no rules")
+	}
+}
+
+func TestBuildDomainRules(t *testing.T) {
+	// Plain entries behave as before: domains match with their
+	// subdomains, a leading dot only the subdomains.
+	rules, err := BuildDomainRules([]string{"https://Example.com/path", ".corp.example", " "}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"outbound":      "proxy",
+		"domain":        []string{"Example.com"},
+		"domain_suffix": []string{"Example.com", "corp.example"},
+	}
+	if len(rules) != 1 || !reflect.DeepEqual(rules[0], want) {
+		t.Errorf("plain rules = %v, want %v", rules, want)
+	}
+
+	rules, err = BuildDomainRules([]string{
+		"example.com", "keyword: TikTok", `regex:^cdn-[0-9]+\.example\.net$`, "Keyword:ads",
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]interface{}{
+		"outbound":       "direct",
+		"domain":         []string{"example.com"},
+		"domain_suffix":  []string{"example.com"},
+		"domain_keyword": []string{"tiktok", "ads"},
+		"domain_regex":   []string{`^cdn-[0-9]+\.example\.net$`},
+	}
+	if len(rules) != 1 || !reflect.DeepEqual(rules[0], want) {
+		t.Errorf("mixed rules = %v, want %v", rules, want)
+	}
+
+	if rules, err := BuildDomainRules([]string{"", "/"}, false); rules != nil || err != nil {
+		t.Errorf("empty entries = %v, %v; want no rules", rules, err)
+	}
+}
+
+func TestBuildDomainRulesRejectsInvalidEntries(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+	}{
+		{"regex:(cdn", "invalid regex"},
+		{"regex:", "empty"},
+		{"regex:" + strings.Repeat("a", maxDomainRegexLen+1), "longer than"},
+		{"regex:(a{1,100}){1,100}", "invalid regex"}, // over RE2's repeat limit
+		{"regex:([a-z]{1,30}){1,33}", "too complex"},
+		{"keyword:", "keyword"},
+		{"keyword:two words", "keyword"},
+	}
+	for _, tt := range tests {
+		_, err := BuildDomainRules([]string{"example.com", "keyword:ok", tt.entry}, false)
+		var entryErr *DomainEntryError
+		if !errors.As(err, &entryErr) {
+			t.Errorf("%q: error %v, want a DomainEntryError", tt.entry, err)
+			continue
+		}
+		if entryErr.Index != 2 || !strings.Contains(err.Error(), "domain entry 2") || !strings.Contains(entryErr.Reason, tt.want) {
+			t.Errorf("%q: %v, want entry 2 and %q", tt.entry, err, tt.want)
+		}
+	}
+}
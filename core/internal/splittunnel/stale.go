@@ -0,0 +1,101 @@
+package splittunnel
+
+import (
+	"sort"
+	"strings"
+)
+
+// Stale entry statuses.
+const (
+	StaleMissing = "missing" // no installed or running app has this exe name
+	StaleChanged = "changed" // apps with this exe name exist, but none at the recorded path
+)
+
+// AppInfo describes an installed Windows application. apps.list sends it
+// to the UI as is.
+type AppInfo struct {
+	Name        string `json:"name"`
+	ExeName     string `json:"exeName"`
+	InstallPath string `json:"installPath,omitempty"`
+	IsUWP       bool   `json:"isUwp"`
+	Icon        string `json:"icon,omitempty"` // base64 PNG
+}
+
+// RunningApp is the executable of a running process.
+type RunningApp struct {
+	ExeName string
+	Path    string // full image path; empty if the process could not be opened
+}
+
+// StaleEntry is a split tunnel app entry that no longer matches an app on
+// the system.
+type StaleEntry struct {
+	ExeName      string   `json:"exeName"`
+	Status       string   `json:"status"`
+	ExpectedPath string   `json:"expectedPath,omitempty"` // recorded when the app was selected
+	FoundPaths   []string `json:"foundPaths,omitempty"`   // same-named apps elsewhere, for StaleChanged
+}
+
+// FindStaleApps compares the selected exe names against installed and
+// running apps. knownPaths maps exe names to the path (directory or full
+// exe path) recorded when the user selected the app; entries without one
+// match any app of that name. Matching is case-insensitive.
+func FindStaleApps(selected []string, knownPaths map[string]string, installed []AppInfo, running []RunningApp) []StaleEntry {
+	// Directories each exe name was seen in; "" when the location is unknown.
+	found := make(map[string]map[string]bool)
+	add := func(exe, dir string) {
+		key := strings.ToLower(exe)
+		if found[key] == nil {
+			found[key] = make(map[string]bool)
+		}
+		found[key][dir] = true
+	}
+	for _, app := range installed {
+		if app.ExeName != "" {
+			add(app.ExeName, normalizeDir(app.InstallPath))
+		}
+	}
+	for _, p := range running {
+		if p.ExeName != "" {
+			add(p.ExeName, normalizeDir(p.Path))
+		}
+	}
+
+	paths := make(map[string]string, len(knownPaths))
+	for exe, path := range knownPaths {
+		paths[strings.ToLower(exe)] = path
+	}
+
+	stale := []StaleEntry{}
+	for _, exe := range selected {
+		key := strings.ToLower(exe)
+		dirs := found[key]
+		if len(dirs) == 0 {
+			stale = append(stale, StaleEntry{ExeName: exe, Status: StaleMissing, ExpectedPath: paths[key]})
+			continue
+		}
+		expected := normalizeDir(paths[key])
+		if expected == "" || dirs[expected] || dirs[""] {
+			continue // no recorded path, a match, or an app whose location is unknown
+		}
+		entry := StaleEntry{ExeName: exe, Status: StaleChanged, ExpectedPath: paths[key]}
+		for dir := range dirs {
+			entry.FoundPaths = append(entry.FoundPaths, dir)
+		}
+		sort.Strings(entry.FoundPaths)
+		stale = append(stale, entry)
+	}
+	return stale
+}
+
+// normalizeDir returns the lowercase directory of a Windows path, which may
+// be a directory or a full exe path.
+func normalizeDir(path string) string {
+	path = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(path), "/", `\`))
+	if strings.HasSuffix(path, ".exe") {
+		if i := strings.LastIndex(path, `\`); i >= 0 {
+			path = path[:i]
+		}
+	}
+	return strings.TrimRight(path, `\`)
+}
@@ -0,0 +1,72 @@
+package splittunnel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindStaleApps(t *testing.T) {
+	installed := []AppInfo{
+		{Name: "Google Chrome", ExeName: "chrome.exe", InstallPath: `C:\Program Files\Google\Chrome\Application`},
+		{Name: "Telegram", ExeName: "Telegram.exe", InstallPath: `C:\Users\me\AppData\Roaming\Telegram Desktop\`},
+		{Name: "Notes", ExeName: "notes.exe"}, // UWP: no install path
+		{Name: "Game Launcher", ExeName: "launcher.exe", InstallPath: `D:\Games\Other`},
+	}
+	running := []RunningApp{
+		{ExeName: "portable.exe", Path: `E:\Tools\portable.exe`},
+		{ExeName: "launcher.exe", Path: `D:\Games\Other\launcher.exe`},
+		{ExeName: "MsMpEng.exe"}, // protected; path unavailable
+	}
+
+	tests := []struct {
+		name     string
+		selected []string
+		paths    map[string]string
+		want     []StaleEntry
+	}{
+		{
+			name:     "all present without recorded paths",
+			selected: []string{"chrome.exe", "TELEGRAM.EXE", "notes.exe", "portable.exe"},
+			want:     []StaleEntry{},
+		},
+		{
+			name:     "uninstalled app",
+			selected: []string{"chrome.exe", "discord.exe"},
+			paths:    map[string]string{"discord.exe": `C:\Users\me\AppData\Local\Discord`},
+			want:     []StaleEntry{{ExeName: "discord.exe", Status: StaleMissing, ExpectedPath: `C:\Users\me\AppData\Local\Discord`}},
+		},
+		{
+			name:     "recorded paths match as directory or exe path",
+			selected: []string{"chrome.exe", "telegram.exe", "portable.exe"},
+			paths: map[string]string{
+				"chrome.exe":   `c:/program files/google/chrome/application/chrome.exe`,
+				"telegram.exe": `C:\Users\me\AppData\Roaming\Telegram Desktop`,
+				"portable.exe": `E:\Tools`,
+			},
+			want: []StaleEntry{},
+		},
+		{
+			name:     "same exe name at a different path",
+			selected: []string{"launcher.exe"},
+			paths:    map[string]string{"launcher.exe": `D:\Games\Mine\launcher.exe`},
+			want: []StaleEntry{{
+				ExeName:      "launcher.exe",
+				Status:       StaleChanged,
+				ExpectedPath: `D:\Games\Mine\launcher.exe`,
+				FoundPaths:   []string{`d:\games\other`},
+			}},
+		},
+		{
+			name:     "unknown location is not flagged as changed",
+			selected: []string{"notes.exe", "msmpeng.exe"},
+			paths:    map[string]string{"notes.exe": `C:\Elsewhere`, "msmpeng.exe": `C:\Elsewhere`},
+			want:     []StaleEntry{},
+		},
+	}
+	for _, tt := range tests {
+		got := FindStaleApps(tt.selected, tt.paths, installed, running)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got  %+v\n want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package sysproxy manages the WinINET proxy exception list ("Do not use
+// the proxy server for addresses beginning with"), stored per user as the
+// ProxyOverride value under Internet Settings.
+//
+// The value is a semicolon-separated list of host patterns with "*"
+// wildcards. The special token "<local>" bypasses host names without a dot.
+// WinINET has no CIDR syntax, so CIDR patterns are expanded to octet
+// wildcards.
+package sysproxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// LocalToken bypasses the proxy for plain host names such as "printer".
+const LocalToken = "<local>"
+
+const (
+	maxPatterns      = 200
+	maxPatternLength = 253
+	// maxExpansion bounds how many wildcards one CIDR may expand to.
+	maxExpansion = 64
+)
+
+// DefaultBypass is always applied: loopback, link-local and private
+// addresses, and plain host names.
+var DefaultBypass = []string{
+	LocalToken,
+	"localhost",
+	"127.*",
+	"10.*",
+	"172.16.0.0/12",
+	"192.168.*",
+	"169.254.*",
+}
+
+// Saved is the user's exception list as it was before the proxy was
+// enabled, restored verbatim on disable.
+type Saved struct {
+	Value   string
+	Present bool // false if the user had no ProxyOverride value
+}
+
+// Validate checks a list of user bypass patterns.
+func Validate(patterns []string) error {
+	if len(patterns) > maxPatterns {
+		return fmt.Errorf("at most %d bypass patterns are allowed", maxPatterns)
+	}
+	for _, p := range patterns {
+		if _, err := expand(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expand returns the WinINET entries for one pattern.
+func expand(pattern string) ([]string, error) {
+	p := strings.TrimSpace(pattern)
+	switch {
+	case p == "":
+		return nil, fmt.Errorf("empty bypass pattern")
+	case len(p) > maxPatternLength:
+		return nil, fmt.Errorf("bypass pattern %.20q... is too long", p)
+	case p == LocalToken:
+		return []string{p}, nil
+	case strings.Contains(p, "/"):
+		return expandCIDR(p)
+	}
+	for _, r := range p {
+		if !validHostRune(r) {
+			return nil, fmt.Errorf("bypass pattern %q: invalid character %q", p, r)
+		}
+	}
+	return []string{p}, nil
+}
+
+func validHostRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	case r == '.' || r == '-' || r == '*' || r == '_' || r == ':' || r == '[' || r == ']':
+		return true
+	}
+	return false
+}
+
+// expandCIDR turns an IPv4 CIDR into octet wildcards, e.g. 10.0.0.0/8
+// into "10.*" and 172.16.0.0/12 into "172.16.*" through "172.31.*".
+func expandCIDR(p string) ([]string, error) {
+	prefix, err := netip.ParsePrefix(p)
+	if err != nil {
+		return nil, fmt.Errorf("bypass pattern %q: %v", p, err)
+	}
+	if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("bypass pattern %q: only IPv4 ranges are supported", p)
+	}
+	prefix = prefix.Masked()
+	bits := prefix.Bits()
+	if bits == 0 {
+		return nil, fmt.Errorf("bypass pattern %q would bypass the proxy for every address", p)
+	}
+
+	// Round up to whole octets; the free bits of the last partial octet
+	// are enumerated.
+	octets := (bits + 7) / 8
+	count := 1 << (octets*8 - bits)
+	if count > maxExpansion {
+		return nil, fmt.Errorf("bypass pattern %q expands to %d entries, more than %d", p, count, maxExpansion)
+	}
+	base := prefix.Addr().As4()
+	out := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		addr := base
+		addr[octets-1] += byte(i)
+		parts := make([]string, 0, 4)
+		for _, b := range addr[:octets] {
+			parts = append(parts, fmt.Sprint(b))
+		}
+		if octets < 4 {
+			parts = append(parts, "*")
+		}
+		out = append(out, strings.Join(parts, "."))
+	}
+	return out, nil
+}
+
+// Split parses a ProxyOverride value. Entries are trimmed; empty ones, as
+// left by doubled or trailing semicolons, are dropped.
+func Split(value string) []string {
+	var out []string
+	for _, entry := range strings.Split(value, ";") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// Merge returns the ProxyOverride value to write: the user's saved entries
+// in their original order and spelling, followed by the default and user
+// patterns they don't already contain. Live edits merge against the saved
+// value again, so patterns removed from the setting don't linger.
+func Merge(saved Saved, patterns []string) (string, error) {
+	entries := Split(saved.Value)
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[strings.ToLower(e)] = true
+	}
+	for _, p := range append(append([]string{}, DefaultBypass...), patterns...) {
+		expanded, err := expand(p)
+		if err != nil {
+			return "", err
+		}
+		for _, e := range expanded {
+			if key := strings.ToLower(e); !seen[key] {
+				seen[key] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	return strings.Join(entries, ";"), nil
+}
@@ -0,0 +1,125 @@
+package sysproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+const defaults = "<local>;localhost;127.*;10.*;172.16.*;172.17.*;172.18.*;172.19.*;172.20.*;172.21.*;172.22.*;172.23.*;172.24.*;172.25.*;172.26.*;172.27.*;172.28.*;172.29.*;172.30.*;172.31.*;192.168.*;169.254.*"
+
+// TestMerge runs the merge against ProxyOverride values as Windows and
+// common enterprise tools write them.
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		saved    Saved
+		patterns []string
+		want     string
+	}{
+		{
+			name: "no existing value",
+			want: defaults,
+		},
+		{
+			name:  "internet options dialog with local addresses ticked",
+			saved: Saved{Value: "*.corp.example;intranet;<local>", Present: true},
+			want:  "*.corp.example;intranet;<local>;" + strings.TrimPrefix(defaults, "<local>;"),
+		},
+		{
+			name:     "group policy value with spaces and a trailing semicolon",
+			saved:    Saved{Value: "10.*; *.Corp.Example ;;", Present: true},
+			patterns: []string{"*.corp.example", "license.example.com"},
+			want:     "10.*;*.Corp.Example;<local>;localhost;127.*;" + strings.SplitN(defaults, "10.*;", 2)[1] + ";license.example.com",
+		},
+		{
+			name:  "unknown tokens are kept verbatim",
+			saved: Saved{Value: "<-loopback>;printer-*", Present: true},
+			want:  "<-loopback>;printer-*;" + defaults,
+		},
+		{
+			name:     "user CIDRs expand to wildcards",
+			patterns: []string{"100.64.0.0/10", "203.0.113.7/32", "198.51.100.0/24"},
+			want:     defaults + ";100.64.*;100.65.*;100.66.*;100.67.*;100.68.*;100.69.*;100.70.*;100.71.*;100.72.*;100.73.*;100.74.*;100.75.*;100.76.*;100.77.*;100.78.*;100.79.*;100.80.*;100.81.*;100.82.*;100.83.*;100.84.*;100.85.*;100.86.*;100.87.*;100.88.*;100.89.*;100.90.*;100.91.*;100.92.*;100.93.*;100.94.*;100.95.*;100.96.*;100.97.*;100.98.*;100.99.*;100.100.*;100.101.*;100.102.*;100.103.*;100.104.*;100.105.*;100.106.*;100.107.*;100.108.*;100.109.*;100.110.*;100.111.*;100.112.*;100.113.*;100.114.*;100.115.*;100.116.*;100.117.*;100.118.*;100.119.*;100.120.*;100.121.*;100.122.*;100.123.*;100.124.*;100.125.*;100.126.*;100.127.*;203.0.113.7;198.51.100.*",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Merge(tt.saved, tt.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Merge =\n%s\nwant\n%s", got, tt.want)
+			}
+			// Merging the written value again changes nothing, so a value
+			// saved after a crash doesn't grow.
+			again, err := Merge(Saved{Value: got, Present: true}, tt.patterns)
+			if err != nil || again != got {
+				t.Errorf("second merge = %q, %v", again, err)
+			}
+		})
+	}
+}
+
+// TestLiveEdit checks that edits merge against the saved original, so a
+// removed pattern is gone and the original can be restored verbatim.
+func TestLiveEdit(t *testing.T) {
+	saved := Saved{Value: " intranet ;<local>;", Present: true}
+
+	first, err := Merge(saved, []string{"printer.example", "license.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Merge(saved, []string{"license.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(first, "printer.example") || strings.Contains(second, "printer.example") {
+		t.Errorf("after removing a pattern:\n%s\n%s", first, second)
+	}
+	if saved.Value != " intranet ;<local>;" {
+		t.Errorf("saved value changed to %q", saved.Value)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []string{"*.corp.example", "printer", "10.1.*", "192.168.10.0/24", "172.16.0.0/12", "<local>", "[fe80::1]", "host_name.lan"}
+	if err := Validate(valid); err != nil {
+		t.Errorf("Validate(%q) = %v", valid, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"   ",
+		"a;b",         // would split the value
+		"http://host", // schemes are not patterns
+		"0.0.0.0/0",   // bypasses everything
+		"10.0.0.0/1",  // expands too far
+		"fd00::/8",    // WinINET has no IPv6 ranges
+		"10.0.0.0/33", // invalid prefix
+		"host name",   // spaces
+		strings.Repeat("a", maxPatternLength+1),
+	} {
+		if err := Validate([]string{bad}); err == nil {
+			t.Errorf("Validate(%q) accepted", bad)
+		}
+	}
+
+	many := make([]string, maxPatterns+1)
+	for i := range many {
+		many[i] = "host"
+	}
+	if err := Validate(many); err == nil {
+		t.Error("Validate accepted too many patterns")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	if got := strings.Join(Split(" a ;;b;\t<local> ;"), "|"); got != "a|b|<local>" {
+		t.Errorf("Split = %q", got)
+	}
+	if got := Split(""); len(got) != 0 {
+		t.Errorf("Split(\"\") = %q", got)
+	}
+}
@@ -0,0 +1,320 @@
+// Package usage keeps a per-day history of tunnel traffic, bucketed by
+// local calendar date (stats.getHistory).
+//
+// Traffic arrives as the session's cumulative totals on every stats poll.
+// The bytes between two polls belong to the day the later poll falls in,
+// except when the two polls straddle the end of a day: the bytes are then
+// split at the boundary in proportion to the time on either side of it.
+//
+// Wall clock time is not trusted to move forward. Samples are placed at
+// the latest time seen so far, so an NTP correction that steps the clock
+// back keeps counting into the current day instead of reopening an
+// earlier one, and dates never go backwards: a day is only started once
+// the current one has ended. A clock more than clockCorrection behind the
+// latest time seen is the correction of one that ran ahead instead: the
+// days after it are folded into its day, samples follow it from then on
+// and Record reports a *ClockCorrectedError. A day keeps the boundaries of the zone it
+// started in; after a time zone change the next day starts at the later
+// of the current day's end and midnight in the new zone. Go reads the
+// local zone once per process, so the service sees a zone change from its
+// next start.
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/paths"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// FileName is the history file inside the data directory.
+const FileName = "usage.json"
+
+const (
+	// maxDays is how many days of history are kept.
+	maxDays = 400
+	// maxSplitGap is the longest time between two polls whose bytes are
+	// split across a day boundary. A longer gap means the machine slept
+	// or the clock jumped, and its bytes go to the later day.
+	maxSplitGap = 5 * time.Minute
+	// saveInterval is how often the history is written while traffic
+	// flows; a new day and the end of a session are written at once.
+	saveInterval = time.Minute
+	// clockCorrection is how far the clock may fall behind the latest
+	// time seen before it is taken as correcting a clock that ran ahead,
+	// rather than as a step back to ride out.
+	clockCorrection = 24 * time.Hour
+)
+
+// DateLayout is the format of Day.Date.
+const DateLayout = "2006-01-02"
+
+// Day is the traffic of one local calendar day. Start and End are its
+// boundaries: 23 or 25 hours apart on days the clocks change, and cut
+// short by a time zone change.
+type Day struct {
+	Date   string    `json:"date"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Offset int       `json:"offset"` // seconds east of UTC at Start
+	Bytes
+}
+
+// Bytes is traffic through the proxy and bypassed by split tunneling, as
+// in vpn.Traffic.
+type Bytes struct {
+	Upload         int64 `json:"upload"`
+	Download       int64 `json:"download"`
+	DirectUpload   int64 `json:"directUpload"`
+	DirectDownload int64 `json:"directDownload"`
+}
+
+// file is the persisted history.
+type file struct {
+	Days []Day `json:"days"` // oldest first, dates strictly increasing
+	// Seen is the latest time a sample was placed at, which samples are
+	// never placed before.
+	Seen time.Time `json:"seen"`
+}
+
+// ClockCorrectedError reports a clock correction: the clock fell from
+// Seen, the latest time seen, to Now. The traffic of the days after Now,
+// listed in Folded, was moved to the day Now falls in.
+type ClockCorrectedError struct {
+	Seen   time.Time
+	Now    time.Time
+	Folded []string
+}
+
+func (e *ClockCorrectedError) Error() string {
+	return fmt.Sprintf("usage history: clock corrected from %s to %s, folded %d later days into %s",
+		e.Seen.Format(time.RFC3339), e.Now.Format(time.RFC3339), len(e.Folded), e.Now.Format(DateLayout))
+}
+
+// History records traffic per day.
+type History struct {
+	path     string
+	now      func() time.Time      // replaced in tests
+	location func() *time.Location // replaced in tests
+
+	mu      sync.Mutex
+	data    file
+	last    Bytes     // totals of the previous sample of the session
+	lastAt  time.Time // when it was placed; zero at the start of a session
+	dirty   bool
+	savedAt time.Time
+}
+
+// Open loads the history at path. A missing file is an empty history; an
+// unreadable one is reported and replaced.
+func Open(path string) (*History, error) {
+	h := &History{path: path, now: time.Now, location: func() *time.Location { return time.Local }}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, fmt.Errorf("failed to read usage history: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.data); err != nil {
+		h.data = file{}
+		return h, fmt.Errorf("failed to parse usage history: %w", err)
+	}
+	return h, nil
+}
+
+// Record adds the traffic since the previous sample, given the session's
+// cumulative totals. Totals lower than before start a new session.
+func (h *History) Record(traffic vpn.Traffic) error {
+	totals := Bytes(traffic)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	at := h.now()
+	var corrected *ClockCorrectedError
+	if h.data.Seen.Sub(at) > clockCorrection {
+		corrected = h.correctClock(at)
+	}
+	if at.Before(h.data.Seen) {
+		at = h.data.Seen
+	}
+	h.data.Seen = at
+
+	delta := totals
+	prev := h.lastAt
+	if !prev.IsZero() && !less(totals, h.last) {
+		delta = sub(totals, h.last)
+	} else {
+		// The first sample of a session carries everything since it
+		// started, which is placed whole.
+		prev = time.Time{}
+	}
+	h.last, h.lastAt = totals, at
+
+	if delta != (Bytes{}) {
+		h.place(prev, at, delta)
+	}
+	if h.dirty && at.Sub(h.savedAt) >= saveInterval {
+		if err := h.saveLocked(at); err != nil {
+			return err
+		}
+	}
+	if corrected != nil {
+		return corrected
+	}
+	return nil
+}
+
+// correctClock takes at, far behind the latest time seen, as the corrected
+// clock: the days starting after it are folded into its day and it
+// becomes the latest time seen.
+func (h *History) correctClock(at time.Time) *ClockCorrectedError {
+	corrected := &ClockCorrectedError{Seen: h.data.Seen, Now: at}
+	var folded Bytes
+	days := h.data.Days
+	for len(days) > 0 && days[len(days)-1].Start.After(at) {
+		day := days[len(days)-1]
+		corrected.Folded = append([]string{day.Date}, corrected.Folded...)
+		folded = add(folded, day.Bytes)
+		days = days[:len(days)-1]
+	}
+	h.data.Days = days
+	h.data.Seen = at
+	if !h.lastAt.IsZero() {
+		h.lastAt = at
+	}
+	if folded != (Bytes{}) {
+		day := h.dayAt(at)
+		day.Bytes = add(day.Bytes, folded)
+	}
+	h.dirty = true
+	h.savedAt = time.Time{}
+	return corrected
+}
+
+// EndSession saves the history; the next sample starts a new session.
+func (h *History) EndSession() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last, h.lastAt = Bytes{}, time.Time{}
+	if !h.dirty {
+		return nil
+	}
+	return h.saveLocked(h.now())
+}
+
+// place adds delta, the bytes between prev and at, to the days they fall
+// in. prev is zero when the bytes have no known start.
+func (h *History) place(prev, at time.Time, delta Bytes) {
+	if !prev.IsZero() && at.Sub(prev) <= maxSplitGap {
+		if cur := h.dayAt(prev); !at.Before(cur.End) {
+			before := scale(delta, float64(cur.End.Sub(prev))/float64(at.Sub(prev)))
+			cur.Bytes = add(cur.Bytes, before)
+			delta = sub(delta, before)
+		}
+	}
+	day := h.dayAt(at)
+	day.Bytes = add(day.Bytes, delta)
+	h.dirty = true
+}
+
+// current returns the latest day, nil if there is none.
+func (h *History) current() *Day {
+	if len(h.data.Days) == 0 {
+		return nil
+	}
+	return &h.data.Days[len(h.data.Days)-1]
+}
+
+// dayAt returns the day at holds, starting a new one if the current day
+// has ended.
+func (h *History) dayAt(at time.Time) *Day {
+	local := at.In(h.location())
+	date := local.Format(DateLayout)
+	cur := h.current()
+	if cur != nil && (at.Before(cur.End) || date <= cur.Date) {
+		return cur
+	}
+	y, m, d := local.Date()
+	day := Day{
+		Date:  date,
+		Start: time.Date(y, m, d, 0, 0, 0, 0, local.Location()),
+		End:   time.Date(y, m, d+1, 0, 0, 0, 0, local.Location()),
+	}
+	if cur != nil && day.Start.Before(cur.End) {
+		day.Start = cur.End
+	}
+	_, day.Offset = day.Start.In(local.Location()).Zone()
+	h.data.Days = append(h.data.Days, day)
+	if len(h.data.Days) > maxDays {
+		h.data.Days = append([]Day(nil), h.data.Days[len(h.data.Days)-maxDays:]...)
+	}
+	// A new day is saved at once, so a crash cannot lose the end of the
+	// previous one.
+	h.savedAt = time.Time{}
+	return h.current()
+}
+
+// Days returns the last n days of history, oldest first, or all of them
+// if n is 0 or less. Days without traffic are absent.
+func (h *History) Days(n int) []Day {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	days := h.data.Days
+	if n > 0 && len(days) > n {
+		days = days[len(days)-n:]
+	}
+	return append([]Day{}, days...)
+}
+
+func (h *History) saveLocked(at time.Time) error {
+	data, err := json.Marshal(h.data)
+	if err != nil {
+		return err
+	}
+	if err := paths.WriteFileAtomic(h.path, data); err != nil {
+		return fmt.Errorf("failed to save usage history: %w", err)
+	}
+	h.dirty = false
+	h.savedAt = at
+	return nil
+}
+
+func add(a, b Bytes) Bytes {
+	return Bytes{
+		Upload:         a.Upload + b.Upload,
+		Download:       a.Download + b.Download,
+		DirectUpload:   a.DirectUpload + b.DirectUpload,
+		DirectDownload: a.DirectDownload + b.DirectDownload,
+	}
+}
+
+func sub(a, b Bytes) Bytes {
+	return Bytes{
+		Upload:         a.Upload - b.Upload,
+		Download:       a.Download - b.Download,
+		DirectUpload:   a.DirectUpload - b.DirectUpload,
+		DirectDownload: a.DirectDownload - b.DirectDownload,
+	}
+}
+
+// less reports whether any total of a is below b's.
+func less(a, b Bytes) bool {
+	return a.Upload < b.Upload || a.Download < b.Download ||
+		a.DirectUpload < b.DirectUpload || a.DirectDownload < b.DirectDownload
+}
+
+// scale returns the share f of t, rounded down.
+func scale(t Bytes, f float64) Bytes {
+	return Bytes{
+		Upload:         int64(float64(t.Upload) * f),
+		Download:       int64(float64(t.Download) * f),
+		DirectUpload:   int64(float64(t.DirectUpload) * f),
+		DirectDownload: int64(float64(t.DirectDownload) * f),
+	}
+}
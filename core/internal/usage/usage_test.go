@@ -0,0 +1,337 @@
+package usage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// fakeClock is a settable wall clock and time zone.
+type fakeClock struct {
+	now time.Time
+	loc *time.Location
+}
+
+func newHistory(t *testing.T, c *fakeClock) *History {
+	t.Helper()
+	h, err := Open(filepath.Join(t.TempDir(), FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.now = func() time.Time { return c.now }
+	h.location = func() *time.Location { return c.loc }
+	return h
+}
+
+func berlin(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// down returns totals of n downloaded bytes.
+func down(n int64) vpn.Traffic { return vpn.Traffic{Download: n} }
+
+// downloads returns the downloads per date.
+func downloads(h *History) map[string]int64 {
+	out := map[string]int64{}
+	for _, d := range h.Days(0) {
+		out[d.Date] = d.Download
+	}
+	return out
+}
+
+func TestSplitAtMidnight(t *testing.T) {
+	c := &fakeClock{loc: berlin(t), now: time.Date(2026, 5, 10, 23, 59, 50, 0, berlin(t))}
+	h := newHistory(t, c)
+	h.Record(vpn.Traffic{Upload: 10, Download: 100, DirectDownload: 40})
+	c.now = c.now.Add(20 * time.Second) // 00:00:10
+	h.Record(vpn.Traffic{Upload: 30, Download: 2100, DirectDownload: 80})
+
+	days := h.Days(0)
+	if len(days) != 2 {
+		t.Fatalf("days %+v", days)
+	}
+	// The 2000 bytes between the polls straddle midnight evenly.
+	want := []Bytes{
+		{Upload: 20, Download: 1100, DirectDownload: 60},
+		{Upload: 10, Download: 1000, DirectDownload: 20},
+	}
+	for i, d := range days {
+		if d.Bytes != want[i] {
+			t.Errorf("%s: %+v, want %+v", d.Date, d.Bytes, want[i])
+		}
+	}
+	if days[0].Date != "2026-05-10" || days[1].Date != "2026-05-11" || !days[0].End.Equal(days[1].Start) {
+		t.Errorf("boundaries %v-%v, %v-%v", days[0].Start, days[0].End, days[1].Start, days[1].End)
+	}
+}
+
+func TestSplitKeepsEveryByte(t *testing.T) {
+	c := &fakeClock{loc: time.UTC, now: time.Date(2026, 5, 10, 23, 59, 57, 0, time.UTC)}
+	h := newHistory(t, c)
+	h.Record(down(0))
+	c.now = c.now.Add(7 * time.Second)
+	h.Record(down(1001))
+	got := downloads(h)
+	// 3 of the 7 seconds fall before midnight; rounding loses nothing.
+	if got["2026-05-10"] != 429 || got["2026-05-11"] != 572 {
+		t.Errorf("downloads %v", got)
+	}
+}
+
+func TestDSTDays(t *testing.T) {
+	loc := berlin(t)
+	tests := []struct {
+		date   time.Time
+		hours  float64
+		offset int
+	}{
+		{time.Date(2026, 3, 29, 12, 0, 0, 0, loc), 23, 3600},  // clocks go forward
+		{time.Date(2026, 10, 25, 12, 0, 0, 0, loc), 25, 7200}, // clocks go back
+		{time.Date(2026, 7, 1, 12, 0, 0, 0, loc), 24, 7200},
+	}
+	for _, tt := range tests {
+		c := &fakeClock{loc: loc, now: tt.date}
+		h := newHistory(t, c)
+		h.Record(down(5))
+		d := h.Days(0)[0]
+		if got := d.End.Sub(d.Start).Hours(); got != tt.hours || d.Offset != tt.offset {
+			t.Errorf("%s: %v hours from offset %d, want %v from %d", d.Date, got, d.Offset, tt.hours, tt.offset)
+		}
+	}
+
+	// The 02:00 that does not exist on the spring day does not move
+	// midnight: the day after starts at the day's end.
+	c := &fakeClock{loc: loc, now: time.Date(2026, 3, 29, 23, 59, 0, 0, loc)}
+	h := newHistory(t, c)
+	h.Record(down(0))
+	c.now = c.now.Add(2 * time.Minute)
+	h.Record(down(120))
+	days := h.Days(0)
+	if len(days) != 2 || !days[1].Start.Equal(time.Date(2026, 3, 30, 0, 0, 0, 0, loc)) || days[0].Download != 60 || days[1].Download != 60 {
+		t.Errorf("days %+v", days)
+	}
+}
+
+func TestClockStepsBack(t *testing.T) {
+	loc := berlin(t)
+	c := &fakeClock{loc: loc, now: time.Date(2026, 5, 10, 23, 59, 55, 0, loc)}
+	h := newHistory(t, c)
+	h.Record(down(0))
+	c.now = c.now.Add(10 * time.Second) // 00:00:05
+	h.Record(down(100))
+	// NTP steps the clock back across midnight.
+	c.now = time.Date(2026, 5, 10, 23, 59, 58, 0, loc)
+	h.Record(down(300))
+	c.now = c.now.Add(time.Second)
+	h.Record(down(400))
+
+	days := h.Days(0)
+	if len(days) != 2 {
+		t.Fatalf("days %+v", days)
+	}
+	if days[0].Date != "2026-05-10" || days[0].Download != 50 || days[1].Date != "2026-05-11" || days[1].Download != 350 {
+		t.Errorf("days %+v", days)
+	}
+	// Once the clock passes the latest time seen, samples follow it again.
+	c.now = time.Date(2026, 5, 11, 0, 1, 0, 0, loc)
+	h.Record(down(500))
+	if got := downloads(h); got["2026-05-11"] != 450 || len(got) != 2 {
+		t.Errorf("downloads %v", got)
+	}
+}
+
+func TestClockCorrection(t *testing.T) {
+	c := &fakeClock{loc: time.UTC, now: time.Date(2026, 5, 10, 12, 0, 0, 0, time.UTC)}
+	h := newHistory(t, c)
+	h.Record(down(100))
+	// The clock jumps months ahead, then NTP corrects it.
+	c.now = time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	h.Record(down(300))
+	c.now = time.Date(2026, 9, 2, 12, 0, 0, 0, time.UTC)
+	h.Record(down(600))
+	c.now = time.Date(2026, 5, 10, 12, 1, 0, 0, time.UTC)
+	err := h.Record(down(1000))
+	var corrected *ClockCorrectedError
+	if !errors.As(err, &corrected) {
+		t.Fatalf("Record after the correction = %v, want a ClockCorrectedError", err)
+	}
+	if want := []string{"2026-09-01", "2026-09-02"}; !reflect.DeepEqual(corrected.Folded, want) {
+		t.Errorf("folded %v, want %v", corrected.Folded, want)
+	}
+	if want := map[string]int64{"2026-05-10": 1000}; !reflect.DeepEqual(downloads(h), want) {
+		t.Errorf("downloads %v, want %v", downloads(h), want)
+	}
+
+	// Samples follow the corrected clock into the next day.
+	c.now = time.Date(2026, 5, 11, 8, 0, 0, 0, time.UTC)
+	if err := h.Record(down(1500)); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"2026-05-10": 1000, "2026-05-11": 500}
+	if got := downloads(h); !reflect.DeepEqual(got, want) {
+		t.Errorf("downloads %v, want %v", got, want)
+	}
+	// The correction was saved.
+	reopened, err := Open(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.data.Seen.Equal(c.now) {
+		t.Errorf("saved seen = %v, want %v", reopened.data.Seen, c.now)
+	}
+}
+
+func TestLongGapGoesToLaterDay(t *testing.T) {
+	c := &fakeClock{loc: time.UTC, now: time.Date(2026, 5, 10, 23, 50, 0, 0, time.UTC)}
+	h := newHistory(t, c)
+	h.Record(down(10))
+	// The machine sleeps past midnight; the bytes after it resumes are not
+	// spread over the night.
+	c.now = time.Date(2026, 5, 11, 7, 0, 0, 0, time.UTC)
+	h.Record(down(1010))
+	// A forward clock jump over several days leaves the days between out.
+	c.now = time.Date(2026, 5, 14, 9, 0, 0, 0, time.UTC)
+	h.Record(down(1510))
+	want := map[string]int64{"2026-05-10": 10, "2026-05-11": 1000, "2026-05-14": 500}
+	if got := downloads(h); !reflect.DeepEqual(got, want) {
+		t.Errorf("downloads %v, want %v", got, want)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	c := &fakeClock{loc: time.UTC, now: time.Date(2026, 5, 10, 9, 0, 0, 0, time.UTC)}
+	h := newHistory(t, c)
+	h.Record(down(100))
+	c.now = c.now.Add(time.Second)
+	h.Record(down(150))
+	// A session that ends and the next one, whose totals start over.
+	h.EndSession()
+	c.now = c.now.Add(time.Hour)
+	h.Record(down(400))
+	c.now = c.now.Add(time.Second)
+	h.Record(down(500))
+	// Totals that drop without an end are a new session too.
+	c.now = c.now.Add(time.Second)
+	h.Record(down(20))
+	if got := downloads(h)["2026-05-10"]; got != 150+500+20 {
+		t.Errorf("download %d", got)
+	}
+	for _, d := range h.Days(0) {
+		if d.Download < 0 || d.Upload < 0 {
+			t.Errorf("negative day %+v", d)
+		}
+	}
+}
+
+func TestTimeZoneChange(t *testing.T) {
+	east := time.FixedZone("UTC+3", 3*3600)
+	west := time.FixedZone("UTC-5", -5*3600)
+
+	// Moving east: midnight in the new zone comes before the day's end,
+	// which still closes it; the next day starts there.
+	c := &fakeClock{loc: time.UTC, now: time.Date(2026, 5, 10, 20, 0, 0, 0, time.UTC)}
+	h := newHistory(t, c)
+	h.Record(down(10))
+	c.loc = east
+	c.now = time.Date(2026, 5, 10, 22, 0, 0, 0, time.UTC) // 01:00 on the 11th in UTC+3
+	h.Record(down(20))
+	c.now = time.Date(2026, 5, 11, 1, 0, 0, 0, time.UTC)
+	h.Record(down(30))
+	days := h.Days(0)
+	if len(days) != 2 || days[0].Download != 20 || days[1].Date != "2026-05-11" || days[1].Download != 10 {
+		t.Fatalf("east: %+v", days)
+	}
+	if !days[1].Start.Equal(days[0].End) || !days[1].End.Equal(time.Date(2026, 5, 11, 21, 0, 0, 0, time.UTC)) || days[1].Offset != 3*3600 {
+		t.Errorf("east: day %v-%v offset %d", days[1].Start, days[1].End, days[1].Offset)
+	}
+
+	// Moving west: the day has ended but the new zone is still on its
+	// date, so no second day of that date is started.
+	c = &fakeClock{loc: time.UTC, now: time.Date(2026, 5, 10, 20, 0, 0, 0, time.UTC)}
+	h = newHistory(t, c)
+	h.Record(down(10))
+	c.loc = west
+	c.now = time.Date(2026, 5, 11, 1, 0, 0, 0, time.UTC) // 20:00 on the 10th in UTC-5
+	h.Record(down(20))
+	c.now = time.Date(2026, 5, 11, 6, 0, 0, 0, time.UTC) // 01:00 on the 11th
+	h.Record(down(30))
+	days = h.Days(0)
+	if len(days) != 2 || days[0].Download != 20 || days[1].Date != "2026-05-11" || days[1].Download != 10 {
+		t.Fatalf("west: %+v", days)
+	}
+	if !days[1].Start.Equal(time.Date(2026, 5, 11, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("west: day starts %v", days[1].Start)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	c := &fakeClock{loc: time.UTC, now: time.Date(2026, 5, 10, 9, 0, 0, 0, time.UTC)}
+	h := newHistory(t, c)
+	h.Record(down(100)) // a new day is saved at once
+	c.now = c.now.Add(10 * time.Second)
+	h.Record(down(150)) // the rest waits for the save interval
+
+	reopen := func() *History {
+		t.Helper()
+		r, err := Open(h.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	if got := reopen().Days(0); len(got) != 1 || got[0].Download != 100 {
+		t.Errorf("after the first sample: %+v", got)
+	}
+	c.now = c.now.Add(saveInterval)
+	h.Record(down(170))
+	if got := reopen().Days(0); got[0].Download != 170 {
+		t.Errorf("after the save interval: %+v", got)
+	}
+	c.now = c.now.Add(time.Second)
+	h.Record(down(200))
+	h.EndSession()
+	r := reopen()
+	if got := r.Days(0); got[0].Download != 200 || !got[0].Start.Equal(time.Date(2026, 5, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("after the session: %+v", got)
+	}
+
+	// The latest time seen survives a restart.
+	r.now = func() time.Time { return time.Date(2026, 5, 9, 23, 0, 0, 0, time.UTC) }
+	r.location = func() *time.Location { return time.UTC }
+	r.Record(down(5))
+	if got := r.Days(0); len(got) != 1 || got[0].Download != 205 {
+		t.Errorf("after a restart with the clock behind: %+v", got)
+	}
+
+	os.WriteFile(h.path, []byte("{"), 0o644)
+	if r, err := Open(h.path); err == nil || len(r.Days(0)) != 0 {
+		t.Errorf("corrupt history: %v, %+v", err, r.Days(0))
+	}
+}
+
+func TestRetention(t *testing.T) {
+	c := &fakeClock{loc: time.UTC, now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	h := newHistory(t, c)
+	for i := 0; i < maxDays+10; i++ {
+		h.Record(down(int64(i + 1)))
+		c.now = c.now.AddDate(0, 0, 1)
+	}
+	days := h.Days(0)
+	if len(days) != maxDays || days[0].Date != "2024-01-11" {
+		t.Errorf("%d days from %s", len(days), days[0].Date)
+	}
+	if last := h.Days(3); len(last) != 3 || last[2].Date != days[len(days)-1].Date {
+		t.Errorf("last 3 days %+v", last)
+	}
+}
@@ -0,0 +1,109 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+)
+
+// ErrNotFound is returned by cleanup helpers when there is nothing to remove.
+var ErrNotFound = errors.New("not found")
+
+// RemoveTunAdapter removes the TUN adapter of inst left behind by a
+// sing-box instance that did not shut down cleanly. Returns ErrNotFound if
+// no such adapter exists.
+func RemoveTunAdapter(inst instance.Instance) error {
+	if _, err := net.InterfaceByName(inst.InterfaceName()); err != nil {
+		return ErrNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	script := fmt.Sprintf(`Get-NetAdapter -Name '%s' -ErrorAction SilentlyContinue | ForEach-Object { pnputil /remove-device $_.PnPDeviceID }`, inst.InterfaceName())
+	cmd := exec.CommandContext(ctx, "powershell", "-NoProfile", "-Command", script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove adapter: %w (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// DeleteFirewallRules removes all Windows Firewall rules created by the
+// service of inst, found by its provider GUID. Returns ErrNotFound if there
+// were none.
+func DeleteFirewallRules(inst instance.Instance) error {
+	return removeFirewallRules(inst.FirewallProvider())
+}
+
+// noFirewallRules is the exit code of firewallRemoveScript when no rule
+// is in the group.
+const noFirewallRules = 3
+
+// firewallRemoveScript returns the PowerShell script that removes every
+// firewall rule grouped under provider.
+func firewallRemoveScript(provider string) string {
+	return fmt.Sprintf(`$rules = @(Get-NetFirewallRule -Group '%s' -ErrorAction SilentlyContinue); `+
+		`if ($rules.Count -eq 0) { exit %d }; $rules | Remove-NetFirewallRule -ErrorAction Stop`,
+		provider, noFirewallRules)
+}
+
+// removeFirewallRules removes the firewall rules grouped under provider.
+// Returns ErrNotFound if there were none.
+func removeFirewallRules(provider string) error {
+	err := powershell(firewallRemoveScript(provider))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == noFirewallRules {
+		return ErrNotFound
+	}
+	return err
+}
+
+// lanFirewallScript returns the PowerShell script that adds the inbound
+// rules for a LAN sharing port, one per protocol: the mixed inbound takes
+// SOCKS5 UDP on the same port. Only the local subnet is allowed in. The
+// rules show as inst's firewall rule name and are grouped under its
+// provider GUID.
+func lanFirewallScript(s *LANShare, inst instance.Instance) string {
+	var cmds []string
+	for _, protocol := range []string{"TCP", "UDP"} {
+		cmds = append(cmds, fmt.Sprintf(`New-NetFirewallRule -DisplayName '%s' -Group '%s' -Direction Inbound -Action Allow `+
+			`-Protocol %s -LocalAddress %s -LocalPort %d -RemoteAddress LocalSubnet -ErrorAction Stop | Out-Null`,
+			inst.FirewallRuleName(), inst.FirewallProvider(), protocol, s.Listen, s.Port))
+	}
+	return strings.Join(cmds, "; ")
+}
+
+// openLANPort allows LAN devices to reach the LAN sharing port.
+func openLANPort(s *LANShare, inst instance.Instance) error {
+	if err := powershell(lanFirewallScript(s, inst)); err != nil {
+		closeLANPort(inst) // don't leave half the rules behind
+		return err
+	}
+	return nil
+}
+
+// closeLANPort removes the rules openLANPort added, with any others of
+// inst: the LAN port is the only one the service opens.
+func closeLANPort(inst instance.Instance) error {
+	if err := removeFirewallRules(inst.FirewallProvider()); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func powershell(script string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("powershell failed: %w (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
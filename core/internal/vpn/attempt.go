@@ -0,0 +1,214 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Connects, reconnects and switches all start attempts, and an attempt
+// holds the engine for as long as it takes to bring a link up. The engine
+// runs one attempt at a time: its slot holds the running attempt and at
+// most one queued behind it. What a new attempt does when the slot is
+// taken is its policy.
+//
+// AttemptReject, the default, refuses the new attempt.
+//
+// AttemptReplace cancels the running attempt and any queued one and takes
+// over once the running attempt has returned, which is switch semantics:
+// a session already up when it gets the engine is ended with ReasonSwitch.
+//
+// AttemptQueue waits for the running attempt to finish, as an automatic
+// reconnect deferring to a user action does. Only one attempt waits; a
+// second one to queue is refused.
+//
+// An attempt that is refused or cancelled returns an *AttemptError naming
+// the attempt that won. Disconnecting cancels the running and queued
+// attempts too.
+const (
+	AttemptReject  = "reject"
+	AttemptReplace = "replace"
+	AttemptQueue   = "queue"
+)
+
+// Attempt kinds.
+const (
+	AttemptConnect    = "connect"
+	AttemptReconnect  = "reconnect"
+	AttemptDisconnect = "disconnect" // only ever a winner
+)
+
+// Attempt outcomes reported by AttemptError.
+const (
+	OutcomeRejected  = "rejected"  // refused, the slot was taken
+	OutcomePreempted = "preempted" // cancelled while running or queued
+)
+
+// ValidAttemptPolicy reports whether policy is one of the attempt
+// policies; empty means AttemptReject.
+func ValidAttemptPolicy(policy string) bool {
+	switch policy {
+	case "", AttemptReject, AttemptReplace, AttemptQueue:
+		return true
+	}
+	return false
+}
+
+// AttemptOptions are what a caller says about the attempt it starts.
+type AttemptOptions struct {
+	Policy string // one of the attempt policies; empty means AttemptReject
+	Origin string // who started it, such as "user" or "schedule"; for errors and logs
+}
+
+// Attempt identifies a connect, reconnect or disconnect.
+type Attempt struct {
+	ID     uint64 `json:"id"` // increases with every attempt the engine starts
+	Kind   string `json:"kind" jsonschema:"enum=connect|reconnect|disconnect"`
+	Origin string `json:"origin,omitempty"`
+}
+
+func (a Attempt) String() string {
+	s := fmt.Sprintf("%s attempt %d", a.Kind, a.ID)
+	if a.Origin != "" {
+		s += " (" + a.Origin + ")"
+	}
+	return s
+}
+
+// AttemptError is returned for an attempt that was refused or cancelled
+// in favour of Winner.
+type AttemptError struct {
+	Attempt Attempt
+	Outcome string // OutcomeRejected or OutcomePreempted
+	Winner  Attempt
+}
+
+func (e *AttemptError) Error() string {
+	if e.Outcome == OutcomeRejected {
+		return fmt.Sprintf("%s rejected: %s holds the engine", e.Attempt, e.Winner)
+	}
+	return fmt.Sprintf("%s preempted by %s", e.Attempt, e.Winner)
+}
+
+// attemptEntry is an attempt in the slot.
+type attemptEntry struct {
+	Attempt
+	cancel context.CancelCauseFunc
+	ready  chan struct{} // closed when a queued attempt gets to run
+}
+
+// attemptSlot runs one attempt at a time; see AttemptReject.
+type attemptSlot struct {
+	mu      sync.Mutex
+	nextID  uint64
+	running *attemptEntry
+	queued  *attemptEntry
+}
+
+// acquire starts an attempt of kind under opts, waiting for its turn if
+// the policy says so. It returns the context the attempt runs under,
+// cancelled if the attempt is preempted, and the function to call when
+// the attempt is done.
+func (s *attemptSlot) acquire(ctx context.Context, kind string, opts AttemptOptions) (context.Context, func(), error) {
+	s.mu.Lock()
+	s.nextID++
+	attemptCtx, cancel := context.WithCancelCause(ctx)
+	entry := &attemptEntry{
+		Attempt: Attempt{ID: s.nextID, Kind: kind, Origin: opts.Origin},
+		cancel:  cancel,
+		ready:   make(chan struct{}),
+	}
+	if s.running == nil {
+		s.running = entry
+		s.mu.Unlock()
+		return attemptCtx, func() { s.release(entry) }, nil
+	}
+
+	switch opts.Policy {
+	case AttemptReplace:
+		s.running.cancel(&AttemptError{Attempt: s.running.Attempt, Outcome: OutcomePreempted, Winner: entry.Attempt})
+		if s.queued != nil {
+			s.queued.cancel(&AttemptError{Attempt: s.queued.Attempt, Outcome: OutcomePreempted, Winner: entry.Attempt})
+		}
+		s.queued = entry
+	case AttemptQueue:
+		if s.queued != nil {
+			err := &AttemptError{Attempt: entry.Attempt, Outcome: OutcomeRejected, Winner: s.queued.Attempt}
+			s.mu.Unlock()
+			cancel(nil)
+			return nil, nil, err
+		}
+		s.queued = entry
+	default:
+		err := &AttemptError{Attempt: entry.Attempt, Outcome: OutcomeRejected, Winner: s.running.Attempt}
+		s.mu.Unlock()
+		cancel(nil)
+		return nil, nil, err
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		return attemptCtx, func() { s.release(entry) }, nil
+	case <-attemptCtx.Done():
+		s.mu.Lock()
+		if s.queued == entry {
+			s.queued = nil
+		}
+		promoted := s.running == entry
+		s.mu.Unlock()
+		if promoted {
+			// Its turn came as it was given up: pass the slot on.
+			s.release(entry)
+		}
+		return nil, nil, attemptErr(attemptCtx)
+	}
+}
+
+// release ends entry's attempt and lets the queued attempt run.
+func (s *attemptSlot) release(entry *attemptEntry) {
+	entry.cancel(nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != entry {
+		return
+	}
+	s.running, s.queued = s.queued, nil
+	if s.running != nil {
+		close(s.running.ready)
+	}
+}
+
+// cancelAll preempts the running and queued attempts in favour of an
+// attempt of kind, which takes no slot. It returns the new attempt.
+func (s *attemptSlot) cancelAll(kind, origin string) Attempt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	winner := Attempt{ID: s.nextID, Kind: kind, Origin: origin}
+	for _, entry := range []*attemptEntry{s.running, s.queued} {
+		if entry != nil {
+			entry.cancel(&AttemptError{Attempt: entry.Attempt, Outcome: OutcomePreempted, Winner: winner})
+		}
+	}
+	return winner
+}
+
+// current returns the running attempt.
+func (s *attemptSlot) current() (Attempt, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == nil {
+		return Attempt{}, false
+	}
+	return s.running.Attempt, true
+}
+
+// attemptErr returns the error of a done attempt context: the
+// *AttemptError it was preempted with, or the context's own error.
+func attemptErr(ctx context.Context) error {
+	if err, ok := context.Cause(ctx).(*AttemptError); ok {
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,322 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// acquired is the outcome of an acquire run in the background.
+type acquired struct {
+	ctx  context.Context
+	done func()
+	err  error
+}
+
+func acquireAsync(s *attemptSlot, ctx context.Context, kind string, opts AttemptOptions) <-chan acquired {
+	ch := make(chan acquired, 1)
+	go func() {
+		ctx, done, err := s.acquire(ctx, kind, opts)
+		ch <- acquired{ctx, done, err}
+	}()
+	return ch
+}
+
+// waitQueued waits until an attempt is queued in s.
+func waitQueued(t *testing.T, s *attemptSlot) {
+	t.Helper()
+	waitFor(t, "a queued attempt", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.queued != nil
+	})
+}
+
+func mustAcquire(t *testing.T, s *attemptSlot, kind string, opts AttemptOptions) (context.Context, func()) {
+	t.Helper()
+	ctx, done, err := s.acquire(context.Background(), kind, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx, done
+}
+
+// wantAttemptErr checks that err is an *AttemptError with outcome and
+// winner.
+func wantAttemptErr(t *testing.T, err error, outcome string, winner Attempt) {
+	t.Helper()
+	var attemptErr *AttemptError
+	if !errors.As(err, &attemptErr) {
+		t.Fatalf("err = %v, want an attempt error", err)
+	}
+	if attemptErr.Outcome != outcome || attemptErr.Winner != winner {
+		t.Errorf("%v: outcome %q winner %v, want %q %v", err, attemptErr.Outcome, attemptErr.Winner, outcome, winner)
+	}
+}
+
+func TestAttemptSlotReject(t *testing.T) {
+	var s attemptSlot
+	_, done := mustAcquire(t, &s, AttemptConnect, AttemptOptions{Origin: "user"})
+	running := Attempt{ID: 1, Kind: AttemptConnect, Origin: "user"}
+
+	for _, policy := range []string{"", AttemptReject} {
+		_, _, err := s.acquire(context.Background(), AttemptReconnect, AttemptOptions{Policy: policy})
+		wantAttemptErr(t, err, OutcomeRejected, running)
+	}
+
+	done()
+	_, done = mustAcquire(t, &s, AttemptConnect, AttemptOptions{})
+	done()
+}
+
+func TestAttemptSlotQueue(t *testing.T) {
+	var s attemptSlot
+	_, done := mustAcquire(t, &s, AttemptConnect, AttemptOptions{Origin: "user"})
+
+	queued := acquireAsync(&s, context.Background(), AttemptReconnect, AttemptOptions{Policy: AttemptQueue, Origin: "auto"})
+	waitQueued(t, &s)
+
+	// One attempt waits; the next is refused in its favour.
+	_, _, err := s.acquire(context.Background(), AttemptConnect, AttemptOptions{Policy: AttemptQueue})
+	wantAttemptErr(t, err, OutcomeRejected, Attempt{ID: 2, Kind: AttemptReconnect, Origin: "auto"})
+
+	select {
+	case <-queued:
+		t.Fatal("queued attempt ran while the slot was taken")
+	case <-time.After(10 * time.Millisecond):
+	}
+	done()
+	r := <-queued
+	if r.err != nil || r.ctx.Err() != nil {
+		t.Fatalf("queued attempt: %v, ctx %v", r.err, r.ctx.Err())
+	}
+	if a, _ := s.current(); a.ID != 2 {
+		t.Errorf("running attempt %v, want the queued one", a)
+	}
+	r.done()
+	if _, ok := s.current(); ok {
+		t.Error("slot still taken")
+	}
+}
+
+func TestAttemptSlotReplace(t *testing.T) {
+	var s attemptSlot
+	runningCtx, done := mustAcquire(t, &s, AttemptConnect, AttemptOptions{})
+	queued := acquireAsync(&s, context.Background(), AttemptReconnect, AttemptOptions{Policy: AttemptQueue})
+	waitQueued(t, &s)
+
+	replacer := acquireAsync(&s, context.Background(), AttemptConnect, AttemptOptions{Policy: AttemptReplace, Origin: "user"})
+	winner := Attempt{ID: 3, Kind: AttemptConnect, Origin: "user"}
+
+	// The running attempt is cancelled and the queued one displaced.
+	<-runningCtx.Done()
+	wantAttemptErr(t, attemptErr(runningCtx), OutcomePreempted, winner)
+	wantAttemptErr(t, (<-queued).err, OutcomePreempted, winner)
+
+	// The replacer waits for the running attempt to return.
+	select {
+	case <-replacer:
+		t.Fatal("replacer ran before the running attempt returned")
+	case <-time.After(10 * time.Millisecond):
+	}
+	done()
+	r := <-replacer
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	r.done()
+}
+
+func TestAttemptSlotQueuedGivesUp(t *testing.T) {
+	var s attemptSlot
+	_, done := mustAcquire(t, &s, AttemptConnect, AttemptOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := acquireAsync(&s, ctx, AttemptReconnect, AttemptOptions{Policy: AttemptQueue})
+	waitQueued(t, &s)
+
+	cancel()
+	if r := <-queued; !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", r.err)
+	}
+	done()
+	if _, ok := s.current(); ok {
+		t.Error("a given-up attempt took the slot")
+	}
+	_, done = mustAcquire(t, &s, AttemptConnect, AttemptOptions{})
+	done()
+}
+
+func TestAttemptSlotDisconnect(t *testing.T) {
+	var s attemptSlot
+	runningCtx, done := mustAcquire(t, &s, AttemptConnect, AttemptOptions{})
+	queued := acquireAsync(&s, context.Background(), AttemptReconnect, AttemptOptions{Policy: AttemptQueue})
+	waitQueued(t, &s)
+
+	winner := s.cancelAll(AttemptDisconnect, ReasonUser)
+	if winner != (Attempt{ID: 3, Kind: AttemptDisconnect, Origin: ReasonUser}) {
+		t.Errorf("disconnect = %v", winner)
+	}
+	wantAttemptErr(t, attemptErr(runningCtx), OutcomePreempted, winner)
+	wantAttemptErr(t, (<-queued).err, OutcomePreempted, winner)
+	done()
+	if _, ok := s.current(); ok {
+		t.Error("slot still taken")
+	}
+}
+
+// gatedEngine returns a stub engine whose core start blocks until gate
+// receives, reporting on started when it does, so an attempt can be held
+// in progress.
+func gatedEngine(t *testing.T) (e *Engine, cfg *Config, started, gate chan struct{}) {
+	e = newStubEngine()
+	started, gate = make(chan struct{}, 4), make(chan struct{}, 4)
+	stubStart := e.startCore
+	e.startCore = func(ctx context.Context, configJSON []byte) (coreBox, error) {
+		started <- struct{}{}
+		<-gate
+		return stubStart(ctx, configJSON)
+	}
+	cfg = DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+	return e, cfg, started, gate
+}
+
+func connectAsync(e *Engine, cfg *Config, opts AttemptOptions) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- e.ConnectWith(context.Background(), cfg, opts) }()
+	return ch
+}
+
+func TestConnectRejectedWhileConnecting(t *testing.T) {
+	e, cfg, started, gate := gatedEngine(t)
+	first := connectAsync(e, cfg, AttemptOptions{Origin: "user"})
+	<-started
+
+	err := e.ConnectWith(context.Background(), cfg, AttemptOptions{Origin: "schedule"})
+	wantAttemptErr(t, err, OutcomeRejected, Attempt{ID: 1, Kind: AttemptConnect, Origin: "user"})
+
+	gate <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	e.Disconnect()
+}
+
+func TestUserConnectPreemptsReconnect(t *testing.T) {
+	e, cfg, started, gate := gatedEngine(t)
+	rec := recordSession(e.stateMachine)
+	gate <- struct{}{}
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	reconnect := make(chan error, 1)
+	go func() { reconnect <- e.ReconnectWith(context.Background(), AttemptOptions{Origin: "auto"}) }()
+	<-started
+
+	// The user picks a server while the reconnect is stuck starting.
+	other := *cfg
+	other.Server = mustParse(t, "vless://u@other.example.com:443")
+	connect := connectAsync(e, &other, AttemptOptions{Policy: AttemptReplace, Origin: "user"})
+	waitQueued(t, &e.attempts)
+	gate <- struct{}{}
+	wantAttemptErr(t, <-reconnect, OutcomePreempted, Attempt{ID: 3, Kind: AttemptConnect, Origin: "user"})
+
+	<-started
+	gate <- struct{}{}
+	if err := <-connect; err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Config().Server.Address; got != "other.example.com" {
+		t.Errorf("connected to %s", got)
+	}
+	rec.mu.Lock()
+	if len(rec.ends) != 1 || rec.ends[0].Reason != ReasonSwitch {
+		t.Errorf("session ends = %+v, want one switch", rec.ends)
+	}
+	rec.mu.Unlock()
+	e.Disconnect()
+}
+
+func TestReplaceSwitchesConnectedSession(t *testing.T) {
+	e, cfg, _, gate := gatedEngine(t)
+	rec := recordSession(e.stateMachine)
+	gate <- struct{}{}
+	gate <- struct{}{}
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Connect(context.Background(), cfg); err == nil {
+		t.Fatal("second connect without replace succeeded")
+	}
+	if err := e.ConnectWith(context.Background(), cfg, AttemptOptions{Policy: AttemptReplace}); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	if len(rec.ends) != 1 || rec.ends[0].Reason != ReasonSwitch || len(rec.timings) != 1 {
+		t.Errorf("ends %+v, timings %d", rec.ends, len(rec.timings))
+	}
+	rec.mu.Unlock()
+	e.Disconnect()
+}
+
+func TestCancelDuringSwitch(t *testing.T) {
+	e, cfg, started, gate := gatedEngine(t)
+	first := connectAsync(e, cfg, AttemptOptions{})
+	<-started
+
+	// A switch is started and given up before the first connect returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	switched := make(chan error, 1)
+	go func() { switched <- e.ConnectWith(ctx, cfg, AttemptOptions{Policy: AttemptReplace}) }()
+	waitQueued(t, &e.attempts)
+	cancel()
+	if err := <-switched; !errors.Is(err, context.Canceled) {
+		t.Fatalf("switch = %v, want context.Canceled", err)
+	}
+
+	// The first connect was preempted all the same.
+	gate <- struct{}{}
+	wantAttemptErr(t, <-first, OutcomePreempted, Attempt{ID: 2, Kind: AttemptConnect})
+	if s := e.stateMachine.State(); s != StateDisconnected {
+		t.Errorf("state = %s, want disconnected", s)
+	}
+	if _, ok := e.attempts.current(); ok {
+		t.Fatal("slot still taken")
+	}
+	gate <- struct{}{}
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	e.Disconnect()
+}
+
+func TestDisconnectDuringQueuedAttempt(t *testing.T) {
+	e, cfg, started, gate := gatedEngine(t)
+	first := connectAsync(e, cfg, AttemptOptions{})
+	<-started
+	queued := connectAsync(e, cfg, AttemptOptions{Policy: AttemptQueue})
+	waitQueued(t, &e.attempts)
+
+	disconnected := make(chan error, 1)
+	go func() { disconnected <- e.DisconnectWithReason(ReasonSchedule) }()
+	winner := Attempt{ID: 3, Kind: AttemptDisconnect, Origin: ReasonSchedule}
+	wantAttemptErr(t, <-queued, OutcomePreempted, winner)
+
+	gate <- struct{}{}
+	wantAttemptErr(t, <-first, OutcomePreempted, winner)
+	if err := <-disconnected; err != nil {
+		t.Fatal(err)
+	}
+	if s := e.stateMachine.State(); s != StateDisconnected {
+		t.Errorf("state = %s, want disconnected", s)
+	}
+	select {
+	case <-started:
+		t.Error("the queued connect ran after the disconnect")
+	default:
+	}
+}
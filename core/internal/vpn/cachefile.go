@@ -0,0 +1,54 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CacheFileName is the name of sing-box's cache file in the data
+// directory. It keeps urltest selections, rule-set downloads and fakeip
+// mappings across connects.
+const CacheFileName = "cache.db"
+
+// cacheFileService is the name sing-box gives its cache file service in
+// start errors.
+const cacheFileService = "cache-file"
+
+// setAsideSuffix is appended to a cache file sing-box could not open.
+// Only the last one is kept, for support.
+const setAsideSuffix = ".bad"
+
+// isCacheFileError reports whether a sing-box start failed on the cache
+// file, because it is locked by another process or corrupted.
+func isCacheFileError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), cacheFileService)
+}
+
+// setAsideCacheFile moves an unusable cache file out of the way so
+// sing-box creates a new one.
+func setAsideCacheFile(path string) error {
+	os.Remove(path + setAsideSuffix)
+	if err := os.Rename(path, path+setAsideSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ClearCacheFile deletes the cache file at path and any copy set aside,
+// reporting whether the cache file existed. sing-box holds the file open
+// while connected, so only call it between sessions.
+func ClearCacheFile(path string) (bool, error) {
+	removed := true
+	if err := os.Remove(path); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to delete the cache file: %w", err)
+		}
+		removed = false
+	}
+	if err := os.Remove(path + setAsideSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return removed, fmt.Errorf("failed to delete the set-aside cache file: %w", err)
+	}
+	return removed, nil
+}
@@ -0,0 +1,77 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+func TestConnectSetsAsideUnusableCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CacheFileName)
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newStubEngine()
+	var configs []string
+	e.startCore = func(ctx context.Context, configJSON []byte) (coreBox, error) {
+		configs = append(configs, string(configJSON))
+		if _, err := os.Stat(path); err == nil {
+			return nil, errors.New("initialize cache-file: timeout")
+		}
+		return stubBox{}, nil
+	}
+
+	cfg := DefaultConfig()
+	cfg.Server = &parser.ServerConfig{Protocol: "vless", Address: "example.com", Port: 443, Params: map[string]string{"uuid": "u"}}
+	cfg.CacheFile = path
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatalf("connect failed on the cache file: %v", err)
+	}
+	defer e.Disconnect()
+
+	if len(configs) != 2 || !strings.Contains(configs[1], "cache_file") {
+		t.Errorf("started %d times; the retry should keep the cache file", len(configs))
+	}
+	if data, err := os.ReadFile(path + setAsideSuffix); err != nil || string(data) != "not a database" {
+		t.Errorf("set-aside file: %q, %v", data, err)
+	}
+}
+
+func TestConnectOtherFailuresNotRetried(t *testing.T) {
+	e := newStubEngine()
+	var starts int
+	e.startCore = func(context.Context, []byte) (coreBox, error) {
+		starts++
+		return nil, errors.New("initialize inbound[0]: access denied")
+	}
+	cfg := DefaultConfig()
+	cfg.Server = &parser.ServerConfig{Protocol: "vless", Address: "example.com", Port: 443, Params: map[string]string{"uuid": "u"}}
+	cfg.CacheFile = filepath.Join(t.TempDir(), CacheFileName)
+	if err := e.Connect(context.Background(), cfg); err == nil || starts != 1 {
+		t.Errorf("err = %v after %d starts", err, starts)
+	}
+}
+
+func TestClearCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CacheFileName)
+	if removed, err := ClearCacheFile(path); removed || err != nil {
+		t.Errorf("no file: removed %v, err %v", removed, err)
+	}
+
+	os.WriteFile(path, []byte("db"), 0o644)
+	os.WriteFile(path+setAsideSuffix, []byte("old"), 0o644)
+	if removed, err := ClearCacheFile(path); !removed || err != nil {
+		t.Errorf("removed %v, err %v", removed, err)
+	}
+	for _, p := range []string{path, path + setAsideSuffix} {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still exists", p)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Hotel and airport networks hold back all traffic until the user signs
+// in on a captive portal page, which looks to a connect like a network
+// that does not answer. The connectivity checks operating systems use to
+// spot portals are plain HTTP fetches of a known response: a portal
+// answers them with a redirect to its sign-in page, or with that page in
+// place of the expected body.
+
+// captiveProbeTimeout bounds the whole detection.
+const captiveProbeTimeout = 5 * time.Second
+
+// captiveProbe is a connectivity check: a URL and how a network without a
+// portal answers it.
+type captiveProbe struct {
+	URL    string
+	Status int    // expected status
+	Body   string // expected body prefix; empty for none
+}
+
+// captiveProbes are the connectivity checks of Windows, Android and
+// Apple devices; a portal cannot special-case all three without letting
+// them through.
+var captiveProbes = []captiveProbe{
+	{URL: "http://www.msftconnecttest.com/connecttest.txt", Status: http.StatusOK, Body: "Microsoft Connect Test"},
+	{URL: "http://connectivitycheck.gstatic.com/generate_204", Status: http.StatusNoContent},
+	{URL: "http://captive.apple.com/hotspot-detect.html", Status: http.StatusOK, Body: "<HTML><HEAD><TITLE>Success</TITLE>"},
+}
+
+// CaptivePortal is the outcome of captive portal detection.
+type CaptivePortal struct {
+	Detected bool   `json:"detected"`
+	URL      string `json:"url,omitempty"` // where to sign in: the redirect target, or the probe that was intercepted
+	// Offline is set when no probe got any answer, so whether there is a
+	// portal is unknown.
+	Offline bool `json:"offline,omitempty"`
+}
+
+// DetectCaptivePortal runs the connectivity checks directly, outside the
+// tunnel, and reports whether a captive portal intercepts them.
+func DetectCaptivePortal(ctx context.Context) CaptivePortal {
+	return detectCaptivePortal(ctx, &http.Transport{Proxy: nil, DisableKeepAlives: true}, captiveProbes)
+}
+
+// captiveVerdict is what one probe found.
+type captiveVerdict int
+
+const (
+	verdictFailed captiveVerdict = iota // no answer
+	verdictClean                        // the expected answer
+	verdictPortal                       // intercepted
+)
+
+// detectCaptivePortal runs probes in parallel over transport. One clean
+// answer means the network is open, however the others were answered;
+// otherwise any intercepted probe means a portal.
+func detectCaptivePortal(ctx context.Context, transport http.RoundTripper, probes []captiveProbe) CaptivePortal {
+	ctx, cancel := context.WithTimeout(ctx, captiveProbeTimeout)
+	defer cancel()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	verdicts := make([]captiveVerdict, len(probes))
+	portalURLs := make([]string, len(probes))
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			verdicts[i], portalURLs[i] = runCaptiveProbe(ctx, client, p)
+		}()
+	}
+	wg.Wait()
+
+	result := CaptivePortal{Offline: true}
+	for i, v := range verdicts {
+		switch v {
+		case verdictClean:
+			return CaptivePortal{}
+		case verdictPortal:
+			result.Offline = false
+			if !result.Detected {
+				result.Detected, result.URL = true, portalURLs[i]
+			}
+		}
+	}
+	return result
+}
+
+// runCaptiveProbe fetches one probe and returns its verdict, with the
+// sign-in URL when intercepted.
+func runCaptiveProbe(ctx context.Context, client *http.Client, p captiveProbe) (captiveVerdict, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return verdictFailed, ""
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return verdictFailed, ""
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if loc, err := resp.Location(); err == nil {
+			return verdictPortal, loc.String()
+		}
+		return verdictPortal, p.URL
+	}
+	if resp.StatusCode == p.Status && strings.HasPrefix(strings.TrimSpace(string(body)), p.Body) {
+		return verdictClean, ""
+	}
+	return verdictPortal, p.URL
+}
+
+// IsNetworkError reports whether a connect failed the way it does on a
+// network that drops or refuses traffic: a timeout, a failed dial or
+// lookup, or a reset connection.
+func IsNetworkError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var urlErr *url.Error
+	return errors.As(err, &dnsErr) || errors.As(err, &opErr) || errors.As(err, &urlErr) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
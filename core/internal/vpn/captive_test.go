@@ -0,0 +1,88 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeTransport answers each URL with a canned response, or fails it.
+type fakeTransport map[string]*http.Response
+
+func (f fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, ok := f[req.URL.String()]
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+func response(status int, body string, header ...string) *http.Response {
+	h := http.Header{}
+	for i := 0; i+1 < len(header); i += 2 {
+		h.Set(header[i], header[i+1])
+	}
+	return &http.Response{StatusCode: status, Header: h, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestDetectCaptivePortal(t *testing.T) {
+	msft, google, apple := captiveProbes[0].URL, captiveProbes[1].URL, captiveProbes[2].URL
+	clean := fakeTransport{
+		msft:   response(200, "Microsoft Connect Test"),
+		google: response(204, ""),
+		apple:  response(200, "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"),
+	}
+	tests := []struct {
+		name      string
+		transport fakeTransport
+		want      CaptivePortal
+	}{
+		{"open network", clean, CaptivePortal{}},
+		{"redirect", fakeTransport{
+			msft:   response(302, "", "Location", "http://portal.hotel.example/login?orig=msft"),
+			google: response(302, "", "Location", "http://portal.hotel.example/login"),
+		}, CaptivePortal{Detected: true, URL: "http://portal.hotel.example/login?orig=msft"}},
+		{"sign-in page in place of the answer", fakeTransport{
+			google: response(200, "<html>Welcome to Airport Wi-Fi</html>"),
+		}, CaptivePortal{Detected: true, URL: google}},
+		{"one clean answer wins", fakeTransport{
+			msft:  response(200, "Microsoft Connect Test"),
+			apple: response(200, "<html>login</html>"),
+		}, CaptivePortal{}},
+		{"offline", fakeTransport{}, CaptivePortal{Offline: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectCaptivePortal(context.Background(), tt.transport, captiveProbes); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNetworkError(t *testing.T) {
+	for _, err := range []error{
+		context.DeadlineExceeded,
+		fmt.Errorf("start: %w", syscall.ECONNREFUSED),
+		&net.DNSError{Err: "no such host", Name: "example.com"},
+		&net.OpError{Op: "dial", Err: errors.New("network is unreachable")},
+		&url.Error{Op: "Get", URL: "http://example.com", Err: io.EOF},
+	} {
+		if !IsNetworkError(err) {
+			t.Errorf("IsNetworkError(%v) = false", err)
+		}
+	}
+	for _, err := range []error{nil, errors.New("invalid config"), ErrTunDriverMissing} {
+		if IsNetworkError(err) {
+			t.Errorf("IsNetworkError(%v) = true", err)
+		}
+	}
+}
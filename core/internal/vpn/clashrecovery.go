@@ -0,0 +1,129 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+)
+
+// If sing-box cannot bind its Clash API, because another program took the
+// port in the meantime, the tunnel works but the stats stay at zero, and
+// everything else served by the API, such as connection lists, hot
+// operations and delay tests, fails. When the first clashUnreachablePolls
+// stats polls of a link all fail to reach the API, the engine reconnects
+// the session once with the API on a newly picked free port. If that
+// link's API is unreachable too, the session keeps its tunnel with
+// StatsUnavailable set, and StatsUnavailable listeners are told once.
+
+// clashUnreachablePolls is how many stats polls at the start of a link
+// must all fail to reach the Clash API before it is taken not to be
+// listening.
+const clashUnreachablePolls = 3
+
+// OriginClashRecovery is the origin of the reconnect that moves the Clash
+// API to a new port.
+const OriginClashRecovery = "clash_recovery"
+
+// Clash API recovery in a session.
+const (
+	clashRecoveryNone    = iota
+	clashRecoveryTried   // reconnected once with the API on a new port
+	clashRecoveryGivenUp // and reported StatsUnavailable
+)
+
+// StatsUnavailableListener is a callback invoked when a session's Clash
+// API cannot be reached even after moving it to a new port.
+type StatsUnavailableListener func(u StatsUnavailable)
+
+// StatsUnavailable reports that the session runs without stats: traffic,
+// speeds and connection lists stay empty until the next connect.
+type StatsUnavailable struct {
+	ClashAddr string `json:"clashAddr"` // where the API was last expected
+	Error     string `json:"error"`     // of the last poll
+}
+
+// clashUnreachable reports whether err, from a stats poll, means nothing
+// listens at the Clash API address, rather than that the API answered
+// with an error.
+func clashUnreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// freeLoopbackAddr returns a loopback address whose port nothing listens
+// on right now.
+func freeLoopbackAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// clashAPIAddr returns the address the current link serves the Clash API
+// on.
+func (e *Engine) clashAPIAddr() string {
+	if addr, _ := e.clashAddr.Load().(string); addr != "" {
+		return addr
+	}
+	return e.inst.ClashAddr()
+}
+
+// recoverClashAPI handles the Clash API of session s's link not being
+// reachable since the link came up, cause being the last poll's error. The
+// first time in a session it reconnects with the API on a new port; after
+// that, or if the reconnect leaves the link as it was, it marks the stats
+// unavailable. It runs on the poller goroutine.
+func (e *Engine) recoverClashAPI(s *pollSession, cause error) {
+	e.mu.Lock()
+	if e.box == nil || e.session != s.id {
+		e.mu.Unlock()
+		return
+	}
+	addr := e.clashAPIAddr()
+	retry := e.clashRecovery == clashRecoveryNone
+	if retry {
+		e.clashRecovery = clashRecoveryTried
+	}
+	e.mu.Unlock()
+
+	if retry {
+		next, err := freeLoopbackAddr()
+		if err == nil {
+			log.Printf("warning: the Clash API at %s is unreachable (%v), reconnecting with it on %s", addr, cause, next)
+			err = e.reconnect(context.Background(), AttemptOptions{Origin: OriginClashRecovery}, func(cfg *Config) {
+				cfg.ClashAddr = next
+			})
+			if err == nil {
+				return
+			}
+		}
+		log.Printf("warning: failed to move the Clash API to a new port: %v", err)
+	}
+
+	e.mu.Lock()
+	if e.box == nil || e.session != s.id {
+		// The reconnect replaced or ended the link.
+		e.mu.Unlock()
+		return
+	}
+	e.statsUnavailable = true
+	notify := e.clashRecovery != clashRecoveryGivenUp
+	e.clashRecovery = clashRecoveryGivenUp
+	e.mu.Unlock()
+
+	log.Printf("warning: the Clash API at %s is unreachable, the session runs without stats: %v", addr, cause)
+	if notify {
+		e.stateMachine.NotifyStatsUnavailable(StatsUnavailable{ClashAddr: addr, Error: cause.Error()})
+	}
+}
+
+// StatsUnavailable reports whether the current link runs without stats
+// because its Clash API cannot be reached.
+func (e *Engine) StatsUnavailable() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.box != nil && e.statsUnavailable
+}
@@ -0,0 +1,210 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeController starts the stub engine's links with a Clash API that
+// listens, or not, as listen says for the link's number, and counts the
+// stats polls sent to each link.
+type fakeController struct {
+	mu     sync.Mutex
+	addrs  []string // the Clash API address of each link
+	polls  map[string]int
+	status int // of the API's answers
+}
+
+type controllerBox struct{ server *http.Server }
+
+func (b controllerBox) Close() error {
+	if b.server != nil {
+		return b.server.Close()
+	}
+	return nil
+}
+
+func newFakeController(t *testing.T, e *Engine, listen func(link int) bool) *fakeController {
+	c := &fakeController{polls: make(map[string]int), status: http.StatusOK}
+	e.startCore = func(_ context.Context, configJSON []byte) (coreBox, error) {
+		var opts struct {
+			Experimental struct {
+				ClashAPI struct {
+					Controller string `json:"external_controller"`
+				} `json:"clash_api"`
+			} `json:"experimental"`
+		}
+		if err := json.Unmarshal(configJSON, &opts); err != nil {
+			return nil, err
+		}
+		addr := opts.Experimental.ClashAPI.Controller
+		c.mu.Lock()
+		c.addrs = append(c.addrs, addr)
+		link := len(c.addrs)
+		c.mu.Unlock()
+		if !listen(link) {
+			return controllerBox{}, nil
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.mu.Lock()
+			status := c.status
+			c.mu.Unlock()
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			json.NewEncoder(w).Encode(clashConnections{DownloadTotal: 10})
+		})}
+		go server.Serve(ln)
+		return controllerBox{server}, nil
+	}
+	client := newClashClient(time.Second)
+	e.fetchConns = func(ctx context.Context, secret string) (*clashConnections, error) {
+		base := e.clashAPIBase()
+		c.mu.Lock()
+		c.polls[base[len("http://"):]]++
+		c.mu.Unlock()
+		return fetchConnections(ctx, client, base, secret)
+	}
+	return c
+}
+
+func (c *fakeController) links() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.addrs...)
+}
+
+func (c *fakeController) pollsOf(addr string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.polls[addr]
+}
+
+// connectOnFreePort connects e with its Clash API on a port nothing
+// listens on but the fake controller's.
+func connectOnFreePort(t *testing.T, e *Engine) {
+	t.Helper()
+	addr, err := freeLoopbackAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+	cfg.ClashAddr = addr
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Disconnect() })
+}
+
+func TestClashRecoveryMovesPort(t *testing.T) {
+	e := newStubEngine()
+	c := newFakeController(t, e, func(link int) bool { return link > 1 })
+	stats := make(chan Stats, 1)
+	e.stateMachine.OnStats(func(s Stats) {
+		select {
+		case stats <- s:
+		default:
+		}
+	})
+	e.stateMachine.OnStatsUnavailable(func(StatsUnavailable) { t.Error("stats reported unavailable") })
+	connectOnFreePort(t, e)
+
+	select {
+	case s := <-stats:
+		if s.Download != 10 {
+			t.Errorf("stats = %+v", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no stats after the recovery")
+	}
+	links := c.links()
+	if len(links) != 2 || links[0] == links[1] {
+		t.Fatalf("links = %v, want a second one on a new port", links)
+	}
+	if n := c.pollsOf(links[0]); n != clashUnreachablePolls {
+		t.Errorf("%d polls of the first link, want %d", n, clashUnreachablePolls)
+	}
+	if e.Reconnects() != 1 || e.StatsUnavailable() || e.Config().ClashAddr != links[1] {
+		t.Errorf("reconnects %d, unavailable %v, addr %s", e.Reconnects(), e.StatsUnavailable(), e.Config().ClashAddr)
+	}
+	if e.stateMachine.State() != StateConnected {
+		t.Errorf("state = %s", e.stateMachine.State())
+	}
+}
+
+func TestClashRecoveryOnce(t *testing.T) {
+	e := newStubEngine()
+	c := newFakeController(t, e, func(int) bool { return false })
+	var mu sync.Mutex
+	var reports []StatsUnavailable
+	e.stateMachine.OnStatsUnavailable(func(u StatsUnavailable) {
+		mu.Lock()
+		reports = append(reports, u)
+		mu.Unlock()
+	})
+	connectOnFreePort(t, e)
+	waitFor(t, "stats to be unavailable", e.StatsUnavailable)
+
+	links := c.links()
+	if len(links) != 2 {
+		t.Fatalf("links = %v, want one recovery", links)
+	}
+	mu.Lock()
+	if len(reports) != 1 || reports[0].ClashAddr != links[1] || reports[0].Error == "" {
+		t.Errorf("reports = %+v", reports)
+	}
+	mu.Unlock()
+	if e.stateMachine.State() != StateConnected {
+		t.Errorf("state = %s, want the tunnel kept up", e.stateMachine.State())
+	}
+
+	// Later links of the session are not recovered or reported again.
+	if err := e.Reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "stats to be unavailable again", e.StatsUnavailable)
+	time.Sleep(20 * time.Millisecond)
+	if links := c.links(); len(links) != 3 {
+		t.Errorf("links = %v, want no second recovery", links)
+	}
+	mu.Lock()
+	if len(reports) != 1 {
+		t.Errorf("%d reports, want 1", len(reports))
+	}
+	mu.Unlock()
+
+	// A new session gets its recovery again.
+	e.Disconnect()
+	connectOnFreePort(t, e)
+	waitFor(t, "the new session's recovery", func() bool { return len(c.links()) == 5 })
+}
+
+func TestClashRecoveryNotForErrorAnswers(t *testing.T) {
+	e := newStubEngine()
+	c := newFakeController(t, e, func(int) bool { return true })
+	c.status = http.StatusUnauthorized
+	stalled := make(chan StatsStall, 1)
+	e.stateMachine.OnStatsStalled(func(s StatsStall) { stalled <- s })
+	connectOnFreePort(t, e)
+
+	select {
+	case <-stalled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no stall reported")
+	}
+	if links := c.links(); len(links) != 1 || e.StatsUnavailable() {
+		t.Errorf("links = %v, unavailable %v; an answering API needs no recovery", links, e.StatsUnavailable())
+	}
+}
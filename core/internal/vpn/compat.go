@@ -0,0 +1,134 @@
+package vpn
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// coreCapability describes a link feature and the first sing-box release
+// that supports it. An empty MinVersion means no sing-box release supports
+// the feature.
+type coreCapability struct {
+	MinVersion  string
+	Description string
+}
+
+// coreCapabilities maps feature names (as returned by RequiredFeatures) to
+// the sing-box version that introduced them.
+var coreCapabilities = map[string]coreCapability{
+	"vless":          {MinVersion: "1.1.0", Description: "VLESS protocol"},
+	"hysteria2":      {MinVersion: "1.5.0", Description: "Hysteria2 protocol"},
+	"hysteria2-obfs": {MinVersion: "1.5.0", Description: "Hysteria2 salamander obfuscation"},
+	"ws":             {MinVersion: "1.0.0", Description: "WebSocket transport"},
+	"grpc":           {MinVersion: "1.0.0", Description: "gRPC transport"},
+	"http":           {MinVersion: "1.0.0", Description: "HTTP/2 transport"},
+	"quic":           {MinVersion: "1.0.0", Description: "QUIC transport"},
+	"httpupgrade":    {MinVersion: "1.8.0", Description: "HTTPUpgrade transport"},
+	"xhttp":          {MinVersion: "", Description: "XHTTP/SplitHTTP transport"},
+	"tls":            {MinVersion: "1.0.0", Description: "TLS"},
+	"reality":        {MinVersion: "1.3.0", Description: "REALITY"},
+	"utls":           {MinVersion: "1.2.0", Description: "uTLS fingerprints"},
+	"ech":            {MinVersion: "1.2.0", Description: "TLS Encrypted Client Hello"},
+}
+
+// RequiredFeatures returns the sorted list of core features a parsed link
+// relies on. Feature names are keys of the capability table.
+func RequiredFeatures(server *parser.ServerConfig) []string {
+	if server == nil {
+		return nil
+	}
+
+	set := map[string]bool{server.Protocol: true}
+	p := server.Params
+
+	switch server.Protocol {
+	case "vless":
+		switch p["type"] {
+		case "ws", "grpc", "quic", "httpupgrade":
+			set[p["type"]] = true
+		case "h2", "http":
+			set["http"] = true
+		case "xhttp", "splithttp":
+			set["xhttp"] = true
+		}
+		switch p["security"] {
+		case "tls", "reality":
+			set[p["security"]] = true
+		}
+		if p["fp"] != "" {
+			set["utls"] = true
+		}
+	case "hysteria2":
+		set["tls"] = true
+		if p["obfs"] != "" {
+			set["hysteria2-obfs"] = true
+		}
+	}
+	if p["ech"] != "" || p["echConfigList"] != "" {
+		set["ech"] = true
+	}
+
+	features := make([]string, 0, len(set))
+	for f := range set {
+		features = append(features, f)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// CheckCompat returns human-readable warnings for each feature the link
+// requires that the given core version does not support. Unknown features
+// and unknown core versions produce no warnings.
+func CheckCompat(server *parser.ServerConfig, version string) []string {
+	var warnings []string
+	for _, f := range RequiredFeatures(server) {
+		c, ok := coreCapabilities[f]
+		if !ok {
+			continue
+		}
+		if c.MinVersion == "" {
+			warnings = append(warnings, fmt.Sprintf("%s is not supported by sing-box", c.Description))
+			continue
+		}
+		if !versionAtLeast(version, c.MinVersion) {
+			warnings = append(warnings, fmt.Sprintf("this link needs sing-box ≥%s for %s (embedded core is %s)",
+				c.MinVersion, c.Description, version))
+		}
+	}
+	return warnings
+}
+
+// UnsupportedFeatureError reports a link that relies on a feature the
+// embedded core lacks, such as the xhttp transport, which the outbound
+// could not carry: the tunnel would come up and pass no traffic.
+type UnsupportedFeatureError struct {
+	Feature     string // a key of the capability table, e.g. "xhttp"
+	Description string
+	CoreVersion string
+	MinVersion  string // empty when no sing-box release supports it
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	if e.MinVersion == "" {
+		return fmt.Sprintf("%s is not supported by this core version (sing-box %s)", e.Description, e.CoreVersion)
+	}
+	return fmt.Sprintf("%s is not supported by this core version (sing-box %s, needs %s or later)", e.Description, e.CoreVersion, e.MinVersion)
+}
+
+// CheckCoreSupport returns an *UnsupportedFeatureError for the first
+// feature the link requires that the given core version does not
+// support, as CheckCompat would warn about.
+func CheckCoreSupport(server *parser.ServerConfig, version string) error {
+	for _, f := range RequiredFeatures(server) {
+		c, ok := coreCapabilities[f]
+		if !ok {
+			continue
+		}
+		if c.MinVersion == "" || !versionAtLeast(version, c.MinVersion) {
+			return &UnsupportedFeatureError{Feature: f, Description: c.Description, CoreVersion: version, MinVersion: c.MinVersion}
+		}
+	}
+	return nil
+}
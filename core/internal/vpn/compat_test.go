@@ -0,0 +1,124 @@
+package vpn
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		v, min string
+		want   bool
+	}{
+		{"1.12.21", "1.8.0", true},
+		{"v1.12.21", "1.12.21", true},
+		{"1.7.9", "1.8.0", false},
+		{"1.10", "1.9.5", true},
+		{"1.8.0-beta.3", "1.8.0", true},
+		{"1.2", "1.2.1", false},
+		{"unknown", "1.8.0", true},
+	}
+	for _, tt := range tests {
+		if got := versionAtLeast(tt.v, tt.min); got != tt.want {
+			t.Errorf("versionAtLeast(%q, %q) = %v, want %v", tt.v, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestRequiredFeatures(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *parser.ServerConfig
+		want   []string
+	}{
+		{
+			name: "vless reality",
+			server: &parser.ServerConfig{Protocol: "vless", Params: map[string]string{
+				"type": "tcp", "security": "reality", "fp": "chrome",
+			}},
+			want: []string{"reality", "utls", "vless"},
+		},
+		{
+			name: "vless httpupgrade tls",
+			server: &parser.ServerConfig{Protocol: "vless", Params: map[string]string{
+				"type": "httpupgrade", "security": "tls",
+			}},
+			want: []string{"httpupgrade", "tls", "vless"},
+		},
+		{
+			name: "vless h2 alias",
+			server: &parser.ServerConfig{Protocol: "vless", Params: map[string]string{
+				"type": "h2", "security": "none",
+			}},
+			want: []string{"http", "vless"},
+		},
+		{
+			name: "hysteria2 obfs",
+			server: &parser.ServerConfig{Protocol: "hysteria2", Params: map[string]string{
+				"obfs": "salamander",
+			}},
+			want: []string{"hysteria2", "hysteria2-obfs", "tls"},
+		},
+	}
+	for _, tt := range tests {
+		if got := RequiredFeatures(tt.server); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: RequiredFeatures = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCompat(t *testing.T) {
+	httpUpgrade := &parser.ServerConfig{Protocol: "vless", Params: map[string]string{
+		"type": "httpupgrade", "security": "tls",
+	}}
+	if w := CheckCompat(httpUpgrade, "1.12.21"); len(w) != 0 {
+		t.Errorf("expected no warnings on 1.12.21, got %v", w)
+	}
+	w := CheckCompat(httpUpgrade, "1.7.0")
+	if len(w) != 1 || !strings.Contains(w[0], "≥1.8.0") {
+		t.Errorf("expected httpupgrade warning on 1.7.0, got %v", w)
+	}
+
+	xhttp := &parser.ServerConfig{Protocol: "vless", Params: map[string]string{"type": "xhttp"}}
+	w = CheckCompat(xhttp, "1.12.21")
+	if len(w) != 1 || !strings.Contains(w[0], "not supported") {
+		t.Errorf("expected unsupported xhttp warning, got %v", w)
+	}
+
+	if w := CheckCompat(httpUpgrade, "unknown"); len(w) != 0 {
+		t.Errorf("expected no warnings for unknown core version, got %v", w)
+	}
+}
+
+func TestCheckCoreSupport(t *testing.T) {
+	httpUpgrade := &parser.ServerConfig{Protocol: "vless", Params: map[string]string{"type": "httpupgrade"}}
+	if err := CheckCoreSupport(httpUpgrade, "1.12.21"); err != nil {
+		t.Errorf("httpupgrade on 1.12.21: %v", err)
+	}
+	var unsupported *UnsupportedFeatureError
+	if err := CheckCoreSupport(httpUpgrade, "1.7.0"); !errors.As(err, &unsupported) || unsupported.MinVersion != "1.8.0" {
+		t.Errorf("httpupgrade on 1.7.0: %v", err)
+	}
+	// No sing-box release carries xhttp, whatever the version.
+	for _, transport := range []string{"xhttp", "splithttp"} {
+		server := &parser.ServerConfig{Protocol: "vless", Params: map[string]string{"type": transport}}
+		err := CheckCoreSupport(server, "unknown")
+		if !errors.As(err, &unsupported) || unsupported.Feature != "xhttp" ||
+			!strings.Contains(err.Error(), "not supported by this core version") {
+			t.Errorf("%s: %v", transport, err)
+		}
+	}
+}
+
+func TestBuildConfigXHTTP(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@cdn.example.com:443?type=xhttp&security=tls&path=%2Fxh&host=cdn.example.com")
+	var unsupported *UnsupportedFeatureError
+	if _, err := BuildSingBoxConfig(cfg); !errors.As(err, &unsupported) || unsupported.Feature != "xhttp" {
+		t.Fatalf("err = %v, want an UnsupportedFeatureError", err)
+	}
+}
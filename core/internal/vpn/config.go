@@ -4,23 +4,208 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 
+	"github.com/mriaz/vpn-core/internal/instance"
 	"github.com/mriaz/vpn-core/internal/parser"
 	"github.com/mriaz/vpn-core/internal/splittunnel"
 )
 
 // Config holds the VPN configuration options.
 type Config struct {
-	Server          *parser.ServerConfig
-	DNS             string   // "system", "cloudflare", "google", "custom"
-	CustomDNS       string   // used when DNS == "custom"
-	MTU             int
-	KillSwitch      bool
-	SplitTunnelMode string   // "off", "app", "domain"
-	SplitTunnelApps []string // process names like "chrome.exe"
+	Server *parser.ServerConfig
+	// RawOutbound, when set, is used as the proxy outbound instead of the
+	// one built from Server, which then only describes it. It comes from
+	// ParseRawOutbound.
+	RawOutbound        map[string]interface{}
+	DNS                string // "system", "cloudflare", "google", "custom"
+	CustomDNS          string // used when DNS == "custom"
+	MTU                int
+	KillSwitch         bool
+	SplitTunnelMode    string   // "off", "app", "domain"
+	SplitTunnelApps    []string // process names like "chrome.exe"
 	SplitTunnelDomains []string
 	SplitTunnelInvert  bool // true = "all except selected"
+
+	// DNSHijackExceptions lists apps (process names) and destination IPs
+	// whose DNS traffic bypasses the hijack and goes direct.
+	DNSHijackExceptions []string
+
+	// DNSServers resolve their domain suffixes with servers of their own,
+	// ahead of the built-in resolvers (see splittunnel.DNSServer).
+	DNSServers []splittunnel.DNSServer
+
+	// BuiltinBypasses names curated destination bundles sent direct
+	// ahead of the final rule (see splittunnel.BuildBypassRules).
+	BuiltinBypasses []string
+
+	// Advanced tuning; zero values use the defaults.
+	TCPKeepAliveSeconds int    // keep-alive period for TCP-based outbounds (VLESS)
+	IdleTimeoutSeconds  int    // idle timeout for UDP sessions, which Hysteria2 carries over QUIC; ignored for other protocols
+	WSMaxEarlyData      int    // WebSocket early data in bytes; overrides the link's ed
+	WSEarlyDataHeader   string // header carrying early data; overrides the link's eh
+	SniffMode           string // SniffFull (default when empty), SniffProxyOnly or SniffOff
+	TransportPolicy     string // TransportAuto (default when empty), TransportTCPOnly or TransportBlockQUIC
+
+	// HardenInterface forces the TUN adapter's interface metric to 1 and
+	// disables its DNS registration after start; PinTunDNS additionally
+	// points the adapter's DNS at the tunnel stub.
+	HardenInterface bool
+	PinTunDNS       bool
+
+	// DelayConnectedUntilRouteVerified holds the Connected state until
+	// Windows routes public addresses through the TUN adapter, so apps
+	// that start on Connected cannot go out directly (see EarlyLeak).
+	DelayConnectedUntilRouteVerified bool
+
+	PowerMode string // PowerNormal (default when empty) or PowerLow
+
+	// DNSQueryLog turns on process lookup, so the domain activity index
+	// (see Engine.SetDNSQueryLog) can tell which app made a connection.
+	DNSQueryLog bool
+
+	// CacheFile is the path of sing-box's cache file; empty disables it
+	// and state such as urltest selections resets every connect.
+	CacheFile string
+
+	LAN *LANShare // nil unless the tunnel is shared with the LAN
+
+	// RateLimit caps the tunnel's throughput; zero is unlimited.
+	RateLimit RateLimit
+
+	// UpstreamProxy, when set, is the HTTP or SOCKS5 proxy the connection
+	// to the server goes through.
+	UpstreamProxy *UpstreamProxy
+
+	// OuterNetwork is how the machine reaches the server; the connect sets
+	// it from the routing table.
+	OuterNetwork OuterNetwork
+
+	// Simulation, when set, runs the session on a simulated core instead
+	// of sing-box; see SimulationFor.
+	Simulation *Simulation
+
+	// Limits bound the size of the generated config; zero fields use
+	// DefaultConfigLimits.
+	Limits ConfigLimits
+
+	// Instance names the TUN adapter and Clash API port; Engine.Connect
+	// sets it to the engine's.
+	Instance instance.Instance
+
+	// ClashAddr, when set, is where the Clash API listens instead of the
+	// instance's port; the engine sets it when that port is taken.
+	ClashAddr string
+}
+
+// clashAddr returns the Clash API listen address of c.
+func (c *Config) clashAddr() string {
+	if c.ClashAddr != "" {
+		return c.ClashAddr
+	}
+	return c.Instance.ClashAddr()
+}
+
+// Outbound and DNS server tags. Explain interprets the generated config by
+// these, so they are the single source of truth for both.
+const (
+	tagProxy     = "proxy" // also set by the parser outbound builders
+	tagDirect    = "direct"
+	tagBlock     = "block"
+	tagDNSOut    = "dns-out"
+	tagRemoteDNS = "remote-dns"
+	tagLocalDNS  = "local-dns"
+)
+
+// Sniff modes control protocol sniffing on the TUN inbound.
+//
+// SniffFull sniffs every connection and rewrites its destination to the
+// sniffed domain. Some IP-pinned apps (anti-cheat, banking) detect the
+// rewrite, which matters when they are routed direct.
+//
+// SniffProxyOnly sniffs only traffic that may be proxied, plus DNS so the
+// hijack keeps working, and rewrites nothing. Direct-routed apps are never
+// sniffed. sing-box cannot rewrite per rule, so proxied traffic also keeps
+// its IP destination.
+//
+// SniffOff disables sniffing. DNS is hijacked by port instead of protocol,
+// and domain split tunneling only matches connections whose domain sing-box
+// learned from its own DNS answers.
+const (
+	SniffFull      = "full"
+	SniffProxyOnly = "proxy-only"
+	SniffOff       = "off"
+)
+
+// Transport policies restrict UDP for networks that drop or throttle it.
+//
+// TransportTCPOnly blocks all UDP except DNS, so apps fall back to TCP
+// instead of waiting on packets that never arrive. Hysteria2 and TUIC run
+// over QUIC and cannot be used.
+//
+// TransportBlockQUIC blocks only UDP port 443, which makes browsers fall
+// back from HTTP/3 to TCP. QUIC inside a TCP-based tunnel is often slower
+// than TCP.
+const (
+	TransportAuto      = "auto"
+	TransportTCPOnly   = "tcp-only"
+	TransportBlockQUIC = "block-quic"
+)
+
+// ErrTransportConflict reports a server whose protocol the transport
+// policy does not allow.
+var ErrTransportConflict = errors.New("server protocol requires UDP, which the transport policy blocks")
+
+// Tuning limits. Keep-alive below 10s wakes radios for nothing; above 10
+// minutes most middleboxes have already dropped the idle flow.
+const (
+	defaultTCPKeepAlive = 30
+	minTCPKeepAlive     = 10
+	maxTCPKeepAlive     = 600
+	minIdleTimeout      = 10
+	maxIdleTimeout      = 3600
+)
+
+// ValidateTuning checks the advanced tuning fields are within range.
+func (c *Config) ValidateTuning() error {
+	if c.TCPKeepAliveSeconds != 0 && (c.TCPKeepAliveSeconds < minTCPKeepAlive || c.TCPKeepAliveSeconds > maxTCPKeepAlive) {
+		return fmt.Errorf("tcpKeepAliveSeconds must be between %d and %d", minTCPKeepAlive, maxTCPKeepAlive)
+	}
+	if c.IdleTimeoutSeconds != 0 && (c.IdleTimeoutSeconds < minIdleTimeout || c.IdleTimeoutSeconds > maxIdleTimeout) {
+		return fmt.Errorf("idleTimeoutSeconds must be between %d and %d", minIdleTimeout, maxIdleTimeout)
+	}
+	if err := c.Limits.Validate(); err != nil {
+		return err
+	}
+	if c.WSMaxEarlyData < 0 || c.WSMaxEarlyData > parser.MaxWSEarlyData {
+		return fmt.Errorf("wsMaxEarlyData must be between 0 and %d", parser.MaxWSEarlyData)
+	}
+	if c.WSEarlyDataHeader != "" {
+		if err := parser.ValidateHeaderName(c.WSEarlyDataHeader); err != nil {
+			return err
+		}
+	}
+	switch c.SniffMode {
+	case "", SniffFull, SniffProxyOnly, SniffOff:
+	default:
+		return fmt.Errorf("sniffMode must be %q, %q or %q", SniffFull, SniffProxyOnly, SniffOff)
+	}
+	switch c.TransportPolicy {
+	case "", TransportAuto, TransportTCPOnly, TransportBlockQUIC:
+	default:
+		return fmt.Errorf("transportPolicy must be %q, %q or %q", TransportAuto, TransportTCPOnly, TransportBlockQUIC)
+	}
+	return c.RateLimit.Validate()
+}
+
+// CheckTransport returns ErrTransportConflict if the server cannot work
+// under the transport policy.
+func (c *Config) CheckTransport() error {
+	if c.TransportPolicy == TransportTCPOnly && c.Server != nil && (c.Server.Protocol == "hysteria2" || c.Server.Protocol == "tuic") {
+		return ErrTransportConflict
+	}
+	return nil
 }
 
 // DefaultConfig returns a Config with sensible defaults.
@@ -29,96 +214,288 @@ func DefaultConfig() *Config {
 		DNS:             "cloudflare",
 		MTU:             9000,
 		SplitTunnelMode: "off",
+		HardenInterface: true,
 	}
 }
 
-// BuildSingBoxConfig builds a complete sing-box JSON configuration.
-// Returns the config JSON, the Clash API secret, and an error.
-func BuildSingBoxConfig(cfg *Config) ([]byte, string, error) {
-	if cfg.Server == nil {
-		return nil, "", fmt.Errorf("no server configuration provided")
-	}
-
-	// Build outbound based on protocol
-	var proxyOutbound map[string]interface{}
-	switch cfg.Server.Protocol {
-	case "vless":
-		proxyOutbound = parser.BuildVLESSOutbound(cfg.Server)
-	case "hysteria2":
-		proxyOutbound = parser.BuildHysteria2Outbound(cfg.Server)
-	default:
-		return nil, "", fmt.Errorf("unsupported protocol: %s", cfg.Server.Protocol)
-	}
+// BuiltConfig is a generated sing-box configuration.
+type BuiltConfig struct {
+	JSON        []byte
+	ClashSecret string     // Clash API authentication secret
+	Rules       []RuleInfo // labels for route.rules, index-aligned
+	Final       RuleInfo   // label for the final route
+}
 
+// BuildSingBoxConfig builds a complete sing-box JSON configuration along
+// with labels for its route rules. The labels are derived from the same
+// rule list that is serialized, so their indices always match.
+func BuildSingBoxConfig(cfg *Config) (*BuiltConfig, error) {
 	// Generate a random secret for the Clash API
 	secretBytes := make([]byte, 16)
 	if _, err := rand.Read(secretBytes); err != nil {
-		return nil, "", fmt.Errorf("failed to generate clash API secret: %w", err)
+		return nil, fmt.Errorf("failed to generate clash API secret: %w", err)
 	}
-	clashSecret := hex.EncodeToString(secretBytes)
+	return buildConfig(cfg, hex.EncodeToString(secretBytes))
+}
+
+// Connection modes: how traffic reaches sing-box. Only ConnectionTUN is
+// implemented; ConnectionProxy, where apps opt in through the system proxy
+// and no TUN adapter exists, is planned.
+const (
+	ConnectionTUN   = "tun"
+	ConnectionProxy = "proxy"
+)
+
+// SplitSupport reports whether a split tunnel mode takes effect in a
+// connection mode. A Limited mode works for part of the traffic only.
+type SplitSupport struct {
+	Mode      string `json:"mode"` // "off", "app" or "domain"
+	Supported bool   `json:"supported"`
+	Limited   bool   `json:"limited,omitempty"`
+	Reason    string `json:"reason,omitempty"` // why not, or what limits it
+}
 
-	// DNS servers
-	dnsServers := buildDNSConfig(cfg)
+// SplitCapabilities lists the split tunnel modes and whether the configs
+// BuildSingBoxConfig generates for connMode and sniffMode honor them. The
+// builder tests check this matrix against the generated rules.
+func SplitCapabilities(connMode, sniffMode string) []SplitSupport {
+	off := SplitSupport{Mode: "off", Supported: true}
+	app := SplitSupport{Mode: "app", Supported: true}
+	domain := SplitSupport{Mode: "domain", Supported: true}
+	switch {
+	case connMode == ConnectionProxy:
+		app = SplitSupport{Mode: "app", Reason: "apps are identified by process, which needs the TUN adapter"}
+		domain = SplitSupport{Mode: "domain", Reason: "proxy-only mode has no rule routing yet"}
+	case sniffMode == SniffOff:
+		domain.Limited = true
+		domain.Reason = "sniffing is off; domain rules only match connections whose domain was resolved through the VPN's DNS"
+	}
+	return []SplitSupport{off, app, domain}
+}
 
-	// Route rules
+// SplitSupportFor returns the support of one split tunnel mode, treating an
+// empty mode as "off".
+func SplitSupportFor(connMode, sniffMode, splitMode string) SplitSupport {
+	if splitMode == "" {
+		splitMode = "off"
+	}
+	for _, s := range SplitCapabilities(connMode, sniffMode) {
+		if s.Mode == splitMode {
+			return s
+		}
+	}
+	return SplitSupport{Mode: splitMode, Reason: "unknown split tunnel mode"}
+}
+
+// buildConfig builds the configuration with the given Clash API secret.
+// The output depends on nothing else, which the golden tests rely on.
+func buildConfig(cfg *Config, clashSecret string) (*BuiltConfig, error) {
+	if cfg.Server == nil {
+		return nil, fmt.Errorf("no server configuration provided")
+	}
+
+	if err := cfg.ValidateTuning(); err != nil {
+		return nil, err
+	}
+	if err := CheckCoreSupport(cfg.Server, CoreVersion()); err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckTransport(); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamProxy != nil {
+		if err := cfg.UpstreamProxy.Validate(); err != nil {
+			return nil, fmt.Errorf("upstream proxy: %w", err)
+		}
+		if err := cfg.CheckUpstreamProxy(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.LAN != nil {
+		if err := cfg.LAN.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	dnsExceptionApps, _, err := splittunnel.ParseDNSExceptions(cfg.DNSHijackExceptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := splittunnel.ValidateBypasses(cfg.BuiltinBypasses); err != nil {
+		return nil, err
+	}
+	if cfg.SplitTunnelMode == "domain" {
+		if _, err := splittunnel.ParseDomains(cfg.SplitTunnelDomains); err != nil {
+			return nil, err
+		}
+	}
+	outbounds, err := buildOutbounds(cfg)
+	if err != nil {
+		return nil, err
+	}
 	routeRules, finalOutbound := buildRouteRules(cfg)
+	dns := buildDNSConfig(cfg)
+	limits := cfg.Limits.WithDefaults()
+	if err := checkComplexity(limits, routeRules, dns, outbounds); err != nil {
+		return nil, err
+	}
 
-	// Build the full config
 	config := map[string]interface{}{
 		"log": map[string]interface{}{
-			"level":     "info",
+			"level":     logLevelFor(cfg.PowerMode),
 			"timestamp": true,
 		},
-		"dns": dnsServers,
-		"inbounds": []interface{}{
-			map[string]interface{}{
-				"type": "tun",
-				"tag":  "tun-in",
-				"interface_name":    "MRVPN",
-				"inet4_address":     "172.19.0.1/30",
-				"inet6_address":     "fdfe:dcba:9876::1/126",
-				"mtu":               cfg.MTU,
-				"auto_route":        true,
-				"strict_route":      cfg.KillSwitch,
-				"stack":             "mixed",
-				"sniff":             true,
-				"sniff_override_destination": true,
-			},
-		},
-		"outbounds": []interface{}{
-			proxyOutbound,
-			map[string]interface{}{
-				"type": "direct",
-				"tag":  "direct",
-			},
-			map[string]interface{}{
-				"type": "block",
-				"tag":  "block",
-			},
-			map[string]interface{}{
-				"type": "dns",
-				"tag":  "dns-out",
-			},
-		},
+		"dns":       dns,
+		"inbounds":  buildInbounds(cfg),
+		"outbounds": outbounds,
 		"route": map[string]interface{}{
-			"rules":        routeRules,
-			"final":        finalOutbound,
+			"rules":                 routeRules,
+			"final":                 finalOutbound,
 			"auto_detect_interface": true,
-			"find_process": cfg.SplitTunnelMode == "app",
-		},
-		"experimental": map[string]interface{}{
-			"clash_api": map[string]interface{}{
-				"external_controller": "127.0.0.1:9090",
-				"secret":              clashSecret,
-			},
+			"find_process":          needsFindProcess(cfg, dnsExceptionApps),
 		},
+		"experimental": buildExperimental(clashSecret, cfg.CacheFile, cfg.clashAddr()),
 	}
 
 	jsonBytes, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
-		return nil, "", err
+		return nil, err
+	}
+	if len(jsonBytes) > limits.MaxJSONBytes {
+		return nil, &ConfigLimitError{Limit: LimitJSONBytes, Max: limits.MaxJSONBytes, Actual: len(jsonBytes)}
+	}
+	rules, final := describeRules(routeRules, finalOutbound)
+	return &BuiltConfig{
+		JSON:        jsonBytes,
+		ClashSecret: clashSecret,
+		Rules:       rules,
+		Final:       final,
+	}, nil
+}
+
+// tunAddress4 is the IPv4 address of the TUN adapter.
+const tunAddress4 = "172.19.0.1"
+
+// buildInbounds builds the TUN inbound and, if enabled, the LAN sharing
+// inbound.
+func buildInbounds(cfg *Config) []interface{} {
+	// Full sniffing uses the inbound options; the other modes sniff via
+	// route rules (see buildRouteRules).
+	inboundSniff := cfg.SniffMode == "" || cfg.SniffMode == SniffFull
+
+	tunInbound := map[string]interface{}{
+		"type":                       "tun",
+		"tag":                        "tun-in",
+		"interface_name":             cfg.Instance.InterfaceName(),
+		"inet4_address":              tunAddress4 + "/30",
+		"inet6_address":              "fdfe:dcba:9876::1/126",
+		"mtu":                        cfg.MTU,
+		"auto_route":                 true,
+		"strict_route":               strictRoute(cfg),
+		"stack":                      "mixed",
+		"sniff":                      inboundSniff,
+		"sniff_override_destination": inboundSniff,
+	}
+	// sing-box has no idle timeout on the hysteria2 outbound, only the
+	// TUN inbound's, which applies to the UDP sessions of every protocol;
+	// so it is only set for hysteria2 servers.
+	if cfg.IdleTimeoutSeconds > 0 && cfg.Server != nil && cfg.Server.Protocol == "hysteria2" {
+		tunInbound["udp_timeout"] = seconds(cfg.IdleTimeoutSeconds)
+	}
+	inbounds := []interface{}{tunInbound}
+	if cfg.LAN != nil {
+		inbounds = append(inbounds, buildLANInbound(cfg.LAN, inboundSniff))
+	}
+	return inbounds
+}
+
+// buildOutbounds builds the proxy outbound followed by the fixed direct,
+// block and DNS outbounds the route rules refer to.
+func buildOutbounds(cfg *Config) ([]interface{}, error) {
+	proxyOutbound, err := buildProxyOutbound(cfg)
+	if err != nil {
+		return nil, err
+	}
+	outbounds := []interface{}{
+		proxyOutbound,
+		map[string]interface{}{
+			"type": "direct",
+			"tag":  tagDirect,
+		},
+		map[string]interface{}{
+			"type": "block",
+			"tag":  tagBlock,
+		},
+		map[string]interface{}{
+			"type": "dns",
+			"tag":  tagDNSOut,
+		},
+	}
+	applyOuterNetwork(cfg, proxyOutbound)
+	if shaped := applyRateLimit(cfg, proxyOutbound); shaped != nil {
+		outbounds = append(outbounds, shaped)
+	}
+	if upstream := applyUpstreamProxy(cfg, proxyOutbound); upstream != nil {
+		outbounds = append(outbounds, upstream)
+	}
+	return outbounds, nil
+}
+
+// buildExperimental enables the Clash API the engine polls for stats on
+// clashAddr, and the cache file when cacheFile is set.
+func buildExperimental(clashSecret, cacheFile, clashAddr string) map[string]interface{} {
+	experimental := map[string]interface{}{
+		"clash_api": map[string]interface{}{
+			"external_controller": clashAddr,
+			"secret":              clashSecret,
+		},
+	}
+	if cacheFile != "" {
+		experimental["cache_file"] = map[string]interface{}{
+			"enabled": true,
+			"path":    cacheFile,
+		}
+	}
+	return experimental
+}
+
+// buildProxyOutbound builds the "proxy" outbound for the server and applies
+// the advanced tuning options. A raw outbound is used as written.
+func buildProxyOutbound(cfg *Config) (map[string]interface{}, error) {
+	if cfg.RawOutbound != nil {
+		return copyRawOutbound(cfg.RawOutbound)
+	}
+	var outbound map[string]interface{}
+	switch cfg.Server.Protocol {
+	case "vless":
+		outbound = buildVLESSOutbound(cfg.Server)
+		keepAlive := cfg.TCPKeepAliveSeconds
+		if keepAlive == 0 {
+			keepAlive = defaultTCPKeepAlive
+		}
+		outbound["tcp_keep_alive"] = seconds(keepAlive)
+	case "hysteria2":
+		outbound = buildHysteria2Outbound(cfg.Server)
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", cfg.Server.Protocol)
 	}
-	return jsonBytes, clashSecret, nil
+
+	if ws, ok := outbound["transport"].(map[string]interface{}); ok && ws["type"] == "ws" {
+		if cfg.WSMaxEarlyData > 0 {
+			ws["max_early_data"] = cfg.WSMaxEarlyData
+			if _, ok := ws["early_data_header_name"]; !ok {
+				ws["early_data_header_name"] = parser.DefaultEarlyDataHeader
+			}
+		}
+		if cfg.WSEarlyDataHeader != "" && ws["max_early_data"] != nil {
+			ws["early_data_header_name"] = cfg.WSEarlyDataHeader
+		}
+	}
+	return outbound, nil
+}
+
+// seconds formats a duration for sing-box duration fields.
+func seconds(n int) string {
+	return fmt.Sprintf("%ds", n)
 }
 
 func buildDNSConfig(cfg *Config) map[string]interface{} {
@@ -135,62 +512,201 @@ func buildDNSConfig(cfg *Config) map[string]interface{} {
 		remoteDNS = "https://cloudflare-dns.com/dns-query"
 		localDNS = "1.1.1.1"
 	}
+	// Without an IPv4 route the public resolvers are out of reach, and only
+	// the network's own resolver synthesizes addresses for IPv4-only
+	// servers.
+	if cfg.OuterNetwork.IPv6Only && cfg.DNS != "custom" {
+		localDNS = "local"
+	}
 
-	return map[string]interface{}{
-		"servers": []interface{}{
-			map[string]interface{}{
-				"tag":     "remote-dns",
-				"address": remoteDNS,
-				"detour":  "proxy",
-			},
-			map[string]interface{}{
-				"tag":     "local-dns",
-				"address": localDNS,
-				"detour":  "direct",
-			},
+	servers := []interface{}{
+		map[string]interface{}{
+			"tag":     tagRemoteDNS,
+			"address": remoteDNS,
+			"detour":  tagProxy,
 		},
-		"rules": []interface{}{
-			map[string]interface{}{
-				"outbound": []string{"any"},
-				"server":   "local-dns",
-			},
+		map[string]interface{}{
+			"tag":     tagLocalDNS,
+			"address": localDNS,
+			"detour":  tagDirect,
 		},
-		"final": "remote-dns",
+	}
+	rules := []interface{}{
+		map[string]interface{}{
+			"outbound": []string{"any"},
+			"server":   tagLocalDNS,
+		},
+	}
+	// Per-domain servers follow the built-in ones; the outbound rule above
+	// keeps resolving the proxy server itself.
+	customServers, customRules := splittunnel.BuildDNSServers(cfg.DNSServers, tagLocalDNS)
+	return map[string]interface{}{
+		"servers": append(servers, customServers...),
+		"rules":   append(rules, customRules...),
+		"final":   tagRemoteDNS,
 	}
 }
 
 func buildRouteRules(cfg *Config) ([]interface{}, string) {
-	rules := []interface{}{
-		// DNS hijack rule
-		map[string]interface{}{
+	// DNS hijack exceptions must come first: the hijack rule below would
+	// otherwise capture their traffic.
+	rules := splittunnel.BuildDNSExceptionRules(cfg.DNSHijackExceptions)
+
+	// DNS hijack rule. Without sniffing the protocol is unknown, so DNS is
+	// recognized by port.
+	switch cfg.SniffMode {
+	case SniffOff:
+		rules = append(rules, map[string]interface{}{
+			"port":     53,
+			"outbound": tagDNSOut,
+		})
+	case SniffProxyOnly:
+		rules = append(rules, sniffRule(map[string]interface{}{"port": 53}), map[string]interface{}{
 			"protocol": "dns",
-			"outbound": "dns-out",
-		},
+			"outbound": tagDNSOut,
+		})
+	default:
+		rules = append(rules, map[string]interface{}{
+			"protocol": "dns",
+			"outbound": tagDNSOut,
+		})
+	}
+	proxyOnly := cfg.SniffMode == SniffProxyOnly
+
+	// UDP blocking applies to direct traffic too and comes after the DNS
+	// hijack so DNS keeps working.
+	switch cfg.TransportPolicy {
+	case TransportTCPOnly:
+		rules = append(rules, map[string]interface{}{
+			"network":  "udp",
+			"outbound": tagBlock,
+		})
+	case TransportBlockQUIC:
+		rules = append(rules, map[string]interface{}{
+			"network":  "udp",
+			"port":     443,
+			"outbound": tagBlock,
+		})
+	}
+
+	// LAN devices always use the tunnel; the split tunnel rules below
+	// describe this machine's apps and choices.
+	if cfg.LAN != nil {
+		rules = append(rules, map[string]interface{}{
+			"inbound":  []string{tagLANIn},
+			"outbound": tagProxy,
+		})
 	}
 
-	finalOutbound := "proxy" // default: route everything through VPN
+	finalOutbound := tagProxy // default: route everything through VPN
 
 	switch cfg.SplitTunnelMode {
 	case "app":
 		appRules := splittunnel.BuildAppRules(cfg.SplitTunnelApps, cfg.SplitTunnelInvert)
-		rules = append(rules, appRules...)
 		if cfg.SplitTunnelInvert {
 			// "all except selected" → selected apps go direct, rest go proxy
-			finalOutbound = "proxy"
+			rules = append(rules, appRules...)
+			if proxyOnly {
+				rules = append(rules, sniffRule(nil))
+			}
+			finalOutbound = tagProxy
 		} else {
 			// "only selected" → selected apps go proxy, rest go direct
-			finalOutbound = "direct"
+			if proxyOnly && len(appRules) > 0 {
+				apps := appRules[0].(map[string]interface{})["process_name"]
+				rules = append(rules, sniffRule(map[string]interface{}{"process_name": apps}))
+			}
+			rules = append(rules, appRules...)
+			finalOutbound = tagDirect
+			if cfg.KillSwitch {
+				// Only traffic of a known other app goes direct. A
+				// connection whose process could not be identified may be
+				// a selected app's, so the kill switch keeps it in the
+				// tunnel with theirs.
+				rules = append(rules, map[string]interface{}{
+					"process_path_regex": []string{anyProcess},
+					"outbound":           tagDirect,
+				})
+				finalOutbound = tagProxy
+			}
 		}
 
 	case "domain":
-		domainRules := splittunnel.BuildDomainRules(cfg.SplitTunnelDomains, cfg.SplitTunnelInvert)
+		// Domains are only known after sniffing.
+		if proxyOnly {
+			rules = append(rules, sniffRule(nil))
+		}
+		domainRules, _ := splittunnel.BuildDomainRules(cfg.SplitTunnelDomains, cfg.SplitTunnelInvert) // validated in buildConfig
 		rules = append(rules, domainRules...)
-		if cfg.SplitTunnelInvert {
-			finalOutbound = "proxy"
-		} else {
-			finalOutbound = "direct"
+		switch {
+		case cfg.SplitTunnelInvert:
+			finalOutbound = tagProxy
+		case cfg.KillSwitch:
+			// Only traffic whose domain is known to be unlisted goes
+			// direct. Connections that could not be sniffed may be to a
+			// listed domain, so the kill switch keeps them in the tunnel.
+			rules = append(rules, map[string]interface{}{
+				"protocol": sniffedDomainProtocols,
+				"outbound": tagDirect,
+			})
+			finalOutbound = tagProxy
+		default:
+			finalOutbound = tagDirect
+		}
+
+	default:
+		if proxyOnly {
+			rules = append(rules, sniffRule(nil))
 		}
 	}
 
+	// Built-in bypasses come after the split tunnel rules, so an app or
+	// domain the user chose for the tunnel keeps it. When the final rule
+	// is direct they have nothing left to do. Every mode above that ends
+	// in the proxy already sniffs in proxy-only mode, so their domains
+	// can match.
+	if finalOutbound == tagProxy {
+		rules = append(rules, splittunnel.BuildBypassRules(cfg.BuiltinBypasses)...)
+	}
+
 	return rules, finalOutbound
 }
+
+// anyProcess matches the path of every process sing-box identified.
+const anyProcess = ".+"
+
+// strictRoute reports whether the TUN inbound routes strictly, keeping
+// traffic from leaving through other interfaces. That is what the kill
+// switch means wherever the tunnel is the default route:
+//
+//	split mode             kill switch off          kill switch on
+//	none, domain           as configured            + strict routing
+//	app, all except        selected apps direct     + strict routing
+//	app, only selected     others direct            selected and unidentified
+//	                                                apps tunneled, no strict
+//	                                                routing
+//
+// With only selected apps in the tunnel, strict routing would hold every
+// other app in the adapter as well, which sing-box versions handle
+// differently, from breaking their traffic to letting it all through.
+// Instead the route rules keep the selected apps, and connections whose
+// app is unknown, on the proxy outbound alone: while the tunnel is down
+// their connections fail rather than go direct, and other apps are not
+// affected. Windows may still send the selected apps' name lookups to
+// other interfaces' DNS servers, which only strict routing prevents.
+func strictRoute(cfg *Config) bool {
+	return cfg.KillSwitch && !(cfg.SplitTunnelMode == "app" && !cfg.SplitTunnelInvert)
+}
+
+// sniffedDomainProtocols are the sniffed protocols that carry a domain.
+var sniffedDomainProtocols = []string{"http", "tls", "quic"}
+
+// sniffRule returns a route rule that sniffs connections matching match
+// (all connections if nil) without rewriting their destination.
+func sniffRule(match map[string]interface{}) map[string]interface{} {
+	rule := map[string]interface{}{"action": "sniff"}
+	for field, value := range match {
+		rule[field] = value
+	}
+	return rule
+}
@@ -0,0 +1,805 @@
+package vpn
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+	"github.com/sagernet/sing-box/option"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// checkGolden compares got with testdata/<name>.golden.json, rewriting the
+// file first when -update is set.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden.json")
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden file (run with -update): %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("mismatch for %s\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func mustParse(t *testing.T, link string) *parser.ServerConfig {
+	t.Helper()
+	server, err := parser.ParseLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// TestProxyOutboundGolden documents how each tuning knob maps to the
+// sing-box outbound JSON.
+func TestProxyOutboundGolden(t *testing.T) {
+	tests := []struct {
+		golden string
+		link   string
+		tune   func(*Config)
+	}{
+		{"vless_default_keepalive", "vless://u@example.com:443?security=tls&sni=example.com", nil},
+		{"vless_keepalive", "vless://u@example.com:443", func(c *Config) { c.TCPKeepAliveSeconds = 120 }},
+		{"vless_ws_early_data_link", "vless://u@example.com:443?type=ws&path=%2Fws%3Fed%3D2048&host=cdn.example.com", nil},
+		{"vless_ws_early_data_override", "vless://u@example.com:443?type=ws&path=%2Fws&ed=1024", func(c *Config) {
+			c.WSMaxEarlyData = 4096
+			c.WSEarlyDataHeader = "X-Early-Data"
+		}},
+		// Provider-documented CDN links: a browser User-Agent as a headers
+		// object, and as repeated header entries alongside early data.
+		{"vless_ws_headers", "vless://u@cdn.example.com:443?type=ws&security=tls&sni=cdn.example.com&path=%2Fvless&host=cdn.example.com&headers=%7B%22User-Agent%22%3A%22Mozilla%2F5.0%20(Windows%20NT%2010.0%3B%20Win64%3B%20x64)%22%7D", nil},
+		{"vless_ws_header_entries", "vless://u@cdn.example.com:443?type=ws&path=%2Fws&ed=2048&eh=Sec-WebSocket-Protocol&header=User-Agent:Mozilla%2F5.0&header=X-Provider-Key:k1", nil},
+		// Idle timeout lives on the TUN inbound; see TestIdleTimeoutOnTunInbound.
+		{"hysteria2", "hy2://p@example.com:443?sni=example.com", func(c *Config) { c.IdleTimeoutSeconds = 300 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Server = mustParse(t, tt.link)
+			if tt.tune != nil {
+				tt.tune(cfg)
+			}
+			outbound, err := buildProxyOutbound(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(outbound, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			checkGolden(t, tt.golden, got)
+		})
+	}
+}
+
+func TestRealityShortID(t *testing.T) {
+	const link = "vless://u@example.com:443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc"
+	tests := []struct {
+		query string
+		want  interface{} // nil when short_id is left out
+	}{
+		{"&sid=6ba85179e30d4fc2", "6ba85179e30d4fc2"},
+		{"&sid=ab12,cd34", "ab12"},
+		{"&sid=", ""},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		outbound := buildVLESSOutbound(mustParse(t, link+tt.query))
+		reality := outbound["tls"].(map[string]interface{})["reality"].(map[string]interface{})
+		if got := reality["short_id"]; got != tt.want {
+			t.Errorf("%q: short_id = %#v, want %#v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestIdleTimeoutOnTunInbound(t *testing.T) {
+	// Only hysteria2 sessions get it: on the TUN inbound it would cut the
+	// UDP sessions of every protocol.
+	tests := []struct {
+		link string
+		want interface{}
+	}{
+		{"hy2://p@example.com:443", "300s"},
+		{"vless://u@example.com:443", nil},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		cfg.Server = mustParse(t, tt.link)
+		cfg.IdleTimeoutSeconds = 300
+
+		built, err := BuildSingBoxConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Inbounds []map[string]interface{} `json:"inbounds"`
+		}
+		if err := json.Unmarshal(built.JSON, &out); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.Inbounds[0]["udp_timeout"]; got != tt.want {
+			t.Errorf("%s: udp_timeout = %v, want %v", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTuning(t *testing.T) {
+	tests := []struct {
+		name    string
+		tune    func(*Config)
+		wantErr string
+	}{
+		{"defaults", func(*Config) {}, ""},
+		{"keep-alive in range", func(c *Config) { c.TCPKeepAliveSeconds = 45 }, ""},
+		{"keep-alive too short", func(c *Config) { c.TCPKeepAliveSeconds = 1 }, "tcpKeepAliveSeconds"},
+		{"keep-alive negative", func(c *Config) { c.TCPKeepAliveSeconds = -5 }, "tcpKeepAliveSeconds"},
+		{"idle timeout too long", func(c *Config) { c.IdleTimeoutSeconds = 7200 }, "idleTimeoutSeconds"},
+		{"early data too large", func(c *Config) { c.WSMaxEarlyData = 9000 }, "wsMaxEarlyData"},
+		{"unknown sniff mode", func(c *Config) { c.SniffMode = "partial" }, "sniffMode"},
+		{"unknown transport policy", func(c *Config) { c.TransportPolicy = "udp-only" }, "transportPolicy"},
+		{"bad header", func(c *Config) { c.WSEarlyDataHeader = "a:b" }, "invalid header name"},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		tt.tune(cfg)
+		err := cfg.ValidateTuning()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got %v, want containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// TestDNSExceptionRulesPrecedeHijack guards rule order: an exception placed
+// after the hijack rule is silently dead.
+func TestDNSExceptionRulesPrecedeHijack(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.SplitTunnelMode = "app"
+	cfg.SplitTunnelApps = []string{"chrome.exe"}
+	cfg.DNSHijackExceptions = []string{`C:\Corp\vpnagent.exe`, "10.0.0.53"}
+
+	rules, _ := buildRouteRules(cfg)
+	var outbounds []string
+	for _, r := range rules {
+		outbounds = append(outbounds, r.(map[string]interface{})["outbound"].(string))
+	}
+	want := []string{"direct", "direct", "dns-out", "proxy"}
+	if strings.Join(outbounds, ",") != strings.Join(want, ",") {
+		t.Fatalf("rule outbounds = %v, want %v", outbounds, want)
+	}
+	if apps := rules[0].(map[string]interface{})["process_name"].([]string); apps[0] != "vpnagent.exe" {
+		t.Errorf("exception app = %v, want normalized name", apps)
+	}
+
+	// Without exceptions the hijack rule stays first.
+	cfg.DNSHijackExceptions = nil
+	rules, _ = buildRouteRules(cfg)
+	if rules[0].(map[string]interface{})["outbound"] != "dns-out" {
+		t.Errorf("first rule = %v, want DNS hijack", rules[0])
+	}
+}
+
+func TestDNSQueryLogEnablesFindProcess(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.PowerMode = PowerLow
+	for _, on := range []bool{false, true} {
+		cfg.DNSQueryLog = on
+		built, err := BuildSingBoxConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Route struct {
+				FindProcess bool `json:"find_process"`
+			} `json:"route"`
+		}
+		if err := json.Unmarshal(built.JSON, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Route.FindProcess != on {
+			t.Errorf("dnsQueryLog %v: find_process %v", on, out.Route.FindProcess)
+		}
+	}
+}
+
+func TestDNSExceptionAppsEnableFindProcess(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.DNSHijackExceptions = []string{"launcher.exe"}
+
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Route struct {
+			FindProcess bool `json:"find_process"`
+		} `json:"route"`
+	}
+	if err := json.Unmarshal(built.JSON, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Route.FindProcess {
+		t.Error("find_process must be on for app-based DNS exceptions")
+	}
+
+	cfg.DNSHijackExceptions = []string{"bad|name"}
+	if _, err := BuildSingBoxConfig(cfg); err == nil {
+		t.Error("invalid exception accepted")
+	}
+}
+
+// TestSniffModeGolden documents the inbound sniff options and route rules
+// each sniff mode generates.
+func TestSniffModeGolden(t *testing.T) {
+	tests := []struct {
+		golden string
+		mode   string
+		split  func(*Config)
+	}{
+		{"sniff_full_only_apps", SniffFull, onlyApps},
+		{"sniff_proxy_only_only_apps", SniffProxyOnly, onlyApps},
+		{"sniff_proxy_only_except_apps", SniffProxyOnly, func(c *Config) {
+			onlyApps(c)
+			c.SplitTunnelInvert = true
+		}},
+		{"sniff_proxy_only_domains", SniffProxyOnly, func(c *Config) {
+			c.SplitTunnelMode = "domain"
+			c.SplitTunnelDomains = []string{"example.org"}
+		}},
+		{"sniff_off_only_apps", SniffOff, onlyApps},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Server = mustParse(t, "vless://u@example.com:443")
+			cfg.SniffMode = tt.mode
+			tt.split(cfg)
+
+			built, err := BuildSingBoxConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gen struct {
+				Inbounds []map[string]interface{} `json:"inbounds"`
+				Route    map[string]interface{}   `json:"route"`
+			}
+			if err := json.Unmarshal(built.JSON, &gen); err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(map[string]interface{}{
+				"sniff":                      gen.Inbounds[0]["sniff"],
+				"sniff_override_destination": gen.Inbounds[0]["sniff_override_destination"],
+				"rules":                      gen.Route["rules"],
+				"final":                      gen.Route["final"],
+			}, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.golden, append(got, '\n'))
+		})
+	}
+}
+
+// TestTransportPolicyGolden documents the UDP blocking rules of each
+// transport policy. They follow the DNS hijack and precede split rules.
+func TestTransportPolicyGolden(t *testing.T) {
+	for _, tt := range []struct {
+		golden string
+		policy string
+	}{
+		{"transport_tcp_only", TransportTCPOnly},
+		{"transport_block_quic", TransportBlockQUIC},
+	} {
+		t.Run(tt.golden, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Server = mustParse(t, "vless://u@example.com:443")
+			cfg.TransportPolicy = tt.policy
+			onlyApps(cfg)
+
+			built, err := BuildSingBoxConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gen struct {
+				Route map[string]interface{} `json:"route"`
+			}
+			if err := json.Unmarshal(built.JSON, &gen); err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(gen.Route["rules"], "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.golden, append(got, '\n'))
+		})
+	}
+}
+
+func TestTransportPolicyRejectsHysteria2(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "hy2://p@example.com:443")
+	cfg.TransportPolicy = TransportTCPOnly
+	if _, err := BuildSingBoxConfig(cfg); !errors.Is(err, ErrTransportConflict) {
+		t.Errorf("tcp-only hysteria2: err = %v, want ErrTransportConflict", err)
+	}
+
+	// Blocking only QUIC in the tunnel leaves the Hysteria2 outbound alone.
+	cfg.TransportPolicy = TransportBlockQUIC
+	if _, err := BuildSingBoxConfig(cfg); err != nil {
+		t.Errorf("block-quic hysteria2: %v", err)
+	}
+}
+
+func onlyApps(c *Config) {
+	c.SplitTunnelMode = "app"
+	c.SplitTunnelApps = []string{"chrome.exe"}
+	c.DNSHijackExceptions = []string{"launcher.exe"}
+}
+
+// TestBuildConfigGolden pins the complete generated config for the
+// combinations users run: every DNS mode, each split tunnel mode with and
+// without invert, the kill switch, and each protocol. Regenerate with
+// go test ./internal/vpn -run TestBuildConfigGolden -update and review the
+// diff.
+func TestBuildConfigGolden(t *testing.T) {
+	const (
+		vlessTLS     = "vless://9b2c7a1e-4a5f-4d1b-8c3e-2f6a7b8c9d0e@de.example.com:443?security=tls&sni=de.example.com&fp=chrome#DE"
+		vlessReality = "vless://9b2c7a1e-4a5f-4d1b-8c3e-2f6a7b8c9d0e@nl.example.net:8443?security=reality&sni=www.microsoft.com&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&sid=6ba85179e30d4fc2&fp=chrome&flow=xtls-rprx-vision#NL"
+		vlessWS      = "vless://9b2c7a1e-4a5f-4d1b-8c3e-2f6a7b8c9d0e@cdn.example.com:443?security=tls&type=ws&path=%2Fws&host=cdn.example.com#WS"
+		hy2          = "hy2://s3cret@fi.example.org:8443?sni=fi.example.org&obfs=salamander&obfs-password=x#FI"
+	)
+	domains := func(invert bool) func(*Config) {
+		return func(c *Config) {
+			c.SplitTunnelMode = "domain"
+			c.SplitTunnelDomains = []string{"example.org", ".corp.example"}
+			c.SplitTunnelInvert = invert
+		}
+	}
+	apps := func(invert bool) func(*Config) {
+		return func(c *Config) {
+			c.SplitTunnelMode = "app"
+			c.SplitTunnelApps = []string{"chrome.exe", "telegram.exe"}
+			c.SplitTunnelInvert = invert
+		}
+	}
+	killSwitch := func(split func(*Config)) func(*Config) {
+		return func(c *Config) {
+			if split != nil {
+				split(c)
+			}
+			c.KillSwitch = true
+		}
+	}
+
+	tests := []struct {
+		golden string
+		link   string
+		tune   func(*Config)
+	}{
+		{"config_vless_tls", vlessTLS, nil},
+		{"config_vless_reality", vlessReality, nil},
+		{"config_vless_ws", vlessWS, nil},
+		{"config_hysteria2", hy2, nil},
+		{"config_dns_google", vlessTLS, func(c *Config) { c.DNS = "google" }},
+		{"config_dns_custom", vlessTLS, func(c *Config) {
+			c.DNS = "custom"
+			c.CustomDNS = "9.9.9.9"
+		}},
+		{"config_dns_corp", vlessTLS, func(c *Config) {
+			domains(true)(c)
+			c.DNSServers = []splittunnel.DNSServer{
+				{DomainSuffixes: []string{"corp.example", "corp-internal.example"}, Address: "10.0.0.53", Detour: "proxy"},
+				{DomainSuffixes: []string{"home.arpa"}, Address: "tls://192.168.1.1", Detour: "direct"},
+			}
+		}},
+		{"config_kill_switch", vlessTLS, killSwitch(nil)},
+		{"config_split_apps_only", vlessTLS, apps(false)},
+		{"config_split_apps_except", vlessTLS, apps(true)},
+		{"config_split_apps_only_kill_switch", vlessTLS, killSwitch(apps(false))},
+		{"config_split_domains_only", vlessTLS, domains(false)},
+		{"config_split_domains_except", vlessTLS, domains(true)},
+		{"config_split_domains_only_kill_switch", vlessTLS, killSwitch(domains(false))},
+		{"config_split_domains_except_kill_switch", hy2, killSwitch(domains(true))},
+		{"config_builtin_bypasses", vlessTLS, func(c *Config) {
+			apps(true)(c)
+			c.BuiltinBypasses = splittunnel.BypassNames()
+		}},
+		{"config_lan_split_domains", vlessTLS, func(c *Config) {
+			domains(false)(c)
+			c.LAN = &LANShare{Listen: "192.168.1.20", Username: "guest", Password: "hunter2"}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Server = mustParse(t, tt.link)
+			if tt.tune != nil {
+				tt.tune(cfg)
+			}
+			built, err := buildConfig(cfg, "0123456789abcdef0123456789abcdef")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.golden, append(built.JSON, '\n'))
+
+			// The same config always yields the same bytes.
+			again, err := buildConfig(cfg, built.ClashSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again.JSON) != string(built.JSON) {
+				t.Error("config generation is not deterministic")
+			}
+		})
+	}
+}
+
+func TestBuildInbounds(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.KillSwitch = true
+	cfg.SniffMode = SniffProxyOnly
+	tun := buildInbounds(cfg)[0].(map[string]interface{})
+	if tun["strict_route"] != true || tun["sniff"] != false || tun["mtu"] != 9000 {
+		t.Errorf("tun inbound = %v", tun)
+	}
+	if _, ok := tun["udp_timeout"]; ok {
+		t.Error("udp_timeout set without an idle timeout")
+	}
+}
+
+func TestBuildOutbounds(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "hy2://p@example.com:443")
+	outbounds, err := buildOutbounds(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, o := range outbounds {
+		tags = append(tags, o.(map[string]interface{})["tag"].(string))
+	}
+	// Route rules and describeRules refer to these tags.
+	if got := strings.Join(tags, ","); got != "proxy,direct,block,dns-out" {
+		t.Errorf("outbound tags = %s", got)
+	}
+
+	cfg.Server = &parser.ServerConfig{Protocol: "wireguard"}
+	if _, err := buildOutbounds(cfg); err == nil {
+		t.Error("unsupported protocol accepted")
+	}
+}
+
+func TestBuildExperimental(t *testing.T) {
+	experimental := buildExperimental("s3cret", "", instance.Default.ClashAddr())
+	api := experimental["clash_api"].(map[string]interface{})
+	// The engine polls this address for stats.
+	if api["external_controller"] != "127.0.0.1:9090" || api["secret"] != "s3cret" {
+		t.Errorf("clash_api = %v", api)
+	}
+	if _, ok := experimental["cache_file"]; ok {
+		t.Error("cache_file emitted without a path")
+	}
+
+	cache, ok := buildExperimental("s3cret", `C:\ProgramData\MRVPN\cache.db`, instance.Default.ClashAddr())["cache_file"].(map[string]interface{})
+	if !ok || cache["enabled"] != true || cache["path"] != `C:\ProgramData\MRVPN\cache.db` {
+		t.Errorf("cache_file = %v", cache)
+	}
+}
+
+func TestInstanceConfigsDoNotConflict(t *testing.T) {
+	type resources struct{ iface, clash string }
+	seen := map[string]string{}
+	for _, name := range []string{"", "dev", "staging"} {
+		inst, err := instance.New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := DefaultConfig()
+		cfg.Server = mustParse(t, "vless://u@example.com:443")
+		cfg.Instance = inst
+		built, err := BuildSingBoxConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Inbounds     []map[string]interface{} `json:"inbounds"`
+			Experimental struct {
+				ClashAPI map[string]interface{} `json:"clash_api"`
+			} `json:"experimental"`
+		}
+		if err := json.Unmarshal(built.JSON, &out); err != nil {
+			t.Fatal(err)
+		}
+		got := resources{out.Inbounds[0]["interface_name"].(string), out.Experimental.ClashAPI["external_controller"].(string)}
+		if got != (resources{inst.InterfaceName(), inst.ClashAddr()}) {
+			t.Errorf("instance %q: config uses %+v", name, got)
+		}
+		for _, id := range []string{"iface " + got.iface, "clash " + got.clash} {
+			if other, ok := seen[id]; ok {
+				t.Errorf("instances %q and %q share %s", other, name, id)
+			}
+			seen[id] = name
+		}
+	}
+}
+
+// TestDomainSplitKillSwitch checks that with the kill switch on, only
+// connections known to be to an unlisted domain bypass the tunnel.
+func TestDomainSplitKillSwitch(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.SplitTunnelMode = "domain"
+	cfg.SplitTunnelDomains = []string{"example.org"}
+
+	_, final := buildRouteRules(cfg)
+	if final != tagDirect {
+		t.Fatalf("final without kill switch = %s, want direct", final)
+	}
+
+	cfg.KillSwitch = true
+	rules, final := buildRouteRules(cfg)
+	if final != tagProxy {
+		t.Errorf("final with kill switch = %s, want proxy", final)
+	}
+	last := rules[len(rules)-1].(map[string]interface{})
+	if last["outbound"] != tagDirect || len(stringList(last["protocol"])) == 0 {
+		t.Errorf("last rule = %v, want sniffed traffic direct", last)
+	}
+
+	infos, finalInfo := describeRules(rules, final)
+	got := matchRule(infos, finalInfo, "protocol=[http tls quic] => route(direct)")
+	if got.Label != "sniffed: http,tls,quic → direct" {
+		t.Errorf("traced rule = %+v", got)
+	}
+
+	e, err := Explain(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.DefaultRoute != RouteProxy || e.Rules[len(e.Rules)-1].Match != "other traffic whose domain was sniffed" {
+		t.Errorf("explanation = %+v", e)
+	}
+}
+
+func TestAppSplitKillSwitch(t *testing.T) {
+	// The kill switch in app mode keeps the tunneled apps from leaking
+	// while the tunnel is down and leaves the others alone.
+	tests := []struct {
+		invert, killSwitch bool
+		final              string
+		strict             bool
+		otherApps          bool // a rule sends other identified apps direct
+	}{
+		{invert: false, killSwitch: false, final: tagDirect},
+		{invert: false, killSwitch: true, final: tagProxy, otherApps: true},
+		{invert: true, killSwitch: false, final: tagProxy},
+		{invert: true, killSwitch: true, final: tagProxy, strict: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("invert=%v,killSwitch=%v", tt.invert, tt.killSwitch), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Server = mustParse(t, "vless://u@example.com:443")
+			cfg.SplitTunnelMode = "app"
+			cfg.SplitTunnelApps = []string{"game.exe"}
+			cfg.SplitTunnelInvert = tt.invert
+			cfg.KillSwitch = tt.killSwitch
+
+			var gen generatedConfig
+			built, err := BuildSingBoxConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(built.JSON, &gen); err != nil {
+				t.Fatal(err)
+			}
+			if gen.Route.Final != tt.final || gen.Inbounds[0].StrictRoute != tt.strict {
+				t.Errorf("final %s, strict_route %v; want %s, %v", gen.Route.Final, gen.Inbounds[0].StrictRoute, tt.final, tt.strict)
+			}
+			appsOut := tagProxy
+			if tt.invert {
+				appsOut = tagDirect
+			}
+			var apps, others int
+			for _, r := range gen.Route.Rules {
+				switch {
+				case len(r.ProcessName) > 0 && r.Outbound == appsOut:
+					apps++
+				case len(r.ProcessName) > 0:
+					t.Errorf("app rule %+v, want outbound %s", r, appsOut)
+				case len(r.ProcessPath) > 0:
+					others++
+					if r.Outbound != tagDirect || r.ProcessPath[0] != anyProcess {
+						t.Errorf("other apps rule %+v", r)
+					}
+				}
+			}
+			if apps != 1 || (others == 1) != tt.otherApps || others > 1 {
+				t.Errorf("%d app rules, %d other apps rules", apps, others)
+			}
+
+			e, err := Explain(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.KillSwitch != tt.killSwitch {
+				t.Errorf("explained kill switch %v", e.KillSwitch)
+			}
+		})
+	}
+
+	// sing-box takes the rule, and traces label it.
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.SplitTunnelMode = "app"
+	cfg.SplitTunnelApps = []string{"game.exe"}
+	cfg.KillSwitch = true
+	rules, final := buildRouteRules(cfg)
+	var opts option.Rule
+	raw, _ := json.Marshal(rules[len(rules)-1])
+	if err := opts.UnmarshalJSON(raw); err != nil || !opts.IsValid() {
+		t.Errorf("sing-box rejects the rule: %v", err)
+	}
+	infos, finalInfo := describeRules(rules, final)
+	got := matchRule(infos, finalInfo, "process_path_regex=[.+] => route(direct)")
+	if got.Label != "split-app: other apps → direct" {
+		t.Errorf("traced rule = %+v", got)
+	}
+}
+
+func TestBuiltinBypasses(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.SplitTunnelMode = "app"
+	cfg.SplitTunnelApps = []string{"game.exe"}
+	cfg.SplitTunnelInvert = true
+	cfg.BuiltinBypasses = []string{splittunnel.BypassTeamsCalls, splittunnel.BypassWindowsUpdate}
+
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, r := range built.Rules {
+		labels = append(labels, r.Label)
+	}
+	want := []string{
+		"dns-hijack → dns-out",
+		"split-app: game.exe → direct",
+		"bypass: windowsUpdate → direct",
+		"bypass: teamsCalls → direct",
+	}
+	if strings.Join(labels, "|") != strings.Join(want, "|") {
+		t.Errorf("rule labels = %q, want %q", labels, want)
+	}
+
+	e, err := Explain(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Rules[len(e.Rules)-2].Match; got != "Windows Update traffic (built-in bypass)" {
+		t.Errorf("explained match = %q", got)
+	}
+
+	// Disabling the bypasses drops their rules from the next config.
+	cfg.BuiltinBypasses = nil
+	rules, _ := buildRouteRules(cfg)
+	if len(rules) != len(want)-2 {
+		t.Errorf("rules without bypasses = %v", rules)
+	}
+
+	// When everything unselected goes direct anyway, they add nothing.
+	cfg.BuiltinBypasses = splittunnel.BypassNames()
+	cfg.SplitTunnelInvert = false
+	rules, final := buildRouteRules(cfg)
+	if final != tagDirect || len(rules) != 2 {
+		t.Errorf("rules with final direct = %v", rules)
+	}
+
+	cfg.BuiltinBypasses = []string{"printers"}
+	if _, err := BuildSingBoxConfig(cfg); err == nil {
+		t.Error("unknown bypass accepted")
+	}
+}
+
+// TestSplitCapabilitiesMatchBuilder derives split tunnel support from the
+// generated configs, so SplitCapabilities cannot drift from the builder.
+func TestSplitCapabilitiesMatchBuilder(t *testing.T) {
+	for _, sniff := range []string{SniffFull, SniffProxyOnly, SniffOff} {
+		caps := SplitCapabilities(ConnectionTUN, sniff)
+		for _, want := range caps {
+			cfg := DefaultConfig()
+			cfg.Server = mustParse(t, "vless://u@example.com:443")
+			cfg.SniffMode = sniff
+			cfg.PowerMode = PowerLow // find_process only when apps need it
+			cfg.SplitTunnelMode = want.Mode
+			cfg.SplitTunnelApps = []string{"chrome.exe"}
+			cfg.SplitTunnelDomains = []string{"example.org"}
+			built, err := BuildSingBoxConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gen struct {
+				Inbounds []struct {
+					Sniff bool `json:"sniff"`
+				} `json:"inbounds"`
+				Route struct {
+					FindProcess bool `json:"find_process"`
+					Rules       []struct {
+						Action       string   `json:"action"`
+						ProcessName  []string `json:"process_name"`
+						DomainSuffix []string `json:"domain_suffix"`
+					} `json:"rules"`
+				} `json:"route"`
+			}
+			if err := json.Unmarshal(built.JSON, &gen); err != nil {
+				t.Fatal(err)
+			}
+			sniffsAll := gen.Inbounds[0].Sniff
+			var appRules, domainRules bool
+			for _, r := range gen.Route.Rules {
+				switch {
+				case r.Action == "sniff" && len(r.ProcessName) == 0:
+					sniffsAll = true
+				case r.Action == "" && len(r.ProcessName) > 0:
+					appRules = true
+				case r.Action == "" && len(r.DomainSuffix) > 0:
+					domainRules = true
+				}
+			}
+
+			got := SplitSupport{Mode: want.Mode, Supported: true}
+			switch want.Mode {
+			case "app":
+				got.Supported = appRules && gen.Route.FindProcess
+			case "domain":
+				got.Supported = domainRules
+				got.Limited = domainRules && !sniffsAll
+			}
+			if got.Supported != want.Supported || got.Limited != want.Limited {
+				t.Errorf("sniff %s, split %s: builder gives supported=%v limited=%v, capabilities say %+v",
+					sniff, want.Mode, got.Supported, got.Limited, want)
+			}
+			if (!want.Supported || want.Limited) && want.Reason == "" {
+				t.Errorf("sniff %s, split %s: no reason given", sniff, want.Mode)
+			}
+		}
+	}
+
+	for _, s := range SplitCapabilities(ConnectionProxy, SniffFull) {
+		if s.Supported != (s.Mode == "off") {
+			t.Errorf("proxy mode: %+v", s)
+		}
+	}
+	if s := SplitSupportFor(ConnectionTUN, "", ""); s.Mode != "off" || !s.Supported {
+		t.Errorf("empty split mode = %+v", s)
+	}
+}
@@ -0,0 +1,60 @@
+package vpn
+
+// Disconnect reasons, carried by the disconnecting and disconnected state
+// changes and recorded with the session.
+const (
+	ReasonUser     = "user"     // the user asked
+	ReasonIdle     = "idle"     // no traffic for the idle period
+	ReasonCap      = "cap"      // a data cap was reached
+	ReasonSchedule = "schedule" // a scheduled disconnect
+)
+
+// Reasons the engine gives itself: the connecting and connected state
+// changes of a reconnect carry ReasonReconnect, a session whose link
+// could not be re-established ends with ReasonFailed, and one replaced by
+// a connect under AttemptReplace with ReasonSwitch.
+const (
+	ReasonReconnect = "reconnect"
+	ReasonFailed    = "failed"
+	ReasonSwitch    = "switch"
+)
+
+// ValidReason reports whether reason is one of the disconnect reasons a
+// client may give.
+func ValidReason(reason string) bool {
+	switch reason {
+	case ReasonUser, ReasonIdle, ReasonCap, ReasonSchedule:
+		return true
+	}
+	return false
+}
+
+// Activity is what the current session is doing, as of the last stats
+// poll. Speeds are proxy bytes per second.
+type Activity struct {
+	ProxyConnections int
+	UpSpeed          int64
+	DownSpeed        int64
+}
+
+// Activity returns the proxied activity of the current session; the zero
+// value when disconnected.
+func (e *Engine) Activity() Activity {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil {
+		return Activity{}
+	}
+	return e.activity
+}
+
+// countProxyConns counts the open connections routed through the proxy.
+func countProxyConns(conns []clashConnection) int {
+	n := 0
+	for i := range conns {
+		if isProxyChain(conns[i].Chains) {
+			n++
+		}
+	}
+	return n
+}
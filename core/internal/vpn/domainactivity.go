@@ -0,0 +1,229 @@
+package vpn
+
+import (
+	"container/list"
+	"strings"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+)
+
+// With the DNS query log on (off by default, as it records the domains
+// each app reaches), the engine indexes the connections of each stats
+// poll by process and domain, as sing-box sniffed or resolved it, with the
+// outbound that carried them and their bytes. This answers which
+// hostnames an app contacted and how each was routed, when it seems to
+// leak around the tunnel. The index lives in memory only: it holds at most
+// domainIndexMaxEntries entries, evicting the least recently seen, forgets
+// entries after DomainActivityRetention, and is cleared when the session
+// ends or the log is turned off.
+
+// ChangeDNSQueryLog is the pending change of turning the DNS query log on
+// or off while connected: process lookup, which tells apps apart, is set
+// when the session's config is built (see Config.DNSQueryLog).
+const ChangeDNSQueryLog = "dnsQueryLog"
+
+const (
+	// DomainActivityRetention is how long a domain stays in the index
+	// after a process last reached it.
+	DomainActivityRetention = time.Hour
+	domainIndexMaxEntries   = 4096
+)
+
+// DomainActivity is a domain a process reached through one outbound.
+type DomainActivity struct {
+	Domain      string `json:"domain"`
+	Outbound    string `json:"outbound"`    // the outbound the route chose, e.g. "proxy" or "direct"
+	Connections int    `json:"connections"` // seen since FirstSeen
+	Upload      int64  `json:"upload"`      // bytes
+	Download    int64  `json:"download"`    // bytes
+	FirstSeen   int64  `json:"firstSeen"`   // unix seconds
+	LastSeen    int64  `json:"lastSeen"`    // unix seconds
+}
+
+type domainKey struct {
+	exe, domain, outbound string
+}
+
+type domainEntry struct {
+	key      domainKey
+	activity DomainActivity
+	lastSeen time.Time
+}
+
+// domainConn is a live connection counted into an entry.
+type domainConn struct {
+	key              domainKey
+	upload, download int64
+}
+
+// domainIndex joins the connections of stats polls with their processes
+// and domains. Its zero value is off; the engine guards it with e.mu.
+type domainIndex struct {
+	enabled bool
+	max     int // entries kept; domainIndexMaxEntries when zero
+	entries map[domainKey]*list.Element
+	lru     *list.List // of *domainEntry, most recently seen first, so by lastSeen
+	conns   map[string]domainConn
+}
+
+// setEnabled turns indexing on or off; off clears the index.
+func (x *domainIndex) setEnabled(on bool) {
+	x.enabled = on
+	if !on {
+		x.clear()
+	}
+}
+
+// clear forgets everything indexed.
+func (x *domainIndex) clear() {
+	x.entries, x.lru, x.conns = nil, nil, nil
+}
+
+// observe adds a poll's connections. Connections without a domain or
+// process are skipped; bytes count what a connection moved since the
+// previous poll.
+func (x *domainIndex) observe(conns []clashConnection, now time.Time) {
+	if !x.enabled {
+		return
+	}
+	if x.entries == nil {
+		x.entries = make(map[domainKey]*list.Element)
+		x.lru = list.New()
+		x.conns = make(map[string]domainConn)
+	}
+	present := make(map[string]bool, len(conns))
+	for i := range conns {
+		c := &conns[i]
+		exe := exeName(c.Metadata.ProcessPath)
+		if c.Metadata.Host == "" || exe == "" {
+			continue
+		}
+		id := c.key()
+		present[id] = true
+		prev, seen := x.conns[id]
+		key := domainKey{exe: exe, domain: strings.ToLower(c.Metadata.Host), outbound: routedOutbound(c.Chains)}
+		if seen && prev.key != key {
+			seen, prev = false, domainConn{}
+		}
+		e := x.touch(key, now)
+		if !seen {
+			e.activity.Connections++
+		}
+		e.activity.Upload += max(c.Upload-prev.upload, 0)
+		e.activity.Download += max(c.Download-prev.download, 0)
+		x.conns[id] = domainConn{key: key, upload: c.Upload, download: c.Download}
+	}
+	for id := range x.conns {
+		if !present[id] {
+			delete(x.conns, id)
+		}
+	}
+	x.prune(now)
+}
+
+// touch returns the entry of key, created if needed, as seen at now.
+func (x *domainIndex) touch(key domainKey, now time.Time) *domainEntry {
+	if el, ok := x.entries[key]; ok {
+		x.lru.MoveToFront(el)
+		e := el.Value.(*domainEntry)
+		e.lastSeen = now
+		return e
+	}
+	e := &domainEntry{key: key, lastSeen: now, activity: DomainActivity{
+		Domain: key.domain, Outbound: key.outbound, FirstSeen: now.Unix(),
+	}}
+	x.entries[key] = x.lru.PushFront(e)
+	return e
+}
+
+// prune evicts the least recently seen entries over the bound and those
+// past DomainActivityRetention.
+func (x *domainIndex) prune(now time.Time) {
+	limit := x.max
+	if limit == 0 {
+		limit = domainIndexMaxEntries
+	}
+	for el := x.lru.Back(); el != nil; el = x.lru.Back() {
+		e := el.Value.(*domainEntry)
+		if x.lru.Len() <= limit && now.Sub(e.lastSeen) < DomainActivityRetention {
+			break
+		}
+		x.lru.Remove(el)
+		delete(x.entries, e.key)
+	}
+}
+
+// activity returns the domains the process exe reached since since, most
+// recently seen first.
+func (x *domainIndex) activity(exe string, since time.Time) []DomainActivity {
+	exe = strings.ToLower(exe)
+	out := []DomainActivity{}
+	if x.lru == nil {
+		return out
+	}
+	for el := x.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*domainEntry)
+		if e.lastSeen.Before(since) {
+			break
+		}
+		if e.key.exe == exe {
+			a := e.activity
+			a.LastSeen = e.lastSeen.Unix()
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// exeName returns the lowercase executable name of a Windows process path.
+func exeName(path string) string {
+	return strings.ToLower(path[strings.LastIndexAny(path, `\/`)+1:])
+}
+
+// routedOutbound returns the outbound the route chose for a connection:
+// the last of its chain, which lists the outbounds it went through.
+func routedOutbound(chains []string) string {
+	if len(chains) == 0 {
+		return ""
+	}
+	return chains[len(chains)-1]
+}
+
+// DNSQueryLogReconnect reports whether turning the DNS query log on or off
+// changes the process lookup of the session running with active, which
+// takes a reconnect.
+func DNSQueryLogReconnect(active *Config, on bool) bool {
+	if active == nil || active.DNSQueryLog == on {
+		return false
+	}
+	apps, _, _ := splittunnel.ParseDNSExceptions(active.DNSHijackExceptions)
+	next := *active
+	next.DNSQueryLog = on
+	return needsFindProcess(active, apps) != needsFindProcess(&next, apps)
+}
+
+// SetDNSQueryLog turns the per-app domain index on or off. Turning it off
+// forgets what was indexed. Connections are only attributed to apps in
+// sessions whose config has DNSQueryLog set.
+func (e *Engine) SetDNSQueryLog(on bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.domains.setEnabled(on)
+}
+
+// DNSQueryLog reports whether the per-app domain index is on.
+func (e *Engine) DNSQueryLog() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.domains.enabled
+}
+
+// DomainActivity returns the domains the process with executable name exe,
+// such as "chrome.exe", reached in the session since since, most recently
+// seen first.
+func (e *Engine) DomainActivity(exe string, since time.Time) []DomainActivity {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.domains.activity(exe, since)
+}
@@ -0,0 +1,155 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func domainConnOf(id, process, host string, up, down int64, chains ...string) clashConnection {
+	return clashConnection{
+		ID: id, Upload: up, Download: down, Chains: chains,
+		Metadata: connMeta{Host: host, ProcessPath: process},
+	}
+}
+
+func TestDomainIndexObserve(t *testing.T) {
+	var x domainIndex
+	x.setEnabled(true)
+	start := time.Unix(1_700_000_000, 0)
+	chrome := `C:\Program Files\Google\Chrome\Application\chrome.exe`
+
+	x.observe([]clashConnection{
+		domainConnOf("1", chrome, "Example.com", 100, 1000, "proxy"),
+		domainConnOf("2", chrome, "example.com", 10, 20, "proxy"),
+		domainConnOf("3", chrome, "cdn.example.net", 5, 5, "direct"),
+		domainConnOf("4", `C:\Tools\curl.exe`, "example.com", 1, 1, "direct"),
+		domainConnOf("5", chrome, "", 1, 1, "proxy"),        // no domain
+		domainConnOf("6", "", "example.com", 1, 1, "proxy"), // no process
+	}, start)
+	// Connection 1 moves more bytes, 2 closes and 7 opens.
+	x.observe([]clashConnection{
+		domainConnOf("1", chrome, "example.com", 150, 3000, "proxy"),
+		domainConnOf("3", chrome, "cdn.example.net", 5, 5, "direct"),
+		domainConnOf("7", chrome, "example.com", 1, 2, "proxy"),
+	}, start.Add(time.Minute))
+
+	got := x.activity("Chrome.exe", start)
+	if len(got) != 2 {
+		t.Fatalf("activity = %+v", got)
+	}
+	byDomain := map[string]DomainActivity{}
+	for _, a := range got {
+		byDomain[a.Domain] = a
+	}
+	want := DomainActivity{
+		Domain: "example.com", Outbound: "proxy", Connections: 3, Upload: 161, Download: 3022,
+		FirstSeen: start.Unix(), LastSeen: start.Add(time.Minute).Unix(),
+	}
+	if a := byDomain["example.com"]; a != want {
+		t.Errorf("example.com = %+v, want %+v", a, want)
+	}
+	if a := byDomain["cdn.example.net"]; a.Outbound != "direct" || a.Connections != 1 || a.Download != 5 {
+		t.Errorf("cdn.example.net = %+v", a)
+	}
+	if got := x.activity("curl.exe", start); len(got) != 1 || got[0].Outbound != "direct" {
+		t.Errorf("curl.exe = %+v", got)
+	}
+	if got := x.activity("chrome.exe", start.Add(30*time.Second)); len(got) != 2 {
+		t.Errorf("since the second poll = %+v", got)
+	}
+	if got := x.activity("firefox.exe", start); len(got) != 0 {
+		t.Errorf("firefox.exe = %+v", got)
+	}
+}
+
+func TestDomainIndexEviction(t *testing.T) {
+	x := domainIndex{max: 3}
+	x.setEnabled(true)
+	start := time.Unix(1_700_000_000, 0)
+	for i := 0; i < 5; i++ {
+		x.observe([]clashConnection{
+			domainConnOf(fmt.Sprint(i), "app.exe", fmt.Sprintf("d%d.example", i), 1, 1, "proxy"),
+		}, start.Add(time.Duration(i)*time.Second))
+	}
+	got := x.activity("app.exe", start)
+	if len(got) != 3 || got[0].Domain != "d4.example" || got[2].Domain != "d2.example" {
+		t.Fatalf("activity = %+v", got)
+	}
+	if len(x.entries) != 3 {
+		t.Errorf("%d entries kept", len(x.entries))
+	}
+
+	// Entries not seen for DomainActivityRetention are forgotten.
+	x.observe([]clashConnection{
+		domainConnOf("9", "app.exe", "d4.example", 1, 1, "proxy"),
+	}, start.Add(DomainActivityRetention+3*time.Second))
+	if got := x.activity("app.exe", start); len(got) != 1 || got[0].Domain != "d4.example" {
+		t.Errorf("after retention = %+v", got)
+	}
+}
+
+func TestDomainIndexQueryLogToggle(t *testing.T) {
+	var x domainIndex
+	now := time.Unix(1_700_000_000, 0)
+	conns := []clashConnection{domainConnOf("1", "app.exe", "example.com", 1, 1, "proxy")}
+
+	// Off by default: nothing is recorded.
+	x.observe(conns, now)
+	if got := x.activity("app.exe", time.Time{}); len(got) != 0 || x.entries != nil {
+		t.Fatalf("recorded while off: %+v", got)
+	}
+
+	x.setEnabled(true)
+	x.observe(conns, now)
+	if got := x.activity("app.exe", time.Time{}); len(got) != 1 {
+		t.Fatalf("activity = %+v", got)
+	}
+	// Turning it off forgets what was recorded.
+	x.setEnabled(false)
+	x.setEnabled(true)
+	if got := x.activity("app.exe", time.Time{}); len(got) != 0 {
+		t.Errorf("kept after turning off: %+v", got)
+	}
+}
+
+func TestDNSQueryLogReconnect(t *testing.T) {
+	active := &Config{SplitTunnelMode: "off"}
+	if !DNSQueryLogReconnect(active, true) {
+		t.Error("turning on without process lookup needs no reconnect")
+	}
+	if DNSQueryLogReconnect(active, false) || DNSQueryLogReconnect(nil, true) {
+		t.Error("unchanged or disconnected needs a reconnect")
+	}
+	// An app split tunnel looks processes up anyway.
+	if DNSQueryLogReconnect(&Config{SplitTunnelMode: "app", SplitTunnelApps: []string{"a.exe"}}, true) {
+		t.Error("process lookup already on needs a reconnect")
+	}
+}
+
+func TestDomainActivityClearedOnDisconnect(t *testing.T) {
+	e := newStubEngine()
+	e.SetDNSQueryLog(true)
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	e.domains.observe([]clashConnection{domainConnOf("1", "app.exe", "example.com", 1, 1, "proxy")}, time.Now())
+	e.mu.Unlock()
+	if got := e.DomainActivity("app.exe", time.Time{}); len(got) != 1 {
+		t.Fatalf("activity = %+v", got)
+	}
+	if err := e.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.DomainActivity("app.exe", time.Time{}); len(got) != 0 {
+		t.Errorf("kept after disconnect: %+v", got)
+	}
+	if !e.DNSQueryLog() {
+		t.Error("disconnect turned the query log off")
+	}
+}
@@ -0,0 +1,88 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+)
+
+// ErrTunDriverMissing is returned by Connect when the Wintun driver cannot
+// be loaded, typically because wintun.dll is missing or was quarantined.
+var ErrTunDriverMissing = errors.New("TUN driver is missing or blocked")
+
+// TunDriverRemediation is user-facing advice for ErrTunDriverMissing.
+const TunDriverRemediation = "Reinstall MRVPN to restore wintun.dll and add the MRVPN install folder to your antivirus exclusions."
+
+// DriverStatus describes the TUN driver as seen before connecting.
+type DriverStatus struct {
+	Loaded       bool   `json:"loaded"`            // wintun.dll could be loaded
+	Version      string `json:"version,omitempty"` // running driver version, empty until first adapter creation
+	GhostAdapter bool   `json:"ghostAdapter"`      // the instance's adapter exists while we are disconnected
+	Error        string `json:"error,omitempty"`
+	Remediation  string `json:"remediation,omitempty"`
+}
+
+// driverProbe abstracts the driver checks so they can be faked in tests.
+type driverProbe interface {
+	// loadDriver loads wintun.dll the way sing-box does and returns the
+	// running driver version ("" if the driver is not loaded yet).
+	loadDriver() (version string, err error)
+	// adapterExists reports whether the TUN adapter is present.
+	adapterExists() bool
+	// removeAdapter removes a leftover TUN adapter.
+	removeAdapter() error
+}
+
+// checkDriver verifies the TUN driver can be used. When clean is true a
+// ghost adapter left by a crashed session is removed so sing-box can
+// recreate it under the same name.
+func checkDriver(p driverProbe, clean bool) (DriverStatus, error) {
+	var status DriverStatus
+
+	version, err := p.loadDriver()
+	if err != nil {
+		status.Error = err.Error()
+		status.Remediation = TunDriverRemediation
+		return status, fmt.Errorf("%w: %v", ErrTunDriverMissing, err)
+	}
+	status.Loaded = true
+	status.Version = version
+
+	if p.adapterExists() {
+		status.GhostAdapter = true
+		if clean {
+			if err := p.removeAdapter(); err != nil {
+				log.Printf("warning: failed to remove leftover TUN adapter: %v", err)
+			} else {
+				log.Printf("Removed leftover TUN adapter from a previous session")
+				status.GhostAdapter = false
+			}
+		}
+	}
+	return status, nil
+}
+
+// CheckDriver reports the TUN driver status for the adapter of inst
+// without modifying anything.
+func CheckDriver(inst instance.Instance) DriverStatus {
+	status, _ := checkDriver(wintunProbe{inst: inst}, false)
+	return status
+}
+
+// wintunProbe is the real driverProbe backed by wintun.dll; see
+// loadDriver.
+type wintunProbe struct {
+	inst instance.Instance // owns the adapter
+}
+
+func (p wintunProbe) adapterExists() bool {
+	_, err := net.InterfaceByName(p.inst.InterfaceName())
+	return err == nil
+}
+
+func (p wintunProbe) removeAdapter() error {
+	return RemoveTunAdapter(p.inst)
+}
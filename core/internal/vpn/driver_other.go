@@ -0,0 +1,10 @@
+//go:build !windows
+
+package vpn
+
+// loadDriver finds nothing to load: only Windows needs the Wintun driver.
+// The service only ships for Windows; builds elsewhere are for
+// development and tests.
+func (wintunProbe) loadDriver() (string, error) {
+	return "", nil
+}
@@ -0,0 +1,58 @@
+package vpn
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeDriver struct {
+	loadErr   error
+	version   string
+	adapter   bool
+	removeErr error
+	removed   bool
+}
+
+func (f *fakeDriver) loadDriver() (string, error) { return f.version, f.loadErr }
+func (f *fakeDriver) adapterExists() bool         { return f.adapter }
+func (f *fakeDriver) removeAdapter() error {
+	f.removed = true
+	return f.removeErr
+}
+
+func TestCheckDriverMissing(t *testing.T) {
+	p := &fakeDriver{loadErr: errors.New("The specified module could not be found.")}
+	status, err := checkDriver(p, true)
+	if !errors.Is(err, ErrTunDriverMissing) {
+		t.Fatalf("err = %v, want ErrTunDriverMissing", err)
+	}
+	if status.Loaded || status.Remediation == "" {
+		t.Errorf("status = %+v, want not loaded with remediation", status)
+	}
+}
+
+func TestCheckDriverGhostAdapter(t *testing.T) {
+	p := &fakeDriver{version: "0.14", adapter: true}
+	status, err := checkDriver(p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.GhostAdapter || p.removed {
+		t.Errorf("report-only check: status = %+v, removed = %v", status, p.removed)
+	}
+
+	status, err = checkDriver(p, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.GhostAdapter || !p.removed || status.Version != "0.14" {
+		t.Errorf("cleaning check: status = %+v, removed = %v", status, p.removed)
+	}
+
+	// A failed cleanup is reported but does not block connecting.
+	p = &fakeDriver{adapter: true, removeErr: errors.New("access denied")}
+	status, err = checkDriver(p, true)
+	if err != nil || !status.GhostAdapter {
+		t.Errorf("failed cleanup: status = %+v, err = %v", status, err)
+	}
+}
@@ -0,0 +1,29 @@
+package vpn
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+func (wintunProbe) loadDriver() (string, error) {
+	// Same search order as golang.zx2c4.com/wintun used by sing-box.
+	dll, err := windows.LoadLibraryEx("wintun.dll", 0,
+		windows.LOAD_LIBRARY_SEARCH_APPLICATION_DIR|windows.LOAD_LIBRARY_SEARCH_SYSTEM32)
+	if err != nil {
+		return "", fmt.Errorf("cannot load wintun.dll: %w", err)
+	}
+	defer windows.FreeLibrary(dll)
+
+	proc, err := windows.GetProcAddress(dll, "WintunGetRunningDriverVersion")
+	if err != nil {
+		return "", fmt.Errorf("wintun.dll is invalid: %w", err)
+	}
+	r, _, _ := syscall.SyscallN(proc)
+	if r == 0 {
+		// Driver not loaded yet; it is installed on first adapter creation.
+		return "", nil
+	}
+	return fmt.Sprintf("%d.%d", r>>16, r&0xffff), nil
+}
@@ -0,0 +1,138 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// earlyLeakWindow is how long after connecting new direct connections are
+// checked for having raced the route setup. Connections opened in the
+// window are still counted when a later poll first sees them, up to twice
+// the window after connecting.
+const earlyLeakWindow = 10 * time.Second
+
+// maxEarlyLeakHosts caps the destinations an EarlyLeak lists.
+const maxEarlyLeakHosts = 5
+
+// EarlyLeakListener is a callback invoked the first time a session sees a
+// connection that went direct right after connecting.
+type EarlyLeakListener func(leak EarlyLeak)
+
+// EarlyLeak accounts for connections that went direct in the first
+// seconds of a session although no direct rule matched them. They were
+// opened while the routes into the TUN adapter were still being set up,
+// so the destination saw the user's real address.
+type EarlyLeak struct {
+	Count int      `json:"count"`
+	Hosts []string `json:"hosts"` // the first few destinations, host:port
+}
+
+// earlyLeakDetector finds early leaks in successive stats polls of one
+// session.
+type earlyLeakDetector struct {
+	connectedAt time.Time
+	seen        map[string]bool // direct connections already checked
+	leak        EarlyLeak
+}
+
+func newEarlyLeakDetector(connectedAt time.Time) *earlyLeakDetector {
+	return &earlyLeakDetector{connectedAt: connectedAt, seen: make(map[string]bool), leak: EarlyLeak{Hosts: []string{}}}
+}
+
+// observe checks the direct connections of a poll taken at now. It reports
+// true when the session's first leak is found.
+func (d *earlyLeakDetector) observe(now time.Time, conns []clashConnection, rules []RuleInfo, final RuleInfo) bool {
+	if now.Sub(d.connectedAt) > 2*earlyLeakWindow {
+		return false
+	}
+	before := d.leak.Count
+	for i := range conns {
+		c := &conns[i]
+		if !isDirectChain(c.Chains) || d.seen[c.key()] {
+			continue
+		}
+		d.seen[c.key()] = true
+		opened := now
+		if t, err := time.Parse(time.RFC3339Nano, c.Start); err == nil {
+			opened = t
+		}
+		if opened.Sub(d.connectedAt) > earlyLeakWindow {
+			continue
+		}
+		if matchRule(rules, final, c.Rule).Outbound == tagDirect {
+			continue
+		}
+		d.leak.Count++
+		if len(d.leak.Hosts) < maxEarlyLeakHosts {
+			d.leak.Hosts = append(d.leak.Hosts, c.Metadata.target())
+		}
+	}
+	return before == 0 && d.leak.Count > 0
+}
+
+func (d *earlyLeakDetector) snapshot() EarlyLeak {
+	leak := d.leak
+	leak.Hosts = append([]string(nil), d.leak.Hosts...)
+	return leak
+}
+
+// EarlyLeakCount returns how many connections of the current session went
+// direct while its routes were being set up.
+func (e *Engine) EarlyLeakCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil || e.earlyLeak == nil {
+		return 0
+	}
+	return e.earlyLeak.leak.Count
+}
+
+// Route verification for Config.DelayConnectedUntilRouteVerified.
+const (
+	routeVerifyTimeout  = 5 * time.Second
+	routeVerifyInterval = 50 * time.Millisecond
+)
+
+// routeProbeAddrs are public addresses whose route must lead into the TUN
+// adapter before the session counts as connected.
+var routeProbeAddrs = []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("8.8.8.8")}
+
+// waitForTunRoute polls until Windows routes every probe address through
+// the named adapter, for up to timeout. It returns ctx's error if ctx is
+// done first.
+func waitForTunRoute(ctx context.Context, api ifaceAPI, name string, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	var lastErr error
+	for {
+		if lastErr = checkTunRoute(api, name); lastErr == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return fmt.Errorf("default route not through %s after %v: %w", name, timeout, lastErr)
+		case <-time.After(routeVerifyInterval):
+		}
+	}
+}
+
+func checkTunRoute(api ifaceAPI, name string) error {
+	index, err := api.interfaceIndex(name)
+	if err != nil {
+		return err
+	}
+	for _, addr := range routeProbeAddrs {
+		best, err := api.bestInterface(addr)
+		if err != nil {
+			return err
+		}
+		if best != index {
+			return fmt.Errorf("%s routes through interface %d", addr, best)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+)
+
+// leakConn is a connection in a Clash API feed, opened at start.
+func leakConn(id string, start time.Time, chain, rule, host string) clashConnection {
+	c := clashConnection{ID: id, Chains: []string{chain}, Rule: rule, Metadata: connMeta{Host: host, DestinationPort: "443"}}
+	if !start.IsZero() {
+		c.Start = start.Format(time.RFC3339Nano)
+	}
+	return c
+}
+
+func TestEarlyLeakDetector(t *testing.T) {
+	rules, final := describeRules([]interface{}{
+		map[string]interface{}{"process_name": []string{"game.exe"}, "outbound": "direct"},
+	}, "proxy")
+	connected := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(sec float64) time.Time { return connected.Add(time.Duration(sec * float64(time.Second))) }
+	d := newEarlyLeakDetector(connected)
+
+	poll := []clashConnection{
+		leakConn("1", at(-0.2), "direct", "final", "ip.example"),                                   // raced the routes
+		leakConn("2", at(1), "direct", "process_name=[game.exe] => route(direct)", "game.example"), // split tunnel
+		leakConn("3", at(1), "proxy", "final", "site.example"),
+		leakConn("4", at(2), "block", "network=udp port=443 => route(block)", "quic.example"),
+	}
+	if !d.observe(at(1.5), poll, rules, final) {
+		t.Fatal("first leak not reported")
+	}
+	// The same connections again, plus a new leak: counted, not reported.
+	poll = append(poll, leakConn("5", at(3), "direct", "ip_cidr=1.2.3.4/32 => route(direct)", "other.example"))
+	if d.observe(at(3.5), poll, rules, final) {
+		t.Error("leak reported twice")
+	}
+	want := EarlyLeak{Count: 2, Hosts: []string{"ip.example:443", "other.example:443"}}
+	if got := d.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("leak = %+v, want %+v", got, want)
+	}
+
+	// Opened after the window, seen within twice the window.
+	d.observe(at(15), []clashConnection{leakConn("6", at(11), "direct", "final", "late.example")}, rules, final)
+	// Without a start time the poll time stands in.
+	d.observe(at(9), []clashConnection{leakConn("7", time.Time{}, "direct", "final", "nostart.example")}, rules, final)
+	d.observe(at(12), []clashConnection{leakConn("8", time.Time{}, "direct", "final", "nostart2.example")}, rules, final)
+	// Polls after twice the window are ignored.
+	d.observe(at(21), []clashConnection{leakConn("9", at(5), "direct", "final", "slow.example")}, rules, final)
+	if got := d.snapshot().Count; got != 3 {
+		t.Errorf("count = %d, want 3", got)
+	}
+}
+
+func TestEarlyLeakHostsCapped(t *testing.T) {
+	connected := time.Now()
+	d := newEarlyLeakDetector(connected)
+	var poll []clashConnection
+	for i := 0; i < 2*maxEarlyLeakHosts; i++ {
+		poll = append(poll, leakConn(fmt.Sprint(i), connected, "direct", "final", fmt.Sprintf("h%d.example", i)))
+	}
+	d.observe(connected, poll, nil, RuleInfo{Outbound: tagProxy})
+	if got := d.snapshot(); got.Count != len(poll) || len(got.Hosts) != maxEarlyLeakHosts {
+		t.Errorf("leak = %+v", got)
+	}
+}
+
+func TestWaitForTunRoute(t *testing.T) {
+	api := newFakeIfaceAPI()
+	var calls atomic.Int32
+	api.routeIndex = func() uint32 {
+		if calls.Add(1) <= 3 {
+			return 3 // the physical adapter, before sing-box adds its routes
+		}
+		return 7
+	}
+	if err := waitForTunRoute(context.Background(), api, instance.Default.InterfaceName(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	api.routeIndex = func() uint32 { return 3 }
+	if err := waitForTunRoute(context.Background(), api, instance.Default.InterfaceName(), 100*time.Millisecond); err == nil {
+		t.Error("route through the physical adapter verified")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waitForTunRoute(ctx, api, instance.Default.InterfaceName(), time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestEngineEarlyLeak(t *testing.T) {
+	e := newStubEngine()
+	var connectedAt atomic.Value
+	e.fetchConns = func(context.Context, string) (*clashConnections, error) {
+		start, _ := connectedAt.Load().(time.Time)
+		return &clashConnections{Connections: []clashConnection{
+			leakConn("1", start, "direct", "final", "ip.example"),
+		}}, nil
+	}
+	leaks := make(chan EarlyLeak, 4)
+	e.stateMachine.OnEarlyLeak(func(leak EarlyLeak) { leaks <- leak })
+
+	api := newFakeIfaceAPI()
+	var routeCalls atomic.Int32
+	api.routeIndex = func() uint32 {
+		if routeCalls.Add(1) <= 2 {
+			return 3
+		}
+		return 7
+	}
+	e.ifaces = api
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+	cfg.DelayConnectedUntilRouteVerified = true
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+	if n := routeCalls.Load(); n < 3 {
+		t.Errorf("connected after %d route checks, want the route verified first", n)
+	}
+	connectedAt.Store(e.ConnectedAt())
+
+	select {
+	case leak := <-leaks:
+		if leak.Count != 1 || !reflect.DeepEqual(leak.Hosts, []string{"ip.example:443"}) {
+			t.Errorf("leak = %+v", leak)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no early leak reported")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(leaks) != 0 {
+		t.Error("early leak reported more than once")
+	}
+	if n := e.EarlyLeakCount(); n != 1 {
+		t.Errorf("EarlyLeakCount = %d", n)
+	}
+}
@@ -2,274 +2,679 @@ package vpn
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	box "github.com/sagernet/sing-box"
-	"github.com/sagernet/sing-box/include"
 	"github.com/sagernet/sing-box/option"
+
+	"github.com/mriaz/vpn-core/internal/instance"
 )
 
+// coreBox is a running sing-box instance.
+type coreBox interface {
+	Close() error
+}
+
 // Engine manages the sing-box instance lifecycle.
 type Engine struct {
+	attempts     attemptSlot // taken before mu; see AttemptReject
 	mu           sync.Mutex
-	box          *box.Box
+	box          coreBox
 	cancel       context.CancelFunc
+	session      uint64 // counts links; identifies the link being polled
 	stateMachine *StateMachine
+	inst         instance.Instance // see SetInstance
 	config       *Config
-	connectedAt  time.Time
+	connectedAt  time.Time // when the current link was established
+	carried      sessionCarry
 	lastUpload   int64
 	lastDownload int64
-
-	// Proxy-only traffic tracking.
-	proxyConns    map[string]connTraffic // active proxy connection traffic
-	closedUpload  int64                  // accumulated upload from closed proxy connections
-	closedDownload int64                 // accumulated download from closed proxy connections
-	clashSecret   string                 // Clash API authentication secret
+	activity     Activity           // as of the last stats poll
+	lanClients   []LANClient        // as of the last stats poll
+	killSwitch   *killSwitchMonitor // nil unless the session has the kill switch on
+	earlyLeak    *earlyLeakDetector
+
+	// Hysteria2 RTT measured through the tunnel; see probeHealth.
+	rttMs int64
+	rttAt time.Time
+
+	health           *healthTracker
+	healthThresholds HealthThresholds
+	healthInterval   time.Duration
+
+	// MTU probing; see ProbeMTU. mtuSuggestions outlive sessions.
+	mtuMu          sync.Mutex
+	mtuSuggestions map[string]int
+	mtuProbeDelay  time.Duration
+
+	// Per-route traffic tracking.
+	traffic     *trafficTracker
+	lastTraffic Traffic      // of the current link; see carried
+	lastTun     [2]int64     // TUN adapter upload and download of the current link
+	clashSecret string       // Clash API authentication secret
+	clashAddr   atomic.Value // string; the current link's Clash API address, read without mu
+
+	// Clash API recovery; see recoverClashAPI.
+	clashRecovery    int  // of the session, a clashRecovery* state
+	statsUnavailable bool // of the current link
+
+	// Connection tracing against the labelled route rules.
+	rules     []RuleInfo
+	finalRule RuleInfo
+	tracer    connTracer
+
+	domains domainIndex // per-app domains of the session; see SetDNSQueryLog
+
+	driver driverProbe
+
+	// Stage timing of the current connect. timingPending is set until the
+	// first traffic is verified and the timing reported.
+	timing        ConnectTiming
+	timingPending bool
+
+	// TUN adapter hardening applied for the current session.
+	ifaces    ifaceAPI
+	hardening *hardening
+	tun       *tunCounter // nil when the adapter's counters cannot be read
+
+	powerMode string // sets the stats poll interval; see SetPowerMode
+
+	// Rate limiting; see RateLimitShaped. shaped is set while the link
+	// dials through the shaper.
+	shaper shaper
+	shaped bool
+
+	// Hot operations on the running session; see ApplyHot.
+	hot            *hotClient
+	pendingChanges []string
+
+	poller        *statsPoller
+	statsWarmup   time.Duration
+	statsInterval time.Duration // overrides the power mode's poll interval when set
+
+	// Replaced in tests to run sessions without sing-box.
+	startCore    func(ctx context.Context, configJSON []byte) (coreBox, error)
+	fetchConns   func(ctx context.Context, secret string) (*clashConnections, error)
+	probeDelay   func(ctx context.Context, secret string) (int64, error)
+	sendMTUProbe func(ctx context.Context, payload int) error
+	reality      realityProbes
 }
 
 // NewEngine creates a new VPN engine.
 func NewEngine(sm *StateMachine) *Engine {
-	return &Engine{
-		stateMachine: sm,
-		config:       DefaultConfig(),
+	client := newClashClient(2 * time.Second)
+	e := &Engine{
+		stateMachine:     sm,
+		config:           DefaultConfig(),
+		driver:           wintunProbe{},
+		ifaces:           newIfaceAPI(),
+		poller:           newStatsPoller(),
+		statsWarmup:      statsWarmup,
+		healthThresholds: DefaultHealthThresholds(),
+		healthInterval:   healthProbeInterval,
+		startCore:        startSingBox,
+		mtuSuggestions:   map[string]int{},
+		mtuProbeDelay:    mtuProbeDelay,
+		sendMTUProbe:     newMTUSender(),
+		reality:          defaultRealityProbes,
+	}
+	e.probeDelay = newProbeDelay(e.clashAPIBase)
+	e.hot = newHotClient(e.clashAPIBase)
+	e.fetchConns = func(ctx context.Context, secret string) (*clashConnections, error) {
+		return fetchConnections(ctx, client, e.clashAPIBase(), secret)
+	}
+	return e
+}
+
+// SetInstance selects the instance whose TUN adapter, firewall rules and
+// Clash API port sessions use. Call it before the first connect.
+func (e *Engine) SetInstance(inst instance.Instance) {
+	e.inst = inst
+	e.driver = wintunProbe{inst: inst}
+}
+
+// Instance returns the instance set with SetInstance.
+func (e *Engine) Instance() instance.Instance {
+	return e.inst
+}
+
+// startSingBox creates and starts a sing-box instance from configJSON.
+// ctx must carry the sing-box type registries.
+func startSingBox(ctx context.Context, configJSON []byte) (coreBox, error) {
+	var opts option.Options
+	if err := opts.UnmarshalJSONContext(ctx, configJSON); err != nil {
+		return nil, fmt.Errorf("failed to parse sing-box options: %w", err)
+	}
+	instance, err := box.New(box.Options{
+		Context: ctx,
+		Options: opts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sing-box instance: %w", err)
+	}
+	if err := instance.Start(); err != nil {
+		instance.Close()
+		return nil, fmt.Errorf("failed to start sing-box: %w", err)
 	}
+	return instance, nil
 }
 
-// Connect starts the VPN connection with the given config.
-func (e *Engine) Connect(cfg *Config) error {
+// Connect starts the VPN connection with the given config, refused while
+// another attempt is in progress. If ctx is done before the tunnel is up,
+// the connect is abandoned and ctx's error returned; once connected, the
+// session no longer depends on ctx.
+func (e *Engine) Connect(ctx context.Context, cfg *Config) error {
+	return e.ConnectWith(ctx, cfg, AttemptOptions{})
+}
+
+// ConnectWith is Connect with the attempt policy and origin of opts. A
+// connect that is refused or preempted returns an *AttemptError.
+func (e *Engine) ConnectWith(ctx context.Context, cfg *Config, opts AttemptOptions) error {
+	ctx, done, err := e.attempts.acquire(ctx, AttemptConnect, opts)
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	if e.box != nil {
-		return fmt.Errorf("already connected, disconnect first")
+		if opts.Policy != AttemptReplace {
+			return fmt.Errorf("already connected, disconnect first")
+		}
+		e.endSession(ReasonSwitch)
 	}
 
+	started := time.Now()
+	e.stateMachine.setServer(cfg.Server)
 	e.stateMachine.SetState(StateConnecting, nil)
+	withInstance := *cfg
+	withInstance.Instance = e.inst
+	if err := e.establish(ctx, &withInstance, started, false); err != nil {
+		if ctx.Err() != nil {
+			return attemptErr(ctx)
+		}
+		return err
+	}
+	return nil
+}
+
+// establish brings up a link with cfg, for a new session or, when
+// reconnect is set, for the current one. e.mu must be held and the
+// connecting state entered.
+func (e *Engine) establish(ctx context.Context, cfg *Config, started time.Time, reconnect bool) error {
+	startCore := e.startCore
+	if cfg.Simulation != nil {
+		// A simulated link touches neither the TUN driver nor the adapter.
+		simulated := *cfg
+		simulated.HardenInterface = false
+		simulated.DelayConnectedUntilRouteVerified = false
+		simulated.LAN = nil
+		cfg = &simulated
+		startCore = cfg.Simulation.startCore
+	}
+
+	// Fail early with an actionable error instead of a deep sing-box one.
+	var err error
+	if cfg.Simulation != nil {
+		err = cfg.Simulation.checkDriver()
+	} else {
+		_, err = checkDriver(e.driver, true)
+	}
+	if err != nil {
+		e.stateMachine.SetState(StateError, err)
+		return err
+	}
 
 	// Build sing-box JSON config
-	configJSON, clashSecret, err := BuildSingBoxConfig(cfg)
+	built, err := BuildSingBoxConfig(cfg)
 	if err != nil {
 		e.stateMachine.SetState(StateError, err)
 		return fmt.Errorf("failed to build config: %w", err)
 	}
+	configBuilt := time.Now()
+	if err := ctx.Err(); err != nil {
+		e.stateMachine.SetState(StateDisconnected, nil)
+		return err
+	}
 
 	log.Printf("sing-box config built for server %s, protocol %s (%d bytes)",
-		cfg.Server.Address, cfg.Server.Protocol, len(configJSON))
+		cfg.Server.Address, cfg.Server.Protocol, len(built.JSON))
+
+	// Open the LAN sharing port before the inbound listens; closed again
+	// if the connect does not complete.
+	if cfg.LAN != nil {
+		if err := openLANPort(cfg.LAN, e.inst); err != nil {
+			e.stateMachine.SetState(StateError, err)
+			return fmt.Errorf("failed to open LAN port %d in the firewall: %w", cfg.LAN.Port, err)
+		}
+		defer func() {
+			if e.box == nil {
+				if err := closeLANPort(e.inst); err != nil {
+					log.Printf("warning: failed to close LAN port: %v", err)
+				}
+			}
+		}()
+	}
 
-	// Create context with sing-box type registries (required for 1.12+).
-	ctx, cancel := context.WithCancel(include.Context(context.Background()))
+	e.shaper.set(cfg.RateLimit)
+	boxCtx, cancel := context.WithCancel(boxContext(context.Background(), &e.shaper))
 
-	// Parse config into sing-box options
-	var opts option.Options
-	if err := opts.UnmarshalJSONContext(ctx, configJSON); err != nil {
+	instance, err := startCore(boxCtx, built.JSON)
+	if isCacheFileError(err) && cfg.CacheFile != "" {
+		// A locked or corrupted cache file is not worth a failed connect:
+		// move it aside, or else do without it this session.
 		cancel()
-		e.stateMachine.SetState(StateError, err)
-		return fmt.Errorf("failed to parse sing-box options: %w", err)
+		log.Printf("warning: sing-box cache file unusable, moving it aside: %v", err)
+		if moveErr := setAsideCacheFile(cfg.CacheFile); moveErr != nil {
+			log.Printf("warning: failed to move the cache file aside, connecting without it: %v", moveErr)
+			noCache := *cfg
+			noCache.CacheFile = ""
+			if built, err = BuildSingBoxConfig(&noCache); err != nil {
+				e.stateMachine.SetState(StateError, err)
+				return fmt.Errorf("failed to build config: %w", err)
+			}
+		}
+		boxCtx, cancel = context.WithCancel(boxContext(context.Background(), &e.shaper))
+		instance, err = startCore(boxCtx, built.JSON)
 	}
-
-	// Create sing-box instance
-	instance, err := box.New(box.Options{
-		Context: ctx,
-		Options: opts,
-	})
 	if err != nil {
 		cancel()
 		e.stateMachine.SetState(StateError, err)
-		return fmt.Errorf("failed to create sing-box instance: %w", err)
+		return err
 	}
+	coreStarted := time.Now()
 
-	// Start sing-box
-	if err := instance.Start(); err != nil {
+	// sing-box start cannot be interrupted; tear down what it brought up
+	// for a caller that has given up meanwhile.
+	if err := ctx.Err(); err != nil {
 		cancel()
 		instance.Close()
-		e.stateMachine.SetState(StateError, err)
-		return fmt.Errorf("failed to start sing-box: %w", err)
+		e.stateMachine.SetState(StateDisconnected, nil)
+		return err
+	}
+
+	// sing-box created the adapter; make sure Windows prefers it and does
+	// not leak our tunnel address to DNS.
+	e.hardening = nil
+	if cfg.HardenInterface {
+		e.hardening = applyHardening(e.ifaces, e.inst.InterfaceName(), cfg.PinTunDNS)
+	}
+	var tun *tunCounter
+	if cfg.Simulation == nil {
+		tun = newTunCounter(e.ifaces, e.inst.InterfaceName())
+	}
+
+	// Hold the Connected transition until apps can no longer race the
+	// route setup, giving up on the wait rather than the session.
+	if cfg.DelayConnectedUntilRouteVerified {
+		if err := waitForTunRoute(ctx, e.ifaces, e.inst.InterfaceName(), routeVerifyTimeout); err != nil {
+			if ctx.Err() != nil {
+				e.revertHardening()
+				cancel()
+				instance.Close()
+				e.stateMachine.SetState(StateDisconnected, nil)
+				return err
+			}
+			log.Printf("warning: %v; reporting connected anyway", err)
+		}
 	}
 
 	e.box = instance
 	e.cancel = cancel
+	e.session++
 	e.config = cfg
 	e.connectedAt = time.Now()
+	e.earlyLeak = newEarlyLeakDetector(e.connectedAt)
+	e.tun = tun
 	e.lastUpload = 0
 	e.lastDownload = 0
-	e.proxyConns = make(map[string]connTraffic)
-	e.closedUpload = 0
-	e.closedDownload = 0
-	e.clashSecret = clashSecret
+	e.lastTun = [2]int64{}
+	e.activity = Activity{}
+	e.lanClients = nil
+	e.killSwitch = nil
+	if cfg.KillSwitch {
+		e.killSwitch = newKillSwitchMonitor()
+	}
+	e.rttMs = 0
+	e.rttAt = time.Time{}
+	e.health = newHealthTracker()
+	e.traffic = newTrafficTracker(statsStrategyFor(cfg))
+	e.lastTraffic = Traffic{}
+	e.clashSecret = built.ClashSecret
+	e.clashAddr.Store(cfg.clashAddr())
+	e.statsUnavailable = false
+	e.rules = built.Rules
+	e.finalRule = built.Final
+	e.shaped = rateLimitMode(cfg) == RateLimitShaped
+	reason := ""
+	if reconnect {
+		// The session's connect timing stays that of its first link.
+		reason = ReasonReconnect
+	} else {
+		e.carried = sessionCarry{}
+		e.pendingChanges = nil
+		e.clashRecovery = clashRecoveryNone
+		e.timing = ConnectTiming{
+			Server:  cfg.Server,
+			At:      started,
+			BuildMs: configBuilt.Sub(started).Milliseconds(),
+			StartMs: coreStarted.Sub(configBuilt).Milliseconds(),
+			TotalMs: e.connectedAt.Sub(started).Milliseconds(),
+		}
+		e.timingPending = true
+	}
 
-	e.stateMachine.SetState(StateConnected, nil)
+	e.stateMachine.SetStateReason(StateConnected, reason)
 
-	// Start stats polling
-	go e.pollStats(ctx)
+	e.poller.hand(&pollSession{ctx: boxCtx, id: e.session, secret: built.ClashSecret, warmup: e.statsWarmup}, e.pollStats)
+	go e.probeHealth(boxCtx, e.session, e.healthInterval)
+	go e.autoProbeMTU(boxCtx, e.session)
 
 	return nil
 }
 
-// Disconnect stops the VPN connection.
+// Disconnect stops the VPN connection at the user's request.
 func (e *Engine) Disconnect() error {
+	return e.DisconnectWithReason(ReasonUser)
+}
+
+// DisconnectWithReason stops the VPN connection, reporting reason with the
+// state changes and to session end listeners. Attempts in progress are
+// preempted, so a connect that is still coming up does not hold the
+// disconnect off.
+func (e *Engine) DisconnectWithReason(reason string) error {
+	e.attempts.cancelAll(AttemptDisconnect, reason)
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	if e.box == nil {
 		return nil
 	}
+	e.endSession(reason)
+	return nil
+}
+
+// endSession ends the connected session with reason. e.mu must be held.
+func (e *Engine) endSession(reason string) {
+	e.stateMachine.SetStateReason(StateDisconnecting, reason)
 
-	e.stateMachine.SetState(StateDisconnecting, nil)
+	// A session that never carried traffic still counts as a connect.
+	if e.timingPending {
+		e.timingPending = false
+		e.stateMachine.NotifyConnectTiming(e.timing)
+	}
 
+	e.closeLink()
+	e.domains.clear()
+
+	e.stateMachine.NotifySessionEnd(SessionEnd{
+		Server:     e.timing.Server,
+		StartedAt:  e.timing.At,
+		EndedAt:    time.Now(),
+		Reason:     reason,
+		Reconnects: e.carried.reconnects,
+	})
+	e.stateMachine.SetStateReason(StateDisconnected, reason)
+}
+
+// closeLink tears down the current link. e.mu must be held.
+func (e *Engine) closeLink() {
 	if e.cancel != nil {
 		e.cancel()
 		e.cancel = nil
 	}
 
+	// Revert while the adapter still exists.
+	e.revertHardening()
+
 	if err := e.box.Close(); err != nil {
 		log.Printf("warning: error closing sing-box: %v", err)
 	}
 	e.box = nil
+	if e.config.LAN != nil {
+		if err := closeLANPort(e.inst); err != nil {
+			log.Printf("warning: failed to close LAN port: %v", err)
+		}
+	}
+}
 
-	e.stateMachine.SetState(StateDisconnected, nil)
-	return nil
+// revertHardening undoes the interface hardening of the session, if any.
+// e.mu must be held.
+func (e *Engine) revertHardening() {
+	if e.hardening == nil {
+		return
+	}
+	for _, err := range e.hardening.revert() {
+		log.Printf("warning: failed to revert interface hardening: %v", err)
+	}
+	e.hardening = nil
 }
 
-// ConnectedAt returns the time the VPN connected.
+// ConnectedAt returns the time the current link was established; see
+// SessionStartedAt for the session.
 func (e *Engine) ConnectedAt() time.Time {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	return e.connectedAt
 }
 
-// Config returns the current config.
-func (e *Engine) Config() *Config {
+// Traffic returns the cumulative traffic of the current session, across
+// its links.
+func (e *Engine) Traffic() Traffic {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	return e.config
+	return e.carried.traffic.plus(e.lastTraffic)
 }
 
-// clashConnections is the response structure from the Clash API /connections endpoint.
-type clashConnections struct {
-	DownloadTotal int64              `json:"downloadTotal"`
-	UploadTotal   int64              `json:"uploadTotal"`
-	Connections   []clashConnection  `json:"connections"`
+// StatsStrategy returns how the current session counts traffic, one of
+// the Stats* strategies; empty when disconnected.
+func (e *Engine) StatsStrategy() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil {
+		return ""
+	}
+	return e.traffic.strategy
 }
 
-// clashConnection represents a single active connection from the Clash API.
-type clashConnection struct {
-	ID       string   `json:"id"`
-	Upload   int64    `json:"upload"`
-	Download int64    `json:"download"`
-	Chains   []string `json:"chains"`
+// LastConnectTiming returns the stage timing of the most recent successful
+// connect; the zero value if there was none.
+func (e *Engine) LastConnectTiming() ConnectTiming {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.timing
 }
 
-// connTraffic tracks the last-seen traffic for a proxy connection.
-type connTraffic struct {
-	upload   int64
-	download int64
+// Hardening returns the interface hardening applied for the current
+// session, or nil if none was attempted.
+func (e *Engine) Hardening() *HardeningReport {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.hardening == nil {
+		return nil
+	}
+	report := e.hardening.report
+	return &report
 }
 
-// isProxyChain returns true if any chain entry indicates proxy outbound.
-func isProxyChain(chains []string) bool {
-	for _, c := range chains {
-		if c == "proxy" {
-			return true
-		}
+// TraceConnections turns connection tracing on or off. While on, each new
+// connection is reported to ConnMatch listeners with the rule that routed
+// it. Tracing turns itself off after 10 minutes; the returned time is when
+// (zero when off).
+func (e *Engine) TraceConnections(enabled bool) time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !enabled {
+		e.tracer.stop()
+		return time.Time{}
 	}
-	return false
+	return e.tracer.start(time.Now())
 }
 
-func (e *Engine) pollStats(ctx context.Context) {
-	// Give the Clash API a moment to start listening.
+// Config returns the current config.
+func (e *Engine) Config() *Config {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.config
+}
+
+// pollStats polls the Clash API for session s until its context is done
+// or another session replaces it. It runs on the poller goroutine only.
+func (e *Engine) pollStats(s *pollSession) {
 	select {
-	case <-ctx.Done():
+	case <-s.ctx.Done():
 		return
-	case <-time.After(1 * time.Second):
+	case <-time.After(s.warmup):
 	}
 
-	client := &http.Client{Timeout: 2 * time.Second}
-	ticker := time.NewTicker(1 * time.Second)
+	e.mu.Lock()
+	interval := e.pollInterval()
+	tun := e.tun
+	e.mu.Unlock()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	lastPoll := time.Now()
+	failures := 0    // consecutive failed polls
+	reached := false // a poll got an answer from the Clash API
 
 	for {
 		select {
-		case <-ctx.Done():
+		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
 			e.mu.Lock()
-			if e.box == nil {
+			if e.box == nil || e.session != s.id {
 				e.mu.Unlock()
 				return
 			}
+			// Power mode changes apply from the next tick.
+			if next := e.pollInterval(); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
 			e.mu.Unlock()
 
 			// Query the Clash API for per-connection traffic.
-			req, reqErr := http.NewRequest("GET", "http://127.0.0.1:9090/connections", nil)
-			if reqErr != nil {
-				continue
-			}
-			if e.clashSecret != "" {
-				req.Header.Set("Authorization", "Bearer "+e.clashSecret)
-			}
-			resp, err := client.Do(req)
+			conns, err := e.fetchConns(s.ctx, s.secret)
 			if err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
+				failures++
+				if !clashUnreachable(err) {
+					reached = true
+				}
+				if !reached && failures == clashUnreachablePolls {
+					e.recoverClashAPI(s, err)
+					return
+				}
+				if failures == statsStallThreshold {
+					log.Printf("warning: %d stats polls in a row failed: %v", failures, err)
+					e.stateMachine.NotifyStatsStalled(StatsStall{Failures: failures, Error: err.Error()})
+				}
 				continue
 			}
-
-			var conns clashConnections
-			if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
-				resp.Body.Close()
-				continue
+			failures = 0
+			reached = true
+			// Only this goroutine reads the session's counter.
+			var tunUpload, tunDownload int64
+			if tun != nil {
+				tun.read(e.ifaces, e.inst.InterfaceName())
+				tunUpload, tunDownload = tun.upload, tun.download
 			}
-			resp.Body.Close()
-
-			// Sum traffic only for connections routed through "proxy" outbound.
-			activeIDs := make(map[string]struct{})
-			var activeUpload, activeDownload int64
-			for _, c := range conns.Connections {
-				if !isProxyChain(c.Chains) {
-					continue
-				}
-				activeIDs[c.ID] = struct{}{}
-				activeUpload += c.Upload
-				activeDownload += c.Download
+
+			now := time.Now()
+			elapsedMs := now.Sub(lastPoll).Milliseconds()
+			lastPoll = now
+			if elapsedMs <= 0 {
+				elapsedMs = 1
 			}
 
 			e.mu.Lock()
-			// Detect closed proxy connections and accumulate their last-seen traffic.
-			for id, traffic := range e.proxyConns {
-				if _, still := activeIDs[id]; !still {
-					e.closedUpload += traffic.upload
-					e.closedDownload += traffic.download
-					delete(e.proxyConns, id)
-				}
-			}
-			// Update tracker with current active proxy connections.
-			for _, c := range conns.Connections {
-				if !isProxyChain(c.Chains) {
-					continue
-				}
-				e.proxyConns[c.ID] = connTraffic{upload: c.Upload, download: c.Download}
+			// The session may have ended during the request.
+			if e.box == nil || e.session != s.id {
+				e.mu.Unlock()
+				return
 			}
+			traffic := e.traffic.update(conns)
 
-			// Total proxy traffic = closed accumulator + active proxy traffic.
-			upload := e.closedUpload + activeUpload
-			download := e.closedDownload + activeDownload
-
-			upSpeed := upload - e.lastUpload
-			downSpeed := download - e.lastDownload
+			// Speeds are per second whatever the poll interval.
+			upSpeed := (traffic.Upload - e.lastUpload) * 1000 / elapsedMs
+			downSpeed := (traffic.Download - e.lastDownload) * 1000 / elapsedMs
 			if upSpeed < 0 {
 				upSpeed = 0
 			}
 			if downSpeed < 0 {
 				downSpeed = 0
 			}
-			e.lastUpload = upload
-			e.lastDownload = download
+			e.lastUpload = traffic.Upload
+			e.lastDownload = traffic.Download
+			e.lastTraffic = traffic
+			e.lastTun = [2]int64{tunUpload, tunDownload}
+			session := e.carried
+			rttMs := e.rttMs
+			e.activity = Activity{
+				ProxyConnections: countProxyConns(conns.Connections),
+				UpSpeed:          upSpeed,
+				DownSpeed:        downSpeed,
+			}
+			if e.config.LAN != nil {
+				e.lanClients = lanClients(conns.Connections)
+			}
+			var engaged *KillSwitchStats
+			if e.killSwitch != nil && e.killSwitch.observe(now, traffic, conns.Connections) {
+				ks := e.killSwitch.snapshot(now)
+				engaged = &ks
+			}
+			var leak *EarlyLeak
+			if e.earlyLeak.observe(now, conns.Connections, e.rules, e.finalRule) {
+				l := e.earlyLeak.snapshot()
+				leak = &l
+			}
+			matches := e.tracer.observe(conns.Connections, e.rules, e.finalRule, time.Now())
+			e.domains.observe(conns.Connections, now)
+			// Data coming back through the proxy verifies the connection.
+			var timing *ConnectTiming
+			if e.timingPending && traffic.Download > 0 {
+				e.timingPending = false
+				e.timing.FirstTrafficMs = time.Since(e.timing.At).Milliseconds()
+				t := e.timing
+				timing = &t
+			}
 			e.mu.Unlock()
 
-			e.stateMachine.NotifyStats(upload, download, upSpeed, downSpeed)
+			if timing != nil {
+				e.stateMachine.NotifyConnectTiming(*timing)
+			}
+			if engaged != nil {
+				log.Printf("kill switch engaged: the proxy stopped answering, traffic held in the tunnel")
+				e.stateMachine.NotifyKillSwitchEngaged(*engaged)
+			}
+			if leak != nil {
+				log.Printf("warning: connections went direct while routes were being set up: %v", leak.Hosts)
+				e.stateMachine.NotifyEarlyLeak(*leak)
+			}
+
+			e.stateMachine.NotifyStats(Stats{Traffic: session.traffic.plus(traffic), UpSpeed: upSpeed, DownSpeed: downSpeed, RTTMs: rttMs,
+				TunUpload: session.tunUpload + tunUpload, TunDownload: session.tunDownload + tunDownload})
+			for _, m := range matches {
+				e.stateMachine.NotifyConnMatched(m)
+			}
 		}
 	}
 }
+
+// pollInterval is the stats poll interval. e.mu must be held.
+func (e *Engine) pollInterval() time.Duration {
+	if e.statsInterval > 0 {
+		return e.statsInterval
+	}
+	return statsIntervalFor(e.powerMode)
+}
@@ -0,0 +1,265 @@
+package vpn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+)
+
+// Route classes reported by Explain.
+const (
+	RouteProxy  = "proxy"  // through the tunnel
+	RouteDirect = "direct" // around the tunnel
+	RouteBlock  = "block"
+	RouteDNS    = "dns" // answered by the built-in DNS servers
+)
+
+// Explanation summarizes what a config will do with traffic, derived from
+// the generated sing-box config rather than from the inputs.
+type Explanation struct {
+	Server       string        `json:"server"`
+	Protocol     string        `json:"protocol"`
+	Rules        []RuleSummary `json:"rules"`        // in evaluation order; first match wins
+	DefaultRoute string        `json:"defaultRoute"` // for traffic no rule matches
+	DNS          []DNSSummary  `json:"dns"`
+	KillSwitch   bool          `json:"killSwitch"`
+	MTU          int           `json:"mtu"`
+	Warnings     []string      `json:"warnings"`
+}
+
+// RuleSummary describes one routing rule.
+type RuleSummary struct {
+	Match          string   `json:"match"` // human-readable condition
+	Apps           []string `json:"apps,omitempty"`
+	Domains        []string `json:"domains,omitempty"`
+	DomainSuffixes []string `json:"domainSuffixes,omitempty"`
+	DomainKeywords []string `json:"domainKeywords,omitempty"`
+	DomainRegexes  []string `json:"domainRegexes,omitempty"`
+	IPs            []string `json:"ips,omitempty"`
+	Port           int      `json:"port,omitempty"`
+	Network        string   `json:"network,omitempty"` // "udp" for transport policy rules
+	Route          string   `json:"route"`
+}
+
+// DNSSummary describes one DNS server and what it resolves.
+type DNSSummary struct {
+	Address string   `json:"address"`
+	Route   string   `json:"route"` // how queries to it travel
+	UsedFor []string `json:"usedFor"`
+}
+
+// generatedConfig is the subset of the sing-box config Explain reads.
+type generatedConfig struct {
+	DNS struct {
+		Servers []struct {
+			Tag     string `json:"tag"`
+			Address string `json:"address"`
+			Detour  string `json:"detour"`
+		} `json:"servers"`
+		Rules []struct {
+			Outbound []string `json:"outbound"`
+			Server   string   `json:"server"`
+		} `json:"rules"`
+		Final string `json:"final"`
+	} `json:"dns"`
+	Inbounds []struct {
+		MTU         int  `json:"mtu"`
+		StrictRoute bool `json:"strict_route"`
+	} `json:"inbounds"`
+	Route struct {
+		Rules []struct {
+			Inbound       listable `json:"inbound"`
+			Protocol      listable `json:"protocol"`
+			Network       string   `json:"network"`
+			Port          int      `json:"port"`
+			ProcessName   []string `json:"process_name"`
+			ProcessPath   []string `json:"process_path_regex"`
+			Domain        []string `json:"domain"`
+			DomainSuffix  []string `json:"domain_suffix"`
+			DomainKeyword []string `json:"domain_keyword"`
+			DomainRegex   []string `json:"domain_regex"`
+			IPCIDR        []string `json:"ip_cidr"`
+			Outbound      string   `json:"outbound"`
+			Action        string   `json:"action"`
+		} `json:"rules"`
+		Final string `json:"final"`
+	} `json:"route"`
+}
+
+// listable is a sing-box field that is either a single string or a list.
+type listable []string
+
+func (l *listable) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*l = listable{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+func (l listable) has(value string) bool {
+	for _, v := range l {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Explain builds the sing-box config for cfg without starting anything and
+// describes the resulting routing and DNS behaviour.
+func Explain(cfg *Config) (*Explanation, error) {
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var gen generatedConfig
+	if err := json.Unmarshal(built.JSON, &gen); err != nil {
+		return nil, fmt.Errorf("failed to read generated config: %w", err)
+	}
+
+	e := &Explanation{
+		Server:       cfg.Server.Name,
+		Protocol:     cfg.Server.Protocol,
+		Rules:        []RuleSummary{},
+		DefaultRoute: routeFor(gen.Route.Final),
+		DNS:          []DNSSummary{},
+		Warnings:     explainWarnings(cfg.Server),
+	}
+	if cfg.SniffMode == SniffOff && cfg.SplitTunnelMode == "domain" {
+		e.Warnings = append(e.Warnings, "sniffing is off; domain rules only match connections whose domain was resolved through the VPN's DNS")
+	}
+	if cfg.SniffMode == SniffOff && bypassesMatchDomains(cfg.BuiltinBypasses) {
+		e.Warnings = append(e.Warnings, "sniffing is off; built-in bypasses only match their domains when resolved through the VPN's DNS")
+	}
+	if cfg.LAN != nil {
+		e.Warnings = append(e.Warnings, fmt.Sprintf("LAN sharing only covers devices whose proxy is set to %s; the rest of the LAN is not tunneled",
+			net.JoinHostPort(cfg.LAN.Listen, strconv.Itoa(cfg.LAN.Port))))
+	}
+	if len(gen.Inbounds) > 0 {
+		e.MTU = gen.Inbounds[0].MTU
+		// Only selected apps in the tunnel have a kill switch without
+		// strict routing; see strictRoute.
+		e.KillSwitch = gen.Inbounds[0].StrictRoute || cfg.KillSwitch
+	}
+
+	for _, r := range gen.Route.Rules {
+		if r.Action == "sniff" {
+			continue // inspects traffic but routes nothing
+		}
+		rs := RuleSummary{
+			Apps:           r.ProcessName,
+			Domains:        r.Domain,
+			DomainSuffixes: r.DomainSuffix,
+			DomainKeywords: r.DomainKeyword,
+			DomainRegexes:  r.DomainRegex,
+			IPs:            r.IPCIDR,
+			Port:           r.Port,
+			Network:        r.Network,
+			Route:          routeFor(r.Outbound),
+		}
+		var bypass *splittunnel.BypassBundle
+		if name, ok := splittunnel.BypassRuleName(r.DomainSuffix, r.IPCIDR); ok && r.Outbound == tagDirect && len(r.Domain) == 0 {
+			bypass = splittunnel.Bypass(name)
+		}
+		switch {
+		case r.Protocol.has("dns") || r.Outbound == tagDNSOut:
+			rs.Match = "DNS queries"
+		case r.Inbound.has(tagLANIn):
+			rs.Match = "traffic from LAN devices using the shared proxy"
+		case r.Network == "udp" && r.Port == 443:
+			rs.Match = "QUIC traffic (UDP port 443)"
+		case r.Network == "udp":
+			rs.Match = "UDP traffic other than DNS"
+		case r.Port == 53 && len(r.ProcessName) > 0:
+			rs.Match = "DNS traffic from these apps (hijack exception)"
+		case r.Port == 53 && len(r.IPCIDR) > 0:
+			rs.Match = "DNS traffic to these servers (hijack exception)"
+		case bypass != nil:
+			rs.Match = bypass.Title + " traffic (built-in bypass)"
+		case len(r.ProcessName) > 0:
+			rs.Match = "traffic from these apps"
+		case len(r.ProcessPath) > 0:
+			rs.Match = "traffic from any other identified app"
+		case len(r.Domain) > 0 || len(r.DomainSuffix) > 0 || len(r.DomainKeyword) > 0 || len(r.DomainRegex) > 0:
+			rs.Match = "traffic to these domains"
+		case len(r.IPCIDR) > 0:
+			rs.Match = "traffic to these addresses"
+		case len(r.Protocol) > 0:
+			rs.Match = "other traffic whose domain was sniffed"
+		default:
+			rs.Match = "other"
+		}
+		e.Rules = append(e.Rules, rs)
+	}
+
+	for _, srv := range gen.DNS.Servers {
+		ds := DNSSummary{Address: srv.Address, Route: routeFor(srv.Detour), UsedFor: []string{}}
+		for _, rule := range gen.DNS.Rules {
+			if rule.Server == srv.Tag && len(rule.Outbound) > 0 {
+				ds.UsedFor = append(ds.UsedFor, "resolving server addresses for outbound connections")
+			}
+		}
+		if gen.DNS.Final == srv.Tag {
+			ds.UsedFor = append(ds.UsedFor, "all other lookups")
+		}
+		e.DNS = append(e.DNS, ds)
+	}
+	return e, nil
+}
+
+// bypassesMatchDomains reports whether any of the named built-in bypasses
+// matches by domain.
+func bypassesMatchDomains(names []string) bool {
+	for _, name := range names {
+		if b := splittunnel.Bypass(name); b != nil && len(b.DomainSuffixes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// routeFor maps an outbound tag to its route class.
+func routeFor(tag string) string {
+	switch tag {
+	case tagProxy:
+		return RouteProxy
+	case tagDirect:
+		return RouteDirect
+	case tagBlock:
+		return RouteBlock
+	case tagDNSOut:
+		return RouteDNS
+	default:
+		return tag
+	}
+}
+
+// explainWarnings lists risky or ignored server settings.
+func explainWarnings(server *parser.ServerConfig) []string {
+	warnings := []string{}
+	for _, key := range parser.UnknownParams(server) {
+		warnings = append(warnings, fmt.Sprintf("link parameter %q is not supported and will be ignored", key))
+	}
+	switch server.Protocol {
+	case "vless":
+		switch server.Params["security"] {
+		case "tls", "reality":
+			if server.Params["fp"] == "" {
+				warnings = append(warnings, "no uTLS fingerprint (fp) set; the TLS handshake is easy to identify")
+			}
+		default:
+			warnings = append(warnings, "connection is not protected by TLS")
+		}
+	case "hysteria2":
+		if server.Params["insecure"] == "1" {
+			warnings = append(warnings, "TLS certificate verification is disabled; the connection is open to interception")
+		}
+	}
+	return append(warnings, CheckCompat(server, CoreVersion())...)
+}
@@ -0,0 +1,64 @@
+package vpn
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExplainGolden(t *testing.T) {
+	tests := []struct {
+		golden string
+		link   string
+		setup  func(*Config)
+	}{
+		{"explain_full_tunnel", "vless://u@example.com:443?security=reality&sni=www.example.com&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&fp=chrome#Home", func(c *Config) {
+			c.KillSwitch = true
+		}},
+		{"explain_only_apps", "vless://u@example.com:443?security=tls&sni=example.com&mux=1#Work", func(c *Config) {
+			c.SplitTunnelMode = "app"
+			c.SplitTunnelApps = []string{`C:\Program Files\Google\chrome.exe`, "telegram.exe"}
+			c.DNSHijackExceptions = []string{"vpnagent.exe", "10.0.0.53"}
+		}},
+		{"explain_except_domains", "hy2://p@example.com:443?insecure=1#Hy", func(c *Config) {
+			c.SplitTunnelMode = "domain"
+			c.SplitTunnelDomains = []string{"https://bank.example/login", ".lan", "keyword:tracker", `regex:^cdn[0-9]+\.bank\.example$`}
+			c.SplitTunnelInvert = true
+			c.DNS = "google"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Server = mustParse(t, tt.link)
+			tt.setup(cfg)
+
+			e, err := Explain(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(e, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.golden, append(got, '\n'))
+		})
+	}
+}
+
+func TestExplainRejectsInvalidConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.TCPKeepAliveSeconds = 1
+	if _, err := Explain(cfg); err == nil {
+		t.Error("Explain accepted an invalid config")
+	}
+
+	cfg.TCPKeepAliveSeconds = 0
+	cfg.SplitTunnelMode = "domain"
+	cfg.SplitTunnelDomains = []string{"example.org", "regex:(cdn"}
+	if _, err := Explain(cfg); err == nil || !strings.Contains(err.Error(), "domain entry 1") {
+		t.Errorf("invalid domain regex: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+)
+
+// Address families as used by the IP Helper API.
+const (
+	afInet  uint16 = 2
+	afInet6 uint16 = 23
+)
+
+// tunDNSStub is the address the adapter's DNS is pointed at when DNS
+// hardening is on. It lies inside the TUN /30, so queries to it enter the
+// tunnel and hit the DNS hijack rule.
+const tunDNSStub = "172.19.0.2"
+
+// errFamilyUnavailable is returned by ifaceAPI when the interface has no
+// configuration for an address family (e.g. IPv6 disabled).
+var errFamilyUnavailable = errors.New("address family not configured on interface")
+
+// HardeningReport describes the interface hardening applied to the TUN
+// adapter for the current session.
+type HardeningReport struct {
+	IPv4Metric              bool     `json:"ipv4Metric"` // metric forced to 1
+	IPv6Metric              bool     `json:"ipv6Metric"`
+	DNSRegistrationDisabled bool     `json:"dnsRegistrationDisabled"`
+	DNSServerPinned         bool     `json:"dnsServerPinned"` // adapter DNS set to the tunnel stub
+	Errors                  []string `json:"errors,omitempty"`
+}
+
+// ifaceAPI wraps the Windows calls on the TUN adapter, used for hardening
+// and its traffic counters, so the decision logic can be tested with a
+// fake.
+type ifaceAPI interface {
+	interfaceIndex(name string) (uint32, error)
+	metric(family uint16, index uint32) (metric uint32, automatic bool, err error)
+	setMetric(family uint16, index uint32, metric uint32, automatic bool) error
+	dnsRegistration(name string) (bool, error)
+	setDNSRegistration(name string, enabled bool) error
+	setDNSServers(name string, servers []string) error // nil resets to automatic
+	bestInterface(dst netip.Addr) (uint32, error)      // index of the adapter dst is routed through
+	interfaceLUID(name string) (uint64, error)
+	octets(luid uint64) (in, out uint64, err error) // the adapter's byte counters
+}
+
+// hardening remembers what applyHardening changed so revert can undo it.
+type hardening struct {
+	undo   []func() error // in apply order
+	report HardeningReport
+}
+
+// applyHardening forces the TUN adapter to the lowest interface metric,
+// disables DNS registration and, if pinDNS is set, points the adapter's DNS
+// at the tunnel stub. Each step is independent: a failure is reported and
+// the remaining steps still run.
+func applyHardening(api ifaceAPI, name string, pinDNS bool) *hardening {
+	h := &hardening{}
+	index, err := api.interfaceIndex(name)
+	if err != nil {
+		h.fail("find adapter", err)
+		return h
+	}
+
+	for _, family := range []uint16{afInet, afInet6} {
+		family := family
+		prev, auto, err := api.metric(family, index)
+		if errors.Is(err, errFamilyUnavailable) {
+			continue
+		}
+		if err == nil {
+			err = api.setMetric(family, index, 1, false)
+		}
+		if err != nil {
+			h.fail(fmt.Sprintf("set %s metric", familyName(family)), err)
+			continue
+		}
+		h.undo = append(h.undo, func() error { return api.setMetric(family, index, prev, auto) })
+		if family == afInet {
+			h.report.IPv4Metric = true
+		} else {
+			h.report.IPv6Metric = true
+		}
+	}
+
+	registered, err := api.dnsRegistration(name)
+	if err == nil && registered {
+		err = api.setDNSRegistration(name, false)
+		if err == nil {
+			h.undo = append(h.undo, func() error { return api.setDNSRegistration(name, true) })
+		}
+	}
+	if err != nil {
+		h.fail("disable DNS registration", err)
+	} else {
+		h.report.DNSRegistrationDisabled = true
+	}
+
+	if pinDNS {
+		if err := api.setDNSServers(name, []string{tunDNSStub}); err != nil {
+			h.fail("pin DNS server", err)
+		} else {
+			h.undo = append(h.undo, func() error { return api.setDNSServers(name, nil) })
+			h.report.DNSServerPinned = true
+		}
+	}
+	return h
+}
+
+// revert undoes the applied steps in reverse order and returns the errors
+// of any that failed.
+func (h *hardening) revert() []error {
+	var errs []error
+	for i := len(h.undo) - 1; i >= 0; i-- {
+		if err := h.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	h.undo = nil
+	return errs
+}
+
+func (h *hardening) fail(step string, err error) {
+	log.Printf("warning: interface hardening: %s: %v", step, err)
+	h.report.Errors = append(h.report.Errors, fmt.Sprintf("%s: %v", step, err))
+}
+
+func familyName(family uint16) string {
+	if family == afInet6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
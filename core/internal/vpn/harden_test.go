@@ -0,0 +1,201 @@
+package vpn
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+)
+
+type fakeMetric struct {
+	value     uint32
+	automatic bool
+}
+
+type fakeIfaceAPI struct {
+	metrics    map[uint16]*fakeMetric // missing family = not configured
+	registered bool
+	dns        []string
+	failSet    map[string]error // keyed by method name
+	calls      []string
+	routeIndex func() uint32 // adapter public addresses route through; 7 (the TUN) if nil
+	luid       uint64        // 0x7000 if 0
+	in, out    uint64        // byte counters
+}
+
+func newFakeIfaceAPI() *fakeIfaceAPI {
+	return &fakeIfaceAPI{
+		metrics: map[uint16]*fakeMetric{
+			afInet:  {value: 25, automatic: true},
+			afInet6: {value: 35, automatic: true},
+		},
+		registered: true,
+		failSet:    map[string]error{},
+	}
+}
+
+func (f *fakeIfaceAPI) interfaceIndex(name string) (uint32, error) {
+	if err := f.failSet["interfaceIndex"]; err != nil {
+		return 0, err
+	}
+	return 7, nil
+}
+
+func (f *fakeIfaceAPI) interfaceLUID(name string) (uint64, error) {
+	if err := f.failSet["interfaceLUID"]; err != nil {
+		return 0, err
+	}
+	if f.luid == 0 {
+		return 0x7000, nil
+	}
+	return f.luid, nil
+}
+
+func (f *fakeIfaceAPI) octets(luid uint64) (uint64, uint64, error) {
+	if err := f.failSet["octets"]; err != nil {
+		return 0, 0, err
+	}
+	return f.in, f.out, nil
+}
+
+func (f *fakeIfaceAPI) bestInterface(dst netip.Addr) (uint32, error) {
+	if f.routeIndex == nil {
+		return 7, nil
+	}
+	return f.routeIndex(), nil
+}
+
+func (f *fakeIfaceAPI) metric(family uint16, index uint32) (uint32, bool, error) {
+	m, ok := f.metrics[family]
+	if !ok {
+		return 0, false, errFamilyUnavailable
+	}
+	return m.value, m.automatic, nil
+}
+
+func (f *fakeIfaceAPI) setMetric(family uint16, index uint32, metric uint32, automatic bool) error {
+	f.calls = append(f.calls, "setMetric "+familyName(family))
+	if err := f.failSet["setMetric "+familyName(family)]; err != nil {
+		return err
+	}
+	f.metrics[family] = &fakeMetric{value: metric, automatic: automatic}
+	return nil
+}
+
+func (f *fakeIfaceAPI) dnsRegistration(name string) (bool, error) {
+	return f.registered, nil
+}
+
+func (f *fakeIfaceAPI) setDNSRegistration(name string, enabled bool) error {
+	f.calls = append(f.calls, "setDNSRegistration")
+	if err := f.failSet["setDNSRegistration"]; err != nil {
+		return err
+	}
+	f.registered = enabled
+	return nil
+}
+
+func (f *fakeIfaceAPI) setDNSServers(name string, servers []string) error {
+	f.calls = append(f.calls, "setDNSServers")
+	f.dns = servers
+	return nil
+}
+
+func TestApplyHardeningAndRevert(t *testing.T) {
+	api := newFakeIfaceAPI()
+	h := applyHardening(api, instance.Default.InterfaceName(), true)
+
+	want := HardeningReport{IPv4Metric: true, IPv6Metric: true, DNSRegistrationDisabled: true, DNSServerPinned: true}
+	if !reflect.DeepEqual(h.report, want) {
+		t.Fatalf("report = %+v, want %+v", h.report, want)
+	}
+	if m := api.metrics[afInet]; m.value != 1 || m.automatic {
+		t.Errorf("IPv4 metric = %+v, want fixed 1", m)
+	}
+	if api.registered {
+		t.Error("DNS registration still enabled")
+	}
+	if !reflect.DeepEqual(api.dns, []string{tunDNSStub}) {
+		t.Errorf("DNS servers = %v", api.dns)
+	}
+
+	api.calls = nil
+	if errs := h.revert(); len(errs) != 0 {
+		t.Fatalf("revert errors: %v", errs)
+	}
+	wantCalls := []string{"setDNSServers", "setDNSRegistration", "setMetric IPv6", "setMetric IPv4"}
+	if !reflect.DeepEqual(api.calls, wantCalls) {
+		t.Errorf("revert calls = %v, want %v", api.calls, wantCalls)
+	}
+	if m := api.metrics[afInet]; m.value != 25 || !m.automatic {
+		t.Errorf("IPv4 metric after revert = %+v", m)
+	}
+	if !api.registered || api.dns != nil {
+		t.Errorf("DNS not restored: registered=%v servers=%v", api.registered, api.dns)
+	}
+}
+
+func TestApplyHardeningWithoutIPv6(t *testing.T) {
+	api := newFakeIfaceAPI()
+	delete(api.metrics, afInet6)
+	h := applyHardening(api, instance.Default.InterfaceName(), false)
+
+	if !h.report.IPv4Metric || h.report.IPv6Metric || len(h.report.Errors) != 0 {
+		t.Errorf("report = %+v", h.report)
+	}
+	if h.report.DNSServerPinned || api.dns != nil {
+		t.Error("DNS pinned although not requested")
+	}
+}
+
+func TestApplyHardeningContinuesAfterFailure(t *testing.T) {
+	api := newFakeIfaceAPI()
+	api.failSet["setMetric IPv4"] = errors.New("access denied")
+	h := applyHardening(api, instance.Default.InterfaceName(), false)
+
+	if h.report.IPv4Metric || !h.report.IPv6Metric || !h.report.DNSRegistrationDisabled {
+		t.Errorf("report = %+v", h.report)
+	}
+	if len(h.report.Errors) != 1 {
+		t.Errorf("errors = %v, want one", h.report.Errors)
+	}
+
+	// Only the steps that were applied are reverted.
+	api.calls = nil
+	h.revert()
+	if !reflect.DeepEqual(api.calls, []string{"setDNSRegistration", "setMetric IPv6"}) {
+		t.Errorf("revert calls = %v", api.calls)
+	}
+}
+
+func TestApplyHardeningLeavesUnregisteredAdapter(t *testing.T) {
+	api := newFakeIfaceAPI()
+	api.registered = false
+	h := applyHardening(api, instance.Default.InterfaceName(), false)
+
+	if !h.report.DNSRegistrationDisabled {
+		t.Error("already-disabled registration not reported")
+	}
+	api.calls = nil
+	h.revert()
+	for _, c := range api.calls {
+		if c == "setDNSRegistration" {
+			t.Error("revert enabled DNS registration that was off before")
+		}
+	}
+}
+
+func TestApplyHardeningAdapterMissing(t *testing.T) {
+	api := newFakeIfaceAPI()
+	api.failSet["interfaceIndex"] = errors.New("no such interface")
+	h := applyHardening(api, instance.Default.InterfaceName(), true)
+
+	if len(api.calls) != 0 || len(h.report.Errors) != 1 {
+		t.Errorf("calls = %v, report = %+v", api.calls, h.report)
+	}
+	if errs := h.revert(); len(errs) != 0 {
+		t.Errorf("revert errors: %v", errs)
+	}
+}
@@ -0,0 +1,199 @@
+package vpn
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// A session stays Connected while sing-box runs, but the server behind it
+// may stop answering or slow to a crawl. Every healthProbeInterval the
+// Clash API delay test (see fetchDelay) runs through the proxy outbound; after enough
+// consecutive failed or slow probes the session is degraded, and it
+// recovers after enough consecutive good ones, so a single lost probe
+// neither degrades nor recovers it.
+const healthProbeInterval = rttProbeInterval
+
+// Reasons a session is degraded.
+const (
+	HealthProbeFailed = "probe_failed" // the delay test through the proxy failed
+	HealthHighRTT     = "high_rtt"     // the delay test took longer than HealthThresholds.RTTMs
+)
+
+// HealthThresholds decide when a session counts as degraded.
+type HealthThresholds struct {
+	FailedProbes   int   // consecutive bad probes before degraded
+	RTTMs          int64 // a probe slower than this is bad
+	RecoveryProbes int   // consecutive good probes before healthy again
+}
+
+// DefaultHealthThresholds returns the thresholds used unless settings
+// change them.
+func DefaultHealthThresholds() HealthThresholds {
+	return HealthThresholds{FailedProbes: 3, RTTMs: 1500, RecoveryProbes: 2}
+}
+
+// HealthListener is a callback invoked when a session becomes degraded or
+// recovers.
+type HealthListener func(health SessionHealth)
+
+// SessionHealth is whether the connected session answers in time. Reason
+// is one of the Health constants while degraded, and empty when healthy.
+// Reality is the post-mortem of a REALITY session degraded by failed
+// probes.
+type SessionHealth struct {
+	Healthy bool              `json:"healthy"`
+	Reason  string            `json:"reason,omitempty"`
+	Metrics HealthMetrics     `json:"metrics"`
+	Reality *RealityDiagnosis `json:"reality,omitempty"`
+}
+
+// HealthMetrics are the probe results behind a SessionHealth.
+type HealthMetrics struct {
+	RTTMs      int64 `json:"rttMs,omitempty"`    // last successful probe
+	BadProbes  int   `json:"badProbes"`          // consecutive failed or slow probes
+	GoodProbes int   `json:"goodProbes"`         // consecutive good probes
+	ProbedAt   int64 `json:"probedAt,omitempty"` // Unix seconds of the last probe
+}
+
+// healthTracker applies the thresholds to the probes of one session.
+type healthTracker struct {
+	health SessionHealth
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{health: SessionHealth{Healthy: true}}
+}
+
+// observe records a probe taken at now that measured rtt or failed with
+// err. It reports true when the session became degraded or recovered.
+func (h *healthTracker) observe(t HealthThresholds, now time.Time, rtt int64, err error) bool {
+	m := &h.health.Metrics
+	m.ProbedAt = now.Unix()
+	reason := ""
+	switch {
+	case err != nil:
+		reason = HealthProbeFailed
+	case rtt > t.RTTMs:
+		m.RTTMs = rtt
+		reason = HealthHighRTT
+	default:
+		m.RTTMs = rtt
+	}
+
+	if reason == "" {
+		m.BadProbes = 0
+		m.GoodProbes++
+		if !h.health.Healthy && m.GoodProbes >= t.RecoveryProbes {
+			h.health.Healthy = true
+			h.health.Reason = ""
+			h.health.Reality = nil
+			return true
+		}
+		return false
+	}
+	m.GoodProbes = 0
+	m.BadProbes++
+	if h.health.Healthy && m.BadProbes >= t.FailedProbes {
+		h.health.Healthy = false
+		h.health.Reason = reason
+		return true
+	}
+	if !h.health.Healthy {
+		h.health.Reason = reason
+	}
+	return false
+}
+
+// SetHealthThresholds sets when the running session and future ones count
+// as degraded.
+func (e *Engine) SetHealthThresholds(t HealthThresholds) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.healthThresholds = t
+}
+
+// Health returns the health of the current session, and false when
+// disconnected.
+func (e *Engine) Health() (SessionHealth, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil || e.health == nil {
+		return SessionHealth{}, false
+	}
+	return e.health.health, true
+}
+
+// probeHealth probes the session through the proxy every interval until
+// ctx is done, tracking its health and, for hysteria2, its RTT. Failed
+// probes keep the previous RTT. A REALITY session degraded by failed
+// probes gets a post-mortem before the change is reported.
+func (e *Engine) probeHealth(ctx context.Context, session uint64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.mu.Lock()
+			if e.box == nil || e.session != session {
+				e.mu.Unlock()
+				return
+			}
+			secret := e.clashSecret
+			e.mu.Unlock()
+
+			rtt, err := e.probeDelay(ctx, secret)
+			if ctx.Err() != nil {
+				return
+			}
+			now := time.Now()
+			e.mu.Lock()
+			if e.box == nil || e.session != session {
+				e.mu.Unlock()
+				return
+			}
+			if err == nil && rttProbeEnabled(e.config) {
+				e.rttMs = rtt
+				e.rttAt = now
+			}
+			changed := e.health.observe(e.healthThresholds, now, rtt, err)
+			health := e.health.health
+			server := e.config.Server
+			e.mu.Unlock()
+
+			if changed && health.Reason == HealthProbeFailed {
+				if d, ok := diagnoseReality(ctx, server, err, e.reality); ok {
+					log.Printf("REALITY post-mortem: %s", d.Hint)
+					e.mu.Lock()
+					if e.box == nil || e.session != session {
+						e.mu.Unlock()
+						return
+					}
+					e.health.health.Reality = &d
+					health = e.health.health
+					e.mu.Unlock()
+				}
+			}
+			if changed {
+				if health.Healthy {
+					log.Printf("session recovered")
+				} else {
+					log.Printf("warning: session degraded: %s", health.Reason)
+				}
+				e.stateMachine.NotifyHealthChanged(health)
+			}
+		}
+	}
+}
+
+// newProbeDelay returns the delay test probeHealth runs by default, against
+// the Clash API at base.
+func newProbeDelay(base func() string) func(ctx context.Context, secret string) (int64, error) {
+	client := newClashClient(rttProbeTimeout + time.Second)
+	return func(ctx context.Context, secret string) (int64, error) {
+		return fetchDelay(ctx, client, base(), secret)
+	}
+}
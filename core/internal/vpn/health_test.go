@@ -0,0 +1,96 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthTrackerHysteresis(t *testing.T) {
+	th := HealthThresholds{FailedProbes: 3, RTTMs: 1000, RecoveryProbes: 2}
+	h := newHealthTracker()
+	now := time.Now()
+	fail := errors.New("timeout")
+
+	steps := []struct {
+		rtt     int64
+		err     error
+		changed bool
+		healthy bool
+		reason  string
+	}{
+		{rtt: 80, healthy: true},
+		{err: fail, healthy: true}, // one lost probe
+		{rtt: 90, healthy: true},   // resets the count
+		{err: fail, healthy: true},
+		{rtt: 2000, healthy: true}, // slow counts as bad
+		{err: fail, changed: true, reason: HealthProbeFailed},
+		{rtt: 1500, reason: HealthHighRTT},
+		{rtt: 100, reason: HealthHighRTT},
+		{err: fail, reason: HealthProbeFailed}, // restarts recovery
+		{rtt: 100, reason: HealthProbeFailed},
+		{rtt: 100, changed: true, healthy: true},
+		{err: fail, healthy: true},
+	}
+	for i, s := range steps {
+		if got := h.observe(th, now, s.rtt, s.err); got != s.changed {
+			t.Errorf("step %d: changed = %v, want %v", i, got, s.changed)
+		}
+		if h.health.Healthy != s.healthy || h.health.Reason != s.reason {
+			t.Errorf("step %d: health = %+v, want healthy %v reason %q", i, h.health, s.healthy, s.reason)
+		}
+	}
+	if m := h.health.Metrics; m.BadProbes != 1 || m.GoodProbes != 0 || m.RTTMs != 100 || m.ProbedAt != now.Unix() {
+		t.Errorf("metrics = %+v", m)
+	}
+}
+
+func TestEngineHealthChanged(t *testing.T) {
+	e := newStubEngine()
+	e.healthInterval = time.Millisecond
+	e.SetHealthThresholds(HealthThresholds{FailedProbes: 2, RTTMs: 1000, RecoveryProbes: 2})
+	var failing atomic.Bool
+	failing.Store(true)
+	e.probeDelay = func(context.Context, string) (int64, error) {
+		if failing.Load() {
+			return 0, errors.New("timeout")
+		}
+		return 40, nil
+	}
+	changes := make(chan SessionHealth, 4)
+	e.stateMachine.OnHealthChanged(func(h SessionHealth) { changes <- h })
+
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+
+	next := func() SessionHealth {
+		t.Helper()
+		select {
+		case h := <-changes:
+			return h
+		case <-time.After(2 * time.Second):
+			t.Fatal("no health change reported")
+		}
+		return SessionHealth{}
+	}
+	if h := next(); h.Healthy || h.Reason != HealthProbeFailed {
+		t.Errorf("degraded = %+v", h)
+	}
+	if e.stateMachine.State() != StateConnected {
+		t.Errorf("state = %s, want connected while degraded", e.stateMachine.State())
+	}
+	if h, ok := e.Health(); !ok || h.Healthy {
+		t.Errorf("Health = %+v, %v", h, ok)
+	}
+	failing.Store(false)
+	if h := next(); !h.Healthy || h.Reason != "" || h.Metrics.RTTMs != 40 {
+		t.Errorf("recovered = %+v", h)
+	}
+}
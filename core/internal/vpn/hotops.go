@@ -0,0 +1,208 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Hot operations change a running session in place. sing-box takes no new
+// config once started; what the Clash API can still do is switch selector
+// outbounds, close connections so they are routed anew, and reset the
+// network, which drops the DNS cache. Route rules, DNS servers and the
+// like only change with a new config, so an operation that needs one is
+// recorded as pending and listed by PendingChanges until the next connect.
+// vpn.reconnect keeps the session's config and does not apply them.
+const (
+	HotSelect           = "select"           // select Outbound in the Selector outbound
+	HotCloseConnections = "closeConnections" // close the connections through Outbound, all when empty
+	HotFlushDNS         = "flushDNS"         // drop the DNS cache; closes every connection too
+	HotReconnect        = "reconnect"        // needs a new config; always pending
+)
+
+// Why an operation was not applied live.
+const (
+	HotReasonNotConnected = "not_connected" // the next connect uses the change anyway
+	HotReasonNeedsConfig  = "needs_config"  // sing-box cannot change it while running
+	HotReasonNoSelector   = "no_selector"   // the session has no such selector outbound
+	HotReasonFailed       = "api_failed"    // the Clash API call failed; see Error
+)
+
+// ChangeSplitTunnel is the pending change of a split tunnel config stored
+// while connected.
+const ChangeSplitTunnel = "splitTunnel"
+
+// HotOp is one operation on the running session. Change names the setting
+// it is for, as PendingChanges lists it when it cannot be applied live.
+type HotOp struct {
+	Kind     string
+	Change   string
+	Selector string
+	Outbound string
+}
+
+// HotResult is the outcome of a HotOp: applied in the running session,
+// pending until the next connect, or neither while disconnected.
+type HotResult struct {
+	Op      string `json:"op"`
+	Change  string `json:"change"`
+	Applied bool   `json:"applied"`
+	Pending bool   `json:"pending"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Closed  int    `json:"closed,omitempty"` // connections closed by HotCloseConnections
+}
+
+// hotClient sends hot operations to the Clash API at base.
+type hotClient struct {
+	client *http.Client
+	base   func() string // replaced in tests
+}
+
+func newHotClient(base func() string) *hotClient {
+	return &hotClient{client: newClashClient(2 * time.Second), base: base}
+}
+
+// do sends a request with a JSON body, if set, and fails unless the
+// response is 204 No Content. It returns the status for the caller to
+// tell missing outbounds apart.
+func (c *hotClient) do(ctx context.Context, method, path, secret string, body interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base()+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return resp.StatusCode, fmt.Errorf("clash API: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// ApplyHot runs ops against the running session in order and reports each
+// one. Operations that cannot be applied live are added to
+// PendingChanges; while disconnected nothing is pending, as the next
+// connect builds its config from the current settings.
+func (e *Engine) ApplyHot(ctx context.Context, ops ...HotOp) []HotResult {
+	e.mu.Lock()
+	connected := e.box != nil
+	session := e.session
+	secret := e.clashSecret
+	e.mu.Unlock()
+
+	results := make([]HotResult, 0, len(ops))
+	for _, op := range ops {
+		result := HotResult{Op: op.Kind, Change: op.Change}
+		if !connected {
+			result.Reason = HotReasonNotConnected
+		} else {
+			e.applyHot(ctx, secret, op, &result)
+		}
+		results = append(results, result)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// A session started meanwhile was built with the changes already.
+	if e.box == nil || e.session != session {
+		for i := range results {
+			results[i].Pending = false
+		}
+		return results
+	}
+	for _, r := range results {
+		if r.Pending && !contains(e.pendingChanges, r.Change) {
+			e.pendingChanges = append(e.pendingChanges, r.Change)
+		}
+	}
+	return results
+}
+
+// applyHot runs op against the Clash API and fills in result.
+func (e *Engine) applyHot(ctx context.Context, secret string, op HotOp, result *HotResult) {
+	var err error
+	switch op.Kind {
+	case HotSelect:
+		var status int
+		status, err = e.hot.do(ctx, http.MethodPut, "/proxies/"+url.PathEscape(op.Selector), secret,
+			map[string]string{"name": op.Outbound})
+		// sing-box answers 404 for an unknown outbound and 400 for one that
+		// is not a selector or lacks the choice.
+		if status == http.StatusNotFound || status == http.StatusBadRequest {
+			result.Pending = true
+			result.Reason = HotReasonNoSelector
+			return
+		}
+	case HotCloseConnections:
+		result.Closed, err = e.closeConnections(ctx, secret, op.Outbound)
+	case HotFlushDNS:
+		// The only Clash API call that resets the DNS cache also closes
+		// every connection.
+		_, err = e.hot.do(ctx, http.MethodDelete, "/connections", secret, nil)
+	default:
+		result.Pending = true
+		result.Reason = HotReasonNeedsConfig
+		return
+	}
+	if err != nil {
+		result.Pending = true
+		result.Reason = HotReasonFailed
+		result.Error = err.Error()
+		return
+	}
+	result.Applied = true
+}
+
+// closeConnections closes the open connections whose chain includes
+// outbound, or all of them when it is empty, and returns how many it
+// closed.
+func (e *Engine) closeConnections(ctx context.Context, secret, outbound string) (int, error) {
+	conns, err := fetchConnections(ctx, e.hot.client, e.hot.base(), secret)
+	if err != nil {
+		return 0, err
+	}
+	closed := 0
+	for _, c := range conns.Connections {
+		if outbound != "" && !contains(c.Chains, outbound) {
+			continue
+		}
+		if _, err := e.hot.do(ctx, http.MethodDelete, "/connections/"+url.PathEscape(c.ID), secret, nil); err != nil {
+			return closed, err
+		}
+		closed++
+	}
+	return closed, nil
+}
+
+// PendingChanges lists the changes made during the session that take
+// effect on the next connect, in the order they were first made.
+func (e *Engine) PendingChanges() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil {
+		return nil
+	}
+	return append([]string(nil), e.pendingChanges...)
+}
@@ -0,0 +1,229 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeClashAPI serves the Clash API calls hot operations make: a
+// "select" selector outbound choosing among "proxy" and "direct", and two
+// open connections, one through each.
+type fakeClashAPI struct {
+	mu       sync.Mutex
+	selected string
+	conns    []clashConnection
+	flushes  int
+	broken   bool // fail every call
+	calls    []string
+}
+
+func newFakeClashAPI(t *testing.T, e *Engine) *fakeClashAPI {
+	api := &fakeClashAPI{
+		selected: "proxy",
+		conns:    []clashConnection{proxyConn("p1", "", 0, 0), directConn("d1", 0, 0)},
+	}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	e.hot.base = func() string { return srv.URL }
+	return api
+}
+
+func (api *fakeClashAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.calls = append(api.calls, r.Method+" "+r.URL.Path)
+	if api.broken {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/proxies/select":
+		var body struct{ Name string }
+		if json.NewDecoder(r.Body).Decode(&body) != nil || (body.Name != "proxy" && body.Name != "direct") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		api.selected = body.Name
+	case r.Method == http.MethodGet && r.URL.Path == "/connections":
+		json.NewEncoder(w).Encode(clashConnections{Connections: api.conns})
+		return
+	case r.Method == http.MethodDelete && r.URL.Path == "/connections":
+		api.conns = nil
+		api.flushes++
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/connections/"):
+		id := strings.TrimPrefix(r.URL.Path, "/connections/")
+		for i, c := range api.conns {
+			if c.ID == id {
+				api.conns = append(api.conns[:i], api.conns[i+1:]...)
+				break
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func connectStub(t *testing.T, e *Engine) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Disconnect() })
+}
+
+func TestApplyHot(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      HotOp
+		applied bool
+		reason  string
+		closed  int
+		check   func(t *testing.T, api *fakeClashAPI)
+	}{
+		{
+			name:    "select",
+			op:      HotOp{Kind: HotSelect, Change: "server", Selector: "select", Outbound: "direct"},
+			applied: true,
+			check: func(t *testing.T, api *fakeClashAPI) {
+				if api.selected != "direct" {
+					t.Errorf("selected %q", api.selected)
+				}
+			},
+		},
+		{
+			name:   "select without such selector",
+			op:     HotOp{Kind: HotSelect, Change: "server", Selector: "auto", Outbound: "direct"},
+			reason: HotReasonNoSelector,
+		},
+		{
+			name:   "select a missing outbound",
+			op:     HotOp{Kind: HotSelect, Change: "server", Selector: "select", Outbound: "other"},
+			reason: HotReasonNoSelector,
+		},
+		{
+			name:    "close connections through an outbound",
+			op:      HotOp{Kind: HotCloseConnections, Change: "rateLimit", Outbound: "proxy"},
+			applied: true,
+			closed:  1,
+			check: func(t *testing.T, api *fakeClashAPI) {
+				if len(api.conns) != 1 || api.conns[0].ID != "d1" {
+					t.Errorf("open connections %+v", api.conns)
+				}
+			},
+		},
+		{
+			name:    "close all connections",
+			op:      HotOp{Kind: HotCloseConnections, Change: "rateLimit"},
+			applied: true,
+			closed:  2,
+		},
+		{
+			name:    "flush DNS",
+			op:      HotOp{Kind: HotFlushDNS, Change: "dns"},
+			applied: true,
+			check: func(t *testing.T, api *fakeClashAPI) {
+				if api.flushes != 1 {
+					t.Errorf("%d flushes", api.flushes)
+				}
+			},
+		},
+		{
+			name:   "rule change",
+			op:     HotOp{Kind: HotReconnect, Change: ChangeBuiltinBypasses},
+			reason: HotReasonNeedsConfig,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newStubEngine()
+			api := newFakeClashAPI(t, e)
+			connectStub(t, e)
+
+			results := e.ApplyHot(context.Background(), tt.op)
+			if len(results) != 1 {
+				t.Fatalf("%d results", len(results))
+			}
+			r := results[0]
+			if r.Applied != tt.applied || r.Pending == tt.applied || r.Reason != tt.reason || r.Closed != tt.closed {
+				t.Errorf("result %+v", r)
+			}
+			var wantPending []string
+			if !tt.applied {
+				wantPending = []string{tt.op.Change}
+			}
+			if got := e.PendingChanges(); !reflect.DeepEqual(got, wantPending) {
+				t.Errorf("pending changes %v, want %v", got, wantPending)
+			}
+			if tt.check != nil {
+				tt.check(t, api)
+			}
+		})
+	}
+}
+
+func TestApplyHotAPIFailure(t *testing.T) {
+	e := newStubEngine()
+	api := newFakeClashAPI(t, e)
+	api.broken = true
+	connectStub(t, e)
+
+	results := e.ApplyHot(context.Background(),
+		HotOp{Kind: HotSelect, Change: "server", Selector: "select", Outbound: "direct"},
+		HotOp{Kind: HotCloseConnections, Change: "rateLimit"},
+		HotOp{Kind: HotFlushDNS, Change: "dns"},
+		HotOp{Kind: HotFlushDNS, Change: "dns"},
+	)
+	for _, r := range results {
+		if r.Applied || !r.Pending || r.Reason != HotReasonFailed || r.Error == "" {
+			t.Errorf("%s: %+v", r.Op, r)
+		}
+	}
+	// A change made twice is listed once.
+	if got, want := e.PendingChanges(), []string{"server", "rateLimit", "dns"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pending changes %v, want %v", got, want)
+	}
+}
+
+func TestPendingChangesLastUntilConnect(t *testing.T) {
+	e := newStubEngine()
+	api := newFakeClashAPI(t, e)
+
+	// Disconnected, the next connect picks the change up.
+	r := e.ApplyHot(context.Background(), HotOp{Kind: HotReconnect, Change: ChangeLogLevel})
+	if r[0].Applied || r[0].Pending || r[0].Reason != HotReasonNotConnected {
+		t.Errorf("while disconnected: %+v", r[0])
+	}
+	if len(api.calls) != 0 {
+		t.Errorf("Clash API called while disconnected: %v", api.calls)
+	}
+
+	connectStub(t, e)
+	e.ApplyHot(context.Background(), HotOp{Kind: HotReconnect, Change: ChangeLogLevel})
+	if err := e.Reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.PendingChanges(); !reflect.DeepEqual(got, []string{ChangeLogLevel}) {
+		t.Errorf("after a reconnect: %v", got)
+	}
+	if err := e.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.PendingChanges(); got != nil {
+		t.Errorf("after disconnecting: %v", got)
+	}
+	connectStub(t, e)
+	if got := e.PendingChanges(); got != nil {
+		t.Errorf("after a new connect: %v", got)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package vpn
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// errNoIfaceAPI is returned by ifaceAPI calls where the platform has no
+// IP Helper API. The service only ships for Windows; builds elsewhere are
+// for development and tests, and connect there reports hardening as
+// failed.
+var errNoIfaceAPI = errors.New("adapter settings are only supported on Windows")
+
+// newIfaceAPI returns the ifaceAPI of this platform.
+func newIfaceAPI() ifaceAPI {
+	return noIfaceAPI{}
+}
+
+// noIfaceAPI implements ifaceAPI by failing every call.
+type noIfaceAPI struct{}
+
+func (noIfaceAPI) interfaceIndex(string) (uint32, error)        { return 0, errNoIfaceAPI }
+func (noIfaceAPI) metric(uint16, uint32) (uint32, bool, error)  { return 0, false, errNoIfaceAPI }
+func (noIfaceAPI) setMetric(uint16, uint32, uint32, bool) error { return errNoIfaceAPI }
+func (noIfaceAPI) dnsRegistration(string) (bool, error)         { return false, errNoIfaceAPI }
+func (noIfaceAPI) setDNSRegistration(string, bool) error        { return errNoIfaceAPI }
+func (noIfaceAPI) setDNSServers(string, []string) error         { return errNoIfaceAPI }
+func (noIfaceAPI) bestInterface(netip.Addr) (uint32, error)     { return 0, errNoIfaceAPI }
+func (noIfaceAPI) interfaceLUID(string) (uint64, error)         { return 0, errNoIfaceAPI }
+func (noIfaceAPI) octets(uint64) (uint64, uint64, error)        { return 0, 0, errNoIfaceAPI }
@@ -0,0 +1,154 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modiphlpapi                     = windows.NewLazySystemDLL("iphlpapi.dll")
+	procInitializeIpInterfaceEntry  = modiphlpapi.NewProc("InitializeIpInterfaceEntry")
+	procGetIpInterfaceEntry         = modiphlpapi.NewProc("GetIpInterfaceEntry")
+	procSetIpInterfaceEntry         = modiphlpapi.NewProc("SetIpInterfaceEntry")
+	procConvertInterfaceAliasToLuid = modiphlpapi.NewProc("ConvertInterfaceAliasToLuid")
+)
+
+// newIfaceAPI returns the ifaceAPI of this platform.
+func newIfaceAPI() ifaceAPI {
+	return winIfaceAPI{}
+}
+
+// winIfaceAPI implements ifaceAPI with the IP Helper API for metrics and
+// the DnsClient PowerShell module for DNS settings.
+type winIfaceAPI struct{}
+
+func (winIfaceAPI) interfaceIndex(name string) (uint32, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(iface.Index), nil
+}
+
+func (winIfaceAPI) interfaceLUID(name string) (uint64, error) {
+	alias, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	var luid uint64
+	r, _, _ := procConvertInterfaceAliasToLuid.Call(uintptr(unsafe.Pointer(alias)), uintptr(unsafe.Pointer(&luid)))
+	if r != 0 {
+		return 0, fmt.Errorf("ConvertInterfaceAliasToLuid: %w", windows.Errno(r))
+	}
+	return luid, nil
+}
+
+func (winIfaceAPI) octets(luid uint64) (uint64, uint64, error) {
+	row := windows.MibIfRow2{InterfaceLuid: luid}
+	if err := windows.GetIfEntry2Ex(windows.MibIfEntryNormal, &row); err != nil {
+		return 0, 0, fmt.Errorf("GetIfEntry2Ex: %w", err)
+	}
+	return row.InOctets, row.OutOctets, nil
+}
+
+func (winIfaceAPI) row(family uint16, index uint32) (*windows.MibIpInterfaceRow, error) {
+	var row windows.MibIpInterfaceRow
+	procInitializeIpInterfaceEntry.Call(uintptr(unsafe.Pointer(&row)))
+	row.Family = family
+	row.InterfaceIndex = index
+	r, _, _ := procGetIpInterfaceEntry.Call(uintptr(unsafe.Pointer(&row)))
+	switch windows.Errno(r) {
+	case 0:
+		return &row, nil
+	case windows.ERROR_NOT_FOUND:
+		return nil, errFamilyUnavailable
+	default:
+		return nil, fmt.Errorf("GetIpInterfaceEntry: %w", windows.Errno(r))
+	}
+}
+
+func (a winIfaceAPI) metric(family uint16, index uint32) (uint32, bool, error) {
+	row, err := a.row(family, index)
+	if err != nil {
+		return 0, false, err
+	}
+	return row.Metric, row.UseAutomaticMetric != 0, nil
+}
+
+func (winIfaceAPI) bestInterface(dst netip.Addr) (uint32, error) {
+	var sa windows.Sockaddr
+	if dst.Is4() {
+		sa = &windows.SockaddrInet4{Addr: dst.As4()}
+	} else {
+		sa = &windows.SockaddrInet6{Addr: dst.As16()}
+	}
+	var index uint32
+	if err := windows.GetBestInterfaceEx(sa, &index); err != nil {
+		return 0, fmt.Errorf("GetBestInterfaceEx: %w", err)
+	}
+	return index, nil
+}
+
+func (a winIfaceAPI) setMetric(family uint16, index uint32, metric uint32, automatic bool) error {
+	row, err := a.row(family, index)
+	if err != nil {
+		return err
+	}
+	row.Metric = metric
+	row.UseAutomaticMetric = 0
+	if automatic {
+		row.UseAutomaticMetric = 1
+	}
+	// SetIpInterfaceEntry rejects IPv4 rows with a site prefix length.
+	if family == afInet {
+		row.SitePrefixLength = 0
+	}
+	if r, _, _ := procSetIpInterfaceEntry.Call(uintptr(unsafe.Pointer(row))); r != 0 {
+		return fmt.Errorf("SetIpInterfaceEntry: %w", windows.Errno(r))
+	}
+	return nil
+}
+
+func (winIfaceAPI) dnsRegistration(name string) (bool, error) {
+	out, err := runPowerShell(fmt.Sprintf(`(Get-DnsClient -InterfaceAlias '%s').RegisterThisConnectionsAddress`, name))
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(out, "True"), nil
+}
+
+func (winIfaceAPI) setDNSRegistration(name string, enabled bool) error {
+	value := "$false"
+	if enabled {
+		value = "$true"
+	}
+	_, err := runPowerShell(fmt.Sprintf(`Set-DnsClient -InterfaceAlias '%s' -RegisterThisConnectionsAddress %s`, name, value))
+	return err
+}
+
+func (winIfaceAPI) setDNSServers(name string, servers []string) error {
+	script := fmt.Sprintf(`Set-DnsClientServerAddress -InterfaceAlias '%s' -ResetServerAddresses`, name)
+	if len(servers) > 0 {
+		script = fmt.Sprintf(`Set-DnsClientServerAddress -InterfaceAlias '%s' -ServerAddresses '%s'`, name, strings.Join(servers, "','"))
+	}
+	_, err := runPowerShell(script)
+	return err
+}
+
+func runPowerShell(script string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-Command", script).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%w (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
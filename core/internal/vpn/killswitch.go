@@ -0,0 +1,122 @@
+package vpn
+
+import "time"
+
+// killSwitchStallAfter is how long proxied traffic can go unanswered
+// before the kill switch counts as engaged.
+const killSwitchStallAfter = 10 * time.Second
+
+// KillSwitchListener is a callback invoked the first time the kill switch
+// engages in a session.
+type KillSwitchListener func(stats KillSwitchStats)
+
+// KillSwitchStats accounts for the kill switch holding traffic in the
+// tunnel during a session.
+//
+// With the kill switch on, strict routing keeps traffic in the TUN adapter
+// even when the proxy stops answering, where it would otherwise find its
+// way out another interface. The kill switch counts as engaged from the
+// first proxied traffic the proxy leaves unanswered, once no proxied
+// download has arrived for killSwitchStallAfter and apps are still
+// sending or opening connections. It disengages when proxied download
+// resumes. An idle machine never engages it.
+//
+// This is inferred from Clash API polls, so episodes shorter than the
+// stall threshold go uncounted and times are accurate to a poll interval.
+type KillSwitchStats struct {
+	Activations        int       // engagements this session
+	LastActivation     time.Time // zero if none
+	Engaged            bool      // the proxy is not answering now
+	ProtectedSeconds   int64     // total time engaged, including the current episode
+	BlockedConnections int       // proxied connections opened while the proxy was not answering
+}
+
+// killSwitchMonitor infers kill switch engagement from successive stats
+// polls of one session.
+type killSwitchMonitor struct {
+	stats        KillSwitchStats
+	lastUpload   int64
+	lastDownload int64
+	seen         map[string]bool // proxied connection IDs in the last poll
+	waitingSince time.Time       // first unanswered traffic since the last download
+	pending      int             // connections opened since waitingSince
+	engagedAt    time.Time
+}
+
+func newKillSwitchMonitor() *killSwitchMonitor {
+	return &killSwitchMonitor{seen: make(map[string]bool)}
+}
+
+// observe updates the accounting with a poll taken at now. It reports true
+// when the kill switch engages for the first time in the session.
+func (m *killSwitchMonitor) observe(now time.Time, traffic Traffic, conns []clashConnection) bool {
+	opened := 0
+	seen := make(map[string]bool, len(m.seen))
+	for i := range conns {
+		if !isProxyChain(conns[i].Chains) {
+			continue
+		}
+		seen[conns[i].ID] = true
+		if !m.seen[conns[i].ID] {
+			opened++
+		}
+	}
+	m.seen = seen
+
+	answered := traffic.Download > m.lastDownload
+	sending := opened > 0 || traffic.Upload > m.lastUpload
+	m.lastUpload, m.lastDownload = traffic.Upload, traffic.Download
+
+	if answered {
+		if m.stats.Engaged {
+			m.stats.ProtectedSeconds += int64(now.Sub(m.engagedAt) / time.Second)
+			m.stats.Engaged = false
+		}
+		m.waitingSince = time.Time{}
+		m.pending = 0
+		return false
+	}
+	if m.stats.Engaged {
+		m.stats.BlockedConnections += opened
+		return false
+	}
+	if m.waitingSince.IsZero() {
+		if !sending {
+			return false
+		}
+		m.waitingSince = now
+	}
+	m.pending += opened
+	if !sending || now.Sub(m.waitingSince) < killSwitchStallAfter {
+		return false
+	}
+
+	m.stats.Engaged = true
+	m.stats.Activations++
+	m.stats.LastActivation = now
+	m.stats.BlockedConnections += m.pending
+	m.engagedAt = m.waitingSince
+	m.pending = 0
+	return m.stats.Activations == 1
+}
+
+// snapshot returns the stats as of now.
+func (m *killSwitchMonitor) snapshot(now time.Time) KillSwitchStats {
+	s := m.stats
+	if s.Engaged {
+		s.ProtectedSeconds += int64(now.Sub(m.engagedAt) / time.Second)
+	}
+	return s
+}
+
+// KillSwitch returns the kill switch accounting of the current session, or
+// nil if there is no session or its kill switch is off.
+func (e *Engine) KillSwitch() *KillSwitchStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil || e.killSwitch == nil {
+		return nil
+	}
+	s := e.killSwitch.snapshot(time.Now())
+	return &s
+}
@@ -0,0 +1,112 @@
+package vpn
+
+import (
+	"testing"
+	"time"
+)
+
+// ksPoll is one simulated stats poll: proxied totals and the IDs of the
+// open proxied connections.
+type ksPoll struct {
+	upload, download int64
+	conns            []string
+}
+
+func runKillSwitchPolls(m *killSwitchMonitor, start time.Time, every time.Duration, polls []ksPoll) (firsts []int) {
+	for i, p := range polls {
+		var conns []clashConnection
+		for _, id := range p.conns {
+			conns = append(conns, proxyConn(id, "", 0, 0))
+		}
+		conns = append(conns, directConn("direct-"+p.conns[0], 0, 0))
+		if m.observe(start.Add(time.Duration(i)*every), Traffic{Upload: p.upload, Download: p.download}, conns) {
+			firsts = append(firsts, i)
+		}
+	}
+	return firsts
+}
+
+func TestKillSwitchEngagesWhenProxyStalls(t *testing.T) {
+	m := newKillSwitchMonitor()
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	firsts := runKillSwitchPolls(m, start, time.Second, []ksPoll{
+		{100, 1000, []string{"a"}}, // 0: healthy
+		{200, 1000, []string{"a", "b"}},
+		{300, 1000, []string{"a", "b", "c"}},
+		{300, 1000, []string{"a", "b", "c"}},
+		{400, 1000, []string{"b", "c", "d"}},
+		{500, 1000, []string{"e"}},
+		{600, 1000, []string{"e"}},
+		{700, 1000, []string{"e"}},
+		{800, 1000, []string{"e"}},
+		{900, 1000, []string{"e"}},
+		{950, 1000, []string{"e"}},
+		{960, 1000, []string{"e", "f"}}, // 11: 10s after the first unanswered poll
+		{970, 1000, []string{"g"}},
+		{980, 5000, []string{"g"}}, // 13: the proxy answers again
+		{990, 6000, []string{"g"}},
+	})
+	if len(firsts) != 1 || firsts[0] != 11 {
+		t.Fatalf("first activation reported at polls %v, want [11]", firsts)
+	}
+	s := m.snapshot(start.Add(20 * time.Second))
+	if s.Engaged || s.Activations != 1 || !s.LastActivation.Equal(start.Add(11*time.Second)) {
+		t.Errorf("stats = %+v", s)
+	}
+	// Held from poll 1 to poll 13.
+	if s.ProtectedSeconds != 12 {
+		t.Errorf("ProtectedSeconds = %d, want 12", s.ProtectedSeconds)
+	}
+	// b, c, d, e and f opened while waiting, g while engaged.
+	if s.BlockedConnections != 6 {
+		t.Errorf("BlockedConnections = %d, want 6", s.BlockedConnections)
+	}
+}
+
+func TestKillSwitchIdleNeverEngages(t *testing.T) {
+	m := newKillSwitchMonitor()
+	start := time.Now()
+	var polls []ksPoll
+	for i := 0; i < 60; i++ {
+		polls = append(polls, ksPoll{100, 1000, []string{"keepalive"}})
+	}
+	if firsts := runKillSwitchPolls(m, start, time.Second, polls); len(firsts) != 0 {
+		t.Errorf("activation reported at polls %v while idle", firsts)
+	}
+	// A lone unanswered send followed by silence is not a stall either.
+	polls = []ksPoll{{200, 1000, []string{"keepalive"}}}
+	for i := 0; i < 20; i++ {
+		polls = append(polls, ksPoll{200, 1000, []string{"keepalive"}})
+	}
+	runKillSwitchPolls(m, start.Add(time.Minute), time.Second, polls)
+	if s := m.snapshot(start.Add(2 * time.Minute)); s.Activations != 0 || s.Engaged {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestKillSwitchCountsEachEpisode(t *testing.T) {
+	m := newKillSwitchMonitor()
+	start := time.Now()
+	// Each episode is an answered poll followed by four unanswered ones.
+	var polls []ksPoll
+	for ep := int64(1); ep <= 3; ep++ {
+		polls = append(polls, ksPoll{ep * 10, ep * 1000, []string{"x"}})
+		for i := int64(1); i <= 4; i++ {
+			polls = append(polls, ksPoll{ep*10 + i, ep * 1000, []string{"x"}})
+		}
+	}
+
+	// Low power mode polls every 5 seconds.
+	firsts := runKillSwitchPolls(m, start, 5*time.Second, polls)
+	if len(firsts) != 1 || firsts[0] != 3 {
+		t.Errorf("first activation reported at polls %v, want [3]", firsts)
+	}
+	s := m.snapshot(start.Add(time.Duration(len(polls)-1) * 5 * time.Second))
+	if s.Activations != 3 || !s.Engaged {
+		t.Errorf("stats = %+v, want 3 activations and engaged", s)
+	}
+	// 20s in each of the first two episodes, 15s so far in the third.
+	if s.ProtectedSeconds != 55 {
+		t.Errorf("ProtectedSeconds = %d, want 55", s.ProtectedSeconds)
+	}
+}
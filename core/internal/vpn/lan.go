@@ -0,0 +1,179 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+)
+
+// DefaultLANPort is the LAN sharing port used when none is given.
+const DefaultLANPort = 7890
+
+// tagLANIn is the tag of the LAN sharing inbound.
+const tagLANIn = "lan-in"
+
+var (
+	// ErrLANCredentials is returned when LAN sharing is requested without a
+	// username and password; an open proxy on the LAN is never created.
+	ErrLANCredentials = errors.New("LAN sharing requires a username and password")
+
+	// ErrNoLANAddress is returned when no LAN address was given and none
+	// could be found.
+	ErrNoLANAddress = errors.New("no LAN address found")
+)
+
+// LANShare configures LAN sharing, which lets devices on the local
+// network, such as a console or a TV, use the tunnel through an
+// authenticated mixed (SOCKS5 and HTTP) proxy inbound bound to this
+// machine's LAN address.
+//
+// There is no routing or NAT for other devices: a device only uses the
+// tunnel when its proxy settings point at the endpoint, and devices that
+// cannot be configured with a proxy are not covered. Everything arriving on
+// the inbound goes through the proxy, whatever the split tunnel mode, since
+// process and domain rules describe this machine's traffic.
+//
+// The port is opened in Windows Firewall for the local subnet while the
+// tunnel is up.
+type LANShare struct {
+	Listen   string // IPv4 address of the LAN interface to bind
+	Port     int
+	Username string
+	Password string
+}
+
+// Validate checks the settings. A missing port defaults to DefaultLANPort.
+func (s *LANShare) Validate() error {
+	if s.Username == "" || s.Password == "" {
+		return ErrLANCredentials
+	}
+	if s.Port == 0 {
+		s.Port = DefaultLANPort
+	}
+	if s.Port < 1024 || s.Port > 65535 {
+		return fmt.Errorf("LAN port must be between 1024 and 65535")
+	}
+	addr, err := netip.ParseAddr(s.Listen)
+	if err != nil || !isLANAddr(addr) {
+		return fmt.Errorf("LAN address %q is not a private IPv4 address", s.Listen)
+	}
+	return nil
+}
+
+// isLANAddr reports whether addr is a private IPv4 address, as a home or
+// office LAN uses.
+func isLANAddr(addr netip.Addr) bool {
+	return addr.Is4() && addr.IsPrivate()
+}
+
+// LANAddress returns the private IPv4 address of this machine's LAN
+// interface, ignoring the tunnel adapter of inst.
+func LANAddress(inst instance.Instance) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	var addrs []net.Addr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Name == inst.InterfaceName() {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, ifaceAddrs...)
+	}
+	return pickLANAddress(addrs)
+}
+
+// pickLANAddress returns the first private IPv4 address in addrs.
+func pickLANAddress(addrs []net.Addr) (string, error) {
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if ok && isLANAddr(addr.Unmap()) {
+			return addr.Unmap().String(), nil
+		}
+	}
+	return "", ErrNoLANAddress
+}
+
+// buildLANInbound returns the mixed inbound for LAN sharing.
+func buildLANInbound(s *LANShare, sniff bool) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "mixed",
+		"tag":         tagLANIn,
+		"listen":      s.Listen,
+		"listen_port": s.Port,
+		"users": []interface{}{
+			map[string]interface{}{"username": s.Username, "password": s.Password},
+		},
+		"sniff":                      sniff,
+		"sniff_override_destination": sniff,
+	}
+}
+
+// LANClient is a LAN device with open connections through the LAN sharing
+// inbound.
+type LANClient struct {
+	IP          string
+	Connections int
+}
+
+// lanClients groups the connections that arrived on the LAN sharing
+// inbound by source address, sorted by address.
+func lanClients(conns []clashConnection) []LANClient {
+	counts := make(map[string]int)
+	for i := range conns {
+		m := &conns[i].Metadata
+		// The Clash API reports the inbound as "type/tag".
+		if !strings.HasSuffix(m.Type, "/"+tagLANIn) {
+			continue
+		}
+		addr, err := netip.ParseAddr(m.SourceIP)
+		if err != nil {
+			continue
+		}
+		counts[addr.Unmap().String()]++
+	}
+	clients := make([]LANClient, 0, len(counts))
+	for ip, n := range counts {
+		clients = append(clients, LANClient{IP: ip, Connections: n})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return netip.MustParseAddr(clients[i].IP).Less(netip.MustParseAddr(clients[j].IP))
+	})
+	return clients
+}
+
+// LAN returns the LAN sharing settings of the current session, or nil if
+// LAN sharing is off or there is no session.
+func (e *Engine) LAN() *LANShare {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil || e.config.LAN == nil {
+		return nil
+	}
+	s := *e.config.LAN
+	return &s
+}
+
+// LANClients returns the LAN devices using the tunnel as of the last stats
+// poll.
+func (e *Engine) LANClients() []LANClient {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil {
+		return nil
+	}
+	return append([]LANClient(nil), e.lanClients...)
+}
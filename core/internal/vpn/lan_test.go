@@ -0,0 +1,147 @@
+package vpn
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+)
+
+func TestLANShareValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		share   LANShare
+		wantErr string
+	}{
+		{"ok", LANShare{Listen: "192.168.1.20", Port: 1080, Username: "u", Password: "p"}, ""},
+		{"no password", LANShare{Listen: "192.168.1.20", Username: "u"}, "username and password"},
+		{"no username", LANShare{Listen: "192.168.1.20", Password: "p"}, "username and password"},
+		{"privileged port", LANShare{Listen: "10.0.0.2", Port: 80, Username: "u", Password: "p"}, "between 1024 and 65535"},
+		{"public address", LANShare{Listen: "8.8.8.8", Username: "u", Password: "p"}, "not a private IPv4 address"},
+		{"wildcard address", LANShare{Listen: "0.0.0.0", Username: "u", Password: "p"}, "not a private IPv4 address"},
+		{"ipv6 address", LANShare{Listen: "fd00::1", Username: "u", Password: "p"}, "not a private IPv4 address"},
+	}
+	for _, tt := range tests {
+		err := tt.share.Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	s := LANShare{Listen: "172.16.0.5", Username: "u", Password: "p"}
+	if err := s.Validate(); err != nil || s.Port != DefaultLANPort {
+		t.Errorf("default port: err = %v, port = %d", err, s.Port)
+	}
+	if err := (&LANShare{Listen: "172.16.0.5"}).Validate(); !errors.Is(err, ErrLANCredentials) {
+		t.Errorf("missing credentials: err = %v, want ErrLANCredentials", err)
+	}
+}
+
+func TestPickLANAddress(t *testing.T) {
+	ipNet := func(s string) net.Addr {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.IP = ip
+		return n
+	}
+	got, err := pickLANAddress([]net.Addr{
+		ipNet("fe80::1/64"), ipNet("100.64.0.1/10"), ipNet("192.168.0.14/24"), ipNet("10.0.0.3/8"),
+	})
+	if err != nil || got != "192.168.0.14" {
+		t.Errorf("pickLANAddress = %q, %v", got, err)
+	}
+	if _, err := pickLANAddress([]net.Addr{ipNet("203.0.113.7/24")}); !errors.Is(err, ErrNoLANAddress) {
+		t.Errorf("no private address: err = %v", err)
+	}
+}
+
+func TestLANClients(t *testing.T) {
+	conn := func(typ, src string) clashConnection {
+		var c clashConnection
+		c.Metadata.Type = typ
+		c.Metadata.SourceIP = src
+		return c
+	}
+	got := lanClients([]clashConnection{
+		conn("mixed/lan-in", "192.168.1.30"),
+		conn("tun/tun-in", "172.19.0.1"),
+		conn("mixed/lan-in", "192.168.1.4"),
+		conn("mixed/lan-in", "::ffff:192.168.1.30"),
+		conn("mixed/lan-in", ""),
+	})
+	want := []LANClient{{IP: "192.168.1.4", Connections: 1}, {IP: "192.168.1.30", Connections: 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lanClients = %+v, want %+v", got, want)
+	}
+	if got := lanClients(nil); got == nil || len(got) != 0 {
+		t.Errorf("lanClients(nil) = %#v, want empty", got)
+	}
+}
+
+func TestLANFirewallScripts(t *testing.T) {
+	s := &LANShare{Listen: "192.168.1.20", Port: 7890}
+	dev, _ := instance.New("dev")
+	add := lanFirewallScript(s, dev)
+	if n := strings.Count(add, "New-NetFirewallRule"); n != 2 {
+		t.Fatalf("got %d rules, want 2: %s", n, add)
+	}
+	for _, want := range []string{"-LocalAddress 192.168.1.20", "-LocalPort 7890", "-RemoteAddress LocalSubnet",
+		"-Protocol UDP", "-DisplayName 'MRVPN-dev'", "-Group '" + dev.FirewallProvider() + "'"} {
+		if !strings.Contains(add, want) {
+			t.Errorf("add script missing %q: %s", want, add)
+		}
+	}
+	// Removal goes by the provider GUID, not the display name.
+	del := firewallRemoveScript(dev.FirewallProvider())
+	if !strings.Contains(del, "-Group '"+dev.FirewallProvider()+"'") || strings.Contains(del, "MRVPN") {
+		t.Errorf("remove script = %s", del)
+	}
+}
+
+// TestLANInboundAlwaysProxied checks that LAN traffic is routed to the
+// proxy ahead of the split tunnel rules, which describe this machine's
+// traffic only.
+func TestLANInboundAlwaysProxied(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SplitTunnelMode = "app"
+	cfg.SplitTunnelApps = []string{"chrome.exe"}
+	cfg.LAN = &LANShare{Listen: "192.168.1.20", Port: 7890, Username: "u", Password: "p"}
+
+	inbounds := buildInbounds(cfg)
+	if len(inbounds) != 2 {
+		t.Fatalf("got %d inbounds, want 2", len(inbounds))
+	}
+	lan := inbounds[1].(map[string]interface{})
+	if lan["type"] != "mixed" || lan["listen"] != "192.168.1.20" || lan["listen_port"] != 7890 {
+		t.Errorf("lan inbound = %v", lan)
+	}
+
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lanRule, appRule := -1, -1
+	for i, r := range built.Rules {
+		switch {
+		case r.Label == "inbound: lan-in → proxy":
+			lanRule = i
+		case strings.HasPrefix(r.Label, "split-app"):
+			appRule = i
+		}
+	}
+	if lanRule < 0 || appRule < 0 || lanRule > appRule {
+		t.Errorf("rules = %+v, want the LAN rule before the app rule", built.Rules)
+	}
+}
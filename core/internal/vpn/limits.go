@@ -0,0 +1,145 @@
+package vpn
+
+import "fmt"
+
+// A pathological configuration, with thousands of split domains, rules
+// and outbounds, can make sing-box take tens of seconds and hundreds of
+// megabytes to start, which looks like a hang. BuildSingBoxConfig refuses
+// one over its ConfigLimits instead.
+
+// Names of the config limits, as ConfigLimitError reports them.
+const (
+	LimitRules         = "rules"         // route rules
+	LimitDomainEntries = "domainEntries" // domain, suffix, keyword and regex matchers of route and DNS rules; a plain split domain is two
+	LimitOutbounds     = "outbounds"
+	LimitJSONBytes     = "jsonBytes" // size of the generated JSON
+)
+
+// ConfigLimits bound the configuration BuildSingBoxConfig generates. A
+// zero field uses the default.
+type ConfigLimits struct {
+	MaxRules         int
+	MaxDomainEntries int
+	MaxOutbounds     int
+	MaxJSONBytes     int
+}
+
+// DefaultConfigLimits are generous for real use; a config over them
+// comes from a runaway import or script.
+var DefaultConfigLimits = ConfigLimits{
+	MaxRules:         2000,
+	MaxDomainEntries: 20000,
+	MaxOutbounds:     32,
+	MaxJSONBytes:     2 << 20,
+}
+
+// CeilingConfigLimits are the most limits can be raised to.
+var CeilingConfigLimits = ConfigLimits{
+	MaxRules:         20000,
+	MaxDomainEntries: 500000,
+	MaxOutbounds:     256,
+	MaxJSONBytes:     32 << 20,
+}
+
+// ConfigLimitError reports a generated config over one of its limits.
+type ConfigLimitError struct {
+	Limit  string // a Limit* name
+	Max    int
+	Actual int
+}
+
+func (e *ConfigLimitError) Error() string {
+	return fmt.Sprintf("config too complex: %d %s, %d over the limit of %d", e.Actual, e.Limit, e.Over(), e.Max)
+}
+
+// Over is by how much the config exceeds the limit.
+func (e *ConfigLimitError) Over() int {
+	return e.Actual - e.Max
+}
+
+// limitNames names the fields of values, in order.
+var limitNames = [...]string{LimitRules, LimitDomainEntries, LimitOutbounds, LimitJSONBytes}
+
+func (l ConfigLimits) values() [len(limitNames)]int {
+	return [...]int{l.MaxRules, l.MaxDomainEntries, l.MaxOutbounds, l.MaxJSONBytes}
+}
+
+// WithDefaults returns l with its zero fields set to the defaults.
+func (l ConfigLimits) WithDefaults() ConfigLimits {
+	def := DefaultConfigLimits
+	if l.MaxRules == 0 {
+		l.MaxRules = def.MaxRules
+	}
+	if l.MaxDomainEntries == 0 {
+		l.MaxDomainEntries = def.MaxDomainEntries
+	}
+	if l.MaxOutbounds == 0 {
+		l.MaxOutbounds = def.MaxOutbounds
+	}
+	if l.MaxJSONBytes == 0 {
+		l.MaxJSONBytes = def.MaxJSONBytes
+	}
+	return l
+}
+
+// Validate checks every limit is zero or between 1 and its ceiling.
+func (l ConfigLimits) Validate() error {
+	ceilings := CeilingConfigLimits.values()
+	for i, v := range l.values() {
+		if v < 0 || v > ceilings[i] {
+			return fmt.Errorf("the %s limit must be between 1 and %d", limitNames[i], ceilings[i])
+		}
+	}
+	return nil
+}
+
+// Raised lists the limits set above their defaults, such as
+// "rules 5000 (default 2000)".
+func (l ConfigLimits) Raised() []string {
+	defaults := DefaultConfigLimits.values()
+	var raised []string
+	for i, v := range l.values() {
+		if v > defaults[i] {
+			raised = append(raised, fmt.Sprintf("%s %d (default %d)", limitNames[i], v, defaults[i]))
+		}
+	}
+	return raised
+}
+
+// checkComplexity checks the parts of a config against limits before it
+// is serialized.
+func checkComplexity(limits ConfigLimits, routeRules []interface{}, dns map[string]interface{}, outbounds []interface{}) error {
+	dnsRules, _ := dns["rules"].([]interface{})
+	for _, c := range []struct {
+		name        string
+		max, actual int
+	}{
+		{LimitRules, limits.MaxRules, len(routeRules)},
+		{LimitDomainEntries, limits.MaxDomainEntries, countDomainEntries(routeRules) + countDomainEntries(dnsRules)},
+		{LimitOutbounds, limits.MaxOutbounds, len(outbounds)},
+	} {
+		if c.actual > c.max {
+			return &ConfigLimitError{Limit: c.name, Max: c.max, Actual: c.actual}
+		}
+	}
+	return nil
+}
+
+// countDomainEntries counts the domain matchers of rules, including those
+// of logical rules.
+func countDomainEntries(rules []interface{}) int {
+	n := 0
+	for _, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, key := range []string{"domain", "domain_suffix", "domain_keyword", "domain_regex"} {
+			n += len(stringList(rule[key]))
+		}
+		if nested, ok := rule["rules"].([]interface{}); ok {
+			n += countDomainEntries(nested)
+		}
+	}
+	return n
+}
@@ -0,0 +1,96 @@
+package vpn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// limitsConfig returns a domain split config with n domains.
+func limitsConfig(t *testing.T, n int) *Config {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443?security=tls&sni=example.com")
+	cfg.SplitTunnelMode = "domain"
+	cfg.SplitTunnelInvert = true
+	for i := 0; i < n; i++ {
+		cfg.SplitTunnelDomains = append(cfg.SplitTunnelDomains, fmt.Sprintf("site%d.example.org", i))
+	}
+	return cfg
+}
+
+// TestConfigLimits builds a config right at each limit, which passes, and
+// one over it, which fails naming the limit and by how much.
+func TestConfigLimits(t *testing.T) {
+	base, err := buildConfig(limitsConfig(t, 10), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Outbounds []interface{} `json:"outbounds"`
+	}
+	if err := json.Unmarshal(base.JSON, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		limit   string
+		domains int
+		limits  ConfigLimits // at the limit; one less is over
+		actual  int
+	}{
+		{LimitRules, 10, ConfigLimits{MaxRules: len(base.Rules)}, len(base.Rules)},
+		// A plain domain matches as itself and as a suffix.
+		{LimitDomainEntries, DefaultConfigLimits.MaxDomainEntries / 2, ConfigLimits{MaxDomainEntries: DefaultConfigLimits.MaxDomainEntries}, DefaultConfigLimits.MaxDomainEntries},
+		{LimitOutbounds, 10, ConfigLimits{MaxOutbounds: len(parsed.Outbounds)}, len(parsed.Outbounds)},
+		{LimitJSONBytes, 10, ConfigLimits{MaxJSONBytes: len(base.JSON)}, len(base.JSON)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.limit, func(t *testing.T) {
+			cfg := limitsConfig(t, tt.domains)
+			cfg.Limits = tt.limits
+			if _, err := buildConfig(cfg, "secret"); err != nil {
+				t.Fatalf("at the limit: %v", err)
+			}
+
+			over := tt.limits.values()
+			for i := range over {
+				if over[i] > 0 {
+					over[i]--
+				}
+			}
+			cfg.Limits = ConfigLimits{MaxRules: over[0], MaxDomainEntries: over[1], MaxOutbounds: over[2], MaxJSONBytes: over[3]}
+			_, err := buildConfig(cfg, "secret")
+			var limitErr *ConfigLimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("over the limit: %v", err)
+			}
+			if limitErr.Limit != tt.limit || limitErr.Actual != tt.actual || limitErr.Over() != 1 {
+				t.Errorf("error = %+v, want %s at %d, 1 over", limitErr, tt.limit, tt.actual)
+			}
+			if !strings.Contains(err.Error(), tt.limit) {
+				t.Errorf("message %q does not name the limit", err)
+			}
+		})
+	}
+}
+
+func TestConfigLimitsDefaultsAndValidation(t *testing.T) {
+	cfg := limitsConfig(t, DefaultConfigLimits.MaxDomainEntries/2+1)
+	if _, err := buildConfig(cfg, "secret"); err == nil {
+		t.Error("default domain limit not enforced")
+	}
+	cfg.Limits.MaxDomainEntries = 30000
+	if _, err := buildConfig(cfg, "secret"); err != nil {
+		t.Errorf("raised limit: %v", err)
+	}
+	if raised := cfg.Limits.Raised(); len(raised) != 1 || raised[0] != "domainEntries 30000 (default 20000)" {
+		t.Errorf("raised = %q", raised)
+	}
+
+	cfg.Limits.MaxOutbounds = CeilingConfigLimits.MaxOutbounds + 1
+	if err := cfg.ValidateTuning(); err == nil || !strings.Contains(err.Error(), LimitOutbounds) {
+		t.Errorf("over the ceiling: %v", err)
+	}
+}
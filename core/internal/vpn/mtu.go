@@ -0,0 +1,210 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A TUN MTU larger than the path behind it lets small exchanges through
+// while large packets vanish: small sites load, large pages hang. Once
+// mtuProbeDelay after connect, and on demand, POST bodies sized to fill one
+// packet of increasing size go through the tunnel to mtuProbeURL. The
+// smallest size that stalls twice, after smaller ones got through, is the
+// threshold; the largest one that got through is the suggested MTU. The
+// probe stops at the first error other than a stall, since an unreachable
+// endpoint says nothing about the MTU.
+const (
+	mtuProbeDelay   = 5 * time.Second
+	mtuProbeTimeout = 4 * time.Second
+	mtuProbeURL     = "https://speed.cloudflare.com/__up"
+
+	// mtuProbeOverhead is subtracted from a packet size for the IP, TCP
+	// and TLS headers and the HTTP request line and headers.
+	mtuProbeOverhead = 300
+	// mtuProbeBudget bounds the payload bytes one probe sends.
+	mtuProbeBudget = 256 << 10
+	// minMTU is the smallest MTU IPv6 allows, and the smallest probed.
+	minMTU = 1280
+)
+
+// mtuProbeSizes are the packet sizes probed, up to the configured MTU.
+var mtuProbeSizes = []int{minMTU, 1380, 1420, 1440, 1460, 1480, 1500, 2000, 4000, 8000, 9000}
+
+// errMTUStall is returned by an MTU probe send that did not complete in
+// time.
+var errMTUStall = errors.New("transfer stalled")
+
+// ErrNotConnected is returned by operations that need a connected session.
+var ErrNotConnected = errors.New("not connected")
+
+// MTUProbe is the outcome of an MTU probe of the connected session.
+// Mismatch is set when packets smaller than the configured MTU stalled;
+// SuggestedMTU is then the largest size that got through.
+type MTUProbe struct {
+	Server        string `json:"server"` // address of the probed session's server
+	ConfiguredMTU int    `json:"configuredMtu"`
+	LargestOK     int    `json:"largestOk,omitempty"` // largest packet size that got through
+	StalledAt     int    `json:"stalledAt,omitempty"` // smallest packet size that stalled
+	SuggestedMTU  int    `json:"suggestedMtu,omitempty"`
+	Mismatch      bool   `json:"mismatch"`
+	// Unavailable is set when the probe endpoint could not be used;
+	// nothing is concluded then.
+	Unavailable bool   `json:"unavailable,omitempty"`
+	Error       string `json:"error,omitempty"`
+	BytesSent   int    `json:"bytesSent"`
+	ProbedAt    int64  `json:"probedAt"` // Unix seconds
+}
+
+// MTUWarningListener is a callback invoked when an MTU probe finds the
+// configured MTU too large.
+type MTUWarningListener func(probe MTUProbe)
+
+// runMTUProbe probes packet sizes up to configured with send, which
+// returns errMTUStall for a payload that did not get through in time.
+func runMTUProbe(ctx context.Context, configured int, send func(ctx context.Context, payload int) error) MTUProbe {
+	result := MTUProbe{ConfiguredMTU: configured}
+	for _, size := range mtuProbeSizes {
+		if size > configured {
+			break
+		}
+		payload := size - mtuProbeOverhead
+		var err error
+		// A single stall may be a lost packet; only a second one counts.
+		for attempt := 0; attempt < 2; attempt++ {
+			if result.BytesSent+payload > mtuProbeBudget {
+				return result
+			}
+			result.BytesSent += payload
+			if err = send(ctx, payload); err == nil || !errors.Is(err, errMTUStall) {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			result.Unavailable = true
+			result.Error = ctx.Err().Error()
+			return result
+		}
+		switch {
+		case err == nil:
+			result.LargestOK = size
+		case errors.Is(err, errMTUStall) && result.LargestOK > 0:
+			result.StalledAt = size
+			result.SuggestedMTU = result.LargestOK
+			result.Mismatch = true
+			return result
+		default:
+			// Nothing got through, or the endpoint failed: no conclusion.
+			result.Unavailable = true
+			result.Error = err.Error()
+			return result
+		}
+	}
+	return result
+}
+
+// newMTUSender returns the send function of runMTUProbe used by default.
+// Its connections are bound to the TUN address, so they enter the tunnel
+// whatever the split tunnel rules route the service's own traffic to.
+func newMTUSender() func(ctx context.Context, payload int) error {
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(tunAddress4)}}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             nil,
+		DialContext:       dialer.DialContext,
+		DisableKeepAlives: true,
+	}}
+	return func(ctx context.Context, payload int) error {
+		ctx, cancel := context.WithTimeout(ctx, mtuProbeTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, mtuProbeURL, bytes.NewReader(make([]byte, payload)))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return errMTUStall
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("probe endpoint returned %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// ProbeMTU runs an MTU probe of the connected session, as done once after
+// connect. A mismatch is remembered for SuggestedMTU and reported to the
+// MTU warning listeners.
+func (e *Engine) ProbeMTU(ctx context.Context) (MTUProbe, error) {
+	e.mu.Lock()
+	if e.box == nil {
+		e.mu.Unlock()
+		return MTUProbe{}, ErrNotConnected
+	}
+	session := e.session
+	e.mu.Unlock()
+	return e.probeMTU(ctx, session), nil
+}
+
+// autoProbeMTU runs the MTU probe of a session once, mtuProbeDelay after
+// connect, unless the session ends first.
+func (e *Engine) autoProbeMTU(ctx context.Context, session uint64) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(e.mtuProbeDelay):
+	}
+	e.probeMTU(ctx, session)
+}
+
+func (e *Engine) probeMTU(ctx context.Context, session uint64) MTUProbe {
+	// Probes of one session would skew each other.
+	e.mtuMu.Lock()
+	defer e.mtuMu.Unlock()
+
+	e.mu.Lock()
+	if e.box == nil || e.session != session {
+		e.mu.Unlock()
+		return MTUProbe{Unavailable: true, Error: ErrNotConnected.Error()}
+	}
+	cfg := e.config
+	e.mu.Unlock()
+	if cfg.Simulation != nil {
+		return MTUProbe{Unavailable: true, Error: "a simulated session has no tunnel to probe"}
+	}
+
+	probe := runMTUProbe(ctx, cfg.MTU, e.sendMTUProbe)
+	probe.Server = cfg.Server.Address
+	probe.ProbedAt = time.Now().Unix()
+
+	switch {
+	case probe.Mismatch:
+		log.Printf("warning: packets of %d bytes stall through the tunnel; MTU %d is too large, suggesting %d",
+			probe.StalledAt, probe.ConfiguredMTU, probe.SuggestedMTU)
+		e.mu.Lock()
+		e.mtuSuggestions[probe.Server] = probe.SuggestedMTU
+		e.mu.Unlock()
+		e.stateMachine.NotifyMTUWarning(probe)
+	case probe.Unavailable:
+		log.Printf("MTU probe inconclusive: %s", probe.Error)
+	}
+	return probe
+}
+
+// SuggestedMTU returns the MTU the last mismatched probe of server
+// suggested, or 0.
+func (e *Engine) SuggestedMTU(server string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.mtuSuggestions[server]
+}
@@ -0,0 +1,124 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// pathWithMTU returns an MTU probe send over a path that drops packets
+// larger than mtu, counting the attempts.
+func pathWithMTU(mtu int, attempts *int) func(ctx context.Context, payload int) error {
+	return func(ctx context.Context, payload int) error {
+		*attempts++
+		if payload+mtuProbeOverhead > mtu {
+			return errMTUStall
+		}
+		return nil
+	}
+}
+
+func TestRunMTUProbe(t *testing.T) {
+	var attempts int
+	got := runMTUProbe(context.Background(), 9000, pathWithMTU(1450, &attempts))
+	if !got.Mismatch || got.LargestOK != 1440 || got.StalledAt != 1460 || got.SuggestedMTU != 1440 {
+		t.Errorf("probe = %+v", got)
+	}
+	// The stalled size is retried once; nothing larger is sent.
+	if attempts != 6 {
+		t.Errorf("attempts = %d, want 6", attempts)
+	}
+	if got.BytesSent > mtuProbeBudget {
+		t.Errorf("sent %d bytes, over the budget", got.BytesSent)
+	}
+
+	attempts = 0
+	got = runMTUProbe(context.Background(), 1500, pathWithMTU(9000, &attempts))
+	if got.Mismatch || got.LargestOK != 1500 || got.Unavailable {
+		t.Errorf("matching path: probe = %+v", got)
+	}
+}
+
+func TestRunMTUProbeRetriesSingleStall(t *testing.T) {
+	stalled := false
+	got := runMTUProbe(context.Background(), 1500, func(ctx context.Context, payload int) error {
+		if payload+mtuProbeOverhead == 1440 && !stalled {
+			stalled = true
+			return errMTUStall
+		}
+		return nil
+	})
+	if got.Mismatch || got.LargestOK != 1500 {
+		t.Errorf("probe = %+v, want one lost packet ignored", got)
+	}
+}
+
+func TestRunMTUProbeUnavailable(t *testing.T) {
+	refused := errors.New("connection refused")
+	tests := []struct {
+		name string
+		send func(ctx context.Context, payload int) error
+	}{
+		{"unreachable", func(context.Context, int) error { return refused }},
+		{"stalls from the start", func(context.Context, int) error { return errMTUStall }},
+		{"fails midway", func(ctx context.Context, payload int) error {
+			if payload+mtuProbeOverhead > 1440 {
+				return refused
+			}
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runMTUProbe(context.Background(), 9000, tt.send)
+			if !got.Unavailable || got.Mismatch || got.Error == "" {
+				t.Errorf("probe = %+v, want unavailable without a conclusion", got)
+			}
+		})
+	}
+}
+
+func TestProbeMTUWarnsAndSuggests(t *testing.T) {
+	e := newStubEngine()
+	e.mtuProbeDelay = time.Hour
+	var attempts int
+	e.sendMTUProbe = pathWithMTU(1400, &attempts)
+	warnings := make(chan MTUProbe, 1)
+	e.stateMachine.OnMTUWarning(func(p MTUProbe) { warnings <- p })
+
+	if _, err := e.ProbeMTU(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("disconnected: err = %v, want ErrNotConnected", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Server = &parser.ServerConfig{Protocol: "vless", Address: "example.com", Port: 443, Params: map[string]string{"uuid": "u"}}
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+
+	got, err := e.ProbeMTU(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Mismatch || got.SuggestedMTU != 1380 || got.Server != "example.com" || got.ConfiguredMTU != cfg.MTU {
+		t.Errorf("probe = %+v", got)
+	}
+	select {
+	case w := <-warnings:
+		if w.SuggestedMTU != 1380 {
+			t.Errorf("warning = %+v", w)
+		}
+	default:
+		t.Error("no MTU warning")
+	}
+	if mtu := e.SuggestedMTU("example.com"); mtu != 1380 {
+		t.Errorf("SuggestedMTU = %d, want 1380", mtu)
+	}
+	if mtu := e.SuggestedMTU("other.example.com"); mtu != 0 {
+		t.Errorf("SuggestedMTU of another server = %d", mtu)
+	}
+}
@@ -0,0 +1,198 @@
+package vpn
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// buildVLESSOutbound builds a sing-box outbound config map for VLESS.
+func buildVLESSOutbound(cfg *parser.ServerConfig) map[string]interface{} {
+	outbound := map[string]interface{}{
+		"type":        "vless",
+		"tag":         "proxy",
+		"server":      cfg.Address,
+		"server_port": cfg.Port,
+		"uuid":        cfg.Params["uuid"],
+	}
+
+	// Flow (for XTLS)
+	if flow, ok := cfg.Params["flow"]; ok && flow != "" {
+		outbound["flow"] = flow
+	}
+
+	// Transport
+	transport := cfg.Params["type"]
+	switch transport {
+	case "ws":
+		wsTransport := map[string]interface{}{
+			"type": "ws",
+		}
+		path, earlyData, earlyHeader := parser.WSEarlyData(cfg.Params)
+		if _, ok := cfg.Params["path"]; ok {
+			wsTransport["path"] = path
+		}
+		headers := map[string]interface{}{}
+		custom, _ := parser.WSHeaders(cfg.Params) // validated with the link
+		for name, value := range custom {
+			headers[name] = value
+		}
+		if host, ok := cfg.Params["host"]; ok {
+			for name := range headers {
+				if strings.EqualFold(name, "Host") {
+					delete(headers, name)
+				}
+			}
+			headers["Host"] = host
+		}
+		if len(headers) > 0 {
+			wsTransport["headers"] = headers
+		}
+		if earlyData > 0 {
+			wsTransport["max_early_data"] = earlyData
+			wsTransport["early_data_header_name"] = earlyHeader
+		}
+		outbound["transport"] = wsTransport
+
+	case "grpc":
+		grpcTransport := map[string]interface{}{
+			"type": "grpc",
+		}
+		if sn, ok := cfg.Params["serviceName"]; ok {
+			grpcTransport["service_name"] = sn
+		}
+		outbound["transport"] = grpcTransport
+
+	case "h2", "http":
+		h2Transport := map[string]interface{}{
+			"type": "http",
+		}
+		if path, ok := cfg.Params["path"]; ok {
+			h2Transport["path"] = path
+		}
+		if host, ok := cfg.Params["host"]; ok {
+			h2Transport["host"] = []string{host}
+		}
+		outbound["transport"] = h2Transport
+
+	case "httpupgrade":
+		httpUpgrade := map[string]interface{}{
+			"type": "httpupgrade",
+		}
+		if path, ok := cfg.Params["path"]; ok {
+			httpUpgrade["path"] = path
+		}
+		if host, ok := cfg.Params["host"]; ok {
+			httpUpgrade["host"] = host
+		}
+		outbound["transport"] = httpUpgrade
+	}
+
+	// TLS
+	security := cfg.Params["security"]
+	switch security {
+	case "tls":
+		tlsCfg := map[string]interface{}{
+			"enabled": true,
+		}
+		if sni, ok := cfg.Params["sni"]; ok {
+			tlsCfg["server_name"] = sni
+		}
+		if alpn, ok := cfg.Params["alpn"]; ok && alpn != "" {
+			tlsCfg["alpn"] = strings.Split(alpn, ",")
+		}
+		if fp, ok := cfg.Params["fp"]; ok && fp != "" {
+			tlsCfg["utls"] = map[string]interface{}{
+				"enabled":     true,
+				"fingerprint": fp,
+			}
+		}
+		outbound["tls"] = tlsCfg
+
+	case "reality":
+		realityCfg := map[string]interface{}{
+			"enabled": true,
+		}
+		if sni, ok := cfg.Params["sni"]; ok {
+			realityCfg["server_name"] = sni
+		}
+		reality := map[string]interface{}{
+			"enabled": true,
+		}
+		if pbk, ok := cfg.Params["pbk"]; ok {
+			reality["public_key"] = pbk
+		}
+		// An empty sid is kept: some servers expect the empty short ID.
+		if sid, ok := cfg.Params["sid"]; ok {
+			reality["short_id"] = parser.RealityShortID(sid)
+		}
+		realityCfg["reality"] = reality
+		if fp, ok := cfg.Params["fp"]; ok && fp != "" {
+			realityCfg["utls"] = map[string]interface{}{
+				"enabled":     true,
+				"fingerprint": fp,
+			}
+		}
+		outbound["tls"] = realityCfg
+	}
+
+	return outbound
+}
+
+// buildHysteria2Outbound builds a sing-box outbound config map for Hysteria2.
+func buildHysteria2Outbound(cfg *parser.ServerConfig) map[string]interface{} {
+	outbound := map[string]interface{}{
+		"type":        "hysteria2",
+		"tag":         "proxy",
+		"server":      cfg.Address,
+		"server_port": cfg.Port,
+		"password":    cfg.Params["password"],
+	}
+
+	// TLS (always enabled for Hysteria2)
+	tlsCfg := map[string]interface{}{
+		"enabled": true,
+	}
+	if sni, ok := cfg.Params["sni"]; ok && sni != "" {
+		tlsCfg["server_name"] = sni
+	}
+	if alpn, ok := cfg.Params["alpn"]; ok && alpn != "" {
+		tlsCfg["alpn"] = strings.Split(alpn, ",")
+	}
+	if insecure, ok := cfg.Params["insecure"]; ok && insecure == "1" {
+		log.Printf("WARNING: TLS certificate verification DISABLED for %s:%d — connection is vulnerable to MITM", cfg.Address, cfg.Port)
+		tlsCfg["insecure"] = true
+	}
+	outbound["tls"] = tlsCfg
+
+	// Obfuscation
+	if obfs, ok := cfg.Params["obfs"]; ok && obfs != "" {
+		obfsCfg := map[string]interface{}{
+			"type": obfs,
+		}
+		if obfsPassword, ok := cfg.Params["obfs-password"]; ok {
+			obfsCfg["password"] = obfsPassword
+		}
+		outbound["obfs"] = obfsCfg
+	}
+
+	// Bandwidth hints
+	if up, ok := cfg.Params["up"]; ok {
+		outbound["up_mbps"] = parseIntOrDefault(up, 0)
+	}
+	if down, ok := cfg.Params["down"]; ok {
+		outbound["down_mbps"] = parseIntOrDefault(down, 0)
+	}
+
+	return outbound
+}
+
+func parseIntOrDefault(s string, def int) int {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,102 @@
+package vpn
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+// On an IPv6-only network, common on mobile tethering, the machine has no
+// IPv4 route out. The network's DNS64 resolver answers IPv6 addresses for
+// IPv4-only names, which its NAT64 gateway translates, but the public
+// resolvers the session otherwise bootstraps with are IPv4 addresses, and
+// a server published as an IPv4 literal is out of reach unless it is
+// translated by hand. An OuterNetwork describing such a network makes the
+// proxy outbound resolve with the system resolver, prefer the server's
+// IPv6 addresses and dial IPv4 literals through NAT64.
+
+// nat64Discovery is the name whose only addresses are IPv4 (RFC 7050), so
+// that the AAAA records a DNS64 resolver synthesizes for it give away the
+// NAT64 prefix.
+const nat64Discovery = "ipv4only.arpa"
+
+// nat64WellKnown are the addresses of nat64Discovery.
+var nat64WellKnown = []netip.Addr{netip.AddrFrom4([4]byte{192, 0, 0, 170}), netip.AddrFrom4([4]byte{192, 0, 0, 171})}
+
+// OuterNetwork is how the machine reaches the server, outside the tunnel.
+// The zero value is a network with an IPv4 route, which needs nothing
+// special.
+type OuterNetwork struct {
+	IPv6Only bool         // there is an IPv6 default route but no IPv4 one
+	NAT64    netip.Prefix // the network's NAT64 /96 prefix; invalid if none was found
+}
+
+// Translate returns the address to dial for ip: on an IPv6-only network
+// with NAT64, an IPv4 address embedded in the NAT64 prefix, otherwise ip
+// itself.
+func (n OuterNetwork) Translate(ip netip.Addr) netip.Addr {
+	ip = ip.Unmap()
+	if !n.IPv6Only || !n.NAT64.IsValid() || !ip.Is4() {
+		return ip
+	}
+	addr := n.NAT64.Addr().As16()
+	v4 := ip.As4()
+	copy(addr[12:], v4[:])
+	return netip.AddrFrom16(addr)
+}
+
+// DiscoverNAT64 returns the NAT64 prefix of the network lookup resolves
+// with (RFC 7050), or an invalid prefix if its resolver does not
+// synthesize addresses. Only /96 prefixes, by far the most common and the
+// only one the well-known prefix uses, are recognized.
+func DiscoverNAT64(ctx context.Context, lookup func(ctx context.Context, host string) ([]net.IP, error)) netip.Prefix {
+	ips, err := lookup(ctx, nat64Discovery)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || !addr.Is6() || addr.Is4In6() {
+			continue
+		}
+		b := addr.As16()
+		embedded := netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]})
+		for _, known := range nat64WellKnown {
+			if embedded == known {
+				copy(b[12:], []byte{0, 0, 0, 0})
+				return netip.PrefixFrom(netip.AddrFrom16(b), 96)
+			}
+		}
+	}
+	return netip.Prefix{}
+}
+
+// applyOuterNetwork adapts the proxy outbound to cfg's outer network. It
+// runs before applyRateLimit, which moves the domain strategy to the
+// outbound that dials, along with the other dial options. Through an
+// upstream proxy, the proxy reaches the server and nothing is translated.
+func applyOuterNetwork(cfg *Config, proxy map[string]interface{}) {
+	if !cfg.OuterNetwork.IPv6Only {
+		return
+	}
+	server, _ := proxy["server"].(string)
+	ip, err := netip.ParseAddr(server)
+	if err != nil {
+		proxy["domain_strategy"] = "prefer_ipv6"
+		return
+	}
+	if cfg.UpstreamProxy != nil {
+		return
+	}
+	translated := cfg.OuterNetwork.Translate(ip)
+	if translated == ip.Unmap() {
+		return
+	}
+	proxy["server"] = translated.String()
+	// The certificate names the published address, not the translated one.
+	if tls, ok := proxy["tls"].(map[string]interface{}); ok && tls["enabled"] == true {
+		if name, _ := tls["server_name"].(string); name == "" {
+			tls["server_name"] = server
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/sagernet/sing-box/option"
+)
+
+// fakeResolver answers lookups from a table; other names do not resolve.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	answers, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	ips := make([]net.IP, len(answers))
+	for i, a := range answers {
+		ips[i] = net.ParseIP(a)
+	}
+	return ips, nil
+}
+
+func TestDiscoverNAT64(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver fakeResolver
+		want     string // "" for none
+	}{
+		{"well-known prefix", fakeResolver{nat64Discovery: {"64:ff9b::c000:aa", "64:ff9b::c000:ab"}}, "64:ff9b::/96"},
+		{"network-specific prefix", fakeResolver{nat64Discovery: {"2001:db8:64::c000:ab"}}, "2001:db8:64::/96"},
+		{"dual-stack without DNS64", fakeResolver{nat64Discovery: {"192.0.0.170", "192.0.0.171"}}, ""},
+		{"unrelated address", fakeResolver{nat64Discovery: {"2001:db8::1"}}, ""},
+		{"does not resolve", fakeResolver{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiscoverNAT64(context.Background(), tt.resolver.lookup)
+			if (tt.want == "" && got.IsValid()) || (tt.want != "" && got.String() != tt.want) {
+				t.Errorf("prefix = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOuterNetworkTranslate(t *testing.T) {
+	nat64 := OuterNetwork{IPv6Only: true, NAT64: netip.MustParsePrefix("64:ff9b::/96")}
+	tests := []struct {
+		network  OuterNetwork
+		ip, want string
+	}{
+		{nat64, "203.0.113.10", "64:ff9b::cb00:710a"},
+		{nat64, "2001:db8::1", "2001:db8::1"},
+		{OuterNetwork{IPv6Only: true}, "203.0.113.10", "203.0.113.10"},
+		{OuterNetwork{NAT64: nat64.NAT64}, "203.0.113.10", "203.0.113.10"},
+	}
+	for _, tt := range tests {
+		if got := tt.network.Translate(netip.MustParseAddr(tt.ip)); got.String() != tt.want {
+			t.Errorf("%+v: Translate(%s) = %s, want %s", tt.network, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestApplyOuterNetwork(t *testing.T) {
+	v6only := OuterNetwork{IPv6Only: true, NAT64: netip.MustParsePrefix("64:ff9b::/96")}
+	tests := []struct {
+		name     string
+		link     string
+		network  OuterNetwork
+		server   string
+		strategy interface{}
+		sni      interface{}
+	}{
+		{"dual-stack hostname", upstreamTestLink, OuterNetwork{}, "example.com", nil, "example.com"},
+		{"v6-only hostname", upstreamTestLink, v6only, "example.com", "prefer_ipv6", "example.com"},
+		{"v6-only IPv4 literal", "vless://11111111-2222-3333-4444-555555555555@203.0.113.10:443?security=tls",
+			v6only, "64:ff9b::cb00:710a", nil, "203.0.113.10"},
+		{"v6-only IPv4 literal with SNI", "vless://11111111-2222-3333-4444-555555555555@203.0.113.10:443?security=tls&sni=example.com",
+			v6only, "64:ff9b::cb00:710a", nil, "example.com"},
+		{"v6-only without NAT64", "vless://11111111-2222-3333-4444-555555555555@203.0.113.10:443?security=tls",
+			OuterNetwork{IPv6Only: true}, "203.0.113.10", nil, nil},
+		{"v6-only IPv6 literal", "vless://11111111-2222-3333-4444-555555555555@[2001:db8::1]:443?security=tls",
+			v6only, "2001:db8::1", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Server = mustParse(t, tt.link)
+			cfg.OuterNetwork = tt.network
+			proxy := builtOutbounds(t, cfg)[0]
+			tls, _ := proxy["tls"].(map[string]interface{})
+			if proxy["server"] != tt.server || proxy["domain_strategy"] != tt.strategy || tls["server_name"] != tt.sni {
+				t.Errorf("server %v, domain_strategy %v, server_name %v; want %v, %v, %v",
+					proxy["server"], proxy["domain_strategy"], tls["server_name"], tt.server, tt.strategy, tt.sni)
+			}
+		})
+	}
+
+	// A shaped session resolves the server in the outbound it dials with.
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, upstreamTestLink)
+	cfg.OuterNetwork = v6only
+	cfg.RateLimit = RateLimit{MaxDownMbps: 5}
+	outbounds := builtOutbounds(t, cfg)
+	if shaped := outbounds[len(outbounds)-1]; outbounds[0]["domain_strategy"] != nil || shaped["domain_strategy"] != "prefer_ipv6" {
+		t.Errorf("proxy %v, shaped %v", outbounds[0], shaped)
+	}
+
+	// Through an upstream proxy, the proxy reaches the server.
+	cfg = DefaultConfig()
+	cfg.Server = mustParse(t, "vless://11111111-2222-3333-4444-555555555555@203.0.113.10:443?security=tls")
+	cfg.OuterNetwork = v6only
+	cfg.UpstreamProxy = &UpstreamProxy{Type: UpstreamHTTP, Host: "proxy.corp.example", Port: 3128}
+	if proxy := builtOutbounds(t, cfg)[0]; proxy["server"] != "203.0.113.10" {
+		t.Errorf("server behind an upstream proxy = %v", proxy["server"])
+	}
+}
+
+func TestOuterNetworkConfig(t *testing.T) {
+	// sing-box takes the generated config, and bootstraps with the
+	// system resolver. A raw outbound, as sing-box rejects the keep-alive
+	// the VLESS builder sets.
+	outbound, server, err := ParseRawOutbound(json.RawMessage(`{"type":"trojan","server":"example.com","server_port":443,
+		"password":"secret","tls":{"enabled":true}}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Server, cfg.RawOutbound = server, outbound
+	cfg.OuterNetwork = OuterNetwork{IPv6Only: true}
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts option.Options
+	if err := opts.UnmarshalJSONContext(boxContext(context.Background(), &shaper{}), built.JSON); err != nil {
+		t.Fatalf("sing-box rejects the config: %v", err)
+	}
+	if local := buildDNSConfig(cfg)["servers"].([]interface{})[1].(map[string]interface{}); local["address"] != "local" {
+		t.Errorf("local DNS = %v, want the system resolver", local)
+	}
+
+	cfg.DNS, cfg.CustomDNS = "custom", "2606:4700:4700::1111"
+	if local := buildDNSConfig(cfg)["servers"].([]interface{})[1].(map[string]interface{}); local["address"] != cfg.CustomDNS {
+		t.Errorf("local DNS = %v, want the custom server", local)
+	}
+}
@@ -0,0 +1,182 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clashAPIBase returns where the current link serves the Clash API.
+func (e *Engine) clashAPIBase() string {
+	return "http://" + e.clashAPIAddr()
+}
+
+// statsStallThreshold is how many stats polls in a row may fail before a
+// StatsStall is reported, once per run of failures.
+const statsStallThreshold = 5
+
+// StatsStallListener is a callback invoked when stats polls keep failing
+// while connected.
+type StatsStallListener func(stall StatsStall)
+
+// StatsStall reports that the Clash API stopped answering stats polls, so
+// traffic and speeds are frozen at their last values.
+type StatsStall struct {
+	Failures int    `json:"failures"` // consecutive failed polls
+	Error    string `json:"error"`    // of the last poll
+}
+
+// newClashClient returns an HTTP client for the local Clash API. It never
+// goes through a proxy, whatever the environment or the system proxy
+// says, and dials loopback addresses only. The one kept-alive connection
+// serves every poll of a session.
+func newClashClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if err := checkLoopback(addr); err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+			MaxIdleConns:        2,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     30 * time.Second,
+		},
+	}
+}
+
+// checkLoopback returns an error unless addr is a loopback IP and port.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !ip.IsLoopback() {
+		return fmt.Errorf("clash API address %s is not loopback", addr)
+	}
+	return nil
+}
+
+// statsWarmup gives the Clash API a moment to start listening before the
+// first poll of a session.
+const statsWarmup = 1 * time.Second
+
+// PollerStats describes the engine's stats poller, for debugging
+// goroutine leaks across reconnects.
+type PollerStats struct {
+	Active     int   // sessions being polled now; 0 or 1
+	Sessions   int64 // sessions polled since the engine was created
+	Violations int64 // times more than one session was polled at once; always 0
+}
+
+// pollSession is one connected session handed to the poller.
+type pollSession struct {
+	ctx    context.Context // done when the session ends
+	id     uint64          // equals Engine.session while the session is current
+	secret string          // Clash API secret
+	warmup time.Duration
+}
+
+// statsPoller is the engine's single stats polling goroutine. Connect hands
+// it each session through start; the session ends when its context is
+// done, and the goroutine waits for the next one. With one long-lived
+// poller, a session that was not torn down cleanly can never leave a
+// second loop writing the speed counters, and the HTTP client is reused.
+type statsPoller struct {
+	mu      sync.Mutex
+	next    *pollSession  // handed over, not yet picked up; a newer one replaces it
+	start   chan struct{} // signaled when next is set
+	running bool          // the goroutine has been started
+
+	active     atomic.Int32
+	sessions   atomic.Int64
+	violations atomic.Int64
+}
+
+func newStatsPoller() *statsPoller {
+	return &statsPoller{start: make(chan struct{}, 1)}
+}
+
+// hand passes a session to the poller, starting its goroutine on first
+// use. It never blocks, so it is safe to call with Engine.mu held.
+func (p *statsPoller) hand(s *pollSession, poll func(*pollSession)) {
+	p.mu.Lock()
+	p.next = s
+	if !p.running {
+		p.running = true
+		go p.run(poll)
+	}
+	p.mu.Unlock()
+	select {
+	case p.start <- struct{}{}:
+	default:
+	}
+}
+
+func (p *statsPoller) run(poll func(*pollSession)) {
+	for range p.start {
+		p.mu.Lock()
+		s := p.next
+		p.next = nil
+		p.mu.Unlock()
+		if s == nil {
+			continue
+		}
+		if n := p.active.Add(1); n > 1 {
+			p.violations.Add(1)
+			log.Printf("BUG: %d stats pollers active", n)
+		}
+		p.sessions.Add(1)
+		poll(s)
+		p.active.Add(-1)
+	}
+}
+
+func (p *statsPoller) stats() PollerStats {
+	return PollerStats{
+		Active:     int(p.active.Load()),
+		Sessions:   p.sessions.Load(),
+		Violations: p.violations.Load(),
+	}
+}
+
+// PollerStats returns the state of the stats poller.
+func (e *Engine) PollerStats() PollerStats {
+	return e.poller.stats()
+}
+
+// fetchConnections reads the open connections from the Clash API.
+func fetchConnections(ctx context.Context, client *http.Client, baseURL, secret string) (*clashConnections, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("clash API: %s", resp.Status)
+	}
+	var conns clashConnections
+	if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+		return nil, err
+	}
+	return &conns, nil
+}
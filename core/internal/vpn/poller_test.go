@@ -0,0 +1,223 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stubDriver struct{}
+
+func (stubDriver) loadDriver() (string, error) { return "0.14", nil }
+func (stubDriver) adapterExists() bool         { return false }
+func (stubDriver) removeAdapter() error        { return nil }
+
+type stubBox struct{}
+
+func (stubBox) Close() error { return nil }
+
+// newStubEngine returns an engine whose sessions run without sing-box.
+// Each session's proxied download total is its connect number, so stats
+// show which session produced them.
+func newStubEngine() *Engine {
+	e := NewEngine(NewStateMachine())
+	e.driver = stubDriver{}
+	e.statsWarmup = 0
+	e.statsInterval = time.Millisecond
+	var session, polls atomic.Int64
+	e.startCore = func(context.Context, []byte) (coreBox, error) {
+		session.Add(1)
+		return stubBox{}, nil
+	}
+	e.fetchConns = func(ctx context.Context, secret string) (*clashConnections, error) {
+		n := polls.Add(1)
+		return &clashConnections{UploadTotal: n * 100, DownloadTotal: session.Load(), Connections: []clashConnection{proxyConn("c", "", n*100, session.Load())}}, nil
+	}
+	e.probeDelay = func(context.Context, string) (int64, error) { return 50, nil }
+	e.sendMTUProbe = func(context.Context, int) error { return nil }
+	return e
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestReconnectCyclesDoNotLeak(t *testing.T) {
+	e := newStubEngine()
+	stats := make(chan Stats, 16)
+	e.stateMachine.OnStats(func(s Stats) {
+		if s.UpSpeed < 0 || s.DownSpeed < 0 {
+			t.Errorf("negative speed %+v", s)
+		}
+		select {
+		case stats <- s:
+		default:
+		}
+	})
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+
+	// Warm up so lazily started goroutines are in the baseline.
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	<-stats
+	e.Disconnect()
+	waitFor(t, "the poller to go idle", func() bool { return e.PollerStats().Active == 0 })
+	base := runtime.NumGoroutine()
+
+	const cycles = 100
+	for i := 2; i <= cycles+1; i++ {
+		if err := e.Connect(context.Background(), cfg); err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+		// Wait for a poll of this session; stale ones from the last
+		// session may still be in the channel.
+		for s := range stats {
+			if s.Download > int64(i) {
+				t.Fatalf("cycle %d: stats from session %d", i, s.Download)
+			}
+			if s.Download == int64(i) {
+				break
+			}
+		}
+		if got := e.Traffic().Download; got != int64(i) {
+			t.Fatalf("cycle %d: traffic from session %d", i, got)
+		}
+		if err := e.Disconnect(); err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+	}
+
+	waitFor(t, "the poller to go idle", func() bool { return e.PollerStats().Active == 0 })
+	if s := e.PollerStats(); s.Sessions != cycles+1 || s.Violations != 0 {
+		t.Errorf("poller stats = %+v", s)
+	}
+	// Nothing polls after the last disconnect.
+	last := e.Traffic()
+	time.Sleep(20 * time.Millisecond)
+	if e.Traffic() != last || e.Activity() != (Activity{}) {
+		t.Errorf("stats changed after disconnect: %+v", e.Traffic())
+	}
+
+	const tolerance = 2
+	waitFor(t, "goroutines to exit", func() bool { return runtime.NumGoroutine()-base <= tolerance })
+}
+
+func TestPollerReplacesPendingSession(t *testing.T) {
+	p := newStatsPoller()
+	release := make(chan struct{})
+	var polled []uint64
+	done := make(chan struct{}, 3)
+	poll := func(s *pollSession) {
+		if s.id == 1 {
+			<-release
+		}
+		polled = append(polled, s.id)
+		done <- struct{}{}
+	}
+
+	p.hand(&pollSession{id: 1}, poll)
+	waitFor(t, "session 1 to start", func() bool { return p.stats().Active == 1 })
+	// Both arrive while session 1 is polled; only the newest is kept.
+	p.hand(&pollSession{id: 2}, poll)
+	p.hand(&pollSession{id: 3}, poll)
+	close(release)
+	<-done
+	<-done
+
+	waitFor(t, "the poller to go idle", func() bool { return p.stats().Active == 0 })
+	if len(polled) != 2 || polled[0] != 1 || polled[1] != 3 {
+		t.Errorf("polled sessions %v, want [1 3]", polled)
+	}
+	if s := p.stats(); s.Sessions != 2 || s.Violations != 0 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestClashClientIgnoresProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		http.Error(w, "proxy", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	clash := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"connections":[{"id":"c1"}]}`))
+	}))
+	defer clash.Close()
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	t.Setenv("http_proxy", proxy.URL)
+	t.Setenv("NO_PROXY", "")
+
+	conns, err := fetchConnections(context.Background(), newClashClient(time.Second), clash.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns.Connections) != 1 || proxied.Load() != 0 {
+		t.Errorf("got %d connections, %d requests through the proxy", len(conns.Connections), proxied.Load())
+	}
+
+	if _, err := fetchConnections(context.Background(), newClashClient(time.Second), "http://10.0.0.1:9090", ""); err == nil {
+		t.Error("dialed a non-loopback Clash API address")
+	}
+}
+
+func TestStatsStallReported(t *testing.T) {
+	e := newStubEngine()
+	var failing atomic.Bool
+	failing.Store(true)
+	var polls atomic.Int32
+	e.fetchConns = func(context.Context, string) (*clashConnections, error) {
+		polls.Add(1)
+		if failing.Load() {
+			return nil, errors.New("connection refused")
+		}
+		return &clashConnections{}, nil
+	}
+	stalls := make(chan StatsStall, 4)
+	e.stateMachine.OnStatsStalled(func(s StatsStall) { stalls <- s })
+
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+
+	select {
+	case s := <-stalls:
+		if s.Failures != statsStallThreshold || s.Error != "connection refused" {
+			t.Errorf("stall = %+v", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no stall reported")
+	}
+	// Reported once per run of failures.
+	n := polls.Load()
+	waitFor(t, "more failed polls", func() bool { return polls.Load() > n+2*statsStallThreshold })
+	if len(stalls) != 0 {
+		t.Error("stall reported twice")
+	}
+	failing.Store(false)
+	n = polls.Load()
+	waitFor(t, "a good poll", func() bool { return polls.Load() > n+1 })
+	failing.Store(true)
+	select {
+	case <-stalls:
+	case <-time.After(2 * time.Second):
+		t.Fatal("new run of failures not reported")
+	}
+}
@@ -0,0 +1,98 @@
+package vpn
+
+import (
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+)
+
+// Power modes trade stats freshness and diagnostics for CPU time on
+// battery-powered machines.
+//
+// PowerLow polls traffic stats every 5 seconds instead of every second,
+// enables process lookup only when app rules have entries, and logs
+// sing-box warnings only. The poll interval changes at runtime; the other
+// two take effect on the next connect.
+const (
+	PowerNormal = "normal"
+	PowerLow    = "low"
+)
+
+const (
+	statsInterval         = 1 * time.Second
+	lowPowerStatsInterval = 5 * time.Second
+)
+
+// Settings that only take effect on reconnect. PowerModeReconnectChanges
+// reports the first two.
+const (
+	ChangeLogLevel        = "logLevel"
+	ChangeFindProcess     = "findProcess"
+	ChangeBuiltinBypasses = "builtinBypasses"
+)
+
+func statsIntervalFor(mode string) time.Duration {
+	if mode == PowerLow {
+		return lowPowerStatsInterval
+	}
+	return statsInterval
+}
+
+func logLevelFor(mode string) string {
+	if mode == PowerLow {
+		return "warn"
+	}
+	return "info"
+}
+
+// needsFindProcess reports whether any rule of cfg matches by process, or
+// the DNS query log needs the process of each connection. Process lookup
+// runs on every new connection, so low power mode skips it for an app
+// split tunnel with no apps selected.
+func needsFindProcess(cfg *Config, dnsExceptionApps []string) bool {
+	if len(dnsExceptionApps) > 0 || cfg.DNSQueryLog {
+		return true
+	}
+	if cfg.SplitTunnelMode != "app" {
+		return false
+	}
+	return cfg.PowerMode != PowerLow || len(cfg.SplitTunnelApps) > 0
+}
+
+// PowerModeReconnectChanges lists the settings that would differ if the
+// session running with active were started in mode, i.e. what switching
+// modes changes only after a reconnect.
+func PowerModeReconnectChanges(active *Config, mode string) []string {
+	changes := []string{}
+	if active == nil {
+		return changes
+	}
+	if logLevelFor(active.PowerMode) != logLevelFor(mode) {
+		changes = append(changes, ChangeLogLevel)
+	}
+	apps, _, _ := splittunnel.ParseDNSExceptions(active.DNSHijackExceptions)
+	next := *active
+	next.PowerMode = mode
+	if needsFindProcess(active, apps) != needsFindProcess(&next, apps) {
+		changes = append(changes, ChangeFindProcess)
+	}
+	return changes
+}
+
+// SetPowerMode sets the stats poll interval for the running session and
+// future ones. The other effects follow Config.PowerMode at connect.
+func (e *Engine) SetPowerMode(mode string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.powerMode = mode
+}
+
+// PowerMode returns the current power mode.
+func (e *Engine) PowerMode() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.powerMode == "" {
+		return PowerNormal
+	}
+	return e.powerMode
+}
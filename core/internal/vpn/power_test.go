@@ -0,0 +1,71 @@
+package vpn
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNeedsFindProcess(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		dns  []string
+		want bool
+	}{
+		{"full tunnel", Config{SplitTunnelMode: "off"}, nil, false},
+		{"app split", Config{SplitTunnelMode: "app", SplitTunnelApps: []string{"a.exe"}}, nil, true},
+		{"empty app split", Config{SplitTunnelMode: "app"}, nil, true},
+		{"empty app split, low power", Config{SplitTunnelMode: "app", PowerMode: PowerLow}, nil, false},
+		{"app split, low power", Config{SplitTunnelMode: "app", SplitTunnelApps: []string{"a.exe"}, PowerMode: PowerLow}, nil, true},
+		{"dns exception apps, low power", Config{SplitTunnelMode: "off", PowerMode: PowerLow}, []string{"a.exe"}, true},
+		{"dns query log, low power", Config{SplitTunnelMode: "off", PowerMode: PowerLow, DNSQueryLog: true}, nil, true},
+	}
+	for _, tt := range tests {
+		if got := needsFindProcess(&tt.cfg, tt.dns); got != tt.want {
+			t.Errorf("%s: needsFindProcess = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPowerModeReconnectChanges(t *testing.T) {
+	active := &Config{SplitTunnelMode: "app", PowerMode: PowerNormal}
+	if got := PowerModeReconnectChanges(active, PowerLow); !reflect.DeepEqual(got, []string{ChangeLogLevel, ChangeFindProcess}) {
+		t.Errorf("normal → low with empty app split = %v", got)
+	}
+
+	active.SplitTunnelApps = []string{"chrome.exe"}
+	if got := PowerModeReconnectChanges(active, PowerLow); !reflect.DeepEqual(got, []string{ChangeLogLevel}) {
+		t.Errorf("normal → low with apps = %v", got)
+	}
+	if got := PowerModeReconnectChanges(active, PowerNormal); len(got) != 0 {
+		t.Errorf("unchanged mode = %v", got)
+	}
+}
+
+func TestLowPowerConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.SplitTunnelMode = "app"
+	cfg.PowerMode = PowerLow
+
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gen struct {
+		Log   struct{ Level string } `json:"log"`
+		Route struct {
+			FindProcess bool `json:"find_process"`
+		} `json:"route"`
+	}
+	if err := json.Unmarshal(built.JSON, &gen); err != nil {
+		t.Fatal(err)
+	}
+	if gen.Log.Level != "warn" || gen.Route.FindProcess {
+		t.Errorf("low power: log level %q, find_process %v", gen.Log.Level, gen.Route.FindProcess)
+	}
+	if statsIntervalFor(PowerLow) != lowPowerStatsInterval || statsIntervalFor("") != statsInterval {
+		t.Error("stats interval does not follow the power mode")
+	}
+}
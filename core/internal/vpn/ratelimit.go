@@ -0,0 +1,160 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// RateLimit caps the tunnel's throughput in megabits per second, as on a
+// metered connection. Zero leaves a direction unlimited.
+type RateLimit struct {
+	MaxDownMbps int `json:"maxDownMbps"`
+	MaxUpMbps   int `json:"maxUpMbps"`
+}
+
+// MaxRateLimitMbps is the highest limit accepted; anything faster is as
+// good as unlimited.
+const MaxRateLimitMbps = 10000
+
+// How a session enforces its rate limit.
+//
+// Hysteria2 paces itself: its bandwidth hints set the rate its Brutal
+// congestion control sends at, and the client's download hint the rate
+// the server sends at. The hints are fixed for the link, so a new limit
+// takes a reconnect.
+//
+// Every other protocol runs over TCP or plain UDP to the server, which
+// the proxy outbound dials through a local shaping layer: a token bucket
+// per direction that a new limit updates in place.
+const (
+	RateLimitHints  = "hints"
+	RateLimitShaped = "shaped"
+)
+
+// Validate checks both limits are within range.
+func (r RateLimit) Validate() error {
+	if r.MaxDownMbps < 0 || r.MaxDownMbps > MaxRateLimitMbps {
+		return fmt.Errorf("maxDownMbps must be between 0 and %d", MaxRateLimitMbps)
+	}
+	if r.MaxUpMbps < 0 || r.MaxUpMbps > MaxRateLimitMbps {
+		return fmt.Errorf("maxUpMbps must be between 0 and %d", MaxRateLimitMbps)
+	}
+	return nil
+}
+
+// IsZero reports whether neither direction is limited.
+func (r RateLimit) IsZero() bool {
+	return r.MaxDownMbps == 0 && r.MaxUpMbps == 0
+}
+
+// rateLimitMode returns how a session built from cfg enforces its rate
+// limit, or "" if it has none.
+func rateLimitMode(cfg *Config) string {
+	if cfg.RateLimit.IsZero() {
+		return ""
+	}
+	if proxyType(cfg) == "hysteria2" {
+		return RateLimitHints
+	}
+	return RateLimitShaped
+}
+
+// proxyType returns the sing-box type of cfg's proxy outbound.
+func proxyType(cfg *Config) string {
+	if cfg.RawOutbound != nil {
+		t, _ := cfg.RawOutbound["type"].(string)
+		return t
+	}
+	if cfg.Server != nil {
+		return cfg.Server.Protocol
+	}
+	return ""
+}
+
+// detourDialFields are the dial options of the proxy outbound that move
+// to the outbound it dials through, the shaping or upstream one, since
+// sing-box ignores them on an outbound with a detour.
+var detourDialFields = []string{"connect_timeout", "tcp_fast_open", "tcp_multi_path", "udp_fragment", "domain_strategy"}
+
+// applyRateLimit enforces cfg's rate limit on the proxy outbound. For a
+// shaped session it returns the shaping outbound the proxy now dials
+// through, to add to the config; otherwise nil.
+func applyRateLimit(cfg *Config, proxy map[string]interface{}) map[string]interface{} {
+	switch rateLimitMode(cfg) {
+	case RateLimitHints:
+		// A tighter hint the link already carries stays.
+		proxy["up_mbps"] = lowerHint(proxy["up_mbps"], cfg.RateLimit.MaxUpMbps)
+		proxy["down_mbps"] = lowerHint(proxy["down_mbps"], cfg.RateLimit.MaxDownMbps)
+	case RateLimitShaped:
+		shaped := map[string]interface{}{
+			"type": shapedOutboundType,
+			"tag":  tagShaped,
+		}
+		for _, field := range detourDialFields {
+			if v, ok := proxy[field]; ok {
+				shaped[field] = v
+				delete(proxy, field)
+			}
+		}
+		proxy["detour"] = tagShaped
+		return shaped
+	}
+	return nil
+}
+
+// lowerHint returns the lower of a bandwidth hint and a limit, where zero
+// means none.
+func lowerHint(hint interface{}, limit int) int {
+	current := 0
+	switch v := hint.(type) {
+	case int:
+		current = v
+	case json.Number: // from a raw outbound
+		n, _ := v.Int64()
+		current = int(n)
+	}
+	if limit == 0 || (current > 0 && current < limit) {
+		return current
+	}
+	return limit
+}
+
+// RateLimit returns the session's rate limit and how it is enforced. The
+// mode is "" while disconnected or unlimited.
+func (e *Engine) RateLimit() (RateLimit, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil || e.config.RateLimit.IsZero() {
+		return RateLimit{}, ""
+	}
+	if e.shaped {
+		return e.config.RateLimit, RateLimitShaped
+	}
+	return e.config.RateLimit, rateLimitMode(e.config)
+}
+
+// SetRateLimit changes the session's rate limit. A session dialing through
+// the shaper takes it at once; any other is reconnected with it under
+// opts, as Hysteria2 hints are fixed for the link, and reconnected is
+// true. A failed reconnect ends the session as ReconnectWith does.
+func (e *Engine) SetRateLimit(ctx context.Context, limit RateLimit, opts AttemptOptions) (reconnected bool, err error) {
+	if err := limit.Validate(); err != nil {
+		return false, err
+	}
+	e.mu.Lock()
+	if e.box == nil {
+		e.mu.Unlock()
+		return false, ErrNotConnected
+	}
+	if e.shaped || (limit.IsZero() && rateLimitMode(e.config) == "") {
+		cfg := *e.config
+		cfg.RateLimit = limit
+		e.config = &cfg
+		e.shaper.set(limit)
+		e.mu.Unlock()
+		return false, nil
+	}
+	e.mu.Unlock()
+	return true, e.reconnect(ctx, opts, func(cfg *Config) { cfg.RateLimit = limit })
+}
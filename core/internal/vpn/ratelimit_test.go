@@ -0,0 +1,438 @@
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-box/option"
+)
+
+// builtOutbounds returns the outbounds of the sing-box config for cfg.
+func builtOutbounds(t *testing.T, cfg *Config) []map[string]interface{} {
+	t.Helper()
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Outbounds []map[string]interface{} `json:"outbounds"`
+	}
+	if err := json.Unmarshal(built.JSON, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Outbounds
+}
+
+func TestApplyRateLimitShaped(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://11111111-2222-3333-4444-555555555555@example.com:443?security=tls&sni=example.com")
+	cfg.RateLimit = RateLimit{MaxDownMbps: 5}
+
+	outbounds := builtOutbounds(t, cfg)
+	proxy, shaped := outbounds[0], outbounds[len(outbounds)-1]
+	if proxy["detour"] != tagShaped || shaped["type"] != shapedOutboundType || shaped["tag"] != tagShaped {
+		t.Fatalf("proxy %v, last outbound %v; want the proxy dialing through the shaping outbound", proxy, shaped)
+	}
+
+	cfg.RateLimit = RateLimit{}
+	for _, o := range builtOutbounds(t, cfg) {
+		if o["type"] == shapedOutboundType || o["detour"] != nil {
+			t.Errorf("unlimited session has %v", o)
+		}
+	}
+}
+
+func TestApplyRateLimitMovesDialOptions(t *testing.T) {
+	outbound, server, err := ParseRawOutbound(json.RawMessage(`{"type":"trojan","server":"example.com","server_port":443,
+		"password":"secret","connect_timeout":"5s","tcp_fast_open":true,"tls":{"enabled":true}}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Server, cfg.RawOutbound = server, outbound
+	cfg.RateLimit = RateLimit{MaxUpMbps: 2}
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sing-box takes the shaping outbound and the detour to it.
+	var opts option.Options
+	if err := opts.UnmarshalJSONContext(boxContext(context.Background(), &shaper{}), built.JSON); err != nil {
+		t.Fatal(err)
+	}
+	// Dial options only take effect on the outbound that dials.
+	outbounds := builtOutbounds(t, cfg)
+	proxy, shaped := outbounds[0], outbounds[len(outbounds)-1]
+	for _, field := range []string{"connect_timeout", "tcp_fast_open"} {
+		if _, ok := proxy[field]; ok || shaped[field] == nil {
+			t.Errorf("%s: proxy %v, shaped %v", field, proxy[field], shaped[field])
+		}
+	}
+	if cfg.RawOutbound["connect_timeout"] == nil {
+		t.Error("building the config changed the raw outbound")
+	}
+}
+
+func TestApplyRateLimitHints(t *testing.T) {
+	tests := []struct {
+		name           string
+		link           string
+		raw            string
+		limit          RateLimit
+		wantUp, wantDn float64
+	}{
+		{"no link hints", "hysteria2://secret@hy.example.com:8443?sni=hy.example.com", "", RateLimit{MaxDownMbps: 20, MaxUpMbps: 5}, 5, 20},
+		{"tighter link hint stays", "hysteria2://secret@hy.example.com:8443?up=3&down=100", "", RateLimit{MaxDownMbps: 20, MaxUpMbps: 5}, 3, 20},
+		{"one direction", "hysteria2://secret@hy.example.com:8443?up=30", "", RateLimit{MaxDownMbps: 20}, 30, 20},
+		{"raw outbound", "", `{"type":"hysteria2","server":"hy.example.com","server_port":8443,"password":"secret","up_mbps":50}`, RateLimit{MaxUpMbps: 10}, 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			if tt.raw != "" {
+				outbound, server, err := ParseRawOutbound(json.RawMessage(tt.raw), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.Server, cfg.RawOutbound = server, outbound
+			} else {
+				cfg.Server = mustParse(t, tt.link)
+			}
+			cfg.RateLimit = tt.limit
+			if mode := rateLimitMode(cfg); mode != RateLimitHints {
+				t.Fatalf("mode = %q, want hints", mode)
+			}
+			outbounds := builtOutbounds(t, cfg)
+			proxy := outbounds[0]
+			if proxy["up_mbps"] != tt.wantUp || proxy["down_mbps"] != tt.wantDn || proxy["detour"] != nil {
+				t.Errorf("up %v down %v detour %v, want up %v down %v and no detour",
+					proxy["up_mbps"], proxy["down_mbps"], proxy["detour"], tt.wantUp, tt.wantDn)
+			}
+			if len(outbounds) != 4 {
+				t.Errorf("got %d outbounds, want no shaping outbound", len(outbounds))
+			}
+		})
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	for _, limit := range []RateLimit{{MaxDownMbps: -1}, {MaxUpMbps: MaxRateLimitMbps + 1}} {
+		if limit.Validate() == nil {
+			t.Errorf("%+v accepted", limit)
+		}
+	}
+	if err := (RateLimit{MaxDownMbps: MaxRateLimitMbps, MaxUpMbps: 1}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	b := &tokenBucket{now: func() time.Time { return now }}
+
+	if d := b.reserve(1 << 20); d != 0 {
+		t.Errorf("unlimited bucket waits %v", d)
+	}
+	b.setRate(1e6) // 1 MB/s: the burst is 50 KB
+	now = now.Add(time.Second)
+	if d := b.reserve(50_000); d != 0 {
+		t.Errorf("burst waits %v", d)
+	}
+	// Past the burst, each byte waits its turn, and callers queue up.
+	if d := b.reserve(100_000); d != 100*time.Millisecond {
+		t.Errorf("first reservation past the burst waits %v, want 100ms", d)
+	}
+	if d := b.reserve(100_000); d != 200*time.Millisecond {
+		t.Errorf("second reservation waits %v, want 200ms", d)
+	}
+	// The debt is paid off at the rate.
+	now = now.Add(200 * time.Millisecond)
+	if d := b.reserve(0); d != 0 {
+		t.Errorf("reservation after the debt waits %v", d)
+	}
+	// A new rate applies to what is reserved next.
+	b.setRate(2e6)
+	if d := b.reserve(200_000); d != 100*time.Millisecond {
+		t.Errorf("reservation at the new rate waits %v, want 100ms", d)
+	}
+	b.setRate(0)
+	if d := b.reserve(1 << 20); d != 0 {
+		t.Errorf("bucket set back to unlimited waits %v", d)
+	}
+}
+
+// echoServer echoes every connection until the test ends.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoThroughput sends size bytes through conn to an echo server and
+// reads them back, returning the rate in Mbps measured after the first
+// warmup bytes came back, past any burst.
+func echoThroughput(t *testing.T, conn net.Conn, size, warmup int) float64 {
+	t.Helper()
+	go func() {
+		buf := make([]byte, 64<<10)
+		for sent := 0; sent < size; sent += len(buf) {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	if _, err := io.CopyN(io.Discard, conn, int64(warmup)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := io.CopyN(io.Discard, conn, int64(size-warmup)); err != nil {
+		t.Fatal(err)
+	}
+	return float64(size-warmup) * 8 / 1e6 / time.Since(start).Seconds()
+}
+
+// checkRate fails unless got is within 15% of want.
+func checkRate(t *testing.T, what string, got, want float64) {
+	t.Helper()
+	if got < want*0.85 || got > want*1.15 {
+		t.Errorf("%s: %.2f Mbps, want %.0f Mbps ±15%%", what, got, want)
+	} else {
+		t.Logf("%s: %.2f Mbps", what, got)
+	}
+}
+
+func TestShapedConnThroughput(t *testing.T) {
+	addr := echoServer(t)
+	for _, tt := range []struct {
+		name  string
+		limit RateLimit
+		want  float64
+	}{
+		{"upload", RateLimit{MaxUpMbps: 16}, 16},
+		{"download", RateLimit{MaxDownMbps: 16}, 16},
+		{"both", RateLimit{MaxDownMbps: 24, MaxUpMbps: 12}, 12},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &shaper{}
+			s.set(tt.limit)
+			raw, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := newShapedConn(raw, s)
+			defer conn.Close()
+			// About a second at the limit.
+			checkRate(t, tt.name, echoThroughput(t, conn, 2<<20, 256<<10), tt.want)
+		})
+	}
+}
+
+func TestShapedConnLiveChange(t *testing.T) {
+	s := &shaper{}
+	s.set(RateLimit{MaxDownMbps: 8})
+	raw, err := net.Dial("tcp", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newShapedConn(raw, s)
+	defer conn.Close()
+	checkRate(t, "before", echoThroughput(t, conn, 1<<20, 128<<10), 8)
+	s.set(RateLimit{MaxDownMbps: 32})
+	checkRate(t, "after", echoThroughput(t, conn, 3<<20, 512<<10), 32)
+}
+
+func TestShapedConnCloseWakesWaiters(t *testing.T) {
+	s := &shaper{}
+	s.set(RateLimit{MaxUpMbps: 1})
+	raw, err := net.Dial("tcp", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newShapedConn(raw, s)
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 1<<20)) // eight seconds at the limit
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("write completed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close left the write waiting")
+	}
+}
+
+// TestShapedOutboundInSingBox runs the shaping outbound in sing-box, as
+// the final outbound behind a mixed inbound, and measures an echo
+// through it.
+func TestShapedOutboundInSingBox(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	s := &shaper{}
+	s.set(RateLimit{MaxUpMbps: 16})
+	configJSON := fmt.Sprintf(`{
+		"log": {"disabled": true},
+		"inbounds": [{"type": "mixed", "tag": "in", "listen": "127.0.0.1", "listen_port": %d}],
+		"outbounds": [{"type": %q, "tag": %q}],
+		"route": {"final": %q}
+	}`, proxyPort, shapedOutboundType, tagShaped, tagShaped)
+	ctx, cancel := context.WithCancel(boxContext(context.Background(), s))
+	defer cancel()
+	instance, err := startSingBox(ctx, []byte(configJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	echo := echoServer(t)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo, echo)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	checkRate(t, "through sing-box", echoThroughput(t, &bufferedConn{Conn: conn, r: reader}, 2<<20, 256<<10), 16)
+
+	// A live change reaches connections already open.
+	s.set(RateLimit{})
+	if got := echoThroughput(t, &bufferedConn{Conn: conn, r: reader}, 8<<20, 1<<20); got < 2*16 {
+		t.Errorf("after lifting the limit: %.2f Mbps", got)
+	}
+}
+
+// bufferedConn reads through r, which may hold bytes read past a
+// response header.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func TestSetRateLimit(t *testing.T) {
+	e := newStubEngine()
+	var starts atomic.Int64
+	e.startCore = func(context.Context, []byte) (coreBox, error) {
+		starts.Add(1)
+		return stubBox{}, nil
+	}
+
+	if _, err := e.SetRateLimit(context.Background(), RateLimit{MaxDownMbps: 5}, AttemptOptions{}); err != ErrNotConnected {
+		t.Fatalf("while disconnected: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+
+	// An unlimited TCP session is not dialing through the shaper yet.
+	if reconnected, err := e.SetRateLimit(context.Background(), RateLimit{MaxDownMbps: 5}, AttemptOptions{}); err != nil || !reconnected {
+		t.Fatalf("first limit: reconnected %v, %v", reconnected, err)
+	}
+	if limit, mode := e.RateLimit(); limit.MaxDownMbps != 5 || mode != RateLimitShaped {
+		t.Errorf("after the reconnect: %+v %q", limit, mode)
+	}
+	// Now changes apply in place, lifting the limit included.
+	for _, limit := range []RateLimit{{MaxDownMbps: 10, MaxUpMbps: 2}, {}} {
+		if reconnected, err := e.SetRateLimit(context.Background(), limit, AttemptOptions{}); err != nil || reconnected {
+			t.Fatalf("%+v: reconnected %v, %v", limit, reconnected, err)
+		}
+		if got := e.Config().RateLimit; got != limit {
+			t.Errorf("config has %+v, want %+v", got, limit)
+		}
+		if e.shaper.down.rate != mbpsToBytes(limit.MaxDownMbps) {
+			t.Errorf("%+v: shaper down rate %v", limit, e.shaper.down.rate)
+		}
+	}
+	if _, mode := e.RateLimit(); mode != "" {
+		t.Errorf("unlimited session reports mode %q", mode)
+	}
+	if n := starts.Load(); n != 2 {
+		t.Errorf("sing-box started %d times, want 2", n)
+	}
+	if _, err := e.SetRateLimit(context.Background(), RateLimit{MaxUpMbps: -1}, AttemptOptions{}); err == nil {
+		t.Error("invalid limit accepted")
+	}
+}
+
+func TestSetRateLimitHysteria2Reconnects(t *testing.T) {
+	e := newStubEngine()
+	var configs []string
+	e.startCore = func(_ context.Context, configJSON []byte) (coreBox, error) {
+		configs = append(configs, string(configJSON))
+		return stubBox{}, nil
+	}
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "hysteria2://secret@hy.example.com:8443")
+	cfg.HardenInterface = false
+	cfg.RateLimit = RateLimit{MaxUpMbps: 5}
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+	if _, mode := e.RateLimit(); mode != RateLimitHints {
+		t.Fatalf("mode = %q", mode)
+	}
+
+	if reconnected, err := e.SetRateLimit(context.Background(), RateLimit{MaxUpMbps: 10}, AttemptOptions{}); err != nil || !reconnected {
+		t.Fatalf("reconnected %v, %v", reconnected, err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("sing-box started %d times", len(configs))
+	}
+	var doc struct {
+		Outbounds []map[string]interface{} `json:"outbounds"`
+	}
+	if err := json.Unmarshal([]byte(configs[1]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if up := doc.Outbounds[0]["up_mbps"]; up != float64(10) {
+		t.Errorf("reconnected with up_mbps %v, want 10", up)
+	}
+}
@@ -0,0 +1,495 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// A raw outbound is a sing-box outbound the user wrote by hand, for server
+// options no link format covers. The service runs elevated, so it is
+// checked against a whitelist of outbound types and, per type, of fields:
+// nothing that reads files (certificate_path, ech.config_path), runs
+// plugins (shadowsocks plugin), chains to other outbounds (detour) or
+// binds to a chosen interface is accepted. Its tag is forced to the proxy
+// tag; inbounds, DNS and routing are still generated.
+
+// maxRawOutboundSize bounds the JSON of a raw outbound.
+const maxRawOutboundSize = 64 << 10
+
+// RawOutboundError reports why a raw outbound was rejected. Field is the
+// dotted path of the offending field, empty for the outbound as a whole.
+type RawOutboundError struct {
+	Field  string
+	Reason string
+}
+
+func (e *RawOutboundError) Error() string {
+	if e.Field == "" {
+		return "outbound: " + e.Reason
+	}
+	return "outbound." + e.Field + ": " + e.Reason
+}
+
+type fieldKind int
+
+const (
+	kindString   fieldKind = iota
+	kindBool               // true or false
+	kindInt                // a non-negative integer
+	kindPort               // 1-65535
+	kindDuration           // a Go duration string such as "30s"
+	kindStrings            // a string or a list of strings
+	kindHopPorts           // a port range or a list of them, see PortRange
+	kindHeaders            // an object of strings or lists of strings
+	kindObject             // an object with the allowed fields
+)
+
+// rawField is what one allowed field may hold.
+type rawField struct {
+	kind     fieldKind
+	required bool
+	enum     []string // allowed values of a kindString field
+	fields   rawFields
+	// variants replaces fields for a kindObject field whose "type" picks
+	// the allowed fields.
+	variants map[string]rawFields
+}
+
+type rawFields map[string]rawField
+
+func with(sets ...rawFields) rawFields {
+	out := rawFields{}
+	for _, set := range sets {
+		for name, f := range set {
+			out[name] = f
+		}
+	}
+	return out
+}
+
+var (
+	rawDialFields = rawFields{
+		"tag":             {kind: kindString}, // replaced by the proxy tag
+		"server":          {kind: kindString, required: true},
+		"server_port":     {kind: kindPort, required: true},
+		"connect_timeout": {kind: kindDuration},
+		"tcp_fast_open":   {kind: kindBool},
+		"tcp_multi_path":  {kind: kindBool},
+		"udp_fragment":    {kind: kindBool},
+	}
+
+	rawTLS = rawField{kind: kindObject, fields: rawFields{
+		"enabled":                 {kind: kindBool},
+		"disable_sni":             {kind: kindBool},
+		"server_name":             {kind: kindString},
+		"insecure":                {kind: kindBool},
+		"alpn":                    {kind: kindStrings},
+		"min_version":             {kind: kindString, enum: []string{"1.0", "1.1", "1.2", "1.3"}},
+		"max_version":             {kind: kindString, enum: []string{"1.0", "1.1", "1.2", "1.3"}},
+		"cipher_suites":           {kind: kindStrings},
+		"certificate":             {kind: kindStrings}, // inline PEM only
+		"fragment":                {kind: kindBool},
+		"fragment_fallback_delay": {kind: kindDuration},
+		"record_fragment":         {kind: kindBool},
+		"ech": {kind: kindObject, fields: rawFields{
+			"enabled": {kind: kindBool},
+			"config":  {kind: kindStrings}, // inline only
+		}},
+		"utls": {kind: kindObject, fields: rawFields{
+			"enabled":     {kind: kindBool},
+			"fingerprint": {kind: kindString},
+		}},
+		"reality": {kind: kindObject, fields: rawFields{
+			"enabled":    {kind: kindBool},
+			"public_key": {kind: kindString},
+			"short_id":   {kind: kindString},
+		}},
+	}}
+
+	rawMultiplex = rawField{kind: kindObject, fields: rawFields{
+		"enabled":         {kind: kindBool},
+		"protocol":        {kind: kindString, enum: []string{"smux", "yamux", "h2mux"}},
+		"max_connections": {kind: kindInt},
+		"min_streams":     {kind: kindInt},
+		"max_streams":     {kind: kindInt},
+		"padding":         {kind: kindBool},
+		"brutal": {kind: kindObject, fields: rawFields{
+			"enabled":   {kind: kindBool},
+			"up_mbps":   {kind: kindInt},
+			"down_mbps": {kind: kindInt},
+		}},
+	}}
+
+	rawTransport = rawField{kind: kindObject, variants: map[string]rawFields{
+		"ws": {
+			"path":                   {kind: kindString},
+			"headers":                {kind: kindHeaders},
+			"max_early_data":         {kind: kindInt},
+			"early_data_header_name": {kind: kindString},
+		},
+		"grpc": {
+			"service_name":          {kind: kindString},
+			"idle_timeout":          {kind: kindDuration},
+			"ping_timeout":          {kind: kindDuration},
+			"permit_without_stream": {kind: kindBool},
+		},
+		"http": {
+			"host":         {kind: kindStrings},
+			"path":         {kind: kindString},
+			"method":       {kind: kindString},
+			"headers":      {kind: kindHeaders},
+			"idle_timeout": {kind: kindDuration},
+			"ping_timeout": {kind: kindDuration},
+		},
+		"httpupgrade": {
+			"host":    {kind: kindString},
+			"path":    {kind: kindString},
+			"headers": {kind: kindHeaders},
+		},
+		"quic": {},
+	}}
+
+	rawNetwork = rawField{kind: kindString, enum: []string{"tcp", "udp"}}
+
+	// rawOutboundTypes are the allowed outbound types and their fields.
+	rawOutboundTypes = map[string]rawFields{
+		"vless": with(rawDialFields, rawFields{
+			"uuid":            {kind: kindString, required: true},
+			"flow":            {kind: kindString, enum: []string{"", "xtls-rprx-vision"}},
+			"network":         rawNetwork,
+			"tls":             rawTLS,
+			"multiplex":       rawMultiplex,
+			"transport":       rawTransport,
+			"packet_encoding": {kind: kindString, enum: []string{"", "packetaddr", "xudp"}},
+		}),
+		"vmess": with(rawDialFields, rawFields{
+			"uuid":                 {kind: kindString, required: true},
+			"security":             {kind: kindString, enum: []string{"auto", "none", "zero", "aes-128-gcm", "chacha20-poly1305", "aes-128-ctr"}},
+			"alter_id":             {kind: kindInt},
+			"global_padding":       {kind: kindBool},
+			"authenticated_length": {kind: kindBool},
+			"network":              rawNetwork,
+			"tls":                  rawTLS,
+			"packet_encoding":      {kind: kindString, enum: []string{"", "packetaddr", "xudp"}},
+			"multiplex":            rawMultiplex,
+			"transport":            rawTransport,
+		}),
+		"trojan": with(rawDialFields, rawFields{
+			"password":  {kind: kindString, required: true},
+			"network":   rawNetwork,
+			"tls":       rawTLS,
+			"multiplex": rawMultiplex,
+			"transport": rawTransport,
+		}),
+		"shadowsocks": with(rawDialFields, rawFields{
+			"method":   {kind: kindString, required: true},
+			"password": {kind: kindString, required: true},
+			"network":  rawNetwork,
+			"udp_over_tcp": {kind: kindObject, fields: rawFields{
+				"enabled": {kind: kindBool},
+				"version": {kind: kindInt},
+			}},
+			"multiplex": rawMultiplex,
+		}),
+		"hysteria2": with(rawDialFields, rawFields{
+			"server_ports": {kind: kindHopPorts},
+			"hop_interval": {kind: kindDuration},
+			"up_mbps":      {kind: kindInt},
+			"down_mbps":    {kind: kindInt},
+			"obfs": {kind: kindObject, fields: rawFields{
+				"type":     {kind: kindString, enum: []string{"salamander"}},
+				"password": {kind: kindString},
+			}},
+			"password": {kind: kindString},
+			"network":  rawNetwork,
+			"tls":      rawTLS,
+		}),
+		"tuic": with(rawDialFields, rawFields{
+			"uuid":               {kind: kindString, required: true},
+			"password":           {kind: kindString},
+			"congestion_control": {kind: kindString, enum: []string{"cubic", "new_reno", "bbr"}},
+			"udp_relay_mode":     {kind: kindString, enum: []string{"native", "quic"}},
+			"udp_over_stream":    {kind: kindBool},
+			"zero_rtt_handshake": {kind: kindBool},
+			"heartbeat":          {kind: kindDuration},
+			"network":            rawNetwork,
+			"tls":                rawTLS,
+		}),
+	}
+)
+
+// RawOutboundTypes returns the outbound types ParseRawOutbound accepts.
+func RawOutboundTypes() []string {
+	types := make([]string, 0, len(rawOutboundTypes))
+	for t := range rawOutboundTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ParseRawOutbound validates a raw sing-box outbound and returns it with
+// the proxy tag, for Config.RawOutbound, and a server description named
+// name, or after the server when name is empty. Errors are
+// *RawOutboundError.
+func ParseRawOutbound(data []byte, name string) (map[string]interface{}, *parser.ServerConfig, error) {
+	if len(data) > maxRawOutboundSize {
+		return nil, nil, &RawOutboundError{Reason: fmt.Sprintf("larger than %d bytes", maxRawOutboundSize)}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var outbound map[string]interface{}
+	if err := dec.Decode(&outbound); err != nil || outbound == nil {
+		return nil, nil, &RawOutboundError{Reason: "not a JSON object"}
+	}
+	if dec.More() {
+		return nil, nil, &RawOutboundError{Reason: "trailing data after the object"}
+	}
+
+	typ, _ := outbound["type"].(string)
+	fields, ok := rawOutboundTypes[typ]
+	if !ok {
+		return nil, nil, &RawOutboundError{Field: "type", Reason: fmt.Sprintf("must be one of %s", strings.Join(RawOutboundTypes(), ", "))}
+	}
+	if err := checkRawObject("", outbound, fields, true); err != nil {
+		return nil, nil, err
+	}
+	server := outbound["server"].(string)
+	if server == "" || strings.ContainsAny(server, "/\\ \t") {
+		return nil, nil, &RawOutboundError{Field: "server", Reason: "must be a host name or IP address"}
+	}
+	port, _ := outbound["server_port"].(json.Number).Int64()
+
+	outbound["tag"] = tagProxy
+	if name == "" {
+		name = net.JoinHostPort(server, fmt.Sprint(port))
+	}
+	return outbound, &parser.ServerConfig{
+		Protocol: typ,
+		Name:     name,
+		Address:  server,
+		Port:     uint16(port),
+		Params:   map[string]string{},
+	}, nil
+}
+
+// checkRawObject checks obj holds only allowed fields of the allowed kinds.
+// typed says obj's "type" was already checked by the caller.
+func checkRawObject(path string, obj map[string]interface{}, fields rawFields, typed bool) error {
+	for name, f := range fields {
+		if _, ok := obj[name]; !ok && f.required {
+			return &RawOutboundError{Field: join(path, name), Reason: "is required"}
+		}
+	}
+	// Sorted, so the same outbound always reports the same field.
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := obj[name]
+		if name == "type" && typed {
+			continue
+		}
+		f, ok := fields[name]
+		if !ok {
+			return &RawOutboundError{Field: join(path, name), Reason: "field not allowed"}
+		}
+		if err := checkRawValue(join(path, name), value, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRawValue(path string, value interface{}, f rawField) error {
+	invalid := func(want string) error {
+		return &RawOutboundError{Field: path, Reason: "must be " + want}
+	}
+	switch f.kind {
+	case kindString:
+		s, ok := value.(string)
+		if !ok {
+			return invalid("a string")
+		}
+		if f.enum != nil && !contains(f.enum, s) {
+			return invalid(fmt.Sprintf("one of %q", f.enum))
+		}
+	case kindBool:
+		if _, ok := value.(bool); !ok {
+			return invalid("true or false")
+		}
+	case kindInt, kindPort:
+		n, ok := value.(json.Number)
+		if !ok {
+			return invalid("a number")
+		}
+		i, err := n.Int64()
+		if f.kind == kindPort && (err != nil || i < 1 || i > 65535) {
+			return invalid("a port number")
+		}
+		if err != nil || i < 0 || i > 1<<31-1 {
+			return invalid("a non-negative integer")
+		}
+	case kindDuration:
+		s, ok := value.(string)
+		if !ok {
+			return invalid("a duration such as \"30s\"")
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return invalid("a duration such as \"30s\"")
+		}
+	case kindStrings:
+		if !isStrings(value) {
+			return invalid("a string or a list of strings")
+		}
+	case kindHopPorts:
+		if _, ok := portRanges(value); !ok {
+			return invalid("a port range such as \"20000:30000\" or a list of them")
+		}
+	case kindHeaders:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return invalid("an object")
+		}
+		for name, v := range obj {
+			if !isStrings(v) {
+				return &RawOutboundError{Field: join(path, name), Reason: "must be a string or a list of strings"}
+			}
+		}
+	case kindObject:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return invalid("an object")
+		}
+		if f.variants == nil {
+			return checkRawObject(path, obj, f.fields, false)
+		}
+		typ, _ := obj["type"].(string)
+		fields, ok := f.variants[typ]
+		if !ok {
+			types := make([]string, 0, len(f.variants))
+			for t := range f.variants {
+				types = append(types, t)
+			}
+			sort.Strings(types)
+			return &RawOutboundError{Field: join(path, "type"), Reason: fmt.Sprintf("must be one of %s", strings.Join(types, ", "))}
+		}
+		return checkRawObject(path, obj, fields, true)
+	}
+	return nil
+}
+
+func isStrings(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return true
+	case []interface{}:
+		for _, item := range v {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// PortRange is an inclusive range of server ports.
+type PortRange struct {
+	Lo, Hi uint16
+}
+
+func (r PortRange) String() string {
+	if r.Lo == r.Hi {
+		return fmt.Sprint(r.Lo)
+	}
+	return fmt.Sprintf("%d:%d", r.Lo, r.Hi)
+}
+
+// RawServerPorts returns the ports a raw outbound from ParseRawOutbound may
+// dial besides server_port: the server_ports ranges of hysteria2 port
+// hopping.
+func RawServerPorts(outbound map[string]interface{}) []PortRange {
+	ranges, _ := portRanges(outbound["server_ports"])
+	return ranges
+}
+
+// portRanges parses a port range or a list of them. A range is a port or
+// "lo:hi" as sing-box writes it; "lo-hi" is taken too.
+func portRanges(value interface{}) ([]PortRange, bool) {
+	var items []interface{}
+	switch v := value.(type) {
+	case nil:
+		return nil, true
+	case string:
+		items = []interface{}{v}
+	case []interface{}:
+		items = v
+	default:
+		return nil, false
+	}
+	ranges := make([]PortRange, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		lo, hi, found := strings.Cut(s, ":")
+		if !found {
+			lo, hi, found = strings.Cut(s, "-")
+		}
+		if !found {
+			hi = lo
+		}
+		l, errLo := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+		h, errHi := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if errLo != nil || errHi != nil || l == 0 || l > h {
+			return nil, false
+		}
+		ranges = append(ranges, PortRange{Lo: uint16(l), Hi: uint16(h)})
+	}
+	return ranges, true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// copyRawOutbound returns a deep copy of a raw outbound, so building a
+// config never changes the one kept in Config.
+func copyRawOutbound(outbound map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(outbound)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out map[string]interface{}
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	out["tag"] = tagProxy
+	return out, nil
+}
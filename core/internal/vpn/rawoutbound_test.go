@@ -0,0 +1,150 @@
+package vpn
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRawOutbound(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"vless reality", `{"type":"vless","tag":"mine","server":"example.com","server_port":443,"uuid":"u","flow":"xtls-rprx-vision",
+			"tls":{"enabled":true,"server_name":"example.com","utls":{"enabled":true,"fingerprint":"chrome"},"reality":{"enabled":true,"public_key":"k","short_id":"ab"}}}`},
+		{"vmess ws", `{"type":"vmess","server":"1.2.3.4","server_port":8080,"uuid":"u","security":"auto",
+			"transport":{"type":"ws","path":"/ws","headers":{"Host":"cdn.example.com"}}}`},
+		{"trojan grpc", `{"type":"trojan","server":"example.com","server_port":443,"password":"p","tls":{"enabled":true,"alpn":["h2"]},
+			"transport":{"type":"grpc","service_name":"svc"},"multiplex":{"enabled":true,"protocol":"h2mux"}}`},
+		{"shadowsocks", `{"type":"shadowsocks","server":"example.com","server_port":8388,"method":"2022-blake3-aes-128-gcm","password":"p","udp_over_tcp":{"enabled":true,"version":2}}`},
+		{"hysteria2", `{"type":"hysteria2","server":"example.com","server_port":443,"password":"p","server_ports":["20000:30000"],"hop_interval":"30s","obfs":{"type":"salamander","password":"o"}}`},
+		{"tuic", `{"type":"tuic","server":"example.com","server_port":443,"uuid":"u","password":"p","congestion_control":"bbr","tls":{"enabled":true,"alpn":"h3"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbound, server, err := ParseRawOutbound([]byte(tt.json), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outbound["tag"] != tagProxy {
+				t.Errorf("tag = %v, want %s", outbound["tag"], tagProxy)
+			}
+			if server.Protocol != outbound["type"] || server.Address != outbound["server"] || server.Port == 0 {
+				t.Errorf("server = %+v", server)
+			}
+			if !strings.HasPrefix(server.Name, server.Address+":") {
+				t.Errorf("name = %q", server.Name)
+			}
+		})
+	}
+
+	_, server, err := ParseRawOutbound([]byte(`{"type":"trojan","server":"example.com","server_port":443,"password":"p"}`), "Work")
+	if err != nil || server.Name != "Work" {
+		t.Errorf("named: server = %+v, err = %v", server, err)
+	}
+
+	outbound, _, err := ParseRawOutbound([]byte(`{"type":"hysteria2","server":"example.com","server_port":443,"server_ports":["20000:30000","40000-40010","443"]}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PortRange{{20000, 30000}, {40000, 40010}, {443, 443}}
+	if got := RawServerPorts(outbound); !reflect.DeepEqual(got, want) {
+		t.Errorf("server ports = %v, want %v", got, want)
+	}
+}
+
+// TestParseRawOutboundRejects covers fields that would let a raw outbound
+// read files, run programs or escape the tunnel in the elevated service.
+func TestParseRawOutboundRejects(t *testing.T) {
+	const base = `"server":"example.com","server_port":443`
+	tests := []struct {
+		name  string
+		json  string
+		field string
+	}{
+		{"detour", `{"type":"vless",` + base + `,"uuid":"u","detour":"direct"}`, "detour"},
+		{"bind interface", `{"type":"vless",` + base + `,"uuid":"u","bind_interface":"eth0"}`, "bind_interface"},
+		{"routing mark", `{"type":"trojan",` + base + `,"password":"p","routing_mark":1}`, "routing_mark"},
+		{"certificate path", `{"type":"trojan",` + base + `,"password":"p","tls":{"enabled":true,"certificate_path":"C:\\secret.pem"}}`, "tls.certificate_path"},
+		{"ech config path", `{"type":"vless",` + base + `,"uuid":"u","tls":{"ech":{"enabled":true,"config_path":"C:\\ech"}}}`, "tls.ech.config_path"},
+		{"shadowsocks plugin", `{"type":"shadowsocks",` + base + `,"method":"aes-128-gcm","password":"p","plugin":"obfs-local","plugin_opts":"obfs=http"}`, "plugin"},
+		{"direct type", `{"type":"direct",` + base + `}`, "type"},
+		{"selector type", `{"type":"selector","outbounds":["proxy"]}`, "type"},
+		{"missing type", `{` + base + `}`, "type"},
+		{"transport type", `{"type":"vmess",` + base + `,"uuid":"u","transport":{"type":"unix","path":"/tmp/s"}}`, "transport.type"},
+		{"transport field", `{"type":"vmess",` + base + `,"uuid":"u","transport":{"type":"ws","path":"/","dial":"x"}}`, "transport.dial"},
+		{"missing field", `{"type":"vless",` + base + `}`, "uuid"},
+		{"wrong kind", `{"type":"vless",` + base + `,"uuid":"u","tcp_fast_open":"yes"}`, "tcp_fast_open"},
+		{"bad port", `{"type":"vless","server":"example.com","server_port":70000,"uuid":"u"}`, "server_port"},
+		{"bad duration", `{"type":"vless",` + base + `,"uuid":"u","connect_timeout":"soon"}`, "connect_timeout"},
+		{"bad server ports", `{"type":"hysteria2",` + base + `,"server_ports":["30000:20000"]}`, "server_ports"},
+		{"server ports not a range", `{"type":"hysteria2",` + base + `,"server_ports":"any"}`, "server_ports"},
+		{"bad enum", `{"type":"vless",` + base + `,"uuid":"u","flow":"xtls-rprx-direct"}`, "flow"},
+		{"bad server", `{"type":"vless","server":"a b","server_port":443,"uuid":"u"}`, "server"},
+		{"not an object", `["vless"]`, ""},
+		{"trailing data", `{"type":"vless",` + base + `,"uuid":"u"} {}`, ""},
+		{"too large", `{"type":"vless",` + base + `,"uuid":"` + strings.Repeat("u", maxRawOutboundSize) + `"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseRawOutbound([]byte(tt.json), "")
+			var rawErr *RawOutboundError
+			if !errors.As(err, &rawErr) {
+				t.Fatalf("err = %v, want a RawOutboundError", err)
+			}
+			if rawErr.Field != tt.field {
+				t.Errorf("field = %q, want %q (%v)", rawErr.Field, tt.field, err)
+			}
+		})
+	}
+}
+
+func TestRawOutboundSplicedIntoConfig(t *testing.T) {
+	outbound, server, err := ParseRawOutbound([]byte(`{"type":"tuic","tag":"x","server":"example.com","server_port":443,"uuid":"u","tls":{"enabled":true}}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Server = server
+	cfg.RawOutbound = outbound
+
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Outbounds []map[string]interface{} `json:"outbounds"`
+		Route     struct {
+			Final string `json:"final"`
+		} `json:"route"`
+	}
+	if err := json.Unmarshal(built.JSON, &out); err != nil {
+		t.Fatal(err)
+	}
+	var proxy map[string]interface{}
+	for _, o := range out.Outbounds {
+		if o["tag"] == tagProxy {
+			proxy = o
+		}
+	}
+	if proxy == nil || proxy["type"] != "tuic" || proxy["uuid"] != "u" {
+		t.Fatalf("proxy outbound = %v", proxy)
+	}
+	if out.Route.Final != tagProxy {
+		t.Errorf("route.final = %q, want %s", out.Route.Final, tagProxy)
+	}
+	// The kept outbound is not changed by building.
+	outbound["uuid"] = "changed"
+	if proxy["uuid"] != "u" {
+		t.Error("built outbound shares the raw outbound")
+	}
+
+	// TUIC runs over QUIC like Hysteria2.
+	cfg.TransportPolicy = TransportTCPOnly
+	if _, err := BuildSingBoxConfig(cfg); !errors.Is(err, ErrTransportConflict) {
+		t.Errorf("tcp-only tuic: err = %v, want ErrTransportConflict", err)
+	}
+}
@@ -0,0 +1,193 @@
+package vpn
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// realityPostMortemTimeout bounds the whole post-mortem.
+const realityPostMortemTimeout = 3 * time.Second
+
+// sntpTimeout bounds the SNTP query, leaving the rest of the post-mortem
+// to the HTTPS fallback when UDP/123 is blocked.
+const sntpTimeout = time.Second
+
+// maxClockSkew is the offset beyond which REALITY authentication is
+// expected to fail.
+const maxClockSkew = 90 * time.Second
+
+// RealityDiagnosis is the outcome of a REALITY post-mortem, run when the
+// health probes of a REALITY session fail through the proxy.
+type RealityDiagnosis struct {
+	ClockOffsetMs  int64  `json:"clockOffsetMs,omitempty"` // local clock minus reference time; valid if ClockChecked
+	ClockChecked   bool   `json:"clockChecked"`
+	DecoyReachable bool   `json:"decoyReachable"` // a plain TLS handshake to the SNI target succeeded
+	Hint           string `json:"hint"`           // the most likely cause, in English
+}
+
+// hint returns a short explanation of the most likely cause.
+func (d RealityDiagnosis) hint() string {
+	offset := time.Duration(d.ClockOffsetMs) * time.Millisecond
+	switch {
+	case d.ClockChecked && ClockSkewed(offset):
+		return fmt.Sprintf("system clock is off by %s; sync the Windows clock and retry", offset.Round(time.Second))
+	case !d.DecoyReachable:
+		return "the REALITY camouflage site (SNI) is unreachable from this network"
+	default:
+		return "clock and camouflage site look fine; check the public key and short ID"
+	}
+}
+
+// realityProbes are the network checks of the post-mortem, replaceable in
+// tests.
+type realityProbes struct {
+	clockOffset func(ctx context.Context) (time.Duration, error)
+	dialDecoy   func(ctx context.Context, sni string) error
+}
+
+var defaultRealityProbes = realityProbes{
+	clockOffset: probeClockOffset,
+	dialDecoy:   probeDecoy,
+}
+
+// diagnoseReality runs a time-bounded post-mortem when a health probe of a
+// session to a REALITY server failed through the proxy, which is where a
+// rejected REALITY handshake shows: sing-box starts without contacting the
+// server. It reports false, running nothing, for other servers and other
+// failures, such as the Clash API not answering.
+func diagnoseReality(ctx context.Context, server *parser.ServerConfig, probeErr error, probes realityProbes) (RealityDiagnosis, bool) {
+	if server == nil || server.Params["security"] != "reality" || !errors.Is(probeErr, errProxyProbeFailed) {
+		return RealityDiagnosis{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, realityPostMortemTimeout)
+	defer cancel()
+
+	sni := server.Params["sni"]
+	if sni == "" {
+		sni = server.Address
+	}
+
+	// Both probes run concurrently so the post-mortem fits the time bound.
+	type clockResult struct {
+		offset time.Duration
+		err    error
+	}
+	clockCh := make(chan clockResult, 1)
+	decoyCh := make(chan error, 1)
+	go func() {
+		offset, err := probes.clockOffset(ctx)
+		clockCh <- clockResult{offset, err}
+	}()
+	go func() { decoyCh <- probes.dialDecoy(ctx, sni) }()
+
+	var d RealityDiagnosis
+	clock := <-clockCh
+	if clock.err == nil {
+		d.ClockChecked = true
+		d.ClockOffsetMs = clock.offset.Milliseconds()
+	}
+	d.DecoyReachable = <-decoyCh == nil
+	d.Hint = d.hint()
+	return d, true
+}
+
+// ntpEpochOffset is the number of seconds between 1900 and 1970.
+const ntpEpochOffset = 2208988800
+
+// ClockOffset measures the local clock's offset from network time, the
+// same way the REALITY post-mortem does.
+func ClockOffset(ctx context.Context) (time.Duration, error) {
+	return probeClockOffset(ctx)
+}
+
+// ClockSkewed reports whether a clock offset is large enough for REALITY
+// authentication to fail.
+func ClockSkewed(offset time.Duration) bool {
+	return offset > maxClockSkew || offset < -maxClockSkew
+}
+
+// probeClockOffset measures the local clock offset with SNTP, falling back
+// to the Date header of an HTTPS response (second resolution) when UDP/123
+// is blocked.
+func probeClockOffset(ctx context.Context) (time.Duration, error) {
+	sntpCtx, cancel := context.WithTimeout(ctx, sntpTimeout)
+	offset, err := sntpOffset(sntpCtx, "time.cloudflare.com:123")
+	cancel()
+	if err == nil {
+		return offset, nil
+	}
+	return httpDateOffset(ctx, "https://www.cloudflare.com/")
+}
+
+func sntpOffset(ctx context.Context, addr string) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x1b // LI 0, version 3, client mode
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	if _, err := conn.Read(resp); err != nil {
+		return 0, err
+	}
+	received := time.Now()
+
+	// Transmit timestamp: seconds and fraction since 1900.
+	secs := binary.BigEndian.Uint32(resp[40:44])
+	frac := binary.BigEndian.Uint32(resp[44:48])
+	if secs == 0 {
+		return 0, fmt.Errorf("empty NTP response")
+	}
+	server := time.Unix(int64(secs)-ntpEpochOffset, int64(frac)*1e9>>32)
+	local := sent.Add(received.Sub(sent) / 2)
+	return local.Sub(server), nil
+}
+
+func httpDateOffset(ctx context.Context, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	sent := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	server, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no usable Date header: %w", err)
+	}
+	local := sent.Add(time.Since(sent) / 2)
+	return local.Sub(server), nil
+}
+
+// probeDecoy checks that the site REALITY impersonates answers a normal TLS
+// handshake.
+func probeDecoy(ctx context.Context, sni string) error {
+	d := tls.Dialer{Config: &tls.Config{ServerName: sni}}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(sni, "443"))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
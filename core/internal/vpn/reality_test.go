@@ -0,0 +1,145 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+func realityServer() *parser.ServerConfig {
+	return &parser.ServerConfig{Protocol: "vless", Address: "1.2.3.4", Port: 443,
+		Params: map[string]string{"uuid": "u", "security": "reality", "sni": "www.example.com"}}
+}
+
+func fakeProbes(offset time.Duration, clockErr, decoyErr error) (realityProbes, *string) {
+	var dialed string
+	return realityProbes{
+		clockOffset: func(context.Context) (time.Duration, error) { return offset, clockErr },
+		dialDecoy: func(_ context.Context, sni string) error {
+			dialed = sni
+			return decoyErr
+		},
+	}, &dialed
+}
+
+// probeFailure is a health probe that failed through the proxy.
+var probeFailure = fmt.Errorf("delay test: 503 Service Unavailable: %w", errProxyProbeFailed)
+
+func TestRealityPostMortemClockSkew(t *testing.T) {
+	probes, dialed := fakeProbes(-3*time.Minute, nil, nil)
+
+	d, ok := diagnoseReality(context.Background(), realityServer(), probeFailure, probes)
+	if !ok {
+		t.Fatal("no post-mortem")
+	}
+	if !d.ClockChecked || d.ClockOffsetMs != -180000 || !d.DecoyReachable {
+		t.Errorf("diagnosis = %+v", d)
+	}
+	if !strings.Contains(d.Hint, "clock") {
+		t.Errorf("hint = %q, want clock advice", d.Hint)
+	}
+	if *dialed != "www.example.com" {
+		t.Errorf("decoy dialed %q, want the SNI", *dialed)
+	}
+}
+
+func TestRealityPostMortemDecoyUnreachable(t *testing.T) {
+	probes, _ := fakeProbes(0, errors.New("udp blocked"), errors.New("timeout"))
+	d, ok := diagnoseReality(context.Background(), realityServer(), probeFailure, probes)
+	if !ok {
+		t.Fatal("no post-mortem")
+	}
+	if d.ClockChecked || d.DecoyReachable {
+		t.Errorf("diagnosis = %+v", d)
+	}
+	if !strings.Contains(d.Hint, "unreachable") {
+		t.Errorf("hint = %q", d.Hint)
+	}
+}
+
+func TestRealityPostMortemSkipped(t *testing.T) {
+	probes := realityProbes{
+		clockOffset: func(context.Context) (time.Duration, error) {
+			t.Error("clock probe ran")
+			return 0, nil
+		},
+		dialDecoy: func(context.Context, string) error {
+			t.Error("decoy probe ran")
+			return nil
+		},
+	}
+
+	tls := realityServer()
+	tls.Params["security"] = "tls"
+	tests := []struct {
+		name   string
+		server *parser.ServerConfig
+		err    error
+	}{
+		{"not reality", tls, probeFailure},
+		{"clash api down", realityServer(), errors.New("dial tcp 127.0.0.1:9090: connection refused")},
+		{"local message", realityServer(), errors.New("tls handshake timeout")},
+		{"no server", nil, probeFailure},
+	}
+	for _, tt := range tests {
+		if _, ok := diagnoseReality(context.Background(), tt.server, tt.err, probes); ok {
+			t.Errorf("%s: post-mortem ran", tt.name)
+		}
+	}
+}
+
+func TestRealityPostMortemBounded(t *testing.T) {
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	probes := realityProbes{
+		clockOffset: func(ctx context.Context) (time.Duration, error) { return 0, slow(ctx) },
+		dialDecoy:   func(ctx context.Context, _ string) error { return slow(ctx) },
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, ok := diagnoseReality(ctx, realityServer(), probeFailure, probes); !ok {
+		t.Fatal("no post-mortem")
+	}
+	if elapsed := time.Since(start); elapsed > realityPostMortemTimeout {
+		t.Errorf("post-mortem took %s", elapsed)
+	}
+}
+
+func TestRealityPostMortemOnDegradedSession(t *testing.T) {
+	e := newStubEngine()
+	e.healthInterval = time.Millisecond
+	e.SetHealthThresholds(HealthThresholds{FailedProbes: 2, RTTMs: 1000, RecoveryProbes: 1})
+	e.probeDelay = func(context.Context, string) (int64, error) { return 0, probeFailure }
+	e.reality, _ = fakeProbes(-3*time.Minute, nil, nil)
+	changes := make(chan SessionHealth, 4)
+	e.stateMachine.OnHealthChanged(func(h SessionHealth) { changes <- h })
+
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&sni=www.example.com")
+	cfg.HardenInterface = false
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+
+	select {
+	case h := <-changes:
+		if h.Healthy || h.Reality == nil || !strings.Contains(h.Reality.Hint, "clock") {
+			t.Errorf("degraded = %+v", h)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no health change reported")
+	}
+	if h, _ := e.Health(); h.Reality == nil {
+		t.Errorf("Health = %+v, want the post-mortem", h)
+	}
+}
@@ -0,0 +1,155 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// A session runs from a connect until the disconnect or failure that ends
+// it. Within it the engine may re-establish the tunnel, replacing the
+// sing-box instance: each instance is one link. Uptime, traffic totals and
+// the connect history belong to the session, so a reconnect shows up as
+// an event within it rather than as a new session.
+
+// ReconnectListener is a callback invoked when a session's link was
+// re-established.
+type ReconnectListener func(r Reconnect)
+
+// Reconnect describes one re-established link.
+type Reconnect struct {
+	Server         *parser.ServerConfig
+	SessionStarted time.Time // when the session's connect started; matches ConnectTiming.At
+	At             time.Time // when the reconnect started
+	DownMs         int64     // from tearing down the old link until the new one was up
+}
+
+// sessionCarry is what a session's earlier links add to the current one.
+type sessionCarry struct {
+	traffic     Traffic
+	tunUpload   int64
+	tunDownload int64
+	reconnects  int
+}
+
+// plus returns the sum of two traffic totals.
+func (t Traffic) plus(o Traffic) Traffic {
+	return Traffic{
+		Upload:         t.Upload + o.Upload,
+		Download:       t.Download + o.Download,
+		DirectUpload:   t.DirectUpload + o.DirectUpload,
+		DirectDownload: t.DirectDownload + o.DirectDownload,
+	}
+}
+
+// Reconnect re-establishes the tunnel of the current session with the
+// session's config, as after the link failed or to apply changes that need
+// a new sing-box instance. The session keeps its start time and traffic
+// totals. If the link cannot be re-established the session ends: it is
+// reported to session end listeners with ReasonFailed, or with the reason
+// of the disconnect or switch that preempted the reconnect.
+func (e *Engine) Reconnect(ctx context.Context) error {
+	return e.ReconnectWith(ctx, AttemptOptions{})
+}
+
+// ReconnectWith is Reconnect with the attempt policy and origin of opts. A
+// reconnect that is refused or preempted returns an *AttemptError.
+func (e *Engine) ReconnectWith(ctx context.Context, opts AttemptOptions) error {
+	return e.reconnect(ctx, opts, nil)
+}
+
+// reconnect is ReconnectWith, first applying update, if set, to a copy of
+// the session's config once the reconnect has the engine.
+func (e *Engine) reconnect(ctx context.Context, opts AttemptOptions, update func(cfg *Config)) error {
+	ctx, done, err := e.attempts.acquire(ctx, AttemptReconnect, opts)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.box == nil {
+		return ErrNotConnected
+	}
+	cfg := e.config
+	if update != nil {
+		updated := *cfg
+		update(&updated)
+		cfg = &updated
+		e.config = cfg
+	}
+	e.carried.traffic = e.carried.traffic.plus(e.lastTraffic)
+	e.carried.tunUpload += e.lastTun[0]
+	e.carried.tunDownload += e.lastTun[1]
+	e.carried.reconnects++
+	// The session's connect is recorded before any reconnect within it.
+	if e.timingPending {
+		e.timingPending = false
+		e.stateMachine.NotifyConnectTiming(e.timing)
+	}
+
+	started := time.Now()
+	e.stateMachine.SetStateReason(StateConnecting, ReasonReconnect)
+	e.closeLink()
+
+	if err := e.establish(ctx, cfg, started, true); err != nil {
+		reason := ReasonFailed
+		if ctx.Err() != nil {
+			err = attemptErr(ctx)
+			reason = preemptedReason(err, reason)
+		}
+		log.Printf("reconnect failed, ending the session: %v", err)
+		e.domains.clear()
+		e.stateMachine.NotifySessionEnd(SessionEnd{
+			Server:     e.timing.Server,
+			StartedAt:  e.timing.At,
+			EndedAt:    time.Now(),
+			Reason:     reason,
+			Reconnects: e.carried.reconnects - 1,
+		})
+		return err
+	}
+	e.stateMachine.NotifyReconnect(Reconnect{
+		Server:         e.timing.Server,
+		SessionStarted: e.timing.At,
+		At:             started,
+		DownMs:         e.connectedAt.Sub(started).Milliseconds(),
+	})
+	return nil
+}
+
+// preemptedReason returns the reason a session ends with when err, from
+// an attempt within it, is a preemption: that of the disconnect, or
+// ReasonSwitch for a connect. Otherwise it returns fallback.
+func preemptedReason(err error, fallback string) string {
+	var preempted *AttemptError
+	if !errors.As(err, &preempted) || preempted.Outcome != OutcomePreempted {
+		return fallback
+	}
+	if preempted.Winner.Kind == AttemptDisconnect && preempted.Winner.Origin != "" {
+		return preempted.Winner.Origin
+	}
+	return ReasonSwitch
+}
+
+// SessionStartedAt returns when the current session first connected; zero
+// when disconnected.
+func (e *Engine) SessionStartedAt() time.Time {
+	return e.stateMachine.SessionStartedAt()
+}
+
+// Reconnects returns how often the current session's link was
+// re-established.
+func (e *Engine) Reconnects() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil {
+		return 0
+	}
+	return e.carried.reconnects
+}
@@ -0,0 +1,117 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionRecorder collects what a session reports to listeners.
+type sessionRecorder struct {
+	mu          sync.Mutex
+	transitions []Transition
+	timings     []ConnectTiming
+	reconnects  []Reconnect
+	ends        []SessionEnd
+}
+
+func recordSession(sm *StateMachine) *sessionRecorder {
+	r := &sessionRecorder{}
+	sm.OnTransition(func(t Transition) { r.mu.Lock(); r.transitions = append(r.transitions, t); r.mu.Unlock() })
+	sm.OnConnectTiming(func(t ConnectTiming) { r.mu.Lock(); r.timings = append(r.timings, t); r.mu.Unlock() })
+	sm.OnReconnect(func(rc Reconnect) { r.mu.Lock(); r.reconnects = append(r.reconnects, rc); r.mu.Unlock() })
+	sm.OnSessionEnd(func(end SessionEnd) { r.mu.Lock(); r.ends = append(r.ends, end); r.mu.Unlock() })
+	return r
+}
+
+func TestSessionSpansReconnects(t *testing.T) {
+	e := newStubEngine()
+	rec := recordSession(e.stateMachine)
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	started := e.SessionStartedAt()
+	firstLink := e.ConnectedAt()
+	waitFor(t, "the first link's traffic", func() bool { return e.Traffic().Download == 1 })
+
+	time.Sleep(5 * time.Millisecond)
+	if err := e.Reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !e.SessionStartedAt().Equal(started) || !e.ConnectedAt().After(firstLink) {
+		t.Errorf("session started %v (want %v), link %v", e.SessionStartedAt(), started, e.ConnectedAt())
+	}
+	if e.Reconnects() != 1 || e.stateMachine.Reason() != ReasonReconnect {
+		t.Errorf("reconnects = %d, reason = %q", e.Reconnects(), e.stateMachine.Reason())
+	}
+	// The second link's download (2) adds to the first one's.
+	waitFor(t, "the session's traffic", func() bool { return e.Traffic().Download == 3 })
+
+	if err := e.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.timings) != 1 || len(rec.ends) != 1 || len(rec.reconnects) != 1 {
+		t.Fatalf("timings %d, ends %d, reconnects %d; want one each", len(rec.timings), len(rec.ends), len(rec.reconnects))
+	}
+	at := rec.timings[0].At
+	if rc := rec.reconnects[0]; !rc.SessionStarted.Equal(at) || rc.Server != cfg.Server || rc.DownMs < 0 {
+		t.Errorf("reconnect = %+v", rc)
+	}
+	if end := rec.ends[0]; !end.StartedAt.Equal(at) || end.Reconnects != 1 || end.Reason != ReasonUser {
+		t.Errorf("session end = %+v", end)
+	}
+	last := rec.transitions[len(rec.transitions)-1]
+	if last.State != StateDisconnected || last.Duration != last.At.Sub(started) {
+		t.Errorf("disconnect duration %s, want %s since the session started", last.Duration, last.At.Sub(started))
+	}
+	for _, tr := range rec.transitions {
+		if tr.State == StateConnected && !tr.SessionStartedAt.Equal(started) {
+			t.Errorf("connected transition %d started its own session at %v", tr.ID, tr.SessionStartedAt)
+		}
+	}
+	if !e.SessionStartedAt().IsZero() || e.Reconnects() != 0 {
+		t.Error("session outlived the disconnect")
+	}
+}
+
+func TestFailedReconnectEndsSession(t *testing.T) {
+	e := newStubEngine()
+	rec := recordSession(e.stateMachine)
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+
+	if err := e.Reconnect(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("reconnect while disconnected = %v", err)
+	}
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	e.startCore = func(context.Context, []byte) (coreBox, error) {
+		return nil, errors.New("server unreachable")
+	}
+	if err := e.Reconnect(context.Background()); err == nil {
+		t.Fatal("reconnect succeeded")
+	}
+	if s := e.stateMachine.State(); s != StateError {
+		t.Errorf("state = %s, want error", s)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	// The connect is recorded even though it never carried traffic.
+	if len(rec.timings) != 1 || len(rec.reconnects) != 0 || len(rec.ends) != 1 {
+		t.Fatalf("timings %d, reconnects %d, ends %d", len(rec.timings), len(rec.reconnects), len(rec.ends))
+	}
+	if end := rec.ends[0]; end.Reason != ReasonFailed || end.Reconnects != 0 || !end.StartedAt.Equal(rec.timings[0].At) {
+		t.Errorf("session end = %+v", end)
+	}
+}
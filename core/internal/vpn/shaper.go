@@ -0,0 +1,263 @@
+package vpn
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	box "github.com/sagernet/sing-box"
+	"github.com/sagernet/sing-box/adapter"
+	sbOutbound "github.com/sagernet/sing-box/adapter/outbound"
+	"github.com/sagernet/sing-box/include"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing-box/protocol/direct"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// The shaping outbound is a direct outbound whose connections pass
+// through the engine's shaper. The proxy outbound of a shaped session
+// dials the server through it (see RateLimitShaped).
+const (
+	shapedOutboundType = "mrvpn-shaped"
+	tagShaped          = "shaped"
+)
+
+const (
+	// shapeChunk bounds the bytes one read or write takes from a bucket,
+	// so a large write is paced rather than sent in one burst.
+	shapeChunk = 16 << 10
+	// shapeBurst is how much of its rate a bucket lets through at once
+	// after a quiet spell.
+	shapeBurst = 50 * time.Millisecond
+	// minShapeBurst keeps a low rate's burst above one chunk.
+	minShapeBurst = 2 * shapeChunk
+)
+
+// tokenBucket paces bytes to a rate. Callers reserve what they send and
+// wait out any deficit, so concurrent connections share the rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second; 0 is unlimited
+	tokens float64 // negative while reserved bytes are still being waited out
+	last   time.Time
+	now    func() time.Time // replaced in tests
+}
+
+// setRate changes the rate, in bytes per second, for the bytes reserved
+// from now on.
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.rate = rate
+	if burst := b.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// reserve takes n bytes and returns how long to wait before sending them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last call; mu must be held.
+func (b *tokenBucket) refill() {
+	now := b.clock()
+	if b.rate == 0 {
+		b.tokens = 0
+	} else if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if burst := b.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// burst returns the most tokens the bucket holds; mu must be held.
+func (b *tokenBucket) burst() float64 {
+	burst := b.rate * shapeBurst.Seconds()
+	if burst < minShapeBurst {
+		burst = minShapeBurst
+	}
+	return burst
+}
+
+func (b *tokenBucket) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+// shaper holds the engine's upload and download buckets, which every
+// connection through the shaping outbound shares.
+type shaper struct {
+	up, down tokenBucket
+}
+
+// set applies limit; a zero direction is unlimited.
+func (s *shaper) set(limit RateLimit) {
+	s.up.setRate(mbpsToBytes(limit.MaxUpMbps))
+	s.down.setRate(mbpsToBytes(limit.MaxDownMbps))
+}
+
+func mbpsToBytes(mbps int) float64 {
+	return float64(mbps) * 1e6 / 8
+}
+
+// wait sleeps for d, or until done is closed, which returns net.ErrClosed.
+func wait(d time.Duration, done <-chan struct{}) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return net.ErrClosed
+	}
+}
+
+// shapedConn paces a connection's reads and writes with a shaper. Holding
+// back reads backs up the TCP window, which slows the sender down to the
+// rate. It exposes only net.Conn, so copy paths cannot bypass it.
+type shapedConn struct {
+	net.Conn
+	shaper    *shaper
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newShapedConn(conn net.Conn, s *shaper) *shapedConn {
+	return &shapedConn{Conn: conn, shaper: s, closed: make(chan struct{})}
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if len(p) > shapeChunk {
+		p = p[:shapeChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if waitErr := wait(c.shaper.down.reserve(n), c.closed); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > shapeChunk {
+			chunk = chunk[:shapeChunk]
+		}
+		if err := wait(c.shaper.up.reserve(len(chunk)), c.closed); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *shapedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// shapedPacketConn paces a packet connection, as for a UDP-based proxy
+// protocol, with a shaper.
+type shapedPacketConn struct {
+	net.PacketConn
+	shaper    *shaper
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newShapedPacketConn(conn net.PacketConn, s *shaper) *shapedPacketConn {
+	return &shapedPacketConn{PacketConn: conn, shaper: s, closed: make(chan struct{})}
+}
+
+func (c *shapedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if n > 0 {
+		if waitErr := wait(c.shaper.down.reserve(n), c.closed); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, addr, err
+}
+
+func (c *shapedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if err := wait(c.shaper.up.reserve(len(p)), c.closed); err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *shapedPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.PacketConn.Close()
+}
+
+// shapedOutbound is a direct outbound whose connections s paces.
+type shapedOutbound struct {
+	adapter.Outbound
+	shaper *shaper
+}
+
+func (o *shapedOutbound) Type() string {
+	return shapedOutboundType
+}
+
+func (o *shapedOutbound) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := o.Outbound.DialContext(ctx, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	return newShapedConn(conn, o.shaper), nil
+}
+
+func (o *shapedOutbound) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	conn, err := o.Outbound.ListenPacket(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	return newShapedPacketConn(conn, o.shaper), nil
+}
+
+// boxContext returns ctx with the sing-box type registries, required
+// since 1.12, plus the shaping outbound type pacing with s.
+func boxContext(ctx context.Context, s *shaper) context.Context {
+	outbounds := include.OutboundRegistry()
+	sbOutbound.Register[option.DirectOutboundOptions](outbounds, shapedOutboundType,
+		func(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, options option.DirectOutboundOptions) (adapter.Outbound, error) {
+			out, err := direct.NewOutbound(ctx, router, logger, tag, options)
+			if err != nil {
+				return nil, err
+			}
+			return &shapedOutbound{Outbound: out, shaper: s}, nil
+		})
+	return box.Context(ctx, include.InboundRegistry(), outbounds, include.EndpointRegistry(),
+		include.DNSTransportRegistry(), include.ServiceRegistry())
+}
@@ -0,0 +1,233 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+// A simulated session stands in for a real one, so the app's UI and its
+// end-to-end tests run without a server or network access. Its link is an
+// ordinary VLESS link whose user ID is SimulationUUID, such as
+//
+//	vless://00000000-sim@sim.example:443?security=none&sim_fail=start#Sim
+//
+// and its sim_* params script it (see SimulationFor). In place of sing-box
+// a simulated core serves the Clash API on the session's port with
+// synthetic traffic, so stats polling, health probes and hot operations
+// run unchanged. The TUN driver check, adapter hardening, route
+// verification, LAN sharing and MTU probes are skipped.
+const SimulationUUID = "00000000-sim"
+
+// Stages a simulated session can be scripted to fail at (sim_fail).
+const (
+	SimFailDriver = "driver" // the connect fails the TUN driver check
+	SimFailStart  = "start"  // the core fails to start
+	SimFailStats  = "stats"  // once connected, stats polls fail
+	SimFailHealth = "health" // once connected, health probes time out
+)
+
+const (
+	defaultSimStageDelay = 800 * time.Millisecond
+	maxSimStageDelay     = 30 * time.Second
+	defaultSimDownMbps   = 40
+	defaultSimUpMbps     = 8
+	maxSimMbps           = 10000
+
+	// simRamp is how long speeds take to reach their peak after connect.
+	simRamp = 8 * time.Second
+	// Every simIdleEvery, traffic pauses for simIdleFor.
+	simIdleEvery = 45 * time.Second
+	simIdleFor   = 8 * time.Second
+)
+
+// Simulation scripts a simulated session.
+type Simulation struct {
+	StageDelay time.Duration // how long the core takes to start
+	Fail       string        // a SimFail stage, or "" to succeed
+	DownMbps   float64       // peak download speed
+	UpMbps     float64       // peak upload speed
+}
+
+// SimulationFor returns the simulation server's link scripts, nil if it
+// is not a simulation link. Its params are
+//
+//	sim_delay  time the core takes to start, as a Go duration (default 800ms)
+//	sim_fail   stage to fail at: driver, start, stats or health
+//	sim_down   peak download speed in Mbps (default 40)
+//	sim_up     peak upload speed in Mbps (default 8)
+func SimulationFor(server *parser.ServerConfig) (*Simulation, error) {
+	if server == nil || server.Protocol != "vless" || server.Params["uuid"] != SimulationUUID {
+		return nil, nil
+	}
+	sim := &Simulation{StageDelay: defaultSimStageDelay, DownMbps: defaultSimDownMbps, UpMbps: defaultSimUpMbps}
+	if v, ok := server.Params["sim_delay"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxSimStageDelay {
+			return nil, fmt.Errorf("sim_delay must be a duration of at most %v", maxSimStageDelay)
+		}
+		sim.StageDelay = d
+	}
+	switch fail := server.Params["sim_fail"]; fail {
+	case "", SimFailDriver, SimFailStart, SimFailStats, SimFailHealth:
+		sim.Fail = fail
+	default:
+		return nil, fmt.Errorf("sim_fail must be %s, %s, %s or %s", SimFailDriver, SimFailStart, SimFailStats, SimFailHealth)
+	}
+	for param, speed := range map[string]*float64{"sim_down": &sim.DownMbps, "sim_up": &sim.UpMbps} {
+		if v, ok := server.Params[param]; ok {
+			mbps, err := strconv.ParseFloat(v, 64)
+			if err != nil || mbps < 0 || mbps > maxSimMbps {
+				return nil, fmt.Errorf("%s must be a speed between 0 and %d Mbps", param, maxSimMbps)
+			}
+			*speed = mbps
+		}
+	}
+	return sim, nil
+}
+
+// checkDriver is the TUN driver check of a simulated connect.
+func (s *Simulation) checkDriver() error {
+	if s.Fail == SimFailDriver {
+		return fmt.Errorf("%w (simulated)", ErrTunDriverMissing)
+	}
+	return nil
+}
+
+// startCore starts a simulated core for configJSON, serving the Clash API
+// at its external controller with its secret, after StageDelay.
+func (s *Simulation) startCore(ctx context.Context, configJSON []byte) (coreBox, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.StageDelay):
+	}
+	if s.Fail == SimFailStart {
+		return nil, fmt.Errorf("failed to start sing-box: start outbound/vless[proxy]: simulated failure")
+	}
+	var opts struct {
+		Experimental struct {
+			ClashAPI struct {
+				Controller string `json:"external_controller"`
+				Secret     string `json:"secret"`
+			} `json:"clash_api"`
+		} `json:"experimental"`
+	}
+	if err := json.Unmarshal(configJSON, &opts); err != nil {
+		return nil, fmt.Errorf("failed to parse sing-box options: %w", err)
+	}
+	ln, err := net.Listen("tcp", opts.Experimental.ClashAPI.Controller)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start sing-box: start clash-api: %w", err)
+	}
+	core := &simCore{sim: s, secret: opts.Experimental.ClashAPI.Secret, started: time.Now()}
+	core.last = core.started
+	core.server = &http.Server{Handler: core}
+	go core.server.Serve(ln)
+	return core, nil
+}
+
+// simCore is a simulated sing-box: a Clash API whose traffic follows a
+// made-up but plausible pattern. Speeds ramp up over simRamp after the
+// start, wobble around their peak and drop to nothing for simIdleFor every
+// simIdleEvery.
+type simCore struct {
+	sim     *Simulation
+	secret  string
+	server  *http.Server
+	started time.Time
+
+	mu       sync.Mutex
+	last     time.Time // when the totals were last advanced
+	upload   float64
+	download float64
+}
+
+func (c *simCore) Close() error {
+	return c.server.Close()
+}
+
+// simConns are the connections the simulated traffic is shared among, with
+// their share of it.
+var simConns = []struct {
+	id, host, process string
+	chain             string
+	share             float64
+}{
+	{"sim-video", "video.example", `C:\Program Files\Browser\browser.exe`, tagProxy, 0.6},
+	{"sim-web", "www.example", `C:\Program Files\Browser\browser.exe`, tagProxy, 0.3},
+	{"sim-update", "update.example", `C:\Windows\System32\svchost.exe`, tagDirect, 0.1},
+}
+
+// simSpeed returns the simulated speed factor, 0 to 1, elapsed after the
+// start.
+func simSpeed(elapsed time.Duration) float64 {
+	if elapsed%simIdleEvery >= simIdleEvery-simIdleFor {
+		return 0
+	}
+	ramp := math.Min(1, float64(elapsed)/float64(simRamp))
+	return ramp * (0.8 + 0.2*math.Sin(elapsed.Seconds()*0.7))
+}
+
+// advance adds the traffic since the last call to the totals and returns
+// them.
+func (c *simCore) advance(now time.Time) (upload, download int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.last) {
+		bytes := simSpeed(now.Sub(c.started)) * now.Sub(c.last).Seconds() * 1e6 / 8
+		c.download += bytes * c.sim.DownMbps
+		c.upload += bytes * c.sim.UpMbps
+		c.last = now
+	}
+	return int64(c.upload), int64(c.download)
+}
+
+func (c *simCore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.secret != "" && r.Header.Get("Authorization") != "Bearer "+c.secret {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/connections" && r.Method == http.MethodGet:
+		if c.sim.Fail == SimFailStats {
+			http.Error(w, "simulated failure", http.StatusServiceUnavailable)
+			return
+		}
+		upload, download := c.advance(time.Now())
+		snapshot := clashConnections{UploadTotal: upload, DownloadTotal: download}
+		start := c.started.UTC().Format(time.RFC3339Nano)
+		for _, conn := range simConns {
+			snapshot.Connections = append(snapshot.Connections, clashConnection{
+				ID:       conn.id,
+				Start:    start,
+				Upload:   int64(float64(upload) * conn.share),
+				Download: int64(float64(download) * conn.share),
+				Chains:   []string{conn.chain},
+				Metadata: connMeta{Network: "tcp", Host: conn.host, DestinationPort: "443", ProcessPath: conn.process},
+			})
+		}
+		json.NewEncoder(w).Encode(snapshot)
+	case strings.HasPrefix(r.URL.Path, "/proxies/") && strings.HasSuffix(r.URL.Path, "/delay"):
+		if c.sim.Fail == SimFailHealth {
+			http.Error(w, "Timeout", http.StatusGatewayTimeout)
+			return
+		}
+		jitter := 15 * math.Sin(time.Since(c.started).Seconds())
+		json.NewEncoder(w).Encode(map[string]int64{"delay": int64(60 + jitter)})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/proxies/"),
+		r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/connections"):
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
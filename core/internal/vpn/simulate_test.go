@@ -0,0 +1,146 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+)
+
+// simEngine returns an engine whose sessions poll and probe every few
+// milliseconds, on an instance of its own so the simulated Clash API
+// does not collide with other tests'.
+func simEngine(t *testing.T) *Engine {
+	t.Helper()
+	inst, err := instance.New("simtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(NewStateMachine())
+	e.SetInstance(inst)
+	e.driver = stubDriver{}
+	e.statsWarmup = 0
+	e.statsInterval = 5 * time.Millisecond
+	e.healthInterval = 5 * time.Millisecond
+	t.Cleanup(func() { e.Disconnect() })
+	return e
+}
+
+func simConfig(t *testing.T, params string) *Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://"+SimulationUUID+"@sim.example:443?security=none&sim_delay=10ms"+params)
+	sim, err := SimulationFor(cfg.Server)
+	if err != nil || sim == nil {
+		t.Fatalf("SimulationFor = %+v, %v", sim, err)
+	}
+	cfg.Simulation = sim
+	cfg.HardenInterface = true // ignored by a simulated session
+	return cfg
+}
+
+func TestSimulatedSession(t *testing.T) {
+	e := simEngine(t)
+	var download atomic.Int64
+	e.stateMachine.OnStats(func(s Stats) { download.Store(s.Download) })
+
+	if err := e.Connect(context.Background(), simConfig(t, "&sim_down=500")); err != nil {
+		t.Fatal(err)
+	}
+	if state := e.stateMachine.State(); state != StateConnected {
+		t.Fatalf("state %s, want connected", state)
+	}
+	waitFor(t, "simulated traffic", func() bool { return download.Load() > 0 })
+
+	results := e.ApplyHot(context.Background(), HotOp{Kind: HotCloseConnections})
+	if len(results) != 1 || !results[0].Applied || results[0].Closed != len(simConns) {
+		t.Errorf("close connections = %+v", results)
+	}
+	if probe, _ := e.ProbeMTU(context.Background()); !probe.Unavailable {
+		t.Errorf("MTU probe of a simulated session = %+v", probe)
+	}
+	if err := e.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if state := e.stateMachine.State(); state != StateDisconnected {
+		t.Errorf("state %s after disconnect", state)
+	}
+}
+
+func TestSimulatedFailures(t *testing.T) {
+	e := simEngine(t)
+	if err := e.Connect(context.Background(), simConfig(t, "&sim_fail=driver")); !errors.Is(err, ErrTunDriverMissing) {
+		t.Errorf("driver failure: err = %v", err)
+	}
+	if err := e.Connect(context.Background(), simConfig(t, "&sim_fail=start")); err == nil || e.stateMachine.State() != StateError {
+		t.Errorf("start failure: err = %v, state %s", err, e.stateMachine.State())
+	}
+
+	stalled := make(chan StatsStall, 1)
+	e.stateMachine.OnStatsStalled(func(s StatsStall) {
+		select {
+		case stalled <- s:
+		default:
+		}
+	})
+	if err := e.Connect(context.Background(), simConfig(t, "&sim_fail=stats")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stalled:
+	case <-time.After(2 * time.Second):
+		t.Error("failing stats polls not reported")
+	}
+
+	degraded := make(chan SessionHealth, 1)
+	e.stateMachine.OnHealthChanged(func(h SessionHealth) {
+		select {
+		case degraded <- h:
+		default:
+		}
+	})
+	if err := e.ConnectWith(context.Background(), simConfig(t, "&sim_fail=health"), AttemptOptions{Policy: AttemptReplace}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case h := <-degraded:
+		if h.Healthy {
+			t.Errorf("health = %+v, want degraded", h)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("failing health probes not reported")
+	}
+}
+
+func TestSimulationFor(t *testing.T) {
+	if sim, err := SimulationFor(mustParse(t, "vless://11111111-2222-3333-4444-555555555555@example.com:443")); sim != nil || err != nil {
+		t.Errorf("ordinary link: %+v, %v", sim, err)
+	}
+	sim, err := SimulationFor(mustParse(t, "vless://"+SimulationUUID+"@sim.example:443"))
+	if err != nil || *sim != (Simulation{StageDelay: defaultSimStageDelay, DownMbps: defaultSimDownMbps, UpMbps: defaultSimUpMbps}) {
+		t.Errorf("defaults: %+v, %v", sim, err)
+	}
+	for _, params := range []string{"sim_fail=later", "sim_delay=forever", "sim_delay=1h", "sim_down=-1", "sim_up=fast"} {
+		if _, err := SimulationFor(mustParse(t, "vless://"+SimulationUUID+"@sim.example:443?"+params)); err == nil {
+			t.Errorf("%s accepted", params)
+		}
+	}
+}
+
+func TestSimSpeed(t *testing.T) {
+	if s := simSpeed(0); s != 0 {
+		t.Errorf("speed at the start = %v", s)
+	}
+	if s := simSpeed(simRamp / 2); s <= 0 || s >= simSpeed(simRamp+time.Second) {
+		t.Errorf("speed does not ramp: %v", s)
+	}
+	if s := simSpeed(simIdleEvery - time.Second); s != 0 {
+		t.Errorf("speed while idle = %v", s)
+	}
+	if s := simSpeed(simIdleEvery + simRamp); s < 0.6 || s > 1 {
+		t.Errorf("speed after an idle period = %v", s)
+	}
+}
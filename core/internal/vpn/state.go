@@ -1,6 +1,13 @@
 package vpn
 
-import "sync"
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
 
 // State represents the VPN connection state.
 type State string
@@ -16,22 +23,106 @@ const (
 // StateListener is a callback invoked when VPN state changes.
 type StateListener func(state State, err error)
 
+// TransitionListener is a callback invoked with every state change,
+// described in full.
+type TransitionListener func(t Transition)
+
+// Transition describes one state change. IDs count up from 1 for the life
+// of the state machine, so a client can order transitions and spot missed
+// ones however late they reach it. A repeat of the current state, with the
+// same error and reason, is passed on with ID 0: it is not a transition.
+type Transition struct {
+	ID       uint64
+	State    State
+	Previous State
+	Err      error
+	Reason   string    // as returned by Reason
+	At       time.Time // when the state was entered
+
+	ConnectedAt      time.Time     // on transitions to connected: when the link was established
+	SessionStartedAt time.Time     // on transitions to connected: when the session first connected
+	Duration         time.Duration // on transitions to disconnected: time since the session connected; 0 if it never did
+
+	// Server is the server of the connect or session the transition
+	// belongs to; nil on transitions outside one.
+	Server *parser.ServerConfig
+}
+
 // StatsListener is a callback invoked with traffic statistics updates.
-type StatsListener func(upload, download, upSpeed, downSpeed int64)
+type StatsListener func(stats Stats)
+
+// Stats is a traffic statistics update. Totals are cumulative for the
+// session; speeds are proxy bytes per second.
+type Stats struct {
+	Traffic
+	UpSpeed   int64
+	DownSpeed int64
+	RTTMs     int64 // measured RTT of hysteria2 sessions; 0 if none
+	// Bytes through the TUN adapter this session, from its interface
+	// counters; 0 when they cannot be read. See tunCounter.
+	TunUpload   int64
+	TunDownload int64
+}
+
+// ConnectTimingListener is a callback invoked once per successful connect
+// with its stage durations.
+type ConnectTimingListener func(timing ConnectTiming)
+
+// SessionEndListener is a callback invoked when a connected session is
+// torn down.
+type SessionEndListener func(end SessionEnd)
+
+// SessionEnd describes a finished session.
+type SessionEnd struct {
+	Server    *parser.ServerConfig
+	StartedAt time.Time // when the connect started; matches ConnectTiming.At
+	EndedAt   time.Time
+	Reason    string // one of the Reason* constants
+	// Reconnects counts the links re-established during the session.
+	Reconnects int
+}
+
+// ConnectTiming breaks a successful connect down by stage.
+type ConnectTiming struct {
+	Server         *parser.ServerConfig
+	At             time.Time // when the connect started
+	BuildMs        int64     // generating the sing-box config
+	StartMs        int64     // creating and starting sing-box
+	TotalMs        int64     // until the connected state
+	FirstTrafficMs int64     // from start until data first came back through the proxy; 0 if none did
+}
 
 // StateMachine manages VPN state transitions and notifies listeners.
 type StateMachine struct {
-	mu             sync.RWMutex
-	state          State
-	lastError      error
-	stateListeners []StateListener
-	statsListeners []StatsListener
+	mu                   sync.RWMutex
+	state                State
+	lastError            error
+	reason               string // why the session is ending; see SetStateReason
+	transitionID         uint64
+	connectedAt          time.Time            // zero unless connected since the last connecting or disconnected state
+	sessionStarted       time.Time            // first connected state of the session; kept across reconnects
+	server               *parser.ServerConfig // see setServer
+	now                  func() time.Time
+	stateListeners       []StateListener
+	transListeners       []TransitionListener
+	statsListeners       []StatsListener
+	matchListeners       []ConnMatchListener
+	timingListeners      []ConnectTimingListener
+	endListeners         []SessionEndListener
+	killListeners        []KillSwitchListener
+	leakListeners        []EarlyLeakListener
+	healthListeners      []HealthListener
+	stallListeners       []StatsStallListener
+	unavailableListeners []StatsUnavailableListener
+	mtuListeners         []MTUWarningListener
+	reconnListeners      []ReconnectListener
 }
 
 // NewStateMachine creates a new state machine in disconnected state.
 func NewStateMachine() *StateMachine {
 	return &StateMachine{
 		state: StateDisconnected,
+		now:   time.Now,
 	}
 }
 
@@ -49,20 +140,99 @@ func (sm *StateMachine) LastError() error {
 	return sm.lastError
 }
 
+// Reason returns the disconnect reason of the current state, or "" if the
+// state was not entered with one.
+func (sm *StateMachine) Reason() string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.reason
+}
+
 // SetState transitions to a new state and notifies listeners.
 func (sm *StateMachine) SetState(s State, err error) {
+	sm.setState(s, err, "")
+}
+
+// SetStateReason transitions to a new state entered for reason, such as
+// disconnecting on a schedule, and notifies listeners. Listeners read the
+// reason with Reason.
+func (sm *StateMachine) SetStateReason(s State, reason string) {
+	sm.setState(s, nil, reason)
+}
+
+// setServer sets the server of the connect about to start, carried by
+// transitions until the next disconnected or error state.
+func (sm *StateMachine) setServer(server *parser.ServerConfig) {
+	sm.mu.Lock()
+	sm.server = server
+	sm.mu.Unlock()
+}
+
+func (sm *StateMachine) setState(s State, err error, reason string) {
 	sm.mu.Lock()
+	t := Transition{
+		State:    s,
+		Previous: sm.state,
+		Err:      err,
+		Reason:   reason,
+		At:       sm.now(),
+		Server:   sm.server,
+	}
+	if !sm.repeats(s, err, reason) {
+		sm.transitionID++
+		t.ID = sm.transitionID
+	}
+	switch s {
+	case StateConnected:
+		sm.connectedAt = t.At
+		if sm.sessionStarted.IsZero() {
+			sm.sessionStarted = t.At
+		}
+		t.ConnectedAt = t.At
+		t.SessionStartedAt = sm.sessionStarted
+	case StateConnecting:
+		sm.connectedAt = time.Time{}
+		if reason != ReasonReconnect {
+			sm.sessionStarted = time.Time{}
+		}
+	case StateDisconnected:
+		if !sm.sessionStarted.IsZero() {
+			t.Duration = t.At.Sub(sm.sessionStarted)
+		}
+		sm.connectedAt = time.Time{}
+		sm.sessionStarted = time.Time{}
+		sm.server = nil
+	case StateError:
+		sm.sessionStarted = time.Time{}
+		sm.server = nil
+	}
 	sm.state = s
 	sm.lastError = err
+	sm.reason = reason
 	listeners := make([]StateListener, len(sm.stateListeners))
 	copy(listeners, sm.stateListeners)
+	transListeners := make([]TransitionListener, len(sm.transListeners))
+	copy(transListeners, sm.transListeners)
 	sm.mu.Unlock()
 
 	for _, l := range listeners {
-		l(s, err)
+		callListener("state", func() { l(s, err) })
+	}
+	for _, l := range transListeners {
+		callListener("transition", func() { l(t) })
 	}
 }
 
+// repeats reports whether entering s with err and reason reports nothing
+// new: the state, error and reason are those already current. Clients see
+// such a repeat as no transition, so it takes no transition ID.
+func (sm *StateMachine) repeats(s State, err error, reason string) bool {
+	if s != sm.state || reason != sm.reason || (err == nil) != (sm.lastError == nil) {
+		return false
+	}
+	return err == nil || err.Error() == sm.lastError.Error()
+}
+
 // OnStateChange registers a state change listener.
 func (sm *StateMachine) OnStateChange(l StateListener) {
 	sm.mu.Lock()
@@ -70,6 +240,13 @@ func (sm *StateMachine) OnStateChange(l StateListener) {
 	sm.stateListeners = append(sm.stateListeners, l)
 }
 
+// OnTransition registers a listener for state changes described in full.
+func (sm *StateMachine) OnTransition(l TransitionListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.transListeners = append(sm.transListeners, l)
+}
+
 // OnStats registers a stats update listener.
 func (sm *StateMachine) OnStats(l StatsListener) {
 	sm.mu.Lock()
@@ -78,13 +255,228 @@ func (sm *StateMachine) OnStats(l StatsListener) {
 }
 
 // NotifyStats notifies all stats listeners.
-func (sm *StateMachine) NotifyStats(upload, download, upSpeed, downSpeed int64) {
+func (sm *StateMachine) NotifyStats(stats Stats) {
 	sm.mu.RLock()
 	listeners := make([]StatsListener, len(sm.statsListeners))
 	copy(listeners, sm.statsListeners)
 	sm.mu.RUnlock()
 
 	for _, l := range listeners {
-		l(upload, download, upSpeed, downSpeed)
+		callListener("stats", func() { l(stats) })
+	}
+}
+
+// OnConnMatched registers a connection tracing listener.
+func (sm *StateMachine) OnConnMatched(l ConnMatchListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.matchListeners = append(sm.matchListeners, l)
+}
+
+// NotifyConnMatched notifies all connection tracing listeners.
+func (sm *StateMachine) NotifyConnMatched(match ConnMatch) {
+	sm.mu.RLock()
+	listeners := make([]ConnMatchListener, len(sm.matchListeners))
+	copy(listeners, sm.matchListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("connection match", func() { l(match) })
+	}
+}
+
+// OnConnectTiming registers a connect timing listener.
+func (sm *StateMachine) OnConnectTiming(l ConnectTimingListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.timingListeners = append(sm.timingListeners, l)
+}
+
+// NotifyConnectTiming notifies all connect timing listeners.
+func (sm *StateMachine) NotifyConnectTiming(timing ConnectTiming) {
+	sm.mu.RLock()
+	listeners := make([]ConnectTimingListener, len(sm.timingListeners))
+	copy(listeners, sm.timingListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("connect timing", func() { l(timing) })
+	}
+}
+
+// OnSessionEnd registers a session end listener.
+func (sm *StateMachine) OnSessionEnd(l SessionEndListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.endListeners = append(sm.endListeners, l)
+}
+
+// NotifySessionEnd notifies all session end listeners.
+func (sm *StateMachine) NotifySessionEnd(end SessionEnd) {
+	sm.mu.RLock()
+	listeners := make([]SessionEndListener, len(sm.endListeners))
+	copy(listeners, sm.endListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("session end", func() { l(end) })
+	}
+}
+
+// OnKillSwitchEngaged registers a listener for the first kill switch
+// engagement of each session.
+func (sm *StateMachine) OnKillSwitchEngaged(l KillSwitchListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.killListeners = append(sm.killListeners, l)
+}
+
+// NotifyKillSwitchEngaged notifies all kill switch listeners.
+func (sm *StateMachine) NotifyKillSwitchEngaged(stats KillSwitchStats) {
+	sm.mu.RLock()
+	listeners := make([]KillSwitchListener, len(sm.killListeners))
+	copy(listeners, sm.killListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("kill switch", func() { l(stats) })
+	}
+}
+
+// OnEarlyLeak registers a listener for the first early leak of each
+// session.
+func (sm *StateMachine) OnEarlyLeak(l EarlyLeakListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.leakListeners = append(sm.leakListeners, l)
+}
+
+// NotifyEarlyLeak notifies all early leak listeners.
+func (sm *StateMachine) NotifyEarlyLeak(leak EarlyLeak) {
+	sm.mu.RLock()
+	listeners := make([]EarlyLeakListener, len(sm.leakListeners))
+	copy(listeners, sm.leakListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("early leak", func() { l(leak) })
 	}
 }
+
+// OnHealthChanged registers a listener for sessions becoming degraded or
+// recovering.
+func (sm *StateMachine) OnHealthChanged(l HealthListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.healthListeners = append(sm.healthListeners, l)
+}
+
+// NotifyHealthChanged notifies all health listeners.
+func (sm *StateMachine) NotifyHealthChanged(health SessionHealth) {
+	sm.mu.RLock()
+	listeners := make([]HealthListener, len(sm.healthListeners))
+	copy(listeners, sm.healthListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("health", func() { l(health) })
+	}
+}
+
+// OnStatsStalled registers a listener for stats polls failing repeatedly
+// while connected.
+func (sm *StateMachine) OnStatsStalled(l StatsStallListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.stallListeners = append(sm.stallListeners, l)
+}
+
+// NotifyStatsStalled notifies all stats stall listeners.
+func (sm *StateMachine) NotifyStatsStalled(stall StatsStall) {
+	sm.mu.RLock()
+	listeners := make([]StatsStallListener, len(sm.stallListeners))
+	copy(listeners, sm.stallListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("stats stall", func() { l(stall) })
+	}
+}
+
+// OnStatsUnavailable registers a listener for a session's Clash API
+// staying unreachable after its recovery.
+func (sm *StateMachine) OnStatsUnavailable(l StatsUnavailableListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.unavailableListeners = append(sm.unavailableListeners, l)
+}
+
+// NotifyStatsUnavailable notifies all stats unavailable listeners.
+func (sm *StateMachine) NotifyStatsUnavailable(u StatsUnavailable) {
+	sm.mu.RLock()
+	listeners := make([]StatsUnavailableListener, len(sm.unavailableListeners))
+	copy(listeners, sm.unavailableListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("stats unavailable", func() { l(u) })
+	}
+}
+
+// OnMTUWarning registers a listener for MTU probes finding the configured
+// MTU too large.
+func (sm *StateMachine) OnMTUWarning(l MTUWarningListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.mtuListeners = append(sm.mtuListeners, l)
+}
+
+// NotifyMTUWarning notifies all MTU warning listeners.
+func (sm *StateMachine) NotifyMTUWarning(probe MTUProbe) {
+	sm.mu.RLock()
+	listeners := make([]MTUWarningListener, len(sm.mtuListeners))
+	copy(listeners, sm.mtuListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("MTU warning", func() { l(probe) })
+	}
+}
+
+// SessionStartedAt returns when the current session first connected, kept
+// across reconnects; zero outside a session.
+func (sm *StateMachine) SessionStartedAt() time.Time {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.sessionStarted
+}
+
+// OnReconnect registers a listener for re-established links.
+func (sm *StateMachine) OnReconnect(l ReconnectListener) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.reconnListeners = append(sm.reconnListeners, l)
+}
+
+// NotifyReconnect notifies all reconnect listeners.
+func (sm *StateMachine) NotifyReconnect(r Reconnect) {
+	sm.mu.RLock()
+	listeners := make([]ReconnectListener, len(sm.reconnListeners))
+	copy(listeners, sm.reconnListeners)
+	sm.mu.RUnlock()
+
+	for _, l := range listeners {
+		callListener("reconnect", func() { l(r) })
+	}
+}
+
+// callListener runs one listener, recovering from a panic so the remaining
+// listeners still run and the service survives.
+func callListener(kind string, fn func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic in %s listener: %v\n%s", kind, p, debug.Stack())
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,168 @@
+package vpn
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+func TestPanickingListenersIsolated(t *testing.T) {
+	sm := NewStateMachine()
+
+	var states []State
+	sm.OnStateChange(func(State, error) { panic("listener bug") })
+	sm.OnStateChange(func(s State, _ error) { states = append(states, s) })
+
+	var got Stats
+	sm.OnStats(func(Stats) {
+		var cfg *Config
+		_ = cfg.Server // nil dereference
+	})
+	sm.OnStats(func(s Stats) { got = s })
+
+	sm.SetState(StateConnecting, nil)
+	sm.SetState(StateConnected, nil)
+	sm.NotifyStats(Stats{Traffic: Traffic{Upload: 1, DirectDownload: 2}, UpSpeed: 3})
+
+	if len(states) != 2 || states[1] != StateConnected {
+		t.Errorf("states after panicking listener = %v", states)
+	}
+	if got.Upload != 1 || got.DirectDownload != 2 || got.UpSpeed != 3 {
+		t.Errorf("stats after panicking listener = %+v", got)
+	}
+	if sm.State() != StateConnected {
+		t.Errorf("state = %s, want connected", sm.State())
+	}
+}
+
+func TestStateReason(t *testing.T) {
+	sm := NewStateMachine()
+
+	var reasons []string
+	sm.OnStateChange(func(State, error) { reasons = append(reasons, sm.Reason()) })
+	var ends []SessionEnd
+	sm.OnSessionEnd(func(end SessionEnd) { ends = append(ends, end) })
+
+	sm.SetState(StateConnected, nil)
+	sm.SetStateReason(StateDisconnecting, ReasonCap)
+	sm.NotifySessionEnd(SessionEnd{Reason: ReasonCap})
+	sm.SetStateReason(StateDisconnected, ReasonCap)
+	sm.SetState(StateConnecting, nil)
+
+	want := []string{"", ReasonCap, ReasonCap, ""}
+	if strings.Join(reasons, ",") != strings.Join(want, ",") {
+		t.Errorf("reasons = %q, want %q", reasons, want)
+	}
+	if len(ends) != 1 || ends[0].Reason != ReasonCap {
+		t.Errorf("session ends = %+v", ends)
+	}
+	if !ValidReason(ReasonIdle) || ValidReason("") || ValidReason("bedtime") {
+		t.Error("ValidReason accepts the wrong reasons")
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	sm := NewStateMachine()
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	now := start
+	sm.now = func() time.Time { return now }
+
+	var got []Transition
+	sm.OnTransition(func(tr Transition) { got = append(got, tr) })
+
+	step := func(d time.Duration, s State, reason string) {
+		now = now.Add(d)
+		sm.SetStateReason(s, reason)
+	}
+	step(0, StateConnecting, "")
+	step(2*time.Second, StateConnected, "")
+	step(90*time.Second, StateDisconnecting, ReasonIdle)
+	step(time.Second, StateDisconnected, ReasonIdle)
+	step(time.Minute, StateConnecting, "")
+	now = now.Add(5 * time.Second)
+	sm.SetState(StateError, errors.New("handshake failed"))
+	step(time.Second, StateDisconnected, "")
+
+	want := []struct {
+		state, previous State
+		duration        time.Duration
+	}{
+		{StateConnecting, StateDisconnected, 0},
+		{StateConnected, StateConnecting, 0},
+		{StateDisconnecting, StateConnected, 0},
+		{StateDisconnected, StateDisconnecting, 91 * time.Second},
+		{StateConnecting, StateDisconnected, 0},
+		{StateError, StateConnecting, 0},
+		{StateDisconnected, StateError, 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d transitions, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		tr := got[i]
+		if tr.ID != uint64(i+1) || tr.State != w.state || tr.Previous != w.previous || tr.Duration != w.duration {
+			t.Errorf("transition %d = %+v, want id %d %s→%s duration %v", i, tr, i+1, w.previous, w.state, w.duration)
+		}
+		if i > 0 && tr.At.Before(got[i-1].At) {
+			t.Errorf("transition %d at %v, before the previous one", i, tr.At)
+		}
+	}
+	if c := got[1]; !c.ConnectedAt.Equal(start.Add(2*time.Second)) || !c.At.Equal(c.ConnectedAt) {
+		t.Errorf("connected transition = %+v", c)
+	}
+	if got[3].Reason != ReasonIdle || got[5].Err == nil || !got[0].ConnectedAt.IsZero() {
+		t.Errorf("transitions = %+v", got)
+	}
+}
+
+func TestRepeatedStateTakesNoTransitionID(t *testing.T) {
+	sm := NewStateMachine()
+	var got []Transition
+	sm.OnTransition(func(tr Transition) { got = append(got, tr) })
+
+	sm.SetState(StateConnecting, nil)
+	sm.SetState(StateConnecting, nil)
+	sm.SetState(StateError, errors.New("handshake failed"))
+	sm.SetState(StateError, errors.New("handshake failed"))
+	sm.SetState(StateError, errors.New("timed out"))
+	sm.SetStateReason(StateDisconnected, ReasonIdle)
+	sm.SetStateReason(StateDisconnected, ReasonUser)
+
+	var ids []uint64
+	for _, tr := range got {
+		ids = append(ids, tr.ID)
+	}
+	if want := []uint64{1, 0, 2, 0, 3, 4, 5}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("IDs = %v, want %v", ids, want)
+	}
+}
+
+func TestTransitionServer(t *testing.T) {
+	sm := NewStateMachine()
+	var got []Transition
+	sm.OnTransition(func(tr Transition) { got = append(got, tr) })
+
+	server := &parser.ServerConfig{Protocol: "vless", Name: "Frankfurt", Address: "de.example.com", Port: 443}
+	sm.setServer(server)
+	sm.SetState(StateConnecting, nil)
+	sm.SetState(StateConnected, nil)
+	sm.SetStateReason(StateConnecting, ReasonReconnect)
+	sm.SetStateReason(StateConnected, ReasonReconnect)
+	sm.SetState(StateDisconnecting, nil)
+	sm.SetState(StateDisconnected, nil)
+	// The session is over: what follows carries no server.
+	sm.SetState(StateConnecting, nil)
+
+	for i, tr := range got[:len(got)-1] {
+		if tr.Server != server {
+			t.Errorf("transition %d to %s has server %v", i, tr.State, tr.Server)
+		}
+	}
+	if last := got[len(got)-1]; last.Server != nil {
+		t.Errorf("connect after the session has server %v", last.Server)
+	}
+}
@@ -0,0 +1,234 @@
+package vpn
+
+import "net"
+
+// clashConnections is the response structure from the Clash API /connections endpoint.
+type clashConnections struct {
+	DownloadTotal int64             `json:"downloadTotal"`
+	UploadTotal   int64             `json:"uploadTotal"`
+	Connections   []clashConnection `json:"connections"`
+}
+
+// clashConnection represents a single active connection from the Clash API.
+type clashConnection struct {
+	ID       string   `json:"id"`
+	Start    string   `json:"start"`
+	Upload   int64    `json:"upload"`
+	Download int64    `json:"download"`
+	Chains   []string `json:"chains"`
+	Rule     string   `json:"rule"` // matched rule as described by sing-box
+	Metadata connMeta `json:"metadata"`
+}
+
+// connMeta is the subset of Clash API connection metadata used for tracing.
+type connMeta struct {
+	Network         string `json:"network"`
+	Host            string `json:"host"`
+	DestinationIP   string `json:"destinationIP"`
+	DestinationPort string `json:"destinationPort"`
+	ProcessPath     string `json:"processPath"`
+	Type            string `json:"type"` // inbound as "type/tag"
+	SourceIP        string `json:"sourceIP"`
+}
+
+// target returns the destination as host:port, preferring the sniffed
+// domain over the IP.
+func (m *connMeta) target() string {
+	host := m.Host
+	if host == "" {
+		host = m.DestinationIP
+	}
+	if host == "" || m.DestinationPort == "" {
+		return host
+	}
+	return net.JoinHostPort(host, m.DestinationPort)
+}
+
+// key identifies a connection across polls. The Clash API may reuse IDs
+// after an internal restart, so the start time is part of the identity
+// when the API provides it.
+func (c *clashConnection) key() string {
+	if c.Start == "" {
+		return c.ID
+	}
+	return c.ID + "|" + c.Start
+}
+
+// connTraffic tracks the last-seen traffic for a connection.
+type connTraffic struct {
+	upload   int64
+	download int64
+}
+
+// isProxyChain returns true if any chain entry indicates proxy outbound.
+func isProxyChain(chains []string) bool {
+	for _, c := range chains {
+		if c == "proxy" {
+			return true
+		}
+	}
+	return false
+}
+
+// isDirectChain returns true if the connection bypasses the tunnel. Blocked
+// and DNS-hijacked connections are neither proxy nor direct.
+func isDirectChain(chains []string) bool {
+	for _, c := range chains {
+		if c == "direct" {
+			return true
+		}
+	}
+	return false
+}
+
+// Traffic is the cumulative session traffic split by route.
+type Traffic struct {
+	Upload         int64 // through the proxy
+	Download       int64
+	DirectUpload   int64 // bypassed by split tunneling
+	DirectDownload int64
+}
+
+// chainAccumulator keeps cumulative traffic for one class of connections
+// (proxy or direct) across snapshots. Its total never decreases.
+type chainAccumulator struct {
+	conns          map[string]connTraffic // active connections by key
+	seen           map[string]struct{}    // keys observed in the current snapshot
+	closedUpload   int64                  // traffic of connections that closed
+	closedDownload int64
+	baseUpload     int64 // traffic folded in from before a Clash API restart
+	baseDownload   int64
+}
+
+func newChainAccumulator() *chainAccumulator {
+	return &chainAccumulator{
+		conns: make(map[string]connTraffic),
+		seen:  make(map[string]struct{}),
+	}
+}
+
+// observe records a connection's current counters.
+func (a *chainAccumulator) observe(c *clashConnection) {
+	key := c.key()
+	// A shrinking counter means the ID now belongs to a different
+	// connection; the previous one is finished.
+	if prev, ok := a.conns[key]; ok && (c.Upload < prev.upload || c.Download < prev.download) {
+		a.closedUpload += prev.upload
+		a.closedDownload += prev.download
+	}
+	a.conns[key] = connTraffic{upload: c.Upload, download: c.Download}
+	a.seen[key] = struct{}{}
+}
+
+// finish ends a snapshot: connections not observed in it have closed and
+// keep their last-seen traffic. It returns the cumulative totals.
+func (a *chainAccumulator) finish() (upload, download int64) {
+	upload = a.baseUpload + a.closedUpload
+	download = a.baseDownload + a.closedDownload
+	for key, traffic := range a.conns {
+		if _, ok := a.seen[key]; !ok {
+			a.closedUpload += traffic.upload
+			a.closedDownload += traffic.download
+			delete(a.conns, key)
+		}
+		upload += traffic.upload
+		download += traffic.download
+	}
+	a.seen = make(map[string]struct{}, len(a.conns))
+	return upload, download
+}
+
+// foldRestart moves everything counted so far into the base offset and
+// clears per-connection state.
+func (a *chainAccumulator) foldRestart() {
+	a.baseUpload += a.closedUpload
+	a.baseDownload += a.closedDownload
+	for _, traffic := range a.conns {
+		a.baseUpload += traffic.upload
+		a.baseDownload += traffic.download
+	}
+	a.closedUpload = 0
+	a.closedDownload = 0
+	a.conns = make(map[string]connTraffic)
+	a.seen = make(map[string]struct{})
+}
+
+// Stats strategies say how a session's traffic is counted.
+//
+// StatsGlobalTotals reads the Clash API's API-wide totals, which are exact
+// but include every outbound; it is used when nothing is routed direct, so
+// all traffic is proxy traffic. Counting per connection misses traffic of
+// connections that open and close between polls, such as the UDP
+// associations of a video call over Hysteria2.
+//
+// StatsPerConnection attributes each connection's traffic by its chain, to
+// tell proxy from direct traffic while split tunneling or a bypass is on.
+const (
+	StatsGlobalTotals  = "global-totals"
+	StatsPerConnection = "per-connection"
+)
+
+// statsStrategyFor returns the stats strategy for a session of cfg.
+func statsStrategyFor(cfg *Config) string {
+	if (cfg.SplitTunnelMode == "" || cfg.SplitTunnelMode == "off") &&
+		len(cfg.BuiltinBypasses) == 0 && len(cfg.DNSHijackExceptions) == 0 {
+		return StatsGlobalTotals
+	}
+	return StatsPerConnection
+}
+
+// trafficTracker accumulates proxy and direct traffic from successive Clash
+// API /connections snapshots, by strategy. Totals it reports never
+// decrease, even when the API restarts (counters reset, IDs repeat) or a
+// connection's counters shrink.
+type trafficTracker struct {
+	strategy      string
+	proxy         *chainAccumulator
+	direct        *chainAccumulator
+	lastUpTotal   int64 // API-wide counters from the previous snapshot
+	lastDownTotal int64
+	baseUpTotal   int64 // API-wide counters folded in from before a restart
+	baseDownTotal int64
+}
+
+func newTrafficTracker(strategy string) *trafficTracker {
+	return &trafficTracker{
+		strategy: strategy,
+		proxy:    newChainAccumulator(),
+		direct:   newChainAccumulator(),
+	}
+}
+
+// update folds a snapshot into the tracker and returns the cumulative
+// traffic for the session.
+func (t *trafficTracker) update(snap *clashConnections) Traffic {
+	// API-wide totals only grow while the API lives; going backwards means
+	// sing-box restarted its Clash server and everything we track is stale.
+	if snap.UploadTotal < t.lastUpTotal || snap.DownloadTotal < t.lastDownTotal {
+		t.proxy.foldRestart()
+		t.direct.foldRestart()
+		t.baseUpTotal += t.lastUpTotal
+		t.baseDownTotal += t.lastDownTotal
+	}
+	t.lastUpTotal = snap.UploadTotal
+	t.lastDownTotal = snap.DownloadTotal
+
+	if t.strategy == StatsGlobalTotals {
+		return Traffic{Upload: t.baseUpTotal + snap.UploadTotal, Download: t.baseDownTotal + snap.DownloadTotal}
+	}
+
+	for i := range snap.Connections {
+		c := &snap.Connections[i]
+		switch {
+		case isProxyChain(c.Chains):
+			t.proxy.observe(c)
+		case isDirectChain(c.Chains):
+			t.direct.observe(c)
+		}
+	}
+
+	var traffic Traffic
+	traffic.Upload, traffic.Download = t.proxy.finish()
+	traffic.DirectUpload, traffic.DirectDownload = t.direct.finish()
+	return traffic
+}
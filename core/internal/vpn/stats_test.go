@@ -0,0 +1,225 @@
+package vpn
+
+import (
+	"context"
+	"testing"
+)
+
+func proxyConn(id, start string, up, down int64) clashConnection {
+	return clashConnection{ID: id, Start: start, Upload: up, Download: down, Chains: []string{"proxy"}}
+}
+
+func directConn(id string, up, down int64) clashConnection {
+	return clashConnection{ID: id, Upload: up, Download: down, Chains: []string{"direct"}}
+}
+
+type trafficStep struct {
+	snap     clashConnections
+	wantUp   int64
+	wantDown int64
+}
+
+func runTrafficSteps(t *testing.T, steps []trafficStep) {
+	t.Helper()
+	tr := newTrafficTracker(StatsPerConnection)
+	for i, step := range steps {
+		traffic := tr.update(&step.snap)
+		up, down := traffic.Upload, traffic.Download
+		if up != step.wantUp || down != step.wantDown {
+			t.Fatalf("step %d: got (%d, %d), want (%d, %d)", i, up, down, step.wantUp, step.wantDown)
+		}
+	}
+}
+
+func TestTrafficTrackerClosedConnections(t *testing.T) {
+	runTrafficSteps(t, []trafficStep{
+		{clashConnections{UploadTotal: 30, DownloadTotal: 300, Connections: []clashConnection{
+			proxyConn("a", "", 10, 100), directConn("d", 20, 200),
+		}}, 10, 100},
+		{clashConnections{UploadTotal: 50, DownloadTotal: 500, Connections: []clashConnection{
+			proxyConn("a", "", 15, 150), proxyConn("b", "", 5, 50),
+		}}, 20, 200},
+		// "a" closed: its last-seen traffic stays in the total.
+		{clashConnections{UploadTotal: 60, DownloadTotal: 600, Connections: []clashConnection{
+			proxyConn("b", "", 10, 100),
+		}}, 25, 250},
+	})
+}
+
+func TestTrafficTrackerAPIRestart(t *testing.T) {
+	runTrafficSteps(t, []trafficStep{
+		{clashConnections{UploadTotal: 100, DownloadTotal: 1000, Connections: []clashConnection{
+			proxyConn("a", "", 40, 400), proxyConn("b", "", 60, 600),
+		}}, 100, 1000},
+		// Restart: API-wide counters go backwards and "a" reappears with a
+		// small counter. Totals must continue from the pre-restart value.
+		{clashConnections{UploadTotal: 5, DownloadTotal: 50, Connections: []clashConnection{
+			proxyConn("a", "", 5, 50),
+		}}, 105, 1050},
+		{clashConnections{UploadTotal: 10, DownloadTotal: 100, Connections: []clashConnection{
+			proxyConn("a", "", 10, 100),
+		}}, 110, 1100},
+	})
+}
+
+func TestTrafficTrackerIDReuse(t *testing.T) {
+	runTrafficSteps(t, []trafficStep{
+		{clashConnections{UploadTotal: 10, DownloadTotal: 100, Connections: []clashConnection{
+			proxyConn("a", "2024-01-01T00:00:00Z", 10, 100),
+		}}, 10, 100},
+		// Same ID, new start time: a different connection. The old one closed.
+		{clashConnections{UploadTotal: 30, DownloadTotal: 300, Connections: []clashConnection{
+			proxyConn("a", "2024-01-01T00:05:00Z", 20, 200),
+		}}, 30, 300},
+	})
+}
+
+func TestTrafficTrackerShrinkingConnection(t *testing.T) {
+	runTrafficSteps(t, []trafficStep{
+		{clashConnections{UploadTotal: 50, DownloadTotal: 500, Connections: []clashConnection{
+			proxyConn("a", "", 50, 500),
+		}}, 50, 500},
+		// No start time and the counter shrank: treat as a reused ID rather
+		// than letting the total go backwards.
+		{clashConnections{UploadTotal: 60, DownloadTotal: 600, Connections: []clashConnection{
+			proxyConn("a", "", 10, 100),
+		}}, 60, 600},
+		{clashConnections{UploadTotal: 70, DownloadTotal: 700, Connections: []clashConnection{
+			proxyConn("a", "", 20, 200),
+		}}, 70, 700},
+	})
+}
+
+func TestChainAccumulator(t *testing.T) {
+	a := newChainAccumulator()
+	c1 := directConn("x", 10, 100)
+	c2 := directConn("y", 5, 50)
+	a.observe(&c1)
+	a.observe(&c2)
+	if up, down := a.finish(); up != 15 || down != 150 {
+		t.Fatalf("first snapshot: got (%d, %d), want (15, 150)", up, down)
+	}
+
+	// "x" closed, "y" grew.
+	c2.Upload, c2.Download = 8, 80
+	a.observe(&c2)
+	if up, down := a.finish(); up != 18 || down != 180 {
+		t.Fatalf("after close: got (%d, %d), want (18, 180)", up, down)
+	}
+
+	// Restart keeps the total; the new "y" starts from zero.
+	a.foldRestart()
+	c2.Upload, c2.Download = 1, 10
+	a.observe(&c2)
+	if up, down := a.finish(); up != 19 || down != 190 {
+		t.Fatalf("after restart: got (%d, %d), want (19, 190)", up, down)
+	}
+
+	// Empty snapshot: everything closed, nothing lost.
+	if up, down := a.finish(); up != 19 || down != 190 {
+		t.Fatalf("empty snapshot: got (%d, %d), want (19, 190)", up, down)
+	}
+}
+
+func TestTrafficTrackerDirectSeparate(t *testing.T) {
+	tr := newTrafficTracker(StatsPerConnection)
+	got := tr.update(&clashConnections{UploadTotal: 37, DownloadTotal: 370, Connections: []clashConnection{
+		proxyConn("a", "", 10, 100),
+		directConn("d", 20, 200),
+		{ID: "b", Upload: 3, Download: 30, Chains: []string{"block"}},
+		{ID: "n", Upload: 4, Download: 40, Chains: []string{"dns-out"}},
+	}})
+	want := Traffic{Upload: 10, Download: 100, DirectUpload: 20, DirectDownload: 200}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// Direct connection closes and the API restarts; both totals hold.
+	got = tr.update(&clashConnections{UploadTotal: 2, DownloadTotal: 20, Connections: []clashConnection{
+		proxyConn("a", "", 1, 10), directConn("e", 1, 10),
+	}})
+	want = Traffic{Upload: 11, Download: 110, DirectUpload: 21, DirectDownload: 210}
+	if got != want {
+		t.Fatalf("after restart: got %+v, want %+v", got, want)
+	}
+}
+
+func TestTrafficTrackerGlobalTotals(t *testing.T) {
+	tr := newTrafficTracker(StatsGlobalTotals)
+	// Short-lived UDP associations never show up as connections; only the
+	// API-wide totals include them.
+	got := tr.update(&clashConnections{UploadTotal: 500, DownloadTotal: 5000, Connections: []clashConnection{
+		proxyConn("a", "", 10, 100),
+	}})
+	if want := (Traffic{Upload: 500, Download: 5000}); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// API restart: totals continue from the pre-restart value.
+	got = tr.update(&clashConnections{UploadTotal: 20, DownloadTotal: 200})
+	if want := (Traffic{Upload: 520, Download: 5200}); got != want {
+		t.Fatalf("after restart: got %+v, want %+v", got, want)
+	}
+}
+
+func TestStatsStrategyFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string
+	}{
+		{"split off", func(*Config) {}, StatsGlobalTotals},
+		{"explicit off", func(c *Config) { c.SplitTunnelMode = "off" }, StatsGlobalTotals},
+		{"app split", func(c *Config) { c.SplitTunnelMode = "app"; c.SplitTunnelApps = []string{"chrome.exe"} }, StatsPerConnection},
+		{"domain split", func(c *Config) { c.SplitTunnelMode = "domain"; c.SplitTunnelDomains = []string{"example.com"} }, StatsPerConnection},
+		{"bypass", func(c *Config) { c.BuiltinBypasses = []string{"steam"} }, StatsPerConnection},
+		{"dns exception", func(c *Config) { c.DNSHijackExceptions = []string{"game.exe"} }, StatsPerConnection},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.modify(cfg)
+			if got := statsStrategyFor(cfg); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsStrategySwitchesPerSession(t *testing.T) {
+	e := newStubEngine()
+	e.fetchConns = func(context.Context, string) (*clashConnections, error) {
+		return &clashConnections{UploadTotal: 70, DownloadTotal: 700, Connections: []clashConnection{
+			proxyConn("a", "", 10, 100), directConn("d", 20, 200),
+		}}, nil
+	}
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.HardenInterface = false
+
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.StatsStrategy(); got != StatsGlobalTotals {
+		t.Fatalf("split off: strategy %q", got)
+	}
+	waitFor(t, "the global totals", func() bool { return e.Traffic() == Traffic{Upload: 70, Download: 700} })
+	if err := e.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.StatsStrategy(); got != "" {
+		t.Errorf("disconnected: strategy %q", got)
+	}
+
+	cfg.SplitTunnelMode = "app"
+	cfg.SplitTunnelApps = []string{"chrome.exe"}
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+	if got := e.StatsStrategy(); got != StatsPerConnection {
+		t.Fatalf("app split: strategy %q", got)
+	}
+	want := Traffic{Upload: 10, Download: 100, DirectUpload: 20, DirectDownload: 200}
+	waitFor(t, "per-connection traffic", func() bool { return e.Traffic() == want })
+}
@@ -0,0 +1,266 @@
+package vpn
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/splittunnel"
+)
+
+// Connection tracing limits. Tracing is a debugging aid; it switches
+// itself off so a forgotten toggle does not leave a firehose running.
+const (
+	traceDuration     = 10 * time.Minute
+	traceMaxPerSecond = 20
+)
+
+// RuleInfo labels one generated route rule so a connection can be traced
+// back to the rule that routed it.
+type RuleInfo struct {
+	Index    int    `json:"index"` // position in route.rules; -1 for the final route or an unknown rule
+	Label    string `json:"label"` // e.g. "split-app: chrome.exe → proxy"
+	Outbound string `json:"outbound"`
+
+	// terms are fragments the Clash API rule string of this rule contains.
+	terms []string
+}
+
+// ConnMatch reports which rule routed a new connection.
+type ConnMatch struct {
+	ID      string   `json:"id"`
+	Network string   `json:"network"`
+	Host    string   `json:"host"` // domain if sniffed, else destination IP, with port
+	Process string   `json:"process,omitempty"`
+	Rule    RuleInfo `json:"rule"`
+	Chains  []string `json:"chains"`
+	Dropped int      `json:"dropped,omitempty"` // matches suppressed by the rate cap before this one
+}
+
+// ConnMatchListener is a callback invoked when tracing matches a new
+// connection to a rule.
+type ConnMatchListener func(match ConnMatch)
+
+// describeRules labels the route rules and the final outbound.
+func describeRules(rules []interface{}, final string) ([]RuleInfo, RuleInfo) {
+	infos := make([]RuleInfo, 0, len(rules))
+	for i, r := range rules {
+		rule, _ := r.(map[string]interface{})
+		infos = append(infos, describeRule(i, rule))
+	}
+	return infos, RuleInfo{Index: -1, Label: "final: " + final, Outbound: final}
+}
+
+func describeRule(index int, rule map[string]interface{}) RuleInfo {
+	info := RuleInfo{Index: index}
+	info.Outbound, _ = rule["outbound"].(string)
+
+	var kind string
+	var values []string
+	for _, field := range []string{"inbound", "process_name", "process_path_regex", "domain", "domain_suffix", "domain_keyword", "domain_regex", "ip_cidr"} {
+		list := stringList(rule[field])
+		if len(list) == 0 {
+			continue
+		}
+		values = append(values, list...)
+		info.terms = append(info.terms, field+"=")
+		info.terms = append(info.terms, list...)
+		if kind == "" {
+			kind = field
+		}
+	}
+	network, _ := rule["network"].(string)
+	if network != "" {
+		info.terms = append(info.terms, "network="+network)
+	}
+	if port, ok := rule["port"].(int); ok {
+		info.terms = append(info.terms, fmt.Sprintf("port=%d", port))
+	}
+	protocols := stringList(rule["protocol"])
+	protocol := strings.Join(protocols, ",")
+	switch len(protocols) {
+	case 0:
+	case 1:
+		info.terms = append(info.terms, "protocol="+protocol)
+	default:
+		info.terms = append(info.terms, "protocol=")
+		info.terms = append(info.terms, protocols...)
+	}
+
+	// Sniff rules never end routing, so the Clash API never reports them.
+	if rule["action"] == "sniff" {
+		info.terms = nil
+		info.Label = "sniff"
+		if len(values) > 0 {
+			info.Label += ": " + summarize(values)
+		} else if port, ok := rule["port"].(int); ok {
+			info.Label += fmt.Sprintf(": port %d", port)
+		}
+		return info
+	}
+
+	bypass, isBypass := splittunnel.BypassRuleName(stringList(rule["domain_suffix"]), stringList(rule["ip_cidr"]))
+	isBypass = isBypass && info.Outbound == tagDirect && (kind == "domain_suffix" || kind == "ip_cidr")
+
+	var prefix string
+	switch {
+	case isBypass:
+		prefix = "bypass: " + bypass
+		values = nil // the bundle name says more than its first entries
+	case protocol == "dns" || info.Outbound == tagDNSOut:
+		prefix = "dns-hijack"
+	case rule["port"] == 53:
+		prefix = "dns-exception"
+	case network != "":
+		prefix = "transport: " + network
+		if port, ok := rule["port"].(int); ok {
+			prefix += fmt.Sprintf("/%d", port)
+		}
+	case protocol != "":
+		prefix = "sniffed: " + protocol
+	case kind == "inbound":
+		prefix = "inbound"
+	case kind == "process_name":
+		prefix = "split-app"
+	case kind == "process_path_regex":
+		prefix = "split-app: other apps"
+		values = nil
+	case strings.HasPrefix(kind, "domain"):
+		prefix = "split-domain"
+	case kind == "ip_cidr":
+		prefix = "split-ip"
+	default:
+		prefix = "rule"
+	}
+	if len(values) > 0 {
+		prefix += ": " + summarize(values)
+	}
+	info.Label = prefix + " → " + info.Outbound
+	return info
+}
+
+// summarize joins values, abbreviating long lists.
+func summarize(values []string) string {
+	const shown = 3
+	if len(values) <= shown {
+		return strings.Join(values, ", ")
+	}
+	return fmt.Sprintf("%s +%d more", strings.Join(values[:shown], ", "), len(values)-shown)
+}
+
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	}
+	return nil
+}
+
+// matchRule maps the rule string the Clash API reports for a connection
+// (e.g. "process_name=[chrome.exe] => route(proxy)") to the first generated
+// rule it describes, mirroring sing-box's first-match evaluation.
+func matchRule(rules []RuleInfo, final RuleInfo, clashRule string) RuleInfo {
+	cond, _, _ := strings.Cut(clashRule, " => ")
+	cond = strings.TrimSpace(cond)
+	if cond == "" || cond == "final" {
+		return final
+	}
+	for _, r := range rules {
+		if len(r.terms) > 0 && containsAll(cond, r.terms) {
+			return r
+		}
+	}
+	return RuleInfo{Index: -1, Label: "unknown: " + clashRule}
+}
+
+func containsAll(s string, terms []string) bool {
+	for _, t := range terms {
+		if !strings.Contains(s, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// connTracer turns connection snapshots into rule matches while tracing is
+// on, reporting each connection once and capping the rate.
+type connTracer struct {
+	until   time.Time       // tracing is on before this instant
+	seen    map[string]bool // connections already reported
+	window  time.Time       // start of the current rate window
+	sent    int             // matches sent in the current window
+	dropped int             // matches suppressed since the last one sent
+}
+
+// start enables tracing for traceDuration and returns when it ends.
+func (t *connTracer) start(now time.Time) time.Time {
+	t.until = now.Add(traceDuration)
+	t.seen = map[string]bool{}
+	t.window, t.sent, t.dropped = time.Time{}, 0, 0
+	return t.until
+}
+
+func (t *connTracer) stop() {
+	t.until = time.Time{}
+	t.seen = nil
+}
+
+func (t *connTracer) active(now time.Time) bool {
+	return now.Before(t.until)
+}
+
+func (t *connTracer) observe(conns []clashConnection, rules []RuleInfo, final RuleInfo, now time.Time) []ConnMatch {
+	if t.until.IsZero() {
+		return nil
+	}
+	if !t.active(now) {
+		log.Printf("connection tracing disabled after %s", traceDuration)
+		t.stop()
+		return nil
+	}
+
+	var matches []ConnMatch
+	present := make(map[string]bool, len(conns))
+	for i := range conns {
+		c := &conns[i]
+		key := c.key()
+		present[key] = true
+		if t.seen[key] {
+			continue
+		}
+		t.seen[key] = true
+
+		if now.Sub(t.window) >= time.Second {
+			t.window, t.sent = now, 0
+		}
+		if t.sent >= traceMaxPerSecond {
+			t.dropped++
+			continue
+		}
+		t.sent++
+		matches = append(matches, ConnMatch{
+			ID:      c.ID,
+			Network: c.Metadata.Network,
+			Host:    c.Metadata.target(),
+			Process: c.Metadata.ProcessPath,
+			Rule:    matchRule(rules, final, c.Rule),
+			Chains:  c.Chains,
+			Dropped: t.dropped,
+		})
+		t.dropped = 0
+	}
+
+	// Forget closed connections so the set does not grow for the whole
+	// tracing window.
+	for key := range t.seen {
+		if !present[key] {
+			delete(t.seen, key)
+		}
+	}
+	return matches
+}
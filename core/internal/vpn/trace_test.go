@@ -0,0 +1,161 @@
+package vpn
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBuildSingBoxConfigRuleLabels(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.SplitTunnelMode = "app"
+	cfg.SplitTunnelApps = []string{"chrome.exe"}
+	cfg.DNSHijackExceptions = []string{"launcher.exe", "10.0.0.53"}
+
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"dns-exception: launcher.exe → direct",
+		"dns-exception: 10.0.0.53/32 → direct",
+		"dns-hijack → dns-out",
+		"split-app: chrome.exe → proxy",
+	}
+	if len(built.Rules) != len(want) {
+		t.Fatalf("got %d rule labels, want %d: %+v", len(built.Rules), len(want), built.Rules)
+	}
+	for i, w := range want {
+		if built.Rules[i].Index != i || built.Rules[i].Label != w {
+			t.Errorf("rule %d = %d %q, want %q", i, built.Rules[i].Index, built.Rules[i].Label, w)
+		}
+	}
+	if built.Final.Label != "final: direct" || built.Final.Index != -1 {
+		t.Errorf("final = %+v", built.Final)
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rules, final := describeRules([]interface{}{
+		map[string]interface{}{"port": 53, "process_name": []string{"launcher.exe"}, "outbound": "direct"},
+		map[string]interface{}{"protocol": "dns", "outbound": "dns-out"},
+		map[string]interface{}{"process_name": []string{"chrome.exe", "firefox.exe"}, "outbound": "direct"},
+		map[string]interface{}{"domain_suffix": []string{".example.com"}, "outbound": "direct"},
+		map[string]interface{}{"network": "udp", "port": 443, "outbound": "block"},
+		map[string]interface{}{"domain_keyword": []string{"tiktok"}, "domain_regex": []string{`^cdn[0-9]+\.`}, "outbound": "proxy"},
+	}, "proxy")
+
+	tests := []struct {
+		clash string
+		index int
+		label string
+	}{
+		{"process_name=[chrome.exe firefox.exe] => route(direct)", 2, "split-app: chrome.exe, firefox.exe → direct"},
+		{"protocol=dns => hijack-dns", 1, "dns-hijack → dns-out"},
+		{"port=53 process_name=launcher.exe => route(direct)", 0, "dns-exception: launcher.exe → direct"},
+		{"domain_suffix=.example.com => route(direct)", 3, "split-domain: .example.com → direct"},
+		{"network=udp port=443 => route(block)", 4, "transport: udp/443 → block"},
+		{`domain_keyword=tiktok domain_regex=^cdn[0-9]+\. => route(proxy)`, 5, `split-domain: tiktok, ^cdn[0-9]+\. → proxy`},
+		{"final", -1, "final: proxy"},
+		{"", -1, "final: proxy"},
+		{"ip_cidr=1.2.3.4/32 => route(block)", -1, "unknown: ip_cidr=1.2.3.4/32 => route(block)"},
+	}
+	for _, tt := range tests {
+		got := matchRule(rules, final, tt.clash)
+		if got.Index != tt.index || got.Label != tt.label {
+			t.Errorf("matchRule(%q) = %d %q, want %d %q", tt.clash, got.Index, got.Label, tt.index, tt.label)
+		}
+	}
+}
+
+func TestSummarizeLongLists(t *testing.T) {
+	got := summarize([]string{"a.exe", "b.exe", "c.exe", "d.exe", "e.exe"})
+	if got != "a.exe, b.exe, c.exe +2 more" {
+		t.Errorf("summarize = %q", got)
+	}
+}
+
+func traceConns(ids ...string) []clashConnection {
+	conns := make([]clashConnection, len(ids))
+	for i, id := range ids {
+		conns[i] = clashConnection{
+			ID:       id,
+			Rule:     "final",
+			Chains:   []string{"proxy"},
+			Metadata: connMeta{Network: "tcp", Host: "example.com", DestinationPort: "443"},
+		}
+	}
+	return conns
+}
+
+func TestConnTracerReportsEachConnectionOnce(t *testing.T) {
+	var tr connTracer
+	now := time.Unix(1000, 0)
+	final := RuleInfo{Index: -1, Label: "final: proxy", Outbound: "proxy"}
+
+	if got := tr.observe(traceConns("a"), nil, final, now); got != nil {
+		t.Fatalf("reported %d matches while tracing is off", len(got))
+	}
+
+	tr.start(now)
+	got := tr.observe(traceConns("a", "b"), nil, final, now)
+	if len(got) != 2 || got[0].Host != "example.com:443" || got[0].Rule.Label != "final: proxy" {
+		t.Fatalf("first snapshot = %+v", got)
+	}
+	if got := tr.observe(traceConns("a", "b", "c"), nil, final, now.Add(time.Second)); len(got) != 1 || got[0].ID != "c" {
+		t.Errorf("second snapshot = %+v, want only c", got)
+	}
+}
+
+func TestConnTracerRateCap(t *testing.T) {
+	var tr connTracer
+	now := time.Unix(1000, 0)
+	tr.start(now)
+
+	ids := make([]string, traceMaxPerSecond+5)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+	}
+	if got := tr.observe(traceConns(ids...), nil, RuleInfo{}, now); len(got) != traceMaxPerSecond {
+		t.Fatalf("sent %d matches, want cap %d", len(got), traceMaxPerSecond)
+	}
+
+	got := tr.observe(traceConns(append(ids, "new")...), nil, RuleInfo{}, now.Add(time.Second))
+	if len(got) != 1 || got[0].Dropped != 5 {
+		t.Errorf("after window = %+v, want one match reporting 5 dropped", got)
+	}
+}
+
+func TestConnTracerAutoDisables(t *testing.T) {
+	var tr connTracer
+	now := time.Unix(1000, 0)
+	until := tr.start(now)
+	if until != now.Add(traceDuration) {
+		t.Errorf("until = %v", until)
+	}
+
+	if got := tr.observe(traceConns("a"), nil, RuleInfo{}, now.Add(traceDuration)); got != nil {
+		t.Errorf("reported after expiry: %+v", got)
+	}
+	if !tr.until.IsZero() {
+		t.Error("tracer still armed after expiry")
+	}
+}
+
+func TestSniffRulesAreNeverMatched(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, "vless://u@example.com:443")
+	cfg.SniffMode = SniffProxyOnly
+
+	built, err := BuildSingBoxConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := built.Rules[0].Label; got != "sniff: port 53" {
+		t.Errorf("rule 0 label = %q", got)
+	}
+	if got := matchRule(built.Rules, built.Final, "protocol=dns => hijack-dns"); got.Index != 1 {
+		t.Errorf("DNS matched rule %d (%s), want the hijack rule", got.Index, got.Label)
+	}
+}
@@ -0,0 +1,150 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Hysteria2 users tune their bandwidth hints by loss and RTT. sing-box keeps
+// the QUIC connection of the hysteria2 outbound unexported, so congestion
+// window and loss are not obtainable; RTT is measured instead by a tiny
+// HTTP request through the proxy outbound every rttProbeInterval, using
+// the Clash API delay test. probeHealth runs it for every session and
+// keeps the RTT of hysteria2 ones. Those requests bypass the router, so they don't
+// show up in traffic stats or connection tracing.
+const (
+	rttProbeInterval = 10 * time.Second
+	rttProbeTimeout  = 5 * time.Second
+	rttProbeURL      = "http://cp.cloudflare.com/generate_204"
+)
+
+// Transport stats sources.
+const (
+	SourceQUIC  = "quic"  // read from the QUIC connection
+	SourceProbe = "probe" // measured by an application-level request
+)
+
+// TransportStats are link quality figures of the active session.
+// LossPercent and CongestionWindow are nil when not obtainable.
+type TransportStats struct {
+	Protocol         string
+	Source           string
+	RTTMs            int64     // 0 until the first measurement
+	MeasuredAt       time.Time // zero until the first measurement
+	LossPercent      *float64
+	CongestionWindow *int64
+}
+
+// rttProbeEnabled reports whether sessions with cfg report RTT. Only
+// hysteria2 has use for it.
+func rttProbeEnabled(cfg *Config) bool {
+	return cfg != nil && cfg.Server != nil && cfg.Server.Protocol == "hysteria2"
+}
+
+// TransportStats returns the link quality of the active session, and false
+// when disconnected or the protocol has none.
+func (e *Engine) TransportStats() (TransportStats, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.box == nil || !rttProbeEnabled(e.config) {
+		return TransportStats{}, false
+	}
+	return TransportStats{
+		Protocol:   e.config.Server.Protocol,
+		Source:     SourceProbe,
+		RTTMs:      e.rttMs,
+		MeasuredAt: e.rttAt,
+	}, true
+}
+
+// errProxyProbeFailed marks a delay test sing-box ran that failed through
+// the proxy, as opposed to one the Clash API did not answer.
+var errProxyProbeFailed = errors.New("the probe failed through the proxy")
+
+// fetchDelay runs a Clash API delay test of the proxy outbound against
+// rttProbeURL and returns the delay in milliseconds.
+func fetchDelay(ctx context.Context, client *http.Client, baseURL, secret string) (int64, error) {
+	query := url.Values{}
+	query.Set("url", rttProbeURL)
+	query.Set("timeout", fmt.Sprint(rttProbeTimeout.Milliseconds()))
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/proxies/"+tagProxy+"/delay?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return 0, fmt.Errorf("delay test: %s: %w", resp.Status, errProxyProbeFailed)
+	default:
+		return 0, fmt.Errorf("delay test: %s", resp.Status)
+	}
+
+	var result struct {
+		Delay int64 `json:"delay"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("delay test: %w", err)
+	}
+	if result.Delay <= 0 {
+		return 0, fmt.Errorf("delay test: no delay reported")
+	}
+	return result.Delay, nil
+}
+
+// TransportInfo describes how the proxy outbound of a config reaches the
+// server.
+type TransportInfo struct {
+	Protocol    string // outbound type, e.g. "vless"
+	Transport   string // "tcp", "ws", "grpc", ..., or "quic" for QUIC-based protocols
+	Security    string // "tls", "reality" or "none"
+	Mux         bool   // connections share multiplexed streams
+	MuxProtocol string // "smux", "yamux" or "h2mux" when Mux is set
+}
+
+// quicProtocols run over QUIC whatever their transport field says.
+var quicProtocols = map[string]bool{"hysteria": true, "hysteria2": true, "tuic": true}
+
+// DescribeTransport reads the transport of the proxy outbound cfg builds.
+func DescribeTransport(cfg *Config) (TransportInfo, error) {
+	outbound, err := buildProxyOutbound(cfg)
+	if err != nil {
+		return TransportInfo{}, err
+	}
+	info := TransportInfo{Transport: "tcp", Security: "none"}
+	info.Protocol, _ = outbound["type"].(string)
+	if transport, ok := outbound["transport"].(map[string]interface{}); ok {
+		if t, _ := transport["type"].(string); t != "" {
+			info.Transport = t
+		}
+	}
+	if quicProtocols[info.Protocol] {
+		info.Transport = "quic"
+	}
+	if tls, ok := outbound["tls"].(map[string]interface{}); ok && tls["enabled"] == true {
+		info.Security = "tls"
+		if reality, ok := tls["reality"].(map[string]interface{}); ok && reality["enabled"] == true {
+			info.Security = "reality"
+		}
+	}
+	if mux, ok := outbound["multiplex"].(map[string]interface{}); ok && mux["enabled"] == true {
+		info.Mux = true
+		info.MuxProtocol, _ = mux["protocol"].(string)
+		if info.MuxProtocol == "" {
+			info.MuxProtocol = "h2mux" // sing-box's default
+		}
+	}
+	return info, nil
+}
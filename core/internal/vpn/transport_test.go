@@ -0,0 +1,102 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+func TestRTTProbeEnabled(t *testing.T) {
+	tests := []struct {
+		protocol string
+		want     bool
+	}{
+		{"hysteria2", true},
+		{"vless", false},
+		{"shadowsocks", false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Server: &parser.ServerConfig{Protocol: tt.protocol}}
+		if got := rttProbeEnabled(cfg); got != tt.want {
+			t.Errorf("rttProbeEnabled(%s) = %v, want %v", tt.protocol, got, tt.want)
+		}
+	}
+	if rttProbeEnabled(nil) || rttProbeEnabled(&Config{}) {
+		t.Error("probe enabled without a server")
+	}
+}
+
+func TestFetchDelay(t *testing.T) {
+	var gotPath, gotURL, gotAuth string
+	status, body := http.StatusOK, `{"delay":87}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotURL, gotAuth = r.URL.Path, r.URL.Query().Get("url"), r.Header.Get("Authorization")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	rtt, err := fetchDelay(context.Background(), srv.Client(), srv.URL, "s3cret")
+	if err != nil || rtt != 87 {
+		t.Fatalf("fetchDelay = %d, %v", rtt, err)
+	}
+	if gotPath != "/proxies/proxy/delay" || gotURL != rttProbeURL || gotAuth != "Bearer s3cret" {
+		t.Errorf("request path %q, url %q, auth %q", gotPath, gotURL, gotAuth)
+	}
+
+	// Timeouts come back as errors, never as a zero RTT.
+	// Only failures through the proxy are marked errProxyProbeFailed.
+	for _, tt := range []struct {
+		status       int
+		body         string
+		throughProxy bool
+	}{
+		{http.StatusGatewayTimeout, `{"message":"Timeout"}`, true},
+		{http.StatusServiceUnavailable, `{"message":"An error occurred in the delay test"}`, true},
+		{http.StatusUnauthorized, `{"message":"Unauthorized"}`, false},
+		{http.StatusOK, `{"delay":0}`, false},
+		{http.StatusOK, `not json`, false},
+	} {
+		status, body = tt.status, tt.body
+		rtt, err := fetchDelay(context.Background(), srv.Client(), srv.URL, "")
+		if err == nil {
+			t.Errorf("%d %s: rtt %d, want error", tt.status, tt.body, rtt)
+		} else if errors.Is(err, errProxyProbeFailed) != tt.throughProxy {
+			t.Errorf("%d %s: err = %v, through the proxy = %v", tt.status, tt.body, err, tt.throughProxy)
+		}
+	}
+}
+
+func TestDescribeTransport(t *testing.T) {
+	tests := []struct {
+		link string
+		want TransportInfo
+	}{
+		{"vless://u@example.com:443?security=reality&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc", TransportInfo{Protocol: "vless", Transport: "tcp", Security: "reality"}},
+		{"vless://u@example.com:443?security=tls&type=ws&path=/ws", TransportInfo{Protocol: "vless", Transport: "ws", Security: "tls"}},
+		{"vless://u@example.com:80", TransportInfo{Protocol: "vless", Transport: "tcp", Security: "none"}},
+		{"hy2://p@example.com:443", TransportInfo{Protocol: "hysteria2", Transport: "quic", Security: "tls"}},
+	}
+	for _, tt := range tests {
+		got, err := DescribeTransport(&Config{Server: mustParse(t, tt.link)})
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %+v, %v; want %+v", tt.link, got, err, tt.want)
+		}
+	}
+
+	raw, server, err := ParseRawOutbound([]byte(`{
+		"type": "vless", "server": "example.com", "server_port": 443, "uuid": "u",
+		"multiplex": {"enabled": true, "protocol": "smux"}
+	}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DescribeTransport(&Config{Server: server, RawOutbound: raw})
+	if want := (TransportInfo{Protocol: "vless", Transport: "tcp", Security: "none", Mux: true, MuxProtocol: "smux"}); err != nil || got != want {
+		t.Errorf("raw outbound: %+v, %v; want %+v", got, err, want)
+	}
+}
@@ -0,0 +1,69 @@
+package vpn
+
+import "log"
+
+// The Clash API counts the bytes of the connections it tracks, which
+// misses UDP flows outside connection tracking and connections that open
+// and close between polls. The TUN adapter's interface counters see every
+// packet that enters or leaves the tunnel, whatever its route, so they are
+// reported alongside as a second source.
+
+// tunCounter turns the TUN adapter's byte counters into session totals.
+// The adapter is found by name once per session and then read by LUID,
+// which unlike its index stays valid while the adapter exists.
+type tunCounter struct {
+	luid     uint64
+	lastIn   uint64
+	lastOut  uint64
+	upload   int64 // bytes apps sent into the tunnel this session
+	download int64 // bytes the tunnel delivered to apps this session
+	failed   bool  // the last read failed; logged once per streak
+}
+
+// newTunCounter finds the TUN adapter and takes the counters' baseline, or
+// returns nil when the adapter cannot be read.
+func newTunCounter(api ifaceAPI, name string) *tunCounter {
+	luid, err := api.interfaceLUID(name)
+	if err != nil {
+		log.Printf("warning: TUN adapter counters unavailable: %v", err)
+		return nil
+	}
+	c := &tunCounter{luid: luid}
+	if in, out, err := api.octets(luid); err == nil {
+		c.lastIn, c.lastOut = in, out
+	}
+	return c
+}
+
+// read adds the traffic counted since the last read. An adapter recreated
+// under the same name gets a new LUID and counters that start from zero.
+func (c *tunCounter) read(api ifaceAPI, name string) {
+	in, out, err := api.octets(c.luid)
+	if err != nil {
+		luid, lookupErr := api.interfaceLUID(name)
+		if lookupErr == nil && luid != c.luid {
+			c.luid, c.lastIn, c.lastOut = luid, 0, 0
+			in, out, err = api.octets(luid)
+		}
+	}
+	if err != nil {
+		if !c.failed {
+			log.Printf("warning: failed to read TUN adapter counters: %v", err)
+		}
+		c.failed = true
+		return
+	}
+	c.failed = false
+	c.download += int64(counterDelta(c.lastIn, in))
+	c.upload += int64(counterDelta(c.lastOut, out))
+	c.lastIn, c.lastOut = in, out
+}
+
+// counterDelta returns how much a counter grew from last to now. A counter
+// below its last value was reset, and counted up from zero since.
+func counterDelta(last, now uint64) uint64 {
+	if now < last {
+		return now
+	}
+	return now - last
+}
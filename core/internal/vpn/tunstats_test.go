@@ -0,0 +1,126 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mriaz/vpn-core/internal/instance"
+	"github.com/mriaz/vpn-core/internal/parser"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		last, now, want uint64
+	}{
+		{100, 150, 50},
+		{100, 100, 0},
+		{1 << 63, 1<<63 + 10, 10},
+		{500, 20, 20}, // reset: counted up from zero
+	}
+	for _, tt := range tests {
+		if got := counterDelta(tt.last, tt.now); got != tt.want {
+			t.Errorf("counterDelta(%d, %d) = %d, want %d", tt.last, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestTunCounter(t *testing.T) {
+	api := newFakeIfaceAPI()
+	api.in, api.out = 1000, 400 // traffic before the session
+
+	c := newTunCounter(api, instance.Default.InterfaceName())
+	if c == nil {
+		t.Fatal("no counter")
+	}
+	api.in, api.out = 1500, 600
+	c.read(api, instance.Default.InterfaceName())
+	if c.download != 500 || c.upload != 200 {
+		t.Errorf("after first read: down %d up %d, want 500 200", c.download, c.upload)
+	}
+
+	// The adapter was recreated under the same LUID: counters restart.
+	api.in, api.out = 30, 10
+	c.read(api, instance.Default.InterfaceName())
+	if c.download != 530 || c.upload != 210 {
+		t.Errorf("after reset: down %d up %d, want 530 210", c.download, c.upload)
+	}
+
+	// Reads by LUID keep working however the adapter's index changes; a
+	// failed read counts nothing and keeps the totals.
+	api.failSet["octets"] = errors.New("not found")
+	c.read(api, instance.Default.InterfaceName())
+	if c.download != 530 || !c.failed {
+		t.Errorf("failed read: down %d failed %v", c.download, c.failed)
+	}
+}
+
+func TestTunCounterFollowsNewLUID(t *testing.T) {
+	api := newFakeIfaceAPI()
+	api.in, api.out = 100, 100
+	c := newTunCounter(api, instance.Default.InterfaceName())
+
+	// The old LUID is gone; the adapter came back with a new one.
+	api.luid = 0x8000
+	api.in, api.out = 40, 20
+	old := &luidFilter{fakeIfaceAPI: api, gone: c.luid}
+	c.read(old, instance.Default.InterfaceName())
+	if c.luid != 0x8000 || c.download != 40 || c.upload != 20 {
+		t.Errorf("counter = %+v, want the new adapter's totals", c)
+	}
+}
+
+// luidFilter fails reads of a LUID that no longer exists.
+type luidFilter struct {
+	*fakeIfaceAPI
+	gone uint64
+}
+
+func (f *luidFilter) octets(luid uint64) (uint64, uint64, error) {
+	if luid == f.gone {
+		return 0, 0, errors.New("element not found")
+	}
+	return f.fakeIfaceAPI.octets(luid)
+}
+
+// growingIface is an adapter whose counters grow by 1000 bytes in and 100
+// out per read.
+type growingIface struct {
+	*fakeIfaceAPI
+	reads atomic.Uint64
+}
+
+func (g *growingIface) octets(luid uint64) (uint64, uint64, error) {
+	n := g.reads.Add(1)
+	return n * 1000, n * 100, nil
+}
+
+func TestStatsReportTunCounters(t *testing.T) {
+	e := newStubEngine()
+	e.ifaces = &growingIface{fakeIfaceAPI: newFakeIfaceAPI()}
+	stats := make(chan Stats, 1)
+	e.stateMachine.OnStats(func(s Stats) {
+		select {
+		case stats <- s:
+		default:
+		}
+	})
+
+	cfg := DefaultConfig()
+	cfg.Server = &parser.ServerConfig{Protocol: "vless", Address: "example.com", Port: 443, Params: map[string]string{"uuid": "u"}}
+	if err := e.Connect(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Disconnect()
+
+	// The baseline is taken at connect; the first poll adds one read.
+	s := <-stats
+	if s.TunDownload != 1000 || s.TunUpload != 100 {
+		t.Errorf("tun counters = down %d up %d, want 1000 100", s.TunDownload, s.TunUpload)
+	}
+	// The proxy counters are reported alongside.
+	if s.Upload == 0 {
+		t.Errorf("proxy upload = 0")
+	}
+}
@@ -0,0 +1,320 @@
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An upstream proxy carries the connection to the server for networks
+// that only reach the internet through a mandatory HTTP or SOCKS5 proxy.
+// The proxy outbound dials the server through a generated outbound to it
+// (tag "upstream"); under a rate limit that outbound in turn dials
+// through the shaping one. An HTTP proxy only relays TCP through CONNECT,
+// and sing-box's SOCKS5 outbound is used the same way, so protocols that
+// run over UDP cannot use one.
+const (
+	UpstreamHTTP   = "http"
+	UpstreamSOCKS5 = "socks5"
+)
+
+const tagUpstream = "upstream"
+
+// ChangeUpstreamProxy is the pending change of the upstream proxy setting
+// made while connected.
+const ChangeUpstreamProxy = "upstreamProxy"
+
+// maxUpstreamCredential is the longest username or password SOCKS5 can
+// carry.
+const maxUpstreamCredential = 255
+
+// upstreamProbeTimeout bounds the whole preflight, from dialing the proxy
+// to its answer to the CONNECT.
+const upstreamProbeTimeout = 5 * time.Second
+
+// UpstreamProxy is the HTTP or SOCKS5 proxy the connection to the server
+// goes through. Username and Password are optional.
+type UpstreamProxy struct {
+	Type     string
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// ErrUpstreamProxyConflict reports a server whose protocol cannot be
+// reached through an upstream proxy.
+var ErrUpstreamProxyConflict = errors.New("server protocol runs over UDP, which an upstream proxy cannot carry")
+
+// Validate checks the proxy is complete and its credentials fit SOCKS5.
+func (p UpstreamProxy) Validate() error {
+	if p.Type != UpstreamHTTP && p.Type != UpstreamSOCKS5 {
+		return fmt.Errorf("type must be %q or %q", UpstreamHTTP, UpstreamSOCKS5)
+	}
+	if p.Host == "" || strings.ContainsAny(p.Host, " /\t") {
+		return fmt.Errorf("host must be a hostname or IP address")
+	}
+	if p.Port < 1 || p.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	if len(p.Username) > maxUpstreamCredential || len(p.Password) > maxUpstreamCredential {
+		return fmt.Errorf("username and password must be at most %d bytes", maxUpstreamCredential)
+	}
+	if p.Password != "" && p.Username == "" {
+		return fmt.Errorf("password requires a username")
+	}
+	return nil
+}
+
+// Addr returns the proxy's host:port.
+func (p UpstreamProxy) Addr() string {
+	return net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+}
+
+// URL returns the proxy as an http.Transport proxy URL, with its
+// credentials.
+func (p UpstreamProxy) URL() *url.URL {
+	u := &url.URL{Scheme: p.Type, Host: p.Addr()}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u
+}
+
+// CheckUpstreamProxy returns ErrUpstreamProxyConflict if the server cannot
+// be reached through the configured upstream proxy.
+func (c *Config) CheckUpstreamProxy() error {
+	if c.UpstreamProxy == nil {
+		return nil
+	}
+	switch proxyType(c) {
+	case "hysteria", "hysteria2", "tuic", "wireguard":
+		return ErrUpstreamProxyConflict
+	}
+	return nil
+}
+
+// applyUpstreamProxy makes the proxy outbound dial through cfg's upstream
+// proxy and returns the outbound for it, to add to the config; nil
+// without one. It runs after applyRateLimit: the upstream outbound takes
+// over the proxy's detour to the shaping outbound, or its dial options.
+func applyUpstreamProxy(cfg *Config, proxy map[string]interface{}) map[string]interface{} {
+	p := cfg.UpstreamProxy
+	if p == nil {
+		return nil
+	}
+	upstream := map[string]interface{}{
+		"type":        "http",
+		"tag":         tagUpstream,
+		"server":      p.Host,
+		"server_port": p.Port,
+	}
+	if p.Type == UpstreamSOCKS5 {
+		upstream["type"] = "socks"
+		upstream["version"] = "5"
+	}
+	if p.Username != "" {
+		upstream["username"] = p.Username
+		upstream["password"] = p.Password
+	}
+	if detour, ok := proxy["detour"]; ok {
+		upstream["detour"] = detour
+	} else {
+		for _, field := range detourDialFields {
+			if v, ok := proxy[field]; ok {
+				upstream[field] = v
+				delete(proxy, field)
+			}
+		}
+	}
+	proxy["detour"] = tagUpstream
+	return upstream
+}
+
+// Preflight stages at which an upstream proxy can fail.
+const (
+	UpstreamStageDial      = "dial"      // the proxy is unreachable
+	UpstreamStageHandshake = "handshake" // it does not speak the configured protocol
+	UpstreamStageAuth      = "auth"      // it refused the credentials or asks for some
+	UpstreamStageConnect   = "connect"   // it refused to connect to the server
+)
+
+// UpstreamProxyError is a failed preflight of an upstream proxy.
+type UpstreamProxyError struct {
+	Stage string
+	Err   error
+}
+
+func (e *UpstreamProxyError) Error() string {
+	return fmt.Sprintf("upstream proxy %s: %v", e.Stage, e.Err)
+}
+
+func (e *UpstreamProxyError) Unwrap() error { return e.Err }
+
+// ProbeUpstreamProxy checks that p accepts its credentials and connects to
+// target, the server's host:port, before the tunnel is attempted; a
+// misconfigured proxy otherwise surfaces as a generic connect failure.
+// Failures are *UpstreamProxyError.
+func ProbeUpstreamProxy(ctx context.Context, p UpstreamProxy, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, upstreamProbeTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Addr())
+	if err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageDial, Err: err}
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if p.Type == UpstreamSOCKS5 {
+		return socks5Connect(conn, p, target)
+	}
+	return httpConnect(conn, p, target)
+}
+
+// httpConnect sends an HTTP CONNECT to target over conn.
+func httpConnect(conn net.Conn, p UpstreamProxy, target string) error {
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if p.Username != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageHandshake, Err: err}
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageHandshake, Err: err}
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return &UpstreamProxyError{Stage: UpstreamStageAuth, Err: fmt.Errorf("proxy answered %s", resp.Status)}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return &UpstreamProxyError{Stage: UpstreamStageConnect, Err: fmt.Errorf("proxy answered %s", resp.Status)}
+	}
+	return nil
+}
+
+// SOCKS5 (RFC 1928) and its username/password authentication (RFC 1929).
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+)
+
+// socks5Connect negotiates authentication and sends a SOCKS5 CONNECT to
+// target over conn. The bound address of the reply is left unread.
+func socks5Connect(conn net.Conn, p UpstreamProxy, target string) error {
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageConnect, Err: err}
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageConnect, Err: err}
+	}
+
+	greeting := []byte{socks5Version, 1, socks5NoAuth}
+	if p.Username != "" {
+		greeting = []byte{socks5Version, 2, socks5NoAuth, socks5UserPass}
+	}
+	reply := make([]byte, 2)
+	if _, err := conn.Write(greeting); err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageHandshake, Err: err}
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageHandshake, Err: err}
+	}
+	if reply[0] != socks5Version {
+		return &UpstreamProxyError{Stage: UpstreamStageHandshake, Err: fmt.Errorf("not a SOCKS5 proxy")}
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if p.Username == "" {
+			return &UpstreamProxyError{Stage: UpstreamStageAuth, Err: fmt.Errorf("proxy requires a username and password")}
+		}
+		auth := []byte{1, byte(len(p.Username))}
+		auth = append(auth, p.Username...)
+		auth = append(auth, byte(len(p.Password)))
+		auth = append(auth, p.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return &UpstreamProxyError{Stage: UpstreamStageAuth, Err: err}
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return &UpstreamProxyError{Stage: UpstreamStageAuth, Err: err}
+		}
+		if reply[1] != 0 {
+			return &UpstreamProxyError{Stage: UpstreamStageAuth, Err: fmt.Errorf("proxy rejected the username or password")}
+		}
+	case socks5NoAcceptable:
+		return &UpstreamProxyError{Stage: UpstreamStageAuth, Err: fmt.Errorf("proxy accepts none of the offered authentication methods")}
+	default:
+		return &UpstreamProxyError{Stage: UpstreamStageHandshake, Err: fmt.Errorf("proxy chose unknown authentication method %d", reply[1])}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return &UpstreamProxyError{Stage: UpstreamStageConnect, Err: fmt.Errorf("host name too long")}
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageConnect, Err: err}
+	}
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return &UpstreamProxyError{Stage: UpstreamStageConnect, Err: err}
+	}
+	if head[1] != 0 {
+		return &UpstreamProxyError{Stage: UpstreamStageConnect, Err: fmt.Errorf("proxy refused the connection: %s", socks5ReplyText(head[1]))}
+	}
+	return nil
+}
+
+// socks5ReplyText describes a SOCKS5 reply code.
+func socks5ReplyText(code byte) string {
+	switch code {
+	case 1:
+		return "general failure"
+	case 2:
+		return "not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("reply code %d", code)
+}
@@ -0,0 +1,216 @@
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing-box/option"
+)
+
+const upstreamTestLink = "vless://11111111-2222-3333-4444-555555555555@example.com:443?security=tls&sni=example.com"
+
+func TestApplyUpstreamProxy(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy UpstreamProxy
+		want  map[string]interface{}
+	}{
+		{
+			name:  "http without auth",
+			proxy: UpstreamProxy{Type: UpstreamHTTP, Host: "proxy.corp.example", Port: 3128},
+			want: map[string]interface{}{
+				"type": "http", "tag": tagUpstream, "server": "proxy.corp.example", "server_port": float64(3128),
+			},
+		},
+		{
+			name:  "socks5 with auth",
+			proxy: UpstreamProxy{Type: UpstreamSOCKS5, Host: "10.0.0.5", Port: 1080, Username: "alice", Password: "s3cret"},
+			want: map[string]interface{}{
+				"type": "socks", "version": "5", "tag": tagUpstream, "server": "10.0.0.5", "server_port": float64(1080),
+				"username": "alice", "password": "s3cret",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A raw outbound, as sing-box rejects the keep-alive the VLESS
+			// builder sets.
+			outbound, server, err := ParseRawOutbound(json.RawMessage(`{"type":"trojan","server":"example.com","server_port":443,
+				"password":"secret","tls":{"enabled":true}}`), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := DefaultConfig()
+			cfg.Server, cfg.RawOutbound = server, outbound
+			cfg.UpstreamProxy = &tt.proxy
+			built, err := BuildSingBoxConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var opts option.Options
+			if err := opts.UnmarshalJSONContext(boxContext(context.Background(), &shaper{}), built.JSON); err != nil {
+				t.Fatalf("sing-box rejects the config: %v", err)
+			}
+
+			outbounds := builtOutbounds(t, cfg)
+			proxy, upstream := outbounds[0], outbounds[len(outbounds)-1]
+			if proxy["detour"] != tagUpstream {
+				t.Errorf("proxy detour %v, want %q", proxy["detour"], tagUpstream)
+			}
+			if fmt.Sprint(upstream) != fmt.Sprint(tt.want) {
+				t.Errorf("upstream outbound %v, want %v", upstream, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyUpstreamProxyChains(t *testing.T) {
+	// A rate limited session dials proxy -> upstream -> shaped.
+	cfg := DefaultConfig()
+	cfg.Server = mustParse(t, upstreamTestLink)
+	cfg.RateLimit = RateLimit{MaxDownMbps: 5}
+	cfg.UpstreamProxy = &UpstreamProxy{Type: UpstreamHTTP, Host: "proxy.corp.example", Port: 8080}
+	outbounds := builtOutbounds(t, cfg)
+	tags := map[string]map[string]interface{}{}
+	for _, o := range outbounds {
+		tags[o["tag"].(string)] = o
+	}
+	if outbounds[0]["detour"] != tagUpstream || tags[tagUpstream]["detour"] != tagShaped || tags[tagShaped] == nil {
+		t.Errorf("proxy %v, upstream %v; want proxy -> upstream -> shaped", outbounds[0], tags[tagUpstream])
+	}
+
+	// Without one, the upstream outbound dials with the proxy's options.
+	outbound, server, err := ParseRawOutbound(json.RawMessage(`{"type":"trojan","server":"example.com","server_port":443,
+		"password":"secret","connect_timeout":"5s","tls":{"enabled":true}}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = DefaultConfig()
+	cfg.Server, cfg.RawOutbound = server, outbound
+	cfg.UpstreamProxy = &UpstreamProxy{Type: UpstreamSOCKS5, Host: "proxy.corp.example", Port: 1080}
+	outbounds = builtOutbounds(t, cfg)
+	proxy, upstream := outbounds[0], outbounds[len(outbounds)-1]
+	if _, ok := proxy["connect_timeout"]; ok || upstream["connect_timeout"] != "5s" || upstream["detour"] != nil {
+		t.Errorf("proxy %v, upstream %v", proxy, upstream)
+	}
+}
+
+func TestUpstreamProxyConflict(t *testing.T) {
+	proxy := &UpstreamProxy{Type: UpstreamHTTP, Host: "proxy.corp.example", Port: 3128}
+	for _, link := range []string{"hy2://p@example.com:443", "hysteria2://p@example.com:443?sni=example.com"} {
+		cfg := DefaultConfig()
+		cfg.Server = mustParse(t, link)
+		cfg.UpstreamProxy = proxy
+		if _, err := BuildSingBoxConfig(cfg); !errors.Is(err, ErrUpstreamProxyConflict) {
+			t.Errorf("%s: err = %v, want ErrUpstreamProxyConflict", link, err)
+		}
+	}
+
+	outbound, server, err := ParseRawOutbound(json.RawMessage(`{"type":"tuic","server":"example.com","server_port":443,
+		"uuid":"11111111-2222-3333-4444-555555555555","tls":{"enabled":true}}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Server, cfg.RawOutbound = server, outbound
+	cfg.UpstreamProxy = proxy
+	if err := cfg.CheckUpstreamProxy(); !errors.Is(err, ErrUpstreamProxyConflict) {
+		t.Errorf("raw tuic: err = %v, want ErrUpstreamProxyConflict", err)
+	}
+
+	cfg = DefaultConfig()
+	cfg.Server = mustParse(t, upstreamTestLink)
+	cfg.UpstreamProxy = proxy
+	if err := cfg.CheckUpstreamProxy(); err != nil {
+		t.Errorf("vless: %v", err)
+	}
+}
+
+func TestUpstreamProxyValidate(t *testing.T) {
+	tests := []struct {
+		proxy UpstreamProxy
+		ok    bool
+	}{
+		{UpstreamProxy{Type: UpstreamHTTP, Host: "proxy", Port: 3128}, true},
+		{UpstreamProxy{Type: UpstreamSOCKS5, Host: "::1", Port: 1080, Username: "u", Password: "p"}, true},
+		{UpstreamProxy{Type: UpstreamSOCKS5, Host: "proxy", Port: 1080, Username: "u"}, true},
+		{UpstreamProxy{Type: "https", Host: "proxy", Port: 443}, false},
+		{UpstreamProxy{Type: UpstreamHTTP, Port: 3128}, false},
+		{UpstreamProxy{Type: UpstreamHTTP, Host: "http://proxy", Port: 3128}, false},
+		{UpstreamProxy{Type: UpstreamHTTP, Host: "proxy", Port: 70000}, false},
+		{UpstreamProxy{Type: UpstreamHTTP, Host: "proxy", Port: 3128, Password: "p"}, false},
+		{UpstreamProxy{Type: UpstreamSOCKS5, Host: "proxy", Port: 1080, Username: string(make([]byte, 256))}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.proxy.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: err = %v", tt.proxy, err)
+		}
+	}
+}
+
+// upstreamServer runs a sing-box mixed inbound, an HTTP and SOCKS5 proxy
+// that wants alice's credentials, and returns its port.
+func upstreamServer(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	configJSON := fmt.Sprintf(`{
+		"log": {"disabled": true},
+		"inbounds": [{"type": "mixed", "tag": "in", "listen": "127.0.0.1", "listen_port": %d,
+			"users": [{"username": "alice", "password": "s3cret"}]}],
+		"outbounds": [{"type": "direct", "tag": "direct"}]
+	}`, port)
+	ctx, cancel := context.WithCancel(boxContext(context.Background(), &shaper{}))
+	t.Cleanup(cancel)
+	instance, err := startSingBox(ctx, []byte(configJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { instance.Close() })
+	return port
+}
+
+func TestProbeUpstreamProxy(t *testing.T) {
+	port := upstreamServer(t)
+	target := echoServer(t)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	tests := []struct {
+		name  string
+		proxy UpstreamProxy
+		stage string // "" for success
+	}{
+		{"http", UpstreamProxy{Type: UpstreamHTTP, Port: port, Username: "alice", Password: "s3cret"}, ""},
+		{"socks5", UpstreamProxy{Type: UpstreamSOCKS5, Port: port, Username: "alice", Password: "s3cret"}, ""},
+		{"http wrong password", UpstreamProxy{Type: UpstreamHTTP, Port: port, Username: "alice", Password: "nope"}, UpstreamStageAuth},
+		{"socks5 wrong password", UpstreamProxy{Type: UpstreamSOCKS5, Port: port, Username: "alice", Password: "nope"}, UpstreamStageAuth},
+		{"socks5 without auth", UpstreamProxy{Type: UpstreamSOCKS5, Port: port}, UpstreamStageAuth},
+		{"unreachable", UpstreamProxy{Type: UpstreamHTTP, Port: closedPort}, UpstreamStageDial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.proxy.Host = "127.0.0.1"
+			err := ProbeUpstreamProxy(context.Background(), tt.proxy, target)
+			var proxyErr *UpstreamProxyError
+			switch {
+			case tt.stage == "" && err != nil:
+				t.Errorf("err = %v", err)
+			case tt.stage != "" && (!errors.As(err, &proxyErr) || proxyErr.Stage != tt.stage):
+				t.Errorf("err = %v, want stage %q", err, tt.stage)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package vpn
+
+import (
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// singBoxModule is the module path of the embedded sing-box core.
+const singBoxModule = "github.com/sagernet/sing-box"
+
+var (
+	coreVersionOnce sync.Once
+	coreVersion     string
+)
+
+// CoreVersion returns the version of the embedded sing-box core as recorded
+// in the binary's build info, e.g. "1.12.21". Returns "unknown" when the
+// build info is unavailable (e.g. stripped test binaries).
+func CoreVersion() string {
+	coreVersionOnce.Do(func() {
+		coreVersion = "unknown"
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		for _, dep := range info.Deps {
+			if dep.Path != singBoxModule {
+				continue
+			}
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				dep = dep.Replace
+			}
+			coreVersion = strings.TrimPrefix(dep.Version, "v")
+			return
+		}
+	})
+	return coreVersion
+}
+
+// parseVersion splits a "1.12.21" style version into numeric components.
+// Pre-release and build suffixes ("-beta.1", "+meta") are ignored.
+// Returns nil if the version is not in a recognizable form.
+func parseVersion(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if idx := strings.IndexAny(v, "-+"); idx != -1 {
+		v = v[:idx]
+	}
+	if v == "" {
+		return nil
+	}
+	parts := strings.Split(v, ".")
+	nums := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil
+		}
+		nums = append(nums, n)
+	}
+	return nums
+}
+
+// versionAtLeast reports whether version v is greater than or equal to min.
+// Unparseable versions are treated as satisfying the requirement so that
+// unknown builds never produce false warnings.
+func versionAtLeast(v, min string) bool {
+	a, b := parseVersion(v), parseVersion(min)
+	if a == nil || b == nil {
+		return true
+	}
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+// Package winevent writes session events to the Windows Event Log, under
+// the event source the service registers at install, so that they reach
+// the tools enterprises collect the log with.
+package winevent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// Event IDs, one per kind of event. They are what log queries and SIEM
+// rules match on, so they never change meaning.
+const (
+	IDConnected         = 1000 // a session came up
+	IDDisconnected      = 1001 // a session ended
+	IDError             = 1002 // a connect failed or a session was lost
+	IDKillSwitchEngaged = 1003 // the kill switch held traffic in the tunnel
+	IDReconnect         = 1004 // a session's link was re-established
+	IDServicePanic      = 1005 // the service stopped on an internal error
+)
+
+// ErrNotRegistered is returned by Open when the event source is not
+// registered, as in a development run of a service never installed.
+var ErrNotRegistered = errors.New("event source is not registered")
+
+// Writer writes events to an event log; *eventlog.Log is one.
+type Writer interface {
+	Info(eid uint32, msg string) error
+	Warning(eid uint32, msg string) error
+	Error(eid uint32, msg string) error
+}
+
+// Severities of an event.
+const (
+	severityInfo = iota
+	severityWarning
+	severityError
+)
+
+// Emitter turns session events into Event Log entries. Entries name the
+// server by its display name, address and protocol; credentials in its
+// parameters are never written.
+type Emitter struct {
+	writer  Writer
+	enabled func() bool
+
+	mu     sync.Mutex
+	server *parser.ServerConfig // of the current session, for events that carry none
+}
+
+// NewEmitter returns an emitter writing to w while enabled returns true.
+func NewEmitter(w Writer, enabled func() bool) *Emitter {
+	return &Emitter{writer: w, enabled: enabled}
+}
+
+// Transition writes the event for a state change, if any: connected,
+// disconnected or error. The link of a reconnect coming up is reported
+// by Reconnect instead.
+func (e *Emitter) Transition(t vpn.Transition) {
+	e.mu.Lock()
+	if t.Server != nil {
+		e.server = t.Server
+	}
+	e.mu.Unlock()
+
+	switch t.State {
+	case vpn.StateConnected:
+		if t.Reason == vpn.ReasonReconnect {
+			return
+		}
+		e.write(severityInfo, IDConnected, fmt.Sprintf("VPN connected to %s.", serverLabel(t.Server)))
+	case vpn.StateDisconnected:
+		if t.Previous == vpn.StateDisconnected || t.Previous == vpn.StateError {
+			return
+		}
+		msg := fmt.Sprintf("VPN disconnected from %s after %s.", serverLabel(t.Server), formatDuration(t.Duration))
+		if t.Reason != "" {
+			msg += " Reason: " + t.Reason + "."
+		}
+		e.write(severityInfo, IDDisconnected, msg)
+	case vpn.StateError:
+		what := "VPN connect to %s failed."
+		if t.Previous == vpn.StateConnected {
+			what = "VPN connection to %s was lost."
+		}
+		msg := fmt.Sprintf(what, serverLabel(t.Server))
+		if t.Err != nil {
+			msg += " Error: " + t.Err.Error()
+		}
+		e.write(severityError, IDError, msg)
+	}
+}
+
+// KillSwitchEngaged writes the first kill switch engagement of a session.
+func (e *Emitter) KillSwitchEngaged(stats vpn.KillSwitchStats) {
+	e.mu.Lock()
+	server := e.server
+	e.mu.Unlock()
+	e.write(severityWarning, IDKillSwitchEngaged, fmt.Sprintf(
+		"VPN kill switch engaged: %s stopped answering and traffic is held in the tunnel. Blocked connections: %d.",
+		serverLabel(server), stats.BlockedConnections))
+}
+
+// Reconnect writes a re-established link.
+func (e *Emitter) Reconnect(r vpn.Reconnect) {
+	e.write(severityInfo, IDReconnect, fmt.Sprintf(
+		"VPN reconnected to %s after %s down. Session up for %s.",
+		serverLabel(r.Server), formatDuration(time.Duration(r.DownMs)*time.Millisecond),
+		formatDuration(r.At.Sub(r.SessionStarted))))
+}
+
+// write writes one entry unless the event log is turned off. It runs in
+// the listener, while the engine holds its lock, which keeps entries in
+// order; writing an entry is a local call that does not block.
+func (e *Emitter) write(severity int, id uint32, msg string) {
+	if !e.enabled() {
+		return
+	}
+	var err error
+	switch severity {
+	case severityWarning:
+		err = e.writer.Warning(id, msg)
+	case severityError:
+		err = e.writer.Error(id, msg)
+	default:
+		err = e.writer.Info(id, msg)
+	}
+	if err != nil {
+		log.Printf("warning: failed to write event %d to the event log: %v", id, err)
+	}
+}
+
+// serverLabel names server as "Name (host:port, protocol)".
+func serverLabel(server *parser.ServerConfig) string {
+	if server == nil {
+		return "the server"
+	}
+	addr := net.JoinHostPort(server.Address, strconv.Itoa(int(server.Port)))
+	if server.Name == "" {
+		return fmt.Sprintf("%s (%s)", addr, server.Protocol)
+	}
+	return fmt.Sprintf("%s (%s, %s)", server.Name, addr, server.Protocol)
+}
+
+// formatDuration rounds d to the second.
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
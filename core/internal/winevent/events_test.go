@@ -0,0 +1,173 @@
+package winevent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mriaz/vpn-core/internal/parser"
+	"github.com/mriaz/vpn-core/internal/vpn"
+)
+
+// entry is one event written to the fake log.
+type entry struct {
+	severity string
+	id       uint32
+	msg      string
+}
+
+// fakeWriter records the events written.
+type fakeWriter struct {
+	entries []entry
+	err     error
+}
+
+func (f *fakeWriter) Info(eid uint32, msg string) error    { return f.add("info", eid, msg) }
+func (f *fakeWriter) Warning(eid uint32, msg string) error { return f.add("warning", eid, msg) }
+func (f *fakeWriter) Error(eid uint32, msg string) error   { return f.add("error", eid, msg) }
+
+func (f *fakeWriter) add(severity string, eid uint32, msg string) error {
+	f.entries = append(f.entries, entry{severity, eid, msg})
+	return f.err
+}
+
+var testServer = &parser.ServerConfig{
+	Protocol: "vless",
+	Name:     "Frankfurt",
+	Address:  "de.example.com",
+	Port:     443,
+	Params:   map[string]string{"uuid": "11111111-2222-3333-4444-555555555555", "pbk": "secret-key"},
+}
+
+func TestTransitionEvents(t *testing.T) {
+	at := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		t            vpn.Transition
+		wantSeverity string
+		wantID       uint32
+		wantText     []string
+	}{
+		{
+			name:         "connected",
+			t:            vpn.Transition{State: vpn.StateConnected, Previous: vpn.StateConnecting, Server: testServer},
+			wantSeverity: "info", wantID: IDConnected,
+			wantText: []string{"Frankfurt (de.example.com:443, vless)"},
+		},
+		{
+			name: "disconnected",
+			t: vpn.Transition{State: vpn.StateDisconnected, Previous: vpn.StateDisconnecting, Reason: vpn.ReasonUser,
+				Duration: 90*time.Minute + 500*time.Millisecond, Server: testServer},
+			wantSeverity: "info", wantID: IDDisconnected,
+			wantText: []string{"Frankfurt", "1h30m1s", "Reason: user"},
+		},
+		{
+			name:         "connect failed",
+			t:            vpn.Transition{State: vpn.StateError, Previous: vpn.StateConnecting, Err: errors.New("handshake timeout"), Server: testServer},
+			wantSeverity: "error", wantID: IDError,
+			wantText: []string{"connect to Frankfurt", "failed", "handshake timeout"},
+		},
+		{
+			name:         "session lost",
+			t:            vpn.Transition{State: vpn.StateError, Previous: vpn.StateConnected, Err: errors.New("tun closed"), Server: testServer},
+			wantSeverity: "error", wantID: IDError,
+			wantText: []string{"was lost", "tun closed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &fakeWriter{}
+			tt.t.At = at
+			NewEmitter(w, func() bool { return true }).Transition(tt.t)
+			if len(w.entries) != 1 {
+				t.Fatalf("got %d events, want 1: %+v", len(w.entries), w.entries)
+			}
+			got := w.entries[0]
+			if got.severity != tt.wantSeverity || got.id != tt.wantID {
+				t.Errorf("got %s %d, want %s %d", got.severity, got.id, tt.wantSeverity, tt.wantID)
+			}
+			for _, s := range tt.wantText {
+				if !strings.Contains(got.msg, s) {
+					t.Errorf("message %q lacks %q", got.msg, s)
+				}
+			}
+			for _, secret := range testServer.Params {
+				if strings.Contains(got.msg, secret) {
+					t.Errorf("message %q contains credential %q", got.msg, secret)
+				}
+			}
+		})
+	}
+}
+
+func TestTransitionsWithoutEvents(t *testing.T) {
+	w := &fakeWriter{}
+	e := NewEmitter(w, func() bool { return true })
+	for _, tr := range []vpn.Transition{
+		{State: vpn.StateConnecting, Previous: vpn.StateDisconnected},
+		{State: vpn.StateDisconnecting, Previous: vpn.StateConnected},
+		// A reconnect's link coming up is reported by Reconnect.
+		{State: vpn.StateConnecting, Previous: vpn.StateConnected, Reason: vpn.ReasonReconnect},
+		{State: vpn.StateConnected, Previous: vpn.StateConnecting, Reason: vpn.ReasonReconnect},
+		// Clearing an error ends no session.
+		{State: vpn.StateDisconnected, Previous: vpn.StateError},
+	} {
+		e.Transition(tr)
+	}
+	if len(w.entries) != 0 {
+		t.Errorf("got %+v, want no events", w.entries)
+	}
+}
+
+func TestKillSwitchAndReconnectEvents(t *testing.T) {
+	w := &fakeWriter{}
+	e := NewEmitter(w, func() bool { return true })
+	e.Transition(vpn.Transition{State: vpn.StateConnected, Previous: vpn.StateConnecting, Server: testServer})
+
+	// The kill switch event names the session's server though its stats
+	// carry none.
+	e.KillSwitchEngaged(vpn.KillSwitchStats{Activations: 1, Engaged: true, BlockedConnections: 4})
+	started := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	e.Reconnect(vpn.Reconnect{Server: testServer, SessionStarted: started, At: started.Add(2 * time.Hour), DownMs: 1800})
+
+	if len(w.entries) != 3 {
+		t.Fatalf("got %+v, want 3 events", w.entries)
+	}
+	ks, rc := w.entries[1], w.entries[2]
+	if ks.severity != "warning" || ks.id != IDKillSwitchEngaged || !strings.Contains(ks.msg, "Frankfurt") || !strings.Contains(ks.msg, "4") {
+		t.Errorf("kill switch event %+v", ks)
+	}
+	if rc.severity != "info" || rc.id != IDReconnect || !strings.Contains(rc.msg, "2s down") || !strings.Contains(rc.msg, "2h0m0s") {
+		t.Errorf("reconnect event %+v", rc)
+	}
+}
+
+func TestDisabledWritesNothing(t *testing.T) {
+	w := &fakeWriter{}
+	enabled := false
+	e := NewEmitter(w, func() bool { return enabled })
+	connected := vpn.Transition{State: vpn.StateConnected, Previous: vpn.StateConnecting, Server: testServer}
+	e.Transition(connected)
+	e.KillSwitchEngaged(vpn.KillSwitchStats{})
+	if len(w.entries) != 0 {
+		t.Fatalf("got %+v while disabled", w.entries)
+	}
+
+	// Turning it on takes effect with the next event.
+	enabled = true
+	e.Transition(connected)
+	if len(w.entries) != 1 {
+		t.Errorf("got %+v once enabled", w.entries)
+	}
+}
+
+func TestWriteErrorIsNotFatal(t *testing.T) {
+	w := &fakeWriter{err: errors.New("log full")}
+	e := NewEmitter(w, func() bool { return true })
+	e.Transition(vpn.Transition{State: vpn.StateConnected, Previous: vpn.StateConnecting})
+	e.Transition(vpn.Transition{State: vpn.StateDisconnected, Previous: vpn.StateDisconnecting})
+	if len(w.entries) != 2 || !strings.Contains(w.entries[0].msg, "the server") {
+		t.Errorf("got %+v", w.entries)
+	}
+}
@@ -0,0 +1,32 @@
+package winevent
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// sourcesKey holds the registered sources of the Application log.
+const sourcesKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+
+// Open opens the event log under source, which service.Install registers.
+// Windows would accept an unregistered source too, but its entries would
+// show without their message text, so that returns ErrNotRegistered.
+func Open(source string) (*eventlog.Log, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, sourcesKey+source, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotRegistered, source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up event source %s: %w", source, err)
+	}
+	k.Close()
+
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %w", err)
+	}
+	return l, nil
+}
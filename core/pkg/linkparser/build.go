@@ -0,0 +1,92 @@
+package linkparser
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// leadingParams come first in a link's query, in this order; the rest
+// follow sorted by key.
+var leadingParams = []string{"type", "security", "sni"}
+
+// Link returns c as a share link that ParseLink reads back into c. The
+// link is canonical: the scheme is vless:// or hysteria2://, the port is
+// always given, params are ordered by leadingParams and then by key, and
+// defaults are left out, as are the transport "tcp", the security "none"
+// and a name equal to the address.
+func (c *ServerConfig) Link() string {
+	var b strings.Builder
+	params := c.Params()
+	switch c.Protocol {
+	case ProtocolVLESS:
+		b.WriteString("vless://")
+		b.WriteString(escapeUserInfo(c.UUID))
+		delete(params, "uuid")
+		if params["type"] == string(TransportTCP) {
+			delete(params, "type")
+		}
+		if params["security"] == string(SecurityNone) {
+			delete(params, "security")
+		}
+	case ProtocolHysteria2:
+		b.WriteString("hysteria2://")
+		b.WriteString(escapeUserInfo(c.Password))
+		delete(params, "password")
+	}
+	b.WriteByte('@')
+	b.WriteString(net.JoinHostPort(c.Address, strconv.Itoa(int(c.Port))))
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := paramRank(keys[i]), paramRank(keys[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+	for i, key := range keys {
+		if i == 0 {
+			b.WriteByte('?')
+		} else {
+			b.WriteByte('&')
+		}
+		b.WriteString(url.QueryEscape(key))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(params[key]))
+	}
+
+	if c.Name != "" && c.Name != c.Address {
+		b.WriteByte('#')
+		b.WriteString(escapeName(c.Name))
+	}
+	return b.String()
+}
+
+// paramRank orders a param by leadingParams, the others after them.
+func paramRank(key string) int {
+	for i, leading := range leadingParams {
+		if key == leading {
+			return i
+		}
+	}
+	return len(leadingParams)
+}
+
+// escapeUserInfo percent-encodes a credential for the user info, where
+// ':' and '@' are delimiters too.
+func escapeUserInfo(s string) string {
+	return strings.NewReplacer(":", "%3A", "@", "%40").Replace(url.PathEscape(s))
+}
+
+// escapeName percent-encodes a name for the fragment. parseURI unescapes
+// the fragment twice, as path and then as query, so '%' and '+', which
+// the second pass would decode, are escaped twice.
+func escapeName(name string) string {
+	return url.PathEscape(strings.NewReplacer("%", "%25", "+", "%2B").Replace(name))
+}
@@ -0,0 +1,124 @@
+package linkparser
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roundTrip checks that cfg's link parses back into cfg, and that the
+// link of the parsed config is the same link.
+func roundTrip(t *testing.T, cfg *ServerConfig) {
+	t.Helper()
+	link := cfg.Link()
+	back, err := ParseLink(link)
+	if err != nil {
+		t.Fatalf("ParseLink(%q): %v", link, err)
+	}
+	if !reflect.DeepEqual(back, cfg) {
+		t.Fatalf("%s\nparsed back %+v\nwant        %+v", link, *back, *cfg)
+	}
+	if again := back.Link(); again != link {
+		t.Errorf("link not stable:\n%s\n%s", link, again)
+	}
+}
+
+// TestLinkRoundTrip runs the links of testdata/links.txt and of
+// testdata/regressions.json that parse through Link and back.
+func TestLinkRoundTrip(t *testing.T) {
+	var links []string
+	f, err := os.Open("testdata/links.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" && !strings.HasPrefix(line, "#") {
+			links = append(links, line)
+		}
+	}
+	data, err := os.ReadFile("testdata/regressions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corpus []struct {
+		Link  string `json:"link"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &corpus); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range corpus {
+		if c.Error == "" {
+			links = append(links, c.Link)
+		}
+	}
+
+	for _, link := range links {
+		cfg, err := ParseLink(link)
+		if err != nil {
+			t.Errorf("ParseLink(%q): %v", link, err)
+			continue
+		}
+		t.Run(cfg.Name, func(t *testing.T) { roundTrip(t, cfg) })
+	}
+}
+
+// TestLinkRoundTripEscaping round-trips credentials, names and params
+// made of the characters links must escape.
+func TestLinkRoundTripEscaping(t *testing.T) {
+	const alphabet = "aZ09-_.~ %+#?&=@:/\\[]!$'()*,;\"<>{}|^`é日🙂\t"
+	runes := []rune(alphabet)
+	rng := rand.New(rand.NewSource(1))
+	random := func() string {
+		b := make([]rune, 1+rng.Intn(12))
+		for i := range b {
+			b[i] = runes[rng.Intn(len(runes))]
+		}
+		return string(b)
+	}
+	for i := 0; i < 500; i++ {
+		cfg := &ServerConfig{Protocol: ProtocolHysteria2, Name: random(), Address: "example.com", Port: uint16(1 + rng.Intn(65535)),
+			Password: random(), SNI: random(), Extra: map[string]string{random(): random(), "obfs-password": random()}}
+		if i%2 == 0 {
+			cfg = &ServerConfig{Protocol: ProtocolVLESS, Name: random(), Address: "2001:db8::1", Port: 443,
+				UUID: random(), Transport: TransportGRPC, Security: SecurityTLS, Extra: map[string]string{"serviceName": random()}}
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, cfg)
+	}
+}
+
+func TestLinkCanonicalForm(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		// Defaults dropped, leading params first and the rest sorted.
+		{"vless://" + testUUID + "@de.example.com?sni=de.example.com&type=tcp&fp=chrome&security=none&alpn=h2#de.example.com",
+			"vless://" + testUUID + "@de.example.com:443?sni=de.example.com&alpn=h2&fp=chrome"},
+		{"vless://" + testUUID + "@de.example.com:443?path=%2Fws&security=tls&type=ws#DE%20Frankfurt",
+			"vless://" + testUUID + "@de.example.com:443?type=ws&security=tls&path=%2Fws#DE%20Frankfurt"},
+		// The hy2 alias becomes hysteria2, IPv6 stays bracketed.
+		{"hy2://p%40ss@[2001:db8::1]:8443?obfs=salamander#A+B", "hysteria2://p%40ss@[2001:db8::1]:8443?obfs=salamander#A%20B"},
+		// Header entries come out as the headers object.
+		{"vless://" + testUUID + "@h.example.com?type=ws&header=X-Token:abc",
+			"vless://" + testUUID + "@h.example.com:443?type=ws&headers=%7B%22X-Token%22%3A%22abc%22%7D"},
+	}
+	for _, tt := range tests {
+		cfg, err := ParseLink(tt.link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cfg.Link(); got != tt.want {
+			t.Errorf("Link() of %s\n= %s\nwant %s", tt.link, got, tt.want)
+		}
+	}
+}
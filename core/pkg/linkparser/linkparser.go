@@ -0,0 +1,155 @@
+// Package linkparser parses VLESS and Hysteria2 share links into server
+// configurations, and builds links back from them.
+//
+// The package follows semantic versioning, reported by Version: within a
+// major version, exported names keep their meaning, and parsing only
+// changes to accept links that were rejected before or to fix behaviour
+// that contradicts the link format.
+package linkparser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Version is the semantic version of the package API.
+const Version = "1.3.0"
+
+// Protocol is the proxy protocol of a link.
+type Protocol string
+
+const (
+	ProtocolVLESS     Protocol = "vless"
+	ProtocolHysteria2 Protocol = "hysteria2"
+)
+
+// Transport is the VLESS transport, the link's "type" param. Values other
+// than the constants below are kept as given.
+type Transport string
+
+const (
+	TransportTCP         Transport = "tcp" // the default
+	TransportWebSocket   Transport = "ws"
+	TransportGRPC        Transport = "grpc"
+	TransportHTTP2       Transport = "h2"
+	TransportHTTP        Transport = "http" // an alias of h2
+	TransportHTTPUpgrade Transport = "httpupgrade"
+	TransportXHTTP       Transport = "xhttp"
+	TransportSplitHTTP   Transport = "splithttp" // the former name of xhttp
+)
+
+// XHTTP upload modes, the "mode" param of an xhttp link.
+const (
+	XHTTPModeAuto     = "auto" // the default
+	XHTTPModePacketUp = "packet-up"
+	XHTTPModeStreamUp = "stream-up"
+)
+
+// Security is the VLESS transport security, the link's "security" param.
+// Values other than the constants below are kept as given.
+type Security string
+
+const (
+	SecurityNone    Security = "none" // the default
+	SecurityTLS     Security = "tls"
+	SecurityReality Security = "reality"
+)
+
+// ServerConfig is a parsed link. The params every link carries have typed
+// fields; all other query params are kept verbatim in Extra.
+//
+// Transport and Security apply to VLESS. Hysteria2 always runs over QUIC
+// with TLS and leaves them empty; a "type" or "security" param on a
+// Hysteria2 link stays in Extra.
+type ServerConfig struct {
+	Protocol Protocol `json:"protocol"`
+	Name     string   `json:"name"`
+	Address  string   `json:"address"`
+	Port     uint16   `json:"port"`
+
+	UUID     string `json:"uuid,omitempty"`     // VLESS user ID
+	Password string `json:"password,omitempty"` // Hysteria2 password
+
+	SNI       string    `json:"sni,omitempty"`
+	Transport Transport `json:"transport,omitempty"`
+	Security  Security  `json:"security,omitempty"`
+
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// ParseLink detects the scheme of a link and parses it.
+func ParseLink(link string) (*ServerConfig, error) {
+	link = strings.TrimSpace(link)
+
+	switch {
+	case strings.HasPrefix(link, "vless://"):
+		return ParseVLESS(link)
+	case strings.HasPrefix(link, "hysteria2://"), strings.HasPrefix(link, "hy2://"):
+		return ParseHysteria2(link)
+	default:
+		return nil, fmt.Errorf("unsupported link scheme: %s", link[:min(20, len(link))])
+	}
+}
+
+// FromParams builds a config from the flat param map used by share links,
+// where the credential is the "uuid" or "password" param. Defaults are
+// applied and the result validated as if it had been parsed from a link.
+func FromParams(protocol Protocol, name, address string, port uint16, params map[string]string) (*ServerConfig, error) {
+	switch protocol {
+	case ProtocolVLESS, ProtocolHysteria2:
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %q", protocol)
+	}
+
+	extra := make(map[string]string, len(params))
+	for key, value := range params {
+		extra[key] = value
+	}
+	cfg := &ServerConfig{Protocol: protocol, Name: name, Address: address, Port: port}
+	take := func(key string) string {
+		value := extra[key]
+		delete(extra, key)
+		return value
+	}
+	switch protocol {
+	case ProtocolVLESS:
+		cfg.UUID = take("uuid")
+		cfg.Transport = Transport(take("type"))
+		cfg.Security = Security(take("security"))
+	case ProtocolHysteria2:
+		cfg.Password = take("password")
+	}
+	cfg.SNI = take("sni")
+	if len(extra) > 0 {
+		cfg.Extra = extra
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Params returns the config as the flat param map FromParams accepts.
+// Empty typed fields are left out.
+func (c *ServerConfig) Params() map[string]string {
+	params := make(map[string]string, len(c.Extra)+4)
+	for key, value := range c.Extra {
+		params[key] = value
+	}
+	set := func(key, value string) {
+		if value != "" {
+			params[key] = value
+		}
+	}
+	switch c.Protocol {
+	case ProtocolVLESS:
+		set("uuid", c.UUID)
+		set("type", string(c.Transport))
+		set("security", string(c.Security))
+	case ProtocolHysteria2:
+		set("password", c.Password)
+	}
+	set("sni", c.SNI)
+	return params
+}
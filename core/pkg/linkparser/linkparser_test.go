@@ -0,0 +1,300 @@
+package linkparser
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want ServerConfig
+	}{
+		{
+			name: "vless reality",
+			link: "vless://" + testUUID + "@de.example.com:8443?security=reality&sni=www.google.com&pbk=SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&sid=ab&fp=chrome&flow=xtls-rprx-vision#DE%20Frankfurt",
+			want: ServerConfig{
+				Protocol: ProtocolVLESS, Name: "DE Frankfurt", Address: "de.example.com", Port: 8443,
+				UUID: testUUID, SNI: "www.google.com", Transport: TransportTCP, Security: SecurityReality,
+				Extra: map[string]string{"pbk": "SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc", "sid": "ab", "fp": "chrome", "flow": "xtls-rprx-vision"},
+			},
+		},
+		{
+			name: "vless ws defaults",
+			link: "  vless://" + testUUID + "@1.2.3.4?type=ws&path=%2Fws%3Fed%3D2048  ",
+			want: ServerConfig{
+				Protocol: ProtocolVLESS, Name: "1.2.3.4", Address: "1.2.3.4", Port: 443,
+				UUID: testUUID, Transport: TransportWebSocket, Security: SecurityNone,
+				Extra: map[string]string{"path": "/ws?ed=2048"},
+			},
+		},
+		{
+			name: "vless ws repeated header entries",
+			link: "vless://" + testUUID + "@cdn.example.com?type=ws&security=tls&host=cdn.example.com&header=User-Agent%3A%20Mozilla%2F5.0&header=X-Token:abc#CDN",
+			want: ServerConfig{
+				Protocol: ProtocolVLESS, Name: "CDN", Address: "cdn.example.com", Port: 443,
+				UUID: testUUID, Transport: TransportWebSocket, Security: SecurityTLS,
+				Extra: map[string]string{"host": "cdn.example.com", "headers": `{"User-Agent":"Mozilla/5.0","X-Token":"abc"}`},
+			},
+		},
+		{
+			name: "vless xhttp",
+			link: "vless://" + testUUID + "@cdn.example.com:443?type=xhttp&security=tls&path=%2Fxh&host=cdn.example.com&mode=stream-up#X",
+			want: ServerConfig{
+				Protocol: ProtocolVLESS, Name: "X", Address: "cdn.example.com", Port: 443,
+				UUID: testUUID, Transport: TransportXHTTP, Security: SecurityTLS,
+				Extra: map[string]string{"path": "/xh", "host": "cdn.example.com", "mode": "stream-up"},
+			},
+		},
+		{
+			name: "vless unknown transport kept",
+			link: "vless://" + testUUID + "@example.com:443?type=meek&security=tls#X",
+			want: ServerConfig{
+				Protocol: ProtocolVLESS, Name: "X", Address: "example.com", Port: 443,
+				UUID: testUUID, Transport: "meek", Security: SecurityTLS,
+			},
+		},
+		{
+			name: "hysteria2",
+			link: "hysteria2://secret@fi.example.com:443?sni=cdn.example.com&obfs=salamander&obfs-password=p#FI",
+			want: ServerConfig{
+				Protocol: ProtocolHysteria2, Name: "FI", Address: "fi.example.com", Port: 443,
+				Password: "secret", SNI: "cdn.example.com",
+				Extra: map[string]string{"obfs": "salamander", "obfs-password": "p"},
+			},
+		},
+		{
+			name: "hy2 alias keeps vless-only params in extra",
+			link: "hy2://secret@[2001:db8::1]:8443?security=tls",
+			want: ServerConfig{
+				Protocol: ProtocolHysteria2, Name: "2001:db8::1", Address: "2001:db8::1", Port: 8443,
+				Password: "secret", Extra: map[string]string{"security": "tls"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLink(tt.link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLinkErrors(t *testing.T) {
+	for link, want := range map[string]string{
+		"vmess://abc":                                                               "unsupported link scheme",
+		"vless://@example.com:443":                                                  "missing UUID",
+		"vless://" + testUUID + "@:443":                                             "missing host",
+		"vless://" + testUUID + "@host:99999":                                       "invalid port",
+		"hy2://@example.com:443":                                                    "missing password",
+		"hysteria2://p@example.com:0":                                               "invalid port",
+		"vless://" + testUUID + "@h?type=ws&ed=x":                                   "early data",
+		"vless://" + testUUID + "@h?type=ws&header=NoColon":                         "must be name:value",
+		"vless://" + testUUID + "@h?type=ws&header=X-A:1&header=X-A:2":              "duplicate header",
+		"vless://" + testUUID + "@h?type=ws&headers=%7B%22Bad%20Name%22:%22v%22%7D": "invalid header name",
+		"vless://" + testUUID + "@h?type=xhttp&mode=stream-down":                    "invalid xhttp mode",
+		"vless://" + testUUID + "@h?type=splithttp&mode=packet":                     "invalid xhttp mode",
+		"vless://" + testUUID + "@h?uuid=9b2c7a1e-4a5f-4d1b-8c3e-2f6a7b8c9d0e":      "uuid param that differs from its user info",
+		"hy2://p@example.com:443?password=other":                                    "password param that differs from its user info",
+	} {
+		if _, err := ParseLink(link); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseLink(%q) = %v, want error containing %q", link, err, want)
+		}
+	}
+	// A credential param repeating the user info is harmless.
+	if cfg, err := ParseLink("hy2://p@example.com:443?password=p"); err != nil || cfg.Password != "p" {
+		t.Errorf("repeated password: %+v, %v", cfg, err)
+	}
+	if _, err := ParseVLESS("hy2://p@example.com"); err == nil {
+		t.Error("ParseVLESS accepted a Hysteria2 link")
+	}
+	if _, err := ParseHysteria2("vless://" + testUUID + "@example.com"); err == nil {
+		t.Error("ParseHysteria2 accepted a VLESS link")
+	}
+}
+
+// TestParseLinkRegressions runs the malformed links collected from user
+// reports in testdata/regressions.json. Each entry expects either an error
+// containing "error" or the given credential, host and port.
+func TestParseLinkRegressions(t *testing.T) {
+	data, err := os.ReadFile("testdata/regressions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corpus []struct {
+		Note       string `json:"note"`
+		Link       string `json:"link"`
+		Credential string `json:"credential"`
+		Host       string `json:"host"`
+		Port       uint16 `json:"port"`
+		Error      string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &corpus); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range corpus {
+		t.Run(c.Note, func(t *testing.T) {
+			cfg, err := ParseLink(c.Link)
+			if c.Error != "" {
+				if err == nil || !strings.Contains(err.Error(), c.Error) {
+					t.Fatalf("ParseLink(%q) error = %v, want containing %q", c.Link, err, c.Error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLink(%q): %v", c.Link, err)
+			}
+			credential := cfg.UUID
+			if cfg.Protocol == ProtocolHysteria2 {
+				credential = cfg.Password
+			}
+			if credential != c.Credential || cfg.Address != c.Host || cfg.Port != c.Port {
+				t.Errorf("got credential %q, host %q, port %d; want %q, %q, %d",
+					credential, cfg.Address, cfg.Port, c.Credential, c.Host, c.Port)
+			}
+		})
+	}
+}
+
+// TestParamsRoundTrip checks that the flat param form, which callers store,
+// survives FromParams and Params unchanged.
+func TestParamsRoundTrip(t *testing.T) {
+	params := map[string]string{
+		"uuid": testUUID, "type": "grpc", "security": "tls", "sni": "example.com",
+		"serviceName": "svc", "alpn": "h2", "fp": "chrome",
+	}
+	cfg, err := FromParams(ProtocolVLESS, "", "example.com", 443, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Transport != TransportGRPC || cfg.Security != SecurityTLS || cfg.Name != "example.com" {
+		t.Errorf("typed fields = %+v", cfg)
+	}
+	if got := cfg.Params(); !reflect.DeepEqual(got, params) {
+		t.Errorf("Params() = %v, want %v", got, params)
+	}
+	params["extra"] = "changed"
+	if _, ok := cfg.Extra["extra"]; ok {
+		t.Error("FromParams kept a reference to the caller's map")
+	}
+
+	// Defaults are filled in.
+	cfg, err = FromParams(ProtocolVLESS, "n", "example.com", 443, map[string]string{"uuid": testUUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := cfg.Params(); p["type"] != "tcp" || p["security"] != "none" {
+		t.Errorf("defaults not applied: %v", p)
+	}
+
+	if _, err := FromParams("vmess", "", "example.com", 443, nil); err == nil || !strings.Contains(err.Error(), "unsupported protocol") {
+		t.Errorf("unknown protocol: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ServerConfig
+		wantErr string
+	}{
+		{"vless ok", ServerConfig{Protocol: ProtocolVLESS, Address: "example.com", Port: 443, UUID: testUUID}, ""},
+		{"hysteria2 ok", ServerConfig{Protocol: ProtocolHysteria2, Address: "1.2.3.4", Port: 8443, Password: "p"}, ""},
+		{"host with scheme", ServerConfig{Protocol: ProtocolVLESS, Address: "https://example.com", Port: 443, UUID: "u"}, "invalid host"},
+		{"zero port", ServerConfig{Protocol: ProtocolHysteria2, Address: "example.com", Password: "p"}, "invalid port"},
+		{"ws early data too large", ServerConfig{Protocol: ProtocolVLESS, Address: "example.com", Port: 443, UUID: "u",
+			Transport: TransportWebSocket, Extra: map[string]string{"ed": "100000"}}, "early data"},
+		{"ws bad early data header", ServerConfig{Protocol: ProtocolVLESS, Address: "example.com", Port: 443, UUID: "u",
+			Transport: TransportWebSocket, Extra: map[string]string{"ed": "2048", "eh": "X Bad"}}, "invalid header name"},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseEarlyData(t *testing.T) {
+	tests := []struct {
+		path, ed, eh string
+		want         EarlyData
+	}{
+		{"/ws", "", "", EarlyData{"/ws", 0, DefaultEarlyDataHeader}},
+		{"/ws", "2048", "", EarlyData{"/ws", 2048, DefaultEarlyDataHeader}},
+		{"/ws?ed=2560", "", "", EarlyData{"/ws", 2560, DefaultEarlyDataHeader}},
+		{"/ws?ed=2560", "1024", "X-Early", EarlyData{"/ws", 1024, "X-Early"}},
+		{"/ws?token=abc", "", "", EarlyData{"/ws?token=abc", 0, DefaultEarlyDataHeader}},
+		{"/ws", "lots", "", EarlyData{"/ws", -1, DefaultEarlyDataHeader}},
+	}
+	for _, tt := range tests {
+		if got := ParseEarlyData(tt.path, tt.ed, tt.eh); got != tt.want {
+			t.Errorf("ParseEarlyData(%q, %q, %q) = %+v, want %+v", tt.path, tt.ed, tt.eh, got, tt.want)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		raw, host string
+		want      map[string]string
+		wantErr   string
+	}{
+		{"", "", nil, ""},
+		{`{"User-Agent":"Mozilla/5.0 (Windows NT 10.0; Win64; x64)","X-Auth_Token.v2":"k"}`, "", map[string]string{
+			"User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64)", "X-Auth_Token.v2": "k",
+		}, ""},
+		{`{"Host":"CDN.example.com"}`, "cdn.example.com", map[string]string{"Host": "CDN.example.com"}, ""},
+		{`{"Host":"other.example.com"}`, "", map[string]string{"Host": "other.example.com"}, ""},
+		{`{"Host":"other.example.com"}`, "cdn.example.com", nil, "conflicts with host param"},
+		{`["User-Agent"]`, "", nil, "JSON object"},
+		{`{"User Agent":"x"}`, "", nil, "invalid header name"},
+		{`{"X-A":"1","x-a":"2"}`, "", nil, "duplicate header"},
+		{`{"Upgrade":"h2c"}`, "", nil, "WebSocket handshake"},
+		{`{"X-A":"a\r\nX-Injected: 1"}`, "", nil, "invalid value"},
+		{`{"X-A":"` + strings.Repeat("v", maxWSHeaderValue+1) + `"}`, "", nil, "invalid value"},
+	}
+	for _, tt := range tests {
+		got, err := ParseHeaders(tt.raw, tt.host)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseHeaders(%.40q) error = %v, want containing %q", tt.raw, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseHeaders(%.40q) = %v, %v; want %v", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestShortIDs(t *testing.T) {
+	for sid, want := range map[string][]string{
+		"":                 {""},
+		"ab12":             {"ab12"},
+		"ab12,cd34":        {"ab12", "cd34"},
+		" ab12 , cd34,":    {"ab12", "cd34", ""},
+		"6ba85179e30d4fc2": {"6ba85179e30d4fc2"},
+	} {
+		if got := ShortIDs(sid); !reflect.DeepEqual(got, want) {
+			t.Errorf("ShortIDs(%q) = %q, want %q", sid, got, want)
+		}
+	}
+}
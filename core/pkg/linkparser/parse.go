@@ -0,0 +1,137 @@
+package linkparser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ParseVLESS parses a VLESS link.
+// Format: vless://uuid@host:port?params#name
+func ParseVLESS(link string) (*ServerConfig, error) {
+	if !strings.HasPrefix(link, "vless://") {
+		return nil, fmt.Errorf("not a VLESS link")
+	}
+	return parseURI(ProtocolVLESS, "VLESS", "uuid", link[len("vless://"):])
+}
+
+// ParseHysteria2 parses a Hysteria2 link.
+// Format: hysteria2://password@host:port?params#name
+// Also supports: hy2://password@host:port?params#name
+func ParseHysteria2(link string) (*ServerConfig, error) {
+	rest, ok := strings.CutPrefix(link, "hysteria2://")
+	if !ok {
+		if rest, ok = strings.CutPrefix(link, "hy2://"); !ok {
+			return nil, fmt.Errorf("not a Hysteria2 link")
+		}
+	}
+	return parseURI(ProtocolHysteria2, "Hysteria2", "password", rest)
+}
+
+// parseURI parses the part of a link after the scheme. The user info is
+// stored as the credential param, the fragment is the name and the port
+// defaults to 443. A credential param in the query must match the user
+// info.
+//
+// The authority is split by hand rather than with url.Parse, which takes a
+// colon in the user info as a password separator and reads a link without
+// '@' as a bare host. The user info runs up to the last '@', so a raw '@'
+// in a Hysteria2 password survives, and is percent-decoded.
+func parseURI(protocol Protocol, label, credential, rest string) (*ServerConfig, error) {
+	rest, fragment, _ := strings.Cut(rest, "#")
+	rest, query, _ := strings.Cut(rest, "?")
+	authority, _, _ := strings.Cut(rest, "/") // a path, as in host:port/?params, is ignored
+
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return nil, fmt.Errorf("%s link missing user info", label)
+	}
+	rawUser, hostPort := authority[:at], authority[at+1:]
+	if protocol == ProtocolVLESS && strings.Contains(rawUser, ":") {
+		return nil, fmt.Errorf("VLESS does not use passwords: user info must be only the UUID")
+	}
+	user, err := url.PathUnescape(rawUser)
+	if err != nil {
+		return nil, fmt.Errorf("%s link has invalid user info: %w", label, err)
+	}
+
+	u, err := url.Parse("https://" + hostPort)
+	if err != nil || u.User != nil {
+		return nil, fmt.Errorf("failed to parse %s host %q", label, hostPort)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("%s link missing host", label)
+	}
+
+	portStr := u.Port()
+	if portStr == "" {
+		portStr = "443"
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	name := host
+	if fragment != "" {
+		if name, err = url.PathUnescape(fragment); err != nil {
+			name = fragment
+		}
+	}
+	name, _ = url.QueryUnescape(name)
+
+	params := make(map[string]string)
+	params[credential] = user
+	values, _ := url.ParseQuery(query) // malformed pairs are skipped
+	// The user info is the credential; a param of the same name may only
+	// repeat it, never override it.
+	for _, v := range values[credential] {
+		if v != user {
+			return nil, fmt.Errorf("%s link has a %s param that differs from its user info", label, credential)
+		}
+	}
+	delete(values, credential)
+	for key, v := range values {
+		if len(v) > 0 {
+			params[key] = v[0]
+		}
+	}
+	if entries := values["header"]; protocol == ProtocolVLESS && len(entries) > 0 {
+		if err := foldHeaderEntries(params, entries); err != nil {
+			return nil, err
+		}
+	}
+	return FromParams(protocol, name, host, uint16(port), params)
+}
+
+// foldHeaderEntries merges header params, repeated "Name: value" entries
+// some providers use instead of a headers object, into the headers param.
+func foldHeaderEntries(params map[string]string, entries []string) error {
+	headers := make(map[string]string)
+	if raw := params["headers"]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+			return fmt.Errorf("invalid headers param: must be a JSON object of strings")
+		}
+	}
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("invalid header param %q: must be name:value", entry)
+		}
+		if _, dup := headers[name]; dup {
+			return fmt.Errorf("duplicate header: %q", name)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	params["headers"] = string(data)
+	delete(params, "header")
+	return nil
+}
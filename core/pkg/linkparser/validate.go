@@ -0,0 +1,267 @@
+package linkparser
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MaxWSEarlyData caps WebSocket early data. Larger values overflow the
+// header size limits of common reverse proxies.
+const MaxWSEarlyData = 8192
+
+// DefaultEarlyDataHeader is the header Xray-compatible servers read
+// WebSocket early data from.
+const DefaultEarlyDataHeader = "Sec-WebSocket-Protocol"
+
+// Validate checks a config against the rules the link parsers apply, so a
+// config built by hand is held to the same standard as a parsed link.
+// Missing VLESS defaults (TCP transport, no security) are filled in and an
+// empty name falls back to the address.
+func (c *ServerConfig) Validate() error {
+	switch c.Protocol {
+	case ProtocolVLESS:
+		if c.Transport == "" {
+			c.Transport = TransportTCP
+		}
+		if c.Security == "" {
+			c.Security = SecurityNone
+		}
+		if c.UUID == "" {
+			return fmt.Errorf("VLESS link missing UUID")
+		}
+		if c.Transport == TransportWebSocket {
+			ed := c.WebSocketEarlyData()
+			if ed.MaxSize < 0 || ed.MaxSize > MaxWSEarlyData {
+				return fmt.Errorf("early data must be between 0 and %d bytes", MaxWSEarlyData)
+			}
+			if err := ValidateHeaderName(ed.Header); err != nil {
+				return err
+			}
+			if _, err := c.WebSocketHeaders(); err != nil {
+				return err
+			}
+		}
+		if c.Transport == TransportXHTTP || c.Transport == TransportSplitHTTP {
+			switch mode := c.Extra["mode"]; mode {
+			case "", XHTTPModeAuto, XHTTPModePacketUp, XHTTPModeStreamUp:
+			default:
+				return fmt.Errorf("invalid xhttp mode %q: must be %s, %s or %s", mode, XHTTPModeAuto, XHTTPModePacketUp, XHTTPModeStreamUp)
+			}
+		}
+		if c.Security == SecurityReality {
+			if err := validateReality(c.Extra); err != nil {
+				return err
+			}
+		}
+	case ProtocolHysteria2:
+		if c.Password == "" {
+			return fmt.Errorf("Hysteria2 link missing password")
+		}
+	default:
+		return fmt.Errorf("unsupported protocol: %q", c.Protocol)
+	}
+
+	if err := validateHost(c.Address); err != nil {
+		return err
+	}
+	if c.Port == 0 {
+		return fmt.Errorf("invalid port: 0")
+	}
+	if c.Name == "" {
+		c.Name = c.Address
+	}
+	return nil
+}
+
+// REALITY public keys are X25519 keys, 32 bytes in unpadded base64url.
+// Short IDs are hex, up to 8 bytes.
+const (
+	realityPublicKeyLen  = 43
+	maxRealityShortIDLen = 16
+)
+
+// validateReality checks the pbk and sid params of a REALITY link. The
+// public key is required; an empty short ID is valid and distinct from a
+// missing one.
+func validateReality(extra map[string]string) error {
+	pbk, ok := extra["pbk"]
+	if !ok || pbk == "" {
+		return fmt.Errorf("REALITY link missing pbk (public key)")
+	}
+	if key, err := base64.RawURLEncoding.DecodeString(pbk); err != nil || len(pbk) != realityPublicKeyLen || len(key) != 32 {
+		return fmt.Errorf("invalid pbk (REALITY public key) %q: must be %d base64url characters", pbk, realityPublicKeyLen)
+	}
+	if sid, ok := extra["sid"]; ok {
+		for _, id := range ShortIDs(sid) {
+			if err := validateShortID(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateShortID(id string) error {
+	if len(id) > maxRealityShortIDLen || len(id)%2 != 0 {
+		return fmt.Errorf("invalid sid (REALITY short ID) %q: must be an even number of hex digits, at most %d", id, maxRealityShortIDLen)
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return fmt.Errorf("invalid sid (REALITY short ID) %q: not hex", id)
+		}
+	}
+	return nil
+}
+
+// ShortIDs splits a REALITY sid param. Servers that rotate short IDs
+// publish links with all of them comma-separated ("ab12,cd34"); any one
+// authenticates and clients use the first. An empty sid is a single empty
+// short ID, which REALITY accepts.
+func ShortIDs(sid string) []string {
+	ids := strings.Split(sid, ",")
+	for i := range ids {
+		ids[i] = strings.TrimSpace(ids[i])
+	}
+	return ids
+}
+
+// validateHost checks that a server address is present and is a bare host
+// (no scheme, path or port).
+func validateHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if strings.ContainsAny(host, "/@ ") {
+		return fmt.Errorf("invalid host: %q", host)
+	}
+	return nil
+}
+
+// ValidateHeaderName checks that name is a plausible HTTP header name.
+func ValidateHeaderName(name string) error {
+	if name == "" || len(name) > 64 {
+		return fmt.Errorf("invalid header name: %q", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("invalid header name: %q", name)
+		}
+	}
+	return nil
+}
+
+// EarlyData is the WebSocket early-data setting of a link.
+type EarlyData struct {
+	Path    string // the WebSocket path, with an embedded ed param removed
+	MaxSize int    // 0 if disabled, negative if the link's value is not a number
+	Header  string // header the early data is sent in
+}
+
+// WebSocketEarlyData returns the early-data setting of a WebSocket link.
+func (c *ServerConfig) WebSocketEarlyData() EarlyData {
+	return ParseEarlyData(c.Extra["path"], c.Extra["ed"], c.Extra["eh"])
+}
+
+// ParseEarlyData reads WebSocket early data from the path, ed and eh link
+// params. Xray links often carry it inside the path ("/ws?ed=2048") rather
+// than as a separate ed param; a separate ed wins when both are present.
+func ParseEarlyData(path, ed, eh string) EarlyData {
+	if i := strings.Index(path, "?"); i >= 0 {
+		if q, err := url.ParseQuery(path[i+1:]); err == nil && q.Get("ed") != "" {
+			if ed == "" {
+				ed = q.Get("ed")
+			}
+			path = path[:i]
+		}
+	}
+	out := EarlyData{Path: path, Header: eh}
+	if ed != "" {
+		n, err := strconv.Atoi(ed)
+		if err != nil {
+			n = -1 // rejected by Validate
+		}
+		out.MaxSize = n
+	}
+	if out.Header == "" {
+		out.Header = DefaultEarlyDataHeader
+	}
+	return out
+}
+
+// Limits of the custom WebSocket headers of a link.
+const (
+	maxWSHeaders     = 16
+	maxWSHeaderValue = 1024
+)
+
+// wsHandshakeHeaders are written by the WebSocket handshake itself and
+// cannot be set by a link.
+var wsHandshakeHeaders = map[string]bool{
+	"connection":               true,
+	"upgrade":                  true,
+	"sec-websocket-key":        true,
+	"sec-websocket-version":    true,
+	"sec-websocket-extensions": true,
+}
+
+// WebSocketHeaders returns the headers a WebSocket link sends with the
+// handshake besides Host, from its headers param; nil if it has none.
+func (c *ServerConfig) WebSocketHeaders() (map[string]string, error) {
+	return ParseHeaders(c.Extra["headers"], c.Extra["host"])
+}
+
+// ParseHeaders reads a headers param, a JSON object of header names to
+// values, as CDN-fronted providers document it ({"User-Agent":"..."}).
+// Names must be HTTP tokens (RFC 9110) and appear once, whatever their
+// case; values must fit on one line. A Host header must agree with host,
+// the link's host param, when that is set.
+func ParseHeaders(raw, host string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		return nil, fmt.Errorf("invalid headers param: must be a JSON object of strings")
+	}
+	if len(headers) > maxWSHeaders {
+		return nil, fmt.Errorf("too many headers: %d, at most %d", len(headers), maxWSHeaders)
+	}
+	seen := make(map[string]bool, len(headers))
+	for name, value := range headers {
+		if !isToken(name) {
+			return nil, fmt.Errorf("invalid header name: %q", name)
+		}
+		lower := strings.ToLower(name)
+		if seen[lower] {
+			return nil, fmt.Errorf("duplicate header: %q", name)
+		}
+		seen[lower] = true
+		if wsHandshakeHeaders[lower] {
+			return nil, fmt.Errorf("header %q is set by the WebSocket handshake", name)
+		}
+		if len(value) > maxWSHeaderValue || strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid value of header %q", name)
+		}
+		if lower == "host" && host != "" && !strings.EqualFold(value, host) {
+			return nil, fmt.Errorf("Host header %q conflicts with host param %q", value, host)
+		}
+	}
+	return headers, nil
+}
+
+// isToken reports whether s is an HTTP token, the syntax of header names.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}